@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os/user"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func getDefaultAcmeCacheDir() string {
+	_user, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(_user.HomeDir, ".dms", "acme")
+}
+
+// Opens the listener for the web UI. If ACME hosts are configured, it serves TLS with certificates
+// obtained and renewed from Let's Encrypt using the TLS-ALPN-01 challenge, which requires the
+// listener to be reachable on port 443 of those hosts.
+func (config *dmsConfig) adminListener() (net.Listener, error) {
+	ln, err := net.Listen("tcp", config.AdminHttp)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.AcmeHosts) == 0 {
+		return ln, nil
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(config.AcmeHosts...),
+		Cache:      autocert.DirCache(config.AcmeCacheDir),
+		Email:      config.AcmeEmail,
+	}
+	return tls.NewListener(ln, m.TLSConfig()), nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/anacrolix/dms/ssdp"
+	"golang.org/x/net/ipv4"
+)
+
+// How long to wait for the multicast and HTTP checks on each interface.
+const checkTimeout = 2 * time.Second
+
+// Prints the results of the checks of -check, with what to do about each problem.
+type checker struct {
+	out      io.Writer
+	problems int
+}
+
+func (me *checker) ok(format string, a ...interface{}) {
+	fmt.Fprintf(me.out, "ok    %s\n", fmt.Sprintf(format, a...))
+}
+
+// Reports a problem that stops devices seeing or playing from dms, and what to do about it.
+func (me *checker) fail(advice, format string, a ...interface{}) {
+	me.problems++
+	fmt.Fprintf(me.out, "FAIL  %s\n      %s\n", fmt.Sprintf(format, a...), advice)
+}
+
+// Reports something that may be a problem, but that dms works without.
+func (me *checker) warn(advice, format string, a ...interface{}) {
+	fmt.Fprintf(me.out, "warn  %s\n      %s\n", fmt.Sprintf(format, a...), advice)
+}
+
+// Checks what most often stops TVs seeing dms or playing from it, printing what to do about each
+// problem found: the config, the shared paths, ffmpeg and ffprobe, and multicast and the HTTP port
+// on each interface. configErr is the error loading the config, if any, and config is nil if it
+// couldn't be loaded at all. It returns an error if there were any problems.
+func runChecks(out io.Writer, config *dmsConfig, configErr error) error {
+	c := &checker{out: out}
+	if configErr != nil {
+		c.fail("Fix the config file or the flags, as the error says.", "config: %v", configErr)
+	} else {
+		c.ok("config")
+	}
+	if config != nil {
+		c.checkPaths(config)
+		c.checkTools(config)
+		c.checkInterfaces(config)
+	}
+	if c.problems != 0 {
+		return fmt.Errorf("problems found: %d", c.problems)
+	}
+	fmt.Fprintln(out, "No problems found. A firewall on this host or the network can still block devices: it must allow TCP to the HTTP port and UDP port 1900.")
+	return nil
+}
+
+func (me *checker) checkPaths(config *dmsConfig) {
+	paths := []string{config.Path}
+	if len(config.Paths) != 0 {
+		paths = nil
+		for _, rd := range config.Paths {
+			paths = append(paths, rd.Path)
+		}
+	}
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err == nil {
+			_, err = f.Readdirnames(1)
+			f.Close()
+			if err == io.EOF {
+				me.warn("Devices will see nothing in it. Check it's the directory meant to be shared.", "shared path %q is empty", p)
+				continue
+			}
+		}
+		if err != nil {
+			advice := "Check that it exists, and that the user dms runs as can read it."
+			if config.User != "" {
+				advice = fmt.Sprintf("Check that it exists, and that user %q given by -user can read it.", config.User)
+			}
+			me.fail(advice, "shared path %q: %v", p, err)
+			continue
+		}
+		me.ok("shared path %q", p)
+	}
+}
+
+func (me *checker) checkTools(config *dmsConfig) {
+	for _, t := range []struct {
+		name, need string
+		disabled   bool
+		flag       string
+	}{
+		{"ffprobe", "durations, resolutions and other details of media", config.NoProbe, "-noProbe"},
+		{"ffmpeg", "transcoding and thumbnails", config.NoTranscode, "-noTranscode"},
+	} {
+		if t.disabled {
+			me.ok("%s isn't needed with %s", t.name, t.flag)
+			continue
+		}
+		p, err := exec.LookPath(t.name)
+		if err == nil {
+			err = exec.Command(p, "-version").Run()
+		}
+		if err != nil {
+			me.warn(fmt.Sprintf("It's used for %s. Install ffmpeg, which has both, in the PATH, or give %s.", t.need, t.flag), "%s: %v", t.name, err)
+			continue
+		}
+		me.ok("%s is %s", t.name, p)
+	}
+}
+
+func (me *checker) checkInterfaces(config *dmsConfig) {
+	patterns := config.IfNames
+	if config.IfName != "" {
+		patterns = append([]string{config.IfName}, patterns...)
+	}
+	ifs, err := selectInterfaces(patterns)
+	if err != nil {
+		me.fail("Give the name of an interface that's listed by ip link, ifconfig or ipconfig to -ifname.", "interfaces: %v", err)
+		return
+	}
+	port, stop, err := me.listenHTTP(config.Http)
+	if err != nil {
+		return
+	}
+	defer stop()
+	up := 0
+	for _, ifi := range ifs {
+		// Those aren't announced on.
+		if ifi.Flags&(net.FlagLoopback|net.FlagPointToPoint) != 0 {
+			continue
+		}
+		ips := interfaceIPv4s(ifi)
+		if ifi.Flags&net.FlagUp == 0 || len(ips) == 0 {
+			me.warn("Devices can't see dms on it until it's up with an address. Connect it, or choose another with -ifname.", "interface %s is down or has no IPv4 address", ifi.Name)
+			continue
+		}
+		up++
+		if ifi.Flags&net.FlagMulticast == 0 {
+			me.fail("Devices find dms by multicast. Choose another interface with -ifname.", "interface %s doesn't support multicast", ifi.Name)
+			continue
+		}
+		if err := checkMulticast(ifi); err != nil {
+			me.fail("Devices won't find dms on it. Check that multicast isn't disabled or blocked for it, such as by a firewall dropping UDP port 1900, or by a VPN.", "interface %s can't send and receive SSDP multicast: %v", ifi.Name, err)
+		} else {
+			me.ok("interface %s sends and receives SSDP multicast", ifi.Name)
+		}
+		for _, ip := range ips {
+			addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+			if err := checkHTTP(addr); err != nil {
+				me.fail(fmt.Sprintf("Devices will find dms but not be able to browse it. Listen on all addresses, such as with -http :%d.", port), "http://%s advertised on %s isn't reachable: %v", addr, ifi.Name, err)
+				continue
+			}
+			me.ok("http://%s advertised on %s is reachable from this host", addr, ifi.Name)
+		}
+	}
+	if up == 0 {
+		me.fail("Devices on the network can't see dms. Connect to the network, or choose an interface that is with -ifname.", "no interface is up with an IPv4 address")
+	}
+}
+
+// Listens on the HTTP address for checkHTTP, returning its port. If it's in use, such as by dms
+// already running, that's checked instead.
+func (me *checker) listenHTTP(addr string) (port int, stop func(), err error) {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		me.fail("Give -http as host:port, such as :1338.", "HTTP address %q: %v", addr, err)
+		return
+	}
+	l, err := net.Listen("tcp", addr)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		me.warn("If that isn't dms already running, stop what's using it, or give dms another port with -http.", "HTTP address %s is in use, checking what's listening on it", addr)
+		port, err = strconv.Atoi(portStr)
+		return port, func() {}, err
+	}
+	if err != nil {
+		me.fail("Give -http a port that's free, and one above 1023 unless dms is started as root.", "can't listen on HTTP address %s: %v", addr, err)
+		return
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	me.ok("listening on HTTP address %s", addr)
+	return l.Addr().(*net.TCPAddr).Port, func() { l.Close() }, nil
+}
+
+func interfaceIPv4s(ifi net.Interface) (ret []net.IP) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+			ret = append(ret, ipn.IP.To4())
+		}
+	}
+	return
+}
+
+// Joins the SSDP multicast group on the interface, and checks a message sent to it out of the
+// interface comes back.
+func checkMulticast(ifi net.Interface) error {
+	l, err := net.ListenMulticastUDP("udp4", &ifi, ssdp.NetAddr)
+	if err != nil {
+		return fmt.Errorf("joining group: %w", err)
+	}
+	defer l.Close()
+	s, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	p := ipv4.NewPacketConn(s)
+	if err := p.SetMulticastInterface(&ifi); err != nil {
+		return err
+	}
+	if err := p.SetMulticastLoopback(true); err != nil {
+		return err
+	}
+	msg := []byte(fmt.Sprintf("dms -check %d %d", os.Getpid(), time.Now().UnixNano()))
+	if _, err := s.WriteTo(msg, ssdp.NetAddr); err != nil {
+		return fmt.Errorf("sending: %w", err)
+	}
+	l.SetReadDeadline(time.Now().Add(checkTimeout))
+	b := make([]byte, 65536)
+	for {
+		n, _, err := l.ReadFrom(b)
+		if err != nil {
+			return fmt.Errorf("receiving: %w", err)
+		}
+		// Other devices' SSDP messages arrive too.
+		if bytes.Equal(b[:n], msg) {
+			return nil
+		}
+	}
+}
+
+func checkHTTP(addr string) error {
+	c, err := net.DialTimeout("tcp", addr, checkTimeout)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
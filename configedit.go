@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/dlna/dms"
+)
+
+// Changes settings from the web UI in the config file, and reloads it as on SIGHUP.
+type configEditor struct {
+	mu   sync.Mutex
+	path string
+	// What the flags gave, which the config file overrides.
+	flagConfig *dmsConfig
+	// Reloads the config file, and returns the config being run with. They're set once the server
+	// has started.
+	reload func() error
+	config func() *dmsConfig
+}
+
+func (me *configEditor) Settings() (ret dms.Settings) {
+	config := me.config()
+	ret.FriendlyName = config.FriendlyName
+	sc := setupConfig{Path: config.Path, Paths: config.Paths}
+	if len(sc.Paths) != 0 {
+		sc.Path = ""
+	}
+	ret.Paths = sc.pathLines()
+	for _, p := range config.AudioProfiles {
+		for _, ua := range p.UserAgents {
+			ret.AudioProfiles = append(ret.AudioProfiles, ua+"="+strings.Join(p.Formats, ","))
+		}
+	}
+	return
+}
+
+// Writes the settings to the config file, keeping the others in it, and reloads it. If that
+// fails, the file is put back as it was and reloaded again.
+func (me *configEditor) SetSettings(s dms.Settings) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	var sc setupConfig
+	if err := sc.setPaths(s.Paths); err != nil {
+		return err
+	}
+	profiles := []dms.AudioProfile{}
+	for _, line := range s.AudioProfiles {
+		p, err := parseAudioProfile(line)
+		if err != nil {
+			return err
+		}
+		profiles = append(profiles, p)
+	}
+	old, err := os.ReadFile(me.path)
+	if err != nil {
+		return err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(old, &fields); err != nil {
+		return fmt.Errorf("decoding config file %q: %w", me.path, err)
+	}
+	// Keys are matched without regard to case when the file is loaded, so any spelling is
+	// replaced.
+	set := func(key string, v interface{}) {
+		for k := range fields {
+			if strings.EqualFold(k, key) {
+				delete(fields, k)
+			}
+		}
+		if v != nil {
+			fields[key], _ = json.Marshal(v)
+		}
+	}
+	set("FriendlyName", s.FriendlyName)
+	if sc.Path != "" {
+		set("Path", sc.Path)
+		// Paths in the file replace those from the flags, which would otherwise be shared.
+		if len(me.flagConfig.Paths) != 0 {
+			set("Paths", []dms.RootDir{})
+		} else {
+			set("Paths", nil)
+		}
+	} else {
+		set("Path", nil)
+		set("Paths", sc.Paths)
+	}
+	set("AudioProfiles", profiles)
+	b, err := json.MarshalIndent(fields, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeConfigFile(me.path, append(b, '\n')); err != nil {
+		return err
+	}
+	if err := me.reload(); err != nil {
+		if err := writeConfigFile(me.path, old); err != nil {
+			log.Levelf(log.Error, "error restoring config file: %v", err)
+		} else if err := me.reload(); err != nil {
+			log.Levelf(log.Error, "error reloading restored config file: %v", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Replaces the config file with b in one step, so that it's never seen half written, keeping its
+// permissions.
+func writeConfigFile(path string, b []byte) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	err = f.Chmod(fi.Mode().Perm())
+	if err == nil {
+		_, err = f.Write(b)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The name dms is installed as a Windows service under.
+const serviceName = "dms"
+
+// Returns args without the flag name, and its value if it takes one, so they can be given to dms
+// run another way, such as in the background or as a service.
+func withoutFlag(args []string, name string, hasValue bool) (ret []string) {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			return append(ret, args[i:]...)
+		}
+		f := strings.TrimPrefix(strings.TrimPrefix(a, "-"), "-")
+		if f == name {
+			if hasValue {
+				i++
+			}
+			continue
+		}
+		if strings.HasPrefix(f, name+"=") {
+			continue
+		}
+		ret = append(ret, a)
+	}
+	return
+}
+
+// Writes the process ID to path, returning a func that removes it.
+func writePidFile(path string) (remove func(), err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0o644); err != nil {
+		return nil, err
+	}
+	return func() { os.Remove(path) }, nil
+}
@@ -0,0 +1,183 @@
+package dms
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/dms/dlna"
+)
+
+// How AccessLogFormat writes each request to the AccessLog.
+const (
+	// A line of key=value fields, including what was requested and why it failed.
+	AccessLogFields = ""
+	// The Common Log Format of web servers, for log analyzers.
+	AccessLogCommon = "common"
+	// The Common Log Format with the referer and User-Agent, as Apache's combined format.
+	AccessLogCombined = "combined"
+)
+
+func (srv *Server) initAccessLog() error {
+	switch srv.AccessLogFormat {
+	case AccessLogFields, AccessLogCommon, AccessLogCombined:
+		return nil
+	}
+	return fmt.Errorf("unknown access log format %q, want common or combined", srv.AccessLogFormat)
+}
+
+func (srv *Server) accessLogFormat() string {
+	return srv.settings().AccessLogFormat
+}
+
+// Counts what's written in response to a request, for the access log.
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (me *accessLogResponseWriter) WriteHeader(code int) {
+	if me.status == 0 {
+		me.status = code
+	}
+	me.ResponseWriter.WriteHeader(code)
+}
+
+func (me *accessLogResponseWriter) Write(b []byte) (int, error) {
+	if me.status == 0 {
+		me.status = http.StatusOK
+	}
+	n, err := me.ResponseWriter.Write(b)
+	me.written += int64(n)
+	return n, err
+}
+
+// Keeps the ReadFrom of the response writer it wraps, through which files are sent with sendfile.
+func (me *accessLogResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if me.status == 0 {
+		me.status = http.StatusOK
+	}
+	n, err := io.Copy(me.ResponseWriter, src)
+	me.written += n
+	return n, err
+}
+
+func (me *accessLogResponseWriter) Flush() {
+	if f, ok := me.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (me *accessLogResponseWriter) CloseNotify() <-chan bool {
+	return me.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+// Notes the transcode a request for media was served with, for the access log.
+func setRequestTranscode(r *http.Request, transcode string) {
+	if rc, ok := r.Context().Value(requestContextKey{}).(*requestContext); ok {
+		rc.transcode = transcode
+	}
+}
+
+// Notes why a request failed, for the access log.
+func setRequestFailure(r *http.Request, err error) {
+	if rc, ok := r.Context().Value(requestContextKey{}).(*requestContext); ok {
+		rc.failure = err
+	}
+}
+
+// Returns the range of the media that was requested, in bytes or, for transcodes, in time.
+func requestRange(r *http.Request) string {
+	if s := r.Header.Get("Range"); s != "" {
+		return s
+	}
+	return r.Header.Get(dlna.TimeSeekRangeDomain)
+}
+
+// Returns the name of the SOAP action of a control request, such as Browse.
+func soapActionName(r *http.Request) string {
+	action := strings.Trim(r.Header.Get("SOAPACTION"), `"`)
+	if i := strings.LastIndexByte(action, '#'); i != -1 {
+		return action[i+1:]
+	}
+	return action
+}
+
+// Appends a key=value field, quoting the value if it needs to be, unless the value is empty.
+func appendAccessLogField(b *bytes.Buffer, key, value string) {
+	if value == "" {
+		return
+	}
+	if strings.ContainsAny(value, " \"=\t\r\n") {
+		value = strconv.Quote(value)
+	}
+	fmt.Fprintf(b, " %s=%s", key, value)
+}
+
+// Returns the quoted value of a Common Log Format field, or "-" if it's empty.
+func commonLogString(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strconv.Quote(s)
+}
+
+// Formats the line of the access log for a request, finished now, that started at start.
+func formatAccessLog(format string, w *accessLogResponseWriter, r *http.Request, start, now time.Time) []byte {
+	var b bytes.Buffer
+	ip := requestClientIP(r)
+	status := w.status
+	if status == 0 {
+		// Nothing was written, such as when a handler returned without a response.
+		status = http.StatusOK
+	}
+	switch format {
+	case AccessLogCommon, AccessLogCombined:
+		size := "-"
+		if w.written != 0 {
+			size = strconv.FormatInt(w.written, 10)
+		}
+		fmt.Fprintf(&b, "%s - - [%s] %s %d %s",
+			ip, start.Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(r.Method+" "+r.RequestURI+" "+r.Proto), status, size)
+		if format == AccessLogCombined {
+			fmt.Fprintf(&b, " %s %s", commonLogString(r.Referer()), commonLogString(r.UserAgent()))
+		}
+	default:
+		b.WriteString(start.Format(time.RFC3339))
+		appendAccessLogField(&b, "client", ip)
+		appendAccessLogField(&b, "session", requestSession(r))
+		appendAccessLogField(&b, "method", r.Method)
+		appendAccessLogField(&b, "path", r.URL.Path)
+		appendAccessLogField(&b, "object", r.URL.Query().Get("path"))
+		appendAccessLogField(&b, "action", soapActionName(r))
+		appendAccessLogField(&b, "range", requestRange(r))
+		appendAccessLogField(&b, "status", strconv.Itoa(status))
+		appendAccessLogField(&b, "bytes", strconv.FormatInt(w.written, 10))
+		appendAccessLogField(&b, "duration", now.Sub(start).Round(time.Millisecond).String())
+		if rc, ok := r.Context().Value(requestContextKey{}).(*requestContext); ok {
+			appendAccessLogField(&b, "transcode", rc.transcode)
+			if rc.failure != nil {
+				appendAccessLogField(&b, "error", rc.failure.Error())
+			}
+		}
+		appendAccessLogField(&b, "ua", r.UserAgent())
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// Writes the request, which started at start, to the access log, once it's been served.
+func (srv *Server) logAccess(w *accessLogResponseWriter, r *http.Request, start time.Time) {
+	line := formatAccessLog(srv.accessLogFormat(), w, r, start, time.Now())
+	srv.accessLogMu.Lock()
+	defer srv.accessLogMu.Unlock()
+	if _, err := srv.AccessLog.Write(line); err != nil {
+		srv.Logger.Printf("error writing access log: %v", err)
+	}
+}
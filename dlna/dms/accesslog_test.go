@@ -0,0 +1,35 @@
+package dms
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFormatAccessLog(t *testing.T) {
+	r := httptest.NewRequest("GET", "/res?path=%2Fa+b.mkv&transcode=t", nil)
+	r.RemoteAddr = "192.168.1.20:4000"
+	r.Header.Set("User-Agent", "Some TV/1.0")
+	r.Header.Set("TimeSeekRange.dlna.org", "npt=10-")
+	rc := &requestContext{transcode: "t", failure: errors.New("no ffmpeg")}
+	rc.Session = "abcd"
+	r = r.WithContext(context.WithValue(r.Context(), requestContextKey{}, rc))
+	w := &accessLogResponseWriter{ResponseWriter: httptest.NewRecorder()}
+	w.WriteHeader(503)
+	w.Write([]byte("failed"))
+	start := time.Date(2024, 3, 1, 20, 15, 0, 0, time.UTC)
+	now := start.Add(1500 * time.Millisecond)
+	for _, c := range []struct {
+		format, want string
+	}{
+		{AccessLogFields, `2024-03-01T20:15:00Z client=192.168.1.20 session=abcd method=GET path=/res object="/a b.mkv" range="npt=10-" status=503 bytes=6 duration=1.5s transcode=t error="no ffmpeg" ua="Some TV/1.0"` + "\n"},
+		{AccessLogCommon, `192.168.1.20 - - [01/Mar/2024:20:15:00 +0000] "GET /res?path=%2Fa+b.mkv&transcode=t HTTP/1.1" 503 6` + "\n"},
+		{AccessLogCombined, `192.168.1.20 - - [01/Mar/2024:20:15:00 +0000] "GET /res?path=%2Fa+b.mkv&transcode=t HTTP/1.1" 503 6 - "Some TV/1.0"` + "\n"},
+	} {
+		if got := string(formatAccessLog(c.format, w, r, start, now)); got != c.want {
+			t.Errorf("%q:\ngot  %s\nwant %s", c.format, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package dms
+
+import (
+	"net"
+)
+
+// Networks clients are allowed from when AllowedIpNets isn't set, besides those of the Interfaces:
+// the RFC 1918 private networks, their IPv6 equivalent, and loopback and link-local addresses.
+var defaultAllowedIPNets = func() (ret []*net.IPNet) {
+	for _, s := range []string{
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		ret = append(ret, ipNet)
+	}
+	return
+}()
+
+// Reports whether a client at ip may discover the server and make requests to it.
+func (me *Server) allowedIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	allowed := me.settings().AllowedIpNets
+	if allowed != nil {
+		return ipNetsContain(allowed, ip)
+	}
+	if ipNetsContain(defaultAllowedIPNets, ip) {
+		return true
+	}
+	// Public addresses are allowed if they're on a network the server is on, which is as local
+	// as a private network.
+	for _, if_ := range me.Interfaces {
+		addrs, err := if_.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ipNetsContain(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package dms
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAllowedIP(t *testing.T) {
+	srv := &Server{}
+	for ip, want := range map[string]bool{
+		"192.168.1.20": true,
+		"10.1.2.3":     true,
+		"172.31.0.1":   true,
+		"172.32.0.1":   false,
+		"127.0.0.1":    true,
+		"8.8.8.8":      false,
+		"fd12::1":      true,
+		"fe80::1":      true,
+		"2001:db8::1":  false,
+	} {
+		if got := srv.allowedIP(net.ParseIP(ip)); got != want {
+			t.Errorf("default: %s: got %v, want %v", ip, got, want)
+		}
+	}
+	_, ipNet, _ := net.ParseCIDR("8.8.8.0/24")
+	srv.AllowedIpNets = []*net.IPNet{ipNet}
+	for ip, want := range map[string]bool{
+		"8.8.8.8":      true,
+		"192.168.1.20": false,
+	} {
+		if got := srv.allowedIP(net.ParseIP(ip)); got != want {
+			t.Errorf("configured: %s: got %v, want %v", ip, got, want)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package dms
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+const (
+	apiBrowsePath  = "/api/browse"
+	apiSearchPath  = "/api/search"
+	apiItemPath    = "/api/item/"
+	apiStatusPath  = "/api/status"
+	apiStreamsPath = "/api/streams"
+	apiTokensPath  = "/api/tokens"
+)
+
+// The JSON equivalent of a DIDL-Lite object.
+type apiObject struct {
+	ID       string
+	ParentID string
+	// For items listed elsewhere too, such as in Recently Played, the ID of the item they are.
+	RefID       string `json:",omitempty"`
+	Title       string
+	Class       string
+	Container   bool   `json:",omitempty"`
+	ChildCount  int    `json:",omitempty"`
+	Artist      string `json:",omitempty"`
+	Album       string `json:",omitempty"`
+	Genre       string `json:",omitempty"`
+	Description string `json:",omitempty"`
+	// Such as "2006-01-02".
+	Date        string        `json:",omitempty"`
+	Icon        string        `json:",omitempty"`
+	AlbumArtURI string        `json:",omitempty"`
+	Res         []apiResource `json:",omitempty"`
+	// Whether the video has been watched.
+	Watched bool `json:",omitempty"`
+}
+
+type apiResource struct {
+	URL          string
+	ProtocolInfo string
+	Size         uint64 `json:",omitempty"`
+	Bitrate      uint   `json:",omitempty"`
+	Duration     string `json:",omitempty"`
+	Resolution   string `json:",omitempty"`
+}
+
+// Space where the server reads media from or writes state to.
+type apiDisk struct {
+	Name      string
+	Path      string
+	Free      uint64
+	Total     uint64
+	FreeFiles uint64 `json:",omitempty"`
+	Files     uint64 `json:",omitempty"`
+	Low       bool
+	Error     string `json:",omitempty"`
+}
+
+type apiStatus struct {
+	FriendlyName string
+	UUID         string
+	Version      string
+	Disks        []apiDisk
+	Warnings     []string
+	// The tag of a newer release, if CheckUpdates found one.
+	NewRelease string `json:",omitempty"`
+	// Media files that can't be played, and why.
+	Problems []problemFile
+}
+
+// A media stream being served.
+type apiStream struct {
+	ID        string
+	Client    string
+	UserAgent string
+	Path      string
+	Transcode string `json:",omitempty"`
+	Started   time.Time
+	Bytes     int64
+}
+
+// An API token, without what's needed to check it.
+type apiToken struct {
+	Name      string
+	Scopes    []string
+	Created   time.Time
+	CreatedBy string `json:",omitempty"`
+	// Only given when the token is created.
+	Token string `json:",omitempty"`
+}
+
+// A page of the results of a browse or search.
+type apiPage struct {
+	Objects      []apiObject
+	TotalMatches int
+}
+
+func makeAPIObject(obj upnpav.Object) apiObject {
+	ret := apiObject{
+		ID:          obj.ID,
+		ParentID:    obj.ParentID,
+		RefID:       obj.RefID,
+		Title:       obj.Title,
+		Class:       obj.Class,
+		Artist:      obj.Artist,
+		Album:       obj.Album,
+		Genre:       obj.Genre,
+		Description: obj.Description,
+		Icon:        obj.Icon,
+		AlbumArtURI: obj.AlbumArtURI,
+	}
+	if !obj.Date.IsZero() {
+		ret.Date = obj.Date.Format("2006-01-02")
+	}
+	return ret
+}
+
+// Converts a upnpav.Container or upnpav.Item, as returned for the ContentDirectory.
+func apiObjectFrom(obj interface{}) (ret apiObject, ok bool) {
+	switch obj := obj.(type) {
+	case upnpav.Container:
+		ret = makeAPIObject(obj.Object)
+		ret.Container = true
+		ret.ChildCount = obj.ChildCount
+	case upnpav.Item:
+		ret = makeAPIObject(obj.Object)
+		for _, res := range obj.Res {
+			ret.Res = append(ret.Res, apiResource{
+				URL:          res.URL,
+				ProtocolInfo: res.ProtocolInfo,
+				Size:         res.Size,
+				Bitrate:      res.Bitrate,
+				Duration:     res.Duration,
+				Resolution:   res.Resolution,
+			})
+		}
+	default:
+		return
+	}
+	return ret, true
+}
+
+// Returns the page given by the start and count query parameters, which are like Browse's
+// StartingIndex and RequestedCount.
+func apiResultPage(objs []interface{}, r *http.Request) (ret apiPage, err error) {
+	q := r.URL.Query()
+	start, count := 0, 0
+	if s := q.Get("start"); s != "" {
+		if start, err = strconv.Atoi(s); err != nil || start < 0 {
+			return ret, upnp.Errorf(upnp.ArgumentValueInvalidErrorCode, "bad start %q", s)
+		}
+	}
+	if s := q.Get("count"); s != "" {
+		if count, err = strconv.Atoi(s); err != nil || count < 0 {
+			return ret, upnp.Errorf(upnp.ArgumentValueInvalidErrorCode, "bad count %q", s)
+		}
+	}
+	ret.TotalMatches = len(objs)
+	if start > len(objs) {
+		start = len(objs)
+	}
+	objs = objs[start:]
+	if count != 0 && count < len(objs) {
+		objs = objs[:count]
+	}
+	ret.Objects = []apiObject{}
+	for _, obj := range objs {
+		if apiObj, ok := apiObjectFrom(obj); ok {
+			ret.Objects = append(ret.Objects, apiObj)
+		}
+	}
+	return ret, nil
+}
+
+func (me *Server) writeAPIResponse(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		me.requestLogger(r).Printf("error writing API response: %v", err)
+	}
+}
+
+// Responds with the error as JSON, with a status code for its UPnP error code if it has one.
+func (me *Server) writeAPIError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	var upnpErr *upnp.Error
+	if errors.As(err, &upnpErr) {
+		switch upnpErr.Code {
+		case upnpav.NoSuchObjectErrorCode, upnpav.NoSuchContainerErrorCode:
+			code = http.StatusNotFound
+		case upnp.ArgumentValueInvalidErrorCode, upnpav.InvalidSearchCriteriaErrorCode:
+			code = http.StatusBadRequest
+		case upnp.InvalidActionErrorCode:
+			code = http.StatusNotImplemented
+		}
+		err = errors.New(upnpErr.Desc)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+}
+
+func (me *Server) apiContentDirectory() *contentDirectoryService {
+	return me.services["ContentDirectory"].(*contentDirectoryService)
+}
+
+// Serves the children of the object with the id query parameter, defaulting to the root, like
+// BrowseDirectChildren.
+func (me *Server) serveAPIBrowse(w http.ResponseWriter, r *http.Request) {
+	if !me.authorizeAPI(w, r, APIScopeBrowse) {
+		return
+	}
+	cds := me.apiContentDirectory()
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		id = "0"
+	}
+	prefs := me.requestClientPrefs(r)
+	obj, err := cds.objectFromID(id)
+	if err == nil && !prefs.allowed(obj.Path) {
+		err = errors.New("not in the containers the client may browse")
+	}
+	if err != nil {
+		me.writeAPIError(w, r, upnp.Errorf(upnpav.NoSuchObjectErrorCode, err.Error()))
+		return
+	}
+	objs, err := cds.directChildren(obj, me.dlnaHost(r), r.UserAgent())
+	if err != nil {
+		me.writeAPIError(w, r, upnp.Errorf(upnpav.NoSuchObjectErrorCode, err.Error()))
+		return
+	}
+	books := me.requestAudiobooks(r)
+	// The listed objects are cached, so they're arranged into a copy.
+	arranged := make([]interface{}, 0, len(objs)+1)
+	for _, o := range cds.clientAudiobookItems(obj, objs, books, me.dlnaHost(r)) {
+		arranged = append(arranged, books.arrange(o))
+	}
+	page, err := apiResultPage(prefs.visible(arranged), r)
+	if err != nil {
+		me.writeAPIError(w, r, err)
+		return
+	}
+	me.externalAPIURLs(page.Objects, r.UserAgent())
+	me.watchedAPIObjects(page.Objects)
+	me.writeAPIResponse(w, r, page)
+}
+
+// Serves the objects within the container with the id query parameter that match the criteria
+// query parameter, which is in the syntax of Search's SearchCriteria.
+func (me *Server) serveAPISearch(w http.ResponseWriter, r *http.Request) {
+	if !me.authorizeAPI(w, r, APIScopeBrowse) {
+		return
+	}
+	if me.index == nil {
+		me.writeAPIError(w, r, upnp.Errorf(upnp.InvalidActionErrorCode, "searching requires an index"))
+		return
+	}
+	q := r.URL.Query()
+	id := q.Get("id")
+	if id == "" {
+		id = "0"
+	}
+	criteria := q.Get("criteria")
+	if criteria == "" {
+		criteria = "*"
+	}
+	objs, err := me.apiContentDirectory().search(id, criteria, me.dlnaHost(r), r.UserAgent())
+	if err != nil {
+		me.writeAPIError(w, r, err)
+		return
+	}
+	page, err := apiResultPage(me.requestClientPrefs(r).visible(objs), r)
+	if err != nil {
+		me.writeAPIError(w, r, err)
+		return
+	}
+	me.externalAPIURLs(page.Objects, r.UserAgent())
+	me.watchedAPIObjects(page.Objects)
+	me.writeAPIResponse(w, r, page)
+}
+
+// Returns the object with the ID at the end of the request's path, after prefix.
+func (me *Server) apiPathObject(r *http.Request, prefix string) (object, error) {
+	// IDs are escaped object paths, which the mux has already unescaped and cleaned, or encoded
+	// ones.
+	id := strings.TrimPrefix(r.URL.Path, prefix)
+	if id != "0" && decodeObjectPath(id) == id {
+		id = url.QueryEscape("/" + id)
+	}
+	obj, err := me.apiContentDirectory().objectFromID(id)
+	if err != nil {
+		return obj, upnp.Errorf(upnpav.NoSuchObjectErrorCode, err.Error())
+	}
+	return obj, nil
+}
+
+// Serves the object with the ID at the end of the path, like BrowseMetadata.
+func (me *Server) serveAPIItem(w http.ResponseWriter, r *http.Request) {
+	if !me.authorizeAPI(w, r, APIScopeBrowse) {
+		return
+	}
+	cds := me.apiContentDirectory()
+	prefs := me.requestClientPrefs(r)
+	obj, err := me.apiPathObject(r, apiItemPath)
+	if err == nil && !prefs.allowed(obj.Path) {
+		err = upnp.Errorf(upnpav.NoSuchObjectErrorCode, "not in the containers the client may browse")
+	}
+	if err != nil {
+		me.writeAPIError(w, r, err)
+		return
+	}
+	ret, err := cds.objectMetadata(obj, me.dlnaHost(r), r.UserAgent())
+	if err == nil && prefs.refersToLocked(ret) {
+		err = upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such object")
+	}
+	if err != nil {
+		me.writeAPIError(w, r, err)
+		return
+	}
+	ret = prefs.arrange(ret)
+	apiObj, ok := apiObjectFrom(me.externalURLs(ret, r.UserAgent()))
+	if !ok {
+		me.writeAPIError(w, r, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such object"))
+		return
+	}
+	objs := []apiObject{apiObj}
+	me.watchedAPIObjects(objs)
+	me.writeAPIResponse(w, r, objs[0])
+}
+
+// Serves the server's health, such as whether it's running out of space.
+func (me *Server) serveAPIStatus(w http.ResponseWriter, r *http.Request) {
+	if !me.authorizeAPI(w, r, APIScopeAdmin) {
+		return
+	}
+	status := apiStatus{
+		FriendlyName: me.settings().FriendlyName,
+		UUID:         me.rootDeviceUUID,
+		Version:      Version(),
+		Disks:        []apiDisk{},
+		NewRelease:   me.updates.get(),
+	}
+	status.Warnings = append(append([]string{}, me.diskWarnings()...), me.fsWarnings()...)
+	status.Problems = append([]problemFile{}, me.problems.list(me.contentFS())...)
+	for _, d := range me.disks.list() {
+		disk := apiDisk{
+			Name:      d.Name,
+			Path:      d.Path,
+			Free:      d.Free,
+			Total:     d.Total,
+			FreeFiles: d.FreeFiles,
+			Files:     d.Files,
+			Low:       d.Low(),
+		}
+		if d.Err != nil {
+			disk.Error = d.Err.Error()
+		}
+		status.Disks = append(status.Disks, disk)
+	}
+	me.writeAPIResponse(w, r, status)
+}
+
+// Lists the media streams being served, or stops the one with the id query parameter on DELETE.
+func (me *Server) serveAPIStreams(w http.ResponseWriter, r *http.Request) {
+	if !me.authorizeAPI(w, r, APIScopePlayback) {
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		if !me.streams.stop(id) {
+			me.writeAPIError(w, r, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no stream %q", id))
+			return
+		}
+		me.requestLogger(r).Printf("stopped stream %s", id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	streams := []apiStream{}
+	for _, s := range me.streams.list() {
+		streams = append(streams, apiStream{
+			ID:        s.ID,
+			Client:    s.IP,
+			UserAgent: s.UserAgent,
+			Path:      s.Path,
+			Transcode: s.Transcode(),
+			Started:   s.Started,
+			Bytes:     s.Bytes(),
+		})
+	}
+	me.writeAPIResponse(w, r, streams)
+}
+
+// Lists the API tokens, creates one from the JSON apiToken in the body on POST, or revokes the one
+// with the name query parameter on DELETE.
+func (me *Server) serveAPITokens(w http.ResponseWriter, r *http.Request) {
+	by, ok := me.authorizeTokens(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		var req apiToken
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			me.writeAPIError(w, r, upnp.Errorf(upnp.ArgumentValueInvalidErrorCode, "bad token: %v", err))
+			return
+		}
+		token, err := me.apiTokens.Add(req.Name, req.Scopes, by)
+		if err != nil {
+			me.writeAPIError(w, r, upnp.Errorf(upnp.ArgumentValueInvalidErrorCode, err.Error()))
+			return
+		}
+		me.requestLogger(r).Printf("added API token %q with scopes %q", req.Name, req.Scopes)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		me.writeAPIResponse(w, r, apiToken{
+			Name:      req.Name,
+			Scopes:    req.Scopes,
+			Created:   time.Now(),
+			CreatedBy: by,
+			Token:     token,
+		})
+		return
+	case "DELETE":
+		name := r.URL.Query().Get("name")
+		if err := me.apiTokens.Revoke(name); err != nil {
+			me.writeAPIError(w, r, upnp.Errorf(upnpav.NoSuchObjectErrorCode, err.Error()))
+			return
+		}
+		me.requestLogger(r).Printf("revoked API token %q", name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tokens, err := me.apiTokens.List()
+	if err != nil {
+		me.writeAPIError(w, r, err)
+		return
+	}
+	ret := []apiToken{}
+	for _, t := range tokens {
+		ret = append(ret, apiToken{Name: t.Name, Scopes: t.Scopes, Created: t.Created, CreatedBy: t.CreatedBy})
+	}
+	me.writeAPIResponse(w, r, ret)
+}
@@ -0,0 +1,51 @@
+package dms
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestAPIResultPage(t *testing.T) {
+	objs := []interface{}{
+		upnpav.Container{Object: upnpav.Object{ID: "%2Fa", Title: "a"}, ChildCount: 3},
+		upnpav.Item{Object: upnpav.Object{ID: "%2Fb.mp3", Title: "b"}, Res: []upnpav.Resource{{URL: "http://x/res"}}},
+		upnpav.Item{Object: upnpav.Object{ID: "%2Fc.mp3", Title: "c"}},
+	}
+	page, err := apiResultPage(objs, httptest.NewRequest("GET", "/api/browse?start=1&count=1", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.TotalMatches != 3 || len(page.Objects) != 1 {
+		t.Fatalf("unexpected page %+v", page)
+	}
+	if o := page.Objects[0]; o.ID != "%2Fb.mp3" || o.Container || len(o.Res) != 1 || o.Res[0].URL != "http://x/res" {
+		t.Errorf("unexpected object %+v", o)
+	}
+	page, _ = apiResultPage(objs, httptest.NewRequest("GET", "/api/browse", nil))
+	if len(page.Objects) != 3 || !page.Objects[0].Container || page.Objects[0].ChildCount != 3 {
+		t.Errorf("unexpected page %+v", page)
+	}
+	if _, err := apiResultPage(objs, httptest.NewRequest("GET", "/api/browse?count=-1", nil)); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestMakeAPIItemOffer(t *testing.T) {
+	item := upnpav.Item{
+		Object: upnpav.Object{Class: "object.item.audioItem.musicTrack"},
+		Res: []upnpav.Resource{
+			{URL: "http://x/flac", ProtocolInfo: "http-get:*:audio/flac:*"},
+			{URL: "http://x/lpcm", ProtocolInfo: "http-get:*:audio/L16;rate=44100;channels=2:*"},
+		},
+	}
+	offer := makeAPIItemOffer(item, nil)
+	if len(offer.Resources) != 2 || offer.Resources[0].URL != "http://x/flac" || offer.Resources[0].Accepted != nil {
+		t.Errorf("unexpected default offer %+v", offer)
+	}
+	offer = makeAPIItemOffer(item, lpcmRendererSink)
+	if len(offer.Resources) != 2 || offer.Resources[0].URL != "http://x/lpcm" || !*offer.Resources[0].Accepted || *offer.Resources[1].Accepted {
+		t.Errorf("unexpected LPCM offer %+v", offer)
+	}
+}
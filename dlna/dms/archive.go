@@ -0,0 +1,411 @@
+package dms
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dms/dlna"
+	"github.com/anacrolix/dms/rrcache"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+const (
+	// Serves the entries of archives, named by their object paths.
+	archivePath = "/archive"
+	// The most entries kept across the cached trees of archives.
+	archiveTreeCacheCapacity = 100000
+)
+
+// Whether the file is an archive that's browsed as a container of its entries, such as a comic
+// book or a zipped photo album. Only zip archives are: RAR ones, such as .cbr comic books, need a
+// decoder Go doesn't have, so they're left out like other files that aren't media.
+func isArchiveFile(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".zip", ".cbz":
+		return true
+	}
+	return false
+}
+
+// Splits an object path at the archive it's in, such as "/comics/a.cbz/01.jpg" into
+// "/comics/a.cbz" and "01.jpg". The entry is empty for the archive itself.
+func splitArchivePath(p string) (archiveObjPath, entry string, ok bool) {
+	elems := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for i, e := range elems {
+		if isArchiveFile(e) {
+			return "/" + path.Join(elems[:i+1]...), path.Join(elems[i+1:]...), true
+		}
+	}
+	return
+}
+
+// An open zip archive, which entries that aren't compressed are read from directly.
+type archive struct {
+	f File
+	*zip.Reader
+}
+
+func openArchive(fsys FS, filePath string) (*archive, error) {
+	f, err := fsys.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &archive{f, r}, nil
+}
+
+func (me *archive) Close() error {
+	return me.f.Close()
+}
+
+// A folder within an archive, which archives needn't have an entry of their own for.
+type archiveDirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (me archiveDirInfo) Name() string       { return me.name }
+func (me archiveDirInfo) Size() int64        { return 0 }
+func (me archiveDirInfo) Mode() os.FileMode  { return os.ModeDir | 0o555 }
+func (me archiveDirInfo) ModTime() time.Time { return me.modTime }
+func (me archiveDirInfo) IsDir() bool        { return true }
+func (me archiveDirInfo) Sys() interface{}   { return nil }
+
+// The folders of an archive and what's directly within them, read from its directory once for
+// each version of it, rather than for each folder listed.
+type archiveTree struct {
+	// The entries of each folder by its path in the archive, "" for the root, in the order
+	// they're in the archive. Entries with names that could escape the archive, such as
+	// "../a.jpg", are left out.
+	dirs map[string][]os.FileInfo
+}
+
+func newArchiveTree(files []*zip.File) *archiveTree {
+	me := &archiveTree{dirs: map[string][]os.FileInfo{"": nil}}
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name, "/")
+		if !fs.ValidPath(name) || name == "." {
+			continue
+		}
+		if f.FileInfo().IsDir() {
+			me.addDir(name, f.Modified)
+			continue
+		}
+		dir := archiveParentDir(name)
+		me.addDir(dir, f.Modified)
+		me.dirs[dir] = append(me.dirs[dir], f.FileInfo())
+	}
+	return me
+}
+
+// Adds the folder, and those it's in, if they haven't been already. Archives needn't have entries
+// of their own for folders, so they're dated by the first entry within them.
+func (me *archiveTree) addDir(dir string, modTime time.Time) {
+	for dir != "" {
+		if _, ok := me.dirs[dir]; ok {
+			return
+		}
+		me.dirs[dir] = nil
+		parent := archiveParentDir(dir)
+		me.dirs[parent] = append(me.dirs[parent], archiveDirInfo{path.Base(dir), modTime})
+		dir = parent
+	}
+}
+
+// Returns the folder within an archive that the entry is in, "" for the root.
+func archiveParentDir(name string) string {
+	if dir := path.Dir(name); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// Returns the number of objects listed in the folder dir: the media files that allowed reports
+// true for, and the folders with any in them. Counts are kept in counts, so that each folder is
+// only counted once however deep it is.
+func (me *archiveTree) childCount(dir string, allowed func(mimeType) bool, counts map[string]int) int {
+	if n, ok := counts[dir]; ok {
+		return n
+	}
+	n := 0
+	for _, fi := range me.dirs[dir] {
+		if fi.IsDir() {
+			if me.childCount(path.Join(dir, fi.Name()), allowed, counts) != 0 {
+				n++
+			}
+		} else if allowed(mimeTypeByBaseName(fi.Name())) {
+			n++
+		}
+	}
+	counts[dir] = n
+	return n
+}
+
+type archiveTreeCacheEntry struct {
+	version fileVersion
+	tree    *archiveTree
+}
+
+// Trees of archives by their paths in the local filesystem.
+type archiveTreeCache struct {
+	mu    sync.Mutex
+	cache *rrcache.RRCache
+}
+
+// Returns the tree of the archive at filePath, from the cache if it hasn't changed since it was
+// read.
+func (me *Server) archiveTree(filePath string) (*archiveTree, error) {
+	fi, err := me.contentFS().Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	version := fileVersionOf(fi)
+	c := &me.archiveTrees
+	c.mu.Lock()
+	if c.cache == nil {
+		c.cache = rrcache.New(archiveTreeCacheCapacity)
+	}
+	v, ok := c.cache.Get(filePath)
+	c.mu.Unlock()
+	if ok && v.(archiveTreeCacheEntry).version == version {
+		me.metrics.cacheLookup("archive", true)
+		return v.(archiveTreeCacheEntry).tree, nil
+	}
+	me.metrics.cacheLookup("archive", false)
+	a, err := openArchive(me.contentFS(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	tree := newArchiveTree(a.File)
+	c.mu.Lock()
+	c.cache.Set(filePath, archiveTreeCacheEntry{version, tree}, int64(len(a.File)+1))
+	c.mu.Unlock()
+	return tree, nil
+}
+
+// Reports whether entries of the type are listed in the archive whose object is o: media, of the
+// types its shared directory has.
+func archiveMediaAllowed(o object) func(mimeType) bool {
+	return func(mt mimeType) bool {
+		return mt.IsMedia() && (o.root == nil || o.root.allowsMediaType(mt.Type()))
+	}
+}
+
+// Returns the file entry with the name, if there is one.
+func (me *archive) file(name string) *zip.File {
+	for _, f := range me.File {
+		if f.Name == name && fs.ValidPath(name) && f.Mode().IsRegular() {
+			return f
+		}
+	}
+	return nil
+}
+
+// Returns the object of the archive that o is in, and the entry that o is within it, if o is in a
+// shared archive.
+func (me *Server) objectArchive(o object) (archiveObj object, entry string, ok bool) {
+	archiveObjPath, entry, ok := splitArchivePath(o.Path)
+	if !ok {
+		return
+	}
+	archiveObj, err := me.objectFromPath(archiveObjPath)
+	if err != nil {
+		return archiveObj, "", false
+	}
+	filePath := archiveObj.FilePath()
+	if ignored, err := me.IgnorePath(filePath); err != nil || ignored {
+		return archiveObj, "", false
+	}
+	fi, err := me.statFS(filePath)
+	if err != nil || !fi.Mode().IsRegular() {
+		return archiveObj, "", false
+	}
+	return archiveObj, entry, true
+}
+
+func archiveEntryURL(host, objectPath string) string {
+	return (&url.URL{
+		Scheme:   "http",
+		Host:     host,
+		Path:     archivePath,
+		RawQuery: url.Values{"path": {objectPath}}.Encode(),
+	}).String()
+}
+
+// Returns the upnpav object for an entry of an archive, or nil if it isn't a media file or a
+// folder with any in it. Folders are counted into counts.
+func (me *contentDirectoryService) archiveEntry(t *archiveTree, o object, entry string, fi os.FileInfo, host string, counts map[string]int) interface{} {
+	obj := upnpav.Object{
+		ID:         o.ID(),
+		ParentID:   o.ParentID(),
+		Restricted: 1,
+		Title:      fi.Name(),
+		Date:       upnpav.Timestamp{Time: fi.ModTime()},
+	}
+	if fi.IsDir() {
+		childCount := t.childCount(entry, archiveMediaAllowed(o), counts)
+		if childCount == 0 {
+			return nil
+		}
+		obj.Class = "object.container.storageFolder"
+		return upnpav.Container{Object: obj, ChildCount: childCount}
+	}
+	mt := mimeTypeByBaseName(fi.Name())
+	if !archiveMediaAllowed(o)(mt) {
+		return nil
+	}
+	stored := false
+	if f, ok := fi.Sys().(*zip.FileHeader); ok {
+		stored = f.Method == zip.Store
+	}
+	obj.Class = "object.item." + mt.Type() + "Item"
+	obj.Title = strings.TrimSuffix(fi.Name(), path.Ext(fi.Name()))
+	return upnpav.Item{
+		Object: obj,
+		Res: []upnpav.Resource{{
+			URL:          archiveEntryURL(host, o.Path),
+			ProtocolInfo: fmt.Sprintf("http-get:*:%s:%s", mt, dlna.ContentFeatures{SupportRange: stored}.String()),
+			Size:         uint64(fi.Size()),
+		}},
+	}
+}
+
+// Returns the upnpav objects for the entries in the folder dir of the archive, whose object is o.
+func (me *contentDirectoryService) archiveObjects(t *archiveTree, o object, dir, host string) (ret []interface{}) {
+	// The tree is cached, so its entries are sorted in a copy.
+	sfis := collatedFileInfoSlice(append([]os.FileInfo(nil), t.dirs[dir]...), me.collator())
+	sort.Sort(sfis)
+	counts := make(map[string]int)
+	for _, fi := range sfis.fileInfoSlice {
+		if obj := me.archiveEntry(t, o.child(fi.Name()), path.Join(dir, fi.Name()), fi, host, counts); obj != nil {
+			ret = append(ret, obj)
+		}
+	}
+	return
+}
+
+// Returns the contents of an archive, or of a folder within one.
+func (me *contentDirectoryService) archiveItems(o, archiveObj object, entry, host string) ([]interface{}, error) {
+	t, err := me.archiveTree(archiveObj.FilePath())
+	if err != nil {
+		return nil, err
+	}
+	return me.archiveObjects(t, o, entry, host), nil
+}
+
+// Returns the container for an archive file, or nil if there's no media in it.
+func (me *contentDirectoryService) archiveContainer(o object, fi os.FileInfo, host string) (ret interface{}, err error) {
+	t, err := me.archiveTree(o.FilePath())
+	if err != nil {
+		return nil, err
+	}
+	childCount := t.childCount("", archiveMediaAllowed(o), make(map[string]int))
+	if childCount == 0 {
+		return nil, nil
+	}
+	return upnpav.Container{
+		Object: upnpav.Object{
+			ID:         o.ID(),
+			ParentID:   o.ParentID(),
+			Restricted: 1,
+			Class:      "object.container.storageFolder",
+			Title:      strings.TrimSuffix(fi.Name(), path.Ext(fi.Name())),
+			Date:       upnpav.Timestamp{Time: fi.ModTime()},
+		},
+		ChildCount: childCount,
+	}, nil
+}
+
+// Returns the object for an object path within an archive, as given to BrowseMetadata.
+func (me *contentDirectoryService) archiveItemObject(o object, host string) (ret interface{}, ok bool) {
+	archiveObj, entry, ok := me.objectArchive(o)
+	if !ok || entry == "" {
+		return nil, false
+	}
+	t, err := me.archiveTree(archiveObj.FilePath())
+	if err != nil {
+		return nil, false
+	}
+	for _, fi := range t.dirs[archiveParentDir(entry)] {
+		if fi.Name() == path.Base(entry) {
+			ret = me.archiveEntry(t, o, entry, fi, host, make(map[string]int))
+			return ret, ret != nil
+		}
+	}
+	return nil, false
+}
+
+// Serves an entry of an archive. Entries that are stored rather than compressed, as images in comic
+// books usually are, are read from the archive in place and can be seeked in.
+func (me *Server) serveArchiveEntry(w http.ResponseWriter, r *http.Request) {
+	o, err := me.objectFromPath(path.Clean("/" + r.URL.Query().Get("path")))
+	if err != nil {
+		me.resourceError(w, r, resourceNotFound, err)
+		return
+	}
+	archiveObj, entry, ok := me.objectArchive(o)
+	if !ok || entry == "" {
+		me.resourceError(w, r, resourceNotFound, errors.New("no such archive"))
+		return
+	}
+	a, err := openArchive(me.contentFS(), archiveObj.FilePath())
+	if err != nil {
+		me.resourceError(w, r, fileErrorCause(err), err)
+		return
+	}
+	defer a.Close()
+	f := a.file(entry)
+	if f == nil {
+		me.resourceError(w, r, resourceNotFound, errors.New("no such entry in archive"))
+		return
+	}
+	mt := mimeTypeByBaseName(path.Base(entry))
+	if !mt.IsMedia() {
+		me.resourceError(w, r, resourceNotFound, errors.New("not a media file"))
+		return
+	}
+	w.Header().Set("Content-Type", string(mt))
+	w.Header().Set("Content-Disposition", attachmentDisposition(path.Base(entry)))
+	if f.Method == zip.Store {
+		offset, err := f.DataOffset()
+		if err != nil {
+			me.resourceError(w, r, resourceInternalError, err)
+			return
+		}
+		http.ServeContent(w, r, "", f.Modified, io.NewSectionReader(a.f, offset, int64(f.CompressedSize64)))
+		return
+	}
+	rc, err := f.Open()
+	if err != nil {
+		me.resourceError(w, r, resourceInternalError, err)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Length", strconv.FormatUint(f.UncompressedSize64, 10))
+	if r.Method == "HEAD" {
+		return
+	}
+	io.Copy(w, io.LimitReader(rc, int64(f.UncompressedSize64)))
+}
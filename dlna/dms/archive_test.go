@@ -0,0 +1,110 @@
+package dms
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSplitArchivePath(t *testing.T) {
+	for _, c := range []struct {
+		p, archive, entry string
+		ok                bool
+	}{
+		{"/comics/a.cbz/01.jpg", "/comics/a.cbz", "01.jpg", true},
+		{"/comics/a.CBZ", "/comics/a.CBZ", "", true},
+		{"/photos.zip/2019/b.jpg", "/photos.zip", "2019/b.jpg", true},
+		{"/comics/a.jpg", "", "", false},
+	} {
+		archive, entry, ok := splitArchivePath(c.p)
+		if archive != c.archive || entry != c.entry || ok != c.ok {
+			t.Errorf("%q: got %q, %q, %v", c.p, archive, entry, ok)
+		}
+	}
+}
+
+// Writes a zip archive of empty entries with the names.
+func writeTestArchive(t *testing.T, filePath string, names ...string) {
+	f, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for _, name := range names {
+		if _, err := w.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveTree(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "a.cbz")
+	writeTestArchive(t, filePath, "01.jpg", "extra/02.jpg", "extra/more/03.jpg", "../04.jpg", "empty/", "notes/readme.txt")
+	a, err := openArchive(osFS{}, filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	tree := newArchiveTree(a.File)
+	names := func(dir string) (ret []string) {
+		for _, fi := range tree.dirs[dir] {
+			name := fi.Name()
+			if fi.IsDir() {
+				name += "/"
+			}
+			ret = append(ret, name)
+		}
+		return
+	}
+	if got := fmt.Sprint(names("")); got != "[01.jpg extra/ empty/ notes/]" {
+		t.Errorf("root: got %s", got)
+	}
+	if got := fmt.Sprint(names("extra")); got != "[02.jpg more/]" {
+		t.Errorf("extra: got %s", got)
+	}
+	if got := fmt.Sprint(names("extra/more")); got != "[03.jpg]" {
+		t.Errorf("extra/more: got %s", got)
+	}
+	if a.file("extra/02.jpg") == nil || a.file("../04.jpg") != nil || a.file("empty/") != nil {
+		t.Error("wrong entries found")
+	}
+	// Folders without media in them aren't counted.
+	counts := make(map[string]int)
+	if n := tree.childCount("", archiveMediaAllowed(object{}), counts); n != 2 {
+		t.Errorf("root has %d children", n)
+	}
+	if counts["extra"] != 2 || counts["extra/more"] != 1 || counts["empty"] != 0 || counts["notes"] != 0 {
+		t.Errorf("counts %v", counts)
+	}
+}
+
+// Archives are read again once they've changed.
+func TestArchiveTreeCache(t *testing.T) {
+	srv := &Server{}
+	srv.metrics = newServerMetrics(srv)
+	filePath := filepath.Join(t.TempDir(), "a.cbz")
+	writeTestArchive(t, filePath, "01.jpg")
+	tree, err := srv.archiveTree(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := srv.archiveTree(filePath); again != tree {
+		t.Error("unchanged archive read again")
+	}
+	writeTestArchive(t, filePath, "01.jpg", "02.jpg")
+	os.Chtimes(filePath, time.Now(), time.Now().Add(time.Minute))
+	tree, err = srv.archiveTree(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.dirs[""]) != 2 {
+		t.Errorf("changed archive has %d entries", len(tree.dirs[""]))
+	}
+}
@@ -0,0 +1,553 @@
+package dms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/dlna"
+	"github.com/anacrolix/dms/misc"
+	"github.com/anacrolix/dms/transcode"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+const (
+	// Name of the item within an audiobook that continues from where the listener left off.
+	audiobookResumeName = "@resume"
+	// Renderers often open a stream briefly to inspect it before playing it. Shorter streams
+	// don't move the resume position.
+	audiobookMinListen = 10 * time.Second
+	// The most positions kept. The least recently updated are dropped for new ones.
+	maxAudiobookPositions = 10000
+)
+
+func isAudiobookGenre(genre string) bool {
+	switch strings.ToLower(genre) {
+	case "audiobook", "audiobooks", "audio book":
+		return true
+	}
+	return false
+}
+
+// An audiobook presented as a container of its parts, with an item to resume it if it's been
+// started. It's either a file, whose parts are its chapters, or a folder of files that are tagged
+// as an audiobook.
+type audiobook struct {
+	object
+	title string
+	parts []audiobookPart
+}
+
+type audiobookPart struct {
+	title    string
+	filePath string
+	// The span of the file. A zero duration is the remainder of it.
+	start, duration time.Duration
+}
+
+// Returns the audiobook for an audio file given its metadata, or nil if it isn't one.
+func fileAudiobook(o object, fi os.FileInfo, md *Metadata) *audiobook {
+	filePath := o.FilePath()
+	if !strings.EqualFold(filepath.Ext(filePath), ".m4b") && !isAudiobookGenre(md.Genre) {
+		return nil
+	}
+	book := &audiobook{
+		object: o,
+		title:  md.Title,
+	}
+	if book.title == "" {
+		book.title = fi.Name()
+	}
+	for i, c := range md.Chapters {
+		title := c.Title
+		if title == "" {
+			title = fmt.Sprintf("Chapter %d", i+1)
+		}
+		book.parts = append(book.parts, audiobookPart{
+			title:    title,
+			filePath: filePath,
+			start:    c.Start,
+			duration: c.End - c.Start,
+		})
+	}
+	if len(book.parts) == 0 {
+		book.parts = append(book.parts, audiobookPart{
+			title:    book.title,
+			filePath: filePath,
+			duration: md.Duration,
+		})
+	}
+	return book
+}
+
+// Returns the audiobook for a folder given its sorted entries, or nil if it isn't one. The first
+// audio file decides.
+func (me *Server) folderAudiobook(o object, fis []os.FileInfo) (book *audiobook) {
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		child := o.child(fi.Name())
+		filePath := child.FilePath()
+		if ignored, err := me.IgnorePath(filePath); err != nil || ignored {
+			continue
+		}
+		mt, err := mimeTypeInFS(me.contentFS(), filePath)
+		if err != nil || !mt.IsAudio() {
+			continue
+		}
+		md := me.fileMetadata(filePath, fi, mt)
+		if book == nil {
+			if !isAudiobookGenre(md.Genre) {
+				return nil
+			}
+			book = &audiobook{
+				object: o,
+				title:  md.Album,
+			}
+			if book.title == "" {
+				book.title = path.Base(o.Path)
+			}
+		}
+		title := md.Title
+		if title == "" {
+			title = fi.Name()
+		}
+		book.parts = append(book.parts, audiobookPart{
+			title:    title,
+			filePath: filePath,
+			duration: md.Duration,
+		})
+	}
+	return
+}
+
+// Returns the audiobook for an object, or nil if it isn't one.
+func (me *Server) objectAudiobook(o object) *audiobook {
+	fi, indexed := os.FileInfo(nil), false
+	if me.index != nil {
+		fi, indexed = me.index.stat(o.Path)
+	}
+	if !indexed {
+		var err error
+		fi, err = me.contentFS().Stat(o.FilePath())
+		if err != nil {
+			return nil
+		}
+	}
+	if !fi.IsDir() {
+		filePath := o.FilePath()
+		mt, err := mimeTypeInFS(me.contentFS(), filePath)
+		if err != nil || !mt.IsAudio() {
+			return nil
+		}
+		return fileAudiobook(o, fi, me.fileMetadata(filePath, fi, mt))
+	}
+	fis, err := me.readObjectDir(o)
+	if err != nil {
+		return nil
+	}
+	sort.Sort(collatedFileInfoSlice(fis, me.collator()))
+	return me.folderAudiobook(o, fis)
+}
+
+// Splits the object path of an item within an audiobook into that of the book and the index of
+// the part, which is -1 for the resume item.
+func splitAudiobookItemPath(p string) (bookPath string, part int, ok bool) {
+	dir, name := path.Split(p)
+	if !strings.HasPrefix(name, "@") || dir == "" {
+		return
+	}
+	if name == audiobookResumeName {
+		part = -1
+	} else {
+		var err error
+		part, err = strconv.Atoi(name[1:])
+		if err != nil || part < 0 {
+			return
+		}
+	}
+	return path.Clean(dir), part, true
+}
+
+// Returns the items for the parts of an audiobook container. The item resuming it is the
+// client's, and is added by clientAudiobookItems.
+func (me *contentDirectoryService) audiobookItems(book *audiobook, host string) (ret []interface{}) {
+	for i := range book.parts {
+		ret = append(ret, me.audiobookItem(book, i, audiobookPosition{}, host))
+	}
+	return
+}
+
+// Returns the objects listed in the container at o with the item resuming it first, if it's an
+// audiobook the client has started.
+func (me *contentDirectoryService) clientAudiobookItems(o object, objs []interface{}, books clientAudiobooks, host string) []interface{} {
+	pos, ok := books[o.Path]
+	if !ok {
+		return objs
+	}
+	book := me.objectAudiobook(o)
+	if book == nil || pos.Part >= len(book.parts) {
+		return objs
+	}
+	return append([]interface{}{me.audiobookItem(book, -1, pos, host)}, objs...)
+}
+
+// Returns the item for an object path within an audiobook, such as that of a chapter. The item
+// resuming it is only found for a client that's started it.
+func (me *contentDirectoryService) audiobookItemObject(o object, books clientAudiobooks, host string) (ret interface{}, ok bool) {
+	bookPath, part, ok := splitAudiobookItemPath(o.Path)
+	if !ok {
+		return
+	}
+	bookObject, err := me.objectFromPath(bookPath)
+	if err != nil {
+		return nil, false
+	}
+	book := me.objectAudiobook(bookObject)
+	if book == nil || part >= len(book.parts) {
+		return nil, false
+	}
+	pos, ok := books[book.Path]
+	if part == -1 && (!ok || pos.Part >= len(book.parts)) {
+		return nil, false
+	}
+	return me.audiobookItem(book, part, pos, host), true
+}
+
+// Returns the item for a part of the book, or for resuming it from pos if part is -1.
+func (me *contentDirectoryService) audiobookItem(book *audiobook, part int, pos audiobookPosition, host string) upnpav.Item {
+	name := audiobookResumeName
+	query := url.Values{
+		"path": {book.Path},
+	}
+	var (
+		title    string
+		duration time.Duration
+	)
+	if part == -1 {
+		p := book.parts[pos.Part]
+		title = fmt.Sprintf("Resume %s at %s", p.title, formatAudiobookOffset(pos.Offset))
+		if p.duration > pos.Offset {
+			duration = p.duration - pos.Offset
+		}
+		query.Set("resume", "1")
+	} else {
+		name = "@" + strconv.Itoa(part)
+		title = book.parts[part].title
+		duration = book.parts[part].duration
+		query.Set("part", strconv.Itoa(part))
+	}
+	item := upnpav.Item{
+		Object: upnpav.Object{
+			ID:         object{Path: path.Join(book.Path, name)}.ID(),
+			ParentID:   book.ID(),
+			Restricted: 1,
+			Class:      "object.item.audioItem.audioBook",
+			Title:      title,
+			Album:      book.title,
+		},
+	}
+	res := upnpav.Resource{
+		URL: (&url.URL{
+			Scheme:   "http",
+			Host:     host,
+			Path:     audiobookPath,
+			RawQuery: query.Encode(),
+		}).String(),
+		ProtocolInfo: "http-get:*:audio/mpeg:" + dlna.ContentFeatures{
+			ProfileName:     "MP3",
+			SupportTimeSeek: true,
+			Transcoded:      true,
+		}.String(),
+	}
+	if duration != 0 {
+		res.Duration = misc.FormatDurationSexagesimal(duration)
+	}
+	item.Res = append(item.Res, res)
+	return item
+}
+
+func formatAudiobookOffset(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
+
+// Streams a part of an audiobook, or the remainder of the part the listener left off in, and
+// moves the resume position along by however long the renderer kept streaming.
+func (me *Server) serveAudiobook(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	o, err := me.objectFromPath(path.Clean("/" + q.Get("path")))
+	if err != nil {
+		me.resourceError(w, r, resourceNotFound, err)
+		return
+	}
+	book := me.objectAudiobook(o)
+	if book == nil {
+		me.resourceError(w, r, resourceNotFound, errors.New("no such audiobook"))
+		return
+	}
+	client := sessionKey{requestClientIP(r), r.UserAgent()}
+	var pos audiobookPosition
+	if q.Get("resume") != "" {
+		pos, _ = me.audiobookPositions.get(client, book.Path)
+	} else {
+		pos.Part, err = strconv.Atoi(q.Get("part"))
+		if err != nil {
+			me.resourceError(w, r, resourceBadRequest, err)
+			return
+		}
+	}
+	if pos.Part < 0 || pos.Part >= len(book.parts) {
+		me.resourceError(w, r, resourceNotFound, errors.New("no such part"))
+		return
+	}
+	part := book.parts[pos.Part]
+	w.Header().Set(dlna.TransferModeDomain, "Streaming")
+	w.Header().Set("content-type", "audio/mpeg")
+	w.Header().Set(dlna.ContentFeaturesDomain, dlna.ContentFeatures{
+		ProfileName:     "MP3",
+		SupportTimeSeek: true,
+		Transcoded:      true,
+	}.String())
+	range_, partialResponse, err := handleDLNARange(w, r.Header, false)
+	if err != nil {
+		me.resourceError(w, r, resourceBadRequest, err)
+		return
+	}
+	if r.Method == "HEAD" {
+		writeResponseCode(w, partialResponse)
+		return
+	}
+	pos.Offset += range_.Start
+	length := time.Duration(-1)
+	if part.duration != 0 {
+		length = part.duration - pos.Offset
+		if range_.End > 0 && range_.End-range_.Start < length {
+			length = range_.End - range_.Start
+		}
+	}
+	logger := me.requestLogger(r)
+	var stderr io.Writer
+	if pattern := me.settings().TranscodeLogPattern; pattern != "" && !me.disks.low(transcodeLogsDiskName) {
+		stderrPath := strings.Replace(pattern, "[tsname]", filepath.Join("audiobook", filepath.Base(part.filePath)), -1)
+		os.MkdirAll(filepath.Dir(stderrPath), 0o750)
+		if f, err := os.Create(stderrPath); err == nil {
+			defer f.Close()
+			stderr = f
+		}
+	}
+	p, err := transcode.AudiobookTranscode(part.filePath, part.start+pos.Offset, length, stderr)
+	if err != nil {
+		logger.Levelf(log.Error, "error starting audiobook transcode of %q: %v", part.filePath, err)
+		me.resourceError(w, r, resourceTranscodeFailed, err)
+		return
+	}
+	defer p.Close()
+	defer me.transcodeStarted(r, "audiobook")()
+	writeResponseCode(w, partialResponse)
+	started := time.Now()
+	io.Copy(w, p)
+	listened := time.Since(started)
+	if listened < audiobookMinListen {
+		return
+	}
+	pos.Offset += listened
+	if part.duration != 0 && pos.Offset >= part.duration {
+		pos.Part++
+		pos.Offset = 0
+	}
+	if pos.Part == len(book.parts) {
+		logger.Levelf(log.Info, "finished audiobook %q", book.title)
+		err = me.audiobookPositions.clear(client, book.Path)
+	} else {
+		logger.Levelf(log.Debug, "audiobook %q at part %d, %v", book.title, pos.Part, pos.Offset)
+		err = me.audiobookPositions.set(client, book.Path, pos)
+	}
+	if err != nil {
+		logger.Levelf(log.Warning, "error saving audiobook position: %v", err)
+	}
+}
+
+// Where the listener is up to in an audiobook.
+type audiobookPosition struct {
+	Part    int
+	Offset  time.Duration
+	Updated time.Time
+}
+
+// A client's position in an audiobook, as persisted. Positions from before they were kept by
+// client have no IP or User-Agent.
+type clientAudiobookPosition struct {
+	IP        string
+	UserAgent string
+	// The object path of the book.
+	Book string
+	audiobookPosition
+}
+
+type audiobookPositionKey struct {
+	client sessionKey
+	book   string
+}
+
+// Resume positions of audiobooks, by client and book. They're kept apart from anything to do
+// with other media, since a book is listened to over days rather than played through. Like
+// bookmarks, clients are identified by their address and User-Agent, so that each listener
+// resumes where they left off.
+type audiobookPositions struct {
+	mu sync.Mutex
+	// File the positions are persisted in, if any.
+	path      string
+	positions map[audiobookPositionKey]audiobookPosition
+}
+
+func (me *audiobookPositions) load(path string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.path = path
+	me.positions = make(map[audiobookPositionKey]audiobookPosition)
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var positions []clientAudiobookPosition
+	if err := json.Unmarshal(b, &positions); err != nil {
+		// Older files have the positions by book, for every client.
+		var old map[string]audiobookPosition
+		if json.Unmarshal(b, &old) != nil {
+			return err
+		}
+		for book, pos := range old {
+			positions = append(positions, clientAudiobookPosition{Book: book, audiobookPosition: pos})
+		}
+	}
+	for _, pos := range positions {
+		me.positions[audiobookPositionKey{sessionKey{pos.IP, pos.UserAgent}, pos.Book}] = pos.audiobookPosition
+	}
+	return nil
+}
+
+// Returns the client's position in the book. Clients without one of their own have the one from
+// before positions were kept by client, if there is one.
+func (me *audiobookPositions) get(client sessionKey, book string) (pos audiobookPosition, ok bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if pos, ok = me.positions[audiobookPositionKey{client, book}]; !ok {
+		pos, ok = me.positions[audiobookPositionKey{book: book}]
+	}
+	return
+}
+
+// Returns the client's positions, by the object paths of the books.
+func (me *audiobookPositions) client(client sessionKey) clientAudiobooks {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ret := make(clientAudiobooks)
+	for k, pos := range me.positions {
+		if k.client == client {
+			ret[k.book] = pos
+		} else if _, ok := ret[k.book]; !ok && k.client == (sessionKey{}) {
+			ret[k.book] = pos
+		}
+	}
+	return ret
+}
+
+func (me *audiobookPositions) set(client sessionKey, book string, pos audiobookPosition) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	pos.Updated = time.Now()
+	me.positions[audiobookPositionKey{client, book}] = pos
+	if len(me.positions) > maxAudiobookPositions {
+		var oldest audiobookPositionKey
+		for k, pos := range me.positions {
+			if oldest == (audiobookPositionKey{}) || pos.Updated.Before(me.positions[oldest].Updated) {
+				oldest = k
+			}
+		}
+		delete(me.positions, oldest)
+	}
+	return me.save()
+}
+
+// Drops the client's position in the book, and the one from before positions were kept by client,
+// so that it doesn't take its place.
+func (me *audiobookPositions) clear(client sessionKey, book string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	delete(me.positions, audiobookPositionKey{client, book})
+	delete(me.positions, audiobookPositionKey{book: book})
+	return me.save()
+}
+
+func (me *audiobookPositions) save() error {
+	if me.path == "" {
+		return nil
+	}
+	positions := make([]clientAudiobookPosition, 0, len(me.positions))
+	for k, pos := range me.positions {
+		positions = append(positions, clientAudiobookPosition{k.client.IP, k.client.UserAgent, k.book, pos})
+	}
+	b, err := json.Marshal(positions)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(me.path), 0o750); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(me.path), filepath.Base(me.path))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), me.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// The positions of a client in audiobooks, by the object paths of the books.
+type clientAudiobooks map[string]audiobookPosition
+
+// Counts the item resuming a book the client has started in the book's container.
+func (me clientAudiobooks) arrange(obj interface{}) interface{} {
+	c, ok := obj.(upnpav.Container)
+	if !ok || len(me) == 0 {
+		return obj
+	}
+	if _, ok := me[objectIDPath(c.ID)]; ok {
+		c.ChildCount++
+	}
+	return c
+}
+
+// Returns the audiobook positions of the client of the request.
+func (srv *Server) requestAudiobooks(r *http.Request) clientAudiobooks {
+	return srv.audiobookPositions.client(sessionKey{requestClientIP(r), r.UserAgent()})
+}
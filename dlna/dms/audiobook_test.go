@@ -0,0 +1,113 @@
+package dms
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestSplitAudiobookItemPath(t *testing.T) {
+	for _, c := range []struct {
+		path string
+		book string
+		part int
+		ok   bool
+	}{
+		{"/books/Dune.m4b/@3", "/books/Dune.m4b", 3, true},
+		{"/books/Dune/@resume", "/books/Dune", -1, true},
+		{"/books/Dune/@x", "", 0, false},
+		{"/books/Dune/chapter1.mp3", "", 0, false},
+		{"@1", "", 0, false},
+	} {
+		book, part, ok := splitAudiobookItemPath(c.path)
+		if ok != c.ok || ok && (book != c.book || part != c.part) {
+			t.Errorf("%s: got %q %d %v", c.path, book, part, ok)
+		}
+	}
+}
+
+func TestAudiobookPositions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dms", "audiobooks.json")
+	tv := sessionKey{"192.168.1.30", "BRAVIA"}
+	phone := sessionKey{"192.168.1.31", "BubbleUPnP"}
+	var a audiobookPositions
+	if err := a.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.set(tv, "/Dune.m4b", audiobookPosition{Part: 2, Offset: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	var b audiobookPositions
+	if err := b.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if pos, ok := b.get(tv, "/Dune.m4b"); !ok || pos.Part != 2 || pos.Offset != time.Minute {
+		t.Errorf("unexpected position %+v", pos)
+	}
+	// Each listener resumes where they left off.
+	if pos, ok := b.get(phone, "/Dune.m4b"); ok {
+		t.Errorf("another client's position %+v", pos)
+	}
+	if books := b.client(phone); len(books) != 0 {
+		t.Errorf("another client's positions %v", books)
+	}
+	if books := b.client(tv); books["/Dune.m4b"].Part != 2 {
+		t.Errorf("client's positions %v", books)
+	}
+	if err := b.clear(tv, "/Dune.m4b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.get(tv, "/Dune.m4b"); ok {
+		t.Error("position should have been cleared")
+	}
+}
+
+// Positions from before they were kept by client are every client's until it has its own.
+func TestAudiobookPositionsUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audiobooks.json")
+	if err := os.WriteFile(path, []byte(`{"/Dune.m4b":{"Part":1,"Offset":60000000000}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tv := sessionKey{"192.168.1.30", "BRAVIA"}
+	var a audiobookPositions
+	if err := a.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if pos, ok := a.get(tv, "/Dune.m4b"); !ok || pos.Part != 1 || pos.Offset != time.Minute {
+		t.Fatalf("old position %+v", pos)
+	}
+	if err := a.set(tv, "/Dune.m4b", audiobookPosition{Part: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if books := a.client(tv); books["/Dune.m4b"].Part != 3 {
+		t.Errorf("client's positions %v", books)
+	}
+	if err := a.clear(tv, "/Dune.m4b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.get(sessionKey{"192.168.1.31", "BubbleUPnP"}, "/Dune.m4b"); ok {
+		t.Error("old position outlived the book being finished")
+	}
+}
+
+func TestClientAudiobooksArrange(t *testing.T) {
+	books := clientAudiobooks{"/Dune.m4b": {Part: 1}}
+	for _, c := range []struct {
+		id   string
+		want int
+	}{
+		{"%2FDune.m4b", 4},
+		{"%2FEmma.m4b", 3},
+	} {
+		obj := upnpav.Container{Object: upnpav.Object{ID: c.id}, ChildCount: 3}
+		if got := books.arrange(obj).(upnpav.Container).ChildCount; got != c.want {
+			t.Errorf("%s: %d children", c.id, got)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package dms
+
+import (
+	"fmt"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// In AudioProfile.Formats, the file as it is.
+const originalAudioFormat = "original"
+
+// The audio formats to offer renderers matched by User-Agent, such as older Sonos players and AV
+// receivers that can't play lossless files as they are.
+type AudioProfile struct {
+	// Substrings of the User-Agents of the renderers. "*" matches every renderer.
+	UserAgents []string
+	// What to offer them, in order of preference: "original" for the file as it is, and the
+	// transcodes flac, wav, lpcm, alac, mp3 and aac. Those left out aren't offered, and alac and
+	// aac are only offered to renderers with a profile naming them.
+	Formats []string
+}
+
+// Checks the audio profiles only give formats that can be offered.
+func (srv *Server) initAudioProfiles() error {
+	for _, p := range srv.AudioProfiles {
+		if len(p.Formats) == 0 {
+			return fmt.Errorf("audio profile for %q has no formats", p.UserAgents)
+		}
+		for _, f := range p.Formats {
+			if _, ok := findAudioTranscode(f); !ok && f != originalAudioFormat {
+				return fmt.Errorf("audio profile for %q: unknown format %q", p.UserAgents, f)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the first audio profile that matches the User-Agent.
+func (srv *Server) audioProfile(userAgent string) (AudioProfile, bool) {
+	for _, p := range srv.settings().AudioProfiles {
+		if matchUserAgent(p.UserAgents, userAgent) {
+			return p, true
+		}
+	}
+	return AudioProfile{}, false
+}
+
+// Returns the resources of an audio file in the profile's formats, given the resource of the file
+// as it is. It stands in for a transcode to the format and rate it's already in.
+func (me AudioProfile) resources(original upnpav.Resource, host, path string, mimeType mimeType, md Metadata, duration string) (ret []upnpav.Resource) {
+	haveOriginal := false
+	addOriginal := func() {
+		if !haveOriginal {
+			ret = append(ret, original)
+			haveOriginal = true
+		}
+	}
+	for _, f := range me.Formats {
+		at, ok := findAudioTranscode(f)
+		if !ok {
+			addOriginal()
+			continue
+		}
+		res := at.resources(host, path, mimeType, md, duration)
+		if len(res) == 0 {
+			addOriginal()
+		}
+		ret = append(ret, res...)
+	}
+	return
+}
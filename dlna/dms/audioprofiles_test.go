@@ -0,0 +1,60 @@
+package dms
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestAudioProfileResources(t *testing.T) {
+	srv := &Server{AudioProfiles: []AudioProfile{
+		{UserAgents: []string{"Sonos"}, Formats: []string{"mp3"}},
+		{UserAgents: []string{"*"}, Formats: []string{"lpcm", "mp3", "original"}},
+	}}
+	if err := srv.initAudioProfiles(); err != nil {
+		t.Fatal(err)
+	}
+	mimeTypes := func(p AudioProfile, mt mimeType, md Metadata) (ret []string) {
+		original := upnpav.Resource{ProtocolInfo: fmt.Sprintf("http-get:*:%s:*", mt)}
+		for _, r := range p.resources(original, "host", "/a", mt, md, "0:03:00.000") {
+			if r.ProtocolInfo != original.ProtocolInfo && r.Duration != "0:03:00.000" {
+				t.Errorf("%s has no duration", r.ProtocolInfo)
+			}
+			ret = append(ret, strings.SplitN(r.ProtocolInfo, ":", 4)[2])
+		}
+		return
+	}
+	p, _ := srv.audioProfile("Sonos/1.0")
+	// Hi-res FLAC is only given as MP3.
+	if got := mimeTypes(p, "audio/flac", Metadata{SampleRate: 96000, AudioChannels: 2}); fmt.Sprint(got) != "[audio/mpeg]" {
+		t.Errorf("got %q", got)
+	}
+	// An MP3 already at a rate they take stands in for the MP3 transcode.
+	if got := mimeTypes(p, "audio/mpeg", Metadata{SampleRate: 44100, AudioChannels: 2}); fmt.Sprint(got) != "[audio/mpeg]" {
+		t.Errorf("got %q", got)
+	}
+	p, _ = srv.audioProfile("Denon AVR")
+	want := "[audio/L16;rate=44100;channels=2 audio/L16;rate=48000;channels=2 audio/mpeg audio/mp4]"
+	if got := mimeTypes(p, "audio/mp4", Metadata{SampleRate: 44100, AudioChannels: 2}); fmt.Sprint(got) != want {
+		t.Errorf("got %q", got)
+	}
+	// An AAC file stands in for the AAC transcode, but not for ALAC.
+	p = AudioProfile{Formats: []string{"alac", "aac"}}
+	aac := Metadata{SampleRate: 44100, AudioChannels: 2, AudioCodec: "aac"}
+	res := p.resources(upnpav.Resource{URL: "original"}, "host", "/a.m4a", "audio/mp4", aac, "")
+	if len(res) != 2 || resourceTranscode(res[0]) != "alac" || res[1].URL != "original" {
+		t.Errorf("got %v", res)
+	}
+	// They're only offered to renderers whose profile names them.
+	for _, r := range audioTranscodeResources("host", "/a.flac", "audio/flac", Metadata{SampleRate: 44100, AudioChannels: 2}, "") {
+		if k := resourceTranscode(r); k == "alac" || k == "aac" {
+			t.Errorf("%s offered", k)
+		}
+	}
+	srv.AudioProfiles = []AudioProfile{{UserAgents: []string{"*"}, Formats: []string{"ogg"}}}
+	if err := srv.initAudioProfiles(); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
@@ -0,0 +1,340 @@
+package dms
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dms/dlna"
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+	"github.com/anacrolix/log"
+)
+
+const (
+	apiBookmarksPath = "/api/bookmarks"
+	// Streams shorter than this don't move bookmarks, since renderers make short requests to probe
+	// files and to read the index at the end of them.
+	bookmarkMinPlay = 10 * time.Second
+	// Media played this far through is finished, and its bookmark is dropped, since the credits
+	// are rarely watched.
+	bookmarkFinished = 0.95
+	// The most bookmarks kept. The least recently updated are dropped for new ones.
+	maxBookmarks = 10000
+)
+
+// How far a client got through an item, to resume it there.
+type bookmark struct {
+	IP        string
+	UserAgent string
+	// The object path of the item.
+	Path     string
+	Position time.Duration
+	Updated  time.Time
+}
+
+func (me bookmark) key() bookmarkKey {
+	return bookmarkKey{sessionKey{me.IP, me.UserAgent}, me.Path}
+}
+
+type bookmarkKey struct {
+	client sessionKey
+	path   string
+}
+
+// Bookmarks of the items clients have played, by client and item. Like sessions and display
+// preferences, clients are identified by their address and User-Agent.
+type bookmarks struct {
+	mu sync.Mutex
+	// File the bookmarks are persisted in, if any.
+	path  string
+	marks map[bookmarkKey]bookmark
+}
+
+func (me *bookmarks) load(path string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.path = path
+	me.marks = make(map[bookmarkKey]bookmark)
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var marks []bookmark
+	if err := json.Unmarshal(b, &marks); err != nil {
+		return err
+	}
+	for _, m := range marks {
+		me.marks[m.key()] = m
+	}
+	return nil
+}
+
+func (me *bookmarks) set(m bookmark) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	m.Updated = time.Now()
+	me.marks[m.key()] = m
+	if len(me.marks) > maxBookmarks {
+		var oldest bookmarkKey
+		for k, m := range me.marks {
+			if oldest == (bookmarkKey{}) || m.Updated.Before(me.marks[oldest].Updated) {
+				oldest = k
+			}
+		}
+		delete(me.marks, oldest)
+	}
+	return me.save()
+}
+
+// Drops the bookmark, returning false if there wasn't one.
+func (me *bookmarks) clear(key bookmarkKey) (bool, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if _, ok := me.marks[key]; !ok {
+		return false, nil
+	}
+	delete(me.marks, key)
+	return true, me.save()
+}
+
+// Returns the bookmarks, the most recently updated first.
+func (me *bookmarks) list() (ret []bookmark) {
+	me.mu.Lock()
+	for _, m := range me.marks {
+		ret = append(ret, m)
+	}
+	me.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Updated.After(ret[j].Updated)
+	})
+	return
+}
+
+// Returns the positions the client is up to in items, by object path.
+func (me *bookmarks) client(key sessionKey) clientBookmarks {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ret := make(clientBookmarks)
+	for k, m := range me.marks {
+		if k.client == key {
+			ret[k.path] = m.Position
+		}
+	}
+	return ret
+}
+
+func (me *bookmarks) save() error {
+	if me.path == "" {
+		return nil
+	}
+	marks := make([]bookmark, 0, len(me.marks))
+	for _, m := range me.marks {
+		marks = append(marks, m)
+	}
+	b, err := json.Marshal(marks)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(me.path), 0o750); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(me.path), filepath.Base(me.path))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), me.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// The positions a client is up to in items, by object path.
+type clientBookmarks map[string]time.Duration
+
+// Gives items the client has a bookmark in Samsung's sec:dcmInfo, which their TVs offer to resume
+// from.
+func (me clientBookmarks) arrange(obj interface{}) interface{} {
+	item, ok := obj.(upnpav.Item)
+	if !ok || len(me) == 0 {
+		return obj
+	}
+	// Items listed elsewhere too, such as in Recently Played, refer to the item they are.
+	id := item.ID
+	if item.RefID != "" {
+		id = item.RefID
+	}
+	p := objectIDPath(id)
+	pos, ok := me[p]
+	if !ok {
+		return obj
+	}
+	item.DCMInfo = fmt.Sprintf("CREATIONDATE=0,FOLDER=%s,BM=%d", path.Base(path.Dir(p)), int(pos/time.Second))
+	return item
+}
+
+// Returns the bookmarks of the client of the request.
+func (srv *Server) requestBookmarks(r *http.Request) clientBookmarks {
+	return srv.bookmarks.client(sessionKey{requestClientIP(r), r.UserAgent()})
+}
+
+// Returns the offset of the first byte of the request's Range, or 0 if it has none.
+func requestRangeStart(r *http.Request) int64 {
+	first, _, _ := strings.Cut(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-")
+	start, err := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return start
+}
+
+// Moves the client's bookmark in the item streamed to how far it got, from where the stream
+// started and how much of it was served. Finishing the item drops it.
+func (srv *Server) noteStreamPosition(r *http.Request, s *activeStream) {
+	if r.URL.Path != resPath || time.Since(s.Started) < bookmarkMinPlay {
+		return
+	}
+	filePath, err := srv.filePath(s.Path)
+	if err != nil {
+		return
+	}
+	fi, err := srv.contentFS().Stat(filePath)
+	if err != nil {
+		return
+	}
+	mt, err := mimeTypeInFS(srv.contentFS(), filePath)
+	if err != nil || !mt.IsVideo() && !mt.IsAudio() {
+		return
+	}
+	md := srv.fileMetadata(filePath, fi, mt)
+	if md.Duration <= 0 {
+		return
+	}
+	var pos time.Duration
+	if s.Transcode() != "" {
+		// Transcodes are served about as fast as they're played, from where they were sought to.
+		pos = time.Since(s.Started)
+		if npt, err := parseDLNARangeHeader(r.Header.Get(dlna.TimeSeekRangeDomain)); err == nil {
+			pos += npt.Start
+		}
+	} else if fi.Size() > 0 {
+		pos = time.Duration(float64(md.Duration) * float64(requestRangeStart(r)+s.Bytes()) / float64(fi.Size()))
+	}
+	key := bookmarkKey{sessionKey{s.IP, s.UserAgent}, path.Clean("/" + s.Path)}
+	logger := srv.requestLogger(r)
+	if pos >= time.Duration(float64(md.Duration)*bookmarkFinished) {
+		if _, err := srv.bookmarks.clear(key); err != nil {
+			logger.Levelf(log.Warning, "error saving bookmarks: %v", err)
+		}
+		if mt.IsVideo() {
+			if ok, err := srv.watched.set(key.path, true); err != nil {
+				logger.Levelf(log.Warning, "error saving watched videos: %v", err)
+			} else if ok {
+				logger.Levelf(log.Debug, "watched %q", key.path)
+			}
+		}
+		return
+	}
+	logger.Levelf(log.Debug, "bookmarked %q at %v", key.path, pos.Round(time.Second))
+	err = srv.bookmarks.set(bookmark{IP: s.IP, UserAgent: s.UserAgent, Path: key.path, Position: pos})
+	if err != nil {
+		logger.Levelf(log.Warning, "error saving bookmarks: %v", err)
+	}
+}
+
+// Samsung's X_SetBookmark, which their TVs call with where playback was stopped.
+type setBookmark struct {
+	ObjectID  string `soap:"required"`
+	PosSecond int64
+}
+
+// Sets the bookmark of the client of the request from an X_SetBookmark action.
+func (srv *Server) setBookmark(r *http.Request, args *setBookmark) error {
+	p := objectIDPath(args.ObjectID)
+	if p == "" || p == "/" || args.PosSecond < 0 {
+		return upnp.Errorf(upnp.ArgumentValueInvalidErrorCode, "bad bookmark of %q at %d", args.ObjectID, args.PosSecond)
+	}
+	return srv.bookmarks.set(bookmark{
+		IP:        requestClientIP(r),
+		UserAgent: r.UserAgent(),
+		Path:      p,
+		Position:  time.Duration(args.PosSecond) * time.Second,
+	})
+}
+
+// A bookmark in the API.
+type apiBookmark struct {
+	Client    string
+	UserAgent string
+	Path      string
+	// In seconds.
+	Position float64
+	Updated  time.Time
+}
+
+// Lists the bookmarks, those of the item with the path query parameter if it's given, or drops
+// the one of the client, User-Agent and path query parameters on DELETE.
+func (me *Server) serveAPIBookmarks(w http.ResponseWriter, r *http.Request) {
+	if !me.authorizeAPI(w, r, APIScopePlayback) {
+		return
+	}
+	q := r.URL.Query()
+	p := ""
+	if q.Get("path") != "" {
+		p = path.Clean("/" + decodeObjectPath(q.Get("path")))
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+	case "DELETE":
+		ok, err := me.bookmarks.clear(bookmarkKey{sessionKey{q.Get("client"), q.Get("ua")}, p})
+		if err != nil {
+			me.writeAPIError(w, r, err)
+			return
+		}
+		if !ok {
+			me.writeAPIError(w, r, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no bookmark of %q for %s %q", p, q.Get("client"), q.Get("ua")))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ret := []apiBookmark{}
+	for _, m := range me.bookmarks.list() {
+		if p != "" && m.Path != p {
+			continue
+		}
+		ret = append(ret, apiBookmark{
+			Client:    m.IP,
+			UserAgent: m.UserAgent,
+			Path:      m.Path,
+			Position:  m.Position.Seconds(),
+			Updated:   m.Updated,
+		})
+	}
+	me.writeAPIResponse(w, r, ret)
+}
@@ -0,0 +1,45 @@
+package dms
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestRequestRangeStart(t *testing.T) {
+	for h, want := range map[string]int64{
+		"":                  0,
+		"bytes=0-":          0,
+		"bytes=1000-":       1000,
+		"bytes=1000-1999":   1000,
+		"bytes=-500":        0,
+		"bytes=10-19,30-39": 10,
+	} {
+		r := httptest.NewRequest("GET", resPath, nil)
+		r.Header.Set("Range", h)
+		if got := requestRangeStart(r); got != want {
+			t.Errorf("%q: got %d, want %d", h, got, want)
+		}
+	}
+}
+
+func TestClientBookmarksArrange(t *testing.T) {
+	marks := clientBookmarks{"/Films/a.mkv": 754 * time.Second}
+	item := upnpav.Item{Object: upnpav.Object{ID: url.QueryEscape("/Films/a.mkv")}}
+	got := marks.arrange(item).(upnpav.Item)
+	if got.DCMInfo != "CREATIONDATE=0,FOLDER=Films,BM=754" {
+		t.Errorf("got %q", got.DCMInfo)
+	}
+	// As listed in Recently Played.
+	item = upnpav.Item{Object: upnpav.Object{ID: url.QueryEscape(recentlyPlayedPath + "/Films/a.mkv"), RefID: item.ID}}
+	if got := marks.arrange(item).(upnpav.Item); got.DCMInfo == "" {
+		t.Error("referring item not bookmarked")
+	}
+	item.ID, item.RefID = url.QueryEscape("/Films/b.mkv"), ""
+	if got := marks.arrange(item).(upnpav.Item); got.DCMInfo != "" {
+		t.Errorf("unplayed item bookmarked: %q", got.DCMInfo)
+	}
+}
@@ -3,7 +3,9 @@ package dms
 import (
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -13,9 +15,10 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/anacrolix/ffprobe"
 	"github.com/anacrolix/log"
+	"golang.org/x/text/collate"
 
 	"github.com/anacrolix/dms/dlna"
 	"github.com/anacrolix/dms/misc"
@@ -28,10 +31,11 @@ const dmsMetadataSuffix = ".dms.json"
 type contentDirectoryService struct {
 	*Server
 	upnp.Eventing
+	soapActions
 }
 
 func (cds *contentDirectoryService) updateIDString() string {
-	return fmt.Sprintf("%d", uint32(os.Getpid()))
+	return fmt.Sprintf("%d", cds.updateIDs.systemID())
 }
 
 type dmsDynamicStreamResource struct {
@@ -100,12 +104,12 @@ func (me *contentDirectoryService) cdsObjectDynamicStreamToUpnpavObject(cdsObjec
 	obj.AlbumArtURI = iconURI
 
 	switch dmsMediaItem.Type {
-		case "video":
-			obj.Class = "object.item.videoItem"
-		case "audio":
-			obj.Class = "object.item.audioItem"
-		default:
-			obj.Class = "object.item.videoItem"
+	case "video":
+		obj.Class = "object.item.videoItem"
+	case "audio":
+		obj.Class = "object.item.audioItem"
+	default:
+		obj.Class = "object.item.videoItem"
 	}
 
 	obj.Title = dmsMediaItem.Title
@@ -181,7 +185,7 @@ func (me *contentDirectoryService) cdsObjectToUpnpavObject(
 		return
 	}
 	isDmsMetadata := strings.HasSuffix(entryFilePath, dmsMetadataSuffix)
-	if !fileInfo.IsDir() && me.AllowDynamicStreams && isDmsMetadata {
+	if !fileInfo.IsDir() && me.settings().AllowDynamicStreams && isDmsMetadata {
 		return me.cdsObjectDynamicStreamToUpnpavObject(cdsObject, fileInfo, host, userAgent)
 	}
 
@@ -190,9 +194,13 @@ func (me *contentDirectoryService) cdsObjectToUpnpavObject(
 		Restricted: 1,
 		ParentID:   cdsObject.ParentID(),
 	}
+	if disc := me.discItem(cdsObject, fileInfo, host); disc != nil {
+		return disc, nil
+	}
 	if fileInfo.IsDir() {
 		obj.Class = "object.container.storageFolder"
 		obj.Title = fileInfo.Name()
+		obj.AlbumArtURI = folderArtURL(host, cdsObject.Path)
 		childCount := me.objectChildCount(cdsObject)
 		if childCount != 0 {
 			ret = upnpav.Container{Object: obj, ChildCount: childCount}
@@ -203,10 +211,22 @@ func (me *contentDirectoryService) cdsObjectToUpnpavObject(
 		me.Logger.Printf("%s ignored: non-regular file", cdsObject.FilePath())
 		return
 	}
-	mimeType, err := MimeTypeByPath(entryFilePath)
+	if isStreamURLFile(entryFilePath) {
+		return me.streamURLFileToUpnpavObject(cdsObject, fileInfo, host)
+	}
+	if isPlaylistFile(entryFilePath) {
+		return me.playlistContainer(cdsObject, fileInfo, host, userAgent)
+	}
+	if isArchiveFile(entryFilePath) {
+		return me.archiveContainer(cdsObject, fileInfo, host)
+	}
+	mimeType, err := me.mimeTypeByPath(entryFilePath)
 	if err != nil {
 		return
 	}
+	if cdsObject.root != nil && mimeType.IsMedia() && !cdsObject.root.allowsMediaType(mimeType.Type()) {
+		return
+	}
 	if !mimeType.IsMedia() {
 		if isDmsMetadata {
 			me.Logger.Levelf(
@@ -217,6 +237,11 @@ func (me *contentDirectoryService) cdsObjectToUpnpavObject(
 		}
 		return
 	}
+	incompleteFiles := me.incompleteFiles()
+	incomplete := incompleteFiles != IncompleteFilesServe && fileIncomplete(me.contentFS(), entryFilePath, fileInfo, time.Now())
+	if incomplete && incompleteFiles == IncompleteFilesHide {
+		return
+	}
 	iconURI := (&url.URL{
 		Scheme: "http",
 		Host:   host,
@@ -230,46 +255,62 @@ func (me *contentDirectoryService) cdsObjectToUpnpavObject(
 	// element.
 	obj.AlbumArtURI = iconURI
 	obj.Class = "object.item." + mimeType.Type() + "Item"
-	var (
-		ffInfo        *ffprobe.Info
-		nativeBitrate uint
-		resDuration   string
-	)
-	if !me.NoProbe {
-		ffInfo, probeErr := me.ffmpegProbe(entryFilePath)
-		switch probeErr {
-		case nil:
-			if ffInfo != nil {
-				nativeBitrate, _ = ffInfo.Bitrate()
-				if d, err := ffInfo.Duration(); err == nil {
-					resDuration = misc.FormatDurationSexagesimal(d)
-				}
-			}
-		case ffprobe.ExeNotFound:
-		default:
-			me.Logger.Printf("error probing %s: %s", entryFilePath, probeErr)
+	md := me.fileMetadata(entryFilePath, fileInfo, mimeType)
+	// A file still being written may only look truncated.
+	problemFiles := me.problemFiles()
+	unplayable := md.Problem != "" && !incomplete
+	if unplayable && problemFiles == ProblemFilesHide {
+		me.Logger.Levelf(log.Debug, "ignored %q: %s", cdsObject.FilePath(), md.Problem)
+		return
+	}
+	if mimeType.IsAudio() {
+		if book := fileAudiobook(cdsObject, fileInfo, md); book != nil {
+			obj.Class = "object.container.album"
+			obj.Title = book.title
+			obj.Artist = md.Artist
+			ret = upnpav.Container{Object: obj, ChildCount: len(me.audiobookItems(book, host))}
+			return
 		}
 	}
+	obj.Title = md.Title
 	if obj.Title == "" {
 		obj.Title = fileInfo.Name()
+	} else if md.Episode != 0 {
+		// TVs list episodes by title, which is only the episode's own in NFO files.
+		obj.Title = fmt.Sprintf("S%02dE%02d %s", md.Season, md.Episode, obj.Title)
+	}
+	if incomplete && incompleteFiles == IncompleteFilesMark {
+		obj.Title += " (" + me.localTitle(incompleteMark) + ")"
+	}
+	if unplayable && problemFiles == ProblemFilesMark {
+		obj.Title += " (" + me.localTitle(unplayableMark) + ")"
+	}
+	obj.Artist = md.Artist
+	obj.Album = md.Album
+	obj.Genre = md.Genre
+	obj.Description = md.Description
+	obj.Date = upnpav.Timestamp{Time: md.Date}
+	obj.SeriesTitle = md.Series
+	obj.EpisodeSeason = md.Season
+	obj.EpisodeNumber = md.Episode
+	if art := me.artworkURL(md.Artwork, host); art != "" {
+		obj.AlbumArtURI = art
+	}
+	nativeBitrate := md.Bitrate
+	var resDuration string
+	if md.Duration != 0 {
+		resDuration = misc.FormatDurationSexagesimal(md.Duration)
+	}
+	resolution := md.Resolution
+	// A file served while it grows has no size yet, and can only be read from the start.
+	size, supportRange := uint64(fileInfo.Size()), true
+	if incomplete && incompleteFiles == IncompleteFilesGrow {
+		size, supportRange = 0, false
 	}
-	resolution := func() string {
-		if ffInfo != nil {
-			for _, strm := range ffInfo.Streams {
-				if strm["codec_type"] != "video" {
-					continue
-				}
-				width := strm["width"]
-				height := strm["height"]
-				return fmt.Sprintf("%.0fx%.0f", width, height)
-			}
-		}
-		return ""
-	}()
 	item := upnpav.Item{
 		Object: obj,
-		// Capacity: 1 for raw, 1 for icon, plus transcodes.
-		Res: make([]upnpav.Resource, 0, 2+len(transcodes)),
+		// Capacity: 1 for raw, 1 for icon, plus transcodes, with L16 offered at two rates.
+		Res: make([]upnpav.Resource, 0, 2+len(transcodes)+len(audioTranscodes)+1),
 	}
 	item.Res = append(item.Res, upnpav.Resource{
 		URL: (&url.URL{
@@ -281,16 +322,27 @@ func (me *contentDirectoryService) cdsObjectToUpnpavObject(
 			}.Encode(),
 		}).String(),
 		ProtocolInfo: fmt.Sprintf("http-get:*:%s:%s", mimeType, dlna.ContentFeatures{
-			SupportRange: true,
+			ProfileName:  md.DLNAProfile,
+			SupportRange: supportRange,
 		}.String()),
-		Bitrate:    nativeBitrate,
-		Duration:   resDuration,
-		Size:       uint64(fileInfo.Size()),
-		Resolution: resolution,
+		Bitrate:         nativeBitrate,
+		Duration:        resDuration,
+		Size:            size,
+		Resolution:      resolution,
+		SampleFrequency: md.SampleRate,
+		NrAudioChannels: md.AudioChannels,
 	})
+	noTranscode := me.settings().NoTranscode
+	if mimeType.IsAudio() && !noTranscode {
+		if p, ok := me.audioProfile(userAgent); ok {
+			item.Res = p.resources(item.Res[0], host, cdsObject.Path, mimeType, *md, resDuration)
+		} else {
+			item.Res = append(item.Res, audioTranscodeResources(host, cdsObject.Path, mimeType, *md, resDuration)...)
+		}
+	}
 	if mimeType.IsVideo() {
-		if !me.NoTranscode {
-			item.Res = append(item.Res, transcodeResources(host, cdsObject.Path, resolution, resDuration)...)
+		if !noTranscode {
+			item.Res = append(item.Res, transcodeResources(host, resPath, cdsObject.Path, resolution, resDuration)...)
 		}
 		item.Res = append(item.Res, upnpav.Resource{
 			URL: (&url.URL{
@@ -304,6 +356,9 @@ func (me *contentDirectoryService) cdsObjectToUpnpavObject(
 			ProtocolInfo: "http-get:*:text/plain",
 		})
 	}
+	if scalableImage(mimeType) {
+		item.Res = append(item.Res, scaledImageResources(host, cdsObject.Path, *md)...)
+	}
 	if mimeType.IsVideo() || mimeType.IsImage() {
 		item.Res = append(item.Res, upnpav.Resource{
 			URL: (&url.URL{
@@ -327,35 +382,268 @@ func (me *contentDirectoryService) readContainer(
 	o object,
 	host, userAgent string,
 ) (ret []interface{}, err error) {
-	sfis := sortableFileInfoSlice{
-		// TODO(anacrolix): Dig up why this special cast was added.
-		FoldersLast: strings.Contains(userAgent, `AwoX/1.1`),
+	if o.Path == remoteStreamsPath {
+		return me.remoteStreamItems(host, userAgent), nil
+	}
+	if isPlacesPath(o.Path) {
+		return me.readPlacesContainer(o, host, userAgent)
+	}
+	if isRecentPath(o.Path) {
+		return me.readRecentContainer(o, host, userAgent)
+	}
+	if isClassPath(o.Path) {
+		return me.readClassContainer(o, host, userAgent)
+	}
+	if isShowsPath(o.Path) {
+		return me.readShowsContainer(o, host, userAgent)
+	}
+	if isWatchedPath(o.Path) {
+		return me.readWatchedContainer(o, host, userAgent)
+	}
+	if o.IsRoot() {
+		// The class, recent, watched, TV shows, streams and places containers come first, in the
+		// top level.
+		virtual := append(me.classContainerObjects(), me.recentContainers()...)
+		virtual = append(virtual, me.watchedContainers()...)
+		if c := me.showsContainer(); c != nil {
+			virtual = append(virtual, c)
+		}
+		if c := me.remoteStreamsContainer(); c != nil {
+			virtual = append(virtual, c)
+		}
+		if c := me.placesContainer(); c != nil {
+			virtual = append(virtual, c)
+		}
+		if len(virtual) != 0 {
+			defer func() {
+				if err == nil {
+					ret = append(virtual, ret...)
+				}
+			}()
+		}
+	}
+	if me.isRootDirsContainer(o) {
+		return me.rootDirContainers(host, userAgent), nil
+	}
+	fis, err := me.readObjectDir(o)
+	if errors.Is(err, errFSUnavailable) {
+		return nil, upnp.Errorf(upnp.ActionFailedErrorCode, err.Error())
 	}
-	sfis.fileInfoSlice, err = o.readDir()
 	if err != nil {
+		// Archives are containers of their entries, as are the folders within them.
+		if archiveObj, entry, ok := me.objectArchive(o); ok {
+			return me.archiveItems(o, archiveObj, entry, host)
+		}
+		// Playlist files are containers of their tracks.
+		if isPlaylistFile(o.Path) {
+			return me.playlistItems(o, host, userAgent)
+		}
+		// Audiobook files are containers of their chapters.
+		if book := me.objectAudiobook(o); book != nil {
+			return me.audiobookItems(book, host), nil
+		}
 		return
 	}
+	sfis := collatedFileInfoSlice(fis, me.collator())
+	// TODO(anacrolix): Dig up why this special cast was added.
+	sfis.FoldersLast = strings.Contains(userAgent, `AwoX/1.1`)
 	sort.Sort(sfis)
-	for _, fi := range sfis.fileInfoSlice {
-		child := object{path.Join(o.Path, fi.Name()), me.RootObjectPath}
+	if book := me.folderAudiobook(o, sfis.fileInfoSlice); book != nil {
+		return me.audiobookItems(book, host), nil
+	}
+	fis = sfis.fileInfoSlice
+	var alternates map[string][]os.FileInfo
+	if !me.settings().NoPhotoGrouping {
+		fis, alternates = groupPhotos(fis)
+	}
+	for _, fi := range fis {
+		child := o.child(fi.Name())
 		obj, err := me.cdsObjectToUpnpavObject(child, fi, host, userAgent)
 		if err != nil {
 			me.Logger.Printf("error with %s: %s", child.FilePath(), err)
 			continue
 		}
 		if obj != nil {
-			ret = append(ret, obj)
+			ret = append(ret, withPhotoAlternates(obj, o, alternates[fi.Name()], host))
 		}
 	}
 	return
 }
 
+// Returns the upnpav object for obj, as given to BrowseMetadata.
+func (me *contentDirectoryService) objectMetadata(obj object, host, userAgent string) (ret interface{}, err error) {
+	if me.OnBrowseMetadata != nil {
+		return me.OnBrowseMetadata(obj.Path, obj.RootObjectPath, host, userAgent)
+	}
+	if me.isRootDirsContainer(obj) {
+		return upnpav.Container{
+			Object: upnpav.Object{
+				ID:         obj.ID(),
+				ParentID:   obj.ParentID(),
+				Restricted: 1,
+				Class:      "object.container.storageFolder",
+				Title:      me.settings().FriendlyName,
+			},
+			ChildCount: len(me.sharedDirs().rootDirs) + me.classChildCount() + me.recentChildCount() + me.watchedChildCount() + me.showsChildCount() + me.remoteStreamsChildCount() + me.placesChildCount(),
+		}, nil
+	}
+	if obj.Path == remoteStreamsPath {
+		if c := me.remoteStreamsContainer(); c != nil {
+			return c, nil
+		}
+	}
+	if rs, i, ok := me.remoteStream(obj.Path); ok {
+		return me.remoteStreamItem(rs, i, host, userAgent), nil
+	}
+	if isRemoteStreamsPath(obj.Path) {
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such remote stream")
+	}
+	if isPlacesPath(obj.Path) {
+		return me.placesObject(obj, host, userAgent)
+	}
+	if isRecentPath(obj.Path) {
+		return me.recentObject(obj, host, userAgent)
+	}
+	if isClassPath(obj.Path) {
+		return me.classObject(obj, host, userAgent)
+	}
+	if isShowsPath(obj.Path) {
+		return me.showsObject(obj, host, userAgent)
+	}
+	if isWatchedPath(obj.Path) {
+		return me.watchedObject(obj, host, userAgent)
+	}
+	if item, ok := me.playlistItemObject(obj, host, userAgent); ok {
+		return item, nil
+	}
+	if item, ok := me.audiobookItemObject(obj, nil, host); ok {
+		return item, nil
+	}
+	if ret, ok := me.archiveItemObject(obj, host); ok {
+		return ret, nil
+	}
+	fileInfo, indexed := os.FileInfo(nil), false
+	if me.index != nil {
+		fileInfo, indexed = me.index.stat(obj.Path)
+	}
+	if !indexed {
+		fileInfo, err = me.statFS(obj.FilePath())
+	}
+	if err != nil {
+		if errors.Is(err, errFSUnavailable) {
+			return nil, upnp.Errorf(upnp.ActionFailedErrorCode, err.Error())
+		}
+		if os.IsNotExist(err) {
+			return nil, &upnp.Error{
+				Code: upnpav.NoSuchObjectErrorCode,
+				Desc: err.Error(),
+			}
+		}
+		return nil, err
+	}
+	ret, err = me.cdsObjectToUpnpavObject(obj, fileInfo, host, userAgent)
+	if err == nil && !me.settings().NoPhotoGrouping && isJPEG(fileInfo.Name()) {
+		parent := obj
+		parent.Path = path.Dir(obj.Path)
+		ret = withPhotoAlternates(ret, parent, me.photoAlternates(obj), host)
+	}
+	return
+}
+
+// Returns the upnpav objects within the container with the given ID that match the criteria, as
+// given to Search.
+func (me *contentDirectoryService) search(containerID, criteria string, host, userAgent string) ([]interface{}, error) {
+	// Searching the filesystem directly would be far too slow.
+	if me.index == nil {
+		return nil, upnp.InvalidActionError
+	}
+	crit, err := parseSearchCriteria(criteria)
+	if err != nil {
+		return nil, upnp.Errorf(upnpav.InvalidSearchCriteriaErrorCode, err.Error())
+	}
+	obj, err := me.objectFromID(containerID)
+	if err != nil {
+		return nil, upnp.Errorf(upnpav.NoSuchContainerErrorCode, err.Error())
+	}
+	return me.searchContainer(obj, crit, host, userAgent)
+}
+
+// Returns the upnpav objects in the container at obj, as given to BrowseDirectChildren.
+func (me *contentDirectoryService) directChildren(obj object, host, userAgent string) ([]interface{}, error) {
+	if me.OnBrowseDirectChildren != nil {
+		return me.OnBrowseDirectChildren(obj.Path, obj.RootObjectPath, host, userAgent)
+	}
+	return me.cachedContainer(obj, host, userAgent)
+}
+
+// Lists the directory at o, from the index if it's been scanned.
+func (me *Server) readObjectDir(o object) ([]os.FileInfo, error) {
+	if me.index != nil {
+		if fis, ok := me.index.readDir(o.Path); ok {
+			return fis, nil
+		}
+	}
+	return me.readDirFS(o)
+}
+
 type browse struct {
-	ObjectID       string
-	BrowseFlag     string
+	ObjectID       string `soap:"required"`
+	BrowseFlag     string `soap:"required"`
+	Filter         string
+	StartingIndex  int
+	RequestedCount int
+	SortCriteria   string
+}
+
+type search struct {
+	ContainerID    string `soap:"required"`
+	SearchCriteria string
 	Filter         string
 	StartingIndex  int
 	RequestedCount int
+	SortCriteria   string
+}
+
+// Returns the response arguments for the requested page of the results of a Browse or Search, with
+// the resources of audio items arranged for the renderer the request is from, the objects as the
+// client prefers, URLs and MIME types for the client with the User-Agent, and only the properties
+// in the filter.
+func (me *contentDirectoryService) resultPage(objs []interface{}, startingIndex, requestedCount int, sink rendererSink, prefs ClientPrefs, marks clientBookmarks, books clientAudiobooks, filter propertyFilter, userAgent string) ([]soapArg, error) {
+	objs = prefs.filter(objs)
+	totalMatches := len(objs)
+	if startingIndex > len(objs) {
+		startingIndex = len(objs)
+	}
+	objs = objs[startingIndex:]
+	if requestedCount != 0 && requestedCount < len(objs) {
+		objs = objs[:requestedCount]
+	}
+	mimeTypes := me.mimeTypeOverrides(userAgent)
+	watched := me.watchedMarks()
+	// The page's objects are encoded one at a time into the response as it's written, rather than
+	// into a document in memory first.
+	writeResult := func(w io.Writer) error {
+		if _, err := io.WriteString(w, didlLiteStart); err != nil {
+			return err
+		}
+		enc := xml.NewEncoder(w)
+		for _, obj := range objs {
+			if err := enc.Encode(sanitizeObject(filter.arrange(me.externalURLs(watched.arrange(marks.arrange(prefs.arrange(books.arrange(sink.arrange(mimeTypes.arrange(obj)))))), userAgent)))); err != nil {
+				return err
+			}
+		}
+		if err := enc.Flush(); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, didlLiteEnd)
+		return err
+	}
+	return []soapArg{
+		{Name: "Result", write: writeResult},
+		{Name: "NumberReturned", Value: fmt.Sprint(len(objs))},
+		{Name: "TotalMatches", Value: fmt.Sprint(totalMatches)},
+		{Name: "UpdateID", Value: me.updateIDString()},
+	}, nil
 }
 
 // ContentDirectory object from ObjectID.
@@ -364,139 +652,183 @@ func (me *contentDirectoryService) objectFromID(id string) (o object, err error)
 	if err != nil {
 		return
 	}
+	o.Path = decodeObjectPath(o.Path)
 	if o.Path == "0" {
 		o.Path = "/"
+	} else if p, ok := classContainerPath(o.Path); ok {
+		o.Path = p
 	}
 	o.Path = path.Clean(o.Path)
 	if !path.IsAbs(o.Path) {
 		err = fmt.Errorf("bad ObjectID %v", o.Path)
 		return
 	}
-	o.RootObjectPath = me.RootObjectPath
-	return
+	return me.objectFromPath(o.Path)
+}
+
+// Returns the actions of the ContentDirectory service.
+func (me *contentDirectoryService) actions() soapActions {
+	featureList := newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+		return []soapArg{{Name: "FeatureList", Value: me.featureList()}}, nil
+	})
+	return soapActions{
+		"GetSystemUpdateID": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			return []soapArg{{Name: "Id", Value: me.updateIDString()}}, nil
+		}),
+		"GetSortCapabilities": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			return []soapArg{{Name: "SortCaps", Value: sortCapabilities}}, nil
+		}),
+		"GetSearchCapabilities": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			searchCaps := ""
+			if me.index != nil {
+				searchCaps = searchCapabilities
+			}
+			return []soapArg{{Name: "SearchCaps", Value: searchCaps}}, nil
+		}),
+		"Browse":         newSOAPAction(me.handleBrowse),
+		"Search":         newSOAPAction(me.handleSearch),
+		"GetFeatureList": featureList,
+		// Samsung Extensions
+		"X_GetFeatureList": featureList,
+		"X_SetBookmark": newSOAPAction(func(args *setBookmark, r *http.Request) ([]soapArg, error) {
+			return []soapArg{}, me.setBookmark(r, args)
+		}),
+		"CreateObject": newSOAPAction(func(args *createObject, r *http.Request) ([]soapArg, error) {
+			return me.createObject(args, r.Host)
+		}),
+		"DestroyObject": newSOAPAction(func(args *destroyObject, r *http.Request) ([]soapArg, error) {
+			return []soapArg{}, me.destroyObject(args, r)
+		}),
+		"ImportResource": newSOAPAction(me.importResource),
+		"GetTransferProgress": newSOAPAction(func(args *transferID, r *http.Request) ([]soapArg, error) {
+			return me.getTransferProgress(args)
+		}),
+		"StopTransferResource": newSOAPAction(func(args *transferID, r *http.Request) ([]soapArg, error) {
+			return me.stopTransferResource(args)
+		}),
+	}
 }
 
-func (me *contentDirectoryService) Handle(action string, argsXML []byte, r *http.Request) ([][2]string, error) {
+// Handles Browse, whose results can be too large to build in memory, such as those of containers
+// of tens of thousands of items, so they're written to the response as they're encoded.
+func (me *contentDirectoryService) handleBrowse(browse *browse, r *http.Request) ([]soapArg, error) {
 	host := r.Host
 	userAgent := r.UserAgent()
-	switch action {
-	case "GetSystemUpdateID":
-		return [][2]string{
-			{"Id", me.updateIDString()},
-		}, nil
-	case "GetSortCapabilities":
-		return [][2]string{
-			{"SortCaps", "dc:title"},
-		}, nil
-	case "Browse":
-		var browse browse
-		if err := xml.Unmarshal([]byte(argsXML), &browse); err != nil {
-			return nil, err
+	sink := me.rendererSink(r)
+	prefs := me.requestClientPrefs(r)
+	marks := me.requestBookmarks(r)
+	books := me.requestAudiobooks(r)
+	if browse.StartingIndex < 0 || browse.RequestedCount < 0 {
+		return nil, upnp.Errorf(upnp.InvalidArgsErrorCode, "Invalid Args: negative StartingIndex or RequestedCount")
+	}
+	sortKeys, err := parseSortCriteria(browse.SortCriteria)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := me.objectFromID(browse.ObjectID)
+	if err != nil {
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, err.Error())
+	}
+	if !prefs.allowed(obj.Path) {
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "not in the containers the client may browse")
+	}
+	switch browse.BrowseFlag {
+	case "BrowseDirectChildren":
+		// Renderers browse the same pages over and over, and the recent and watched containers
+		// change with streams.
+		cacheable := me.OnBrowseDirectChildren == nil && !isRecentPath(obj.Path) && !isWatchedPath(obj.Path)
+		key := me.didlCacheKey(obj, browse, r, sink, prefs, marks, books)
+		updateID, modTime, now := me.updateIDs.systemID(), containerModTime(me.contentFS(), obj), time.Now()
+		if cacheable {
+			args, ok := me.didlCache.get(key, updateID, modTime, now)
+			me.metrics.cacheLookup("didl", ok)
+			if ok {
+				return args, nil
+			}
 		}
-		obj, err := me.objectFromID(browse.ObjectID)
+		objs, err := me.directChildren(obj, host, userAgent)
 		if err != nil {
 			return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, err.Error())
 		}
-		switch browse.BrowseFlag {
-		case "BrowseDirectChildren":
-			var objs []interface{}
-			if me.OnBrowseDirectChildren == nil {
-				objs, err = me.readContainer(obj, host, userAgent)
-			} else {
-				objs, err = me.OnBrowseDirectChildren(obj.Path, obj.RootObjectPath, host, userAgent)
-			}
-			if err != nil {
-				return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, err.Error())
-			}
-			totalMatches := len(objs)
-			objs = objs[func() (low int) {
-				low = browse.StartingIndex
-				if low > len(objs) {
-					low = len(objs)
-				}
-				return
-			}():]
-			if browse.RequestedCount != 0 && int(browse.RequestedCount) < len(objs) {
-				objs = objs[:browse.RequestedCount]
-			}
-			result, err := xml.Marshal(objs)
-			if err != nil {
-				return nil, err
-			}
-			return [][2]string{
-				{"Result", didl_lite(string(result))},
-				{"NumberReturned", fmt.Sprint(len(objs))},
-				{"TotalMatches", fmt.Sprint(totalMatches)},
-				{"UpdateID", me.updateIDString()},
-			}, nil
-		case "BrowseMetadata":
-			var ret interface{}
-			var err error
-			if me.OnBrowseMetadata == nil {
-				var fileInfo os.FileInfo
-				fileInfo, err = os.Stat(obj.FilePath())
-				if err != nil {
-					if os.IsNotExist(err) {
-						return nil, &upnp.Error{
-							Code: upnpav.NoSuchObjectErrorCode,
-							Desc: err.Error(),
-						}
-					}
-					return nil, err
-				}
-				ret, err = me.cdsObjectToUpnpavObject(obj, fileInfo, host, userAgent)
-			} else {
-				ret, err = me.OnBrowseMetadata(obj.Path, obj.RootObjectPath, host, userAgent)
-			}
-			if err != nil {
-				return nil, err
+		objs = me.clientAudiobookItems(obj, objs, books, host)
+		objs = me.sortObjects(objs, sortKeys)
+		if me.settings().PrefetchBrowse && me.OnBrowseDirectChildren == nil {
+			me.prefetchContainers(objs, browse.StartingIndex, browse.RequestedCount, host, userAgent)
+		}
+		args, err := me.resultPage(objs, browse.StartingIndex, browse.RequestedCount, sink, prefs, marks, books, parsePropertyFilter(browse.Filter), userAgent)
+		if err != nil || !cacheable {
+			return args, err
+		}
+		return me.didlCache.keep(key, args, updateID, modTime, now), nil
+	case "BrowseMetadata":
+		ret, err := me.objectMetadata(obj, host, userAgent)
+		if err != nil && path.Base(obj.Path) == audiobookResumeName {
+			// Only the clients that have started a book have an item resuming it.
+			if item, ok := me.audiobookItemObject(obj, books, host); ok {
+				ret, err = item, nil
 			}
-			buf, err := xml.Marshal(ret)
-			if err != nil {
-				return nil, err
+		}
+		if err != nil {
+			return nil, err
+		}
+		if prefs.hidden(obj.Path) && !obj.IsRoot() || prefs.refersToLocked(ret) {
+			return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "hidden")
+		}
+		// The top level is counted without the containers the client hides, as are those above
+		// the containers it's limited to.
+		if c, ok := ret.(upnpav.Container); ok && (obj.IsRoot() && len(prefs.HiddenContainers) != 0 || prefs.above(obj.Path)) {
+			if objs, err := me.directChildren(obj, host, userAgent); err == nil {
+				c.ChildCount = len(prefs.filter(objs))
+				ret = c
 			}
-			return [][2]string{
-				{"Result", didl_lite(func() string { return string(buf) }())},
-				{"NumberReturned", "1"},
-				{"TotalMatches", "1"},
-				{"UpdateID", me.updateIDString()},
-			}, nil
-		default:
-			return nil, upnp.Errorf(
-				upnp.ArgumentValueInvalidErrorCode,
-				"unhandled browse flag: %v",
-				browse.BrowseFlag,
-			)
 		}
-	case "GetSearchCapabilities":
-		return [][2]string{
-			{"SearchCaps", ""},
-		}, nil
-	// Samsung Extensions
-	case "X_GetFeatureList":
-		// TODO: make it dependable on model
-		// https://github.com/1100101/minidlna/blob/ca6dbba18390ad6f8b8d7b7dbcf797dbfd95e2db/upnpsoap.c#L2153-L2199
-		return [][2]string{
-			{"FeatureList", `<Features xmlns="urn:schemas-upnp-org:av:avs" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:schemaLocation="urn:schemas-upnp-org:av:avs http://www.upnp.org/schemas/av/avs.xsd">
-	<Feature name="samsung.com_BASICVIEW" version="1">
-		<container id="0" type="object.item.audioItem"/> // "A"
-		<container id="0" type="object.item.videoItem"/> // "V"
-		<container id="0" type="object.item.imageItem"/> // "I"
-	</Feature>
-</Features>`},
+		buf, err := xml.Marshal(sanitizeObject(parsePropertyFilter(browse.Filter).arrange(me.externalURLs(me.watchedMarks().arrange(marks.arrange(prefs.arrange(books.arrange(sink.arrange(me.mimeTypeOverrides(userAgent).arrange(ret)))))), userAgent))))
+		if err != nil {
+			return nil, err
+		}
+		return []soapArg{
+			{Name: "Result", Value: didl_lite(string(buf))},
+			{Name: "NumberReturned", Value: "1"},
+			{Name: "TotalMatches", Value: "1"},
+			{Name: "UpdateID", Value: me.updateIDString()},
 		}, nil
-	case "X_SetBookmark":
-		// just ignore
-		return [][2]string{}, nil
 	default:
-		return nil, upnp.InvalidActionError
+		return nil, upnp.Errorf(
+			upnp.ArgumentValueInvalidErrorCode,
+			"unhandled browse flag: %v",
+			browse.BrowseFlag,
+		)
 	}
 }
 
+// Handles Search, whose results are written to the response as they're encoded, as Browse's are.
+func (me *contentDirectoryService) handleSearch(search *search, r *http.Request) ([]soapArg, error) {
+	if search.StartingIndex < 0 || search.RequestedCount < 0 {
+		return nil, upnp.Errorf(upnp.InvalidArgsErrorCode, "Invalid Args: negative StartingIndex or RequestedCount")
+	}
+	sortKeys, err := parseSortCriteria(search.SortCriteria)
+	if err != nil {
+		return nil, err
+	}
+	objs, err := me.search(search.ContainerID, search.SearchCriteria, r.Host, r.UserAgent())
+	if err != nil {
+		return nil, err
+	}
+	return me.resultPage(me.sortObjects(objs, sortKeys), search.StartingIndex, search.RequestedCount, me.rendererSink(r), me.requestClientPrefs(r), me.requestBookmarks(r), me.requestAudiobooks(r), parsePropertyFilter(search.Filter), r.UserAgent())
+}
+
 // Represents a ContentDirectory object.
 type object struct {
 	Path           string // The cleaned, absolute path for the object relative to the server.
 	RootObjectPath string
+	// The root dir containing the object, if the server has several. Its name is the first element
+	// of Path.
+	root *RootDir
+}
+
+func (o object) child(name string) object {
+	o.Path = path.Join(o.Path, name)
+	return o
 }
 
 // Returns the number of children this object has, such as for a container.
@@ -514,10 +846,17 @@ func (cds *contentDirectoryService) objectHasChildren(obj object) bool {
 
 // Returns the actual local filesystem path for the object.
 func (o *object) FilePath() string {
-	return filepath.Join(o.RootObjectPath, filepath.FromSlash(o.Path))
+	p := o.Path
+	if o.root != nil {
+		_, p = splitRootPath(p)
+	}
+	return filepath.Join(o.RootObjectPath, filepath.FromSlash(p))
 }
 
-// Returns the ObjectID for the object. This is used in various ContentDirectory actions.
+// Returns the ObjectID for the object. This is used in various ContentDirectory actions. It's the
+// escaped object path, encoded first if it needs it, so it's the same across restarts for renderers
+// that keep IDs, such as to resume playback or in favourites, and nothing needs to be kept to map it
+// back. Renaming a file changes it.
 func (o object) ID() string {
 	if !path.IsAbs(o.Path) {
 		log.Panicf("Relative object path: %s", o.Path)
@@ -525,7 +864,10 @@ func (o object) ID() string {
 	if len(o.Path) == 1 {
 		return "0"
 	}
-	return url.QueryEscape(o.Path)
+	if id, ok := classContainerID(o.Path); ok {
+		return id
+	}
+	return url.QueryEscape(encodeObjectPath(o.Path))
 }
 
 func (o *object) IsRoot() bool {
@@ -542,34 +884,20 @@ func (o object) ParentID() string {
 	return o.ID()
 }
 
-// This function exists rather than just calling os.(*File).Readdir because I
-// want to stat(), not lstat() each entry.
-func (o *object) readDir() (fis []os.FileInfo, err error) {
-	dirPath := o.FilePath()
-	dirFile, err := os.Open(dirPath)
-	if err != nil {
-		return
-	}
-	defer dirFile.Close()
-	var dirContent []string
-	dirContent, err = dirFile.Readdirnames(-1)
-	if err != nil {
-		return
-	}
-	fis = make([]os.FileInfo, 0, len(dirContent))
-	for _, file := range dirContent {
-		fi, err := os.Stat(filepath.Join(dirPath, file))
-		if err != nil {
-			continue
-		}
-		fis = append(fis, fi)
-	}
-	return
-}
-
 type sortableFileInfoSlice struct {
 	fileInfoSlice []os.FileInfo
 	FoldersLast   bool
+	// Collation keys of the names, if they're collated rather than compared in lower case.
+	keys [][]byte
+}
+
+// Returns the file infos to be sorted by their names as collated by c.
+func collatedFileInfoSlice(fis []os.FileInfo, c *collate.Collator) sortableFileInfoSlice {
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return sortableFileInfoSlice{fileInfoSlice: fis, keys: collationKeys(c, names)}
 }
 
 func (me sortableFileInfoSlice) Len() int {
@@ -583,9 +911,15 @@ func (me sortableFileInfoSlice) Less(i, j int) bool {
 	if !me.fileInfoSlice[i].IsDir() && me.fileInfoSlice[j].IsDir() {
 		return me.FoldersLast
 	}
+	if me.keys != nil {
+		return collatedLess(me.keys[i], me.keys[j], me.fileInfoSlice[i].Name(), me.fileInfoSlice[j].Name())
+	}
 	return strings.ToLower(me.fileInfoSlice[i].Name()) < strings.ToLower(me.fileInfoSlice[j].Name())
 }
 
 func (me sortableFileInfoSlice) Swap(i, j int) {
 	me.fileInfoSlice[i], me.fileInfoSlice[j] = me.fileInfoSlice[j], me.fileInfoSlice[i]
+	if me.keys != nil {
+		me.keys[i], me.keys[j] = me.keys[j], me.keys[i]
+	}
 }
@@ -26,3 +26,31 @@ func TestRootParentObjectID(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestObjectIDRoundTrip(t *testing.T) {
+	cds := &contentDirectoryService{Server: &Server{RootObjectPath: "/media"}}
+	for _, p := range []string{
+		"/Films/Heat (1995).mkv", "/50% off/a+b #1?.mp3", "/Musique/Café.flac",
+		// Names that aren't UTF-8, or have control characters, which are encoded.
+		"/Musique/Caf\xe9.flac", "/Films/a\x01b\n.mkv", "/Caf\xe9/Heat.mkv",
+	} {
+		id := (object{Path: p}).ID()
+		o, err := cds.objectFromID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o.Path != p || o.ID() != id {
+			t.Fatalf("ID %q of %q is the object %q", id, p, o.Path)
+		}
+		if objectIDPath(id) != p {
+			t.Fatalf("ID %q has the path %q", id, objectIDPath(id))
+		}
+		if objectPathNeedsEncoding(p) && strings.ContainsAny(id, "%+") {
+			t.Fatalf("ID %q of %q is escaped", id, p)
+		}
+	}
+	// Other IDs are as they've always been.
+	if id := (object{Path: "/Films/Heat (1995).mkv"}).ID(); id != "%2FFilms%2FHeat+%281995%29.mkv" {
+		t.Fatalf("ID %q", id)
+	}
+}
@@ -0,0 +1,179 @@
+package dms
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// The containers of all the media in the index of each class, in the order they're listed in the
+// top level. Directories of the same names in the shared directory are hidden by them. Their
+// ObjectIDs are those many servers give them, which control points such as the Xbox 360 browse
+// without listing the top level first, and which GetFeatureList gives Samsung TVs.
+var classContainers = []struct {
+	path, id string
+	// The type of the MIME type of the media, as in RootDir.MediaTypes.
+	mediaType string
+	// The upnp:class the items are derived from.
+	class string
+	title string
+}{
+	{"/@music", "1", "audio", "object.item.audioItem", "Music"},
+	{"/@videos", "2", "video", "object.item.videoItem", "Videos"},
+	{"/@photos", "3", "image", "object.item.imageItem", "Photos"},
+}
+
+// The media in the index by type, from a scan of it. It's kept a while like the places, since the
+// top level container needs to know if there's any every time it's browsed.
+type classMediaCache struct {
+	mu sync.Mutex
+	// Object paths of the files, by the type of their media.
+	byType  map[string][]string
+	expires time.Time
+}
+
+// Drops the media, such as when the shared directories change.
+func (me *classMediaCache) clear() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.byType = nil
+}
+
+// Whether the class containers are listed, which needs the index.
+func (srv *Server) classContainersListed() bool {
+	return srv.settings().ClassContainers && srv.index != nil
+}
+
+// Whether the object path is one of the class containers or within them.
+func isClassPath(p string) bool {
+	for _, c := range classContainers {
+		if p == c.path || strings.HasPrefix(p, c.path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the fixed ObjectID of the object path, if it's of a class container.
+func classContainerID(p string) (string, bool) {
+	for _, c := range classContainers {
+		if p == c.path {
+			return c.id, true
+		}
+	}
+	return "", false
+}
+
+// Returns the object path of the class container with the fixed ObjectID.
+func classContainerPath(id string) (string, bool) {
+	for _, c := range classContainers {
+		if id == c.id {
+			return c.path, true
+		}
+	}
+	return "", false
+}
+
+// Returns the object paths of the media in the index by type.
+func (srv *Server) classMedia() map[string][]string {
+	c := &srv.classMediaCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.byType != nil && now.Before(c.expires) {
+		return c.byType
+	}
+	ret := make(map[string][]string)
+	err := srv.index.forEachEntry("/", true, func(dir string, e *indexEntry) bool {
+		if !e.Mode.IsRegular() {
+			return true
+		}
+		mt, err := MimeTypeByPath(e.Name)
+		if err != nil || !mt.IsMedia() {
+			return true
+		}
+		ret[mt.Type()] = append(ret[mt.Type()], path.Join(dir, e.Name))
+		return true
+	})
+	if err != nil {
+		srv.Logger.Printf("error listing media by class: %v", err)
+		return nil
+	}
+	c.byType, c.expires = ret, now.Add(browseCacheTTL)
+	return ret
+}
+
+// Returns the container of the class at index i of classContainers.
+func (me *contentDirectoryService) classContainer(i int, byType map[string][]string) upnpav.Container {
+	c := classContainers[i]
+	o := object{Path: c.path}
+	return upnpav.Container{
+		Object: upnpav.Object{
+			ID:         o.ID(),
+			ParentID:   o.ParentID(),
+			Restricted: 1,
+			Class:      "object.container",
+			Title:      me.localTitle(c.title),
+		},
+		ChildCount: len(byType[c.mediaType]),
+	}
+}
+
+// Returns the class containers that have anything in them, for the top level.
+func (me *contentDirectoryService) classContainerObjects() (ret []interface{}) {
+	if !me.classContainersListed() {
+		return nil
+	}
+	byType := me.classMedia()
+	for i, c := range classContainers {
+		if len(byType[c.mediaType]) != 0 {
+			ret = append(ret, me.classContainer(i, byType))
+		}
+	}
+	return
+}
+
+// Returns the number of top level objects the class containers add.
+func (me *contentDirectoryService) classChildCount() int {
+	return len(me.classContainerObjects())
+}
+
+// Returns the items of the class container at o, by title.
+func (me *contentDirectoryService) readClassContainer(o object, host, userAgent string) ([]interface{}, error) {
+	if me.classContainersListed() {
+		for _, c := range classContainers {
+			if o.Path != c.path {
+				continue
+			}
+			var ret []interface{}
+			for _, p := range me.classMedia()[c.mediaType] {
+				if item, ok := me.referringItem(o.Path, p, host, userAgent); ok && strings.HasPrefix(item.(upnpav.Item).Class, c.class) {
+					ret = append(ret, item)
+				}
+			}
+			return me.sortObjects(ret, []sortKey{{property: "dc:title"}}), nil
+		}
+	}
+	return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such class container")
+}
+
+// Returns the object for an object path within the class containers, as given to BrowseMetadata.
+func (me *contentDirectoryService) classObject(o object, host, userAgent string) (interface{}, error) {
+	if me.classContainersListed() {
+		for i, c := range classContainers {
+			if o.Path == c.path {
+				return me.classContainer(i, me.classMedia()), nil
+			}
+			if mediaPath := strings.TrimPrefix(o.Path, c.path); mediaPath != o.Path {
+				if item, ok := me.referringItem(c.path, mediaPath, host, userAgent); ok && strings.HasPrefix(item.(upnpav.Item).Class, c.class) {
+					return item, nil
+				}
+			}
+		}
+	}
+	return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such class container or media")
+}
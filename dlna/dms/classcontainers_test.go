@@ -0,0 +1,25 @@
+package dms
+
+import (
+	"testing"
+)
+
+func TestClassContainerIDs(t *testing.T) {
+	cds := &contentDirectoryService{Server: &Server{}}
+	for p, id := range map[string]string{
+		"/@music":  "1",
+		"/@videos": "2",
+		"/@photos": "3",
+	} {
+		o := object{Path: p}
+		if o.ID() != id || o.ParentID() != "0" {
+			t.Errorf("%s: got ID %q, parent %q", p, o.ID(), o.ParentID())
+		}
+		if got, err := cds.objectFromID(id); err != nil || got.Path != p {
+			t.Errorf("%s: got %v, %v", id, got, err)
+		}
+	}
+	if !isClassPath("/@videos/Films/Heat.mkv") || isClassPath("/@videos2") {
+		t.Error("isClassPath")
+	}
+}
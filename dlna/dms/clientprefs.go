@@ -0,0 +1,391 @@
+package dms
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+const clientsPath = "/clients"
+
+// Title formats for ClientPrefs.TitleFormat.
+const (
+	// Items are titled from their metadata, falling back to the file name.
+	titleFormatTitle = ""
+	// Items are titled with their file names.
+	titleFormatFileName = "filename"
+)
+
+// Such as "en" or "pt-BR", as subtitle files are named for, such as Film.pt-BR.srt.
+var subtitleLanguageRegexp = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]+)*$`)
+
+// Display settings for a client, set in the web UI and applied to its requests. Like sessions,
+// clients are identified by their address and User-Agent.
+type ClientPrefs struct {
+	IP        string
+	UserAgent string
+	// The transcode listed first, such as "chromecast" or "mp3", for renderers that play the
+	// first resource they're given.
+	Transcode string `json:",omitempty"`
+	// Subtitles in this language, such as "en" for Film.en.srt, are served instead of Film.srt
+	// where there are any.
+	SubtitleLanguage string `json:",omitempty"`
+	// "filename" titles items with their file names rather than their metadata.
+	TitleFormat string `json:",omitempty"`
+	// Object paths of containers that aren't listed, such as "/@places".
+	HiddenContainers []string `json:",omitempty"`
+	Updated          time.Time
+	// The only containers the client may browse, from the ClientRules, if it's limited.
+	containers []string
+	// The ProtectedContainers, unless the client is unlocked.
+	locked []string
+}
+
+func (me ClientPrefs) key() sessionKey {
+	return sessionKey{me.IP, me.UserAgent}
+}
+
+// Returns the names of the transcodes a client may prefer, the video ones first.
+func clientPrefsTranscodes() (ret []string) {
+	for k := range transcodes {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	for _, at := range audioTranscodes {
+		ret = append(ret, at.name)
+	}
+	return
+}
+
+func (me ClientPrefs) check() error {
+	if me.Transcode != "" {
+		if _, ok := transcodes[me.Transcode]; !ok {
+			if _, ok := findAudioTranscode(me.Transcode); !ok {
+				return fmt.Errorf("unknown transcode %q", me.Transcode)
+			}
+		}
+	}
+	if me.SubtitleLanguage != "" && !subtitleLanguageRegexp.MatchString(me.SubtitleLanguage) {
+		return fmt.Errorf("bad subtitle language %q", me.SubtitleLanguage)
+	}
+	if me.TitleFormat != titleFormatTitle && me.TitleFormat != titleFormatFileName {
+		return fmt.Errorf("unknown title format %q", me.TitleFormat)
+	}
+	for _, h := range me.HiddenContainers {
+		if !path.IsAbs(h) || path.Clean(h) != h || h == "/" {
+			return fmt.Errorf("bad container to hide %q", h)
+		}
+	}
+	return nil
+}
+
+// Returns the object path of an ObjectID.
+func objectIDPath(id string) string {
+	if id == "0" {
+		return "/"
+	}
+	p, err := url.QueryUnescape(id)
+	if err != nil {
+		return ""
+	}
+	return path.Clean(decodeObjectPath(p))
+}
+
+// Whether the object at the path is within a hidden container, or is one, or isn't allowed.
+func (me ClientPrefs) hidden(objectPath string) bool {
+	if !me.allowed(objectPath) {
+		return true
+	}
+	for _, h := range me.HiddenContainers {
+		if objectPath == h || strings.HasPrefix(objectPath, h+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the objects that aren't hidden.
+func (me ClientPrefs) filter(objs []interface{}) []interface{} {
+	if len(me.HiddenContainers) == 0 && len(me.containers) == 0 && len(me.locked) == 0 {
+		return objs
+	}
+	ret := make([]interface{}, 0, len(objs))
+	for _, obj := range objs {
+		var id string
+		switch obj := obj.(type) {
+		case upnpav.Container:
+			id = obj.ID
+		case upnpav.Item:
+			id = obj.ID
+		}
+		if !me.hidden(objectIDPath(id)) && !me.refersToLocked(obj) {
+			ret = append(ret, obj)
+		}
+	}
+	return ret
+}
+
+// Returns obj titled and with its resources ordered as preferred, and locked containers empty.
+// Objects are cached, so they're copied rather than changed.
+func (me ClientPrefs) arrange(obj interface{}) interface{} {
+	if c, ok := obj.(upnpav.Container); ok && me.isLocked(objectIDPath(c.ID)) {
+		c.ChildCount = 0
+		return c
+	}
+	item, ok := obj.(upnpav.Item)
+	if !ok {
+		return obj
+	}
+	if me.TitleFormat == titleFormatFileName {
+		name := path.Base(objectIDPath(item.ID))
+		// Chapters of audiobooks and the like aren't files.
+		if mt, err := MimeTypeByPath(name); err == nil && mt.IsMedia() {
+			item.Title = name
+		}
+	}
+	if me.Transcode != "" {
+		res := make([]upnpav.Resource, 0, len(item.Res))
+		for _, r := range item.Res {
+			if resourceTranscode(r) == me.Transcode {
+				res = append(res, r)
+			}
+		}
+		for _, r := range item.Res {
+			if resourceTranscode(r) != me.Transcode {
+				res = append(res, r)
+			}
+		}
+		item.Res = res
+	}
+	return item
+}
+
+// Returns the transcode a resource is served with, or "" if it's the file as it is.
+func resourceTranscode(r upnpav.Resource) string {
+	u, err := url.Parse(r.URL)
+	if err != nil || u.Path != resPath {
+		return ""
+	}
+	return u.Query().Get("transcode")
+}
+
+// Preferences of clients, persisted in a file.
+type clientPrefsStore struct {
+	mu sync.Mutex
+	// File the preferences are persisted in, if any.
+	path  string
+	prefs map[sessionKey]ClientPrefs
+}
+
+func (me *clientPrefsStore) load(path string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.path = path
+	me.prefs = make(map[sessionKey]ClientPrefs)
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var prefs []ClientPrefs
+	if err := json.Unmarshal(b, &prefs); err != nil {
+		return err
+	}
+	for _, p := range prefs {
+		me.prefs[p.key()] = p
+	}
+	return nil
+}
+
+func (me *clientPrefsStore) get(key sessionKey) (ClientPrefs, bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	p, ok := me.prefs[key]
+	return p, ok
+}
+
+func (me *clientPrefsStore) set(p ClientPrefs) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	p.Updated = time.Now()
+	me.prefs[p.key()] = p
+	return me.save()
+}
+
+func (me *clientPrefsStore) clear(key sessionKey) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	delete(me.prefs, key)
+	return me.save()
+}
+
+// Returns the preferences, by IP and User-Agent.
+func (me *clientPrefsStore) list() []ClientPrefs {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.sorted()
+}
+
+func (me *clientPrefsStore) sorted() (ret []ClientPrefs) {
+	ret = make([]ClientPrefs, 0, len(me.prefs))
+	for _, p := range me.prefs {
+		ret = append(ret, p)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].IP != ret[j].IP {
+			return ret[i].IP < ret[j].IP
+		}
+		return ret[i].UserAgent < ret[j].UserAgent
+	})
+	return
+}
+
+func (me *clientPrefsStore) save() error {
+	if me.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(me.sorted(), "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(me.path), 0o750); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(me.path), filepath.Base(me.path))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), me.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Returns the preferences of the client making the request, which are empty if it has none.
+func (srv *Server) requestClientPrefs(r *http.Request) ClientPrefs {
+	p, _ := srv.clientPrefs.get(sessionKey{requestClientIP(r), r.UserAgent()})
+	p.containers = srv.clientContainers(requestClientIP(r), r.UserAgent())
+	p.locked = srv.lockedContainers(requestClientIP(r), time.Now())
+	return p
+}
+
+// A client on the clients page, with the preferences it has, if any.
+type clientsPageClient struct {
+	ClientPrefs
+	HasPrefs bool
+}
+
+// Returns the clients that have preferences or were seen recently, by IP and User-Agent.
+func (srv *Server) clientsPageClients() (ret []clientsPageClient) {
+	seen := make(map[sessionKey]bool)
+	for _, p := range srv.clientPrefs.list() {
+		ret = append(ret, clientsPageClient{p, true})
+		seen[p.key()] = true
+	}
+	for _, cs := range srv.sessions.recent(time.Now()) {
+		if !seen[cs.sessionKey] {
+			ret = append(ret, clientsPageClient{ClientPrefs: ClientPrefs{IP: cs.IP, UserAgent: cs.UserAgent}})
+			seen[cs.sessionKey] = true
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].IP != ret[j].IP {
+			return ret[i].IP < ret[j].IP
+		}
+		return ret[i].UserAgent < ret[j].UserAgent
+	})
+	return
+}
+
+// A container that can be hidden from a client, from the top level.
+type clientsPageContainer struct {
+	Path, Title string
+	Hidden      bool
+}
+
+// Lists the clients, and lets the display preferences of one be set.
+func (srv *Server) serveClients(w http.ResponseWriter, r *http.Request) {
+	if !srv.authorizeAPI(w, r, APIScopeAdmin) {
+		return
+	}
+	q := r.URL.Query()
+	key := sessionKey{q.Get("ip"), q.Get("ua")}
+	data := struct {
+		Clients    []clientsPageClient
+		Client     *ClientPrefs
+		Transcodes []string
+		Containers []clientsPageContainer
+		Saved      bool
+		Error      error
+	}{
+		Transcodes: clientPrefsTranscodes(),
+	}
+	if key.IP != "" {
+		p, ok := srv.clientPrefs.get(key)
+		if !ok {
+			p = ClientPrefs{IP: key.IP, UserAgent: key.UserAgent}
+		}
+		if r.Method == "POST" {
+			if !SameOrigin(r) {
+				http.Error(w, "cross-origin request", http.StatusForbidden)
+				return
+			}
+			if r.FormValue("forget") != "" {
+				data.Error = srv.clientPrefs.clear(key)
+				p = ClientPrefs{IP: key.IP, UserAgent: key.UserAgent}
+			} else {
+				p.Transcode = r.FormValue("transcode")
+				p.SubtitleLanguage = strings.TrimSpace(r.FormValue("subtitleLanguage"))
+				p.TitleFormat = r.FormValue("titleFormat")
+				p.HiddenContainers = r.Form["hide"]
+				if data.Error = p.check(); data.Error == nil {
+					data.Error = srv.clientPrefs.set(p)
+				}
+			}
+			if data.Error == nil {
+				data.Saved = true
+				srv.requestLogger(r).Printf("set display preferences of %s %q", key.IP, key.UserAgent)
+			}
+		}
+		data.Client = &p
+		// The top level as the client sees it, without what it hides.
+		cds := srv.services["ContentDirectory"].(*contentDirectoryService)
+		if root, err := cds.objectFromPath("/"); err == nil {
+			objs, _ := cds.directChildren(root, srv.dlnaHost(r), key.UserAgent)
+			for _, obj := range objs {
+				if c, ok := obj.(upnpav.Container); ok {
+					p := objectIDPath(c.ID)
+					data.Containers = append(data.Containers, clientsPageContainer{p, c.Title, data.Client.hidden(p)})
+				}
+			}
+		}
+	}
+	data.Clients = srv.clientsPageClients()
+	w.Header().Set("content-type", "text/html")
+	if err := clientsTmpl.Execute(w, data); err != nil {
+		srv.Logger.Print(err)
+	}
+}
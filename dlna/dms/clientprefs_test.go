@@ -0,0 +1,98 @@
+package dms
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestClientPrefsArrange(t *testing.T) {
+	item := upnpav.Item{
+		Object: upnpav.Object{ID: object{Path: "/Films/Heat.mkv"}.ID(), Title: "Heat"},
+		Res: []upnpav.Resource{
+			{URL: "http://h/res?path=%2FFilms%2FHeat.mkv"},
+			{URL: "http://h/res?path=%2FFilms%2FHeat.mkv&transcode=t"},
+			{URL: "http://h/res?path=%2FFilms%2FHeat.mkv&transcode=chromecast"},
+		},
+	}
+	got := ClientPrefs{Transcode: "chromecast", TitleFormat: titleFormatFileName}.arrange(item).(upnpav.Item)
+	if got.Title != "Heat.mkv" {
+		t.Errorf("title %q", got.Title)
+	}
+	if resourceTranscode(got.Res[0]) != "chromecast" || resourceTranscode(got.Res[1]) != "" {
+		t.Errorf("resources %v", got.Res)
+	}
+	if resourceTranscode(item.Res[0]) != "" {
+		t.Error("original item changed")
+	}
+	// Chapters aren't files, so they keep their titles.
+	chapter := upnpav.Item{Object: upnpav.Object{ID: object{Path: "/Dune.m4b/@3"}.ID(), Title: "Chapter 3"}}
+	if got := (ClientPrefs{TitleFormat: titleFormatFileName}).arrange(chapter).(upnpav.Item); got.Title != "Chapter 3" {
+		t.Errorf("chapter title %q", got.Title)
+	}
+}
+
+func TestClientPrefsFilter(t *testing.T) {
+	objs := []interface{}{
+		upnpav.Container{Object: upnpav.Object{ID: object{Path: placesPath}.ID()}},
+		upnpav.Container{Object: upnpav.Object{ID: object{Path: "/Films"}.ID()}},
+		upnpav.Item{Object: upnpav.Object{ID: object{Path: "/Kids/Cars.mkv"}.ID()}},
+		upnpav.Item{Object: upnpav.Object{ID: object{Path: "/Kidsongs.mp3"}.ID()}},
+	}
+	got := ClientPrefs{HiddenContainers: []string{placesPath, "/Kids"}}.filter(objs)
+	if len(got) != 2 {
+		t.Fatalf("got %v", got)
+	}
+	if want := (object{Path: "/Films"}).ID(); got[0].(upnpav.Container).ID != want {
+		t.Errorf("got %v", got[0])
+	}
+}
+
+func TestClientPrefsCheck(t *testing.T) {
+	for _, p := range []ClientPrefs{
+		{Transcode: "mp4"},
+		{SubtitleLanguage: "../en"},
+		{TitleFormat: "upper"},
+		{HiddenContainers: []string{"/"}},
+		{HiddenContainers: []string{"Films"}},
+	} {
+		if p.check() == nil {
+			t.Errorf("%+v passed", p)
+		}
+	}
+	if err := (ClientPrefs{Transcode: "mp3", SubtitleLanguage: "pt-BR", HiddenContainers: []string{"/@places"}}).check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientPrefsStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dms", "clients.json")
+	var a clientPrefsStore
+	if err := a.load(path); err != nil {
+		t.Fatal(err)
+	}
+	tv := ClientPrefs{IP: "192.168.1.20", UserAgent: "TV", SubtitleLanguage: "en"}
+	if err := a.set(tv); err != nil {
+		t.Fatal(err)
+	}
+	var b clientPrefsStore
+	if err := b.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := b.get(tv.key()); !ok || p.SubtitleLanguage != "en" {
+		t.Fatalf("got %+v %v", p, ok)
+	}
+	if _, ok := b.get(sessionKey{"192.168.1.20", "Phone"}); ok {
+		t.Fatal("another client has the TV's preferences")
+	}
+	if err := b.clear(tv.key()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.list()) != 0 {
+		t.Fatal("preferences not forgotten")
+	}
+}
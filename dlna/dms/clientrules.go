@@ -0,0 +1,115 @@
+package dms
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Limits which containers clients may browse, such as a kids' TV only seeing their films.
+type ClientRule struct {
+	// Addresses or networks of the clients, such as "192.168.1.30" or "192.168.2.0/24". Any client
+	// if empty.
+	IPs []string
+	// Substrings of the User-Agents of the clients, such as "BRAVIA". Any client if empty.
+	UserAgents []string
+	// Object paths of the containers the clients may browse, such as "/video/kids". The containers
+	// above them are listed with only them in, and the rest of the library, including Recently
+	// Added and the other containers that gather media from all over it, isn't there for them.
+	Containers []string
+	ipNets     []*net.IPNet
+}
+
+// Parses the addresses of the client rules, and checks their containers.
+func (srv *Server) initClientRules() error {
+	for i := range srv.ClientRules {
+		rule := &srv.ClientRules[i]
+		rule.ipNets = nil
+		for _, s := range rule.IPs {
+			_, ipNet, err := net.ParseCIDR(s)
+			if err != nil {
+				ip := net.ParseIP(s)
+				if ip == nil {
+					return fmt.Errorf("client rule: bad address %q", s)
+				}
+				ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+			}
+			rule.ipNets = append(rule.ipNets, ipNet)
+		}
+		if len(rule.Containers) == 0 {
+			return fmt.Errorf("client rule for %q %q has no containers", rule.IPs, rule.UserAgents)
+		}
+		for _, c := range rule.Containers {
+			if !path.IsAbs(c) || path.Clean(c) != c || c == "/" {
+				return fmt.Errorf("client rule: bad container %q", c)
+			}
+			if isRemoteStreamsPath(c) || isPlacesPath(c) || isRecentPath(c) || isClassPath(c) || isShowsPath(c) || isWatchedPath(c) {
+				return fmt.Errorf("client rule: container %q gathers media from the whole library", c)
+			}
+		}
+	}
+	return nil
+}
+
+func (me ClientRule) matches(ip net.IP, userAgent string) bool {
+	if len(me.ipNets) != 0 && (ip == nil || !ipNetsContain(me.ipNets, ip)) {
+		return false
+	}
+	return len(me.UserAgents) == 0 || matchUserAgent(me.UserAgents, userAgent)
+}
+
+// Returns the containers the first of the ClientRules that matches the client limits it to, or
+// nil if none match.
+func (srv *Server) clientContainers(ip, userAgent string) []string {
+	for _, rule := range srv.settings().ClientRules {
+		if rule.matches(net.ParseIP(ip), userAgent) {
+			return rule.Containers
+		}
+	}
+	return nil
+}
+
+// Whether the client may see the object at the path under the ClientRules: whether it's in one
+// of the containers it's limited to, or above one, and not within a locked container.
+func (me ClientPrefs) allowed(objectPath string) bool {
+	if me.inLocked(objectPath) {
+		return false
+	}
+	if len(me.containers) == 0 {
+		return true
+	}
+	for _, c := range me.containers {
+		if objectPath == c || strings.HasPrefix(objectPath, c+"/") || objectPath == "/" ||
+			strings.HasPrefix(c, objectPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the object at the path is a container above those the client is limited to, which is
+// listed with only them in.
+func (me ClientPrefs) above(objectPath string) bool {
+	for _, c := range me.containers {
+		if objectPath == "/" || strings.HasPrefix(c, objectPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Refuses requests for media and its art that the client may not see under the ClientRules, or
+// that's locked, as if it weren't there. Reports whether the request is to be served.
+func (srv *Server) allowResourceRequest(w http.ResponseWriter, r *http.Request) bool {
+	if !resolvedResourcePaths[r.URL.Path] {
+		return true
+	}
+	prefs := srv.requestClientPrefs(r)
+	if prefs.allowed(path.Clean("/" + r.URL.Query().Get("path"))) {
+		return true
+	}
+	srv.resourceError(w, r, resourceNotFound, fmt.Errorf("the client may not browse %q", r.URL.Query().Get("path")))
+	return false
+}
@@ -0,0 +1,58 @@
+package dms
+
+import (
+	"testing"
+)
+
+func TestClientRules(t *testing.T) {
+	srv := &Server{ClientRules: []ClientRule{
+		{IPs: []string{"192.168.1.30"}, Containers: []string{"/video/kids"}},
+		{IPs: []string{"192.168.2.0/24"}, UserAgents: []string{"BRAVIA"}, Containers: []string{"/music", "/photos"}},
+	}}
+	if err := srv.initClientRules(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ip, userAgent string
+		want          []string
+	}{
+		{"192.168.1.30", "Any", []string{"/video/kids"}},
+		{"192.168.2.7", "KDL-50W BRAVIA", []string{"/music", "/photos"}},
+		{"192.168.2.7", "VLC", nil},
+		{"192.168.1.31", "Any", nil},
+	} {
+		got := srv.clientContainers(c.ip, c.userAgent)
+		if len(got) != len(c.want) || len(got) != 0 && got[0] != c.want[0] {
+			t.Errorf("%s %s: got %q", c.ip, c.userAgent, got)
+		}
+	}
+	prefs := ClientPrefs{containers: []string{"/video/kids"}}
+	for p, want := range map[string]bool{
+		"/":                   true,
+		"/video":              true,
+		"/video/kids":         true,
+		"/video/kids/a.mkv":   true,
+		"/video/kidsfilm.mkv": false,
+		"/video/b.mkv":        false,
+		"/music":              false,
+		recentlyAddedPath:     false,
+	} {
+		if got := prefs.allowed(p); got != want {
+			t.Errorf("%s: got %v", p, got)
+		}
+	}
+	if !prefs.above("/video") || prefs.above("/video/kids") {
+		t.Error("wrong containers above")
+	}
+	for _, rule := range []ClientRule{
+		{IPs: []string{"bad"}, Containers: []string{"/a"}},
+		{IPs: []string{"192.168.1.30"}},
+		{Containers: []string{"video"}},
+		{Containers: []string{recentlyAddedPath}},
+	} {
+		srv.ClientRules = []ClientRule{rule}
+		if srv.initClientRules() == nil {
+			t.Errorf("%v: no error", rule)
+		}
+	}
+}
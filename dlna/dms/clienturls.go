@@ -0,0 +1,78 @@
+package dms
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+const (
+	// The query parameter of resource URLs naming the client they were given to.
+	clientURLParam = "client"
+	// The most User-Agents remembered for the client parameter. Clients are few, so more are
+	// likely made up.
+	maxClientUserAgents = 1000
+)
+
+// The User-Agents of the clients resource URLs were given to, by the ID in their client
+// parameter, so that a renderer fetching one through a proxy that strips its User-Agent still
+// gets what its quirks call for, such as its audio formats, subtitle language and whether remote
+// streams are proxied.
+type clientUserAgents struct {
+	mu   sync.Mutex
+	byID map[string]string
+}
+
+// Returns the ID of the User-Agent given in resource URLs, or "" if there's none to give.
+func (me *clientUserAgents) id(userAgent string) string {
+	if userAgent == "" {
+		return ""
+	}
+	// IDs are the same across restarts, so URLs given out before one still work once the client
+	// has browsed again.
+	h := sha256.Sum256([]byte(userAgent))
+	id := hex.EncodeToString(h[:6])
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if _, ok := me.byID[id]; !ok {
+		if len(me.byID) >= maxClientUserAgents {
+			return ""
+		}
+		if me.byID == nil {
+			me.byID = make(map[string]string)
+		}
+		me.byID[id] = userAgent
+	}
+	return id
+}
+
+func (me *clientUserAgents) userAgent(id string) string {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.byID[id]
+}
+
+// Adds the client parameter for the User-Agent to the resource URL.
+func (srv *Server) addClientParam(u *url.URL, userAgent string) {
+	id := srv.clientUserAgents.id(userAgent)
+	if id == "" {
+		return
+	}
+	q := u.Query()
+	q.Set(clientURLParam, id)
+	u.RawQuery = q.Encode()
+}
+
+// Gives a request for a resource without a User-Agent that of the client the URL was given to.
+// The User-Agent of a request that has one is kept, since URLs are often played by a renderer
+// other than the control point that browsed for them.
+func (srv *Server) restoreUserAgent(r *http.Request) {
+	if r.Header.Get("User-Agent") != "" || !resolvedResourcePaths[r.URL.Path] {
+		return
+	}
+	if ua := srv.clientUserAgents.userAgent(r.URL.Query().Get(clientURLParam)); ua != "" {
+		r.Header.Set("User-Agent", ua)
+	}
+}
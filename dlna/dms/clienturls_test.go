@@ -0,0 +1,31 @@
+package dms
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRestoreUserAgent(t *testing.T) {
+	var srv Server
+	const ua = "PS4Application libhttp/1.000"
+	u, _ := url.Parse("http://host/res?path=%2Fa.mkv")
+	srv.addClientParam(u, ua)
+	r := httptest.NewRequest("GET", u.String(), nil)
+	srv.restoreUserAgent(r)
+	if got := r.UserAgent(); got != ua {
+		t.Fatalf("stripped User-Agent restored as %q", got)
+	}
+	r = httptest.NewRequest("GET", u.String(), nil)
+	r.Header.Set("User-Agent", "renderer")
+	srv.restoreUserAgent(r)
+	if got := r.UserAgent(); got != "renderer" {
+		t.Fatalf("User-Agent replaced with %q", got)
+	}
+	u.Path = "/api/browse"
+	r = httptest.NewRequest("GET", u.String(), nil)
+	srv.restoreUserAgent(r)
+	if got := r.UserAgent(); got != "" {
+		t.Fatalf("User-Agent of a request that isn't for a resource restored as %q", got)
+	}
+}
@@ -9,34 +9,45 @@ import (
 // const defaultProtocolInfo = "http-get:*:video/mpeg:*,http-get:*:video/mp4:*,http-get:*:video/vnd.dlna.mpeg-tts:*,http-get:*:video/avi:*,http-get:*:video/x-matroska:*,http-get:*:video/x-ms-wmv:*,http-get:*:video/wtv:*,http-get:*:audio/mpeg:*,http-get:*:audio/mp3:*,http-get:*:audio/mp4:*,http-get:*:audio/x-ms-wma*,http-get:*:audio/wav:*,http-get:*:audio/L16:*,http-get:*image/jpeg:*,http-get:*image/png:*,http-get:*image/gif:*,http-get:*image/tiff:*"
 const defaultProtocolInfo = "http-get:*:image/jpeg:DLNA.ORG_PN=JPEG_TN,http-get:*:image/jpeg:DLNA.ORG_PN=JPEG_SM,http-get:*:image/jpeg:DLNA.ORG_PN=JPEG_MED,http-get:*:image/jpeg:DLNA.ORG_PN=JPEG_LRG,http-get:*:image/jpeg:DLNA.ORG_PN=JPEG_RES_H_V,http-get:*:image/png:DLNA.ORG_PN=PNG_TN,http-get:*:image/png:DLNA.ORG_PN=PNG_LRG,http-get:*:image/gif:DLNA.ORG_PN=GIF_LRG,http-get:*:audio/mpeg:DLNA.ORG_PN=MP3,http-get:*:audio/L16:DLNA.ORG_PN=LPCM,http-get:*:video/mpeg:DLNA.ORG_PN=AVC_TS_HD_24_AC3_ISO;SONY.COM_PN=AVC_TS_HD_24_AC3_ISO,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=AVC_TS_HD_24_AC3;SONY.COM_PN=AVC_TS_HD_24_AC3,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=AVC_TS_HD_24_AC3_T;SONY.COM_PN=AVC_TS_HD_24_AC3_T,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=MPEG_PS_PAL,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=MPEG_PS_NTSC,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=MPEG_TS_SD_50_L2_T,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=MPEG_TS_SD_60_L2_T,http-get:*:video/mpeg:DLNA.ORG_PN=MPEG_TS_SD_EU_ISO,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=MPEG_TS_SD_EU,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=MPEG_TS_SD_EU_T,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=MPEG_TS_SD_50_AC3_T,http-get:*:video/mpeg:DLNA.ORG_PN=MPEG_TS_HD_50_L2_ISO;SONY.COM_PN=HD2_50_ISO,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=MPEG_TS_SD_60_AC3_T,http-get:*:video/mpeg:DLNA.ORG_PN=MPEG_TS_HD_60_L2_ISO;SONY.COM_PN=HD2_60_ISO,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=MPEG_TS_HD_50_L2_T;SONY.COM_PN=HD2_50_T,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=MPEG_TS_HD_60_L2_T;SONY.COM_PN=HD2_60_T,http-get:*:video/mpeg:DLNA.ORG_PN=AVC_TS_HD_50_AC3_ISO;SONY.COM_PN=AVC_TS_HD_50_AC3_ISO,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=AVC_TS_HD_50_AC3;SONY.COM_PN=AVC_TS_HD_50_AC3,http-get:*:video/mpeg:DLNA.ORG_PN=AVC_TS_HD_60_AC3_ISO;SONY.COM_PN=AVC_TS_HD_60_AC3_ISO,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=AVC_TS_HD_60_AC3;SONY.COM_PN=AVC_TS_HD_60_AC3,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=AVC_TS_HD_50_AC3_T;SONY.COM_PN=AVC_TS_HD_50_AC3_T,http-get:*:video/vnd.dlna.mpeg-tts:DLNA.ORG_PN=AVC_TS_HD_60_AC3_T;SONY.COM_PN=AVC_TS_HD_60_AC3_T,http-get:*:video/x-mp2t-mphl-188:*,http-get:*:video/*:*,http-get:*:audio/*:*,http-get:*:image/*:*,http-get:*:text/srt:*,http-get:*:text/smi:*,http-get:*:text/ssa:*,http-get:*:*:*"
 
+// ConnectionManager's error for connection IDs it doesn't know.
+const invalidConnectionReferenceErrorCode = 706
+
 type connectionManagerService struct {
 	*Server
 	upnp.Eventing
+	soapActions
+}
+
+type getCurrentConnectionInfo struct {
+	ConnectionID int `soap:"required"`
 }
 
-func (cms *connectionManagerService) Handle(action string, argsXML []byte, r *http.Request) ([][2]string, error) {
-	switch action {
-	case ".GetCurrentConnectionInfo":
-		return [][2]string{
-			{"ConnectionID", "0"},
-			{"RcsID", "-1"},
-			{"AVTransportID", "-1"},
-			{"ProtocolInfo", ""},
-			{"PeerConnectionManager", ""},
-			{"PeerConnectionID", "-1"},
-			{"Direction", "Output"},
-			{"Status", "OK"},
-		}, nil
-	case "GetCurrentConnectionIDs":
-		return [][2]string{
-			{"ConnectionIDs", ""},
-		}, nil
-	case "GetProtocolInfo":
-		return [][2]string{
-			{"Source", defaultProtocolInfo},
-			{"Sink", ""},
-		}, nil
-	default:
-		return nil, upnp.InvalidActionError
+// Returns the actions of the ConnectionManager service. Content is only served over HTTP, so
+// there's only the connection with ID 0.
+func (cms *connectionManagerService) actions() soapActions {
+	return soapActions{
+		"GetCurrentConnectionInfo": newSOAPAction(func(args *getCurrentConnectionInfo, r *http.Request) ([]soapArg, error) {
+			if args.ConnectionID != 0 {
+				return nil, upnp.Errorf(invalidConnectionReferenceErrorCode, "Invalid connection reference")
+			}
+			return soapArgs([][2]string{
+				{"RcsID", "-1"},
+				{"AVTransportID", "-1"},
+				{"ProtocolInfo", ""},
+				{"PeerConnectionManager", ""},
+				{"PeerConnectionID", "-1"},
+				{"Direction", "Output"},
+				{"Status", "OK"},
+			}), nil
+		}),
+		"GetCurrentConnectionIDs": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			return []soapArg{{Name: "ConnectionIDs", Value: "0"}}, nil
+		}),
+		"GetProtocolInfo": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			return []soapArg{
+				{Name: "Source", Value: defaultProtocolInfo},
+				{Name: "Sink", Value: ""},
+			}, nil
+		}),
 	}
 }
@@ -0,0 +1,99 @@
+package dms
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Changes to containers are sent to subscribers together at most this often, as UPnP
+	// moderates ContainerUpdateIDs.
+	containerEventInterval = 2 * time.Second
+	// The seconds event subscriptions last for when the subscriber doesn't say, or asks for them
+	// to last forever.
+	defaultEventSubscriptionTimeout = 1800
+	// How long a subscriber has to take an event, so that one that's gone doesn't hold up the
+	// rest.
+	eventNotifyTimeout = 10 * time.Second
+)
+
+var eventNotifyClient = &http.Client{Timeout: eventNotifyTimeout}
+
+// Returns the seconds a subscription lasts, given its TIMEOUT header.
+func eventSubscriptionTimeout(header string) int {
+	var timeout int
+	if _, err := fmt.Sscanf(header, "Second-%d", &timeout); err != nil || timeout <= 0 {
+		return defaultEventSubscriptionTimeout
+	}
+	return timeout
+}
+
+// The SystemUpdateID, which changes whenever anything shared does, and the ContainerUpdateIDs of
+// containers changed since subscribers were last told.
+type updateIDs struct {
+	mu     sync.Mutex
+	system uint32
+	// The SystemUpdateID when each of the changed containers last changed, by ObjectID.
+	changed map[string]uint32
+}
+
+func (me *updateIDs) systemID() uint32 {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.system
+}
+
+// Counts a change to the container with the ObjectID, returning whether it's the first since
+// subscribers were last told.
+func (me *updateIDs) containerChanged(id string) (first bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.system++
+	if me.changed == nil {
+		me.changed = make(map[string]uint32)
+	}
+	first = len(me.changed) == 0
+	me.changed[id] = me.system
+	return
+}
+
+// Returns the SystemUpdateID and the ContainerUpdateIDs, as pairs of ObjectIDs and update IDs, of
+// the containers changed since it was last called.
+func (me *updateIDs) takeChanged() (system uint32, containers string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ids := make([]string, 0, len(me.changed))
+	for id := range me.changed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var parts []string
+	for _, id := range ids {
+		parts = append(parts, id, fmt.Sprint(me.changed[id]))
+	}
+	me.changed = nil
+	return me.system, strings.Join(parts, ",")
+}
+
+// Tells subscribers to the ContentDirectory that the container at the object path has changed,
+// along with others that change soon after.
+func (srv *Server) containerChanged(objectPath string) {
+	if !srv.updateIDs.containerChanged(object{Path: objectPath}.ID()) {
+		return
+	}
+	time.AfterFunc(containerEventInterval, func() {
+		system, containers := srv.updateIDs.takeChanged()
+		service, ok := srv.services["ContentDirectory"]
+		if !ok {
+			return
+		}
+		props := contentDirectoryEventProperties(system, containers)
+		for _, n := range service.Notifications("") {
+			srv.notify(n, props)
+		}
+	})
+}
@@ -0,0 +1,32 @@
+package dms
+
+import "testing"
+
+func TestContainerUpdateIDs(t *testing.T) {
+	u := updateIDs{system: 10}
+	if !u.containerChanged("%2FFilms") {
+		t.Fatal("first change wasn't reported as first")
+	}
+	if u.containerChanged("0") || u.containerChanged("%2FFilms") {
+		t.Fatal("later change reported as first")
+	}
+	system, containers := u.takeChanged()
+	if system != 13 || containers != "%2FFilms,13,0,12" {
+		t.Fatalf("got %d, %q", system, containers)
+	}
+	if _, containers := u.takeChanged(); containers != "" {
+		t.Fatalf("changes given again: %q", containers)
+	}
+}
+
+func TestEventSubscriptionTimeout(t *testing.T) {
+	for header, want := range map[string]int{
+		"Second-300":      300,
+		"Second-infinite": defaultEventSubscriptionTimeout,
+		"":                defaultEventSubscriptionTimeout,
+	} {
+		if got := eventSubscriptionTimeout(header); got != want {
+			t.Errorf("%q gave %d, want %d", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package dms
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"time"
+)
+
+const debugVarsPath = "/debug/vars"
+
+// Runtime stats of the process and the server, for watching memory and goroutines grow, such as
+// during a scan of a large library. It's like what the expvar package serves.
+type debugVars struct {
+	Cmdline    []string
+	Uptime     string
+	Goroutines int
+	NumCPU     int
+	// The Go heap and GC.
+	Memstats runtime.MemStats
+	// What the server has going on, which goroutines are started for.
+	Streams     int
+	SSDPServers int
+	Renderers   int
+	Sessions    int
+}
+
+func (srv *Server) debugVars() (ret debugVars) {
+	ret.Cmdline = os.Args
+	ret.Uptime = time.Since(startTime).Round(time.Second).String()
+	ret.Goroutines = runtime.NumGoroutine()
+	ret.NumCPU = runtime.NumCPU()
+	runtime.ReadMemStats(&ret.Memstats)
+	ret.Streams = len(srv.streams.list())
+	srv.mu.RLock()
+	ret.SSDPServers = len(srv.ssdpServers)
+	srv.mu.RUnlock()
+	ret.Renderers = len(srv.renderers.infos())
+	ret.Sessions = len(srv.sessions.recent(time.Now()))
+	return
+}
+
+// Routes the profiles of net/http/pprof, and the runtime stats. They're for diagnosing the server
+// in production, and are only served on DebugConn, as profiles can be large and slow to take, and
+// show what's shared.
+func (srv *Server) initDebugMux(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc(debugVarsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(srv.debugVars())
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, "/debug/pprof/", http.StatusFound)
+	})
+}
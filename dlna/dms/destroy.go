@@ -0,0 +1,73 @@
+package dms
+
+import (
+	"net"
+	"net/http"
+	"path"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+	"github.com/anacrolix/log"
+)
+
+// Reports whether the client at ip may delete items with DestroyObject. Control points don't log
+// in, so it's only allowed once there's a web user or an API token added by the operator, and the
+// web UI and API that can change what's shared aren't open to the network.
+func (srv *Server) deleteAllowed(ip net.IP) bool {
+	s := srv.settings()
+	allowed := s.AllowDelete && ip != nil && ipNetsContain(s.DeleteIpNets, ip)
+	if !allowed {
+		return false
+	}
+	ok, err := srv.loginConfigured()
+	return ok && err == nil
+}
+
+type destroyObject struct {
+	ObjectID string `soap:"required"`
+}
+
+// Deletes the file of an item, such as a recording that's been watched. Containers aren't deleted,
+// nor are items that aren't files of their own, such as chapters and remote streams.
+func (me *contentDirectoryService) destroyObject(args *destroyObject, r *http.Request) error {
+	if !me.deleteAllowed(net.ParseIP(requestClientIP(r))) {
+		return upnp.Errorf(restrictedObjectErrorCode, "deleting isn't allowed")
+	}
+	fsys, ok := me.contentFS().(RemoveFS)
+	if !ok {
+		return upnp.Errorf(restrictedObjectErrorCode, "files can't be deleted from the shared directories")
+	}
+	obj, err := me.objectFromID(args.ObjectID)
+	if err != nil {
+		return upnp.Errorf(upnpav.NoSuchObjectErrorCode, err.Error())
+	}
+	ret, err := me.objectMetadata(obj, r.Host, r.UserAgent())
+	if err != nil {
+		return err
+	}
+	item, ok := ret.(upnpav.Item)
+	if !ok {
+		return upnp.Errorf(restrictedObjectErrorCode, "only items can be deleted")
+	}
+	// Items listed elsewhere too, such as in Recently Played, refer to their file's item.
+	if item.RefID != "" {
+		if obj, err = me.objectFromID(item.RefID); err != nil {
+			return upnp.Errorf(upnpav.NoSuchObjectErrorCode, err.Error())
+		}
+	}
+	filePath := obj.FilePath()
+	if fi, err := fsys.Lstat(filePath); err != nil || !fi.Mode().IsRegular() {
+		return upnp.Errorf(restrictedObjectErrorCode, "%q isn't a file", obj.Path)
+	}
+	if err := fsys.Remove(filePath); err != nil {
+		return upnp.Errorf(upnp.ActionFailedErrorCode, err.Error())
+	}
+	me.requestLogger(r).Levelf(log.Info, "deleted %q", filePath)
+	// The index tells subscribers the container changed when it finds the file gone.
+	if me.index != nil {
+		me.index.rescan(path.Dir(obj.Path), false)
+	} else {
+		me.containerChanged(path.Dir(obj.Path))
+	}
+	return nil
+}
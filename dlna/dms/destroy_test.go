@@ -0,0 +1,73 @@
+package dms
+
+import (
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestDestroyObject(t *testing.T) {
+	srv := newMemFSServer()
+	fsys := srv.FS.(memFS)
+	// Beside the shared directory, where no ObjectID should reach.
+	fsys["outside.mp4"] = fsys["media/film.mp4"]
+	_, deleteNet, _ := net.ParseCIDR("192.168.1.20/32")
+	srv.AllowDelete = true
+	srv.DeleteIpNets = []*net.IPNet{deleteNet}
+	cds := &contentDirectoryService{Server: srv}
+	destroy := func(id, remoteAddr string) error {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = remoteAddr
+		return cds.destroyObject(&destroyObject{ObjectID: id}, r)
+	}
+	wantCode := func(err error, code uint) {
+		t.Helper()
+		if e, ok := err.(*upnp.Error); !ok || e.Code != code {
+			t.Errorf("got %v, want error code %d", err, code)
+		}
+	}
+	// Not until the web UI and API can't be used by anyone to change what's shared.
+	wantCode(destroy(url.QueryEscape("/film.mp4"), "192.168.1.20:4000"), restrictedObjectErrorCode)
+	// A token nobody's known to have added could have been added by anyone.
+	if err := srv.apiTokens.Load(filepath.Join(t.TempDir(), "tokens.json")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.apiTokens.Add("old", []string{APIScopeAdmin}, ""); err != nil {
+		t.Fatal(err)
+	}
+	wantCode(destroy(url.QueryEscape("/film.mp4"), "192.168.1.20:4000"), restrictedObjectErrorCode)
+	srv.WebUsers = []WebUser{{Name: "admin", Password: "secret", Scopes: []string{APIScopeAdmin}}}
+	if err := destroy(url.QueryEscape("/film.mp4"), "192.168.1.20:4000"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fsys["media/film.mp4"]; ok {
+		t.Fatal("film wasn't deleted")
+	}
+	// Deleting it again finds nothing.
+	wantCode(destroy(url.QueryEscape("/film.mp4"), "192.168.1.20:4000"), upnpav.NoSuchObjectErrorCode)
+	// Clients beyond DeleteIpNets can't delete anything.
+	wantCode(destroy(url.QueryEscape("/song.mp3"), "192.168.1.21:4000"), restrictedObjectErrorCode)
+	// Containers aren't deleted.
+	wantCode(destroy(url.QueryEscape("/Shows"), "192.168.1.20:4000"), restrictedObjectErrorCode)
+	// Paths are cleaned to within the shared directory.
+	for _, id := range []string{"/../outside.mp4", url.QueryEscape("/../outside.mp4"), "../outside.mp4", url.QueryEscape("/Shows/../../outside.mp4")} {
+		if err := destroy(id, "192.168.1.20:4000"); err == nil {
+			t.Errorf("%q: deleted", id)
+		}
+	}
+	if _, ok := fsys["outside.mp4"]; !ok {
+		t.Fatal("file outside the shared directory was deleted")
+	}
+	srv.AllowDelete = false
+	wantCode(destroy(url.QueryEscape("/song.mp3"), "192.168.1.20:4000"), restrictedObjectErrorCode)
+	for _, name := range []string{"media/song.mp3", "media/Shows/a.mkv"} {
+		if _, ok := fsys[name]; !ok {
+			t.Errorf("%s was deleted", name)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package dms
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	apiDevicesPath = "/api/devices"
+	// How long after a device was last seen it's taken to be off the network. Devices announce
+	// themselves, and TVs search, at least this often while they're on.
+	deviceOnlineTimeout = 30 * time.Minute
+	// How long after a device was last seen it's forgotten.
+	deviceForgetTimeout = 7 * 24 * time.Hour
+)
+
+// How devices are seen.
+const (
+	deviceSeenSearch    = "search"
+	deviceSeenAnnounce  = "announce"
+	deviceSeenSubscribe = "subscribe"
+	deviceSeenHTTP      = "http"
+)
+
+// A device that has discovered the server or made requests of it, by address.
+type device struct {
+	Address string
+	// Its name, if it's a renderer that has announced itself.
+	Name string
+	// Of its latest HTTP request, or of its SSDP messages until it makes one.
+	UserAgent string
+	// How it's been seen, of search, announce, subscribe and http.
+	Seen      []string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Whether it's been seen within deviceOnlineTimeout, and hasn't said it's leaving since.
+	Online bool
+}
+
+type deviceEntry struct {
+	device
+	// Whether UserAgent is from an HTTP request.
+	httpUserAgent bool
+	// Whether it's sent ssdp:byebye since it was last seen.
+	left bool
+}
+
+// The devices seen on the network, so admins can see which TVs are there. They're kept in
+// memory, since they're soon seen again after a restart.
+type deviceRegistry struct {
+	mu        sync.Mutex
+	byIP      map[string]*deviceEntry
+	lastPrune time.Time
+}
+
+// Records that the device at ip was seen, and how.
+func (me *deviceRegistry) seen(ip, how, userAgent string, now time.Time) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if now.Sub(me.lastPrune) >= deviceOnlineTimeout {
+		for k, d := range me.byIP {
+			if now.Sub(d.LastSeen) >= deviceForgetTimeout {
+				delete(me.byIP, k)
+			}
+		}
+		me.lastPrune = now
+	}
+	d := me.byIP[ip]
+	if d == nil {
+		d = &deviceEntry{device: device{Address: ip, FirstSeen: now}}
+		if me.byIP == nil {
+			me.byIP = make(map[string]*deviceEntry)
+		}
+		me.byIP[ip] = d
+	}
+	d.LastSeen = now
+	d.left = false
+	if userAgent != "" && (how == deviceSeenHTTP || !d.httpUserAgent) {
+		d.UserAgent = userAgent
+		d.httpUserAgent = how == deviceSeenHTTP
+	}
+	for _, s := range d.Seen {
+		if s == how {
+			return
+		}
+	}
+	d.Seen = append(d.Seen, how)
+	sort.Strings(d.Seen)
+}
+
+// Records that the device at ip said it's leaving the network.
+func (me *deviceRegistry) leave(ip string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if d := me.byIP[ip]; d != nil {
+		d.left = true
+	}
+}
+
+// Returns the devices, the most recently seen first.
+func (me *deviceRegistry) list(now time.Time) (ret []device) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for _, d := range me.byIP {
+		if now.Sub(d.LastSeen) >= deviceForgetTimeout {
+			continue
+		}
+		dev := d.device
+		dev.Seen = append([]string(nil), d.Seen...)
+		dev.Online = !d.left && now.Sub(d.LastSeen) < deviceOnlineTimeout
+		ret = append(ret, dev)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if !ret[i].LastSeen.Equal(ret[j].LastSeen) {
+			return ret[i].LastSeen.After(ret[j].LastSeen)
+		}
+		return ret[i].Address < ret[j].Address
+	})
+	return
+}
+
+// Returns the devices seen, with the names of renderers that have announced themselves.
+func (srv *Server) listDevices(now time.Time) []device {
+	ret := srv.devices.list(now)
+	infos := srv.renderers.infos()
+	for i := range ret {
+		ret[i].Name = infos[ret[i].Address].name
+	}
+	return ret
+}
+
+// Records the sender of an M-SEARCH, if it's allowed.
+func (srv *Server) deviceSearched(req *http.Request, sender *net.UDPAddr) {
+	if !srv.allowedIP(sender.IP) {
+		return
+	}
+	srv.devices.seen(sender.IP.String(), deviceSeenSearch, req.Header.Get("user-agent"), time.Now())
+}
+
+// Records the sender of an SSDP announcement, or that it's leaving.
+func (srv *Server) deviceAnnouncedPresence(req *http.Request, sender *net.UDPAddr) {
+	ip := sender.IP.String()
+	if req.Header.Get("nts") == "ssdp:byebye" {
+		srv.devices.leave(ip)
+		return
+	}
+	srv.devices.seen(ip, deviceSeenAnnounce, req.Header.Get("server"), time.Now())
+}
+
+// Lists the devices that have discovered the server or made requests of it, the most recently
+// seen first.
+func (me *Server) serveAPIDevices(w http.ResponseWriter, r *http.Request) {
+	if !me.authorizeAPI(w, r, APIScopeAdmin) {
+		return
+	}
+	ret := me.listDevices(time.Now())
+	if ret == nil {
+		ret = []device{}
+	}
+	me.writeAPIResponse(w, r, ret)
+}
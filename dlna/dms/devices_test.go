@@ -0,0 +1,41 @@
+package dms
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeviceRegistry(t *testing.T) {
+	var r deviceRegistry
+	now := time.Now()
+	r.seen("192.168.1.23", deviceSeenSearch, "Linux/4.4 UPnP/1.0 Samsung", now)
+	r.seen("192.168.1.23", deviceSeenHTTP, "SEC_HHP_[TV] Samsung/1.0", now.Add(time.Second))
+	// SSDP messages don't replace the User-Agent of HTTP requests.
+	r.seen("192.168.1.23", deviceSeenAnnounce, "Linux/4.4 UPnP/1.0", now.Add(2*time.Second))
+	r.seen("192.168.1.24", deviceSeenHTTP, "VLC/3.0", now.Add(time.Minute))
+	got := r.list(now.Add(time.Minute))
+	if len(got) != 2 || got[0].Address != "192.168.1.24" {
+		t.Fatalf("got %+v", got)
+	}
+	d := got[1]
+	if d.UserAgent != "SEC_HHP_[TV] Samsung/1.0" || !d.FirstSeen.Equal(now) || !d.Online {
+		t.Fatalf("got %+v", d)
+	}
+	if want := []string{"announce", "http", "search"}; !reflect.DeepEqual(d.Seen, want) {
+		t.Fatalf("seen by %q, want %q", d.Seen, want)
+	}
+	r.leave("192.168.1.23")
+	if got := r.list(now.Add(time.Minute)); got[1].Online {
+		t.Fatal("online after leaving")
+	}
+	r.seen("192.168.1.23", deviceSeenSearch, "", now.Add(2*time.Minute))
+	later := now.Add(time.Minute + deviceOnlineTimeout)
+	got = r.list(later)
+	if !got[0].Online || got[1].Online {
+		t.Fatalf("got %+v", got)
+	}
+	if got := r.list(now.Add(time.Minute + deviceForgetTimeout)); len(got) != 1 || got[0].Address != "192.168.1.23" {
+		t.Fatalf("got %+v", got)
+	}
+}
@@ -0,0 +1,149 @@
+package dms
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dms/rrcache"
+)
+
+const (
+	// The most bytes of DIDL-Lite kept across the cached pages.
+	didlCacheCapacity = 64 << 20
+	// Pages larger than this are written as they're encoded every time, rather than kept.
+	didlCacheMaxResult = 1 << 20
+)
+
+// Pages differ by the container, the arguments of the Browse, and the client, whose preferences,
+// renderer and bookmarks arrange the objects on them.
+type didlCacheKey struct {
+	path, sortCriteria, filter    string
+	startingIndex, requestedCount int
+	host, userAgent               string
+	// A hash of what the objects are arranged by for the client.
+	client uint64
+}
+
+type didlCacheEntry struct {
+	result, numberReturned, totalMatches string
+	// The SystemUpdateID when the page was encoded, which the index's watcher changes with the
+	// files.
+	updateID uint32
+	// Of the directory when it was listed.
+	modTime time.Time
+	expires time.Time
+}
+
+// The encoded results of BrowseDirectChildren, so that renderers that browse the same containers
+// every few seconds don't have them arranged and encoded again each time. Pages are kept no longer
+// than the listings they're of, and are dropped when the SystemUpdateID changes.
+type didlCache struct {
+	mu    sync.Mutex
+	cache *rrcache.RRCache
+}
+
+// Returns the cached page, if nothing it was encoded from has changed since.
+func (me *didlCache) get(key didlCacheKey, updateID uint32, modTime, now time.Time) ([]soapArg, bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.cache == nil {
+		return nil, false
+	}
+	v, ok := me.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	e := v.(didlCacheEntry)
+	if e.updateID != updateID || now.After(e.expires) || !e.modTime.Equal(modTime) {
+		return nil, false
+	}
+	return []soapArg{
+		{Name: "Result", Value: e.result},
+		{Name: "NumberReturned", Value: e.numberReturned},
+		{Name: "TotalMatches", Value: e.totalMatches},
+		{Name: "UpdateID", Value: fmt.Sprint(e.updateID)},
+	}, true
+}
+
+func (me *didlCache) set(key didlCacheKey, e didlCacheEntry) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.cache == nil {
+		me.cache = rrcache.New(didlCacheCapacity)
+	}
+	me.cache.Set(key, e, int64(len(e.result)))
+}
+
+// Drops the pages, such as when the shared directories or the titles change.
+func (me *didlCache) clear() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.cache = nil
+}
+
+// Returns the response arguments of resultPage, keeping the Result as it's written if it isn't too
+// large.
+func (me *didlCache) keep(key didlCacheKey, args []soapArg, updateID uint32, modTime, now time.Time) []soapArg {
+	e := didlCacheEntry{updateID: updateID, modTime: modTime, expires: now.Add(browseCacheTTL)}
+	ret := append([]soapArg(nil), args...)
+	for i, arg := range ret {
+		switch arg.Name {
+		case "NumberReturned":
+			e.numberReturned = arg.Value
+		case "TotalMatches":
+			e.totalMatches = arg.Value
+		case "Result":
+			write := arg.write
+			ret[i].write = func(w io.Writer) error {
+				var buf bytes.Buffer
+				lw := &limitedBuffer{&buf, didlCacheMaxResult}
+				if err := write(io.MultiWriter(w, lw)); err != nil {
+					return err
+				}
+				if lw.remaining >= 0 {
+					e.result = buf.String()
+					me.set(key, e)
+				}
+				return nil
+			}
+		}
+	}
+	return ret
+}
+
+// Keeps what's written to it until more than the remaining bytes are, when it stops, leaving
+// remaining negative.
+type limitedBuffer struct {
+	buf       *bytes.Buffer
+	remaining int
+}
+
+func (me *limitedBuffer) Write(b []byte) (int, error) {
+	me.remaining -= len(b)
+	if me.remaining >= 0 {
+		me.buf.Write(b)
+	}
+	return len(b), nil
+}
+
+// Returns the key of the page of a BrowseDirectChildren for the client of the request.
+func (me *contentDirectoryService) didlCacheKey(o object, browse *browse, r *http.Request, sink rendererSink, prefs ClientPrefs, marks clientBookmarks, books clientAudiobooks) didlCacheKey {
+	h := fnv.New64a()
+	// Maps are printed sorted by key.
+	fmt.Fprint(h, sink, prefs, marks, books, me.watchedMarks().prefix, me.watched.changes())
+	return didlCacheKey{
+		path:           o.Path,
+		sortCriteria:   browse.SortCriteria,
+		filter:         browse.Filter,
+		startingIndex:  browse.StartingIndex,
+		requestedCount: browse.RequestedCount,
+		host:           r.Host,
+		userAgent:      r.UserAgent(),
+		client:         h.Sum64(),
+	}
+}
@@ -0,0 +1,61 @@
+package dms
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDIDLCacheKeep(t *testing.T) {
+	var c didlCache
+	now := time.Now()
+	modTime := now.Add(-time.Hour)
+	key := didlCacheKey{path: "/Films", requestedCount: 10}
+	page := func(result string) []soapArg {
+		return []soapArg{
+			{Name: "Result", write: func(w io.Writer) error {
+				_, err := io.WriteString(w, result)
+				return err
+			}},
+			{Name: "NumberReturned", Value: "1"},
+			{Name: "TotalMatches", Value: "1"},
+			{Name: "UpdateID", Value: "7"},
+		}
+	}
+	if _, ok := c.get(key, 7, modTime, now); ok {
+		t.Fatal("empty cache hit")
+	}
+	var buf bytes.Buffer
+	args := c.keep(key, page("<DIDL-Lite/>"), 7, modTime, now)
+	if err := args[0].write(&buf); err != nil || buf.String() != "<DIDL-Lite/>" {
+		t.Fatalf("wrote %q, %v", buf.String(), err)
+	}
+	got, ok := c.get(key, 7, modTime, now)
+	if !ok || got[0].Value != "<DIDL-Lite/>" || got[1].Value != "1" || got[3].Value != "7" {
+		t.Fatalf("got %v, %v", got, ok)
+	}
+	for _, miss := range []struct {
+		updateID     uint32
+		modTime, now time.Time
+	}{
+		{8, modTime, now},
+		{7, now, now},
+		{7, modTime, now.Add(browseCacheTTL + time.Second)},
+	} {
+		if _, ok := c.get(key, miss.updateID, miss.modTime, miss.now); ok {
+			t.Errorf("stale hit %v", miss)
+		}
+	}
+	// Pages too large to keep are still written whole.
+	key.startingIndex = 10
+	large := strings.Repeat("x", didlCacheMaxResult+1)
+	buf.Reset()
+	if err := c.keep(key, page(large), 7, modTime, now)[0].write(&buf); err != nil || buf.Len() != len(large) {
+		t.Fatalf("wrote %d, %v", buf.Len(), err)
+	}
+	if _, ok := c.get(key, 7, modTime, now); ok {
+		t.Error("large page kept")
+	}
+}
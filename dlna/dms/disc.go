@@ -0,0 +1,387 @@
+package dms
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/anacrolix/dms/dlna"
+	"github.com/anacrolix/dms/transcode"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// Serves the main titles of DVDs and Blu-rays, named by the object paths of their folders or
+// images.
+const discPath = "/disc"
+
+// The transcode key of the main title of a disc remuxed without re-encoding it, which its
+// resources are by default.
+const discRemux = "remux"
+
+var discRemuxSpec = transcodeSpec{mimeType: "video/mpeg", Transcode: transcode.Remux}
+
+// Whether the file is a disc image, which is played as the DVD in it.
+func isDiscImage(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".iso")
+}
+
+// A file of a disc's title, where it starts in the image it's in, if it's in one.
+type discFile struct {
+	name   string
+	offset int64
+	size   int64
+}
+
+// The VOBs of DVD title sets, as VTS_01_1.VOB. Part 0 is the title set's menu.
+var dvdTitleVOBRegexp = regexp.MustCompile(`(?i)^VTS_(\d\d)_([1-9])\.VOB$`)
+
+// Returns the VOBs of a DVD's main title, the title set with the most in it, in the order they're
+// played. Extras and menus are in title sets of their own, or in part 0 of them.
+func dvdMainTitle(files []discFile) (ret []discFile) {
+	sets := make(map[string][]discFile)
+	sizes := make(map[string]int64)
+	for _, f := range files {
+		m := dvdTitleVOBRegexp.FindStringSubmatch(f.name)
+		if m == nil {
+			continue
+		}
+		sets[m[1]] = append(sets[m[1]], f)
+		sizes[m[1]] += f.size
+	}
+	main := ""
+	for set, size := range sizes {
+		if main == "" || size > sizes[main] || size == sizes[main] && set < main {
+			main = set
+		}
+	}
+	ret = sets[main]
+	sort.Slice(ret, func(i, j int) bool {
+		return strings.ToUpper(ret[i].name) < strings.ToUpper(ret[j].name)
+	})
+	return
+}
+
+// Returns the subdirectory of dir in fsys with the name, which discs burned or copied on some
+// systems have in lower case.
+func discSubdir(fsys FS, dir, name string) (string, bool) {
+	for _, n := range []string{name, strings.ToLower(name)} {
+		p := filepath.Join(dir, n)
+		if fi, err := fsys.Stat(p); err == nil && fi.IsDir() {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// Whether the object path is within the files of a DVD or Blu-ray folder, which are found as the
+// disc's item instead.
+func isDiscContentPath(p string) bool {
+	for _, elem := range strings.Split(p, "/") {
+		if strings.EqualFold(elem, "VIDEO_TS") || strings.EqualFold(elem, "BDMV") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the files in the directory in fsys with their sizes.
+func discFiles(fsys FS, dir string) (ret []discFile, err error) {
+	fis, err := fsys.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			ret = append(ret, discFile{name: fi.Name(), size: fi.Size()})
+		}
+	}
+	return
+}
+
+// Returns the ffmpeg input for the main title of a DVD or Blu-ray folder in fsys: the VOBs of the
+// DVD's main title concatenated, or the Blu-ray's largest stream.
+func folderDiscInput(fsys FS, dir string) (string, bool) {
+	if videoTS, ok := discSubdir(fsys, dir, "VIDEO_TS"); ok {
+		files, err := discFiles(fsys, videoTS)
+		if err != nil {
+			return "", false
+		}
+		var paths []string
+		for _, f := range dvdMainTitle(files) {
+			paths = append(paths, filepath.Join(videoTS, f.name))
+		}
+		return concatInput(paths)
+	}
+	bdmv, ok := discSubdir(fsys, dir, "BDMV")
+	if !ok {
+		return "", false
+	}
+	stream, ok := discSubdir(fsys, bdmv, "STREAM")
+	if !ok {
+		return "", false
+	}
+	files, err := discFiles(fsys, stream)
+	if err != nil {
+		return "", false
+	}
+	var largest discFile
+	for _, f := range files {
+		if strings.EqualFold(path.Ext(f.name), ".m2ts") && f.size > largest.size {
+			largest = f
+		}
+	}
+	if largest.name == "" {
+		return "", false
+	}
+	return filepath.Join(stream, largest.name), true
+}
+
+// Returns an input of ffmpeg's concat protocol for the parts, which can't have a | in them.
+func concatInput(parts []string) (string, bool) {
+	if len(parts) == 0 {
+		return "", false
+	}
+	for _, p := range parts {
+		if strings.Contains(p, "|") {
+			return "", false
+		}
+	}
+	return "concat:" + strings.Join(parts, "|"), true
+}
+
+const isoSectorSize = 2048
+
+// An entry of an ISO 9660 directory.
+type isoDirEntry struct {
+	name string
+	dir  bool
+	// The sector its data starts at.
+	extent uint32
+	size   uint32
+}
+
+// Parses an ISO 9660 directory record, as the root directory's in the volume descriptor.
+func parseISODirRecord(b []byte) (ret isoDirEntry, ok bool) {
+	if len(b) < 34 || int(b[0]) > len(b) || 33+int(b[32]) > int(b[0]) {
+		return
+	}
+	ret.extent = binary.LittleEndian.Uint32(b[2:])
+	ret.size = binary.LittleEndian.Uint32(b[10:])
+	ret.dir = b[25]&2 != 0
+	ret.name = string(b[33 : 33+b[32]])
+	// Files have a version, as VTS_01_1.VOB;1.
+	ret.name, _, _ = strings.Cut(ret.name, ";")
+	return ret, true
+}
+
+// Returns the root directory of the ISO 9660 filesystem of the image, from its primary volume
+// descriptor.
+func readISORoot(r io.ReaderAt) (isoDirEntry, error) {
+	b := make([]byte, isoSectorSize)
+	// The volume descriptors start at sector 16, and end with a terminator of type 255.
+	for sector := int64(16); sector < 32; sector++ {
+		if _, err := r.ReadAt(b, sector*isoSectorSize); err != nil {
+			return isoDirEntry{}, err
+		}
+		if string(b[1:6]) != "CD001" || b[0] == 255 {
+			break
+		}
+		if b[0] == 1 {
+			if root, ok := parseISODirRecord(b[156:190]); ok && root.dir {
+				return root, nil
+			}
+			break
+		}
+	}
+	return isoDirEntry{}, errors.New("no ISO 9660 filesystem")
+}
+
+// Returns the entries of the ISO 9660 directory, not including itself and its parent.
+func readISODir(r io.ReaderAt, dir isoDirEntry) (ret []isoDirEntry, err error) {
+	// Directories of discs are a few sectors at most.
+	if dir.size > 64*isoSectorSize {
+		return nil, fmt.Errorf("directory of %d bytes is too large", dir.size)
+	}
+	b := make([]byte, dir.size)
+	if _, err = r.ReadAt(b, int64(dir.extent)*isoSectorSize); err != nil {
+		return
+	}
+	for off := 0; off < len(b); {
+		// Records don't span sectors, and the rest of one after its last record is zeroed.
+		if b[off] == 0 {
+			off = (off/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		e, ok := parseISODirRecord(b[off:])
+		if !ok {
+			return nil, errors.New("bad directory record")
+		}
+		off += int(b[off])
+		if e.name != "\x00" && e.name != "\x01" {
+			ret = append(ret, e)
+		}
+	}
+	return
+}
+
+// Returns the ffmpeg input for the main title of the DVD in an image in fsys: its VOBs
+// concatenated, read from where they are in the image. Blu-ray images, which have only UDF, aren't
+// handled.
+func isoDiscInput(fsys FS, filePath string) (string, bool) {
+	f, err := fsys.Open(filePath)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	root, err := readISORoot(f)
+	if err != nil {
+		return "", false
+	}
+	entries, err := readISODir(f, root)
+	if err != nil {
+		return "", false
+	}
+	for _, e := range entries {
+		if !e.dir || !strings.EqualFold(e.name, "VIDEO_TS") {
+			continue
+		}
+		vobs, err := readISODir(f, e)
+		if err != nil {
+			return "", false
+		}
+		var files []discFile
+		for _, vob := range vobs {
+			if !vob.dir {
+				files = append(files, discFile{vob.name, int64(vob.extent) * isoSectorSize, int64(vob.size)})
+			}
+		}
+		var parts []string
+		for _, vob := range dvdMainTitle(files) {
+			parts = append(parts, fmt.Sprintf("subfile,,start,%d,end,%d,,:%s", vob.offset, vob.offset+vob.size, filePath))
+		}
+		return concatInput(parts)
+	}
+	return "", false
+}
+
+// Returns the ffmpeg input for the main title of the DVD or Blu-ray that's the folder or image at
+// filePath in fsys, if it is one.
+func discInput(fsys FS, filePath string, fi os.FileInfo) (string, bool) {
+	if fi.IsDir() {
+		return folderDiscInput(fsys, filePath)
+	}
+	if fi.Mode().IsRegular() && isDiscImage(fi.Name()) {
+		return isoDiscInput(fsys, filePath)
+	}
+	return "", false
+}
+
+func discURL(host, objectPath, transcode string) string {
+	q := url.Values{"path": {objectPath}}
+	if transcode != "" {
+		q.Set("transcode", transcode)
+	}
+	return (&url.URL{
+		Scheme:   "http",
+		Host:     host,
+		Path:     discPath,
+		RawQuery: q.Encode(),
+	}).String()
+}
+
+// Returns the item for a DVD or Blu-ray folder or image, which plays its main title rather than
+// the fragments it's stored in, or nil if it isn't one. Discs can't be played without ffmpeg, so
+// they're left as they are if transcoding is disabled. Shared directories stay containers, even if
+// they're discs.
+func (me *contentDirectoryService) discItem(o object, fi os.FileInfo, host string) interface{} {
+	if me.settings().NoTranscode || o.root != nil && !o.root.allowsMediaType("video") {
+		return nil
+	}
+	if o.FilePath() == filepath.Clean(o.RootObjectPath) {
+		return nil
+	}
+	if _, ok := discInput(me.contentFS(), o.FilePath(), fi); !ok {
+		return nil
+	}
+	obj := upnpav.Object{
+		ID:         o.ID(),
+		ParentID:   o.ParentID(),
+		Restricted: 1,
+		Class:      "object.item.videoItem.movie",
+		Title:      fi.Name(),
+		Date:       upnpav.Timestamp{Time: fi.ModTime()},
+	}
+	if fi.IsDir() {
+		obj.AlbumArtURI = folderArtURL(host, o.Path)
+	} else {
+		obj.Title = strings.TrimSuffix(fi.Name(), path.Ext(fi.Name()))
+	}
+	res := []upnpav.Resource{{
+		URL: discURL(host, o.Path, ""),
+		ProtocolInfo: fmt.Sprintf("http-get:*:%s:%s", discRemuxSpec.mimeType, dlna.ContentFeatures{
+			SupportTimeSeek: true,
+			Transcoded:      true,
+		}.String()),
+	}}
+	return upnpav.Item{
+		Object: obj,
+		Res:    append(res, transcodeResources(host, discPath, o.Path, "", "")...),
+	}
+}
+
+// Serves the main title of a DVD or Blu-ray, remuxed, or transcoded with the transcode query
+// parameter.
+func (me *Server) serveDisc(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filePath, err := me.filePath(q.Get("path"))
+	if err != nil {
+		me.resourceError(w, r, resourceNotFound, err)
+		return
+	}
+	if ignored, err := me.IgnorePath(filePath); err != nil {
+		me.resourceError(w, r, resourceInternalError, err)
+		return
+	} else if ignored {
+		me.resourceError(w, r, resourceNotFound, errors.New("no such object"))
+		return
+	}
+	fi, err := me.statFS(filePath)
+	if err != nil {
+		me.resourceError(w, r, fileErrorCause(err), err)
+		return
+	}
+	s := me.settings()
+	if s.NoTranscode {
+		me.resourceError(w, r, resourceDisabled, errors.New("transcodes disabled"))
+		return
+	}
+	input, ok := discInput(me.contentFS(), filePath, fi)
+	if !ok {
+		me.resourceError(w, r, resourceNotFound, errors.New("not a DVD or Blu-ray"))
+		return
+	}
+	k := s.ForceTranscodeTo
+	if k == "" {
+		k = q.Get("transcode")
+	}
+	spec := discRemuxSpec
+	if k == "" {
+		k = discRemux
+	} else {
+		if spec, ok = transcodes[k]; !ok {
+			me.resourceError(w, r, resourceBadRequest, fmt.Errorf("bad transcode spec key: %s", k))
+			return
+		}
+		spec = me.hwTranscodeSpec(spec)
+	}
+	me.serveDLNATranscode(w, r, input, spec, k, false)
+}
@@ -0,0 +1,112 @@
+package dms
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDVDMainTitle(t *testing.T) {
+	title := dvdMainTitle([]discFile{
+		{name: "VIDEO_TS.VOB", size: 100},
+		{name: "VTS_01_0.VOB", size: 100},
+		{name: "VTS_01_1.VOB", size: 300},
+		{name: "VTS_02_0.VOB", size: 1000},
+		{name: "VTS_02_2.VOB", size: 200},
+		{name: "vts_02_1.vob", size: 400},
+		{name: "VTS_02_1.IFO", size: 1000},
+	})
+	if len(title) != 2 || title[0].name != "vts_02_1.vob" || title[1].name != "VTS_02_2.VOB" {
+		t.Errorf("got %v", title)
+	}
+	if title := dvdMainTitle([]discFile{{name: "VIDEO_TS.VOB"}}); len(title) != 0 {
+		t.Errorf("got %v", title)
+	}
+}
+
+func TestFolderDiscInput(t *testing.T) {
+	dir := t.TempDir()
+	videoTS := filepath.Join(dir, "video_ts")
+	if err := os.Mkdir(videoTS, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"VTS_01_0.VOB", "VTS_01_1.VOB", "VTS_01_2.VOB"} {
+		if err := os.WriteFile(filepath.Join(videoTS, name), []byte("vob"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	input, ok := folderDiscInput(osFS{}, dir)
+	want := "concat:" + filepath.Join(videoTS, "VTS_01_1.VOB") + "|" + filepath.Join(videoTS, "VTS_01_2.VOB")
+	if !ok || input != want {
+		t.Errorf("got %q, %v", input, ok)
+	}
+	if _, ok := folderDiscInput(osFS{}, t.TempDir()); ok {
+		t.Error("empty folder is a disc")
+	}
+}
+
+// Returns an ISO 9660 directory record.
+func isoDirRecord(name string, dir bool, extent, size uint32) []byte {
+	b := make([]byte, 33+len(name)+(len(name)+1)%2)
+	b[0] = byte(len(b))
+	binary.LittleEndian.PutUint32(b[2:], extent)
+	binary.LittleEndian.PutUint32(b[10:], size)
+	if dir {
+		b[25] = 2
+	}
+	b[32] = byte(len(name))
+	copy(b[33:], name)
+	return b
+}
+
+func TestISODiscInput(t *testing.T) {
+	// The volume descriptors are at sectors 16 and 17, the root at 18, VIDEO_TS at 19, and the
+	// VOBs after them.
+	image := make([]byte, 20*isoSectorSize)
+	sector := func(i int) []byte {
+		return image[i*isoSectorSize : (i+1)*isoSectorSize]
+	}
+	pvd := sector(16)
+	pvd[0] = 1
+	copy(pvd[1:], "CD001")
+	copy(pvd[156:], isoDirRecord("\x00", true, 18, isoSectorSize))
+	copy(sector(17)[1:], "CD001")
+	sector(17)[0] = 255
+	var dir []byte
+	for _, r := range [][]byte{
+		isoDirRecord("\x00", true, 18, isoSectorSize),
+		isoDirRecord("\x01", true, 18, isoSectorSize),
+		isoDirRecord("AUDIO_TS", true, 0, 0),
+		isoDirRecord("VIDEO_TS", true, 19, isoSectorSize),
+	} {
+		dir = append(dir, r...)
+	}
+	copy(sector(18), dir)
+	dir = nil
+	for _, r := range [][]byte{
+		isoDirRecord("\x00", true, 19, isoSectorSize),
+		isoDirRecord("\x01", true, 18, isoSectorSize),
+		isoDirRecord("VTS_01_0.VOB;1", false, 20, 1000),
+		isoDirRecord("VTS_01_1.VOB;1", false, 21, 5000),
+		isoDirRecord("VTS_01_2.VOB;1", false, 24, 3000),
+	} {
+		dir = append(dir, r...)
+	}
+	copy(sector(19), dir)
+	filePath := filepath.Join(t.TempDir(), "a.iso")
+	if err := os.WriteFile(filePath, image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	input, ok := isoDiscInput(osFS{}, filePath)
+	want := "concat:subfile,,start,43008,end,48008,,:" + filePath + "|subfile,,start,49152,end,52152,,:" + filePath
+	if !ok || input != want {
+		t.Errorf("got %q, %v", input, ok)
+	}
+	if err := os.WriteFile(filePath, make([]byte, 20*isoSectorSize), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := isoDiscInput(osFS{}, filePath); ok {
+		t.Error("image without ISO 9660 is a disc")
+	}
+}
@@ -0,0 +1,214 @@
+package dms
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+const (
+	// How often free space is checked.
+	diskCheckInterval = time.Minute
+	// A volume is low on space when it has less than this free, or lowDiskFraction of its size.
+	lowDiskBytes    = 1 << 30
+	lowDiskFraction = 0.01
+	// Likewise for inodes, where the filesystem has them.
+	lowDiskFiles = 1000
+)
+
+// Space on a filesystem.
+type diskUsage struct {
+	Free, Total uint64
+	// Inodes, or 0 where the filesystem doesn't report them.
+	FreeFiles, Files uint64
+}
+
+func (me diskUsage) lowSpace() bool {
+	return me.Free < lowDiskBytes || float64(me.Free) < lowDiskFraction*float64(me.Total)
+}
+
+func (me diskUsage) lowFiles() bool {
+	if me.Files == 0 {
+		return false
+	}
+	return me.FreeFiles < lowDiskFiles || float64(me.FreeFiles) < lowDiskFraction*float64(me.Files)
+}
+
+// A location the server reads or writes, and the space where it is.
+type diskStatus struct {
+	// What's there, such as "index" or "media root Movies".
+	Name string
+	Path string
+	diskUsage
+	Err error
+}
+
+func (me diskStatus) Low() bool {
+	return me.Err == nil && (me.lowSpace() || me.lowFiles())
+}
+
+func (me diskStatus) FreeSpace() string {
+	return fmt.Sprintf("%s of %s", formatBytes(me.Free), formatBytes(me.Total))
+}
+
+// A warning to show for the status, if any.
+func (me diskStatus) Warning() string {
+	switch {
+	case me.Err != nil:
+		return fmt.Sprintf("can't check space for %s at %q: %v", me.Name, me.Path, me.Err)
+	case me.lowSpace():
+		return fmt.Sprintf("low on space for %s at %q: %s free", me.Name, me.Path, formatBytes(me.Free))
+	case me.lowFiles():
+		return fmt.Sprintf("low on inodes for %s at %q: %d free", me.Name, me.Path, me.FreeFiles)
+	}
+	return ""
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// The last checked space of the locations the server uses.
+type diskMonitor struct {
+	mu       sync.Mutex
+	statuses []diskStatus
+}
+
+func (me *diskMonitor) list() []diskStatus {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return append([]diskStatus(nil), me.statuses...)
+}
+
+// Reports whether the named location was low on space at the last check.
+func (me *diskMonitor) low(name string) bool {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for _, s := range me.statuses {
+		if s.Name == name {
+			return s.Low()
+		}
+	}
+	return false
+}
+
+// Names of the locations that writes are paused for when they're low on space.
+const (
+	indexDiskName         = "index"
+	transcodeLogsDiskName = "transcode logs"
+)
+
+// Returns the locations to check: where media is read from, and where state is written.
+func (srv *Server) diskPaths() (names, paths []string) {
+	s := srv.settings()
+	add := func(name, path string) {
+		if path != "" {
+			names = append(names, name)
+			paths = append(paths, path)
+		}
+	}
+	sd := srv.sharedDirs()
+	if len(sd.rootDirs) == 0 {
+		add("media", sd.rootObjectPath)
+	}
+	for _, rd := range sd.rootDirs {
+		add("media root "+rd.Name, rd.Path)
+	}
+	if srv.IndexPath != "" {
+		add(indexDiskName, filepath.Dir(srv.IndexPath))
+	}
+	if srv.AudiobookPositionsPath != "" {
+		add("audiobook positions", filepath.Dir(srv.AudiobookPositionsPath))
+	}
+	if s.ImageCacheDir != "" {
+		add(imageCacheDiskName, s.ImageCacheDir)
+	}
+	if s.AllowUpload {
+		add(uploadDiskName, s.UploadDir)
+	}
+	if s.TranscodeCacheDir != "" {
+		add(transcodeCacheDiskName, s.TranscodeCacheDir)
+	}
+	// Patterns such as /dev/null turn transcode logs off.
+	if p := s.TranscodeLogPattern; p != "" && !strings.HasPrefix(p, "/dev/") {
+		if i := strings.Index(p, "[tsname]"); i >= 0 {
+			p = p[:i] + "x"
+		}
+		add(transcodeLogsDiskName, filepath.Dir(p))
+	}
+	return
+}
+
+// Returns path, or its closest ancestor that exists, since directories for state may not have been
+// created yet.
+func nearestExistingPath(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil || filepath.Dir(path) == path {
+			return path
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// Checks the space of the locations the server uses, warning when one runs low.
+func (srv *Server) checkDisks() {
+	names, paths := srv.diskPaths()
+	statuses := make([]diskStatus, 0, len(names))
+	for i, name := range names {
+		s := diskStatus{Name: name, Path: paths[i]}
+		s.diskUsage, s.Err = getDiskUsage(nearestExistingPath(s.Path))
+		statuses = append(statuses, s)
+	}
+	srv.disks.mu.Lock()
+	old := srv.disks.statuses
+	srv.disks.statuses = statuses
+	srv.disks.mu.Unlock()
+	wasLow := make(map[string]bool, len(old))
+	for _, s := range old {
+		wasLow[s.Name] = s.Low()
+	}
+	for _, s := range statuses {
+		if s.Low() && !wasLow[s.Name] {
+			srv.Logger.Levelf(log.Warning, "%s", s.Warning())
+		} else if !s.Low() && wasLow[s.Name] {
+			srv.Logger.Levelf(log.Info, "space for %s at %q recovered", s.Name, s.Path)
+		}
+	}
+}
+
+func (srv *Server) monitorDisks() {
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+	for {
+		srv.checkDisks()
+		select {
+		case <-srv.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns the warnings for the locations the server uses.
+func (srv *Server) diskWarnings() (ret []string) {
+	for _, s := range srv.disks.list() {
+		if w := s.Warning(); w != "" {
+			ret = append(ret, w)
+		}
+	}
+	return
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package dms
+
+import (
+	"errors"
+)
+
+func getDiskUsage(path string) (diskUsage, error) {
+	return diskUsage{}, errors.New("not supported on this platform")
+}
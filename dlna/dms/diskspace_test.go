@@ -0,0 +1,40 @@
+package dms
+
+import (
+	"testing"
+)
+
+func TestDiskUsageLow(t *testing.T) {
+	for _, tc := range []struct {
+		usage              diskUsage
+		lowSpace, lowFiles bool
+	}{
+		{diskUsage{Free: 100 << 30, Total: 1000 << 30, FreeFiles: 1e6, Files: 2e6}, false, false},
+		{diskUsage{Free: 512 << 20, Total: 8 << 30}, true, false},
+		// Under 1% of a very large volume.
+		{diskUsage{Free: 50 << 30, Total: 16 << 40}, true, false},
+		{diskUsage{Free: 100 << 30, Total: 1000 << 30, FreeFiles: 500, Files: 1e6}, false, true},
+		// Filesystems without inodes.
+		{diskUsage{Free: 100 << 30, Total: 1000 << 30}, false, false},
+	} {
+		if got := tc.usage.lowSpace(); got != tc.lowSpace {
+			t.Errorf("%+v: lowSpace %v, want %v", tc.usage, got, tc.lowSpace)
+		}
+		if got := tc.usage.lowFiles(); got != tc.lowFiles {
+			t.Errorf("%+v: lowFiles %v, want %v", tc.usage, got, tc.lowFiles)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[uint64]string{
+		512:           "512 B",
+		1536:          "1.5 KiB",
+		3 << 30:       "3.0 GiB",
+		5<<40 + 1<<39: "5.5 TiB",
+	} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
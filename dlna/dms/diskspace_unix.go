@@ -0,0 +1,20 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package dms
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func getDiskUsage(path string) (ret diskUsage, err error) {
+	var st unix.Statfs_t
+	if err = unix.Statfs(path, &st); err != nil {
+		return
+	}
+	ret.Free = st.Bavail * uint64(st.Bsize)
+	ret.Total = st.Blocks * uint64(st.Bsize)
+	ret.FreeFiles = st.Ffree
+	ret.Files = st.Files
+	return
+}
@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package dms
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+func getDiskUsage(path string) (ret diskUsage, err error) {
+	winPath, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return
+	}
+	// NTFS has no fixed number of inodes, so only the space is reported.
+	err = windows.GetDiskFreeSpaceEx(winPath, &ret.Free, &ret.Total, nil)
+	return
+}
@@ -2,16 +2,18 @@ package dms
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
-	"net/http/pprof"
 	"net/url"
 	"os"
 	"os/exec"
@@ -21,10 +23,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/anacrolix/ffprobe"
 	"github.com/anacrolix/log"
+	"golang.org/x/text/language"
 
 	"github.com/anacrolix/dms/dlna"
 	"github.com/anacrolix/dms/soap"
@@ -39,23 +43,45 @@ import (
 // breaking changes to our behaviour that other devices might want to act on.
 const serverVersion = "1"
 
-var (
-	serverField = fmt.Sprintf(`Linux/3.4 DLNADOC/1.50 UPnP/1.0 %s/%s`,
-		userAgentProduct,
-		serverVersion)
-	rootDeviceModelName = fmt.Sprintf("%s %s", userAgentProduct, serverVersion)
+var rootDeviceModelName = fmt.Sprintf("%s %s", userAgentProduct, serverVersion)
+
+// The versions of UPnP that the server can describe itself as, for UPnPVersion.
+const (
+	UPnPVersion10 = "1.0"
+	UPnPVersion11 = "1.1"
+	UPnPVersion20 = "2.0"
 )
 
+// Where the optional fields of the device description of UPnP 2.0 point to.
+const projectURL = "https://github.com/anacrolix/dms"
+
+// Returns the SERVER of SSDP messages and the Server header of HTTP responses, which give the UPnP
+// version.
+func makeServerField(upnpVersion string) string {
+	// The release follows as a comment, so the product version stays what devices act on.
+	return fmt.Sprintf(`Linux/3.4 DLNADOC/1.50 UPnP/%s %s/%s (%s)`,
+		upnpVersion,
+		userAgentProduct,
+		serverVersion,
+		Version())
+}
+
 const (
 	userAgentProduct            = "dms"
 	rootDeviceType              = "urn:schemas-upnp-org:device:MediaServer:1"
 	resPath                     = "/res"
 	iconPath                    = "/icon"
 	subtitlePath                = "/subtitle"
+	audiobookPath               = "/audiobook"
 	rootDescPath                = "/rootDesc.xml"
 	contentDirectoryEventSubURL = "/evt/ContentDirectory"
 	serviceControlURL           = "/ctl"
 	deviceIconPath              = "/deviceIcon"
+	logPath                     = "/log"
+	metricsPath                 = "/metrics"
+	statusPath                  = "/status"
+	browsePath                  = "/browse"
+	tokensPath                  = "/tokens"
 )
 
 type transcodeSpec struct {
@@ -63,6 +89,8 @@ type transcodeSpec struct {
 	DLNAProfileName string
 	DLNAFlags       string
 	Transcode       func(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error)
+	// Transcode, encoding the video on hardware. Nil if it can't be.
+	hwTranscode func(hw transcode.HWAccel, path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error)
 }
 
 var transcodes = map[string]transcodeSpec{
@@ -72,8 +100,91 @@ var transcodes = map[string]transcodeSpec{
 		Transcode:       transcode.Transcode,
 	},
 	"vp8":        {mimeType: "video/webm", Transcode: transcode.VP8Transcode},
-	"chromecast": {mimeType: "video/mp4", Transcode: transcode.ChromecastTranscode},
-	"web":        {mimeType: "video/mp4", Transcode: transcode.WebTranscode},
+	"chromecast": {mimeType: "video/mp4", Transcode: transcode.ChromecastTranscode, hwTranscode: transcode.HWAccel.ChromecastTranscode},
+	"web":        {mimeType: "video/mp4", Transcode: transcode.WebTranscode, hwTranscode: transcode.HWAccel.WebTranscode},
+}
+
+// Returns the spec with its video encoded on the server's HWAccel, if there's one and it can be.
+func (me *Server) hwTranscodeSpec(spec transcodeSpec) transcodeSpec {
+	hw := me.settings().HWAccel
+	if hw.API == "" || spec.hwTranscode == nil {
+		return spec
+	}
+	hwTranscode := spec.hwTranscode
+	spec.Transcode = func(path string, start, length time.Duration, stderr io.Writer) (io.ReadCloser, error) {
+		return hwTranscode(hw, path, start, length, stderr)
+	}
+	return spec
+}
+
+// A format audio is transcoded to for renderers that don't take the original, such as speakers.
+type audioTranscode struct {
+	name            string
+	mimeType        string
+	DLNAProfileName string
+	// The codec, as ffprobe names it, where the MIME type doesn't give it.
+	codec string
+	// Only offered to renderers whose audio profile names it, such as Apple's, which take ALAC
+	// and AAC where others take FLAC.
+	optional bool
+}
+
+// Audio transcodes, in the order they're offered. The lossless ones come first.
+var audioTranscodes = []audioTranscode{
+	{name: "flac", mimeType: "audio/flac"},
+	{name: "wav", mimeType: "audio/wav"},
+	{name: "lpcm", mimeType: "audio/L16", DLNAProfileName: "LPCM"},
+	{name: "alac", mimeType: "audio/mp4", codec: "alac", optional: true},
+	{name: "mp3", mimeType: "audio/mpeg", DLNAProfileName: "MP3"},
+	{name: "aac", mimeType: "audio/mp4", DLNAProfileName: "AAC_ISO_320", codec: "aac", optional: true},
+}
+
+func findAudioTranscode(name string) (audioTranscode, bool) {
+	for _, at := range audioTranscodes {
+		if at.name == name {
+			return at, true
+		}
+	}
+	return audioTranscode{}, false
+}
+
+// Returns the MIME type of the transcode's output, which for L16 gives its rate and channels.
+func (me audioTranscode) contentType(sampleRate, channels int) string {
+	if me.name == "lpcm" {
+		return fmt.Sprintf("%s;rate=%d;channels=%d", me.mimeType, sampleRate, channels)
+	}
+	return me.mimeType
+}
+
+// Returns the DLNA profile of the transcode's output, if it fits it. The LPCM profile only allows
+// 44.1kHz and 48kHz, in mono or stereo, and MP3 only the rates of MPEG-1.
+func (me audioTranscode) profileName(sampleRate, channels int) string {
+	switch {
+	case me.DLNAProfileName == "LPCM" && (sampleRate != 44100 && sampleRate != 48000 || channels > 2):
+		return ""
+	case me.DLNAProfileName == "MP3" && sampleRate != 32000 && sampleRate != 44100 && sampleRate != 48000:
+		return ""
+	}
+	return me.DLNAProfileName
+}
+
+func (me audioTranscode) spec(sampleRate, channels int) transcodeSpec {
+	return transcodeSpec{
+		mimeType:        me.contentType(sampleRate, channels),
+		DLNAProfileName: me.profileName(sampleRate, channels),
+		Transcode: func(path string, start, length time.Duration, stderr io.Writer) (io.ReadCloser, error) {
+			return transcode.AudioTranscode(path, start, length, me.name, sampleRate, channels, stderr)
+		},
+	}
+}
+
+// Returns the rate to transcode audio sampled at sampleRate to: 44.1kHz or 48kHz, whichever it
+// divides into most simply, since those are what speakers take.
+func audioTranscodeRate(sampleRate int) int {
+	if sampleRate != 0 && sampleRate%11025 == 0 {
+		return 44100
+	}
+	return 48000
 }
 
 func makeDeviceUuid(unique string) string {
@@ -117,9 +228,14 @@ var services = []*service{
 	},
 }
 
+// Returns the UPnP AV services and the OpenHome ones.
+func allServices() []*service {
+	return append(append([]*service(nil), services...), openHomeServices...)
+}
+
 // The control URL for every service is the same. We're able to infer the desired service from the request headers.
 func init() {
-	for _, s := range services {
+	for _, s := range allServices() {
 		s.ControlURL = serviceControlURL
 	}
 }
@@ -130,8 +246,16 @@ func devices() []string {
 	}
 }
 
-func serviceTypes() (ret []string) {
-	for _, s := range services {
+// Returns the services offered: the OpenHome ones are only offered for an OpenHomeRenderer.
+func (me *Server) offeredServices() []*service {
+	if me.OpenHomeRenderer == "" {
+		return services
+	}
+	return allServices()
+}
+
+func (me *Server) serviceTypes() (ret []string) {
+	for _, s := range me.offeredServices() {
 		ret = append(ret, s.ServiceType)
 	}
 	return
@@ -141,23 +265,101 @@ func (me *Server) httpPort() int {
 	return me.HTTPConn.Addr().(*net.TCPAddr).Port
 }
 
-func (me *Server) serveHTTP() error {
+// Reports whether the request arrived at an address of one of the Interfaces, or loopback, so that
+// media isn't served on networks that weren't chosen.
+func (me *Server) onServedInterface(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if !ok || addr.IP.IsLoopback() {
+		return true
+	}
+	for _, if_ := range me.Interfaces {
+		addrs, err := if_.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(addr.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (me *Server) serveHTTP(conn net.Listener, mux *http.ServeMux) error {
 	srv := &http.Server{
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if me.LogHeaders {
+			me.restoreUserAgent(r)
+			r = me.withRequestContext(r)
+			if me.AccessLog != nil {
+				aw := &accessLogResponseWriter{ResponseWriter: w}
+				w = aw
+				defer me.logAccess(aw, r, time.Now())
+			}
+			me.requestLogger(r).Levelf(log.Debug, "%s %s %q", r.Method, r.RequestURI, r.UserAgent())
+			logHeaders := me.settings().LogHeaders
+			if logHeaders {
 				fmt.Fprintf(os.Stderr, "%s %s\r\n", r.Method, r.RequestURI)
 				r.Header.Write(os.Stderr)
 				fmt.Fprintln(os.Stderr)
 			}
 			w.Header().Set("Ext", "")
-			w.Header().Set("Server", serverField)
-			me.httpServeMux.ServeHTTP(&mitmRespWriter{
+			w.Header().Set("Server", me.serverField)
+			if conn == me.HTTPConn || conn == me.HTTPSConn {
+				if !me.onServedInterface(r) {
+					me.requestLogger(r).Levelf(log.Info, "refused request to an address not on the interfaces served")
+					http.Error(w, "forbidden", http.StatusForbidden)
+					return
+				}
+				if !me.allowClient(w, r) {
+					return
+				}
+				if !me.requireHTTPS(w, r) {
+					return
+				}
+			}
+			if conn == me.AdminConn {
+				if !me.authorizeAdmin(w, r) {
+					return
+				}
+			} else if conn != me.DebugConn && me.isWebUIRequest(r) && !me.authorizeWebUI(w, r) {
+				return
+			}
+			w, ok := me.simulateNetwork(w, r)
+			if !ok {
+				return
+			}
+			if !me.resolveResourceRequest(w, r) {
+				return
+			}
+			if !me.allowResourceRequest(w, r) {
+				return
+			}
+			mux.ServeHTTP(&mitmRespWriter{
 				ResponseWriter: w,
-				logHeader:      me.LogHeaders,
+				logHeader:      logHeaders,
 			}, r)
 		}),
+		IdleTimeout:       httpIdleTimeout,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+	ln := conn
+	// Renderers that stop reading streams without closing them would otherwise hold them open for
+	// good. The admin address may be TLS, which net/http needs to see the connections of.
+	if conn == me.HTTPConn || conn == me.HTTPSConn {
+		ln = stalledWriteListener{conn, httpStalledWriteTimeout}
+	}
+	if conn == me.HTTPSConn {
+		ln = tls.NewListener(ln, me.TLSConfig)
+	}
+	me.mu.Lock()
+	me.httpServers = append(me.httpServers, srv)
+	me.mu.Unlock()
+	err := srv.Serve(ln)
+	// Close shuts it down, or closes the listener if it's called first.
+	if errors.Is(err, http.ErrServerClosed) || errors.Is(err, net.ErrClosed) {
+		return nil
 	}
-	err := srv.Serve(me.HTTPConn)
 	select {
 	case <-me.closed:
 		return nil
@@ -169,39 +371,115 @@ func (me *Server) serveHTTP() error {
 // An interface with these flags should be valid for SSDP.
 const ssdpInterfaceFlags = net.FlagUp | net.FlagMulticast
 
-func (me *Server) doSSDP() {
-	var wg sync.WaitGroup
-	for _, if_ := range me.Interfaces {
-		if_ := if_
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			me.ssdpInterface(if_)
-		}()
+// Resolves NotifyAddrs. Host names are only looked up on start.
+func (srv *Server) initNotifyAddrs() error {
+	srv.notifyAddrs = nil
+	for _, a := range srv.NotifyAddrs {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			a = net.JoinHostPort(strings.Trim(a, "[]"), "1900")
+		}
+		addr, err := net.ResolveUDPAddr("udp", a)
+		if err != nil {
+			return fmt.Errorf("resolving address to send SSDP notifications to: %w", err)
+		}
+		srv.notifyAddrs = append(srv.notifyAddrs, addr)
+	}
+	return nil
+}
+
+// Reports whether the HTTP listener is reachable over IPv6, or IPv4, so that there's no point
+// advertising it over the other. Listening on the unspecified IPv6 address is dual-stack.
+func (me *Server) httpServesFamily(ipv6 bool) bool {
+	ip := me.HTTPConn.Addr().(*net.TCPAddr).IP
+	if ipv6 {
+		return ip.To4() == nil
+	}
+	return ip.To4() != nil || ip.IsUnspecified()
+}
+
+// Reports whether the HTTP listener can be reached at ip, an address of one of the interfaces.
+func (me *Server) httpServesIP(ip net.IP) bool {
+	listenIP := me.HTTPConn.Addr().(*net.TCPAddr).IP
+	if !listenIP.IsUnspecified() {
+		return listenIP.Equal(ip)
 	}
-	wg.Wait()
+	return listenIP.To4() == nil || ip.To4() != nil
 }
 
-// Run SSDP server on an interface.
-func (me *Server) ssdpInterface(if_ net.Interface) {
-	logger := me.Logger.WithNames("ssdp", if_.Name)
+// Reports whether the HTTP listener can be reached at any of the interface's addresses, so that
+// announcing on it isn't pointless, or worse, a leak onto networks that weren't chosen.
+func (me *Server) httpServesInterface(if_ net.Interface) bool {
+	addrs, err := if_.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && me.httpServesIP(ipNet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run SSDP server on an interface, for one address family, until stop is closed or the server
+// stops by itself, such as when the interface goes.
+func (me *Server) ssdpInterface(if_ net.Interface, ipv6 bool, stop <-chan struct{}) {
+	family := "ipv4"
+	if ipv6 {
+		family = "ipv6"
+	}
+	logger := me.Logger.WithNames("ssdp", if_.Name, family)
 	s := ssdp.Server{
 		Interface: if_,
 		Devices:   devices(),
-		Services:  serviceTypes(),
+		Services:  me.serviceTypes(),
 		Location: func(ip net.IP) string {
 			return me.location(ip)
 		},
-		Server:         serverField,
+		IPFilter: func(ip net.IP) bool {
+			// Control points elsewhere can't fetch a loopback LOCATION, and it's only on loopback
+			// interfaces that are allowed explicitly.
+			if ip.IsLoopback() && if_.Flags&net.FlagLoopback == 0 {
+				return false
+			}
+			return me.httpServesIP(ip) && me.preferAddr(if_, ip)
+		},
+		Server:         me.serverField,
 		UUID:           me.rootDeviceUUID,
 		NotifyInterval: me.NotifyInterval,
+		MaxAge:         me.SSDPMaxAge,
+		TTL:            me.SSDPTTL,
 		Logger:         logger,
+		OnNotify: func(nts string) {
+			me.metrics.ssdpNotifies.WithLabelValues(nts).Inc()
+		},
+		OnSearch: func(req *http.Request, sender *net.UDPAddr, answered bool) {
+			me.metrics.ssdpSearched(answered)
+			me.deviceSearched(req, sender)
+		},
+		SenderFilter: me.allowedIP,
+		OnAnnounce:   me.deviceAnnounced,
+		IPv6:         ipv6,
+		UnicastAddrs: me.notifyAddrs,
+		OnMessage: func(sent bool, msg []byte, addr *net.UDPAddr) {
+			me.dumpSSDP(if_.Name, sent, msg, addr)
+		},
+	}
+	if me.HTTPSConn != nil {
+		s.SecureLocation = me.secureLocation
 	}
+	me.mu.RLock()
+	s.BootID, s.ConfigID = me.bootID, me.configID
+	me.mu.RUnlock()
 	if err := s.Init(); err != nil {
 		if if_.Flags&ssdpInterfaceFlags != ssdpInterfaceFlags {
 			// Didn't expect it to work anyway.
 			return
 		}
+		if ssdpPortInUse(err) {
+			logger.Levelf(log.Error, "can't be discovered on %s: another program, such as another media server, has the SSDP port, 1900, and doesn't share it: %v", if_.Name, err)
+			return
+		}
 		if strings.Contains(err.Error(), "listen") {
 			// OSX has a lot of dud interfaces. Failure to create a socket on
 			// the interface are what we're expecting if the interface is no
@@ -212,7 +490,9 @@ func (me *Server) ssdpInterface(if_ net.Interface) {
 		return
 	}
 	defer s.Close()
-	logger.Levelf(log.Info, "started SSDP on %q", if_.Name)
+	me.addSSDPServer(&s)
+	defer me.removeSSDPServer(&s)
+	logger.Levelf(log.Info, "started SSDP on %q over %s", if_.Name, family)
 	stopped := make(chan struct{})
 	go func() {
 		defer close(stopped)
@@ -220,13 +500,36 @@ func (me *Server) ssdpInterface(if_ net.Interface) {
 			logger.Printf("%q: %q\n", if_.Name, err)
 		}
 	}()
+	// The OpenHomeRenderer is found without waiting for its announcement. Otherwise renderers are
+	// searched for once they're listed, to play to.
+	if me.OpenHomeRenderer != "" {
+		for _, target := range rendererSearchTargets {
+			s.Search(target)
+		}
+	}
 	select {
-	case <-me.closed:
+	case <-stop:
 		// Returning will close the server.
+		logger.Levelf(log.Info, "stopped SSDP on %q over %s", if_.Name, family)
 	case <-stopped:
 	}
 }
 
+func (me *Server) addSSDPServer(s *ssdp.Server) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.ssdpServers == nil {
+		me.ssdpServers = make(map[*ssdp.Server]struct{})
+	}
+	me.ssdpServers[s] = struct{}{}
+}
+
+func (me *Server) removeSSDPServer(s *ssdp.Server) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	delete(me.ssdpServers, s)
+}
+
 var startTime time.Time
 
 type Icon struct {
@@ -236,11 +539,17 @@ type Icon struct {
 }
 
 type Server struct {
-	HTTPConn               net.Listener
-	FriendlyName           string
-	Interfaces             []net.Interface
-	httpServeMux           *http.ServeMux
-	RootObjectPath         string
+	HTTPConn     net.Listener
+	FriendlyName string
+	Interfaces   []net.Interface
+	httpServeMux *http.ServeMux
+	// Optional listener that serves only the web UI, such as one with TLS for access from beyond
+	// the LAN. The web UI is also available on HTTPConn.
+	AdminConn      net.Listener
+	adminServeMux  *http.ServeMux
+	RootObjectPath string
+	// Directories shared as separate top-level containers. If set, RootObjectPath is ignored.
+	RootDirs               []RootDir
 	OnBrowseDirectChildren func(path string, rootObjectPath string, host, userAgent string) (ret []interface{}, err error)
 	OnBrowseMetadata       func(path string, rootObjectPath string, host, userAgent string) (ret interface{}, err error)
 	rootDescXML            []byte
@@ -257,19 +566,38 @@ type Server struct {
 	ForceTranscodeTo string
 	// Disable media probing with ffprobe
 	NoProbe bool
-	Icons   []Icon
+	// List every photo separately, rather than grouping RAW+JPEG pairs and bursts into single
+	// items.
+	NoPhotoGrouping bool
+	// List the subcontainers of those browsed in the background, so that libraries on slow
+	// storage are quick to move around in.
+	PrefetchBrowse bool
+	Icons          []Icon
 	// Stall event subscription requests until they drop. A workaround for
 	// some bad clients.
 	StallEventSubscribe bool
 	// Time interval between SSPD announces
 	NotifyInterval time.Duration
+	// Names of network interfaces, or patterns such as "eth*", in order of preference for the
+	// address advertised when several interfaces are on the same network. Interfaces that aren't
+	// listed come after, wired before wireless, then by route metric and link speed.
+	InterfacePriority []string
 	// Ignore hidden files and directories
 	IgnoreHidden bool
 	// Ignore unreadable files and directories
 	IgnoreUnreadable bool
 	// Ignore comma separated list of directories
 	IgnorePaths []string
-	// White list of clients
+	// Ignore directories that contain a .nomedia file, along with the files in them.
+	IgnoreNomedia bool
+	// If any are given, only files whose names match one of these are shown. Patterns are globs,
+	// such as "*.mkv", or regular expressions prefixed with "re:". Directories are always shown.
+	IncludePatterns []string
+	// Names of files and directories to ignore, as patterns like those of IncludePatterns, such as
+	// "*.nfo" and "sample-*".
+	ExcludePatterns []string
+	// Networks that clients are allowed from, both to discover the server and make requests. If
+	// nil, private networks and those of the Interfaces are allowed.
 	AllowedIpNets []*net.IPNet
 	// Activate support for dynamic streams configured via .dms.json metadata files
 	// This feature is not enabled by default, since having write access to a shared media
@@ -278,15 +606,264 @@ type Server struct {
 	// pattern where to write transcode logs to. The [tsname] placeholder is replaced with the name
 	// of the item currently being played. The default is $HOME/.dms/log/[tsname]
 	TranscodeLogPattern string
+	// Check once a day for a newer release, to show in the web UI and the status API. Only the
+	// latest release is asked for, with nothing identifying the server.
+	CheckUpdates bool
+	updates      updateCheck
+	// Substrings of the User-Agents of renderers that only take L16 audio besides MP3, such as some
+	// DLNA certified ones. They're given the L16 transcode first for other audio. "*" matches every
+	// renderer.
+	LPCMUserAgents []string
+	// Remote media, such as internet radio, listed in a container of its own in the top level.
+	RemoteStreams []RemoteStream
+	// The address or name of a renderer to offer the OpenHome Product, Playlist and Radio services
+	// for, so that OpenHome control points queue music and tune the RemoteStreams on it through
+	// the server. They aren't offered if it's empty. Changing it requires a restart.
+	OpenHomeRenderer string
+	openHome         openHomePlayer
+	// Substrings of the User-Agents of renderers that are sent the remote media of .strm and .url
+	// files and RemoteStreams through the server, for those that don't follow redirects or can't
+	// fetch external URLs. "*" matches every renderer. The rest are redirected to it, or given its
+	// URL.
+	StrmProxyUserAgents []string
 	Logger              log.Logger
 	eventingLogger      log.Logger
+	// Guards the root device description and the running SSDP servers, which can change on
+	// Reload.
+	mu          sync.RWMutex
+	ssdpServers map[*ssdp.Server]struct{}
+	sessions    sessionTracker
+	// CONFIGID.UPNP.ORG of the root device description, and BOOTID.UPNP.ORG.
+	configID, bootID int32
+	// Compiled from IncludePatterns and ExcludePatterns.
+	includePatterns, excludePatterns namePatterns
+	// Renderers that have announced themselves, and what they accept.
+	renderers renderers
+	// Devices that have searched for, announced, subscribed to or made requests of the server.
+	devices deviceRegistry
+	// Recent log entries for the web UI.
+	logs *logRing
+	// Path of a database to index the shared directories into. If set, they're scanned in the
+	// background and watched for changes, and Browse and Search are served from the index.
+	IndexPath string
+	index     *index
+	// Names of the registered metadata providers to identify media files with, in order of
+	// precedence. If nil, all of them are used.
+	MetadataProviders []string
+	// File to keep the positions listeners are up to in audiobooks. If empty, they're lost on
+	// restart.
+	AudiobookPositionsPath string
+	audiobookPositions     audiobookPositions
+	metrics                *serverMetrics
+	streams                activeStreams
+	disks                  diskMonitor
+	browseCache            browseCache
+	didlCache              didlCache
+	// File of the tokens for the REST API. Until one is added, the API is open to allowed
+	// clients.
+	APITokensPath string
+	apiTokens     APITokens
+	// Shell commands to run on events, keyed by event, such as HookStreamStart. They're given the
+	// event's data in environment variables prefixed with DMS_.
+	Hooks map[string][]string
+	// Directory to keep images scaled to the DLNA JPEG profiles in. If empty, they're scaled every
+	// time they're requested.
+	ImageCacheDir string
+	// Delay every HTTP request by this, and limit responses to this many kilobits a second, to
+	// reproduce how renderers behave on a poor network. Not for normal use.
+	SimulatedLatency time.Duration
+	SimulatedKbps    int
+	// List photos with a GPS location in a Places container in the top level too, grouped by
+	// where they were taken. It needs IndexPath.
+	PhotoPlaces bool
+	placesCache placesCache
+	// The audio formats offered to renderers matched by User-Agent, by the first profile that
+	// matches them. Others are offered every format.
+	AudioProfiles []AudioProfile
+	localServers  localServers
+	// Encode the video of the chromecast and web transcodes on this hardware, rather than the
+	// CPU.
+	HWAccel transcode.HWAccel
+	// File of the display preferences of clients, set in the web UI. Changing it requires a
+	// restart.
+	ClientPrefsPath string
+	clientPrefs     clientPrefsStore
+	// What to do with files that are still being written, such as downloads: one of the
+	// IncompleteFiles constants.
+	IncompleteFiles string
+	// Directory transcodes of whole files are cached in, or "" to not cache them, and the bytes
+	// it may hold before the least recently played are deleted.
+	TranscodeCacheDir  string
+	TranscodeCacheSize int64
+	transcodeCache     transcodeCache
+	// Limit each stream of media to this many kilobits a second, and all of them together to
+	// TotalStreamKbps, such as to keep streams to remote clients from filling the uplink.
+	StreamKbps        int
+	TotalStreamKbps   int
+	totalStreamBucket tokenBucket
+	// The most media streams served at once, or 0 for no limit. More wait briefly for one to end,
+	// and are then refused with a time to retry after.
+	MaxStreams    int
+	streamLimiter streamLimiter
+	// How long Close lets streams finish before closing them.
+	ShutdownTimeout time.Duration
+	httpServers     []*http.Server
+	// Addresses of clients whose SOAP requests and responses are dumped in full to files in
+	// SOAPDumpDir, for investigating their quirks.
+	SOAPDumpClients []string
+	SOAPDumpDir     string
+	soapDumper      soapDumper
+	// File the SSDP messages received and sent on every interface are recorded in, as JSON lines,
+	// for investigating discovery.
+	SSDPDumpPath string
+	ssdpDumper   ssdpDumper
+	// What to do with media files that can't be played, such as empty, truncated or DRM protected
+	// ones: one of the ProblemFiles constants.
+	ProblemFiles string
+	problems     problemFileSet
+	// Maps the URLs of resources given to clients, such as to sign them. Nil leaves them be.
+	ResourceResolver ResourceResolver
+	clientUserAgents clientUserAgents
+	updateIDs        updateIDs
+	// The number of media listed in the Recently Added containers, for each type of media, and in
+	// Recently Played, or 0 to not list them. Recently Added needs IndexPath.
+	RecentItems        int
+	recentlyAddedCache recentlyAddedCache
+	recentlyPlayed     recentlyPlayed
+	// How long the index keeps what it knows about files that have gone, such as their metadata
+	// and thumbnails, in case they come back, such as when a mount is briefly unavailable. 0
+	// forgets them at once.
+	KeepMissing time.Duration
+	// Addresses of control points, as host or host:port, to send SSDP NOTIFY messages to directly
+	// as well as to the multicast group, such as ones on routed networks it doesn't reach. The
+	// port defaults to 1900.
+	NotifyAddrs []string
+	notifyAddrs []*net.UDPAddr
+	// File to keep how far each client got through the items it played in, to resume them there.
+	// If empty, they're lost on restart.
+	BookmarksPath string
+	bookmarks     bookmarks
+	// Whether control points may upload media with CreateObject, such as cameras and phones that
+	// push to DLNA servers. Uploads are saved to UploadDir, which needs to be shared for them to be
+	// listed.
+	AllowUpload bool
+	UploadDir   string
+	uploads     uploads
+	// Changes settings from the web UI's settings page. If nil, they can't be changed there.
+	SettingsEditor SettingsEditor
+	// Whether control points at DeleteIpNets may delete items with DestroyObject, such as
+	// recordings that have been watched. Other allowed clients may not.
+	AllowDelete  bool
+	DeleteIpNets []*net.IPNet
+	// Shared directories whose filesystem has stopped responding, such as hung network mounts.
+	fsGuard fsGuard
+	// Where each HTTP request is logged once it's been served, in AccessLogFormat, one of the
+	// AccessLog constants. Nil logs them only at debug level. Changing it requires a restart.
+	AccessLog       io.Writer
+	AccessLogFormat string
+	accessLogMu     sync.Mutex
+	// Optional listener that serves the profiles of net/http/pprof and runtime stats, for
+	// diagnosing the server. They aren't authenticated, so it should be on loopback or a trusted
+	// network.
+	DebugConn     net.Listener
+	debugServeMux *http.ServeMux
+	// Interfaces, or patterns such as "lo", to announce on though they're skipped by default:
+	// loopback, point-to-point such as VPN tunnels, those without multicast, and virtual ones with
+	// SSDPSkipVirtual.
+	SSDPAllowInterfaces []string
+	// Don't announce on virtual interfaces, such as bridges, Docker's and those of VMs.
+	SSDPSkipVirtual bool
+	// Optional listener that serves the same as HTTPConn over TLS, with TLSConfig. Its description
+	// URL is advertised as SECURELOCATION.UPNP.ORG for control points that support it, media
+	// browsed over it is linked over it, and the web UI and API on HTTPConn send clients to it.
+	HTTPSConn     net.Listener
+	TLSConfig     *tls.Config
+	webUIServeMux *http.ServeMux
+	// People who log in to the web UI and API. Once there are any, the web UI requires a login, or
+	// an API token, with the scope WebUIAuth gives each path, by the path it's routed by, such as
+	// "/metrics". Paths it doesn't have require browse, except the log, which requires admin.
+	// DLNA is left open to renderers.
+	WebUsers  []WebUser
+	WebUIAuth map[string]string
+	digestKey []byte
+	// The nonce-counts Digest logins have used, so they can't be replayed.
+	digestNonceCounts digestNonceCounts
+	// Limits clients to some of the containers, by address and User-Agent. The first that matches
+	// a client applies.
+	ClientRules []ClientRule
+	// Object paths of containers, such as "/video/grown-ups", that are listed as empty, and whose
+	// media isn't served, until a client is unlocked with ParentalPIN in the web UI or API. Clients
+	// stay unlocked by IP for ParentalUnlockDuration, an hour if it's 0.
+	ProtectedContainers    []string
+	ParentalPIN            string
+	ParentalUnlockDuration time.Duration
+	parentalLocks          parentalLocks
+	// BCP 47 language, such as "de" or "ja", that the containers dms generates, such as Recently
+	// Added, are titled in, and names are sorted for. Names are sorted by the Unicode default, and
+	// generated titles are in English, if it's empty or dms doesn't have them in the language.
+	Locale string
+	// Titles for the generated containers and marks, by their English ones, such as "Recently
+	// Added", in place of those for the Locale.
+	GeneratedTitles map[string]string
+	localeTag       language.Tag
+	localeTitles    map[string]string
+	// MIME types given to the clients matched by User-Agent in place of those dms gives, such as
+	// video/x-msvideo for video/avi to TVs that only recognize that.
+	MimeTypeOverrides []MimeTypeOverride
+	// The types ffprobe found of files whose names and contents didn't give one.
+	probedMimeTypes sync.Map
+	// List all the music, videos and photos in the index in a container for each in the top level,
+	// with the ObjectIDs 1, 2 and 3. It needs IndexPath.
+	ClassContainers bool
+	classMediaCache classMediaCache
+	// List the episodes of TV shows in the index in a container in the top level too, by series
+	// and season. It needs IndexPath.
+	TVShows    bool
+	showsCache showsCache
+	// File to keep the videos that have been watched in. If empty, they're lost on restart.
+	WatchedPath string
+	watched     watchedItems
+	// Put before the titles of watched videos, such as "✓ ", if not empty.
+	WatchedPrefix string
+	// List the videos that have been watched, and those in the index that haven't, in Watched and
+	// Unwatched containers in the top level.
+	WatchedContainers bool
+	// The UPnP version the server describes itself as, one of the UPnPVersion constants: 1.0
+	// leaves out the configId of the device description, and 2.0 adds its optional fields, such as
+	// modelURL and serialNumber, which renderers that validate the description may want. The
+	// default is 1.1. Changing it requires a restart.
+	UPnPVersion string
+	serverField string
+	// The CACHE-CONTROL max-age of SSDP announcements and search responses, and the multicast TTL
+	// of what's sent. They default to those of the ssdp package, and NotifyInterval to half the
+	// max-age.
+	SSDPMaxAge time.Duration
+	SSDPTTL    int
+	// The filesystem the shared directories are read from, or nil for the local one.
+	FS FS
+	// Snapshot of the shared directories, which Reload replaces.
+	shared atomic.Pointer[sharedDirs]
+	// Snapshot of the settings Reload can change, which it replaces.
+	reloadable atomic.Pointer[reloadableSettings]
+	// The chapters ffprobe found in audiobooks, by ffmpegInfoCacheKey, so that they're probed
+	// once for each version of a file rather than on each identification.
+	probedChapters sync.Map
+	// The trees of archives, so that listing their folders doesn't read them each time.
+	archiveTrees archiveTreeCache
+	// Publish what was last played on a renderer from the web UI or API as an MPRIS player on the
+	// DBus session bus, so that Linux desktops show it and control it with their media keys.
+	// Changing it requires a restart.
+	MPRIS      bool
+	nowPlaying nowPlaying
 }
 
 // UPnP SOAP service.
 type UPnPService interface {
 	Handle(action string, argsXML []byte, r *http.Request) (respArgs [][2]string, err error)
 	Subscribe(callback []*url.URL, timeoutSeconds int) (sid string, actualTimeout int, err error)
+	Renew(sid string, timeoutSeconds int) (actualTimeout int, err error)
 	Unsubscribe(sid string) error
+	Notifications(sid string) []upnp.Notification
 }
 
 type Cache interface {
@@ -337,9 +914,13 @@ func itemExtra(item *upnpav.Object, info *ffprobe.Info) {
 type ffmpegInfoCacheKey struct {
 	Path    string
 	ModTime int64
+	// Older caches don't have it, so their entries aren't used.
+	Size int64
 }
 
-func transcodeResources(host, path, resolution, duration string) (ret []upnpav.Resource) {
+// Returns resources for the media at the object path transcoded to each of the transcodes, served
+// at urlPath.
+func transcodeResources(host, urlPath, path, resolution, duration string) (ret []upnpav.Resource) {
 	ret = make([]upnpav.Resource, 0, len(transcodes))
 	for k, v := range transcodes {
 		ret = append(ret, upnpav.Resource{
@@ -351,7 +932,7 @@ func transcodeResources(host, path, resolution, duration string) (ret []upnpav.R
 			URL: (&url.URL{
 				Scheme: "http",
 				Host:   host,
-				Path:   resPath,
+				Path:   urlPath,
 				RawQuery: url.Values{
 					"path":      {path},
 					"transcode": {k},
@@ -364,6 +945,78 @@ func transcodeResources(host, path, resolution, duration string) (ret []upnpav.R
 	return
 }
 
+// Returns resources for audio transcoded to each of the audioTranscodes that aren't optional, for
+// renderers to choose from.
+func audioTranscodeResources(host, path string, mimeType mimeType, md Metadata, duration string) (ret []upnpav.Resource) {
+	for _, at := range audioTranscodes {
+		if at.optional {
+			continue
+		}
+		ret = append(ret, at.resources(host, path, mimeType, md, duration)...)
+	}
+	return
+}
+
+// Returns resources for audio transcoded to the format, or none if the file is already in it at a
+// rate renderers take. L16 is offered at 44.1kHz and 48kHz, since renderers that take it often
+// only take one of them.
+func (at audioTranscode) resources(host, path string, mimeType mimeType, md Metadata, duration string) (ret []upnpav.Resource) {
+	rate := audioTranscodeRate(md.SampleRate)
+	channels := md.AudioChannels
+	if channels <= 0 || channels > 2 {
+		channels = 2
+	}
+	add := func(rate int) {
+		ret = append(ret, upnpav.Resource{
+			ProtocolInfo: fmt.Sprintf("http-get:*:%s:%s", at.contentType(rate, channels), dlna.ContentFeatures{
+				SupportTimeSeek: true,
+				Transcoded:      true,
+				ProfileName:     at.profileName(rate, channels),
+			}.String()),
+			URL: (&url.URL{
+				Scheme: "http",
+				Host:   host,
+				Path:   resPath,
+				RawQuery: url.Values{
+					"path":      {path},
+					"transcode": {at.name},
+					"rate":      {strconv.Itoa(rate)},
+					"channels":  {strconv.Itoa(channels)},
+				}.Encode(),
+			}).String(),
+			Duration:        duration,
+			SampleFrequency: rate,
+			NrAudioChannels: channels,
+		})
+	}
+	if at.mimeType == string(mimeType) && (at.codec == "" || at.codec == md.AudioCodec) && rate == md.SampleRate {
+		return
+	}
+	add(rate)
+	if at.name == "lpcm" {
+		add(44100 + 48000 - rate)
+	}
+	return
+}
+
+// Returns the audio transcode given in the query of a resource request, with its rate and
+// channels.
+func parseAudioTranscode(k string, q url.Values) (spec transcodeSpec, ok bool, err error) {
+	at, ok := findAudioTranscode(k)
+	if !ok {
+		return
+	}
+	rate, err := strconv.Atoi(q.Get("rate"))
+	if err != nil || rate < 8000 || rate > 192000 {
+		return spec, true, fmt.Errorf("bad sample rate %q", q.Get("rate"))
+	}
+	channels, err := strconv.Atoi(q.Get("channels"))
+	if err != nil || channels < 1 || channels > 2 {
+		return spec, true, fmt.Errorf("bad channels %q", q.Get("channels"))
+	}
+	return at.spec(rate, channels), true, nil
+}
+
 func parseDLNARangeHeader(val string) (ret dlna.NPTRange, err error) {
 	if !strings.HasPrefix(val, "npt=") {
 		err = errors.New("bad prefix")
@@ -379,16 +1032,14 @@ func parseDLNARangeHeader(val string) (ret dlna.NPTRange, err error) {
 // Determines the time-based range to transcode, and sets the appropriate
 // headers. Returns !ok if there was an error and the caller should stop
 // handling the request.
-func handleDLNARange(w http.ResponseWriter, hs http.Header, dynamicMode bool) (r dlna.NPTRange, partialResponse, ok bool) {
+func handleDLNARange(w http.ResponseWriter, hs http.Header, dynamicMode bool) (r dlna.NPTRange, partialResponse bool, err error) {
 	if dynamicMode || len(hs[http.CanonicalHeaderKey(dlna.TimeSeekRangeDomain)]) == 0 {
-		ok = true
 		return
 	}
 	partialResponse = true
 	h := hs.Get(dlna.TimeSeekRangeDomain)
-	r, err := parseDLNARangeHeader(h)
+	r, err = parseDLNARangeHeader(h)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	// Passing an exact NPT duration seems to cause trouble pass the "iono"
@@ -396,7 +1047,6 @@ func handleDLNARange(w http.ResponseWriter, hs http.Header, dynamicMode bool) (r
 	//
 	// TODO: Check that the request range can't already have /.
 	w.Header().Set(dlna.TimeSeekRangeDomain, h+"/*")
-	ok = true
 	return
 }
 
@@ -411,6 +1061,7 @@ func writeResponseCode(w http.ResponseWriter, partialResponse bool) {
 }
 
 func (me *Server) serveDLNATranscode(w http.ResponseWriter, r *http.Request, path_ string, ts transcodeSpec, tsname string, dynamicMode bool) {
+	setRequestTranscode(r, tsname)
 	w.Header().Set(dlna.TransferModeDomain, "Streaming")
 	w.Header().Set("content-type", ts.mimeType)
 	w.Header().Set(dlna.ContentFeaturesDomain, (dlna.ContentFeatures{
@@ -422,8 +1073,9 @@ func (me *Server) serveDLNATranscode(w http.ResponseWriter, r *http.Request, pat
 	// If a range of any kind is given, we have to respond with 206 if we're
 	// interpreting that range. Since only the DLNA range is handled in this
 	// function, it alone determines if we'll give a partial response.
-	range_, partialResponse, ok := handleDLNARange(w, r.Header, dynamicMode)
-	if !ok {
+	range_, partialResponse, err := handleDLNARange(w, r.Header, dynamicMode)
+	if err != nil {
+		me.resourceError(w, r, resourceBadRequest, err)
 		return
 	}
 
@@ -449,25 +1101,51 @@ func (me *Server) serveDLNATranscode(w http.ResponseWriter, r *http.Request, pat
 	} else {
 		logTsName = tsname
 	}
-	stderrPath := strings.Replace(me.TranscodeLogPattern, "[tsname]", logTsName, -1)
-	var logFile io.Writer
-	if stderrPath != "" {
-		os.MkdirAll(filepath.Dir(stderrPath), 0o750)
-		aLogFile, err := os.Create(stderrPath)
-		if err != nil {
-			log.Printf("couldn't create transcode log file: %s", err)
-		} else {
-			defer aLogFile.Close()
-			log.Printf("logging transcode to %q", stderrPath)
+	logger := me.requestLogger(r)
+	start := func() (io.ReadCloser, error) {
+		stderrPath := strings.Replace(me.settings().TranscodeLogPattern, "[tsname]", logTsName, -1)
+		var logFile io.Writer
+		if stderrPath != "" && me.disks.low(transcodeLogsDiskName) {
+			logger.Levelf(log.Debug, "not logging transcode, as space is low")
+		} else if stderrPath != "" {
+			os.MkdirAll(filepath.Dir(stderrPath), 0o750)
+			aLogFile, err := os.Create(stderrPath)
+			if err != nil {
+				logger.Printf("couldn't create transcode log file: %s", err)
+			} else {
+				// The transcoder has its own descriptor for it once it's started.
+				defer aLogFile.Close()
+				logger.Printf("logging transcode to %q", stderrPath)
+				logFile = aLogFile
+			}
 		}
-		logFile = aLogFile
+		return ts.Transcode(path_, range_.Start, range_.End-range_.Start, logFile)
+	}
+	var p io.ReadCloser
+	// Transcodes of whole files are cached, so that playing them again, or on several clients at
+	// once, doesn't transcode them again.
+	if cacheDir, _ := me.transcodeCacheSettings(); cacheDir != "" && !dynamicMode && range_ == (dlna.NPTRange{}) {
+		var fi os.FileInfo
+		if fi, err = os.Stat(path_); err == nil {
+			p, err = me.cachedTranscode(r.Context(), cacheDir, transcodeCacheName(path_, fi, tsname, r.URL.Query()), start)
+		} else if os.IsNotExist(err) {
+			// Inputs that aren't files, such as a concat: of a DVD's VOBs, aren't cached.
+			p, err = start()
+		}
+	} else {
+		p, err = start()
 	}
-	p, err := ts.Transcode(path_, range_.Start, range_.End-range_.Start, logFile)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Levelf(log.Error, "error starting transcode of %q: %v", path_, err)
+		me.resourceError(w, r, resourceTranscodeFailed, err)
 		return
 	}
 	defer p.Close()
+	if dynamicMode {
+		// The names of dynamic streams are up to whoever writes the metadata files.
+		tsname = "dynamic"
+	}
+	defer me.transcodeStarted(r, tsname)()
 	// I recently switched this to returning 200 if no range is specified for
 	// pure UPnP clients. It's possible that DLNA clients will *always* expect
 	// 206. It appears the HTTP standard requires that 206 only be used if a
@@ -538,13 +1216,20 @@ func (me *mitmRespWriter) Write(b []byte) (int, error) {
 	return me.ResponseWriter.Write(b)
 }
 
+func (me *mitmRespWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !me.loggedHeader {
+		me.doLogHeader(200)
+	}
+	return io.Copy(me.ResponseWriter, src)
+}
+
 func (me *mitmRespWriter) CloseNotify() <-chan bool {
 	return me.ResponseWriter.(http.CloseNotifier).CloseNotify()
 }
 
 // Set the SCPD serve paths.
 func init() {
-	for _, s := range services {
+	for _, s := range allServices() {
 		lastInd := strings.LastIndex(s.ServiceId, ":")
 		p := path.Join("/scpd", s.ServiceId[lastInd+1:])
 		s.SCPDURL = p + ".xml"
@@ -553,7 +1238,7 @@ func init() {
 
 // Install handlers to serve SCPD for each UPnP service.
 func handleSCPDs(mux *http.ServeMux) {
-	for _, s := range services {
+	for _, s := range allServices() {
 		mux.HandleFunc(s.SCPDURL, func(serviceDesc string) http.HandlerFunc {
 			return func(w http.ResponseWriter, r *http.Request) {
 				w.Header().Set("content-type", `text/xml; charset="utf-8"`)
@@ -563,55 +1248,48 @@ func handleSCPDs(mux *http.ServeMux) {
 	}
 }
 
-// Marshal SOAP response arguments into a response XML snippet.
-func marshalSOAPResponse(sa upnp.SoapAction, args [][2]string) []byte {
-	soapArgs := make([]soap.Arg, 0, len(args))
-	for _, arg := range args {
-		argName, value := arg[0], arg[1]
-		soapArgs = append(soapArgs, soap.Arg{
-			XMLName: xml.Name{Local: argName},
-			Value:   value,
-		})
-	}
-	return []byte(fmt.Sprintf(`<u:%[1]sResponse xmlns:u="%[2]s">%[3]s</u:%[1]sResponse>`, sa.Action, sa.ServiceURN.String(), xmlMarshalOrPanic(soapArgs)))
-}
-
 // Handle a SOAP request and return the response arguments or UPnP error.
-func (me *Server) soapActionResponse(sa upnp.SoapAction, actionRequestXML []byte, r *http.Request) ([][2]string, error) {
+func (me *Server) soapActionResponse(sa upnp.SoapAction, actionRequestXML []byte, r *http.Request) ([]soapArg, error) {
 	service, ok := me.services[sa.Type]
 	if !ok {
 		// TODO: What's the invalid service error?!
 		return nil, upnp.Errorf(upnp.InvalidActionErrorCode, "Invalid service: %s", sa.Type)
 	}
-	return service.Handle(sa.Action, actionRequestXML, r)
+	if h, ok := service.(soapHandler); ok {
+		return h.handleSOAP(sa.Action, actionRequestXML, r)
+	}
+	respArgs, err := service.Handle(sa.Action, actionRequestXML, r)
+	return soapArgs(respArgs), err
+}
+
+// Checks the client is allowed by allowedIP, responding with 403 Forbidden if it isn't.
+func (me *Server) allowClient(w http.ResponseWriter, r *http.Request) bool {
+	clientIp := requestClientIP(r)
+	if me.allowedIP(net.ParseIP(clientIp)) {
+		return true
+	}
+	me.requestLogger(r).Printf("not allowed client %s", clientIp)
+	http.Error(w, "forbidden", http.StatusForbidden)
+	return false
 }
 
 // Handle a service control HTTP request.
 func (me *Server) serviceControlHandler(w http.ResponseWriter, r *http.Request) {
-	found := false
-	clientIp, _, _ := net.SplitHostPort(r.RemoteAddr)
-	if zoneDelimiterIdx := strings.Index(clientIp, "%"); zoneDelimiterIdx != -1 {
-		// IPv6 addresses may have the form address%zone (e.g. ::1%eth0)
-		clientIp = clientIp[:zoneDelimiterIdx]
-	}
-	for _, ipnet := range me.AllowedIpNets {
-		if ipnet.Contains(net.ParseIP(clientIp)) {
-			found = true
-		}
-	}
-	if !found {
-		log.Printf("not allowed client %s, %+v", clientIp, me.AllowedIpNets)
-		http.Error(w, "forbidden", http.StatusForbidden)
-		return
-	}
+	logger := me.requestLogger(r)
 	soapActionString := r.Header.Get("SOAPACTION")
 	soapAction, err := upnp.ParseActionHTTPHeader(soapActionString)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	dumpPath := me.soapDumpPath(r)
+	var reqBody bytes.Buffer
+	body := io.Reader(r.Body)
+	if dumpPath != "" {
+		body = io.TeeReader(r.Body, &reqBody)
+	}
 	var env soap.Envelope
-	if err := xml.NewDecoder(r.Body).Decode(&env); err != nil {
+	if err := xml.NewDecoder(body).Decode(&env); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -619,21 +1297,42 @@ func (me *Server) serviceControlHandler(w http.ResponseWriter, r *http.Request)
 	// log.Println(r.UserAgent())
 	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
 	w.Header().Set("Ext", "")
-	w.Header().Set("Server", serverField)
-	soapRespXML, code := func() ([]byte, int) {
-		respArgs, err := me.soapActionResponse(soapAction, env.Body.Action, r)
-		if err != nil {
-			upnpErr := upnp.ConvertError(err)
-			return xmlMarshalOrPanic(soap.NewFault("UPnPError", upnpErr)), 500
-		}
-		return marshalSOAPResponse(soapAction, respArgs), 200
-	}()
-	bodyStr := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8" standalone="yes"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>%s</s:Body></s:Envelope>`, soapRespXML)
-	// Compatibility with Samsung Frame TV's - they don't display an empty content directory without this hack:
-	bodyStr = strings.Replace(bodyStr, "&#34;", `"`, -1)
+	w.Header().Set("Server", me.serverField)
+	logger.Levelf(log.Debug, "SOAP action %s#%s", soapAction.Type, soapAction.Action)
+	respArgs, err := me.soapActionResponse(soapAction, env.Body.Action, r)
+	me.metrics.soapAction(me.services[soapAction.Type] != nil, soapAction, err)
+	code := http.StatusOK
+	upnpErr := upnp.ConvertError(err)
+	if upnpErr != nil {
+		logger.Levelf(log.Info, "SOAP action %s#%s failed: %v", soapAction.Type, soapAction.Action, upnpErr)
+		// UPnP errors are sent as faults with 500 Internal Server Error, whatever they are.
+		code = http.StatusInternalServerError
+	}
+	// Responses are written as they're encoded, as Browse results can be large.
+	var respBody bytes.Buffer
+	out := io.Writer(w)
+	if dumpPath != "" {
+		out = io.MultiWriter(w, &respBody)
+	}
+	secure := secureSOAPResponse(out, r)
 	w.WriteHeader(code)
-	if _, err := w.Write([]byte(bodyStr)); err != nil {
-		log.Print(err)
+	if upnpErr != nil {
+		err = writeSOAPFault(secure, upnpErr)
+	} else {
+		err = writeSOAPResponse(secure, soapAction, respArgs)
+	}
+	if err == nil {
+		err = secure.Close()
+	}
+	if err != nil {
+		logger.Print(err)
+	}
+	if dumpPath != "" {
+		// Whatever follows the envelope.
+		io.Copy(&reqBody, r.Body)
+		if err := me.dumpSOAP(dumpPath, r, reqBody.Bytes(), w.Header(), code, respBody.Bytes()); err != nil {
+			logger.Levelf(log.Warning, "error dumping SOAP: %v", err)
+		}
 	}
 }
 
@@ -641,12 +1340,28 @@ func safeFilePath(root, given string) string {
 	return filepath.Join(root, filepath.FromSlash(path.Clean("/" + given))[1:])
 }
 
-func (s *Server) filePath(_path string) string {
-	return safeFilePath(s.RootObjectPath, _path)
+// Returns the local filesystem path for the object path given in a request.
+func (s *Server) filePath(_path string) (string, error) {
+	if sd := s.sharedDirs(); len(sd.rootDirs) == 0 {
+		return safeFilePath(sd.rootObjectPath, _path), nil
+	}
+	o, err := s.objectFromPath(path.Clean("/" + _path))
+	if err != nil {
+		return "", err
+	}
+	if o.root == nil {
+		return "", errors.New("not a file")
+	}
+	_, rest := splitRootPath(o.Path)
+	return safeFilePath(o.RootObjectPath, rest), nil
 }
 
 func (me *Server) serveIcon(w http.ResponseWriter, r *http.Request) {
-	filePath := me.filePath(r.URL.Query().Get("path"))
+	filePath, err := me.filePath(r.URL.Query().Get("path"))
+	if err != nil {
+		me.resourceError(w, r, resourceNotFound, err)
+		return
+	}
 	c := r.URL.Query().Get("c")
 	if c == "" {
 		c = "png"
@@ -662,14 +1377,47 @@ func (me *Server) serveIcon(w http.ResponseWriter, r *http.Request) {
 		args = append(args, "-t", strconv.Itoa(rand.Intn(100)))
 	}
 
-	args = append(args, "-i", filePath, "-o", "/dev/stdout", "-c"+c)
-	cmd := exec.Command("ffmpegthumbnailer", args...)
-	// cmd.Stderr = os.Stderr
-	body, err := cmd.Output()
+	var version fileVersion
+	objectPath := path.Clean("/" + r.URL.Query().Get("path"))
+	// Random thumbnails aren't worth keeping.
+	if me.index != nil && !randThumbnail {
+		if fi, err := me.contentFS().Stat(filePath); err == nil {
+			version = fileVersionOf(fi)
+		}
+		body, ok := me.index.thumbnail(objectPath, c, version)
+		me.metrics.cacheLookup("thumbnail", ok)
+		if ok {
+			http.ServeContent(w, r, "", version.ModTime, bytes.NewReader(body))
+			return
+		}
+	}
+	// Stop filling the index with thumbnails once it's low on space, and serve the device icon
+	// instead.
+	if me.index != nil && me.disks.low(indexDiskName) {
+		icon := me.settings().Icons[0]
+		w.Header().Set("Content-Type", icon.Mimetype)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(icon.Bytes))
+		return
+	}
+
+	var body []byte
+	if mt, _ := mimeTypeInFS(me.contentFS(), filePath); scalableImage(mt) {
+		// Photos are scaled here rather than by ffmpegthumbnailer, so they're turned upright.
+		body, err = scaleImageFile(r.Context(), me.contentFS(), filePath, thumbnailProfile, c)
+	} else {
+		args = append(args, "-i", filePath, "-o", "/dev/stdout", "-c"+c)
+		cmd := exec.Command("ffmpegthumbnailer", args...)
+		// cmd.Stderr = os.Stderr
+		body, err = cmd.Output()
+	}
+	if err == nil && !version.ModTime.IsZero() {
+		me.index.storeThumbnail(objectPath, c, version, body)
+	}
 	if err != nil {
 		// serve 1st Icon if no ffmpegthumbnailer
-		w.Header().Set("Content-Type", me.Icons[0].Mimetype)
-		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(me.Icons[0].Bytes))
+		icon := me.settings().Icons[0]
+		w.Header().Set("Content-Type", icon.Mimetype)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(icon.Bytes))
 		// http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -677,42 +1425,70 @@ func (me *Server) serveIcon(w http.ResponseWriter, r *http.Request) {
 }
 
 func (me *Server) serveSubtitle(w http.ResponseWriter, r *http.Request) {
-	filePath := me.filePath(r.URL.Query().Get("path"))
-	subtitleFilePath := strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".srt"
-	http.ServeFile(w, r, subtitleFilePath)
+	filePath, err := me.filePath(r.URL.Query().Get("path"))
+	if err != nil {
+		me.resourceError(w, r, resourceNotFound, err)
+		return
+	}
+	base := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	subtitleFilePath := base + ".srt"
+	if lang := me.requestClientPrefs(r).SubtitleLanguage; lang != "" {
+		if _, err := me.contentFS().Stat(base + "." + lang + ".srt"); err == nil {
+			subtitleFilePath = base + "." + lang + ".srt"
+		}
+	}
+	if _, err := me.contentFS().Stat(subtitleFilePath); err != nil {
+		me.resourceError(w, r, fileErrorCause(err), err)
+		return
+	}
+	me.serveFile(w, r, subtitleFilePath)
 }
 
-func (server *Server) contentDirectoryInitialEvent(urls []*url.URL, sid string) {
-	body := xmlMarshalOrPanic(upnp.PropertySet{
-		Properties: []upnp.Property{
-			{
-				Variable: upnp.Variable{
-					XMLName: xml.Name{
-						Local: "SystemUpdateID",
-					},
-					Value: "0",
+func (server *Server) contentDirectoryInitialEvent(sid string) {
+	service := server.services["ContentDirectory"]
+	for _, n := range service.Notifications(sid) {
+		server.notify(n, contentDirectoryEventProperties(server.updateIDs.systemID(), ""))
+	}
+}
+
+// Returns the properties of an event of the ContentDirectory.
+func contentDirectoryEventProperties(systemUpdateID uint32, containerUpdateIDs string) []upnp.Property {
+	return []upnp.Property{
+		{
+			Variable: upnp.Variable{
+				XMLName: xml.Name{
+					Local: "SystemUpdateID",
+				},
+				Value: strconv.FormatUint(uint64(systemUpdateID), 10),
+			},
+		},
+		{
+			Variable: upnp.Variable{
+				XMLName: xml.Name{
+					Local: "ContainerUpdateIDs",
 				},
+				Value: containerUpdateIDs,
 			},
-			// upnp.Property{
-			// 	Variable: upnp.Variable{
-			// 		XMLName: xml.Name{
-			// 			Local: "ContainerUpdateIDs",
-			// 		},
-			// 	},
-			// },
-			// upnp.Property{
-			// 	Variable: upnp.Variable{
-			// 		XMLName: xml.Name{
-			// 			Local: "TransferIDs",
-			// 		},
-			// 	},
-			// },
 		},
-		Space: "urn:schemas-upnp-org:event-1-0",
+		// upnp.Property{
+		// 	Variable: upnp.Variable{
+		// 		XMLName: xml.Name{
+		// 			Local: "TransferIDs",
+		// 		},
+		// 	},
+		// },
+	}
+}
+
+// Sends an event with the properties to a subscriber.
+func (server *Server) notify(n upnp.Notification, props []upnp.Property) {
+	body := xmlMarshalOrPanic(upnp.PropertySet{
+		Properties: props,
+		Space:      "urn:schemas-upnp-org:event-1-0",
 	})
 	body = append([]byte(`<?xml version="1.0"?>`+"\n"), body...)
 	server.eventingLogger.Print(string(body))
-	for _, _url := range urls {
+	for _, _url := range n.URLs {
 		bodyReader := bytes.NewReader(body)
 		req, err := http.NewRequest("NOTIFY", _url.String(), bodyReader)
 		if err != nil {
@@ -722,13 +1498,13 @@ func (server *Server) contentDirectoryInitialEvent(urls []*url.URL, sid string)
 		req.Header["CONTENT-TYPE"] = []string{`text/xml; charset="utf-8"`}
 		req.Header["NT"] = []string{"upnp:event"}
 		req.Header["NTS"] = []string{"upnp:propchange"}
-		req.Header["SID"] = []string{sid}
-		req.Header["SEQ"] = []string{"0"}
+		req.Header["SID"] = []string{n.SID}
+		req.Header["SEQ"] = []string{strconv.FormatUint(uint64(n.Seq), 10)}
 		// req.Header["TRANSFER-ENCODING"] = []string{"chunked"}
 		// req.ContentLength = int64(bodyReader.Len())
 		server.eventingLogger.Print(req.Header)
 		server.eventingLogger.Print("starting notify")
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := eventNotifyClient.Do(req)
 		server.eventingLogger.Print("finished notify")
 		if err != nil {
 			log.Printf("Could not notify %s: %s", _url.String(), err)
@@ -742,7 +1518,7 @@ func (server *Server) contentDirectoryInitialEvent(urls []*url.URL, sid string)
 }
 
 func (server *Server) contentDirectoryEventSubHandler(w http.ResponseWriter, r *http.Request) {
-	if server.StallEventSubscribe {
+	if server.settings().StallEventSubscribe {
 		// I have an LG TV that doesn't like my eventing implementation.
 		// Returning unimplemented (501?) errors, results in repeat subscribe
 		// attempts which hits some kind of error count limit on the TV
@@ -762,17 +1538,22 @@ func (server *Server) contentDirectoryEventSubHandler(w http.ResponseWriter, r *
 		server.eventingLogger.Printf("stalled subscribe connection went away after %s", time.Since(t))
 		return
 	}
-	// The following code is a work in progress. It partially implements
-	// the spec on eventing but hasn't been completed as I have nothing to
-	// test it with.
+	// Subscribers are sent the SystemUpdateID and the ContainerUpdateIDs when the index finds
+	// containers have changed, so they can refresh them.
+	server.serveEventSub(w, r, "ContentDirectory", server.contentDirectoryInitialEvent)
+}
+
+// Handles subscriptions to the events of the service, by name, sending each new subscriber its
+// initial event with initialEvent.
+func (server *Server) serveEventSub(w http.ResponseWriter, r *http.Request, name string, initialEvent func(sid string)) {
 	server.eventingLogger.Print(r.Header)
-	service := server.services["ContentDirectory"]
+	service := server.services[name]
 	server.eventingLogger.Println(r.RemoteAddr, r.Method, r.Header.Get("SID"))
 	if r.Method == "SUBSCRIBE" && r.Header.Get("SID") == "" {
+		server.devices.seen(requestClientIP(r), deviceSeenSubscribe, r.UserAgent(), time.Now())
 		urls := upnp.ParseCallbackURLs(r.Header.Get("CALLBACK"))
 		server.eventingLogger.Println(urls)
-		var timeout int
-		fmt.Sscanf(r.Header.Get("TIMEOUT"), "Second-%d", &timeout)
+		timeout := eventSubscriptionTimeout(r.Header.Get("TIMEOUT"))
 		server.eventingLogger.Println(timeout, r.Header.Get("TIMEOUT"))
 		sid, timeout, _ := service.Subscribe(urls, timeout)
 		w.Header()["SID"] = []string{sid}
@@ -781,19 +1562,30 @@ func (server *Server) contentDirectoryEventSubHandler(w http.ResponseWriter, r *
 		w.WriteHeader(http.StatusOK)
 		go func() {
 			time.Sleep(100 * time.Millisecond)
-			server.contentDirectoryInitialEvent(urls, sid)
+			initialEvent(sid)
 		}()
 	} else if r.Method == "SUBSCRIBE" {
-		http.Error(w, "meh", http.StatusPreconditionFailed)
+		timeout, err := service.Renew(r.Header.Get("SID"), eventSubscriptionTimeout(r.Header.Get("TIMEOUT")))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		w.Header()["SID"] = []string{r.Header.Get("SID")}
+		w.Header()["TIMEOUT"] = []string{fmt.Sprintf("Second-%d", timeout)}
+	} else if r.Method == "UNSUBSCRIBE" {
+		if err := service.Unsubscribe(r.Header.Get("SID")); err != nil {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		}
 	} else {
 		server.eventingLogger.Printf("unhandled event method: %s", r.Method)
 	}
 }
 
-func (server *Server) serveDynamicStream(w http.ResponseWriter, r *http.Request, metadataPath string) error {
+func (server *Server) serveDynamicStream(w http.ResponseWriter, r *http.Request, metadataPath string) {
 	dmsMediaItem, err := readDynamicStream(metadataPath)
 	if err != nil {
-		return err
+		server.resourceError(w, r, resourceInternalError, err)
+		return
 	}
 
 	aindex := 0
@@ -801,12 +1593,14 @@ func (server *Server) serveDynamicStream(w http.ResponseWriter, r *http.Request,
 	if index != "" {
 		aindex, err = strconv.Atoi(index)
 		if err != nil {
-			return err
+			server.resourceError(w, r, resourceBadRequest, err)
+			return
 		}
 	}
 
 	if aindex < 0 || aindex >= len(dmsMediaItem.Resources) {
-		return fmt.Errorf("invalid index %d, corresponding stream not found", aindex)
+		server.resourceError(w, r, resourceNotFound, fmt.Errorf("invalid index %d, corresponding stream not found", aindex))
+		return
 	}
 	dmsStream := dmsMediaItem.Resources[aindex]
 	dmsTsSpec := transcodeSpec{
@@ -816,10 +1610,10 @@ func (server *Server) serveDynamicStream(w http.ResponseWriter, r *http.Request,
 		Transcode:       transcode.Exec,
 	}
 	server.serveDLNATranscode(w, r, dmsStream.Command, dmsTsSpec, filepath.Base(metadataPath), true)
-	return nil
 }
 
-func (server *Server) initMux(mux *http.ServeMux) {
+// Install the handlers for the web UI, which is served on both the DLNA and admin listeners.
+func (server *Server) initWebUIMux(mux *http.ServeMux) {
 	// Handle root (presentationURL)
 	mux.HandleFunc("/", func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("content-type", "text/html")
@@ -828,87 +1622,153 @@ func (server *Server) initMux(mux *http.ServeMux) {
 			Path     string
 		}{
 			true,
-			server.RootObjectPath,
+			server.sharedDirs().rootObjectPath,
 		})
 		if err != nil {
 			log.Println(err)
 		}
 	})
+	mux.HandleFunc(logPath, server.serveLog)
+	mux.Handle(metricsPath, server.metrics.handler())
+	mux.HandleFunc(statusPath, server.serveStatus)
+	mux.HandleFunc(browsePath, server.serveBrowse)
+	mux.HandleFunc(apiBrowsePath, server.serveAPIBrowse)
+	mux.HandleFunc(apiSearchPath, server.serveAPISearch)
+	mux.HandleFunc(apiItemPath, server.serveAPIItem)
+	mux.HandleFunc(apiItemsPath, server.serveAPIItemDetail)
+	mux.HandleFunc(apiStatusPath, server.serveAPIStatus)
+	mux.HandleFunc(apiStreamsPath, server.serveAPIStreams)
+	mux.HandleFunc(apiTokensPath, server.serveAPITokens)
+	mux.HandleFunc(apiBookmarksPath, server.serveAPIBookmarks)
+	mux.HandleFunc(apiWatchedPath, server.serveAPIWatched)
+	mux.HandleFunc(apiRenderersPath, server.serveAPIRenderers)
+	mux.HandleFunc(apiDevicesPath, server.serveAPIDevices)
+	mux.HandleFunc(apiPlayPath, server.serveAPIPlay)
+	mux.HandleFunc(apiUnlockPath, server.serveAPIUnlock)
+	mux.HandleFunc(apiRescanPath, server.serveAPIRescan)
+	mux.HandleFunc(tokensPath, server.serveTokens)
+	mux.HandleFunc(clientsPath, server.serveClients)
+	mux.HandleFunc(parentalPath, server.serveParental)
+	mux.HandleFunc(trashPath, server.serveTrash)
+	mux.HandleFunc(settingsPath, server.serveSettings)
+	// Control points send what they upload here, once CreateObject has given them the URL. It's
+	// authorized like the web UI, as it adds files to the shared directories.
+	mux.HandleFunc(uploadPath, server.serveUpload)
+}
+
+func (server *Server) initMux(mux *http.ServeMux) {
+	server.initWebUIMux(mux)
 	mux.HandleFunc(contentDirectoryEventSubURL, server.contentDirectoryEventSubHandler)
+	server.initOpenHomeMux(mux)
 	mux.HandleFunc(iconPath, server.serveIcon)
 	mux.HandleFunc(subtitlePath, server.serveSubtitle)
-	mux.HandleFunc(resPath, func(w http.ResponseWriter, r *http.Request) {
-		filePath := server.filePath(r.URL.Query().Get("path"))
+	mux.HandleFunc(imagePath, server.serveScaledImage)
+	mux.HandleFunc(folderArtPath, server.serveFolderArt)
+	mux.HandleFunc(audiobookPath, server.streamHandler(server.serveAudiobook))
+	mux.HandleFunc(archivePath, server.streamHandler(server.serveArchiveEntry))
+	mux.HandleFunc(discPath, server.streamHandler(server.serveDisc))
+	mux.HandleFunc(resPath, server.streamHandler(func(w http.ResponseWriter, r *http.Request) {
+		if rs, _, ok := server.remoteStream(r.URL.Query().Get("path")); ok {
+			server.serveRemoteStream(w, r, rs)
+			return
+		}
+		filePath, err := server.filePath(r.URL.Query().Get("path"))
+		if err != nil {
+			server.resourceError(w, r, resourceNotFound, err)
+			return
+		}
 		if ignored, err := server.IgnorePath(filePath); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			server.resourceError(w, r, resourceInternalError, err)
 			return
 		} else if ignored {
-			http.Error(w, "no such object", http.StatusNotFound)
+			server.resourceError(w, r, resourceNotFound, errors.New("no such object"))
+			return
+		}
+		fi, err := server.statFS(filePath)
+		if err != nil {
+			server.resourceError(w, r, fileErrorCause(err), err)
+			return
+		}
+		if isStreamURLFile(filePath) {
+			server.serveStreamURL(w, r, filePath)
 			return
 		}
 		if strings.HasSuffix(filePath, dmsMetadataSuffix) {
-			if server.AllowDynamicStreams {
-				err := server.serveDynamicStream(w, r, filePath)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-				}
+			if server.settings().AllowDynamicStreams {
+				server.serveDynamicStream(w, r, filePath)
 				return
 			} else {
-				http.Error(w, "dynamic streams are disabled", http.StatusNotFound)
+				server.resourceError(w, r, resourceDisabled, errors.New("dynamic streams are disabled"))
 				return
 			}
 		}
+		s := server.settings()
 		var k string
-		if server.ForceTranscodeTo != "" {
-			k = server.ForceTranscodeTo
+		if s.ForceTranscodeTo != "" {
+			k = s.ForceTranscodeTo
 		} else {
 			k = r.URL.Query().Get("transcode")
 		}
-		mimeType, err := MimeTypeByPath(filePath)
+		mimeType, err := server.mimeTypeByPath(filePath)
 		if k == "" || mimeType.IsImage() {
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				server.resourceError(w, r, resourceInternalError, err)
+				return
+			}
+			w.Header().Set("Content-Type", server.mimeTypeOverrides(r.UserAgent()).mimeType(string(mimeType)))
+			w.Header().Set("Content-Disposition", attachmentDisposition(path.Base(filePath)))
+			if server.incompleteFiles() == IncompleteFilesGrow && fileIncomplete(server.contentFS(), filePath, fi, time.Now()) {
+				server.serveGrowingFile(w, r, filePath)
 				return
 			}
-			w.Header().Set("Content-Type", string(mimeType))
-			w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(path.Base(filePath)))
-			http.ServeFile(w, r, filePath)
+			server.serveFile(w, r, filePath)
 			return
 		}
-		if server.NoTranscode {
-			http.Error(w, "transcodes disabled", http.StatusNotFound)
+		if s.NoTranscode {
+			server.resourceError(w, r, resourceDisabled, errors.New("transcodes disabled"))
 			return
 		}
 		spec, ok := transcodes[k]
 		if !ok {
-			http.Error(w, fmt.Sprintf("bad transcode spec key: %s", k), http.StatusBadRequest)
+			spec, ok, err = parseAudioTranscode(k, r.URL.Query())
+			if err != nil {
+				server.resourceError(w, r, resourceBadRequest, err)
+				return
+			}
+		}
+		if !ok {
+			server.resourceError(w, r, resourceBadRequest, fmt.Errorf("bad transcode spec key: %s", k))
 			return
 		}
-		server.serveDLNATranscode(w, r, filePath, spec, k, false)
-	})
+		server.serveDLNATranscode(w, r, filePath, server.hwTranscodeSpec(spec), k, false)
+	}))
 	mux.HandleFunc(rootDescPath, func(w http.ResponseWriter, r *http.Request) {
+		server.mu.RLock()
+		rootDescXML := server.rootDescXML
+		server.mu.RUnlock()
 		w.Header().Set("content-type", `text/xml; charset="utf-8"`)
-		w.Header().Set("content-length", fmt.Sprint(len(server.rootDescXML)))
-		w.Header().Set("server", serverField)
-		w.Write(server.rootDescXML)
+		w.Header().Set("content-length", fmt.Sprint(len(rootDescXML)))
+		w.Header().Set("server", server.serverField)
+		w.Write(rootDescXML)
 	})
 	handleSCPDs(mux)
 	mux.HandleFunc(serviceControlURL, server.serviceControlHandler)
-	mux.HandleFunc("/debug/pprof/", pprof.Index)
-	// DeviceIcons
-	iconHandl := func(w http.ResponseWriter, r *http.Request) {
+	// DeviceIcons. The icons can change on Reload, so every index is routed here.
+	mux.HandleFunc(deviceIconPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		icons := server.settings().Icons
+		if len(icons) == 0 {
+			http.NotFound(w, r)
+			return
+		}
 		idStr := path.Base(r.URL.Path)
 		id, _ := strconv.Atoi(idStr)
-		if id < 0 || id >= len(server.Icons) {
+		if id < 0 || id >= len(icons) {
 			id = 0
 		}
-		di := server.Icons[id]
+		di := icons[id]
 		w.Header().Set("Content-Type", di.Mimetype)
 		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(di.Bytes))
-	}
-	for i := range server.Icons {
-		mux.HandleFunc(fmt.Sprintf("%s/%d", deviceIconPath, i), iconHandl)
-	}
+	})
 }
 
 func (s *Server) initServices() (err error) {
@@ -924,30 +1784,108 @@ func (s *Server) initServices() (err error) {
 	if err != nil {
 		return
 	}
+	cds := &contentDirectoryService{Server: s}
+	cds.soapActions = cds.actions()
+	cms := &connectionManagerService{Server: s}
+	cms.soapActions = cms.actions()
+	mrrs := &mediaReceiverRegistrarService{Server: s}
+	mrrs.soapActions = mrrs.actions()
 	s.services = map[string]UPnPService{
-		urn.Type: &contentDirectoryService{
-			Server: s,
-		},
-		urn1.Type: &connectionManagerService{
-			Server: s,
-		},
-		urn2.Type: &mediaReceiverRegistrarService{
-			Server: s,
-		},
+		urn.Type:  cds,
+		urn1.Type: cms,
+		urn2.Type: mrrs,
 	}
+	s.initOpenHomeServices()
 	return
 }
 
 func (srv *Server) Init() (err error) {
+	if srv.Logger.IsZero() {
+		srv.Logger = log.Default.WithNames("dms")
+	}
+	srv.logs = newLogRing(logRingSize)
+	srv.Logger.SetHandlers(append(srv.Logger.Handlers[:len(srv.Logger.Handlers):len(srv.Logger.Handlers)], srv.logs)...)
 	srv.eventingLogger = srv.Logger.WithNames("eventing")
 	srv.eventingLogger.Levelf(log.Debug, "hello %v", "world")
 	if err = srv.initServices(); err != nil {
 		return
 	}
+	srv.metrics = newServerMetrics(srv)
+	if err = srv.initRootDirs(); err != nil {
+		return
+	}
+	if err = srv.initMetadataProviders(); err != nil {
+		return
+	}
+	if err = srv.initHooks(); err != nil {
+		return
+	}
+	if err = srv.initRemoteStreams(); err != nil {
+		return
+	}
+	if err = srv.initAudioProfiles(); err != nil {
+		return
+	}
+	if err = srv.HWAccel.Check(); err != nil {
+		return
+	}
+	if err = srv.initIncompleteFiles(); err != nil {
+		return
+	}
+	if err = srv.initProblemFiles(); err != nil {
+		return
+	}
+	if err = srv.initAccessLog(); err != nil {
+		return
+	}
+	if err = srv.initSSDPAllowInterfaces(); err != nil {
+		return
+	}
+	if err = srv.initWebUsers(); err != nil {
+		return
+	}
+	if err = srv.initClientRules(); err != nil {
+		return
+	}
+	if err = srv.initProtectedContainers(); err != nil {
+		return
+	}
+	if err = srv.initLocale(); err != nil {
+		return
+	}
+	if err = srv.initMimeTypeOverrides(); err != nil {
+		return
+	}
+	if err = srv.initDigestKey(); err != nil {
+		return
+	}
+	srv.warnSimulatedNetwork()
+	if err = srv.initNamePatterns(); err != nil {
+		return
+	}
+	if err = srv.initNotifyAddrs(); err != nil {
+		return
+	}
+	if err = srv.audiobookPositions.load(srv.AudiobookPositionsPath); err != nil {
+		return fmt.Errorf("loading audiobook positions: %w", err)
+	}
+	if err = srv.bookmarks.load(srv.BookmarksPath); err != nil {
+		return fmt.Errorf("loading bookmarks: %w", err)
+	}
+	if err = srv.watched.load(srv.WatchedPath); err != nil {
+		return fmt.Errorf("loading watched videos: %w", err)
+	}
+	if err = srv.apiTokens.Load(srv.APITokensPath); err != nil {
+		return fmt.Errorf("loading API tokens: %w", err)
+	}
+	if err = srv.clientPrefs.load(srv.ClientPrefsPath); err != nil {
+		return fmt.Errorf("loading client preferences: %w", err)
+	}
 	srv.closed = make(chan struct{})
 	if srv.FriendlyName == "" {
 		srv.FriendlyName = getDefaultFriendlyName()
 	}
+	srv.reloadable.Store(srv.takeSettings())
 	if srv.HTTPConn == nil {
 		srv.HTTPConn, err = net.Listen("tcp", "")
 		if err != nil {
@@ -960,8 +1898,9 @@ func (srv *Server) Init() (err error) {
 			log.Print(err)
 		}
 		var tmp []net.Interface
+		// Those that are down are kept for SSDP to start on if they come up.
 		for _, if_ := range ifs {
-			if if_.Flags&net.FlagUp == 0 || if_.MTU <= 0 {
+			if if_.MTU <= 0 {
 				continue
 			}
 			tmp = append(tmp, if_)
@@ -973,53 +1912,126 @@ func (srv *Server) Init() (err error) {
 	}
 	srv.httpServeMux = http.NewServeMux()
 	srv.rootDeviceUUID = makeDeviceUuid(srv.FriendlyName)
-	srv.rootDescXML, err = xml.MarshalIndent(
-		upnp.DeviceDesc{
-			NSDLNA:      "urn:schemas-dlna-org:device-1-0",
-			NSSEC:       "http://www.sec.co.kr/dlna",
-			SpecVersion: upnp.SpecVersion{Major: 1, Minor: 0},
-			Device: upnp.Device{
-				DeviceType:   rootDeviceType,
-				FriendlyName: srv.FriendlyName,
-				Manufacturer: "Matt Joiner <anacrolix@gmail.com>",
-				ModelName:    rootDeviceModelName,
-				UDN:          srv.rootDeviceUUID,
-				VendorXML: `
+	switch srv.UPnPVersion {
+	case "":
+		srv.UPnPVersion = UPnPVersion11
+	case UPnPVersion10, UPnPVersion11, UPnPVersion20:
+	default:
+		return fmt.Errorf("unknown UPnP version %q, want 1.0, 1.1 or 2.0", srv.UPnPVersion)
+	}
+	srv.serverField = makeServerField(srv.UPnPVersion)
+	srv.rootDescXML, srv.configID, err = srv.makeRootDescXML()
+	if err != nil {
+		return
+	}
+	// Boot IDs must increase across restarts, which the time does.
+	srv.bootID = int32(time.Now().Unix())
+	// So must the SystemUpdateID, so that control points don't keep what they have from before.
+	srv.updateIDs.system = uint32(srv.bootID)
+	srv.Logger.Println("HTTP srv on", srv.HTTPConn.Addr())
+	srv.initMux(srv.httpServeMux)
+	// For telling requests for the web UI from those for DLNA.
+	srv.webUIServeMux = http.NewServeMux()
+	srv.initWebUIMux(srv.webUIServeMux)
+	if srv.HTTPSConn != nil {
+		if srv.TLSConfig == nil {
+			return errors.New("HTTPSConn requires TLSConfig")
+		}
+		srv.Logger.Println("HTTPS srv on", srv.HTTPSConn.Addr())
+	}
+	if srv.AdminConn != nil {
+		srv.Logger.Println("admin HTTP srv on", srv.AdminConn.Addr())
+		srv.adminServeMux = http.NewServeMux()
+		srv.initWebUIMux(srv.adminServeMux)
+	}
+	if srv.DebugConn != nil {
+		srv.Logger.Println("debug HTTP srv on", srv.DebugConn.Addr())
+		srv.debugServeMux = http.NewServeMux()
+		srv.initDebugMux(srv.debugServeMux)
+	}
+	if srv.IndexPath != "" {
+		srv.index, err = openIndex(srv, srv.IndexPath)
+		if err != nil {
+			return fmt.Errorf("opening index: %w", err)
+		}
+	}
+	srv.ssdpStopped = make(chan struct{})
+	return nil
+}
+
+// Returns the device description, and its config ID for CONFIGID.UPNP.ORG. The ID is derived from
+// the rest of the description, so that it stays the same across restarts until the description
+// changes.
+func (srv *Server) makeRootDescXML() (b []byte, configID int32, err error) {
+	b, err = srv.marshalRootDesc(0)
+	if err != nil {
+		return
+	}
+	h := fnv.New32a()
+	h.Write(b)
+	// Config IDs are at most 2^24-1, and 0 would be omitted.
+	configID = int32(h.Sum32()%(1<<24-1)) + 1
+	b, err = srv.marshalRootDesc(configID)
+	return
+}
+
+func (srv *Server) marshalRootDesc(configID int32) ([]byte, error) {
+	desc := upnp.DeviceDesc{
+		NSDLNA:      "urn:schemas-dlna-org:device-1-0",
+		NSSEC:       "http://www.sec.co.kr/dlna",
+		ConfigID:    configID,
+		SpecVersion: upnp.SpecVersion{Major: 1, Minor: 1},
+		Device: upnp.Device{
+			DeviceType:   rootDeviceType,
+			FriendlyName: srv.settings().FriendlyName,
+			Manufacturer: "Matt Joiner <anacrolix@gmail.com>",
+			ModelName:    rootDeviceModelName,
+			ModelNumber:  Version(),
+			UDN:          srv.rootDeviceUUID,
+			VendorXML: `
      <dlna:X_DLNACAP/>
      <dlna:X_DLNADOC>DMS-1.50</dlna:X_DLNADOC>
      <dlna:X_DLNADOC>M-DMS-1.50</dlna:X_DLNADOC>
      <sec:ProductCap>smi,DCM10,getMediaInfo.sec,getCaptionInfo.sec</sec:ProductCap>
      <sec:X_ProductCap>smi,DCM10,getMediaInfo.sec,getCaptionInfo.sec</sec:X_ProductCap>`,
-				ServiceList: func() (ss []upnp.Service) {
-					for _, s := range services {
-						ss = append(ss, s.Service)
-					}
-					return
-				}(),
-				IconList: func() (ret []upnp.Icon) {
-					for i, di := range srv.Icons {
-						ret = append(ret, upnp.Icon{
-							Height:   di.Height,
-							Width:    di.Width,
-							Depth:    di.Depth,
-							Mimetype: di.Mimetype,
-							URL:      fmt.Sprintf("%s/%d", deviceIconPath, i),
-						})
-					}
-					return
-				}(),
-				PresentationURL: "/",
-			},
+			ServiceList: func() (ss []upnp.Service) {
+				for _, s := range srv.offeredServices() {
+					ss = append(ss, s.Service)
+				}
+				return
+			}(),
+			IconList: func() (ret []upnp.Icon) {
+				for i, di := range srv.settings().Icons {
+					ret = append(ret, upnp.Icon{
+						Height:   di.Height,
+						Width:    di.Width,
+						Depth:    di.Depth,
+						Mimetype: di.Mimetype,
+						URL:      fmt.Sprintf("%s/%d", deviceIconPath, i),
+					})
+				}
+				return
+			}(),
+			PresentationURL: "/",
 		},
-		" ", "  ")
+	}
+	switch srv.UPnPVersion {
+	case UPnPVersion10:
+		// configId came with UPnP 1.1.
+		desc.SpecVersion.Minor = 0
+		desc.ConfigID = 0
+	case UPnPVersion20:
+		desc.SpecVersion = upnp.SpecVersion{Major: 2, Minor: 0}
+		desc.Device.ManufacturerURL = projectURL
+		desc.Device.ModelDescription = "UPnP DLNA Digital Media Server"
+		desc.Device.ModelURL = projectURL
+		desc.Device.SerialNumber = strings.TrimPrefix(srv.rootDeviceUUID, "uuid:")
+	}
+	b, err := xml.MarshalIndent(desc, " ", "  ")
 	if err != nil {
-		return
+		return nil, err
 	}
-	srv.rootDescXML = append([]byte(`<?xml version="1.0"?>`), srv.rootDescXML...)
-	srv.Logger.Println("HTTP srv on", srv.HTTPConn.Addr())
-	srv.initMux(srv.httpServeMux)
-	srv.ssdpStopped = make(chan struct{})
-	return nil
+	return append([]byte(`<?xml version="1.0"?>`), b...), nil
 }
 
 // Deprecated: Use Init and then Run. There's a race calling Close on a Server that's had Serve
@@ -1033,28 +2045,98 @@ func (srv *Server) Serve() (err error) {
 }
 
 func (srv *Server) Run() (err error) {
+	if srv.index != nil {
+		srv.index.start()
+	}
+	go srv.monitorDisks()
+	go srv.monitorUpdates()
+	go srv.startMPRIS()
+	go srv.pollOpenHome()
 	go func() {
 		srv.doSSDP()
 		close(srv.ssdpStopped)
 	}()
-	return srv.serveHTTP()
+	if srv.AdminConn != nil {
+		go func() {
+			if err := srv.serveHTTP(srv.AdminConn, srv.adminServeMux); err != nil {
+				srv.Logger.Levelf(log.Error, "error serving admin HTTP: %v", err)
+			}
+		}()
+	}
+	if srv.HTTPSConn != nil {
+		go func() {
+			if err := srv.serveHTTP(srv.HTTPSConn, srv.httpServeMux); err != nil {
+				srv.Logger.Levelf(log.Error, "error serving HTTPS: %v", err)
+			}
+		}()
+	}
+	if srv.DebugConn != nil {
+		go func() {
+			if err := srv.serveHTTP(srv.DebugConn, srv.debugServeMux); err != nil {
+				srv.Logger.Levelf(log.Error, "error serving debug HTTP: %v", err)
+			}
+		}()
+	}
+	return srv.serveHTTP(srv.HTTPConn, srv.httpServeMux)
 }
 
+// How long transcoders are given to exit once interrupted, before they're killed.
+const transcoderStopTimeout = 5 * time.Second
+
+// Stops serving. New connections are refused, streams are let finish for up to ShutdownTimeout,
+// and then what's left is closed, transcoders are stopped, and the server says byebye.
 func (srv *Server) Close() (err error) {
+	srv.mu.Lock()
+	httpServers := srv.httpServers
+	timeout := srv.settings().ShutdownTimeout
+	srv.mu.Unlock()
+	if n := len(srv.streams.list()); n != 0 && timeout > 0 {
+		srv.Logger.Levelf(log.Info, "letting %d streams finish for up to %v", n, timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, hs := range httpServers {
+		if hs.Shutdown(ctx) != nil {
+			hs.Close()
+		}
+	}
+	// They may not have started serving yet.
+	if srv.AdminConn != nil {
+		srv.AdminConn.Close()
+	}
+	if srv.DebugConn != nil {
+		srv.DebugConn.Close()
+	}
+	if srv.HTTPSConn != nil {
+		srv.HTTPSConn.Close()
+	}
+	if closeErr := srv.HTTPConn.Close(); !errors.Is(closeErr, net.ErrClosed) {
+		err = closeErr
+	}
+	transcode.StopAll(transcoderStopTimeout)
 	close(srv.closed)
-	err = srv.HTTPConn.Close()
+	srv.stopMPRIS()
 	<-srv.ssdpStopped
+	if srv.index != nil {
+		if indexErr := srv.index.Close(); err == nil {
+			err = indexErr
+		}
+	}
 	return
 }
 
-func didl_lite(chardata string) string {
-	return `<DIDL-Lite` +
+const (
+	didlLiteStart = `<DIDL-Lite` +
 		` xmlns:dc="http://purl.org/dc/elements/1.1/"` +
 		` xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/"` +
 		` xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/"` +
-		` xmlns:dlna="urn:schemas-dlna-org:metadata-1-0/">` +
-		chardata +
-		`</DIDL-Lite>`
+		` xmlns:dlna="urn:schemas-dlna-org:metadata-1-0/"` +
+		` xmlns:sec="http://www.sec.co.kr/">`
+	didlLiteEnd = `</DIDL-Lite>`
+)
+
+func didl_lite(chardata string) string {
+	return didlLiteStart + chardata + didlLiteEnd
 }
 
 func (me *Server) location(ip net.IP) string {
@@ -1080,15 +2162,22 @@ func (srv *Server) ffmpegProbe(path string) (info *ffprobe.Info, err error) {
 	if err != nil {
 		return
 	}
-	key := ffmpegInfoCacheKey{path, fi.ModTime().UnixNano()}
+	key := ffmpegInfoCacheKey{path, fi.ModTime().UnixNano(), fi.Size()}
 	value, ok := srv.FFProbeCache.Get(key)
+	// Failures aren't cached, so that they're found again for the problems of files. Older caches
+	// have them as nil.
+	if ok {
+		info = value.(*ffprobe.Info)
+		ok = info != nil
+	}
+	srv.metrics.cacheLookup("ffprobe", ok)
 	if !ok {
 		info, err = ffprobe.Run(path)
-		err = suppressFFmpegProbeDataErrors(err)
-		srv.FFProbeCache.Set(key, info)
-		return
+		err = ffmpegProbeDataError(err)
+		if info != nil {
+			srv.FFProbeCache.Set(key, info)
+		}
 	}
-	info = value.(*ffprobe.Info)
 	return
 }
 
@@ -1097,7 +2186,8 @@ func (server *Server) IgnorePath(path string) (bool, error) {
 	if !filepath.IsAbs(path) {
 		return false, fmt.Errorf("Path must be absolute: %s", path)
 	}
-	if server.IgnoreHidden {
+	s := server.settings()
+	if s.IgnoreHidden {
 		if hidden, err := isHiddenPath(path); err != nil {
 			return false, err
 		} else if hidden {
@@ -1105,8 +2195,13 @@ func (server *Server) IgnorePath(path string) (bool, error) {
 			return true, nil
 		}
 	}
-	if server.IgnoreUnreadable {
-		if readable, err := isReadablePath(path); err != nil {
+	if s.IgnoreUnreadable {
+		isReadable := isReadablePath
+		if server.FS != nil {
+			// The local filesystem's permissions are nothing to do with another's.
+			isReadable = func(path string) (bool, error) { return tryToOpenPath(server.FS, path) }
+		}
+		if readable, err := isReadable(path); err != nil {
 			return false, err
 		} else if !readable {
 			log.Print(path, " ignored: unreadable")
@@ -1114,22 +2209,35 @@ func (server *Server) IgnorePath(path string) (bool, error) {
 		}
 	}
 
-	for _, element := range server.IgnorePaths {
+	for _, element := range server.sharedDirs().ignorePaths {
 		if strings.Contains(path, fmt.Sprintf("/%s/", element)) {
 			log.Print(path, " ignored: in ignore list")
 			return true, nil
 		}
 	}
+	if reason := server.filterPath(path); reason != "" {
+		log.Print(path, " ignored: ", reason)
+		return true, nil
+	}
 
 	return false, nil
 }
 
-func tryToOpenPath(path string) (bool, error) {
+func tryToOpenPath(fsys FS, path string) (bool, error) {
 	// Ugly but portable way to check if we can open a file/directory
-	if fh, err := os.Open(path); err == nil {
+	fh, err := fsys.Open(path)
+	if err == nil {
 		fh.Close()
 		return true, nil
-	} else if !os.IsPermission(err) {
+	}
+	// Directories of filesystems other than the local one may only be read with ReadDir.
+	if fi, statErr := fsys.Stat(path); statErr == nil && fi.IsDir() && !os.IsPermission(err) {
+		_, err = fsys.ReadDir(path)
+		if err == nil {
+			return true, nil
+		}
+	}
+	if !os.IsPermission(err) {
 		return false, err
 	}
 	return false, nil
@@ -8,5 +8,5 @@ func isHiddenPath(path string) (bool, error) {
 }
 
 func isReadablePath(path string) (bool, error) {
-	return tryToOpenPath(path)
+	return tryToOpenPath(osFS{}, path)
 }
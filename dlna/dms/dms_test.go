@@ -2,6 +2,7 @@ package dms
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
 	"runtime"
 	"testing"
@@ -64,3 +65,52 @@ func TestResponse(t *testing.T) {
 	resp.Write(&buf)
 	t.Logf("%q", buf.String())
 }
+
+func TestRootDescConfigID(t *testing.T) {
+	srv := &Server{FriendlyName: "one"}
+	desc, configID, err := srv.makeRootDescXML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configID <= 0 || configID >= 1<<24 {
+		t.Fatalf("config ID %d out of range", configID)
+	}
+	if !bytes.Contains(desc, []byte(fmt.Sprintf(`configId="%d"`, configID))) {
+		t.Fatalf("config ID missing from description: %s", desc)
+	}
+	if _, again, _ := srv.makeRootDescXML(); again != configID {
+		t.Errorf("config ID changed from %d to %d with the same description", configID, again)
+	}
+	srv.FriendlyName = "two"
+	if _, changed, _ := srv.makeRootDescXML(); changed == configID {
+		t.Error("config ID didn't change with the description")
+	}
+}
+
+func TestRootDescUPnPVersion(t *testing.T) {
+	srv := &Server{FriendlyName: "one", UPnPVersion: UPnPVersion10, rootDeviceUUID: "uuid:1234"}
+	desc, _, err := srv.makeRootDescXML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(desc, []byte("configId")) || !bytes.Contains(desc, []byte("<minor>0</minor>")) {
+		t.Fatalf("UPnP 1.0 description: %s", desc)
+	}
+	srv.UPnPVersion = UPnPVersion20
+	desc, _, err = srv.makeRootDescXML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(desc, []byte("<major>2</major>")) || !bytes.Contains(desc, []byte("configId")) {
+		t.Fatalf("UPnP 2.0 description: %s", desc)
+	}
+	// The optional fields come in the order UPnP has them, before the UDN.
+	last := 0
+	for _, e := range []string{"<manufacturer>", "<manufacturerURL>", "<modelDescription>", "<modelName>", "<modelURL>", "<serialNumber>1234<", "<UDN>"} {
+		i := bytes.Index(desc, []byte(e))
+		if i < last {
+			t.Fatalf("%s missing or out of order: %s", e, desc)
+		}
+		last = i
+	}
+}
@@ -32,5 +32,5 @@ func isHiddenPath(path string) (hidden bool, err error) {
 }
 
 func isReadablePath(path string) (bool, error) {
-	return tryToOpenPath(path)
+	return tryToOpenPath(osFS{}, path)
 }
@@ -0,0 +1,121 @@
+package dms
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/dms/internal/upnptest"
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// Runs the server on the loopback interface, and finds, browses and streams from it, and
+// subscribes to its events, as a control point on the network does.
+func TestEndToEnd(t *testing.T) {
+	var lo net.Interface
+	ifs, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ifi := range ifs {
+		if ifi.Flags&net.FlagLoopback != 0 && ifi.Flags&net.FlagUp != 0 {
+			lo = ifi
+			break
+		}
+	}
+	if lo.Name == "" {
+		t.Skip("no loopback interface")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newMemFSServer()
+	srv.FriendlyName = "dms end-to-end test"
+	srv.Interfaces = []net.Interface{lo}
+	srv.SSDPAllowInterfaces = []string{lo.Name}
+	srv.HTTPConn = l
+	if err := srv.Init(); err != nil {
+		t.Fatal(err)
+	}
+	go srv.Run()
+	defer srv.Close()
+
+	cp := &upnptest.ControlPoint{Interface: lo}
+	found, err := cp.Search(srv.rootDeviceUUID, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, err := cp.Describe(found.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.Device.FriendlyName != srv.FriendlyName || dev.Device.UDN != srv.rootDeviceUUID {
+		t.Errorf("described as %q, %q", dev.Device.FriendlyName, dev.Device.UDN)
+	}
+	cds, err := dev.Service("ContentDirectory")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	top, err := cp.Browse(cds, "0", false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	var film upnptest.Object
+	for _, o := range top.Objects {
+		titles = append(titles, o.Title)
+		if o.Title == "film.mp4" {
+			film = o
+		}
+	}
+	if top.TotalMatches != 4 || len(top.Objects) != 4 || !top.Objects[0].Container {
+		t.Fatalf("top level %q, %d matches", titles, top.TotalMatches)
+	}
+	page, err := cp.Browse(cds, "0", false, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Objects) != 1 || page.Objects[0].ID != top.Objects[1].ID || page.TotalMatches != 4 {
+		t.Errorf("page %v", page)
+	}
+	md, err := cp.Browse(cds, film.ID, true, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(md.Objects) != 1 || md.Objects[0].Title != "film.mp4" || len(md.Objects[0].Res) == 0 {
+		t.Fatalf("metadata %v", md.Objects)
+	}
+	resp, err := http.Get(md.Objects[0].Res[0].URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(b) != "film" {
+		t.Errorf("streamed %q, %v", b, err)
+	}
+	var upnpErr *upnp.Error
+	if _, err := cp.Browse(cds, "no such object", false, 0, 0); !errors.As(err, &upnpErr) || upnpErr.Code != upnpav.NoSuchObjectErrorCode {
+		t.Errorf("browsing missing object: %v", err)
+	}
+
+	sub, err := cp.Subscribe(cds, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	select {
+	case e := <-sub.Events:
+		if _, ok := e.Properties["SystemUpdateID"]; e.Seq != 0 || !ok {
+			t.Errorf("initial event %v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("no initial event")
+	}
+}
@@ -0,0 +1,253 @@
+package dms
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"time"
+)
+
+// The most read of the start of a JPEG for its EXIF and dimensions.
+const maxJPEGHeaderSize = 256 << 10
+
+// What's read from the EXIF and frame header of a JPEG. Zero fields are unknown.
+type jpegInfo struct {
+	Width, Height int
+	// From 1, upright, to 8. Orientations 5 to 8 are turned a quarter.
+	Orientation int
+	// When the photo was taken, in its wall clock time if the offset isn't known.
+	Taken    time.Time
+	HasGPS   bool
+	Latitude float64
+	// East of Greenwich is positive.
+	Longitude float64
+}
+
+// Returns the dimensions with the sides swapped if the orientation turns the image a quarter.
+func (me jpegInfo) uprightSize() (int, int) {
+	if me.Orientation >= 5 {
+		return me.Height, me.Width
+	}
+	return me.Width, me.Height
+}
+
+func readJPEGInfo(fsys FS, filePath string) (jpegInfo, error) {
+	f, err := fsys.Open(filePath)
+	if err != nil {
+		return jpegInfo{}, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, maxJPEGHeaderSize))
+	if err != nil {
+		return jpegInfo{}, err
+	}
+	return parseJPEGInfo(b), nil
+}
+
+// Parses the segments of a JPEG up to the image data.
+func parseJPEGInfo(b []byte) (ret jpegInfo) {
+	ret.Orientation = 1
+	if len(b) < 4 || b[0] != 0xff || b[1] != 0xd8 {
+		return
+	}
+	b = b[2:]
+	for len(b) >= 4 && b[0] == 0xff {
+		marker := b[1]
+		// Start of scan, or end of image: there are no more headers.
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(b[2:4]))
+		if n < 2 || len(b) < 2+n {
+			break
+		}
+		seg := b[4 : 2+n]
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")):
+			parseExif(seg[6:], &ret)
+		// Start of frame, other than DHT, JPG and DAC, which share the range.
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			if len(seg) >= 5 {
+				ret.Height = int(binary.BigEndian.Uint16(seg[1:3]))
+				ret.Width = int(binary.BigEndian.Uint16(seg[3:5]))
+			}
+			return
+		}
+		b = b[2+n:]
+	}
+	return
+}
+
+// Returns the EXIF orientation of a JPEG, from 1 to 8, or 1 if it has none.
+func jpegOrientation(b []byte) int {
+	return parseJPEGInfo(b).Orientation
+}
+
+// The TIFF structure EXIF is stored in.
+type tiff struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+// Calls f with the tag, type and value of each entry of the IFD at offset.
+func (me tiff) entries(offset int, f func(tag, typ uint16, value []byte)) {
+	if offset < 8 || offset+2 > len(me.b) {
+		return
+	}
+	count := int(me.order.Uint16(me.b[offset:]))
+	for i := 0; i < count; i++ {
+		e := offset + 2 + 12*i
+		if e+12 > len(me.b) {
+			return
+		}
+		tag, typ := me.order.Uint16(me.b[e:]), me.order.Uint16(me.b[e+2:])
+		var size int
+		switch typ {
+		case 1, 2, 7:
+			size = 1
+		case 3:
+			size = 2
+		case 4, 9:
+			size = 4
+		case 5, 10:
+			size = 8
+		default:
+			continue
+		}
+		n := int(me.order.Uint32(me.b[e+4:]))
+		if n <= 0 || n > len(me.b)/size {
+			continue
+		}
+		n *= size
+		// Values of up to 4 bytes are in the entry, and the rest are at an offset.
+		value := me.b[e+8 : e+8+4]
+		if n <= 4 {
+			value = value[:n]
+		} else {
+			off := int(me.order.Uint32(value))
+			if off < 0 || off+n > len(me.b) {
+				continue
+			}
+			value = me.b[off : off+n]
+		}
+		f(tag, typ, value)
+	}
+}
+
+func (me tiff) uint(typ uint16, value []byte) int {
+	switch typ {
+	case 3:
+		return int(me.order.Uint16(value))
+	case 4:
+		return int(me.order.Uint32(value))
+	}
+	return 0
+}
+
+// Returns the degrees of a GPS coordinate given as degrees, minutes and seconds.
+func (me tiff) degrees(typ uint16, value []byte) (float64, bool) {
+	if typ != 5 || len(value) < 24 {
+		return 0, false
+	}
+	var ret float64
+	for i, unit := range []float64{1, 60, 3600} {
+		num, den := me.order.Uint32(value[8*i:]), me.order.Uint32(value[8*i+4:])
+		if den == 0 {
+			return 0, false
+		}
+		ret += float64(num) / float64(den) / unit
+	}
+	return ret, true
+}
+
+func exifString(value []byte) string {
+	return strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+}
+
+// Parses EXIF dates, such as "2023:07:14 18:03:22", with an offset such as "+02:00" if there's
+// one.
+func parseExifTime(s, offset string) time.Time {
+	loc := time.UTC
+	if t, err := time.Parse("-07:00", offset); err == nil {
+		loc = t.Location()
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", s, loc)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func parseExif(b []byte, ret *jpegInfo) {
+	if len(b) < 8 {
+		return
+	}
+	t := tiff{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return
+	}
+	var exifIFD, gpsIFD int
+	var dateTime string
+	t.entries(int(t.order.Uint32(b[4:8])), func(tag, typ uint16, value []byte) {
+		switch tag {
+		case 0x0112:
+			if o := t.uint(typ, value); o >= 1 && o <= 8 {
+				ret.Orientation = o
+			}
+		case 0x0132:
+			dateTime = exifString(value)
+		case 0x8769:
+			exifIFD = t.uint(typ, value)
+		case 0x8825:
+			gpsIFD = t.uint(typ, value)
+		}
+	})
+	var taken, offset string
+	t.entries(exifIFD, func(tag, typ uint16, value []byte) {
+		switch tag {
+		case 0x9003:
+			taken = exifString(value)
+		case 0x9011:
+			offset = exifString(value)
+		case 0xa002:
+			ret.Width = t.uint(typ, value)
+		case 0xa003:
+			ret.Height = t.uint(typ, value)
+		}
+	})
+	if taken == "" {
+		taken = dateTime
+	}
+	ret.Taken = parseExifTime(taken, offset)
+	var latRef, lonRef string
+	var lat, lon float64
+	var haveLat, haveLon bool
+	t.entries(gpsIFD, func(tag, typ uint16, value []byte) {
+		switch tag {
+		case 0x0001:
+			latRef = exifString(value)
+		case 0x0002:
+			lat, haveLat = t.degrees(typ, value)
+		case 0x0003:
+			lonRef = exifString(value)
+		case 0x0004:
+			lon, haveLon = t.degrees(typ, value)
+		}
+	})
+	if !haveLat || !haveLon || lat > 90 || lon > 180 || lat == 0 && lon == 0 {
+		return
+	}
+	if latRef == "S" {
+		lat = -lat
+	}
+	if lonRef == "W" {
+		lon = -lon
+	}
+	ret.HasGPS, ret.Latitude, ret.Longitude = true, lat, lon
+}
@@ -0,0 +1,107 @@
+package dms
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+type exifEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+// Returns big-endian EXIF of the IFDs, which are laid out in order. The values of the Exif and GPS
+// IFD pointers are the indexes of the IFDs they point to.
+func buildExif(ifds ...[]exifEntry) []byte {
+	valuesSize := func(ifd []exifEntry) (n int) {
+		for _, e := range ifd {
+			if len(e.value) > 4 {
+				n += len(e.value)
+			}
+		}
+		return
+	}
+	offsets := []int{8}
+	for _, ifd := range ifds {
+		offsets = append(offsets, offsets[len(offsets)-1]+2+12*len(ifd)+4+valuesSize(ifd))
+	}
+	b := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	be := binary.BigEndian
+	for i, ifd := range ifds {
+		values := offsets[i] + 2 + 12*len(ifd) + 4
+		var extra []byte
+		b = be.AppendUint16(b, uint16(len(ifd)))
+		for _, e := range ifd {
+			b = be.AppendUint16(b, e.tag)
+			b = be.AppendUint16(b, e.typ)
+			b = be.AppendUint32(b, e.count)
+			v := e.value
+			if e.tag == 0x8769 || e.tag == 0x8825 {
+				v = be.AppendUint32(nil, uint32(offsets[v[0]]))
+			}
+			if len(v) > 4 {
+				b = be.AppendUint32(b, uint32(values+len(extra)))
+				extra = append(extra, v...)
+			} else {
+				b = append(b, append(v, make([]byte, 4-len(v))...)...)
+			}
+		}
+		b = append(be.AppendUint32(b, 0), extra...)
+	}
+	return b
+}
+
+func rationals(vs ...uint32) (b []byte) {
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return
+}
+
+func TestParseJPEGInfo(t *testing.T) {
+	exif := buildExif(
+		[]exifEntry{
+			{0x0112, 3, 1, []byte{0, 6}},
+			{0x8769, 4, 1, []byte{1}},
+			{0x8825, 4, 1, []byte{2}},
+		},
+		[]exifEntry{
+			{0x9003, 2, 20, []byte("2023:07:14 18:03:22\x00")},
+			{0x9011, 2, 7, []byte("+02:00\x00")},
+		},
+		[]exifEntry{
+			{0x0001, 2, 2, []byte("N\x00")},
+			{0x0002, 5, 3, rationals(48, 1, 51, 1, 2400, 100)},
+			{0x0003, 2, 2, []byte("W\x00")},
+			{0x0004, 5, 3, rationals(2, 1, 21, 1, 0, 1)},
+		},
+	)
+	app1 := append([]byte("Exif\x00\x00"), exif...)
+	b := append([]byte{0xff, 0xd8, 0xff, 0xe1}, binary.BigEndian.AppendUint16(nil, uint16(len(app1)+2))...)
+	b = append(b, app1...)
+	// A baseline start of frame, 3000 wide and 2000 high.
+	b = append(b, 0xff, 0xc0, 0, 11, 8, 0x07, 0xd0, 0x0b, 0xb8, 1, 1, 0x11, 0)
+	info := parseJPEGInfo(b)
+	if info.Width != 3000 || info.Height != 2000 || info.Orientation != 6 {
+		t.Errorf("%dx%d, orientation %d", info.Width, info.Height, info.Orientation)
+	}
+	if w, h := info.uprightSize(); w != 2000 || h != 3000 {
+		t.Errorf("upright %dx%d", w, h)
+	}
+	if want := time.Date(2023, 7, 14, 16, 3, 22, 0, time.UTC); !info.Taken.Equal(want) {
+		t.Errorf("taken %v", info.Taken)
+	}
+	if !info.HasGPS || math.Abs(info.Latitude-(48+51/60.+24/3600.)) > 1e-9 || info.Longitude != -(2+21/60.) {
+		t.Errorf("location %v %v,%v", info.HasGPS, info.Latitude, info.Longitude)
+	}
+	if info := parseJPEGInfo(b[:len(b)-13]); info.Width != 0 || !info.HasGPS {
+		t.Errorf("without a frame: %+v", info)
+	}
+	if info := parseJPEGInfo(bytes.Repeat([]byte{0xff}, 10)); info != (jpegInfo{Orientation: 1}) {
+		t.Errorf("not a JPEG: %+v", info)
+	}
+}
@@ -0,0 +1,60 @@
+package dms
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// The classes of the containers of Samsung's BASICVIEW feature, by the media type of RootDir.
+var basicViewClasses = []struct {
+	mediaType, class string
+}{
+	{"audio", "object.item.audioItem"},
+	{"video", "object.item.videoItem"},
+	{"image", "object.item.imageItem"},
+}
+
+// Returns the ObjectID of the container Samsung TVs should show media of the type from in their
+// Music, Videos and Photos views: its class container if they're listed, otherwise the root dir
+// that's the only one with the type, or the root.
+func (srv *Server) mediaTypeRootID(mediaType string) string {
+	if srv.classContainersListed() {
+		for _, c := range classContainers {
+			if c.mediaType == mediaType {
+				return c.id
+			}
+		}
+	}
+	var found *RootDir
+	sd := srv.sharedDirs()
+	for i := range sd.rootDirs {
+		rd := &sd.rootDirs[i]
+		if !rd.allowsMediaType(mediaType) {
+			continue
+		}
+		if found != nil {
+			return "0"
+		}
+		found = rd
+	}
+	if found == nil {
+		return "0"
+	}
+	return object{Path: path.Join("/", found.Name)}.ID()
+}
+
+// Returns the FeatureList of GetFeatureList and Samsung's X_GetFeatureList, whose TVs only show
+// their Music, Videos and Photos views of servers that give the BASICVIEW feature. See
+// https://github.com/1100101/minidlna/blob/ca6dbba18390ad6f8b8d7b7dbcf797dbfd95e2db/upnpsoap.c#L2153-L2199.
+func (srv *Server) featureList() string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` +
+		`<Features xmlns="urn:schemas-upnp-org:av:avs" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:schemaLocation="urn:schemas-upnp-org:av:avs http://www.upnp.org/schemas/av/avs.xsd">` +
+		`<Feature name="samsung.com_BASICVIEW" version="1">`)
+	for _, c := range basicViewClasses {
+		fmt.Fprintf(&b, `<container id="%s" type="%s"/>`, xmlEscapeAttr(srv.mediaTypeRootID(c.mediaType)), c.class)
+	}
+	b.WriteString(`</Feature></Features>`)
+	return b.String()
+}
@@ -0,0 +1,27 @@
+package dms
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFeatureList(t *testing.T) {
+	srv := &Server{RootDirs: []RootDir{
+		{Name: "Movies", MediaTypes: []string{"video"}},
+		{Name: "Photos & Home", MediaTypes: []string{"image", "video"}},
+		{Name: "Music", MediaTypes: []string{"audio"}},
+	}}
+	got := srv.featureList()
+	for _, want := range []string{
+		`<container id="%2FMusic" type="object.item.audioItem"/>`,
+		`<container id="0" type="object.item.videoItem"/>`,
+		`<container id="%2FPhotos+%26+Home" type="object.item.imageItem"/>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("no %s in %s", want, got)
+		}
+	}
+	if got := (&Server{}).mediaTypeRootID("audio"); got != "0" {
+		t.Errorf("got %q", got)
+	}
+}
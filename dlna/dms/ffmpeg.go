@@ -1,12 +1,17 @@
 package dms
 
 import (
+	"errors"
 	"os/exec"
 	"runtime"
 	"syscall"
 )
 
-func suppressFFmpegProbeDataErrors(_err error) (err error) {
+// Given by ffmpegProbe for files ffprobe can't make sense of, such as truncated or corrupt ones.
+var errInvalidMediaData = errors.New("invalid data")
+
+// Returns errInvalidMediaData for ffprobe failing on the contents of a file.
+func ffmpegProbeDataError(_err error) (err error) {
 	if _err == nil {
 		return
 	}
@@ -22,10 +27,10 @@ func suppressFFmpegProbeDataErrors(_err error) (err error) {
 	code := waitStat.ExitStatus()
 	if runtime.GOOS == "windows" {
 		if code == -1094995529 {
-			err = nil
+			err = errInvalidMediaData
 		}
 	} else if code == 183 {
-		err = nil
+		err = errInvalidMediaData
 	}
 	return
 }
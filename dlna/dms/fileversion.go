@@ -0,0 +1,41 @@
+package dms
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+)
+
+// The version of a file that something cached about it was made from, such as its probe, a
+// thumbnail or a scaled image, so that it's made again when the file changes. A file replaced by
+// another with the same modification time, as copies that keep times make, nearly always differs
+// in size.
+type fileVersion struct {
+	ModTime time.Time
+	Size    int64
+}
+
+func fileVersionOf(fi os.FileInfo) fileVersion {
+	return fileVersion{fi.ModTime(), fi.Size()}
+}
+
+// The length of the version at the start of cached data.
+const fileVersionLen = 16
+
+// Returns b with the version in front of it.
+func (me fileVersion) prefix(b []byte) []byte {
+	ret := make([]byte, fileVersionLen, fileVersionLen+len(b))
+	binary.BigEndian.PutUint64(ret, uint64(me.ModTime.UnixNano()))
+	binary.BigEndian.PutUint64(ret[8:], uint64(me.Size))
+	return append(ret, b...)
+}
+
+// Returns the data after the version at the start of b, if it's this version.
+func (me fileVersion) trim(b []byte) ([]byte, bool) {
+	if len(b) < fileVersionLen ||
+		int64(binary.BigEndian.Uint64(b)) != me.ModTime.UnixNano() ||
+		int64(binary.BigEndian.Uint64(b[8:])) != me.Size {
+		return nil, false
+	}
+	return b[fileVersionLen:], true
+}
@@ -0,0 +1,112 @@
+package dms
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A file that marks the directory it's in as having no media to show, as on Android.
+const nomediaFileName = ".nomedia"
+
+// Patterns prefixed with this are regular expressions. The rest are globs.
+const regexpPatternPrefix = "re:"
+
+// A pattern that the names of files and directories are matched against.
+type namePattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func compileNamePattern(s string) (ret namePattern, err error) {
+	if strings.HasPrefix(s, regexpPatternPrefix) {
+		ret.re, err = regexp.Compile(strings.TrimPrefix(s, regexpPatternPrefix))
+		return
+	}
+	// Match reports malformed patterns whatever the name.
+	if _, err = filepath.Match(s, ""); err != nil {
+		return ret, fmt.Errorf("bad glob %q: %w", s, err)
+	}
+	ret.glob = s
+	return
+}
+
+func (me namePattern) match(name string) bool {
+	if me.re != nil {
+		return me.re.MatchString(name)
+	}
+	ok, _ := filepath.Match(me.glob, name)
+	return ok
+}
+
+type namePatterns []namePattern
+
+func compileNamePatterns(ss []string) (ret namePatterns, err error) {
+	for _, s := range ss {
+		if s == "" {
+			continue
+		}
+		p, err := compileNamePattern(s)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, p)
+	}
+	return
+}
+
+func (me namePatterns) match(name string) bool {
+	for _, p := range me {
+		if p.match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *Server) initNamePatterns() (err error) {
+	if srv.includePatterns, err = compileNamePatterns(srv.IncludePatterns); err != nil {
+		return fmt.Errorf("include patterns: %w", err)
+	}
+	if srv.excludePatterns, err = compileNamePatterns(srv.ExcludePatterns); err != nil {
+		return fmt.Errorf("exclude patterns: %w", err)
+	}
+	return nil
+}
+
+func hasNomediaFile(fsys FS, dir string) bool {
+	_, err := fsys.Stat(filepath.Join(dir, nomediaFileName))
+	return err == nil
+}
+
+// Returns why the file or directory at path is filtered out by the patterns and .nomedia files, or
+// "" if it isn't.
+func (srv *Server) filterPath(path string) string {
+	s := srv.settings()
+	include, exclude, nomedia := s.includePatterns, s.excludePatterns, s.IgnoreNomedia
+	name := filepath.Base(path)
+	if exclude.match(name) {
+		return "excluded"
+	}
+	if nomedia && hasNomediaFile(srv.contentFS(), filepath.Dir(path)) {
+		return "in .nomedia directory"
+	}
+	if len(include) == 0 && !nomedia {
+		return ""
+	}
+	fi, err := srv.contentFS().Stat(path)
+	if err != nil {
+		return ""
+	}
+	if fi.IsDir() {
+		if nomedia && hasNomediaFile(srv.contentFS(), path) {
+			return "has .nomedia"
+		}
+		return ""
+	}
+	if len(include) != 0 && !include.match(name) {
+		return "not included"
+	}
+	return ""
+}
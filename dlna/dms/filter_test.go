@@ -0,0 +1,64 @@
+package dms
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnorePathFilters(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{
+		"movie.mkv",
+		"movie.nfo",
+		"sample-movie.mkv",
+		"Sample.mkv",
+		"notes.txt",
+		"extras/clip.mkv",
+		"private/.nomedia",
+		"private/photo.jpg",
+	} {
+		p = filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{
+		IgnoreNomedia:   true,
+		IncludePatterns: []string{"*.mkv", "*.nfo"},
+		ExcludePatterns: []string{"*.nfo", "sample-*", "re:(?i)^sample\\."},
+	}
+	if err := srv.initNamePatterns(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"movie.mkv":         false,
+		"movie.nfo":         true,
+		"sample-movie.mkv":  true,
+		"Sample.mkv":        true,
+		"notes.txt":         true,
+		"extras":            false,
+		"extras/clip.mkv":   false,
+		"private":           true,
+		"private/photo.jpg": true,
+	} {
+		got, err := srv.IgnorePath(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("IgnorePath(%q) = %v, want %v", name, got, want)
+		}
+	}
+	srv.ExcludePatterns = []string{"[a-"}
+	if err := srv.initNamePatterns(); err == nil {
+		t.Error("bad glob accepted")
+	}
+	srv.ExcludePatterns = []string{"re:("}
+	if err := srv.initNamePatterns(); err == nil {
+		t.Error("bad regexp accepted")
+	}
+}
@@ -0,0 +1,231 @@
+package dms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/anacrolix/log"
+	"github.com/nfnt/resize"
+)
+
+const (
+	folderArtPath = "/folderart"
+	// Folder art is cached in ImageCacheDir as if it were a scaled image of the folder in this
+	// profile.
+	folderArtCacheProfile = "folder art"
+	// The most pictures in a collage, in a 2x2 grid.
+	folderArtCollageTiles = 4
+)
+
+// Names of pictures of what's in a folder, such as album covers and film posters, in order of
+// preference. They're matched ignoring case.
+var folderArtNames = []string{
+	"folder.jpg", "cover.jpg", "front.jpg", "poster.jpg", "albumart.jpg",
+	"folder.png", "cover.png", "front.png", "poster.png",
+}
+
+// Returns the URL of the art of the container at objectPath.
+func folderArtURL(host, objectPath string) string {
+	return (&url.URL{
+		Scheme:   "http",
+		Host:     host,
+		Path:     folderArtPath,
+		RawQuery: url.Values{"path": {objectPath}}.Encode(),
+	}).String()
+}
+
+// Returns the folder's own art, if it has any, from its entries.
+func findFolderArt(dirPath string, entries []os.DirEntry) (string, bool) {
+	names := make(map[string]string, len(entries))
+	for _, e := range entries {
+		names[strings.ToLower(e.Name())] = e.Name()
+	}
+	for _, n := range folderArtNames {
+		if name, ok := names[n]; ok {
+			return filepath.Join(dirPath, name), true
+		}
+	}
+	return "", false
+}
+
+// Returns the pictures to make a collage of a folder without art from: the art of its subfolders,
+// and its pictures, in the order they're listed.
+func (srv *Server) folderArtCollageSources(dirPath string, entries []os.DirEntry) (ret []string) {
+	for _, e := range entries {
+		if len(ret) == folderArtCollageTiles {
+			break
+		}
+		p := filepath.Join(dirPath, e.Name())
+		if ignored, err := srv.IgnorePath(p); err != nil || ignored {
+			continue
+		}
+		fi, err := srv.contentFS().Stat(p)
+		if err != nil {
+			continue
+		}
+		if fi.IsDir() {
+			if subEntries, err := readFSDirEntries(srv.contentFS(), p); err == nil {
+				if art, ok := findFolderArt(p, subEntries); ok {
+					ret = append(ret, art)
+				}
+			}
+		} else if mt, err := mimeTypeInFS(srv.contentFS(), p); err == nil && scalableImage(mt) {
+			ret = append(ret, p)
+		}
+	}
+	return
+}
+
+// Returns the middle square of img, scaled to size.
+func squareImage(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	corner := b.Min.Add(image.Pt((b.Dx()-side)/2, (b.Dy()-side)/2))
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), img, corner, draw.Src)
+	return resize.Resize(uint(size), uint(size), square, resize.Lanczos3)
+}
+
+// Makes the art of a folder from pictures: the picture scaled to fit a thumbnail if there's one,
+// and otherwise a 2x2 collage of the middles of them, repeating them to fill it.
+func folderArt(ctx context.Context, fsys FS, sources []string) ([]byte, error) {
+	select {
+	case imageScaleSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-imageScaleSlots }()
+	if len(sources) == 1 {
+		b, err := readFSFile(fsys, sources[0])
+		if err != nil {
+			return nil, err
+		}
+		return scaleImage(b, thumbnailProfile, "jpeg")
+	}
+	size := thumbnailProfile.width
+	tile := size / 2
+	var tiles []image.Image
+	for _, s := range sources {
+		b, err := readFSFile(fsys, s)
+		if err != nil {
+			continue
+		}
+		img, _, err := image.Decode(bytes.NewReader(b))
+		if err != nil {
+			continue
+		}
+		tiles = append(tiles, orientImage(squareImage(img, tile), jpegOrientation(b)))
+	}
+	if len(tiles) == 0 {
+		return nil, errors.New("no pictures could be decoded")
+	}
+	collage := image.NewRGBA(image.Rect(0, 0, size, size))
+	for i := 0; i < folderArtCollageTiles; i++ {
+		t := tiles[i%len(tiles)]
+		// Two go diagonally across from each other, rather than in stripes.
+		if len(tiles) == 2 && i >= 2 {
+			t = tiles[3-i]
+		}
+		r := image.Rect(i%2*tile, i/2*tile, i%2*tile+tile, i/2*tile+tile)
+		draw.Draw(collage, r, t, t.Bounds().Min, draw.Src)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, collage, &jpeg.Options{Quality: scaledImageJPEGQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Serves the art of a folder: its own if it has any, and otherwise a collage of the art of its
+// subfolders and its pictures, cached in ImageCacheDir.
+func (me *Server) serveFolderArt(w http.ResponseWriter, r *http.Request) {
+	dirPath, err := me.filePath(r.URL.Query().Get("path"))
+	if err != nil {
+		me.resourceError(w, r, resourceNotFound, err)
+		return
+	}
+	if ignored, err := me.IgnorePath(dirPath); err != nil {
+		me.resourceError(w, r, resourceInternalError, err)
+		return
+	} else if ignored {
+		me.resourceError(w, r, resourceNotFound, errors.New("no such object"))
+		return
+	}
+	fi, err := me.contentFS().Stat(dirPath)
+	if err != nil {
+		me.resourceError(w, r, fileErrorCause(err), err)
+		return
+	}
+	if !fi.IsDir() {
+		me.resourceError(w, r, resourceBadRequest, fmt.Errorf("%s isn't a folder", path.Base(dirPath)))
+		return
+	}
+	entries, err := readFSDirEntries(me.contentFS(), dirPath)
+	if err != nil {
+		me.resourceError(w, r, fileErrorCause(err), err)
+		return
+	}
+	var sources []string
+	if art, ok := findFolderArt(dirPath, entries); ok {
+		sources = []string{art}
+	} else {
+		sources = me.folderArtCollageSources(dirPath, entries)
+	}
+	if len(sources) == 0 {
+		me.resourceError(w, r, resourceNotFound, fmt.Errorf("no pictures in %s", path.Base(dirPath)))
+		return
+	}
+	// It's made again when the folder, or a picture it's made from, changes. The size is of the
+	// pictures together.
+	version := fileVersion{ModTime: fi.ModTime()}
+	for _, s := range sources {
+		if fi, err := me.contentFS().Stat(s); err == nil {
+			if fi.ModTime().After(version.ModTime) {
+				version.ModTime = fi.ModTime()
+			}
+			version.Size += fi.Size()
+		}
+	}
+	cacheDir := me.settings().ImageCacheDir
+	var cachePath string
+	if cacheDir != "" {
+		cachePath = scaledImageCachePath(cacheDir, dirPath, folderArtCacheProfile)
+		b, ok := readScaledImageCache(cachePath, version)
+		me.metrics.cacheLookup("image", ok)
+		if ok {
+			w.Header().Set("Content-Type", "image/jpeg")
+			http.ServeContent(w, r, "", version.ModTime, bytes.NewReader(b))
+			return
+		}
+	}
+	b, err := folderArt(r.Context(), me.contentFS(), sources)
+	if r.Context().Err() != nil {
+		return
+	}
+	if err != nil {
+		me.resourceError(w, r, resourceInternalError, fmt.Errorf("making art of %s: %w", path.Base(dirPath), err))
+		return
+	}
+	// Stop filling the cache once it's low on space.
+	if cachePath != "" && !me.disks.low(imageCacheDiskName) {
+		if err := writeScaledImageCache(cachePath, b, version); err != nil {
+			me.Logger.Levelf(log.Warning, "error caching folder art: %v", err)
+		}
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, "", version.ModTime, bytes.NewReader(b))
+}
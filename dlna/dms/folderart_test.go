@@ -0,0 +1,61 @@
+package dms
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFolderArt(t *testing.T) {
+	dir := t.TempDir()
+	writeJPEG := func(name string, c color.Gray) {
+		img := image.NewGray(image.Rect(0, 0, 300, 200))
+		for i := range img.Pix {
+			img.Pix[i] = c.Y
+		}
+		var buf bytes.Buffer
+		jpeg.Encode(&buf, img, nil)
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0o600)
+	}
+	writeJPEG("Album/Cover.JPG", color.Gray{0})
+	writeJPEG("photo.jpg", color.Gray{255})
+	os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0o600)
+	entries, _ := os.ReadDir(filepath.Join(dir, "Album"))
+	if art, ok := findFolderArt(filepath.Join(dir, "Album"), entries); !ok || filepath.Base(art) != "Cover.JPG" {
+		t.Fatalf("found %q", art)
+	}
+	entries, _ = os.ReadDir(dir)
+	var srv Server
+	sources := srv.folderArtCollageSources(dir, entries)
+	if len(sources) != 2 {
+		t.Fatalf("sources %q", sources)
+	}
+	b, err := folderArt(context.Background(), osFS{}, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 160 || img.Bounds().Dy() != 160 {
+		t.Fatalf("%v", img.Bounds())
+	}
+	// The album cover and photo go diagonally across from each other.
+	for _, c := range []struct {
+		x, y  int
+		light bool
+	}{{40, 40, false}, {120, 40, true}, {40, 120, true}, {120, 120, false}} {
+		if y, _, _, _ := img.At(c.x, c.y).RGBA(); (y > 0x8000) != c.light {
+			t.Errorf("tile at %d,%d", c.x, c.y)
+		}
+	}
+}
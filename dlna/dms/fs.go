@@ -0,0 +1,116 @@
+package dms
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The filesystem the shared directories are read from. It's like fs.FS, but names are paths in the
+// local filesystem, as the shared directories and the index have them, rather than unrooted
+// slash-separated ones. ffmpeg and ffprobe are given the paths, so they read the local filesystem
+// whatever this is, as do uploads and the files dms keeps its own state in.
+type FS interface {
+	Open(name string) (File, error)
+	Stat(name string) (fs.FileInfo, error)
+	// Returns the entries of the directory in no particular order, following symlinks. Entries
+	// that can't be statted, such as broken symlinks, are left out.
+	ReadDir(name string) ([]fs.FileInfo, error)
+}
+
+// An FS that files can be deleted from, with DestroyObject. Items can't be deleted from others.
+type RemoveFS interface {
+	FS
+	// Like Stat, but doesn't follow a symlink, so that the link is what's deleted.
+	Lstat(name string) (fs.FileInfo, error)
+	Remove(name string) error
+}
+
+// A file opened from an FS. Streams are served from it with ranges, and archives and photos are
+// read at offsets.
+type File interface {
+	fs.File
+	io.ReaderAt
+	io.Seeker
+}
+
+// The local filesystem. Its files are *os.File, so that streams can still be sent with sendfile.
+type osFS struct{}
+
+func (osFS) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// This exists rather than just calling os.ReadDir because I want to stat(), not lstat() each entry.
+func (osFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	dirFile, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer dirFile.Close()
+	dirContent, err := dirFile.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	fis := make([]fs.FileInfo, 0, len(dirContent))
+	for _, file := range dirContent {
+		fi, err := os.Stat(filepath.Join(name, file))
+		if err != nil {
+			continue
+		}
+		fis = append(fis, fi)
+	}
+	return fis, nil
+}
+
+// Returns the filesystem the shared directories are read from.
+func (srv *Server) contentFS() FS {
+	if srv.FS == nil {
+		return osFS{}
+	}
+	return srv.FS
+}
+
+// Reads the whole of the named file from fsys, like os.ReadFile.
+func readFSFile(fsys FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// Returns the entries of the named directory in fsys sorted by name, like os.ReadDir.
+func readFSDirEntries(fsys FS, name string) ([]fs.DirEntry, error) {
+	fis, err := fsys.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(fis, func(i, j int) bool {
+		return fis[i].Name() < fis[j].Name()
+	})
+	ret := make([]fs.DirEntry, 0, len(fis))
+	for _, fi := range fis {
+		ret = append(ret, fs.FileInfoToDirEntry(fi))
+	}
+	return ret, nil
+}
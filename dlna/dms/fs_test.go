@@ -0,0 +1,190 @@
+package dms
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// An in-memory FS, of files by their paths in the local filesystem without the leading slash, such
+// as "media/film.mp4". Directories are implied by the files in them.
+type memFS fstest.MapFS
+
+func (me memFS) name(name string) string {
+	if name = strings.TrimPrefix(filepath.ToSlash(name), "/"); name == "" {
+		return "."
+	}
+	return name
+}
+
+func (me memFS) Open(name string) (File, error) {
+	f, err := fstest.MapFS(me).Open(me.name(name))
+	if err != nil {
+		return nil, err
+	}
+	if ret, ok := f.(File); ok {
+		return ret, nil
+	}
+	// Directories are only read with ReadDir.
+	f.Close()
+	return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+}
+
+func (me memFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(fstest.MapFS(me), me.name(name))
+}
+
+func (me memFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	entries, err := fs.ReadDir(fstest.MapFS(me), me.name(name))
+	if err != nil {
+		return nil, err
+	}
+	var ret []fs.FileInfo
+	for _, e := range entries {
+		if fi, err := e.Info(); err == nil {
+			ret = append(ret, fi)
+		}
+	}
+	return ret, nil
+}
+
+func (me memFS) Lstat(name string) (fs.FileInfo, error) {
+	return me.Stat(name)
+}
+
+func (me memFS) Remove(name string) error {
+	name = me.name(name)
+	if _, ok := me[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(me, name)
+	return nil
+}
+
+func newMemFSServer() *Server {
+	return &Server{
+		RootObjectPath: "/media",
+		FS: memFS{
+			"media/film.mp4":         {Data: []byte("film")},
+			"media/song.mp3":         {Data: []byte("song")},
+			"media/notes.txt":        {Data: []byte("notes")},
+			"media/trailer":          {Data: []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom")},
+			"media/Private/.nomedia": {},
+			"media/Private/a.mkv":    {Data: []byte("private")},
+			"media/Shows/a.mkv":      {Data: []byte("show")},
+		},
+		NoProbe:       true,
+		IgnoreNomedia: true,
+		Logger:        log.Default,
+	}
+}
+
+// Browses the shared directory without touching the disk, checking what's listed and which
+// transcodes are offered.
+func TestMemFSBrowse(t *testing.T) {
+	srv := newMemFSServer()
+	fsys := srv.FS.(memFS)
+	// A DVD folder, found as the item of its main title.
+	fsys["media/Movie/VIDEO_TS/VTS_01_0.VOB"] = &fstest.MapFile{Data: []byte("menu")}
+	fsys["media/Movie/VIDEO_TS/VTS_01_1.VOB"] = &fstest.MapFile{Data: []byte("title")}
+	// Whether files can be read is found in the FS too.
+	srv.IgnoreUnreadable = true
+	cds := &contentDirectoryService{Server: srv}
+	objs, err := cds.readContainer(object{Path: "/", RootObjectPath: srv.RootObjectPath}, "host:1338", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := make(map[string]upnpav.Item)
+	var containers []string
+	for _, o := range objs {
+		switch o := o.(type) {
+		case upnpav.Item:
+			items[o.Title] = o
+		case upnpav.Container:
+			containers = append(containers, o.Title)
+		}
+	}
+	if len(containers) != 1 || containers[0] != "Shows" {
+		t.Errorf("containers %q", containers)
+	}
+	if len(items) != 4 {
+		t.Fatalf("items %v", items)
+	}
+	if movie := items["Movie"]; movie.Class != "object.item.videoItem.movie" || !strings.Contains(movie.Res[0].URL, discPath+"?") {
+		t.Errorf("DVD folder listed as %+v", movie)
+	}
+	if input, ok := folderDiscInput(fsys, "/media/Movie"); !ok || input != "concat:"+filepath.FromSlash("/media/Movie/VIDEO_TS/VTS_01_1.VOB") {
+		t.Errorf("DVD input %q", input)
+	}
+	// Its type comes from its contents.
+	if c := items["trailer"].Class; c != "object.item.videoItem" {
+		t.Errorf("trailer class %q", c)
+	}
+	if c := items["song.mp3"].Class; c != "object.item.audioItem" {
+		t.Errorf("song class %q", c)
+	}
+	film := items["film.mp4"]
+	if film.Res[0].Size != 4 {
+		t.Errorf("film size %d", film.Res[0].Size)
+	}
+	transcodes := func(item upnpav.Item) (n int) {
+		for _, r := range item.Res {
+			if strings.Contains(r.URL, "transcode=") {
+				n++
+			}
+		}
+		return
+	}
+	if transcodes(film) == 0 {
+		t.Error("film has no transcodes")
+	}
+	srv.NoTranscode = true
+	objs, err = cds.readContainer(object{Path: "/", RootObjectPath: srv.RootObjectPath}, "host:1338", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range objs {
+		if item, ok := o.(upnpav.Item); ok && transcodes(item) != 0 {
+			t.Errorf("%s has transcodes with NoTranscode", item.Title)
+		}
+	}
+}
+
+// Streams from the shared directory without touching the disk.
+func TestMemFSStream(t *testing.T) {
+	srv := newMemFSServer()
+	srv.metrics = newServerMetrics(srv)
+	mux := http.NewServeMux()
+	srv.initMux(mux)
+	get := func(path, rng string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", resPath+"?path="+path, nil)
+		if rng != "" {
+			r.Header.Set("Range", rng)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	w := get("/film.mp4", "")
+	if w.Code != http.StatusOK || w.Body.String() != "film" || w.Header().Get("Content-Type") != "video/mp4" {
+		t.Errorf("got %d %q %q", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	if w := get("/film.mp4", "bytes=1-2"); w.Code != http.StatusPartialContent || w.Body.String() != "il" {
+		t.Errorf("range got %d %q", w.Code, w.Body)
+	}
+	if w := get("/missing.mp4", ""); w.Code != http.StatusNotFound {
+		t.Errorf("missing file got %d", w.Code)
+	}
+	if w := get("/Private/a.mkv", ""); w.Code != http.StatusNotFound {
+		t.Errorf("file in .nomedia directory got %d", w.Code)
+	}
+}
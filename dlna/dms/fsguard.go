@@ -0,0 +1,139 @@
+package dms
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+const (
+	// How long a filesystem operation in a request may take before the shared directory it's in is
+	// taken to be on a hung network mount.
+	fsOpTimeout = 10 * time.Second
+	// How long a shared directory that timed out is unavailable before it's tried again.
+	fsUnavailableFor = 30 * time.Second
+)
+
+// Returned for operations in a shared directory that's unavailable. It doesn't say which, as
+// clients aren't told where the media is kept.
+var errFSUnavailable = errors.New("the shared directory is temporarily unavailable: a filesystem operation timed out")
+
+// Circuit breakers for the shared directories, which may be on network mounts such as SMB and NFS,
+// where a stat or open can hang for minutes. Once an operation in one times out, requests for it
+// fail at once until it's tried again, rather than each waiting on the mount.
+type fsGuard struct {
+	mu sync.Mutex
+	// When each shared directory that timed out can be tried again, by its path.
+	unavailableUntil map[string]time.Time
+}
+
+// Returns the shared directory that filePath is in, or filePath if it's in none.
+func (srv *Server) sharedDirOf(filePath string) string {
+	ret := ""
+	consider := func(dir string) {
+		if dir != "" && len(dir) > len(ret) && (filePath == dir || strings.HasPrefix(filePath, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))) {
+			ret = dir
+		}
+	}
+	sd := srv.sharedDirs()
+	consider(sd.rootObjectPath)
+	for i := range sd.rootDirs {
+		consider(sd.rootDirs[i].Path)
+	}
+	if ret == "" {
+		return filePath
+	}
+	return ret
+}
+
+// Runs op on filePath, returning errFSUnavailable if the shared directory it's in is unavailable
+// or op takes longer than fsOpTimeout. An op that times out is left to finish in the background,
+// as there's no interrupting a hung syscall, so it mustn't share its results until it's done.
+func (srv *Server) guardFS(filePath string, op func() error) error {
+	dir := srv.sharedDirOf(filePath)
+	me := &srv.fsGuard
+	me.mu.Lock()
+	if time.Now().Before(me.unavailableUntil[dir]) {
+		me.mu.Unlock()
+		return errFSUnavailable
+	}
+	me.mu.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		done <- op()
+	}()
+	timer := time.NewTimer(fsOpTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+	me.mu.Lock()
+	if me.unavailableUntil == nil {
+		me.unavailableUntil = make(map[string]time.Time)
+	}
+	me.unavailableUntil[dir] = time.Now().Add(fsUnavailableFor)
+	me.mu.Unlock()
+	srv.Logger.Levelf(log.Warning, "accessing %q took longer than %v: treating %q as unavailable for %v", filePath, fsOpTimeout, dir, fsUnavailableFor)
+	return errFSUnavailable
+}
+
+// Returns warnings for the shared directories that are unavailable.
+func (srv *Server) fsWarnings() (ret []string) {
+	me := &srv.fsGuard
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	now := time.Now()
+	for dir, until := range me.unavailableUntil {
+		if now.Before(until) {
+			ret = append(ret, fmt.Sprintf("%q is unavailable until %s: a filesystem operation in it timed out", dir, until.Format("15:04:05")))
+		}
+	}
+	sort.Strings(ret)
+	return
+}
+
+// Stats the file, unless it's in a shared directory that's unavailable.
+func (srv *Server) statFS(filePath string) (os.FileInfo, error) {
+	type result struct {
+		fi  os.FileInfo
+		err error
+	}
+	// The op owns its result until it's received, as it may outlive the call.
+	results := make(chan result, 1)
+	if err := srv.guardFS(filePath, func() error {
+		fi, err := srv.contentFS().Stat(filePath)
+		results <- result{fi, err}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	r := <-results
+	return r.fi, r.err
+}
+
+// Reads the directory at o, unless it's in a shared directory that's unavailable.
+func (srv *Server) readDirFS(o object) ([]os.FileInfo, error) {
+	type result struct {
+		fis []os.FileInfo
+		err error
+	}
+	results := make(chan result, 1)
+	if err := srv.guardFS(o.FilePath(), func() error {
+		fis, err := srv.contentFS().ReadDir(o.FilePath())
+		results <- result{fis, err}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	r := <-results
+	return r.fis, r.err
+}
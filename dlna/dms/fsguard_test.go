@@ -0,0 +1,46 @@
+package dms
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSharedDirOf(t *testing.T) {
+	srv := &Server{RootDirs: []RootDir{{Path: "/mnt/nas"}, {Path: "/mnt/nas/music"}, {Path: "/srv/video"}}}
+	for _, c := range []struct{ filePath, want string }{
+		{"/mnt/nas/music/a.flac", "/mnt/nas/music"},
+		{"/mnt/nas/b.mkv", "/mnt/nas"},
+		{"/mnt/nas", "/mnt/nas"},
+		{"/srv/videos/c.mkv", "/srv/videos/c.mkv"},
+	} {
+		if got := srv.sharedDirOf(c.filePath); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.filePath, got, c.want)
+		}
+	}
+}
+
+func TestFSUnavailable(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "a.mp3")
+	if err := os.WriteFile(filePath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{RootObjectPath: dir}
+	if _, err := srv.statFS(filePath); err != nil {
+		t.Fatal(err)
+	}
+	srv.fsGuard.unavailableUntil = map[string]time.Time{dir: time.Now().Add(time.Minute)}
+	if _, err := srv.statFS(filePath); !errors.Is(err, errFSUnavailable) {
+		t.Errorf("got %v", err)
+	}
+	if fileErrorCause(errFSUnavailable).statusCode() != 503 {
+		t.Error("unavailable isn't 503")
+	}
+	srv.fsGuard.unavailableUntil[dir] = time.Now()
+	if _, err := srv.statFS(filePath); err != nil {
+		t.Errorf("not tried again: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package dms
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// Events that hooks can be run on.
+const (
+	// A media stream started being served.
+	HookStreamStart = "stream_start"
+	// A media stream ended, whether it was played through or not.
+	HookStreamStop = "stream_stop"
+	// The index finished scanning directories, after starting or changes to them.
+	HookScanComplete = "scan_complete"
+	// A client started a session, such as a renderer being turned on.
+	HookDeviceDiscovered = "device_discovered"
+)
+
+var HookEvents = []string{HookStreamStart, HookStreamStop, HookScanComplete, HookDeviceDiscovered}
+
+// How long a hook may run before it's killed.
+const hookTimeout = time.Minute
+
+func isHookEvent(event string) bool {
+	for _, e := range HookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *Server) initHooks() error {
+	for event := range srv.Hooks {
+		if !isHookEvent(event) {
+			return fmt.Errorf("unknown hook event %q, have %q", event, HookEvents)
+		}
+	}
+	return nil
+}
+
+// Returns the command that runs a hook in the system's shell.
+func hookCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// Runs the hooks for the event in the background. The event and its data are given in environment
+// variables prefixed with DMS_, such as DMS_EVENT and DMS_PATH.
+func (srv *Server) runHooks(event string, data map[string]string) {
+	commands := srv.settings().Hooks[event]
+	if len(commands) == 0 {
+		return
+	}
+	env := append(os.Environ(), "DMS_EVENT="+event)
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, "DMS_"+k+"="+data[k])
+	}
+	logger := srv.Logger.WithNames("hooks")
+	for _, command := range commands {
+		go func(command string) {
+			ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+			defer cancel()
+			cmd := hookCommand(ctx, command)
+			cmd.Env = env
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				logger.Levelf(log.Warning, "%s hook %q failed: %v: %s", event, command, err, out)
+				return
+			}
+			logger.Levelf(log.Debug, "ran %s hook %q: %s", event, command, out)
+		}(command)
+	}
+}
@@ -0,0 +1,47 @@
+package dms
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+func TestRunHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook uses sh syntax")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	srv := &Server{
+		Logger: log.Default,
+		Hooks: map[string][]string{
+			HookStreamStart: {`echo "$DMS_EVENT $DMS_PATH" > ` + out},
+		},
+	}
+	if err := srv.initHooks(); err != nil {
+		t.Fatal(err)
+	}
+	srv.runHooks(HookStreamStop, map[string]string{"PATH": "/wrong"})
+	srv.runHooks(HookStreamStart, map[string]string{"PATH": "/a.mp4"})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, err := os.ReadFile(out)
+		if err == nil && len(b) != 0 {
+			if got := string(b); got != "stream_start /a.mp4\n" {
+				t.Fatalf("hook got %q", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("hook didn't run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	srv.Hooks["bogus"] = []string{"true"}
+	if err := srv.initHooks(); err == nil {
+		t.Error("unknown event accepted")
+	}
+}
@@ -4,7 +4,18 @@ import (
 	"html/template"
 )
 
-var rootTmpl *template.Template
+var (
+	rootTmpl     *template.Template
+	logTmpl      *template.Template
+	statusTmpl   *template.Template
+	browseTmpl   *template.Template
+	errorTmpl    *template.Template
+	tokensTmpl   *template.Template
+	clientsTmpl  *template.Template
+	trashTmpl    *template.Template
+	settingsTmpl *template.Template
+	parentalTmpl *template.Template
+)
 
 func init() {
 	rootTmpl = template.Must(template.New("root").Parse(
@@ -15,5 +26,264 @@ func init() {
 				value="{{.Path}}"
 			/>
 			<input type="submit" value="Update"{{if .Readonly}} disabled="disabled"{{end}}/>
+		</form>
+		<p><a href="/status">Status</a> <a href="/browse">Browse</a> <a href="/log">Log</a> <a href="/clients">Clients</a> <a href="/parental">Parental</a> <a href="/tokens">API tokens</a> <a href="/trash">Trash</a> <a href="/settings">Settings</a></p>`))
+	logTmpl = template.Must(template.New("log").Parse(
+		`<form method="get">
+			IP: <input type="text" name="ip" value="{{.IP}}"/>
+			Session: <input type="text" name="session" value="{{.Session}}"/>
+			Subsystem: <input type="text" name="subsystem" value="{{.Subsystem}}"/>
+			Level: <input type="text" name="level" value="{{.Level}}" placeholder="debug"/>
+			<input type="submit" value="Filter"/>
+			<a href="?">Clear</a>
+		</form>
+		<table>
+			<tr><th>Time</th><th>Level</th><th>Subsystem</th><th>Client</th><th>Session</th><th>Message</th></tr>
+			{{range .Entries}}
+			<tr>
+				<td>{{.Time.Format "2006-01-02 15:04:05.000"}}</td>
+				<td>{{.Level.LogString}}</td>
+				<td><a href="?subsystem={{.Subsystem}}">{{.Subsystem}}</a></td>
+				<td>{{if .IP}}<a href="?ip={{.IP}}">{{.IP}}</a>{{end}}</td>
+				<td>{{if .Session}}<a href="?session={{.Session}}">{{.Session}}</a>{{end}}</td>
+				<td><pre>{{.Text}}</pre></td>
+			</tr>
+			{{end}}
+		</table>`))
+	statusTmpl = template.Must(template.New("status").Parse(
+		`<h1>{{.FriendlyName}}</h1>
+		<p>
+			UUID: {{.UUID}}<br/>
+			Version: {{.Version}}<br/>
+			HTTP: {{.HTTPAddr}}<br/>
+			Up since {{.Started.Format "2006-01-02 15:04:05"}}
+		</p>
+		<p><a href="/browse">Browse</a> <a href="/log">Log</a> <a href="/metrics">Metrics</a></p>
+		{{if .NewRelease}}<p><strong>New release available:</strong> <a href="{{.ReleasesURL}}">{{.NewRelease}}</a></p>{{end}}
+		{{range .Warnings}}<p><strong>Warning:</strong> {{.}}</p>{{end}}
+		<h2>Interfaces</h2>
+		<table>
+			<tr><th>Name</th><th>Addresses</th><th>SSDP</th></tr>
+			{{range .Interfaces}}
+			<tr>
+				<td>{{.Name}}</td>
+				<td>{{range .Addrs}}{{.}}<br/>{{end}}</td>
+				<td>{{if .SSDP}}advertising{{else}}not advertising{{end}}</td>
+			</tr>
+			{{end}}
+		</table>
+		<h2>Clients</h2>
+		<table>
+			<tr><th>IP</th><th>User-Agent</th><th>Session</th><th>Started</th><th>Last seen</th></tr>
+			{{range .Clients}}
+			<tr>
+				<td><a href="/log?ip={{.IP}}">{{.IP}}</a></td>
+				<td><a href="/clients?ip={{.IP}}&amp;ua={{.UserAgent}}">{{.UserAgent}}</a></td>
+				<td><a href="/log?session={{.ID}}">{{.ID}}</a></td>
+				<td>{{.Started.Format "15:04:05"}}</td>
+				<td>{{.LastSeen.Format "15:04:05"}}</td>
+			</tr>
+			{{end}}
+		</table>
+		<h2>Devices</h2>
+		<table>
+			<tr><th>IP</th><th>Name</th><th>User-Agent</th><th>Seen by</th><th>First seen</th><th>Last seen</th><th>Online</th></tr>
+			{{range .Devices}}
+			<tr>
+				<td><a href="/log?ip={{.Address}}">{{.Address}}</a></td>
+				<td>{{.Name}}</td>
+				<td>{{.UserAgent}}</td>
+				<td>{{range $i, $s := .Seen}}{{if $i}}, {{end}}{{$s}}{{end}}</td>
+				<td>{{.FirstSeen.Format "2006-01-02 15:04"}}</td>
+				<td>{{.LastSeen.Format "2006-01-02 15:04"}}</td>
+				<td>{{if .Online}}yes{{else}}no{{end}}</td>
+			</tr>
+			{{end}}
+		</table>
+		<h2>Streams</h2>
+		<table>
+			<tr><th>Client</th><th>Session</th><th>Path</th><th>Transcode</th><th>Started</th><th>Bytes</th></tr>
+			{{range .Streams}}
+			<tr>
+				<td>{{.IP}}</td>
+				<td><a href="/log?session={{.Session}}">{{.Session}}</a></td>
+				<td>{{.Path}}</td>
+				<td>{{.Transcode}}</td>
+				<td>{{.Started.Format "15:04:05"}}</td>
+				<td>{{.Bytes}}</td>
+			</tr>
+			{{end}}
+		</table>
+		<h2>Disks</h2>
+		<table>
+			<tr><th>Use</th><th>Path</th><th>Free</th><th>Free inodes</th></tr>
+			{{range .Disks}}
+			<tr>
+				<td>{{.Name}}</td>
+				<td>{{.Path}}</td>
+				<td>{{if .Err}}{{.Err}}{{else}}{{.FreeSpace}}{{if .Low}} (low){{end}}{{end}}</td>
+				<td>{{if .Files}}{{.FreeFiles}} of {{.Files}}{{end}}</td>
+			</tr>
+			{{end}}
+		</table>
+		{{if .Problems}}
+		<h2>Problems</h2>
+		<table>
+			<tr><th>Path</th><th>Problem</th></tr>
+			{{range .Problems}}
+			<tr><td>{{.Path}}</td><td>{{.Problem}}</td></tr>
+			{{end}}
+		</table>
+		{{end}}`))
+	browseTmpl = template.Must(template.New("browse").Parse(
+		`<h1>{{.Path}}</h1>
+		{{if .ParentID}}<p><a href="?id={{.ParentID}}">Up</a></p>{{end}}
+		{{if .Error}}<p><strong>Error:</strong> {{.Error}}</p>{{end}}
+		{{if .Playing}}<p>Playing {{.Playing}}.</p>{{end}}
+		<ul>
+			{{range .Containers}}
+			<li><a href="?id={{.ID}}">{{.Title}}</a> ({{.ChildCount}})</li>
+			{{end}}
+		</ul>
+		<table>
+			<tr><th>Title</th><th>Class</th><th>Resources</th>{{if .Renderers}}<th>Play to</th>{{end}}</tr>
+			{{range .Items}}
+			<tr>
+				<td>{{.Title}}</td>
+				<td>{{.Class}}</td>
+				<td>{{range .Res}}<a href="{{.URL}}">{{.ProtocolInfo}}</a><br/>{{end}}</td>
+				{{if $.Renderers}}<td><form method="post">
+					<input type="hidden" name="item" value="{{.ID}}"/>
+					<select name="renderer">{{range $.Renderers}}<option value="{{.Address}}">{{.Name}}</option>{{end}}</select>
+					<input type="submit" value="Play"/>
+				</form></td>{{end}}
+			</tr>
+			{{end}}
+		</table>`))
+	errorTmpl = template.Must(template.New("error").Parse(
+		`<h1>{{.Code}} {{.Status}}</h1>
+		<p>{{.Message}}</p>
+		{{if .Session}}<p>Session: <a href="/log?session={{.Session}}">{{.Session}}</a></p>{{end}}`))
+	tokensTmpl = template.Must(template.New("tokens").Parse(
+		`<h1>API tokens</h1>
+		{{if .Error}}<p><strong>Error:</strong> {{.Error}}</p>{{end}}
+		{{if .NewToken}}<p>Token for {{.NewName}}, which won't be shown again: <code>{{.NewToken}}</code></p>{{end}}
+		{{if not .Tokens}}<p>The API is open to allowed clients until a token is added. Add an admin token first.</p>{{end}}
+		<table>
+			<tr><th>Name</th><th>Scopes</th><th>Created</th><th>Created by</th><th></th></tr>
+			{{range .Tokens}}
+			<tr>
+				<td>{{.Name}}</td>
+				<td>{{range .Scopes}}{{.}} {{end}}</td>
+				<td>{{.Created.Format "2006-01-02 15:04"}}</td>
+				<td>{{.CreatedBy}}</td>
+				<td><form method="post">
+					<input type="hidden" name="name" value="{{.Name}}"/>
+					<input type="submit" name="revoke" value="Revoke"/>
+				</form></td>
+			</tr>
+			{{end}}
+		</table>
+		<form method="post">
+			Name: <input type="text" name="name"/>
+			{{range .Scopes}}<label><input type="checkbox" name="scope" value="{{.}}"/> {{.}}</label> {{end}}
+			<input type="submit" name="add" value="Add"/>
 		</form>`))
+	clientsTmpl = template.Must(template.New("clients").Parse(
+		`<h1>Clients</h1>
+		{{if .Error}}<p><strong>Error:</strong> {{.Error}}</p>{{end}}
+		{{with .Client}}
+		<h2>{{.IP}} {{.UserAgent}}</h2>
+		{{if $.Saved}}<p>Saved. They apply from the client's next request.</p>{{end}}
+		<form method="post">
+			<p>Transcode listed first: <select name="transcode">
+				<option value="">None</option>
+				{{range $.Transcodes}}<option value="{{.}}"{{if eq . $.Client.Transcode}} selected{{end}}>{{.}}</option>{{end}}
+			</select></p>
+			<p>Subtitle language: <input type="text" name="subtitleLanguage" value="{{.SubtitleLanguage}}" placeholder="en"/></p>
+			<p>Titles: <select name="titleFormat">
+				<option value="">From metadata</option>
+				<option value="filename"{{if eq .TitleFormat "filename"}} selected{{end}}>File names</option>
+			</select></p>
+			<p>Hidden containers:
+				{{range $.Containers}}<label><input type="checkbox" name="hide" value="{{.Path}}"{{if .Hidden}} checked{{end}}/> {{.Title}}</label> {{end}}
+			</p>
+			<input type="submit" name="save" value="Save"/>
+			<input type="submit" name="forget" value="Forget"/>
+		</form>
+		{{end}}
+		<table>
+			<tr><th>IP</th><th>User-Agent</th><th>Preferences</th></tr>
+			{{range .Clients}}
+			<tr>
+				<td>{{.IP}}</td>
+				<td><a href="?ip={{.IP}}&amp;ua={{.UserAgent}}">{{.UserAgent}}</a></td>
+				<td>{{if .HasPrefs}}set {{.Updated.Format "2006-01-02 15:04"}}{{else}}none{{end}}</td>
+			</tr>
+			{{end}}
+		</table>`))
+	trashTmpl = template.Must(template.New("trash").Parse(
+		`<h1>Trash</h1>
+		{{if .Error}}<p><strong>Error:</strong> {{.Error}}</p>{{end}}
+		{{if .Forgot}}<p>Forgot {{.Forgot}} files.</p>{{end}}
+		{{if not .Indexed}}<p>Files that have gone are only kept when the shared directories are indexed.</p>{{end}}
+		<p>Files gone from the shared directories. What's known about them, such as their metadata and thumbnails, is kept in case they come back until they're forgotten.</p>
+		<table>
+			<tr><th>Path</th><th>Size</th><th>Gone since</th><th>Forgotten</th><th></th></tr>
+			{{range .Files}}
+			<tr>
+				<td>{{.Path}}</td>
+				<td>{{.Size}}</td>
+				<td>{{.Since.Format "2006-01-02 15:04"}}</td>
+				<td>{{.Expires.Format "2006-01-02 15:04"}}</td>
+				<td><form method="post">
+					<input type="hidden" name="path" value="{{.Path}}"/>
+					<input type="submit" value="Forget"/>
+				</form></td>
+			</tr>
+			{{end}}
+		</table>
+		{{if .Files}}<form method="post"><input type="submit" value="Empty trash"/></form>{{end}}`))
+	settingsTmpl = template.Must(template.New("settings").Parse(
+		`<h1>Settings</h1>
+		{{if .Error}}<p><strong>Error:</strong> {{.Error}}</p>{{end}}
+		{{if .Saved}}<p>Saved and applied.</p>{{end}}
+		{{if .Editable}}
+		<form method="post">
+			<p>Name shown on TVs and players: <input type="text" name="friendlyName" value="{{.Settings.FriendlyName}}" placeholder="Default"/></p>
+			<p>Media directories to share, one per line, optionally named with Name=directory:<br/>
+				<textarea name="paths" rows="4" cols="60">{{range .Settings.Paths}}{{.}}
+{{end}}</textarea></p>
+			<p>Audio profiles, one per line, as User-Agent substring=formats, such as Sonos=mp3,original:<br/>
+				<textarea name="audioProfiles" rows="4" cols="60">{{range .Settings.AudioProfiles}}{{.}}
+{{end}}</textarea></p>
+			<input type="submit" value="Save"/>
+		</form>
+		<p>Settings are saved to the config file, and applied like reloading it. Other settings can be changed there.</p>
+		{{else}}
+		<p>Settings can only be changed here when dms is started with a config file, with -config.</p>
+		{{end}}`))
+	parentalTmpl = template.Must(template.New("parental").Parse(
+		`<h1>Parental</h1>
+		{{if .Error}}<p><strong>Error:</strong> {{.Error}}</p>{{end}}
+		<p>Protected containers are empty for clients until they're unlocked with the PIN.</p>
+		<form method="post">
+			Client: <input type="text" name="ip" list="clients" placeholder="192.168.1.30"/>
+			<datalist id="clients">{{range .Clients}}<option value="{{.IP}}">{{.UserAgent}}</option>{{end}}</datalist>
+			PIN: <input type="password" name="pin" autocomplete="off"/>
+			<input type="submit" name="unlock" value="Unlock"/>
+		</form>
+		<table>
+			<tr><th>Unlocked client</th><th>Until</th><th></th></tr>
+			{{range .Unlocked}}
+			<tr>
+				<td>{{.IP}}</td>
+				<td>{{.Until.Format "15:04"}}</td>
+				<td><form method="post">
+					<input type="hidden" name="ip" value="{{.IP}}"/>
+					<input type="submit" name="lock" value="Lock"/>
+				</form></td>
+			</tr>
+			{{end}}
+		</table>`))
 }
@@ -0,0 +1,72 @@
+package dms
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+func (me *Server) httpsPort() int {
+	return me.HTTPSConn.Addr().(*net.TCPAddr).Port
+}
+
+// Returns the HTTPS URL of the device description at ip, for SECURELOCATION.UPNP.ORG.
+func (me *Server) secureLocation(ip net.IP) string {
+	url := url.URL{
+		Scheme: "https",
+		Host: (&net.TCPAddr{
+			IP:   ip,
+			Port: me.httpsPort(),
+		}).String(),
+		Path: rootDescPath,
+	}
+	return url.String()
+}
+
+// Links media in a SOAP response to a request over HTTPS over HTTPS too, as it's written to w. The
+// URLs in responses are made for the host the request was made to, and http. It must be closed
+// once the response is written.
+func secureSOAPResponse(w io.Writer, r *http.Request) *replacingWriter {
+	if r.TLS == nil {
+		return &replacingWriter{w: w}
+	}
+	return &replacingWriter{w: w, old: []byte("http://" + r.Host + "/"), new: []byte("https://" + r.Host + "/")}
+}
+
+// Reports whether the request is for the web UI or the REST API rather than for DLNA.
+func (me *Server) isWebUIRequest(r *http.Request) bool {
+	_, webUIPattern := me.webUIServeMux.Handler(r)
+	_, pattern := me.httpServeMux.Handler(r)
+	return webUIPattern == pattern
+}
+
+// Sends requests for the web UI and API on HTTPConn to HTTPSConn, so that API tokens, passwords
+// and what's shared aren't sent in the clear. Pages are redirected, and the rest are refused, as
+// a redirect would have the client send them in the clear again first. Loopback clients are left
+// be. Reports whether the request is to be served.
+func (me *Server) requireHTTPS(w http.ResponseWriter, r *http.Request) bool {
+	if me.HTTPSConn == nil || r.TLS != nil || !me.isWebUIRequest(r) {
+		return true
+	}
+	if ip := net.ParseIP(requestClientIP(r)); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     net.JoinHostPort(host, strconv.Itoa(me.httpsPort())),
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		http.Redirect(w, r, u.String(), http.StatusFound)
+		return false
+	}
+	http.Error(w, "use HTTPS at "+u.String(), http.StatusForbidden)
+	return false
+}
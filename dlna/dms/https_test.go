@@ -0,0 +1,88 @@
+package dms
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRequireHTTPS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv := &Server{
+		HTTPSConn:     ln,
+		httpServeMux:  http.NewServeMux(),
+		webUIServeMux: http.NewServeMux(),
+	}
+	for _, mux := range []*http.ServeMux{srv.httpServeMux, srv.webUIServeMux} {
+		mux.HandleFunc("/", http.NotFound)
+		mux.HandleFunc(apiStatusPath, http.NotFound)
+	}
+	srv.httpServeMux.HandleFunc(serviceControlURL, http.NotFound)
+	port := srv.httpsPort()
+	for _, c := range []struct {
+		method, target, remoteAddr string
+		tls                        bool
+		code                       int
+		location                   string
+	}{
+		{"GET", "/status?x=1", "192.168.1.20:4000", false, http.StatusFound, "https://192.168.1.10:" + strconv.Itoa(port) + "/status?x=1"},
+		{"POST", apiStatusPath, "192.168.1.20:4000", false, http.StatusForbidden, ""},
+		// DLNA is left to renderers that don't do TLS.
+		{"POST", serviceControlURL, "192.168.1.20:4000", false, 0, ""},
+		{"GET", "/status", "192.168.1.20:4000", true, 0, ""},
+		{"GET", "/status", "127.0.0.1:4000", false, 0, ""},
+	} {
+		r := httptest.NewRequest(c.method, "http://192.168.1.10:1338"+c.target, nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		if ok := srv.requireHTTPS(w, r); ok != (c.code == 0) {
+			t.Errorf("%s %s from %s: got %v", c.method, c.target, c.remoteAddr, ok)
+			continue
+		}
+		if c.code != 0 && w.Code != c.code {
+			t.Errorf("%s %s: got code %d", c.method, c.target, w.Code)
+		}
+		if got := w.Header().Get("Location"); got != c.location {
+			t.Errorf("%s %s: got location %q", c.method, c.target, got)
+		}
+	}
+}
+
+func TestSecureSOAPResponse(t *testing.T) {
+	const body = `<res>http://192.168.1.10:1339/res?path=a</res><x>http://192.168.1.10:13390/</x>`
+	r := httptest.NewRequest("POST", "http://192.168.1.10:1339/ctl", nil)
+	// Written a few bytes at a time, so that URLs are split between writes.
+	secure := func() string {
+		var b strings.Builder
+		w := secureSOAPResponse(&b, r)
+		for s := body; len(s) > 0; {
+			n := 7
+			if n > len(s) {
+				n = len(s)
+			}
+			w.Write([]byte(s[:n]))
+			s = s[n:]
+		}
+		w.Close()
+		return b.String()
+	}
+	if got := secure(); got != body {
+		t.Errorf("got %s", got)
+	}
+	r.TLS = &tls.ConnectionState{}
+	want := `<res>https://192.168.1.10:1339/res?path=a</res><x>http://192.168.1.10:13390/</x>`
+	if got := secure(); got != want {
+		t.Errorf("got %s", got)
+	}
+}
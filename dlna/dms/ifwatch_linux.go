@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package dms
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns the bit of a netlink multicast group for binding to it.
+func netlinkGroup(group uint32) uint32 {
+	return 1 << (group - 1)
+}
+
+// Returns a channel that's sent to when an interface goes up or down or its addresses change, from
+// the kernel's netlink route notifications, and a func to stop watching. The channel is nil if they
+// can't be subscribed to, leaving changes to be polled for.
+func watchInterfaces() (<-chan struct{}, func()) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, func() {}
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: netlinkGroup(syscall.RTNLGRP_LINK) | netlinkGroup(syscall.RTNLGRP_IPV4_IFADDR) | netlinkGroup(syscall.RTNLGRP_IPV6_IFADDR),
+	}); err != nil {
+		syscall.Close(fd)
+		return nil, func() {}
+	}
+	// Non-blocking, so that reads go through the runtime's poller, and closing the file ends them.
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, func() {}
+	}
+	f := os.NewFile(uintptr(fd), "netlink")
+	changed := make(chan struct{}, 1)
+	go func() {
+		b := make([]byte, 1<<16)
+		for {
+			// What changed isn't parsed: the interfaces are all looked at again.
+			if _, err := f.Read(b); err != nil {
+				return
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changed, func() { f.Close() }
+}
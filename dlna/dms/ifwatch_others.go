@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package dms
+
+// Interface changes are only polled for on other systems.
+func watchInterfaces() (<-chan struct{}, func()) {
+	return nil, func() {}
+}
@@ -0,0 +1,313 @@
+package dms
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/anacrolix/log"
+	"github.com/nfnt/resize"
+
+	"github.com/anacrolix/dms/dlna"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+const (
+	imagePath              = "/image"
+	imageCacheDiskName     = "image cache"
+	scaledImageJPEGQuality = 85
+	// The most images scaled at once. Decoding a large photo takes a lot of memory.
+	maxImageScales = 2
+)
+
+// A DLNA JPEG profile that images are scaled to fit.
+type imageProfile struct {
+	name          string
+	width, height int
+}
+
+// From the largest, so that the first an image doesn't fit gives the rest too.
+var imageProfiles = []imageProfile{
+	{"JPEG_LRG", 4096, 4096},
+	{"JPEG_MED", 1024, 768},
+	{"JPEG_SM", 640, 480},
+}
+
+// What photo thumbnails are scaled to fit.
+var thumbnailProfile = imageProfile{"JPEG_TN", 160, 160}
+
+func findImageProfile(name string) (imageProfile, bool) {
+	for _, p := range imageProfiles {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return imageProfile{}, false
+}
+
+var imageScaleSlots = make(chan struct{}, maxImageScales)
+
+// Whether images of the MIME type can be decoded to be scaled.
+func scalableImage(mt mimeType) bool {
+	switch mt {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// Returns the size an image is scaled to, to fit within maxWidth and maxHeight. It's the same as
+// resize.Thumbnail's.
+func fitImage(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= maxWidth && height <= maxHeight {
+		return width, height
+	}
+	if width > maxWidth {
+		height = height * maxWidth / width
+		if height < 1 {
+			height = 1
+		}
+		width = maxWidth
+	}
+	if height > maxHeight {
+		width = width * maxHeight / height
+		if width < 1 {
+			width = 1
+		}
+		height = maxHeight
+	}
+	return width, height
+}
+
+// Returns resources for the image scaled to the JPEG profiles it doesn't fit as it is, turned
+// upright. All are offered if its resolution isn't known.
+func scaledImageResources(host, objectPath string, md Metadata) (ret []upnpav.Resource) {
+	var width, height int
+	known := false
+	if n, _ := fmt.Sscanf(md.Resolution, "%dx%d", &width, &height); n == 2 && width > 0 && height > 0 {
+		known = true
+	}
+	if md.Orientation >= 5 {
+		width, height = height, width
+	}
+	for _, p := range imageProfiles {
+		if known && width <= p.width && height <= p.height {
+			continue
+		}
+		var resolution string
+		if known {
+			w, h := fitImage(width, height, p.width, p.height)
+			resolution = fmt.Sprintf("%dx%d", w, h)
+		}
+		ret = append(ret, upnpav.Resource{
+			URL: (&url.URL{
+				Scheme: "http",
+				Host:   host,
+				Path:   imagePath,
+				RawQuery: url.Values{
+					"path":    {objectPath},
+					"profile": {p.name},
+				}.Encode(),
+			}).String(),
+			ProtocolInfo: fmt.Sprintf("http-get:*:image/jpeg:%s", dlna.ContentFeatures{
+				ProfileName:  p.name,
+				SupportRange: true,
+				Transcoded:   true,
+			}.String()),
+			Resolution: resolution,
+		})
+	}
+	return
+}
+
+// Returns img turned the right way up, for an EXIF orientation.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// Decodes an image, and returns it turned the right way up and scaled down to fit the profile, as
+// a PNG if the format is "png", and otherwise a JPEG.
+func scaleImage(b []byte, p imageProfile, format string) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	orientation := jpegOrientation(b)
+	width, height := p.width, p.height
+	// Turning it a quarter swaps the sides, so it's scaled to fit them swapped.
+	if orientation >= 5 {
+		width, height = height, width
+	}
+	bounds := img.Bounds()
+	if w, h := fitImage(bounds.Dx(), bounds.Dy(), width, height); w != bounds.Dx() || h != bounds.Dy() {
+		img = resize.Resize(uint(w), uint(h), img, resize.Lanczos3)
+	}
+	img = orientImage(img, orientation)
+	var buf bytes.Buffer
+	if format == "png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: scaledImageJPEGQuality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Reads and scales the image at filePath, waiting for a turn to limit the images scaled at once.
+func scaleImageFile(ctx context.Context, fsys FS, filePath string, p imageProfile, format string) ([]byte, error) {
+	select {
+	case imageScaleSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-imageScaleSlots }()
+	b, err := readFSFile(fsys, filePath)
+	if err != nil {
+		return nil, err
+	}
+	return scaleImage(b, p, format)
+}
+
+// Returns the file a scaled version of the image at filePath is cached in.
+func scaledImageCachePath(cacheDir, filePath, profile string) string {
+	h := sha256.Sum256([]byte(filePath + "\x00" + profile))
+	return filepath.Join(cacheDir, hex.EncodeToString(h[:])+".jpg")
+}
+
+// Returns the cached scaled image, if it's from this version of the image.
+func readScaledImageCache(cachePath string, version fileVersion) ([]byte, bool) {
+	b, err := os.ReadFile(cachePath)
+	if err != nil {
+		return nil, false
+	}
+	return version.trim(b)
+}
+
+// Caches a scaled image, after the version of the image it's from.
+func writeScaledImageCache(cachePath string, b []byte, version fileVersion) error {
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(cachePath), ".scaling-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(version.prefix(b))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), cachePath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Serves an image scaled to fit a DLNA JPEG profile, from ImageCacheDir if it's been scaled before.
+func (me *Server) serveScaledImage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p, ok := findImageProfile(q.Get("profile"))
+	if !ok {
+		me.resourceError(w, r, resourceBadRequest, fmt.Errorf("bad image profile %q", q.Get("profile")))
+		return
+	}
+	filePath, err := me.filePath(q.Get("path"))
+	if err != nil {
+		me.resourceError(w, r, resourceNotFound, err)
+		return
+	}
+	if ignored, err := me.IgnorePath(filePath); err != nil {
+		me.resourceError(w, r, resourceInternalError, err)
+		return
+	} else if ignored {
+		me.resourceError(w, r, resourceNotFound, errors.New("no such object"))
+		return
+	}
+	if mt, err := mimeTypeInFS(me.contentFS(), filePath); err != nil || !scalableImage(mt) {
+		me.resourceError(w, r, resourceBadRequest, fmt.Errorf("%s can't be scaled", path.Base(filePath)))
+		return
+	}
+	fi, err := me.contentFS().Stat(filePath)
+	if err != nil {
+		me.resourceError(w, r, fileErrorCause(err), err)
+		return
+	}
+	cacheDir := me.settings().ImageCacheDir
+	var cachePath string
+	if cacheDir != "" {
+		cachePath = scaledImageCachePath(cacheDir, filePath, p.name)
+	}
+	if cachePath != "" {
+		b, ok := readScaledImageCache(cachePath, fileVersionOf(fi))
+		me.metrics.cacheLookup("image", ok)
+		if ok {
+			w.Header().Set("Content-Type", "image/jpeg")
+			http.ServeContent(w, r, "", fi.ModTime(), bytes.NewReader(b))
+			return
+		}
+	}
+	b, err := scaleImageFile(r.Context(), me.contentFS(), filePath, p, "jpeg")
+	if r.Context().Err() != nil {
+		return
+	}
+	if err != nil {
+		me.resourceError(w, r, resourceInternalError, fmt.Errorf("scaling %s: %w", path.Base(filePath), err))
+		return
+	}
+	// Stop filling the cache once it's low on space.
+	if cachePath != "" && !me.disks.low(imageCacheDiskName) {
+		if err := writeScaledImageCache(cachePath, b, fileVersionOf(fi)); err != nil {
+			me.Logger.Levelf(log.Warning, "error caching scaled image: %v", err)
+		}
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, "", fi.ModTime(), bytes.NewReader(b))
+}
@@ -0,0 +1,88 @@
+package dms
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a JPEG of the size with an EXIF orientation.
+func orientedJPEG(t *testing.T, width, height, orientation int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	exif[6+8+2+8+1] = byte(orientation)
+	app1 := append([]byte{0xff, 0xe1, 0, byte(len(exif) + 2)}, exif...)
+	return append(append([]byte{0xff, 0xd8}, app1...), buf.Bytes()[2:]...)
+}
+
+func TestScaleImage(t *testing.T) {
+	b := orientedJPEG(t, 200, 100, 6)
+	if o := jpegOrientation(b); o != 6 {
+		t.Fatalf("orientation %d", o)
+	}
+	scaled, err := scaleImage(b, imageProfile{"T", 80, 40}, "jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(scaled))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Turned upright it's 100x200, which fits 80x40 at 20x40.
+	if cfg.Width != 20 || cfg.Height != 40 {
+		t.Errorf("scaled to %dx%d", cfg.Width, cfg.Height)
+	}
+	if o := jpegOrientation(orientedJPEG(t, 10, 10, 1)[:20]); o != 1 {
+		t.Errorf("truncated EXIF gave orientation %d", o)
+	}
+}
+
+func TestScaledImageResources(t *testing.T) {
+	var got []string
+	for _, r := range scaledImageResources("host", "/a.jpg", Metadata{Resolution: "2000x1500"}) {
+		got = append(got, r.ProtocolInfo[:strings.Index(r.ProtocolInfo, ";")])
+	}
+	if want := "http-get:*:image/jpeg:DLNA.ORG_PN=JPEG_MED http-get:*:image/jpeg:DLNA.ORG_PN=JPEG_SM"; strings.Join(got, " ") != want {
+		t.Errorf("got %q", got)
+	}
+	if n := len(scaledImageResources("host", "/a.jpg", Metadata{})); n != 3 {
+		t.Errorf("%d resources for unknown resolution", n)
+	}
+}
+
+func TestScaledImageResourcesOriented(t *testing.T) {
+	// Turned a quarter, it's 2000 wide and 3000 high.
+	res := scaledImageResources("host", "/a.jpg", Metadata{Resolution: "3000x2000", Orientation: 6})
+	var got []string
+	for _, r := range res {
+		got = append(got, r.Resolution)
+	}
+	if want := "512x768 320x480"; strings.Join(got, " ") != want {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestScaledImageCacheVersion(t *testing.T) {
+	cachePath := scaledImageCachePath(t.TempDir(), "/photos/a.jpg", "JPEG_SM")
+	v := fileVersion{time.Unix(1700000000, 0), 1000}
+	if err := writeScaledImageCache(cachePath, []byte("scaled"), v); err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := readScaledImageCache(cachePath, v); !ok || string(b) != "scaled" {
+		t.Fatalf("got %q, %v", b, ok)
+	}
+	// Replaced by a copy that kept the modification time.
+	if _, ok := readScaledImageCache(cachePath, fileVersion{v.ModTime, 2000}); ok {
+		t.Fatal("scaled image of the replaced file was used")
+	}
+	if _, ok := readScaledImageCache(filepath.Join(filepath.Dir(cachePath), "missing"), v); ok {
+		t.Fatal("missing cache file was read")
+	}
+}
@@ -0,0 +1,135 @@
+package dms
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// What IncompleteFiles does with files that are still being written, such as downloads.
+const (
+	// List and serve them as they are.
+	IncompleteFilesServe = ""
+	// Leave them out until they're complete.
+	IncompleteFilesHide = "hide"
+	// List them with "(incomplete)" after their titles.
+	IncompleteFilesMark = "mark"
+	// Serve them while they grow, following them to their end.
+	IncompleteFilesGrow = "grow"
+)
+
+// What's put in brackets after the titles of incomplete files that are marked.
+const incompleteMark = "incomplete"
+
+const (
+	// A file modified this recently may still be being written.
+	incompleteModTimeWindow = 30 * time.Second
+	// How often the end of a growing file being served is checked for more.
+	growPollInterval = time.Second
+	// How long a growing file being served may not grow before it's given up on, such as a paused
+	// download.
+	growIdleTimeout = 5 * time.Minute
+)
+
+// Files that downloaders keep beside a file while they write it, by suffix: Firefox's and others'
+// .part, and aria2's control file. Transmission instead writes to the .part itself, which is listed
+// as what it will be.
+var incompleteMarkerSuffixes = []string{".part", ".aria2"}
+
+func (srv *Server) initIncompleteFiles() error {
+	switch srv.IncompleteFiles {
+	case IncompleteFilesServe, IncompleteFilesHide, IncompleteFilesMark, IncompleteFilesGrow:
+		return nil
+	}
+	return fmt.Errorf("unknown incomplete files handling %q, want hide, mark or grow", srv.IncompleteFiles)
+}
+
+func (srv *Server) incompleteFiles() string {
+	return srv.settings().IncompleteFiles
+}
+
+// Whether the file looks like it's still being written: it was modified within
+// incompleteModTimeWindow, or it's a downloader's marker or has one beside it.
+func fileIncomplete(fsys FS, filePath string, fi os.FileInfo, now time.Time) bool {
+	if now.Sub(fi.ModTime()) < incompleteModTimeWindow {
+		return true
+	}
+	for _, s := range incompleteMarkerSuffixes {
+		if strings.HasSuffix(filePath, s) {
+			return true
+		}
+		if _, err := fsys.Stat(filePath + s); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads a file that's still being written, waiting at its end for more until it's complete.
+type growingReader struct {
+	ctx      context.Context
+	fsys     FS
+	f        File
+	filePath string
+	lastGrew time.Time
+}
+
+func (me *growingReader) Read(b []byte) (n int, err error) {
+	for {
+		n, err = me.f.Read(b)
+		if n != 0 || err != io.EOF {
+			if n != 0 {
+				me.lastGrew = time.Now()
+			}
+			return
+		}
+		now := time.Now()
+		if me.lastGrew.IsZero() {
+			me.lastGrew = now
+		}
+		// It's looked up by path, since a .part is renamed when it's complete.
+		fi, err := me.fsys.Stat(me.filePath)
+		if err != nil || !fileIncomplete(me.fsys, me.filePath, fi, now) || now.Sub(me.lastGrew) >= growIdleTimeout {
+			return 0, io.EOF
+		}
+		t := time.NewTimer(growPollInterval)
+		select {
+		case <-t.C:
+		case <-me.ctx.Done():
+			t.Stop()
+			return 0, me.ctx.Err()
+		}
+	}
+}
+
+// Serves a file that's still being written. Its length isn't known, so it's streamed from the
+// start without one until it's complete. Other ranges are served from what's been written so far.
+func (srv *Server) serveGrowingFile(w http.ResponseWriter, r *http.Request, filePath string) {
+	f, err := srv.contentFS().Open(filePath)
+	if err != nil {
+		srv.resourceError(w, r, fileErrorCause(err), err)
+		return
+	}
+	defer f.Close()
+	if rng := r.Header.Get("Range"); rng != "" && rng != "bytes=0-" {
+		fi, err := f.Stat()
+		if err != nil {
+			srv.resourceError(w, r, fileErrorCause(err), err)
+			return
+		}
+		http.ServeContent(w, r, "", fi.ModTime(), io.NewSectionReader(f, 0, fi.Size()))
+		return
+	}
+	w.Header().Set("transferMode.dlna.org", "Streaming")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return
+	}
+	if _, err := io.Copy(w, &growingReader{ctx: r.Context(), fsys: srv.contentFS(), f: f, filePath: filePath}); err != nil && r.Context().Err() == nil {
+		srv.requestLogger(r).Printf("error serving growing file %q: %v", filePath, err)
+	}
+}
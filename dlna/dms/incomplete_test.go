@@ -0,0 +1,72 @@
+package dms
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileIncomplete(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "film.mkv")
+	if err := os.WriteFile(filePath, []byte("film"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fileIncomplete(osFS{}, filePath, fi, fi.ModTime().Add(time.Second)) {
+		t.Error("just written file complete")
+	}
+	later := fi.ModTime().Add(time.Hour)
+	if fileIncomplete(osFS{}, filePath, fi, later) {
+		t.Error("old file incomplete")
+	}
+	if err := os.WriteFile(filePath+".part", nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !fileIncomplete(osFS{}, filePath, fi, later) {
+		t.Error("file with .part beside it complete")
+	}
+	if !fileIncomplete(osFS{}, filePath+".part", fi, later) {
+		t.Error(".part complete")
+	}
+}
+
+func TestGrowingReader(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "film.mkv")
+	if err := os.WriteFile(filePath, []byte("first"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath+".aria2", nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	go func() {
+		time.Sleep(growPollInterval / 2)
+		w, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.WriteString(" second")
+		w.Close()
+		old := time.Now().Add(-time.Hour)
+		os.Chtimes(filePath, old, old)
+		os.Remove(filePath + ".aria2")
+	}()
+	b, err := io.ReadAll(&growingReader{ctx: context.Background(), fsys: osFS{}, f: f, filePath: filePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "first second" {
+		t.Fatalf("read %q", b)
+	}
+}
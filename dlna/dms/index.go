@@ -0,0 +1,613 @@
+package dms
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+	"github.com/fsnotify/fsnotify"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// Directory entries, keyed by the object path of the directory and the entry name separated by
+	// a NUL, so the entries of a directory are adjacent.
+	indexEntriesBucket = []byte("entries")
+	// Object paths of the directories that have been scanned, with the time they were scanned.
+	indexDirsBucket = []byte("dirs")
+	// Generated thumbnails, keyed by object path and format separated by a NUL.
+	indexThumbsBucket = []byte("thumbs")
+	// Entries of files that have gone from their directories, keyed like indexEntriesBucket, until
+	// they've been gone for longer than Server.KeepMissing.
+	indexMissingBucket = []byte("missing")
+	// The indexVersion the index was written with, under indexVersionKey.
+	indexMetaBucket = []byte("meta")
+	indexVersionKey = []byte("version")
+)
+
+// Bumped when what the index keeps changes, such as a field added to Metadata, so that what was
+// indexed before is identified again. Indexes from before it was kept are version 0.
+//
+// 1: Metadata.AudioCodec.
+const indexVersion = 1
+
+// How long to let filesystem events settle before rescanning the affected directories.
+const indexRescanDelay = time.Second
+
+// What the index knows about a directory entry.
+type indexEntry struct {
+	Name    string
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+	// From the metadata providers, for media files.
+	Metadata *Metadata `json:",omitempty"`
+}
+
+func (e *indexEntry) unchanged(fi os.FileInfo) bool {
+	return e.Mode == fi.Mode() && e.Size == fi.Size() && e.ModTime.Equal(fi.ModTime())
+}
+
+// An os.FileInfo for an indexed entry. Sys returns the *indexEntry.
+type indexFileInfo struct {
+	e *indexEntry
+}
+
+func (fi indexFileInfo) Name() string       { return fi.e.Name }
+func (fi indexFileInfo) Size() int64        { return fi.e.Size }
+func (fi indexFileInfo) Mode() os.FileMode  { return fi.e.Mode }
+func (fi indexFileInfo) ModTime() time.Time { return fi.e.ModTime }
+func (fi indexFileInfo) IsDir() bool        { return fi.e.Mode.IsDir() }
+func (fi indexFileInfo) Sys() interface{}   { return fi.e }
+
+func indexEntryKey(dir, name string) []byte {
+	return []byte(dir + "\x00" + name)
+}
+
+// A persistent index of the shared directories. They're scanned in the background and watched
+// for changes, so that Browse and Search don't have to stat and probe files on each request.
+type index struct {
+	srv     *Server
+	db      *bolt.DB
+	logger  log.Logger
+	watcher *fsnotify.Watcher
+
+	mu sync.Mutex
+	// Watched local directories, and the object paths they're indexed under.
+	watched map[string]string
+	// Object paths of directories to rescan, and whether to rescan the directories below them.
+	pending map[string]bool
+
+	wake   chan struct{}
+	closed chan struct{}
+	done   chan struct{}
+}
+
+func openIndex(srv *Server, dbPath string) (*index, error) {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{indexEntriesBucket, indexDirsBucket, indexThumbsBucket, indexMissingBucket, indexMetaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return upgradeIndex(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &index{
+		srv:     srv,
+		db:      db,
+		logger:  srv.Logger.WithNames("index"),
+		watcher: watcher,
+		watched: make(map[string]string),
+		pending: make(map[string]bool),
+		wake:    make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+// Brings an index written by an older version of dms up to indexVersion, by forgetting the
+// metadata of its entries. The scan on start identifies the files again, from the ffprobe cache
+// where they're in it.
+func upgradeIndex(tx *bolt.Tx) error {
+	meta := tx.Bucket(indexMetaBucket)
+	version, _ := strconv.Atoi(string(meta.Get(indexVersionKey)))
+	if version == indexVersion {
+		return nil
+	}
+	entries := tx.Bucket(indexEntriesBucket)
+	err := forgetIndexMetadata(entries, func(v []byte) (interface{}, *indexEntry, error) {
+		var e indexEntry
+		return &e, &e, json.Unmarshal(v, &e)
+	})
+	if err != nil {
+		return err
+	}
+	err = forgetIndexMetadata(tx.Bucket(indexMissingBucket), func(v []byte) (interface{}, *indexEntry, error) {
+		var m missingEntry
+		return &m, &m.Entry, json.Unmarshal(v, &m)
+	})
+	if err != nil {
+		return err
+	}
+	return meta.Put(indexVersionKey, []byte(strconv.Itoa(indexVersion)))
+}
+
+// Clears the Metadata of the entries in b, which decode gives the value to write back and the
+// entry of.
+func forgetIndexMetadata(b *bolt.Bucket, decode func([]byte) (interface{}, *indexEntry, error)) error {
+	updated := make(map[string][]byte)
+	err := b.ForEach(func(k, v []byte) error {
+		value, e, err := decode(v)
+		if err != nil || e.Metadata == nil {
+			return nil
+		}
+		e.Metadata = nil
+		if updated[string(k)], err = json.Marshal(value); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range updated {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Starts scanning everything, and then keeps the index up to date.
+func (me *index) start() {
+	me.done = make(chan struct{})
+	me.rescan("/", true)
+	go me.watch()
+	go me.run()
+}
+
+func (me *index) Close() error {
+	close(me.closed)
+	me.watcher.Close()
+	if me.done != nil {
+		<-me.done
+	}
+	return me.db.Close()
+}
+
+// Queues the directory at object path p to be rescanned.
+func (me *index) rescan(p string, recursive bool) {
+	me.mu.Lock()
+	me.pending[p] = me.pending[p] || recursive
+	me.mu.Unlock()
+	select {
+	case me.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (me *index) run() {
+	defer close(me.done)
+	purge := time.NewTicker(indexPurgeInterval)
+	defer purge.Stop()
+	me.purgeMissing()
+	for {
+		select {
+		case <-me.closed:
+			return
+		case <-purge.C:
+			me.purgeMissing()
+			continue
+		case <-me.wake:
+		}
+		// Let bursts of changes, such as a file being copied in, settle.
+		select {
+		case <-me.closed:
+			return
+		case <-time.After(indexRescanDelay):
+		}
+		me.mu.Lock()
+		pending := me.pending
+		me.pending = make(map[string]bool)
+		me.mu.Unlock()
+		for p, recursive := range pending {
+			o, err := me.srv.objectFromPath(p)
+			if err != nil {
+				// No longer shared. It's pruned by rescanning the root.
+				continue
+			}
+			started := time.Now()
+			dirs := me.scanDir(o, recursive)
+			me.logger.Levelf(log.Debug, "scanned %d directories from %q in %v", dirs, p, time.Since(started))
+			me.srv.runHooks(HookScanComplete, map[string]string{
+				"PATH":     p,
+				"DIRS":     strconv.Itoa(dirs),
+				"DURATION": strconv.FormatFloat(time.Since(started).Seconds(), 'f', 0, 64),
+			})
+		}
+	}
+}
+
+func (me *index) watch() {
+	for {
+		select {
+		case <-me.closed:
+			return
+		case ev, ok := <-me.watcher.Events:
+			if !ok {
+				return
+			}
+			me.mu.Lock()
+			p, ok := me.watched[filepath.Dir(ev.Name)]
+			gone, watched := me.watched[ev.Name]
+			me.mu.Unlock()
+			if ok {
+				me.rescan(p, false)
+			}
+			// The watch goes with the directory, so one made in its place needs a new one.
+			if watched && ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				me.unwatch(gone)
+				me.rescan(gone, true)
+			}
+		case err, ok := <-me.watcher.Errors:
+			if !ok {
+				return
+			}
+			me.logger.Levelf(log.Warning, "error watching for changes: %v", err)
+		}
+	}
+}
+
+// Lists the directory at o from the filesystem. For the container of several root dirs, the
+// entries are the root dirs under their names.
+func (me *index) listDir(o object) (fis []os.FileInfo, err error) {
+	if !me.srv.isRootDirsContainer(o) {
+		return me.srv.contentFS().ReadDir(o.FilePath())
+	}
+	sd := me.srv.sharedDirs()
+	for i := range sd.rootDirs {
+		rd := &sd.rootDirs[i]
+		fi, err := me.srv.contentFS().Stat(rd.Path)
+		if err != nil {
+			me.logger.Levelf(log.Warning, "error indexing root dir: %v", err)
+			continue
+		}
+		fis = append(fis, indexFileInfo{&indexEntry{
+			Name:    rd.Name,
+			Mode:    fi.Mode(),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		}})
+	}
+	return
+}
+
+// Updates the index with the current contents of the directory at o. Directories below it are
+// scanned if recursive is set, or if they haven't been indexed yet. Returns the number of
+// directories scanned.
+func (me *index) scanDir(o object, recursive bool) (dirs int) {
+	select {
+	case <-me.closed:
+		return
+	default:
+	}
+	fis, err := me.listDir(o)
+	if err != nil {
+		me.logger.Levelf(log.Debug, "removing %q from index: %v", o.Path, err)
+		keep := me.srv.keepMissing() != 0
+		me.update(func(tx *bolt.Tx) error {
+			if keep {
+				return retireIndexSubtree(tx, o.Path, time.Now())
+			}
+			return deleteIndexSubtree(tx, o.Path)
+		})
+		me.unwatch(o.Path)
+		return
+	}
+	old := me.dirEntries(o.Path)
+	missing := me.missingEntries(o.Path)
+	// Whether the container has changed since it was last scanned.
+	changed := false
+	entries := make([]*indexEntry, 0, len(fis))
+	// Whether each current entry is a directory.
+	current := make(map[string]bool, len(fis))
+	for _, fi := range fis {
+		// Ignored entries are left out, so they're dropped from the index if they were in it.
+		child := o.child(fi.Name())
+		filePath := child.FilePath()
+		if ignored, err := me.srv.IgnorePath(filePath); err != nil || ignored {
+			continue
+		}
+		current[fi.Name()] = fi.IsDir()
+		e := &indexEntry{
+			Name:    fi.Name(),
+			Mode:    fi.Mode(),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		}
+		if m, ok := missing[fi.Name()]; ok && m.Entry.unchanged(fi) && m.Entry.Metadata != nil {
+			// It's come back, so it needn't be identified again.
+			changed = true
+			e.Metadata = m.Entry.Metadata
+			me.srv.problems.note(filePath, e.Metadata)
+		} else if prev, ok := old[fi.Name()]; !ok || !prev.unchanged(fi) {
+			changed = true
+		} else if prev.Metadata != nil {
+			e.Metadata = prev.Metadata
+			me.srv.problems.note(filePath, e.Metadata)
+		}
+		if e.Metadata == nil && fi.Mode().IsRegular() {
+			if mt, err := me.srv.mimeTypeByPath(filePath); err == nil && mt.IsMedia() {
+				e.Metadata = me.srv.identify(filePath, fi, mt)
+			}
+		}
+		entries = append(entries, e)
+	}
+	keep := me.srv.keepMissing() != 0
+	now := time.Now()
+	// Directories that are gone, and no longer to be watched.
+	var gone []string
+	me.update(func(tx *bolt.Tx) error {
+		gone = gone[:0]
+		b := tx.Bucket(indexEntriesBucket)
+		for name, prev := range old {
+			if isDir, ok := current[name]; ok && isDir == prev.Mode.IsDir() {
+				continue
+			}
+			changed = true
+			p := path.Join(o.Path, name)
+			if prev.Mode.IsDir() {
+				gone = append(gone, p)
+			}
+			if keep {
+				if err := retireIndexEntry(tx, o.Path, prev, now); err != nil {
+					return err
+				}
+				if prev.Mode.IsDir() {
+					if err := retireIndexSubtree(tx, p, now); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := b.Delete(indexEntryKey(o.Path, name)); err != nil {
+				return err
+			}
+			if err := deleteIndexPrefix(tx.Bucket(indexThumbsBucket), p+"\x00"); err != nil {
+				return err
+			}
+			if prev.Mode.IsDir() {
+				if err := deleteIndexSubtree(tx, p); err != nil {
+					return err
+				}
+			}
+		}
+		for name := range missing {
+			if _, ok := current[name]; ok {
+				if err := tx.Bucket(indexMissingBucket).Delete(indexEntryKey(o.Path, name)); err != nil {
+					return err
+				}
+			}
+		}
+		for _, e := range entries {
+			v, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(indexEntryKey(o.Path, e.Name), v); err != nil {
+				return err
+			}
+		}
+		t, _ := time.Now().MarshalBinary()
+		return tx.Bucket(indexDirsBucket).Put([]byte(o.Path), t)
+	})
+	for _, p := range gone {
+		me.unwatch(p)
+	}
+	if changed {
+		me.srv.containerChanged(o.Path)
+	}
+	dirs++
+	if !me.srv.isRootDirsContainer(o) {
+		me.addWatch(o.FilePath(), o.Path)
+	}
+	for _, e := range entries {
+		if !e.Mode.IsDir() {
+			continue
+		}
+		p := path.Join(o.Path, e.Name)
+		if !recursive && me.isIndexed(p) {
+			continue
+		}
+		child, err := me.srv.objectFromPath(p)
+		if err != nil {
+			continue
+		}
+		dirs += me.scanDir(child, recursive)
+	}
+	return
+}
+
+func (me *index) addWatch(fsPath, objectPath string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.watched[fsPath] == objectPath {
+		return
+	}
+	if err := me.watcher.Add(fsPath); err != nil {
+		me.logger.Levelf(log.Warning, "can't watch %q for changes: %v", fsPath, err)
+		return
+	}
+	me.watched[fsPath] = objectPath
+}
+
+// Stops watching the directories at and below the object path p, so they're watched again if
+// they're scanned.
+func (me *index) unwatch(p string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for fsPath, objectPath := range me.watched {
+		if objectPath == p || strings.HasPrefix(objectPath, strings.TrimSuffix(p, "/")+"/") {
+			// Removed already if the directory was deleted.
+			me.watcher.Remove(fsPath)
+			delete(me.watched, fsPath)
+		}
+	}
+}
+
+func (me *index) update(f func(*bolt.Tx) error) {
+	if err := me.db.Update(f); err != nil {
+		me.logger.Levelf(log.Error, "error updating index: %v", err)
+	}
+}
+
+// Deletes everything in the index at and below the object path p, other than its own entry in
+// its parent directory.
+func deleteIndexSubtree(tx *bolt.Tx, p string) error {
+	for _, del := range []struct {
+		bucket   []byte
+		prefixes []string
+	}{
+		{indexEntriesBucket, []string{p + "\x00", p + "/"}},
+		{indexDirsBucket, []string{p + "/"}},
+		{indexThumbsBucket, []string{p + "/"}},
+	} {
+		for _, prefix := range del.prefixes {
+			if err := deleteIndexPrefix(tx.Bucket(del.bucket), prefix); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Bucket(indexDirsBucket).Delete([]byte(p))
+}
+
+func deleteIndexPrefix(b *bolt.Bucket, prefix string) error {
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (me *index) isIndexed(dir string) (ok bool) {
+	me.db.View(func(tx *bolt.Tx) error {
+		ok = tx.Bucket(indexDirsBucket).Get([]byte(dir)) != nil
+		return nil
+	})
+	return
+}
+
+// Calls f with the directory and entry of everything indexed in the directory at object path dir,
+// and below it if recursive is set, until f returns false.
+func (me *index) forEachEntry(dir string, recursive bool, f func(dir string, e *indexEntry) bool) error {
+	return me.db.View(func(tx *bolt.Tx) error {
+		prefix := dir + "\x00"
+		if recursive {
+			prefix = strings.TrimSuffix(dir, "/")
+		}
+		c := tx.Bucket(indexEntriesBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			i := bytes.IndexByte(k, 0)
+			entryDir := string(k[:i])
+			if entryDir != dir && !strings.HasPrefix(entryDir, prefix+"/") {
+				// A sibling with dir's name as a prefix.
+				continue
+			}
+			var e indexEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if !f(entryDir, &e) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (me *index) dirEntries(dir string) map[string]*indexEntry {
+	ret := make(map[string]*indexEntry)
+	err := me.forEachEntry(dir, false, func(_ string, e *indexEntry) bool {
+		ret[e.Name] = e
+		return true
+	})
+	if err != nil {
+		me.logger.Levelf(log.Error, "error reading index: %v", err)
+	}
+	return ret
+}
+
+// Returns the indexed entries of the directory at object path dir, or false if it hasn't been
+// scanned yet.
+func (me *index) readDir(dir string) (fis []os.FileInfo, ok bool) {
+	if !me.isIndexed(dir) {
+		return nil, false
+	}
+	err := me.forEachEntry(dir, false, func(_ string, e *indexEntry) bool {
+		fis = append(fis, indexFileInfo{e})
+		return true
+	})
+	return fis, err == nil
+}
+
+// Returns the indexed entry for the object path p.
+func (me *index) stat(p string) (fi os.FileInfo, ok bool) {
+	me.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(indexEntriesBucket).Get(indexEntryKey(path.Dir(p), path.Base(p)))
+		if v == nil {
+			return nil
+		}
+		var e indexEntry
+		if json.Unmarshal(v, &e) == nil {
+			fi, ok = indexFileInfo{&e}, true
+		}
+		return nil
+	})
+	return
+}
+
+func indexThumbnailKey(p, format string) []byte {
+	return []byte(p + "\x00" + format)
+}
+
+// Returns the thumbnail stored for the object path p, if it's of this version of the file.
+func (me *index) thumbnail(p, format string, version fileVersion) (b []byte, ok bool) {
+	me.db.View(func(tx *bolt.Tx) error {
+		b, ok = version.trim(tx.Bucket(indexThumbsBucket).Get(indexThumbnailKey(p, format)))
+		b = append([]byte(nil), b...)
+		return nil
+	})
+	return
+}
+
+func (me *index) storeThumbnail(p, format string, version fileVersion, b []byte) {
+	v := version.prefix(b)
+	me.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexThumbsBucket).Put(indexThumbnailKey(p, format), v)
+	})
+}
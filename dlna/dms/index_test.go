@@ -0,0 +1,244 @@
+package dms
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Entries indexed before the index had a version, and so before Metadata.AudioCodec, have their
+// metadata forgotten, so that they're identified again.
+func TestIndexUpgrade(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "index.db")
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		put := func(bucket []byte, key []byte, v interface{}) error {
+			b, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+			j, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			return b.Put(key, j)
+		}
+		e := indexEntry{Name: "a.m4a", Size: 1, Metadata: &Metadata{SampleRate: 44100}}
+		if err := put(indexEntriesBucket, indexEntryKey("/", e.Name), e); err != nil {
+			return err
+		}
+		e.Name = "b.m4a"
+		return put(indexMissingBucket, indexEntryKey("/", e.Name), missingEntry{Entry: e, Since: time.Now()})
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		idx, err := openIndex(&Server{Logger: log.Default}, dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := idx.dirEntries("/")["a.m4a"]
+		m := idx.missingEntries("/")["b.m4a"]
+		idx.Close()
+		if e == nil || e.Size != 1 || e.Metadata != nil {
+			t.Fatalf("entry %+v", e)
+		}
+		if m == nil || m.Entry.Metadata != nil {
+			t.Fatalf("missing entry %+v", m)
+		}
+	}
+}
+
+// Returns a server sharing a temporary directory with the files, by their slash-separated paths in
+// it, and an index of it in a temporary database.
+func newTestIndex(t *testing.T, files ...string) (*Server, *index) {
+	dir := t.TempDir()
+	for _, name := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{RootObjectPath: dir, NoProbe: true, Logger: log.Default}
+	idx, err := openIndex(srv, filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { idx.Close() })
+	return srv, idx
+}
+
+// Returns the names indexed in the directory at the object path, sorted, or nil if it isn't
+// indexed.
+func indexedNames(idx *index, dir string) (ret []string) {
+	fis, ok := idx.readDir(dir)
+	if !ok {
+		return nil
+	}
+	ret = []string{}
+	for _, fi := range fis {
+		ret = append(ret, fi.Name())
+	}
+	sort.Strings(ret)
+	return
+}
+
+func TestIndexScan(t *testing.T) {
+	srv, idx := newTestIndex(t, "a.mp4", "b.mp3", "notes.txt", "Sub/c.mkv", "Sub/Deeper/d.mkv")
+	root, err := srv.objectFromPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := idx.readDir("/"); ok {
+		t.Fatal("indexed before it's scanned")
+	}
+	if dirs := idx.scanDir(root, true); dirs != 3 {
+		t.Errorf("scanned %d directories", dirs)
+	}
+	if got := fmt.Sprint(indexedNames(idx, "/")); got != "[Sub a.mp4 b.mp3 notes.txt]" {
+		t.Errorf("root has %s", got)
+	}
+	if got := fmt.Sprint(indexedNames(idx, "/Sub/Deeper")); got != "[d.mkv]" {
+		t.Errorf("/Sub/Deeper has %s", got)
+	}
+	fi, ok := idx.stat("/Sub/c.mkv")
+	if !ok || fi.Size() != int64(len("Sub/c.mkv")) || fi.Sys().(*indexEntry).Metadata == nil {
+		t.Fatalf("/Sub/c.mkv indexed as %v %v", fi, ok)
+	}
+	if fi, _ := idx.stat("/notes.txt"); fi.Sys().(*indexEntry).Metadata != nil {
+		t.Error("metadata kept for a file that isn't media")
+	}
+
+	// A renamed file is dropped under its old name, with its thumbnails, and added under its new.
+	version := fileVersion{time.Unix(1, 0), 5}
+	idx.storeThumbnail("/a.mp4", "jpeg", version, []byte("thumb"))
+	if err := os.Rename(filepath.Join(srv.RootObjectPath, "a.mp4"), filepath.Join(srv.RootObjectPath, "e.mp4")); err != nil {
+		t.Fatal(err)
+	}
+	idx.scanDir(root, false)
+	if got := fmt.Sprint(indexedNames(idx, "/")); got != "[Sub b.mp3 e.mp4 notes.txt]" {
+		t.Errorf("root has %s after renaming", got)
+	}
+	if _, ok := idx.thumbnail("/a.mp4", "jpeg", version); ok {
+		t.Error("thumbnail of renamed file kept")
+	}
+
+	// A deleted directory is pruned with everything below it.
+	if err := os.RemoveAll(filepath.Join(srv.RootObjectPath, "Sub")); err != nil {
+		t.Fatal(err)
+	}
+	idx.scanDir(root, false)
+	if got := fmt.Sprint(indexedNames(idx, "/")); got != "[b.mp3 e.mp4 notes.txt]" {
+		t.Errorf("root has %s after deleting", got)
+	}
+	for _, dir := range []string{"/Sub", "/Sub/Deeper"} {
+		if idx.isIndexed(dir) {
+			t.Errorf("%s is still indexed", dir)
+		}
+	}
+	if _, ok := idx.stat("/Sub/Deeper/d.mkv"); ok {
+		t.Error("file in deleted directory is still indexed")
+	}
+
+	// As is one that's rescanned itself after it's gone.
+	if err := os.Mkdir(filepath.Join(srv.RootObjectPath, "Gone"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	idx.scanDir(root, false)
+	gone, err := srv.objectFromPath("/Gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !idx.isIndexed("/Gone") {
+		t.Fatal("new directory isn't indexed")
+	}
+	os.Remove(filepath.Join(srv.RootObjectPath, "Gone"))
+	idx.scanDir(gone, false)
+	if idx.isIndexed("/Gone") {
+		t.Error("directory that's gone is still indexed")
+	}
+}
+
+// Changes in watched directories are indexed without being asked for.
+func TestIndexWatch(t *testing.T) {
+	srv, idx := newTestIndex(t, "a.mp4", "Sub/b.mp4")
+	idx.start()
+	waitFor := func(what string, f func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * indexRescanDelay); !f(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	waitFor("the first scan", func() bool { return idx.isIndexed("/Sub") })
+	if err := os.WriteFile(filepath.Join(srv.RootObjectPath, "Sub", "c.mp4"), []byte("c"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("a new file", func() bool {
+		_, ok := idx.stat("/Sub/c.mp4")
+		return ok
+	})
+	if err := os.Remove(filepath.Join(srv.RootObjectPath, "a.mp4")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("a deleted file", func() bool {
+		_, ok := idx.stat("/a.mp4")
+		return !ok
+	})
+	// A directory made in place of a deleted one is watched like it.
+	sub := filepath.Join(srv.RootObjectPath, "Sub")
+	if err := os.RemoveAll(sub); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the directory to be made again", func() bool {
+		_, ok := idx.stat("/Sub/b.mp4")
+		return !ok
+	})
+	if err := os.WriteFile(filepath.Join(sub, "c.mp4"), []byte("c"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("a file in the directory made again", func() bool {
+		_, ok := idx.stat("/Sub/c.mp4")
+		return ok
+	})
+}
+
+// Thumbnails are kept for the version of the file they were made from.
+func TestIndexThumbnails(t *testing.T) {
+	_, idx := newTestIndex(t)
+	version := fileVersion{time.Unix(1, 0), 5}
+	if _, ok := idx.thumbnail("/a.mp4", "jpeg", version); ok {
+		t.Fatal("thumbnail before one's stored")
+	}
+	idx.storeThumbnail("/a.mp4", "jpeg", version, []byte("thumb"))
+	if b, ok := idx.thumbnail("/a.mp4", "jpeg", version); !ok || string(b) != "thumb" {
+		t.Errorf("got %q %v", b, ok)
+	}
+	if _, ok := idx.thumbnail("/a.mp4", "png", version); ok {
+		t.Error("thumbnail in another format")
+	}
+	for _, changed := range []fileVersion{{time.Unix(2, 0), 5}, {time.Unix(1, 0), 6}} {
+		if _, ok := idx.thumbnail("/a.mp4", "jpeg", changed); ok {
+			t.Errorf("thumbnail of %v kept for %v", version, changed)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package dms
+
+import (
+	"net"
+	"path"
+)
+
+// What's known about an interface's link, for choosing between interfaces on the same network.
+type interfaceLink struct {
+	Wireless bool
+	// Metric of the route to the network through the interface, or -1 if unknown.
+	Metric int
+	// In Mb/s, or 0 if unknown.
+	Speed int
+}
+
+// How an interface ranks for advertising an address on a network, when several are on it.
+type interfaceRank struct {
+	// The index of the first InterfacePriority pattern matching the interface, or the number of
+	// patterns if none do.
+	priority int
+	link     interfaceLink
+	index    int
+}
+
+func (me interfaceRank) betterThan(other interfaceRank) bool {
+	if me.priority != other.priority {
+		return me.priority < other.priority
+	}
+	if me.link.Wireless != other.link.Wireless {
+		return !me.link.Wireless
+	}
+	if me.link.Metric != other.link.Metric {
+		if me.link.Metric == -1 || other.link.Metric == -1 {
+			return other.link.Metric == -1
+		}
+		return me.link.Metric < other.link.Metric
+	}
+	if me.link.Speed != other.link.Speed {
+		return me.link.Speed > other.link.Speed
+	}
+	// Pick one consistently rather than advertising both.
+	return me.index < other.index
+}
+
+func (me *Server) interfaceRank(if_ net.Interface, ip net.IP) interfaceRank {
+	priorities := me.settings().InterfacePriority
+	rank := interfaceRank{
+		priority: len(priorities),
+		link:     getInterfaceLink(if_.Name, ip),
+		index:    if_.Index,
+	}
+	for i, pattern := range priorities {
+		if ok, _ := path.Match(pattern, if_.Name); ok {
+			rank.priority = i
+			break
+		}
+	}
+	return rank
+}
+
+// Returns the network of an address of the interface.
+func interfaceIPNet(if_ net.Interface, ip net.IP) *net.IPNet {
+	addrs, err := if_.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return ipNet
+		}
+	}
+	return nil
+}
+
+// Reports whether to advertise ip, an address of if_, in LOCATION. It isn't if another interface
+// has an address on the same network and ranks better, so that renderers fetch the description,
+// and then stream, over the better link, such as wired rather than Wi-Fi.
+func (me *Server) preferAddr(if_ net.Interface, ip net.IP) bool {
+	if ip.IsLinkLocalUnicast() {
+		return true
+	}
+	ipNet := interfaceIPNet(if_, ip)
+	if ipNet == nil {
+		return true
+	}
+	var rank *interfaceRank
+	for _, other := range me.Interfaces {
+		if other.Index == if_.Index || !me.ssdpEligible(other) {
+			continue
+		}
+		addrs, err := other.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			otherNet, ok := a.(*net.IPNet)
+			if !ok || !ipNet.Contains(otherNet.IP) && !otherNet.Contains(ip) {
+				continue
+			}
+			if rank == nil {
+				r := me.interfaceRank(if_, ip)
+				rank = &r
+			}
+			if me.interfaceRank(other, otherNet.IP).betterThan(*rank) {
+				return false
+			}
+		}
+	}
+	return true
+}
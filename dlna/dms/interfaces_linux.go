@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package dms
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func getInterfaceLink(name string, ip net.IP) (ret interfaceLink) {
+	sysDir := filepath.Join("/sys/class/net", name)
+	if _, err := os.Stat(filepath.Join(sysDir, "wireless")); err == nil {
+		ret.Wireless = true
+	}
+	// Reading this fails for wireless interfaces, and it's -1 if the link is down.
+	if b, err := os.ReadFile(filepath.Join(sysDir, "speed")); err == nil {
+		if speed, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && speed > 0 {
+			ret.Speed = speed
+		}
+	}
+	ret.Metric = routeMetric(name, ip)
+	return
+}
+
+// Reports whether the interface is made by software, such as a bridge, veth or tun device, rather
+// than a network card. The kernel puts those under the virtual devices.
+func isVirtualInterface(name string) bool {
+	_, err := os.Stat(filepath.Join("/sys/devices/virtual/net", name))
+	return err == nil
+}
+
+// Returns the metric of the IPv4 route through the interface to the network with ip, from
+// /proc/net/route, or -1 if there isn't one.
+func routeMetric(name string, ip net.IP) int {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return -1
+	}
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	// Skip the header.
+	s.Scan()
+	for s.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask MTU Window IRTT
+		fields := strings.Fields(s.Text())
+		if len(fields) < 8 || fields[0] != name {
+			continue
+		}
+		dest, destErr := parseProcRouteAddr(fields[1])
+		mask, maskErr := parseProcRouteAddr(fields[7])
+		metric, metricErr := strconv.Atoi(fields[6])
+		if destErr != nil || maskErr != nil || metricErr != nil || mask.Equal(net.IPv4zero) {
+			continue
+		}
+		if ip4.Mask(net.IPMask(mask)).Equal(dest) {
+			return metric
+		}
+	}
+	return -1
+}
+
+// Addresses in /proc/net/route are in hex, in host byte order, which is assumed to be
+// little-endian.
+func parseProcRouteAddr(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 4 {
+		return nil, fmt.Errorf("bad address %q", s)
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+	return ip, nil
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package dms
+
+import (
+	"net"
+	"path"
+)
+
+func getInterfaceLink(name string, ip net.IP) interfaceLink {
+	return interfaceLink{Metric: -1}
+}
+
+// Names of the virtual interfaces of Docker, VMs, bridges and tunnels on the BSDs, macOS and
+// Windows, where there's nothing to tell them by.
+var virtualInterfacePatterns = []string{
+	"docker*", "veth*", "br-*", "bridge*", "virbr*", "vmnet*", "vboxnet*", "tun*", "tap*", "utun*",
+	"vEthernet*",
+}
+
+func isVirtualInterface(name string) bool {
+	for _, pattern := range virtualInterfacePatterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package dms
+
+import (
+	"net"
+	"testing"
+)
+
+func TestInterfaceRank(t *testing.T) {
+	wired := interfaceRank{priority: 1, link: interfaceLink{Metric: 100, Speed: 1000}, index: 2}
+	wifi := interfaceRank{priority: 1, link: interfaceLink{Wireless: true, Metric: 50}, index: 3}
+	if !wired.betterThan(wifi) || wifi.betterThan(wired) {
+		t.Error("wired should beat wireless")
+	}
+	wifi.priority = 0
+	if !wifi.betterThan(wired) {
+		t.Error("InterfacePriority should come first")
+	}
+	slow := interfaceRank{priority: 1, link: interfaceLink{Metric: 100, Speed: 100}, index: 1}
+	if !wired.betterThan(slow) {
+		t.Error("faster link should win")
+	}
+	unknown := interfaceRank{priority: 1, link: interfaceLink{Metric: -1, Speed: 10000}, index: 1}
+	if !slow.betterThan(unknown) {
+		t.Error("known route metric should win")
+	}
+	same := wired
+	same.index = 5
+	if wired.betterThan(wired) || !wired.betterThan(same) || same.betterThan(wired) {
+		t.Error("ties should be broken by interface index")
+	}
+}
+
+func TestSSDPTargets(t *testing.T) {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lo net.Interface
+	for _, if_ := range ifs {
+		if if_.Flags&net.FlagLoopback != 0 && if_.Flags&net.FlagUp != 0 {
+			lo = if_
+		}
+	}
+	if lo.Name == "" {
+		t.Skip("no loopback interface")
+	}
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv := &Server{
+		HTTPConn: ln,
+		// One that's gone, such as a USB Wi-Fi adapter that was unplugged.
+		Interfaces: []net.Interface{lo, {Index: 1000, Name: "gone0"}},
+	}
+	// Loopback is skipped unless it's allowed.
+	if targets := srv.ssdpTargets(); len(targets) != 0 {
+		t.Fatalf("got %v", targets)
+	}
+	srv.SSDPAllowInterfaces = []string{lo.Name}
+	targets := srv.ssdpTargets()
+	if len(targets) != 1 {
+		t.Fatalf("got %v", targets)
+	}
+	if target, ok := targets[ssdpKey{lo.Name, false}]; !ok || target.addrs == "" {
+		t.Errorf("got %v", targets)
+	}
+}
+
+func TestSSDPEligible(t *testing.T) {
+	const up = net.FlagUp | net.FlagMulticast | net.FlagBroadcast
+	srv := &Server{SSDPAllowInterfaces: []string{"lo*"}}
+	for _, c := range []struct {
+		if_  net.Interface
+		want bool
+	}{
+		{net.Interface{Name: "dmstest0", Flags: up}, true},
+		{net.Interface{Name: "dmstest1", Flags: up &^ net.FlagUp}, false},
+		{net.Interface{Name: "dmstest2", Flags: net.FlagUp}, false},
+		{net.Interface{Name: "dmstun0", Flags: net.FlagUp | net.FlagMulticast | net.FlagPointToPoint}, false},
+		{net.Interface{Name: "dmsloop0", Flags: net.FlagUp | net.FlagLoopback}, false},
+		{net.Interface{Name: "lo", Flags: net.FlagUp | net.FlagLoopback}, true},
+		{net.Interface{Name: "lo", Flags: net.FlagLoopback}, false},
+	} {
+		if got := srv.ssdpEligible(c.if_); got != c.want {
+			t.Errorf("%s %v: got %v", c.if_.Name, c.if_.Flags, got)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package dms
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/anacrolix/ffprobe"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+const apiItemsPath = "/api/items/"
+
+// Everything the server knows about a media file, for troubleshooting what clients are offered.
+type apiItemDetail struct {
+	apiObject
+	// The file's location in the local filesystem.
+	File     string
+	Size     int64
+	ModTime  time.Time
+	MimeType string
+	// As identified by the metadata providers, or from the index.
+	Metadata *Metadata
+	// ffprobe's results, if the file was probed.
+	Format     map[string]interface{}   `json:",omitempty"`
+	Streams    []map[string]interface{} `json:",omitempty"`
+	ProbeError string                   `json:",omitempty"`
+	// What the different kinds of client are offered.
+	Offers []apiItemOffer
+}
+
+// The resources a kind of client is offered, in the order they're given. Clients that are neither
+// matched by a User-Agent nor known renderers get the default offer, which has neither set.
+type apiItemOffer struct {
+	// A User-Agent substring of an audio profile or LPCMUserAgents.
+	UserAgent string `json:",omitempty"`
+	// The address of a renderer that has announced what it accepts.
+	Renderer  string `json:",omitempty"`
+	Resources []apiOfferedResource
+}
+
+type apiOfferedResource struct {
+	apiResource
+	// Whether the client takes the resource, if what it accepts is known.
+	Accepted *bool `json:",omitempty"`
+}
+
+func makeAPIItemOffer(item upnpav.Item, sink rendererSink) (ret apiItemOffer) {
+	item, _ = sink.arrange(item).(upnpav.Item)
+	apiObj, _ := apiObjectFrom(item)
+	for _, res := range apiObj.Res {
+		offered := apiOfferedResource{apiResource: res}
+		if len(sink) != 0 {
+			accepted := sink.accepts(res.ProtocolInfo)
+			offered.Accepted = &accepted
+		}
+		ret.Resources = append(ret.Resources, offered)
+	}
+	return
+}
+
+// Returns what the kinds of client that are treated differently are offered of the item: clients
+// matched by audio profiles or LPCMUserAgents, and renderers that have announced what they accept.
+func (me *contentDirectoryService) itemOffers(obj object, item upnpav.Item, host string, mt mimeType) (ret []apiItemOffer) {
+	ret = append(ret, makeAPIItemOffer(item, nil))
+	s := me.settings()
+	audioProfiles, lpcmUserAgents := s.AudioProfiles, s.LPCMUserAgents
+	// The offer for a User-Agent substring is the one made to a client whose User-Agent is just
+	// that, which an earlier audio profile may match.
+	userAgentOffer := func(userAgent string, sink rendererSink) {
+		if userAgent == "*" {
+			userAgent = ""
+		}
+		uaItem := item
+		if ret, err := me.objectMetadata(obj, host, userAgent); err == nil {
+			if i, ok := ret.(upnpav.Item); ok {
+				uaItem = i
+			}
+		}
+		offer := makeAPIItemOffer(uaItem, sink)
+		offer.UserAgent = userAgent
+		ret = append(ret, offer)
+	}
+	if mt.IsAudio() {
+		for _, p := range audioProfiles {
+			for _, ua := range p.UserAgents {
+				userAgentOffer(ua, nil)
+			}
+		}
+	}
+	for _, ua := range lpcmUserAgents {
+		userAgentOffer(ua, lpcmRendererSink)
+	}
+	sinks := me.renderers.sinks()
+	ips := make([]string, 0, len(sinks))
+	for ip := range sinks {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		offer := makeAPIItemOffer(item, sinks[ip])
+		offer.Renderer = ip
+		ret = append(ret, offer)
+	}
+	return
+}
+
+// Serves everything known about the media file with the ID at the end of the path: its metadata,
+// ffprobe's streams, and the resources each kind of client is offered.
+func (me *Server) serveAPIItemDetail(w http.ResponseWriter, r *http.Request) {
+	// File paths and what's offered to whom are for administrators.
+	if !me.authorizeAPI(w, r, APIScopeAdmin) {
+		return
+	}
+	cds := me.apiContentDirectory()
+	obj, err := me.apiPathObject(r, apiItemsPath)
+	if err != nil {
+		me.writeAPIError(w, r, err)
+		return
+	}
+	host := me.dlnaHost(r)
+	ret, err := cds.objectMetadata(obj, host, "")
+	if err != nil {
+		me.writeAPIError(w, r, err)
+		return
+	}
+	item, ok := ret.(upnpav.Item)
+	// Items listed elsewhere too, such as in Recently Played, refer to their file's item.
+	if ok && item.RefID != "" {
+		if obj, err = cds.objectFromID(item.RefID); err == nil {
+			ret, err = cds.objectMetadata(obj, host, "")
+			item, ok = ret.(upnpav.Item)
+		}
+	}
+	if !ok || err != nil {
+		me.writeAPIError(w, r, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "%q isn't a media file", obj.Path))
+		return
+	}
+	filePath := obj.FilePath()
+	fi, indexed := os.FileInfo(nil), false
+	if me.index != nil {
+		fi, indexed = me.index.stat(obj.Path)
+	}
+	if !indexed {
+		fi, err = me.contentFS().Stat(filePath)
+	}
+	mt, mtErr := mimeTypeInFS(me.contentFS(), filePath)
+	if err != nil || mtErr != nil || !fi.Mode().IsRegular() {
+		me.writeAPIError(w, r, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "%q isn't a media file", obj.Path))
+		return
+	}
+	apiObj, _ := apiObjectFrom(me.externalURLs(item, r.UserAgent()))
+	// The resources are given with the offers.
+	apiObj.Res = nil
+	detail := apiItemDetail{
+		apiObject: apiObj,
+		File:      filePath,
+		Size:      fi.Size(),
+		ModTime:   fi.ModTime(),
+		MimeType:  string(mt),
+		Metadata:  me.fileMetadata(filePath, fi, mt),
+	}
+	if !me.settings().NoProbe {
+		info, err := me.ffmpegProbe(filePath)
+		if info != nil {
+			detail.Format, detail.Streams = info.Format, info.Streams
+		}
+		if err != nil && err != ffprobe.ExeNotFound {
+			detail.ProbeError = err.Error()
+		}
+	}
+	detail.Offers = cds.itemOffers(obj, item, host, mt)
+	for i := range detail.Offers {
+		for j := range detail.Offers[i].Resources {
+			res := &detail.Offers[i].Resources[j]
+			res.URL = me.externalURL(res.URL, r.UserAgent())
+		}
+	}
+	me.writeAPIResponse(w, r, detail)
+}
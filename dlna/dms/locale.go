@@ -0,0 +1,124 @@
+package dms
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The titles dms gives what it generates, such as the recent containers, and the marks it adds to
+// titles, in English.
+var generatedTitles = []string{
+	recentlyAddedTitle,
+	recentlyPlayedTitle,
+	"Videos",
+	"Music",
+	"Photos",
+	placesTitle,
+	remoteStreamsTitle,
+	showsTitle,
+	seasonTitle,
+	specialsTitle,
+	watchedTitle,
+	unwatchedTitle,
+	incompleteMark,
+	unplayableMark,
+}
+
+// The generated titles in the languages dms has them in, in the order of generatedTitles.
+var generatedTitleTranslations = map[language.Tag][]string{
+	language.German:             {"Neu hinzugefügt", "Zuletzt gespielt", "Videos", "Musik", "Fotos", "Orte", "Streams", "Serien", "Staffel", "Specials", "Gesehen", "Nicht gesehen", "unvollständig", "nicht abspielbar"},
+	language.Spanish:            {"Añadido recientemente", "Reproducido recientemente", "Vídeos", "Música", "Fotos", "Lugares", "Emisiones", "Series", "Temporada", "Especiales", "Vistos", "No vistos", "incompleto", "no reproducible"},
+	language.French:             {"Ajouts récents", "Lus récemment", "Vidéos", "Musique", "Photos", "Lieux", "Flux", "Séries", "Saison", "Épisodes spéciaux", "Vus", "Non vus", "incomplet", "illisible"},
+	language.Italian:            {"Aggiunti di recente", "Riprodotti di recente", "Video", "Musica", "Foto", "Luoghi", "Stream", "Serie TV", "Stagione", "Speciali", "Visti", "Non visti", "incompleto", "non riproducibile"},
+	language.Dutch:              {"Recent toegevoegd", "Recent afgespeeld", "Video's", "Muziek", "Foto's", "Plaatsen", "Streams", "Series", "Seizoen", "Specials", "Bekeken", "Niet bekeken", "onvolledig", "niet afspeelbaar"},
+	language.Portuguese:         {"Adicionados recentemente", "Reproduzidos recentemente", "Vídeos", "Música", "Fotos", "Locais", "Transmissões", "Séries", "Temporada", "Especiais", "Assistidos", "Não assistidos", "incompleto", "não reproduzível"},
+	language.Swedish:            {"Nyligen tillagda", "Nyligen spelade", "Videor", "Musik", "Foton", "Platser", "Strömmar", "TV-serier", "Säsong", "Specialavsnitt", "Sedda", "Osedda", "ofullständig", "ospelbar"},
+	language.Japanese:           {"最近追加した項目", "最近再生した項目", "ビデオ", "ミュージック", "写真", "撮影地", "ストリーム", "テレビ番組", "シーズン", "スペシャル", "視聴済み", "未視聴", "不完全", "再生不可"},
+	language.SimplifiedChinese:  {"最近添加", "最近播放", "视频", "音乐", "照片", "地点", "流媒体", "电视剧", "季", "特别篇", "已观看", "未观看", "不完整", "无法播放"},
+	language.TraditionalChinese: {"最近新增", "最近播放", "影片", "音樂", "照片", "地點", "串流", "電視劇", "季", "特別篇", "已觀看", "未觀看", "不完整", "無法播放"},
+	language.Korean:             {"최근 추가됨", "최근 재생됨", "동영상", "음악", "사진", "장소", "스트림", "TV 프로그램", "시즌", "스페셜", "시청함", "시청 안 함", "불완전", "재생 불가"},
+	language.Polish:             {"Ostatnio dodane", "Ostatnio odtwarzane", "Filmy", "Muzyka", "Zdjęcia", "Miejsca", "Strumienie", "Seriale", "Sezon", "Odcinki specjalne", "Obejrzane", "Nieobejrzane", "niekompletny", "nieodtwarzalny"},
+}
+
+// Matches a Locale to the language of the generated titles that suits it, English if none does.
+var generatedTitleMatcher, generatedTitleLanguages = func() (language.Matcher, []language.Tag) {
+	tags := []language.Tag{language.English}
+	for tag := range generatedTitleTranslations {
+		tags = append(tags, tag)
+	}
+	return language.NewMatcher(tags), tags
+}()
+
+// Parses the Locale, and works out the generated titles in it.
+func (srv *Server) initLocale() error {
+	srv.localeTag = language.Und
+	if srv.Locale != "" {
+		tag, err := language.Parse(srv.Locale)
+		if err != nil {
+			return fmt.Errorf("bad locale %q: %w", srv.Locale, err)
+		}
+		srv.localeTag = tag
+	}
+	srv.localeTitles = make(map[string]string, len(generatedTitles))
+	_, i, confidence := generatedTitleMatcher.Match(srv.localeTag)
+	if translations, ok := generatedTitleTranslations[generatedTitleLanguages[i]]; ok && confidence >= language.High {
+		for j, t := range generatedTitles {
+			srv.localeTitles[t] = translations[j]
+		}
+	}
+	for k, v := range srv.GeneratedTitles {
+		if !isGeneratedTitle(k) {
+			return fmt.Errorf("unknown generated title %q", k)
+		}
+		srv.localeTitles[k] = v
+	}
+	return nil
+}
+
+func isGeneratedTitle(s string) bool {
+	for _, t := range generatedTitles {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns one of the generatedTitles in the Locale.
+func (srv *Server) localTitle(title string) string {
+	if t, ok := srv.settings().localeTitles[title]; ok {
+		return t
+	}
+	return title
+}
+
+// Returns a collator that orders names as people who speak the Locale expect, ignoring case, and
+// otherwise by the Unicode default, which puts accented letters with their base letters and orders
+// CJK by script. Collators can't be shared between goroutines, so each sort makes its own.
+func (srv *Server) collator() *collate.Collator {
+	return collate.New(srv.settings().localeTag, collate.IgnoreCase)
+}
+
+// Returns the collation keys of the strings, which are normalized to NFC first, so that names from
+// file systems that decompose accents, such as macOS's, sort with those that don't.
+func collationKeys(c *collate.Collator, ss []string) [][]byte {
+	var buf collate.Buffer
+	ret := make([][]byte, len(ss))
+	for i, s := range ss {
+		ret[i] = c.KeyFromString(&buf, norm.NFC.String(s))
+	}
+	return ret
+}
+
+// Compares strings by their collation keys, and by their bytes where they collate the same, such
+// as when they differ only in case, so that they're always in the same order.
+func collatedLess(keyA, keyB []byte, a, b string) bool {
+	if c := bytes.Compare(keyA, keyB); c != 0 {
+		return c < 0
+	}
+	return a < b
+}
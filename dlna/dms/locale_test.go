@@ -0,0 +1,63 @@
+package dms
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLocalTitle(t *testing.T) {
+	for locale, want := range map[string]string{
+		"":      recentlyAddedTitle,
+		"de-AT": "Neu hinzugefügt",
+		"pt-BR": "Adicionados recentemente",
+		"ja":    "最近追加した項目",
+		"fi":    recentlyAddedTitle,
+	} {
+		srv := &Server{Locale: locale}
+		if err := srv.initLocale(); err != nil {
+			t.Fatal(err)
+		}
+		if got := srv.localTitle(recentlyAddedTitle); got != want {
+			t.Errorf("%q: got %q", locale, got)
+		}
+	}
+	srv := &Server{Locale: "de", GeneratedTitles: map[string]string{"Music": "Lieder"}}
+	if err := srv.initLocale(); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.localTitle("Music"); got != "Lieder" {
+		t.Errorf("got %q", got)
+	}
+	for _, bad := range []*Server{
+		{Locale: "not a locale"},
+		{GeneratedTitles: map[string]string{"Movies": "Films"}},
+	} {
+		if bad.initLocale() == nil {
+			t.Errorf("%q %q: no error", bad.Locale, bad.GeneratedTitles)
+		}
+	}
+}
+
+func TestCollatedFileInfoSlice(t *testing.T) {
+	srv := &Server{}
+	if err := srv.initLocale(); err != nil {
+		t.Fatal(err)
+	}
+	// "Été" decomposed, as macOS names files.
+	names := []string{"zebra.mkv", "E\u0301te\u0301.mkv", "Eagle.mkv", "été.mkv", "ezra.mkv", "Émile.mkv", "東京.mkv", "apple.mkv"}
+	var fis []os.FileInfo
+	for _, n := range names {
+		fis = append(fis, indexFileInfo{&indexEntry{Name: n}})
+	}
+	sort.Sort(collatedFileInfoSlice(fis, srv.collator()))
+	var got []string
+	for _, fi := range fis {
+		got = append(got, fi.Name())
+	}
+	want := []string{"apple.mkv", "Eagle.mkv", "Émile.mkv", "E\u0301te\u0301.mkv", "été.mkv", "ezra.mkv", "zebra.mkv", "東京.mkv"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,76 @@
+package dms
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/anacrolix/log"
+)
+
+const mediaServerDeviceTypePrefix = "urn:schemas-upnp-org:device:MediaServer:"
+
+// Other media servers that have announced themselves from this host, such as MiniDLNA or Plex,
+// by UUID, so that each is only warned about once.
+type localServers struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// Whether the IP is one of this host's.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handles SSDP announcements from other devices.
+func (srv *Server) deviceAnnounced(req *http.Request, sender *net.UDPAddr) {
+	srv.deviceAnnouncedPresence(req, sender)
+	srv.rendererAnnounced(req, sender)
+	srv.mediaServerAnnounced(req, sender)
+}
+
+// Warns about other media servers running on this host. They can be discovered alongside this
+// one, but if one of them doesn't share the SSDP port, control points may only find some of them.
+func (srv *Server) mediaServerAnnounced(req *http.Request, sender *net.UDPAddr) {
+	if !strings.HasPrefix(req.Header.Get("nt"), mediaServerDeviceTypePrefix) || req.Header.Get("nts") == "ssdp:byebye" {
+		return
+	}
+	// Such as "uuid:4d696e69-444c-164e-9d41-b827eb000000::urn:schemas-upnp-org:device:MediaServer:1".
+	uuid, _, _ := strings.Cut(req.Header.Get("usn"), "::")
+	if uuid == "" || uuid == srv.rootDeviceUUID || !isLocalIP(sender.IP) {
+		return
+	}
+	me := &srv.localServers
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.seen[uuid] {
+		return
+	}
+	if me.seen == nil {
+		me.seen = make(map[string]bool)
+	}
+	me.seen[uuid] = true
+	srv.Logger.Levelf(log.Warning, "another media server is running on this host (%q at %s). "+
+		"Both are discoverable as long as it shares the SSDP port, 1900, and they serve HTTP on different ports",
+		req.Header.Get("server"), req.Header.Get("location"))
+}
+
+// Whether listening for SSDP failed because another program has the port and doesn't share it.
+func ssdpPortInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
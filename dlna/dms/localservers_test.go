@@ -0,0 +1,29 @@
+package dms
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/anacrolix/log"
+)
+
+func TestMediaServerAnnounced(t *testing.T) {
+	srv := &Server{Logger: log.Default, rootDeviceUUID: "uuid:11111111-0000-0000-0000-000000000000"}
+	announce := func(usn string, ip net.IP) {
+		srv.mediaServerAnnounced(&http.Request{Header: http.Header{
+			"Nt":  {"urn:schemas-upnp-org:device:MediaServer:1"},
+			"Nts": {"ssdp:alive"},
+			"Usn": {usn + "::urn:schemas-upnp-org:device:MediaServer:1"},
+		}}, &net.UDPAddr{IP: ip})
+	}
+	announce(srv.rootDeviceUUID, net.IPv4(127, 0, 0, 1))
+	announce("uuid:22222222-0000-0000-0000-000000000000", net.IPv4(203, 0, 113, 9))
+	if len(srv.localServers.seen) != 0 {
+		t.Errorf("warned about %v", srv.localServers.seen)
+	}
+	announce("uuid:33333333-0000-0000-0000-000000000000", net.IPv4(127, 0, 0, 1))
+	if !srv.localServers.seen["uuid:33333333-0000-0000-0000-000000000000"] {
+		t.Error("didn't warn about another server on the host")
+	}
+}
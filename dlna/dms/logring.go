@@ -0,0 +1,118 @@
+package dms
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// Number of log entries kept in memory for the web UI.
+const logRingSize = 2000
+
+// Added to the values of messages logged while handling a request, so the entries for a particular
+// client can be picked out later.
+type clientLogTag struct {
+	IP      string
+	Session string
+}
+
+type logEntry struct {
+	Time  time.Time
+	Level log.Level
+	// The logger names, such as "dms server ssdp eth0", without the source location.
+	Subsystem string
+	Text      string
+	clientLogTag
+}
+
+// A log.Handler that keeps the most recent records in memory so they can be browsed from the web
+// UI without shell access to the host.
+type logRing struct {
+	mu      sync.Mutex
+	entries []logEntry
+	// Index in entries that the next record is written to.
+	next int
+	full bool
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{
+		entries: make([]logEntry, size),
+	}
+}
+
+func (me *logRing) Handle(r log.Record) {
+	e := logEntry{
+		Time:  time.Now(),
+		Level: r.Level,
+		Text:  r.Text(),
+	}
+	// The last two names are the package and file:line of the call site.
+	if n := len(r.Names) - 2; n > 0 {
+		e.Subsystem = strings.Join(r.Names[:n], " ")
+	}
+	r.Values(func(v interface{}) bool {
+		tag, ok := v.(clientLogTag)
+		if ok {
+			e.clientLogTag = tag
+		}
+		return !ok
+	})
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.entries[me.next] = e
+	me.next++
+	if me.next == len(me.entries) {
+		me.next = 0
+		me.full = true
+	}
+}
+
+// Returns the buffered entries for which filter returns true, oldest first.
+func (me *logRing) Entries(filter func(*logEntry) bool) (ret []logEntry) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	appendMatching := func(es []logEntry) {
+		for i := range es {
+			if filter(&es[i]) {
+				ret = append(ret, es[i])
+			}
+		}
+	}
+	if me.full {
+		appendMatching(me.entries[me.next:])
+	}
+	appendMatching(me.entries[:me.next])
+	return
+}
+
+// Serves the buffered log entries, filtered by the optional ip, session, subsystem and level
+// query parameters.
+func (me *Server) serveLog(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	minLevel := log.NotSet
+	if s := q.Get("level"); s != "" {
+		if err := minLevel.UnmarshalText([]byte(s)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ip, session, subsystem := q.Get("ip"), q.Get("session"), q.Get("subsystem")
+	entries := me.logs.Entries(func(e *logEntry) bool {
+		return (ip == "" || e.IP == ip) &&
+			(session == "" || e.Session == session) &&
+			strings.Contains(e.Subsystem, subsystem) &&
+			!e.Level.LessThan(minLevel)
+	})
+	w.Header().Set("content-type", "text/html")
+	err := logTmpl.Execute(w, struct {
+		IP, Session, Subsystem, Level string
+		Entries                       []logEntry
+	}{ip, session, subsystem, q.Get("level"), entries})
+	if err != nil {
+		me.Logger.Print(err)
+	}
+}
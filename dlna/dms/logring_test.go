@@ -0,0 +1,31 @@
+package dms
+
+import (
+	"testing"
+
+	"github.com/anacrolix/log"
+)
+
+func TestLogRingWrapsAndFilters(t *testing.T) {
+	ring := newLogRing(3)
+	logger := log.Default.WithNames("test")
+	logger.SetHandlers(ring)
+	tagged := logger.WithMap(func(m log.Msg) log.Msg {
+		return m.WithValues(clientLogTag{IP: "10.0.0.2", Session: "abcd"})
+	})
+	logger.Print("a")
+	tagged.Print("b")
+	logger.Print("c")
+	tagged.Print("d")
+	all := ring.Entries(func(*logEntry) bool { return true })
+	if len(all) != 3 || all[0].Text != "b" || all[2].Text != "d" {
+		t.Fatalf("unexpected entries %+v", all)
+	}
+	if all[0].Subsystem != "test" {
+		t.Fatalf("unexpected subsystem %q", all[0].Subsystem)
+	}
+	session := ring.Entries(func(e *logEntry) bool { return e.Session == "abcd" })
+	if len(session) != 2 || session[1].IP != "10.0.0.2" {
+		t.Fatalf("unexpected session entries %+v", session)
+	}
+}
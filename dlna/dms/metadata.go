@@ -0,0 +1,633 @@
+package dms
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/ffprobe"
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/dlna"
+)
+
+// What's known about a media file beyond its file info. Zero fields are unknown.
+type Metadata struct {
+	Title       string
+	Artist      string
+	Album       string
+	Genre       string
+	Description string
+	Date        time.Time
+	Duration    time.Duration
+	Bitrate     uint
+	// Dimensions of the video, such as "1920x1080".
+	Resolution string
+	Chapters   []Chapter `json:",omitempty"`
+	// The DLNA.ORG_PN for the file's format, such as "AVC_MP4_MP_SD_AAC_MULT5".
+	DLNAProfile string `json:",omitempty"`
+	// Of the first audio stream, which decide what it's transcoded to for speakers.
+	SampleRate    int `json:",omitempty"`
+	AudioChannels int `json:",omitempty"`
+	// As ffprobe names it, such as "aac" or "alac", which share a MIME type.
+	AudioCodec string `json:",omitempty"`
+	// The EXIF orientation of photos, from 1, upright, to 8.
+	Orientation int `json:",omitempty"`
+	// Where photos were taken, in degrees north and east.
+	Latitude, Longitude float64 `json:",omitempty"`
+	// The show an episode is of, and its numbers in it.
+	Series          string `json:",omitempty"`
+	Season, Episode int    `json:",omitempty"`
+	// A picture of the media, such as a film's poster, as a path in the local filesystem or an
+	// HTTP URL.
+	Artwork string `json:",omitempty"`
+	// Why the file can't be played, such as that it's empty or truncated. It's found by identify
+	// rather than the providers.
+	Problem string `json:",omitempty"`
+}
+
+// A chapter of a media file.
+type Chapter struct {
+	Title      string
+	Start, End time.Duration
+}
+
+// Sets the fields of me that are unknown to those of other.
+func (me *Metadata) fill(other *Metadata) {
+	fillString := func(s *string, o string) {
+		if *s == "" {
+			*s = o
+		}
+	}
+	fillString(&me.Title, other.Title)
+	fillString(&me.Artist, other.Artist)
+	fillString(&me.Album, other.Album)
+	fillString(&me.Genre, other.Genre)
+	fillString(&me.Description, other.Description)
+	fillString(&me.Resolution, other.Resolution)
+	fillString(&me.DLNAProfile, other.DLNAProfile)
+	if me.Date.IsZero() {
+		me.Date = other.Date
+	}
+	if me.Duration == 0 {
+		me.Duration = other.Duration
+	}
+	if me.Bitrate == 0 {
+		me.Bitrate = other.Bitrate
+	}
+	if len(me.Chapters) == 0 {
+		me.Chapters = other.Chapters
+	}
+	if me.SampleRate == 0 {
+		me.SampleRate = other.SampleRate
+		me.AudioChannels = other.AudioChannels
+	}
+	if me.AudioCodec == "" {
+		me.AudioCodec = other.AudioCodec
+	}
+	if me.Orientation == 0 {
+		me.Orientation = other.Orientation
+	}
+	if me.Latitude == 0 && me.Longitude == 0 {
+		me.Latitude, me.Longitude = other.Latitude, other.Longitude
+	}
+	fillString(&me.Series, other.Series)
+	if me.Season == 0 && me.Episode == 0 {
+		me.Season, me.Episode = other.Season, other.Episode
+	}
+	fillString(&me.Artwork, other.Artwork)
+}
+
+// Whether the photo's location is known.
+func (me *Metadata) hasLocation() bool {
+	return me.Latitude != 0 || me.Longitude != 0
+}
+
+// A media file being identified by MetadataProviders.
+type MediaFile struct {
+	// The file's location in the local filesystem.
+	Path string
+	os.FileInfo
+	// Such as "video/mp4".
+	MimeType string
+
+	srv        *Server
+	probed     bool
+	probeInfo  *ffprobe.Info
+	probeError error
+}
+
+// Returns ffprobe's results for the file, probing it at most once for all the providers. Returns
+// nil info with nil error if probing is disabled or ffprobe isn't installed.
+func (me *MediaFile) Probe() (*ffprobe.Info, error) {
+	if me.srv.settings().NoProbe {
+		return nil, nil
+	}
+	if !me.probed {
+		me.probeInfo, me.probeError = me.srv.ffmpegProbe(me.Path)
+		if me.probeError == ffprobe.ExeNotFound {
+			me.probeError = nil
+		}
+		me.probed = true
+	}
+	return me.probeInfo, me.probeError
+}
+
+// Identifies media files, such as from tags embedded in them, files alongside them, or online
+// databases.
+type MetadataProvider interface {
+	// Returns what the provider knows about the file, or nil if it has nothing.
+	Identify(f *MediaFile) (*Metadata, error)
+}
+
+type namedMetadataProvider struct {
+	name string
+	MetadataProvider
+}
+
+var metadataProviders struct {
+	mu  sync.RWMutex
+	all []namedMetadataProvider
+}
+
+// Makes a metadata provider available under the given name, typically from an init function.
+// Unless Server.MetadataProviders says otherwise, all registered providers are used, and ones
+// registered later take precedence over earlier ones for each field of Metadata. The built-in
+// providers are registered first, so that they're the fallback.
+func RegisterMetadataProvider(name string, p MetadataProvider) {
+	metadataProviders.mu.Lock()
+	defer metadataProviders.mu.Unlock()
+	for _, np := range metadataProviders.all {
+		if np.name == name {
+			panic(fmt.Sprintf("metadata provider %q registered twice", name))
+		}
+	}
+	metadataProviders.all = append(metadataProviders.all, namedMetadataProvider{name, p})
+}
+
+// Removes the metadata provider registered under the name, such as one a test registered.
+func unregisterMetadataProvider(name string) {
+	metadataProviders.mu.Lock()
+	defer metadataProviders.mu.Unlock()
+	for i, np := range metadataProviders.all {
+		if np.name == name {
+			metadataProviders.all = append(metadataProviders.all[:i:i], metadataProviders.all[i+1:]...)
+			return
+		}
+	}
+}
+
+// Returns the names of the registered metadata providers, in order of precedence.
+func MetadataProviderNames() (names []string) {
+	metadataProviders.mu.RLock()
+	defer metadataProviders.mu.RUnlock()
+	for i := len(metadataProviders.all) - 1; i >= 0; i-- {
+		names = append(names, metadataProviders.all[i].name)
+	}
+	return
+}
+
+func lookupMetadataProvider(name string) (MetadataProvider, bool) {
+	metadataProviders.mu.RLock()
+	defer metadataProviders.mu.RUnlock()
+	for _, np := range metadataProviders.all {
+		if np.name == name {
+			return np.MetadataProvider, true
+		}
+	}
+	return nil, false
+}
+
+func init() {
+	RegisterMetadataProvider("ffprobe", ffprobeMetadataProvider{})
+	RegisterMetadataProvider("exif", exifMetadataProvider{})
+	RegisterMetadataProvider("tags", tagsMetadataProvider{})
+	RegisterMetadataProvider("chapters", chaptersMetadataProvider{})
+	RegisterMetadataProvider("nfo", nfoMetadataProvider{})
+}
+
+func (srv *Server) initMetadataProviders() error {
+	for _, name := range srv.MetadataProviders {
+		if _, ok := lookupMetadataProvider(name); !ok {
+			return fmt.Errorf("unknown metadata provider %q, have %q", name, MetadataProviderNames())
+		}
+	}
+	return nil
+}
+
+// Returns the metadata providers to use, in order of precedence.
+func (srv *Server) metadataProviders() (ret []namedMetadataProvider) {
+	names := srv.settings().MetadataProviders
+	if names == nil {
+		names = MetadataProviderNames()
+	}
+	for _, name := range names {
+		if p, ok := lookupMetadataProvider(name); ok {
+			ret = append(ret, namedMetadataProvider{name, p})
+		}
+	}
+	return
+}
+
+// Asks the metadata providers about the media file at path.
+func (srv *Server) identify(path string, fi os.FileInfo, mt mimeType) *Metadata {
+	f := &MediaFile{
+		Path:     path,
+		FileInfo: fi,
+		MimeType: mt.String(),
+		srv:      srv,
+	}
+	md := &Metadata{}
+	for _, p := range srv.metadataProviders() {
+		pmd, err := p.Identify(f)
+		if err != nil {
+			// Probing the file fails the same way for each provider, and it's given as its problem.
+			if !f.probed || err != f.probeError {
+				srv.Logger.Printf("error identifying %s with %s: %s", path, p.name, err)
+			}
+			continue
+		}
+		if pmd != nil {
+			md.fill(pmd)
+		}
+	}
+	md.Problem = mediaProblem(f)
+	srv.problems.note(path, md)
+	return md
+}
+
+// Returns the metadata for a media file from the index if it was listed from there, and otherwise
+// from the metadata providers.
+func (srv *Server) fileMetadata(path string, fi os.FileInfo, mt mimeType) *Metadata {
+	if e, ok := fi.Sys().(*indexEntry); ok && e.Metadata != nil {
+		return e.Metadata
+	}
+	return srv.identify(path, fi, mt)
+}
+
+// Provides the duration, bitrate, resolution and DLNA profile from ffprobe.
+type ffprobeMetadataProvider struct{}
+
+func (ffprobeMetadataProvider) Identify(f *MediaFile) (*Metadata, error) {
+	info, err := f.Probe()
+	if info == nil {
+		return nil, err
+	}
+	md := &Metadata{}
+	md.Bitrate, _ = info.Bitrate()
+	md.Duration, _ = info.Duration()
+	for _, strm := range info.Streams {
+		if strm["codec_type"] != "video" {
+			continue
+		}
+		md.Resolution = fmt.Sprintf("%.0fx%.0f", strm["width"], strm["height"])
+		break
+	}
+	mi := probeMediaInfo(info)
+	md.DLNAProfile = dlna.ProfileName(mi)
+	md.SampleRate, md.AudioChannels, md.AudioCodec = mi.SampleRate, mi.AudioChannels, mi.AudioCodec
+	return md, nil
+}
+
+// Returns the first video and audio streams' properties, that the DLNA profile depends on.
+func probeMediaInfo(info *ffprobe.Info) (mi dlna.MediaInfo) {
+	mi.Format, _ = info.Format["format_name"].(string)
+	for _, strm := range info.Streams {
+		codec, _ := strm["codec_name"].(string)
+		switch strm["codec_type"] {
+		case "video":
+			if mi.VideoCodec != "" {
+				continue
+			}
+			// Cover art in audio files is an attached picture, not video.
+			if disp, ok := strm["disposition"].(map[string]interface{}); ok && disp["attached_pic"] == 1.0 {
+				continue
+			}
+			mi.VideoCodec = codec
+			mi.VideoProfile, _ = strm["profile"].(string)
+			width, _ := strm["width"].(float64)
+			height, _ := strm["height"].(float64)
+			mi.Width, mi.Height = int(width), int(height)
+		case "audio":
+			if mi.AudioCodec != "" {
+				continue
+			}
+			mi.AudioCodec = codec
+			channels, _ := strm["channels"].(float64)
+			mi.AudioChannels = int(channels)
+			// ffprobe reports the sample rate as a string.
+			sampleRate, _ := strm["sample_rate"].(string)
+			mi.SampleRate, _ = strconv.Atoi(sampleRate)
+		}
+	}
+	return
+}
+
+// Provides the title, artist, album and so on from the tags in the file's container, as reported
+// by ffprobe.
+type tagsMetadataProvider struct{}
+
+func (tagsMetadataProvider) Identify(f *MediaFile) (*Metadata, error) {
+	info, err := f.Probe()
+	if info == nil {
+		return nil, err
+	}
+	rawTags, _ := info.Format["tags"].(map[string]interface{})
+	if len(rawTags) == 0 {
+		return nil, nil
+	}
+	// Tag names are in whatever case the container uses.
+	tags := make(map[string]string, len(rawTags))
+	for k, v := range rawTags {
+		if s, ok := v.(string); ok {
+			tags[strings.ToLower(k)] = strings.TrimSpace(s)
+		}
+	}
+	md := &Metadata{
+		Title:       tags["title"],
+		Artist:      tags["artist"],
+		Album:       tags["album"],
+		Genre:       tags["genre"],
+		Description: tags["comment"],
+	}
+	if md.Artist == "" {
+		md.Artist = tags["album_artist"]
+	}
+	md.Date = parseMetadataDate(tags["date"])
+	return md, nil
+}
+
+// Provides the date JPEG photos were taken, their dimensions, orientation and location, from EXIF.
+type exifMetadataProvider struct{}
+
+func (exifMetadataProvider) Identify(f *MediaFile) (*Metadata, error) {
+	if f.MimeType != "image/jpeg" {
+		return nil, nil
+	}
+	info, err := readJPEGInfo(f.srv.contentFS(), f.Path)
+	if err != nil {
+		return nil, err
+	}
+	md := &Metadata{
+		Date:        info.Taken,
+		Orientation: info.Orientation,
+	}
+	if info.Width > 0 && info.Height > 0 {
+		md.Resolution = fmt.Sprintf("%dx%d", info.Width, info.Height)
+	}
+	if info.HasGPS {
+		md.Latitude, md.Longitude = info.Latitude, info.Longitude
+	}
+	return md, nil
+}
+
+// Provides the chapters of audiobooks, so they can be browsed chapter by chapter.
+type chaptersMetadataProvider struct{}
+
+func (chaptersMetadataProvider) Identify(f *MediaFile) (*Metadata, error) {
+	if f.srv.settings().NoProbe || !mimeType(f.MimeType).IsAudio() {
+		return nil, nil
+	}
+	// Chapters need a separate probe, so it's only worth it for books.
+	if !strings.EqualFold(filepath.Ext(f.Path), ".m4b") {
+		info, err := f.Probe()
+		if info == nil {
+			return nil, err
+		}
+		md, err := tagsMetadataProvider{}.Identify(f)
+		if md == nil || !isAudiobookGenre(md.Genre) {
+			return nil, err
+		}
+	}
+	chapters, err := f.srv.probeChapters(f.Path, f.FileInfo)
+	if chapters == nil {
+		return nil, err
+	}
+	return &Metadata{Chapters: chapters}, nil
+}
+
+// Returns the chapters ffprobe finds in the file, from those found before in this version of it
+// if there are any. Returns nil chapters with nil error if ffprobe isn't installed. Failures
+// aren't kept, as ffmpegProbe's aren't.
+func (srv *Server) probeChapters(path string, fi os.FileInfo) ([]Chapter, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	key := ffmpegInfoCacheKey{absPath, fi.ModTime().UnixNano(), fi.Size()}
+	if chapters, ok := srv.probedChapters.Load(key); ok {
+		srv.metrics.cacheLookup("chapters", true)
+		return chapters.([]Chapter), nil
+	}
+	srv.metrics.cacheLookup("chapters", false)
+	out, err := exec.Command("ffprobe", "-v", "error", "-show_chapters", "-of", "json", absPath).Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	chapters, err := parseProbedChapters(out)
+	if err != nil {
+		return nil, err
+	}
+	srv.probedChapters.Store(key, chapters)
+	return chapters, nil
+}
+
+// Parses the output of ffprobe -show_chapters -of json. Files without chapters have an empty
+// list, rather than nil.
+func parseProbedChapters(out []byte) ([]Chapter, error) {
+	var probed struct {
+		Chapters []struct {
+			StartTime string            `json:"start_time"`
+			EndTime   string            `json:"end_time"`
+			Tags      map[string]string `json:"tags"`
+		}
+	}
+	if err := json.Unmarshal(out, &probed); err != nil {
+		return nil, err
+	}
+	ret := make([]Chapter, 0, len(probed.Chapters))
+	for _, c := range probed.Chapters {
+		start, err := strconv.ParseFloat(c.StartTime, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing chapter start: %w", err)
+		}
+		end, err := strconv.ParseFloat(c.EndTime, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing chapter end: %w", err)
+		}
+		ret = append(ret, Chapter{
+			Title: c.Tags["title"],
+			Start: time.Duration(start * float64(time.Second)),
+			End:   time.Duration(end * float64(time.Second)),
+		})
+	}
+	return ret, nil
+}
+
+// Parses the dates found in tags and NFO files, which are often just the year.
+func parseMetadataDate(s string) time.Time {
+	for _, layout := range []string{"2006-01-02", "2006"} {
+		if len(s) >= len(layout) {
+			if t, err := time.Parse(layout, s[:len(layout)]); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// Provides metadata from Kodi style NFO files: the movie, episode or music video's, named after
+// the media file, or movie.nfo alongside a video, and tvshow.nfo in the folder of an episode or
+// the one above it, such as a show's folder of seasons.
+type nfoMetadataProvider struct{}
+
+// What's read from NFO files, whichever of movie, episodedetails, tvshow or musicvideo they are.
+type nfo struct {
+	Title     string   `xml:"title"`
+	ShowTitle string   `xml:"showtitle"`
+	Plot      string   `xml:"plot"`
+	Genres    []string `xml:"genre"`
+	Year      string   `xml:"year"`
+	Premiered string   `xml:"premiered"`
+	Aired     string   `xml:"aired"`
+	Artist    string   `xml:"artist"`
+	Album     string   `xml:"album"`
+	Season    string   `xml:"season"`
+	Episode   string   `xml:"episode"`
+	// Artwork, as URLs or paths relative to the NFO file, such as posters, and fan art.
+	Thumbs       []string `xml:"thumb"`
+	FanartThumbs []string `xml:"fanart>thumb"`
+}
+
+// Reads the NFO file at path, returning nil if there isn't one, or it's not XML, as some are just
+// a link to an online database.
+func readNFO(f *MediaFile, path string) (*nfo, error) {
+	b, err := readFSFile(f.srv.contentFS(), path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var n nfo
+	if err := xml.Unmarshal(b, &n); err != nil {
+		f.srv.Logger.Levelf(log.Debug, "ignoring %q: %v", path, err)
+		return nil, nil
+	}
+	return &n, nil
+}
+
+// Returns the first artwork the NFO file at nfoPath refers to that's an HTTP URL or a file that
+// exists.
+func (n *nfo) artwork(fsys FS, nfoPath string) string {
+	for _, t := range append(n.Thumbs, n.FanartThumbs...) {
+		t = strings.TrimSpace(t)
+		if strings.HasPrefix(t, "http://") || strings.HasPrefix(t, "https://") {
+			return t
+		}
+		if t == "" || strings.Contains(t, "://") {
+			continue
+		}
+		if !filepath.IsAbs(t) {
+			t = filepath.Join(filepath.Dir(nfoPath), filepath.FromSlash(t))
+		}
+		if fi, err := fsys.Stat(t); err == nil && fi.Mode().IsRegular() {
+			return t
+		}
+	}
+	return ""
+}
+
+func (nfoMetadataProvider) Identify(f *MediaFile) (*Metadata, error) {
+	candidates := []string{strings.TrimSuffix(f.Path, filepath.Ext(f.Path)) + ".nfo"}
+	isVideo := mimeType(f.MimeType).IsVideo()
+	if isVideo {
+		candidates = append(candidates, filepath.Join(filepath.Dir(f.Path), "movie.nfo"))
+	}
+	var md *Metadata
+	for _, c := range candidates {
+		n, err := readNFO(f, c)
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			continue
+		}
+		md = &Metadata{
+			Title:       strings.TrimSpace(n.Title),
+			Series:      strings.TrimSpace(n.ShowTitle),
+			Description: strings.TrimSpace(n.Plot),
+			Artist:      strings.TrimSpace(n.Artist),
+			Album:       strings.TrimSpace(n.Album),
+			Artwork:     n.artwork(f.srv.contentFS(), c),
+		}
+		md.Season, _ = strconv.Atoi(strings.TrimSpace(n.Season))
+		md.Episode, _ = strconv.Atoi(strings.TrimSpace(n.Episode))
+		if len(n.Genres) != 0 {
+			md.Genre = strings.TrimSpace(n.Genres[0])
+		}
+		for _, d := range []string{n.Premiered, n.Aired, n.Year} {
+			if md.Date = parseMetadataDate(strings.TrimSpace(d)); !md.Date.IsZero() {
+				break
+			}
+		}
+		break
+	}
+	if !isVideo || md != nil && md.Episode == 0 {
+		return md, nil
+	}
+	// Episodes are in the show's folder, or a folder of its seasons.
+	dir := filepath.Dir(f.Path)
+	for _, c := range []string{filepath.Join(dir, "tvshow.nfo"), filepath.Join(filepath.Dir(dir), "tvshow.nfo")} {
+		show, err := readNFO(f, c)
+		if err != nil {
+			return nil, err
+		}
+		if show == nil {
+			continue
+		}
+		showMD := &Metadata{Series: strings.TrimSpace(show.Title), Artwork: show.artwork(f.srv.contentFS(), c)}
+		if len(show.Genres) != 0 {
+			showMD.Genre = strings.TrimSpace(show.Genres[0])
+		}
+		if md == nil {
+			return showMD, nil
+		}
+		md.fill(showMD)
+		break
+	}
+	return md, nil
+}
+
+// Returns the URL of the artwork from metadata, which is scaled to fit JPEG_MED if it's a file,
+// or "" if there isn't any, or it's a file outside the shared directories.
+func (srv *Server) artworkURL(artwork, host string) string {
+	if artwork == "" || strings.Contains(artwork, "://") {
+		return artwork
+	}
+	o, ok := srv.objectFromFilePath(artwork)
+	if !ok {
+		return ""
+	}
+	return (&url.URL{
+		Scheme: "http",
+		Host:   host,
+		Path:   imagePath,
+		RawQuery: url.Values{
+			"path":    {o.Path},
+			"profile": {"JPEG_MED"},
+		}.Encode(),
+	}).String()
+}
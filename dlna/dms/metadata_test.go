@@ -0,0 +1,134 @@
+package dms
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type staticMetadataProvider Metadata
+
+func (me staticMetadataProvider) Identify(*MediaFile) (*Metadata, error) {
+	md := Metadata(me)
+	return &md, nil
+}
+
+func TestMetadataProviders(t *testing.T) {
+	dir := t.TempDir()
+	video := filepath.Join(dir, "lebowski.mkv")
+	if err := os.WriteFile(video, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := os.WriteFile(filepath.Join(dir, "lebowski.nfo"), []byte(`<?xml version="1.0"?>
+<movie>
+  <title>The Big Lebowski</title>
+  <plot>The Dude abides.</plot>
+  <genre>Comedy</genre>
+  <genre>Crime</genre>
+  <year>1998</year>
+</movie>`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterMetadataProvider("test", staticMetadataProvider{Title: "Lebowski", Artist: "Coen"})
+	// Other tests use all the providers, and would be given its metadata.
+	t.Cleanup(func() { unregisterMetadataProvider("test") })
+	fi, err := os.Stat(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{NoProbe: true}
+	srv.MetadataProviders = []string{"nfo", "test"}
+	md := srv.identify(video, fi, "video/x-matroska")
+	if md.Title != "The Big Lebowski" || md.Artist != "Coen" || md.Genre != "Comedy" ||
+		md.Description != "The Dude abides." || !md.Date.Equal(time.Date(1998, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+	srv.MetadataProviders = []string{"test", "nfo"}
+	if md := srv.identify(video, fi, "video/x-matroska"); md.Title != "Lebowski" || md.Genre != "Comedy" {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+	srv.MetadataProviders = nil
+	if md := srv.identify(video, fi, "video/x-matroska"); md.Title != "Lebowski" {
+		t.Errorf("later registrations should take precedence, got %+v", md)
+	}
+}
+
+func TestNFOEpisode(t *testing.T) {
+	show := t.TempDir()
+	season := filepath.Join(show, "Season 1")
+	for name, content := range map[string]string{
+		"tvshow.nfo": `<tvshow><title>Twin Peaks</title><genre>Mystery</genre><thumb aspect="poster">poster.jpg</thumb></tvshow>`,
+		"poster.jpg": "",
+		"Season 1/Twin.Peaks.S01E02.nfo": `<episodedetails><title>Traces to Nowhere</title><season>1</season><episode>2</episode>` +
+			`<aired>1990-04-12</aired><thumb>http://example.com/s01e02.jpg</thumb></episodedetails>`,
+		"Season 1/Twin.Peaks.S01E02.mkv": "",
+		"Season 1/Twin.Peaks.S01E03.mkv": "",
+	} {
+		p := filepath.Join(show, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{NoProbe: true, MetadataProviders: []string{"nfo"}}
+	identify := func(name string) *Metadata {
+		p := filepath.Join(season, name)
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return srv.identify(p, fi, "video/x-matroska")
+	}
+	md := identify("Twin.Peaks.S01E02.mkv")
+	if md.Title != "Traces to Nowhere" || md.Series != "Twin Peaks" || md.Season != 1 || md.Episode != 2 ||
+		md.Genre != "Mystery" || md.Artwork != "http://example.com/s01e02.jpg" || md.Date.Year() != 1990 {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+	// Episodes without their own NFO file are still of the show.
+	md = identify("Twin.Peaks.S01E03.mkv")
+	if md.Title != "" || md.Series != "Twin Peaks" || md.Artwork != filepath.Join(show, "poster.jpg") {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+}
+
+func TestParseProbedChapters(t *testing.T) {
+	chapters, err := parseProbedChapters([]byte(`{"chapters": [
+		{"start_time": "0.000000", "end_time": "61.500000", "tags": {"title": "Prologue"}},
+		{"start_time": "61.500000", "end_time": "120.000000"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chapters) != 2 || chapters[0].Title != "Prologue" || chapters[1].Start != 61500*time.Millisecond || chapters[1].End != 2*time.Minute {
+		t.Errorf("got %+v", chapters)
+	}
+	if chapters, err := parseProbedChapters([]byte(`{}`)); err != nil || chapters == nil || len(chapters) != 0 {
+		t.Errorf("no chapters gave %v %v", chapters, err)
+	}
+	if _, err := parseProbedChapters([]byte(`{"chapters": [{"start_time": "x", "end_time": "1"}]}`)); err == nil {
+		t.Error("bad start time parsed")
+	}
+}
+
+// Chapters are probed once for each version of a file.
+func TestProbeChaptersCache(t *testing.T) {
+	srv := &Server{}
+	srv.metrics = newServerMetrics(srv)
+	filePath := filepath.Join(t.TempDir(), "Dune.m4b")
+	if err := os.WriteFile(filePath, []byte("book"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Chapter{{Title: "Prologue", End: time.Minute}}
+	srv.probedChapters.Store(ffmpegInfoCacheKey{filePath, fi.ModTime().UnixNano(), fi.Size()}, want)
+	if got, err := srv.probeChapters(filePath, fi); err != nil || len(got) != 1 || got[0] != want[0] {
+		t.Errorf("got %v %v", got, err)
+	}
+}
@@ -0,0 +1,186 @@
+package dms
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/anacrolix/dms/upnp"
+)
+
+const metricsNamespace = "dms"
+
+// Prometheus metrics for monitoring long-running servers. Each Server has its own registry, so
+// that several can run in the same process.
+type serverMetrics struct {
+	registry         *prometheus.Registry
+	ssdpNotifies     *prometheus.CounterVec
+	ssdpSearches     *prometheus.CounterVec
+	soapActions      *prometheus.CounterVec
+	activeStreams    prometheus.Gauge
+	streamedBytes    prometheus.Counter
+	transcodes       *prometheus.CounterVec
+	activeTranscodes prometheus.Gauge
+	cacheLookups     *prometheus.CounterVec
+	resourceErrors   *prometheus.CounterVec
+}
+
+func newServerMetrics(srv *Server) *serverMetrics {
+	me := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		ssdpNotifies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "ssdp_notifies_total",
+			Help:      "SSDP NOTIFY messages sent, by NTS.",
+		}, []string{"nts"}),
+		ssdpSearches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "ssdp_searches_total",
+			Help:      "SSDP M-SEARCH discovery requests received, by whether they were answered.",
+		}, []string{"result"}),
+		soapActions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "soap_actions_total",
+			Help:      "SOAP actions handled, by service, action and result.",
+		}, []string{"service", "action", "result"}),
+		activeStreams: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_streams",
+			Help:      "Media streams currently being served.",
+		}),
+		streamedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "streamed_bytes_total",
+			Help:      "Bytes of media served.",
+		}),
+		transcodes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "transcodes_total",
+			Help:      "Transcode sessions started, by transcode.",
+		}, []string{"transcode"}),
+		activeTranscodes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_transcodes",
+			Help:      "Transcode sessions currently running.",
+		}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_lookups_total",
+			Help:      "Lookups in the ffprobe, chapters, archive, thumbnail, scaled image, browse and transcode caches, by cache and result.",
+		}, []string{"cache", "result"}),
+		resourceErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "resource_errors_total",
+			Help:      "Failed requests for media resources, by cause.",
+		}, []string{"cause"}),
+	}
+	me.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		me.ssdpNotifies,
+		me.ssdpSearches,
+		me.soapActions,
+		me.activeStreams,
+		me.streamedBytes,
+		me.transcodes,
+		me.activeTranscodes,
+		me.cacheLookups,
+		me.resourceErrors,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "gena_subscribers",
+			Help:      "Unexpired GENA event subscriptions across all services.",
+		}, func() float64 {
+			return float64(srv.numEventSubscribers())
+		}),
+	)
+	return me
+}
+
+func (me *serverMetrics) ssdpSearched(answered bool) {
+	if answered {
+		me.ssdpSearches.WithLabelValues("answered").Inc()
+	} else {
+		me.ssdpSearches.WithLabelValues("ignored").Inc()
+	}
+}
+
+func (me *serverMetrics) soapAction(knownService bool, sa upnp.SoapAction, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	if !knownService {
+		// Don't let clients make up label values.
+		sa.Type, sa.Action = "unknown", "unknown"
+	}
+	me.soapActions.WithLabelValues(sa.Type, sa.Action, result).Inc()
+}
+
+func (me *serverMetrics) cacheLookup(cache string, hit bool) {
+	if hit {
+		me.cacheLookups.WithLabelValues(cache, "hit").Inc()
+	} else {
+		me.cacheLookups.WithLabelValues(cache, "miss").Inc()
+	}
+}
+
+// Marks a transcode session as running until the returned func is called.
+func (me *serverMetrics) transcodeStarted(name string) (finished func()) {
+	me.transcodes.WithLabelValues(name).Inc()
+	me.activeTranscodes.Inc()
+	return me.activeTranscodes.Dec
+}
+
+func (me *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(me.registry, promhttp.HandlerOpts{})
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	bytes  prometheus.Counter
+	stream *activeStream
+}
+
+// Returned by writes to streams stopped through the API.
+var errStreamStopped = errors.New("stream stopped")
+
+func (me *countingResponseWriter) Write(b []byte) (n int, err error) {
+	if me.stream.isStopped() {
+		return 0, errStreamStopped
+	}
+	n, err = me.ResponseWriter.Write(b)
+	me.bytes.Add(float64(n))
+	me.stream.bytes.Add(int64(n))
+	return
+}
+
+// Counts files as they're sent, in chunks, while keeping them visible to the ReadFrom of the
+// response writer it wraps, so that they're sent with sendfile.
+func (me *countingResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if me.stream.isStopped() {
+		return 0, errStreamStopped
+	}
+	return copyInChunks(me.ResponseWriter, src, func(n int64) error {
+		me.bytes.Add(float64(n))
+		me.stream.bytes.Add(n)
+		if me.stream.isStopped() {
+			return errStreamStopped
+		}
+		return nil
+	})
+}
+
+// Returns the number of unexpired event subscriptions to the services.
+func (srv *Server) numEventSubscribers() (n int) {
+	for _, s := range srv.services {
+		if c, ok := s.(interface{ NumSubscribers() int }); ok {
+			n += c.NumSubscribers()
+		}
+	}
+	return
+}
@@ -1,24 +1,89 @@
 package dms
 
 import (
+	"bytes"
+	"fmt"
 	"mime"
 	"net/http"
-	"os"
 	"path"
+	"path/filepath"
 	"strings"
 
+	"github.com/anacrolix/ffprobe"
 	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/upnpav"
 )
 
+// The types of media by extension, which are given in place of those of the system's MIME tables,
+// as those differ between systems, and many don't have MKV, FLAC, or RAW photos, or have .ts as
+// something else.
+var mediaMimeTypes = map[string]string{
+	".3g2":  "video/3gpp2",
+	".3gp":  "video/3gpp",
+	".asf":  "video/x-ms-asf",
+	".avi":  "video/avi",
+	".divx": "video/avi",
+	".flv":  "video/x-flv",
+	".m2t":  "video/mp2t",
+	".m2ts": "video/mp2t",
+	".m4v":  "video/mp4",
+	".mk3d": "video/x-matroska",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".mp4":  "video/mp4",
+	".mpe":  "video/mpeg",
+	".mpeg": "video/mpeg",
+	".mpg":  "video/mpeg",
+	".mts":  "video/mp2t",
+	".ogv":  "video/ogg",
+	".rmvb": "application/vnd.rn-realmedia-vbr",
+	".tp":   "video/mp2t",
+	".ts":   "video/mp2t",
+	".vob":  "video/mpeg",
+	".webm": "video/webm",
+	".wmv":  "video/x-ms-wmv",
+
+	".aac":  "audio/aac",
+	".aif":  "audio/aiff",
+	".aiff": "audio/aiff",
+	".ape":  "audio/x-ape",
+	".dff":  "audio/x-dff",
+	".dsf":  "audio/x-dsf",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".m4b":  "audio/mp4",
+	".mka":  "audio/x-matroska",
+	".mp3":  "audio/mpeg",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".wma":  "audio/x-ms-wma",
+	".wv":   "audio/x-wavpack",
+
+	".avif": "image/avif",
+	".bmp":  "image/bmp",
+	".gif":  "image/gif",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".webp": "image/webp",
+}
+
+// Registers the types of media with the mime package too, for extensions of types, such as for
+// uploads.
 func init() {
-	if err := mime.AddExtensionType(".rmvb", "application/vnd.rn-realmedia-vbr"); err != nil {
-		log.Printf("Could not register application/vnd.rn-realmedia-vbr MIME type: %s", err)
-	}
-	if err := mime.AddExtensionType(".ogv", "video/ogg"); err != nil {
-		log.Printf("Could not register video/ogg MIME type: %s", err)
-	}
-	if err := mime.AddExtensionType(".ogg", "audio/ogg"); err != nil {
-		log.Printf("Could not register audio/ogg MIME type: %s", err)
+	for _, types := range []map[string]string{mediaMimeTypes, rawPhotoMimeTypes} {
+		for ext, typ := range types {
+			if err := mime.AddExtensionType(ext, typ); err != nil {
+				log.Printf("Could not register %s MIME type: %s", typ, err)
+			}
+		}
 	}
 }
 
@@ -57,9 +122,14 @@ func (mt mimeType) String() string {
 
 // MimeTypeByPath determines the MIME-type of file at the given path
 func MimeTypeByPath(filePath string) (ret mimeType, err error) {
+	return mimeTypeInFS(osFS{}, filePath)
+}
+
+// Determines the MIME-type of the file at the given path in fsys, like MimeTypeByPath.
+func mimeTypeInFS(fsys FS, filePath string) (ret mimeType, err error) {
 	ret = mimeTypeByBaseName(path.Base(filePath))
-	if ret == "" {
-		ret, err = mimeTypeByContent(filePath)
+	if ret == "" || ret == "application/octet-stream" {
+		ret, err = mimeTypeByContent(fsys, filePath)
 	}
 	if ret == "video/x-msvideo" {
 		ret = "video/avi"
@@ -72,23 +142,280 @@ func MimeTypeByPath(filePath string) (ret mimeType, err error) {
 // Guess MIME-type from the extension, ignoring ".part".
 func mimeTypeByBaseName(name string) mimeType {
 	name = strings.TrimSuffix(name, ".part")
-	ext := path.Ext(name)
-	if ext != "" {
-		return mimeType(mime.TypeByExtension(ext))
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" {
+		return mimeType("")
 	}
-	return mimeType("")
+	if typ, ok := mediaMimeTypes[ext]; ok {
+		return mimeType(typ)
+	}
+	if typ, ok := rawPhotoMimeTypes[ext]; ok {
+		return mimeType(typ)
+	}
+	return mimeType(mime.TypeByExtension(ext))
 }
 
 // Guess the MIME-type by analysing the first 512 bytes of the file.
-func mimeTypeByContent(path string) (ret mimeType, err error) {
-	file, err := os.Open(path)
+func mimeTypeByContent(fsys FS, path string) (ret mimeType, err error) {
+	file, err := fsys.Open(path)
 	if err != nil {
 		return
 	}
 	defer file.Close()
 	var data [512]byte
 	if n, err := file.Read(data[:]); err == nil {
-		ret = mimeType(http.DetectContentType(data[:n]))
+		ret = sniffMimeType(data[:n])
 	}
 	return
 }
+
+// The start of the header object of ASF files, such as WMV and WMA.
+var asfHeaderGUID = []byte("\x30\x26\xb2\x75\x8e\x66\xcf\x11\xa6\xd9\x00\xaa\x00\x62\xce\x6c")
+
+// Guesses the MIME-type from the magic numbers at the start of the data, of the media containers
+// and RAW photos that http.DetectContentType doesn't know, and then by it.
+func sniffMimeType(data []byte) mimeType {
+	has := func(offset int, magic string) bool {
+		return len(data) >= offset+len(magic) && string(data[offset:offset+len(magic)]) == magic
+	}
+	switch {
+	case has(0, "\x1a\x45\xdf\xa3"):
+		// EBML, with the DocType near the start.
+		head := data
+		if len(head) > 64 {
+			head = head[:64]
+		}
+		if bytes.Contains(head, []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case has(4, "ftyp"):
+		if len(data) >= 12 {
+			return ftypMimeType(string(data[8:12]))
+		}
+	case has(0, "RIFF") && has(8, "AVI "):
+		return "video/avi"
+	case has(0, "RIFF") && has(8, "WAVE"):
+		return "audio/wav"
+	case has(0, "FORM") && (has(8, "AIFF") || has(8, "AIFC")):
+		return "audio/aiff"
+	case has(0, "OggS"):
+		if bytes.Contains(data, []byte("OpusHead")) || bytes.Contains(data, []byte("\x01vorbis")) || bytes.Contains(data, []byte("\x7fFLAC")) {
+			return "audio/ogg"
+		}
+		return "video/ogg"
+	case has(0, "fLaC"):
+		return "audio/flac"
+	case has(0, "ID3"):
+		return "audio/mpeg"
+	case has(0, string(asfHeaderGUID)):
+		return "video/x-ms-asf"
+	case has(0, "FLV\x01"):
+		return "video/x-flv"
+	case has(0, "\x00\x00\x01\xba"):
+		return "video/mpeg"
+	case has(0, "\x47") && has(188, "\x47") && has(376, "\x47"),
+		// M2TS, with a timestamp before each packet.
+		has(4, "\x47") && has(196, "\x47") && has(388, "\x47"):
+		return "video/mp2t"
+	case has(0, "FUJIFILMCCD-RAW"):
+		return "image/x-fuji-raf"
+	case has(0, "IIRO"), has(0, "IIRS"):
+		return "image/x-olympus-orf"
+	case has(0, "IIU\x00"):
+		return "image/x-panasonic-rw2"
+	case has(0, "II*\x00") && has(8, "CR"):
+		return "image/x-canon-cr2"
+	case has(0, "II*\x00"), has(0, "MM\x00*"):
+		return "image/tiff"
+	case len(data) >= 2 && data[0] == 0xff && data[1]&0xf6 == 0xf0:
+		// An ADTS frame.
+		return "audio/aac"
+	case len(data) >= 2 && data[0] == 0xff && data[1]&0xe0 == 0xe0 && data[1]&0x06 != 0:
+		// An MPEG audio frame, of a layer other than the reserved one.
+		return "audio/mpeg"
+	}
+	return mimeType(http.DetectContentType(data))
+}
+
+// Returns the type of the ISO base media file with the major brand.
+func ftypMimeType(brand string) mimeType {
+	switch {
+	case brand == "M4A " || brand == "M4B " || brand == "M4P ":
+		return "audio/mp4"
+	case brand == "qt  ":
+		return "video/quicktime"
+	case brand == "crx ":
+		return "image/x-canon-cr3"
+	case brand == "avif" || brand == "avis":
+		return "image/avif"
+	case brand == "heic" || brand == "heix" || brand == "heim" || brand == "heis":
+		return "image/heic"
+	case brand == "mif1" || brand == "msf1":
+		return "image/heif"
+	case strings.HasPrefix(brand, "3g2"):
+		return "video/3gpp2"
+	case strings.HasPrefix(brand, "3gp"):
+		return "video/3gpp"
+	}
+	return "video/mp4"
+}
+
+// Returns the type of media that ffprobe found, by the format it names, and whether there's video
+// in it. It's empty if it's none dms serves.
+func probedMimeType(info *ffprobe.Info) mimeType {
+	mi := probeMediaInfo(info)
+	video := mi.VideoCodec != ""
+	either := func(videoType, audioType mimeType) mimeType {
+		if video {
+			return videoType
+		}
+		return audioType
+	}
+	// ffprobe names formats by all the demuxer's names, such as "mov,mp4,m4a,3gp,3g2,mj2".
+	for _, f := range strings.Split(mi.Format, ",") {
+		switch f {
+		case "matroska":
+			return either("video/x-matroska", "audio/x-matroska")
+		case "webm":
+			return either("video/webm", "audio/webm")
+		case "mov", "mp4":
+			return either("video/mp4", "audio/mp4")
+		case "asf":
+			return either("video/x-ms-asf", "audio/x-ms-wma")
+		case "ogg":
+			return either("video/ogg", "audio/ogg")
+		case "avi":
+			return "video/avi"
+		case "flv":
+			return "video/x-flv"
+		case "mpegts":
+			return "video/mp2t"
+		case "mpeg", "mpegvideo":
+			return "video/mpeg"
+		case "mp3":
+			return "audio/mpeg"
+		case "flac":
+			return "audio/flac"
+		case "wav":
+			return "audio/wav"
+		case "aiff":
+			return "audio/aiff"
+		case "aac":
+			return "audio/aac"
+		case "ape":
+			return "audio/x-ape"
+		case "wv":
+			return "audio/x-wavpack"
+		case "dsf":
+			return "audio/x-dsf"
+		}
+	}
+	return ""
+}
+
+// Determines the MIME-type of the file like MimeTypeByPath, and by what ffprobe makes of it where
+// that can't tell, unless probing is disabled. What's probed is kept by path, size and modification
+// time, as files that aren't media would be probed each time they're listed.
+func (srv *Server) mimeTypeByPath(filePath string) (mimeType, error) {
+	ret, err := mimeTypeInFS(srv.contentFS(), filePath)
+	if err != nil || ret != "application/octet-stream" || srv.settings().NoProbe {
+		return ret, err
+	}
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return ret, err
+	}
+	fi, err := srv.contentFS().Stat(absPath)
+	if err != nil {
+		return ret, err
+	}
+	key := ffmpegInfoCacheKey{absPath, fi.ModTime().UnixNano(), fi.Size()}
+	if probed, ok := srv.probedMimeTypes.Load(key); ok {
+		return probed.(mimeType), nil
+	}
+	if info, _ := srv.ffmpegProbe(absPath); info != nil {
+		if mt := probedMimeType(info); mt != "" {
+			ret = mt
+		}
+	}
+	srv.probedMimeTypes.Store(key, ret)
+	return ret, nil
+}
+
+// MIME-types given to clients matched by User-Agent in place of those dms gives, for renderers
+// that only recognize another name for a type.
+type MimeTypeOverride struct {
+	// Substrings of the User-Agents of the clients. "*" matches every client.
+	UserAgents []string
+	// The types to give them, by those dms gives, such as "video/avi": "video/x-msvideo".
+	Types map[string]string
+}
+
+// Checks the MIME-type overrides are of types that can be given.
+func (srv *Server) initMimeTypeOverrides() error {
+	for _, o := range srv.MimeTypeOverrides {
+		if len(o.UserAgents) == 0 {
+			return fmt.Errorf("MIME type override %q has no user agents", o.Types)
+		}
+		for from, to := range o.Types {
+			for _, t := range []string{from, to} {
+				if _, _, err := mime.ParseMediaType(t); err != nil || !strings.Contains(t, "/") || strings.ContainsAny(t, ":,") {
+					return fmt.Errorf("MIME type override for %q: bad type %q", o.UserAgents, t)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// The MIME-types to give a client in place of dms's own.
+type mimeTypeOverrides map[string]string
+
+// Returns the MIME-types to give the client with the User-Agent, by every override that matches
+// it, earlier ones first.
+func (srv *Server) mimeTypeOverrides(userAgent string) mimeTypeOverrides {
+	var ret mimeTypeOverrides
+	for _, o := range srv.settings().MimeTypeOverrides {
+		if !matchUserAgent(o.UserAgents, userAgent) {
+			continue
+		}
+		if ret == nil {
+			ret = make(mimeTypeOverrides)
+		}
+		for from, to := range o.Types {
+			if _, ok := ret[from]; !ok {
+				ret[from] = to
+			}
+		}
+	}
+	return ret
+}
+
+// Returns the type to give the client for one dms gives.
+func (me mimeTypeOverrides) mimeType(mt string) string {
+	if to, ok := me[mt]; ok {
+		return to
+	}
+	return mt
+}
+
+// Returns obj with the MIME-types in the protocolInfo of its resources overridden. Objects are
+// cached, so they're copied rather than changed.
+func (me mimeTypeOverrides) arrange(obj interface{}) interface{} {
+	item, ok := obj.(upnpav.Item)
+	if !ok || len(me) == 0 {
+		return obj
+	}
+	res := make([]upnpav.Resource, len(item.Res))
+	for i, r := range item.Res {
+		// protocol:network:contentFormat:additionalInfo
+		if fields := strings.SplitN(r.ProtocolInfo, ":", 4); len(fields) == 4 {
+			fields[2] = me.mimeType(fields[2])
+			r.ProtocolInfo = strings.Join(fields, ":")
+		}
+		res[i] = r
+	}
+	item.Res = res
+	return item
+}
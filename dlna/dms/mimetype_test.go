@@ -0,0 +1,85 @@
+package dms
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestMimeTypeByBaseName(t *testing.T) {
+	for name, want := range map[string]mimeType{
+		"Heat.MKV":       "video/x-matroska",
+		"song.flac.part": "audio/flac",
+		"news.ts":        "video/mp2t",
+		"IMG_0001.CR3":   "image/x-canon-cr3",
+		"no extension":   "",
+		"holiday.avi":    "video/avi",
+		"audiobook.m4b":  "audio/mp4",
+		"IMG_0002.heic":  "image/heic",
+	} {
+		if got := mimeTypeByBaseName(name); got != want {
+			t.Errorf("%q: got %q", name, got)
+		}
+	}
+}
+
+func TestSniffMimeType(t *testing.T) {
+	ts := make([]byte, 512)
+	ts[0], ts[188], ts[376] = 0x47, 0x47, 0x47
+	for want, data := range map[mimeType]string{
+		"video/x-matroska":  "\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x88matroska",
+		"video/webm":        "\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm",
+		"video/mp4":         "\x00\x00\x00\x20ftypisom\x00\x00\x02\x00",
+		"audio/mp4":         "\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00",
+		"video/quicktime":   "\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00",
+		"image/x-canon-cr3": "\x00\x00\x00\x18ftypcrx \x00\x00\x00\x01",
+		"audio/flac":        "fLaC\x00\x00\x00\x22",
+		"audio/mpeg":        "ID3\x04\x00\x00\x00\x00\x00\x00",
+		"audio/ogg":         "OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00OpusHead",
+		"video/avi":         "RIFF\x00\x00\x00\x00AVI LIST",
+		"video/mp2t":        string(ts),
+		"image/x-fuji-raf":  "FUJIFILMCCD-RAW 0201",
+		"image/x-canon-cr2": "II*\x00\x10\x00\x00\x00CR\x02\x00",
+		"image/jpeg":        "\xff\xd8\xff\xe0\x00\x10JFIF\x00",
+	} {
+		if got := sniffMimeType([]byte(data)); got != want {
+			t.Errorf("%s: got %q", want, got)
+		}
+	}
+}
+
+func TestMimeTypeOverrides(t *testing.T) {
+	srv := &Server{MimeTypeOverrides: []MimeTypeOverride{
+		{UserAgents: []string{"SEC_HHP_"}, Types: map[string]string{"video/avi": "video/x-msvideo"}},
+		{UserAgents: []string{"*"}, Types: map[string]string{"video/avi": "video/divx", "video/mp2t": "video/mpeg"}},
+	}}
+	if err := srv.initMimeTypeOverrides(); err != nil {
+		t.Fatal(err)
+	}
+	item := upnpav.Item{Res: []upnpav.Resource{
+		{ProtocolInfo: "http-get:*:video/avi:DLNA.ORG_OP=01"},
+		{ProtocolInfo: "http-get:*:video/mpeg:DLNA.ORG_PN=MPEG_PS_PAL"},
+	}}
+	got := srv.mimeTypeOverrides("SEC_HHP_[TV] Samsung/1.0").arrange(item).(upnpav.Item)
+	if got.Res[0].ProtocolInfo != "http-get:*:video/x-msvideo:DLNA.ORG_OP=01" || got.Res[1].ProtocolInfo != item.Res[1].ProtocolInfo {
+		t.Errorf("got %q", got.Res)
+	}
+	if item.Res[0].ProtocolInfo != "http-get:*:video/avi:DLNA.ORG_OP=01" {
+		t.Error("cached item changed")
+	}
+	if got := srv.mimeTypeOverrides("VLC/3.0").mimeType("video/mp2t"); got != "video/mpeg" {
+		t.Errorf("got %q", got)
+	}
+
+	for _, bad := range []MimeTypeOverride{
+		{Types: map[string]string{"video/avi": "video/x-msvideo"}},
+		{UserAgents: []string{"LG"}, Types: map[string]string{"video/avi": "avi"}},
+		{UserAgents: []string{"LG"}, Types: map[string]string{"video/avi": "video/x-msvideo:DLNA"}},
+	} {
+		srv := &Server{MimeTypeOverrides: []MimeTypeOverride{bad}}
+		if err := srv.initMimeTypeOverrides(); err == nil || !strings.Contains(err.Error(), "MIME type override") {
+			t.Errorf("%q: got %v", bad.Types, err)
+		}
+	}
+}
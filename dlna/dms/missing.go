@@ -0,0 +1,220 @@
+package dms
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/anacrolix/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	trashPath = "/trash"
+	// How often entries missing for longer than KeepMissing are forgotten.
+	indexPurgeInterval = time.Hour
+)
+
+// An index entry for a file that's gone from its directory, kept in case it comes back, such as
+// when a mount is briefly unavailable.
+type missingEntry struct {
+	Entry indexEntry
+	// When the file was found to be gone.
+	Since time.Time
+}
+
+// How long the index keeps what it knows about files that have gone, or 0 to drop it at once.
+func (srv *Server) keepMissing() time.Duration {
+	return srv.settings().KeepMissing
+}
+
+// Moves the entry of a file that's gone from the directory at object path dir to the missing
+// entries. Its thumbnails are kept with it.
+func retireIndexEntry(tx *bolt.Tx, dir string, e *indexEntry, now time.Time) error {
+	key := indexEntryKey(dir, e.Name)
+	if err := tx.Bucket(indexEntriesBucket).Delete(key); err != nil {
+		return err
+	}
+	if e.Mode.IsDir() {
+		return nil
+	}
+	v, err := json.Marshal(missingEntry{*e, now})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(indexMissingBucket).Put(key, v)
+}
+
+// Like deleteIndexSubtree, but the entries of files are moved to the missing entries rather than
+// deleted, along with their thumbnails.
+func retireIndexSubtree(tx *bolt.Tx, p string, now time.Time) error {
+	type entry struct {
+		dir string
+		e   indexEntry
+	}
+	// Entries in the top level are keyed "/\x00name", so everything is under "/".
+	prefixes, below := []string{p + "\x00", p + "/"}, p+"/"
+	if p == "/" {
+		prefixes, below = []string{"/"}, "/"
+	}
+	var entries []entry
+	c := tx.Bucket(indexEntriesBucket).Cursor()
+	for _, prefix := range prefixes {
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			var e indexEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			entries = append(entries, entry{string(k[:bytes.IndexByte(k, 0)]), e})
+		}
+	}
+	for i := range entries {
+		if err := retireIndexEntry(tx, entries[i].dir, &entries[i].e, now); err != nil {
+			return err
+		}
+	}
+	if err := deleteIndexPrefix(tx.Bucket(indexDirsBucket), below); err != nil {
+		return err
+	}
+	return tx.Bucket(indexDirsBucket).Delete([]byte(p))
+}
+
+// Returns the missing entries of the directory at object path dir, by name.
+func (me *index) missingEntries(dir string) map[string]*missingEntry {
+	ret := make(map[string]*missingEntry)
+	err := me.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(dir + "\x00")
+		c := tx.Bucket(indexMissingBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var m missingEntry
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			ret[m.Entry.Name] = &m
+		}
+		return nil
+	})
+	if err != nil {
+		me.logger.Levelf(log.Error, "error reading index: %v", err)
+	}
+	return ret
+}
+
+// A file in the trash: missing from the shared directories, and forgotten at Expires unless it
+// comes back.
+type trashFile struct {
+	Path    string
+	Size    int64
+	Since   time.Time
+	Expires time.Time
+}
+
+// Returns the missing files, those gone longest first.
+func (me *index) trash(keep time.Duration) (ret []trashFile, err error) {
+	err = me.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexMissingBucket).ForEach(func(k, v []byte) error {
+			var m missingEntry
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			ret = append(ret, trashFile{
+				Path:    path.Join(string(k[:bytes.IndexByte(k, 0)]), m.Entry.Name),
+				Size:    m.Entry.Size,
+				Since:   m.Since,
+				Expires: m.Since.Add(keep),
+			})
+			return nil
+		})
+	})
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Since.Before(ret[j].Since)
+	})
+	return
+}
+
+// Forgets the missing files that went before the time, and their thumbnails. If p isn't empty,
+// only the file at that object path is forgotten. Returns how many were.
+func (me *index) forgetMissing(before time.Time, p string) (n int, err error) {
+	err = me.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(indexMissingBucket)
+		var keys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			if p != "" && !bytes.Equal(k, indexEntryKey(path.Dir(p), path.Base(p))) {
+				return nil
+			}
+			var m missingEntry
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			if m.Since.Before(before) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			i := bytes.IndexByte(k, 0)
+			filePath := path.Join(string(k[:i]), string(k[i+1:]))
+			if err := deleteIndexPrefix(tx.Bucket(indexThumbsBucket), filePath+"\x00"); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	return
+}
+
+// Forgets the files that have been missing for longer than KeepMissing.
+func (me *index) purgeMissing() {
+	n, err := me.forgetMissing(time.Now().Add(-me.srv.keepMissing()), "")
+	if err != nil {
+		me.logger.Levelf(log.Error, "error forgetting missing files: %v", err)
+	} else if n != 0 {
+		me.logger.Levelf(log.Debug, "forgot %d files missing for longer than %v", n, me.srv.keepMissing())
+	}
+}
+
+func (srv *Server) serveTrash(w http.ResponseWriter, r *http.Request) {
+	if !srv.authorizeAPI(w, r, APIScopeAdmin) {
+		return
+	}
+	data := struct {
+		Indexed bool
+		Files   []trashFile
+		Forgot  int
+		Error   error
+	}{
+		Indexed: srv.index != nil,
+	}
+	if srv.index != nil {
+		if r.Method == "POST" {
+			if !SameOrigin(r) {
+				http.Error(w, "cross-origin request", http.StatusForbidden)
+				return
+			}
+			// Emptying the trash forgets everything, and forgetting a file only that one.
+			data.Forgot, data.Error = srv.index.forgetMissing(time.Now(), r.FormValue("path"))
+			if data.Error == nil {
+				srv.requestLogger(r).Printf("forgot %d missing files", data.Forgot)
+			}
+		}
+		files, err := srv.index.trash(srv.keepMissing())
+		if data.Error == nil {
+			data.Error = err
+		}
+		data.Files = files
+	}
+	w.Header().Set("content-type", "text/html")
+	if err := trashTmpl.Execute(w, data); err != nil {
+		srv.Logger.Print(err)
+	}
+}
@@ -0,0 +1,63 @@
+package dms
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRetireIndexSubtree(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "index.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	idx := &index{db: db}
+	gone := time.Now().Add(-time.Hour)
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{indexEntriesBucket, indexDirsBucket, indexThumbsBucket, indexMissingBucket} {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		v, _ := json.Marshal(indexEntry{Name: "a.mkv", Size: 3, Metadata: &Metadata{Title: "A"}})
+		tx.Bucket(indexEntriesBucket).Put(indexEntryKey("/Films/New", "a.mkv"), v)
+		v, _ = json.Marshal(indexEntry{Name: "b.mkv"})
+		tx.Bucket(indexEntriesBucket).Put(indexEntryKey("/Films2", "b.mkv"), v)
+		tx.Bucket(indexDirsBucket).Put([]byte("/Films/New"), nil)
+		tx.Bucket(indexThumbsBucket).Put(indexThumbnailKey("/Films/New/a.mkv", "jpeg"), []byte("thumb"))
+		return retireIndexSubtree(tx, "/Films", gone)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.isIndexed("/Films/New") {
+		t.Error("retired directory is still indexed")
+	}
+	m := idx.missingEntries("/Films/New")["a.mkv"]
+	if m == nil || m.Entry.Metadata.Title != "A" || !m.Since.Equal(gone) {
+		t.Fatalf("missing entry %+v", m)
+	}
+	files, err := idx.trash(2 * time.Hour)
+	if err != nil || len(files) != 1 || files[0].Path != "/Films/New/a.mkv" || !files[0].Expires.Equal(gone.Add(2*time.Hour)) {
+		t.Fatalf("trash %+v %v", files, err)
+	}
+	if n, err := idx.forgetMissing(gone, ""); n != 0 || err != nil {
+		t.Fatalf("forgot %d files missing since before they went: %v", n, err)
+	}
+	if n, err := idx.forgetMissing(time.Now(), ""); n != 1 || err != nil {
+		t.Fatalf("forgot %d files: %v", n, err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(indexThumbsBucket).Get(indexThumbnailKey("/Films/New/a.mkv", "jpeg")) != nil {
+			t.Error("thumbnail of forgotten file kept")
+		}
+		if tx.Bucket(indexEntriesBucket).Get(indexEntryKey("/Films2", "b.mkv")) == nil {
+			t.Error("sibling with the directory's name as a prefix retired")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,212 @@
+package dms
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/dlna"
+	"github.com/anacrolix/dms/mpris"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// How often the renderer of the session is asked whether it's still playing, with MPRIS.
+const nowPlayingPollInterval = 5 * time.Second
+
+// What was last played on a renderer from the web UI or API, which is published as an MPRIS
+// player, so that desktops show it and send it their media keys.
+type nowPlaying struct {
+	mu sync.Mutex
+	// The renderer, by IP, and what's known of it. The IP is empty until something's played.
+	ip   string
+	info rendererInfo
+	// One of the mpris PlaybackStatus constants.
+	status   string
+	metadata mpris.Metadata
+	// Nil without MPRIS, or until it's published.
+	player *mpris.Player
+}
+
+// Returns the state of the session for MPRIS. The caller holds mu.
+func (me *nowPlaying) state() mpris.State {
+	ret := mpris.State{Status: mpris.Stopped}
+	if me.ip == "" {
+		return ret
+	}
+	ret.Status = me.status
+	ret.Metadata = me.metadata
+	ret.CanPlay = true
+	ret.CanPause = me.status == mpris.Playing
+	// Renderers are given a single URI with AVTransport, while OpenHome ones have a queue.
+	ret.CanGoNext = me.info.avTransport.control == nil
+	ret.CanGoPrevious = ret.CanGoNext
+	return ret
+}
+
+// Tells the MPRIS player, if there is one, what the session is. The caller holds mu.
+func (me *nowPlaying) publish() {
+	if me.player != nil {
+		me.player.Update(me.state())
+	}
+}
+
+// Returns the MPRIS metadata of the item played on a renderer, with the resource it was given.
+func nowPlayingMetadata(item upnpav.Item, res upnpav.Resource, trackID int) mpris.Metadata {
+	ret := mpris.Metadata{
+		TrackID: trackID,
+		Title:   item.Title,
+		Album:   item.Album,
+		ArtURL:  item.AlbumArtURI,
+		URL:     res.URL,
+	}
+	if item.Artist != "" {
+		ret.Artists = []string{item.Artist}
+	}
+	if d, err := dlna.ParseNPTTime(res.Duration); err == nil {
+		ret.Length = d
+	}
+	return ret
+}
+
+// Records that the item was played on the renderer at ip with the resource, as the session.
+func (srv *Server) setNowPlaying(ip string, info rendererInfo, item upnpav.Item, res upnpav.Resource) {
+	me := &srv.nowPlaying
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.ip, me.info = ip, info
+	me.status = mpris.Playing
+	me.metadata = nowPlayingMetadata(item, res, me.metadata.TrackID+1)
+	me.publish()
+}
+
+// Records that the renderer at ip was stopped, if it's the session's.
+func (srv *Server) stoppedNowPlaying(ip string) {
+	me := &srv.nowPlaying
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.ip == ip {
+		me.status = mpris.Stopped
+		me.publish()
+	}
+}
+
+// Does what MPRIS asked of the session, one of the mpris control constants, on its renderer.
+func (srv *Server) controlNowPlaying(control string) error {
+	me := &srv.nowPlaying
+	me.mu.Lock()
+	ip, info, status := me.ip, me.info, me.status
+	me.mu.Unlock()
+	if ip == "" {
+		return fmt.Errorf("nothing has been played")
+	}
+	action, next := control, mpris.Playing
+	switch control {
+	case mpris.PlayPause:
+		action = mpris.Play
+		if status == mpris.Playing {
+			action = mpris.Pause
+		}
+		if action == mpris.Pause {
+			next = mpris.Paused
+		}
+	case mpris.Pause:
+		next = mpris.Paused
+	case mpris.Stop:
+		next = mpris.Stopped
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), playToTimeout)
+	defer cancel()
+	// The controls left are named like the transport actions.
+	if err := srv.renderers.transport(ctx, info, action); err != nil {
+		return err
+	}
+	srv.Logger.Levelf(log.Debug, "%s on renderer at %v from MPRIS", action, ip)
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	// Another item may have been played meanwhile.
+	if me.ip == ip {
+		me.status = next
+		me.publish()
+	}
+	return nil
+}
+
+// Asks the renderer of the session what it's doing, so that what's published follows it being
+// paused from its own remote, or finishing.
+func (srv *Server) pollNowPlaying() {
+	me := &srv.nowPlaying
+	for {
+		select {
+		case <-srv.closed:
+			return
+		case <-time.After(nowPlayingPollInterval):
+		}
+		me.mu.Lock()
+		ip, info := me.ip, me.info
+		me.mu.Unlock()
+		if ip == "" {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), rendererFetchTimeout)
+		status, err := srv.renderers.transportStatus(ctx, info)
+		cancel()
+		if err != nil {
+			srv.Logger.Levelf(log.Debug, "error getting transport state of renderer at %v: %v", ip, err)
+			continue
+		}
+		me.mu.Lock()
+		if me.ip == ip && me.status != status {
+			me.status = status
+			me.publish()
+		}
+		me.mu.Unlock()
+	}
+}
+
+// Publishes the session as an MPRIS player on the session bus, if MPRIS is set. Without a
+// session bus, such as on a server with no desktop, it's left unpublished.
+func (srv *Server) startMPRIS() {
+	enabled, name := srv.MPRIS, srv.settings().FriendlyName
+	if !enabled {
+		return
+	}
+	player := &mpris.Player{
+		Name:      "dms",
+		Identity:  name,
+		OnControl: srv.controlNowPlaying,
+		Logger:    srv.Logger.WithNames("mpris"),
+	}
+	if err := player.Start(); err != nil {
+		srv.Logger.Levelf(log.Warning, "not publishing play-to session with MPRIS: %v", err)
+		return
+	}
+	me := &srv.nowPlaying
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	select {
+	case <-srv.closed:
+		// Close has already run stopMPRIS.
+		player.Close()
+		return
+	default:
+	}
+	srv.Logger.Levelf(log.Info, "publishing play-to session with MPRIS as %s", player.BusName())
+	me.player = player
+	me.publish()
+	go srv.pollNowPlaying()
+}
+
+// Removes the MPRIS player from the session bus. It's called once the server is closed.
+func (srv *Server) stopMPRIS() {
+	me := &srv.nowPlaying
+	me.mu.Lock()
+	player := me.player
+	me.player = nil
+	me.mu.Unlock()
+	if player != nil {
+		player.Close()
+	}
+}
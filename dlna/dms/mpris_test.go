@@ -0,0 +1,90 @@
+package dms
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/mpris"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestNowPlayingAVTransport(t *testing.T) {
+	srv := &Server{Logger: log.Default}
+	if err := srv.controlNowPlaying(mpris.Play); err == nil {
+		t.Error("controlled nothing")
+	}
+	avTransport, actions := newTestTransport(t, "urn:schemas-upnp-org:service:AVTransport:1", "PAUSED_PLAYBACK")
+	info := rendererInfo{name: "TV", avTransport: avTransport}
+	item := upnpav.Item{Object: upnpav.Object{Title: "Song", Artist: "Artist", Album: "Album"}}
+	res := upnpav.Resource{URL: "http://host/res?path=%2Fa.flac", Duration: "0:01:30.000"}
+	srv.setNowPlaying("192.168.1.30", info, item, res)
+	state := srv.nowPlaying.state()
+	if state.Status != mpris.Playing || !state.CanPlay || !state.CanPause || state.CanGoNext {
+		t.Errorf("got state %+v", state)
+	}
+	md := state.Metadata
+	if md.TrackID != 1 || md.Title != "Song" || md.Artists[0] != "Artist" || md.Length != 90*time.Second || md.URL != res.URL {
+		t.Errorf("got metadata %+v", md)
+	}
+
+	for _, tc := range []struct {
+		control, status string
+	}{
+		{mpris.PlayPause, mpris.Paused},
+		{mpris.PlayPause, mpris.Playing},
+		{mpris.Stop, mpris.Stopped},
+		{mpris.Play, mpris.Playing},
+	} {
+		if err := srv.controlNowPlaying(tc.control); err != nil {
+			t.Fatal(err)
+		}
+		if got := srv.nowPlaying.state().Status; got != tc.status {
+			t.Errorf("%s: got %s, expected %s", tc.control, got, tc.status)
+		}
+	}
+	if got := strings.Join(*actions, ","); got != "Pause,Play,Stop,Play" {
+		t.Errorf("got actions %s", got)
+	}
+
+	// Stopping another renderer leaves the session.
+	srv.stoppedNowPlaying("192.168.1.31")
+	if got := srv.nowPlaying.state().Status; got != mpris.Playing {
+		t.Errorf("got %s", got)
+	}
+	status, err := srv.renderers.transportStatus(context.Background(), info)
+	if err != nil || status != mpris.Paused {
+		t.Errorf("got %q, %v", status, err)
+	}
+	srv.setNowPlaying("192.168.1.30", info, item, res)
+	if id := srv.nowPlaying.state().Metadata.TrackID; id != 2 {
+		t.Errorf("got track ID %d", id)
+	}
+}
+
+func TestNowPlayingOpenHome(t *testing.T) {
+	srv := &Server{Logger: log.Default}
+	playlist, actions := newTestTransport(t, "urn:av-openhome-org:service:Playlist:1", "Buffering")
+	info := rendererInfo{playlist: playlist}
+	srv.setNowPlaying("192.168.1.30", info, upnpav.Item{}, upnpav.Resource{})
+	state := srv.nowPlaying.state()
+	if !state.CanGoNext || !state.CanGoPrevious || state.Metadata.Length != 0 {
+		t.Errorf("got state %+v", state)
+	}
+	if err := srv.controlNowPlaying(mpris.Next); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.controlNowPlaying(mpris.Pause); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(*actions, ","); got != "Next,Pause" {
+		t.Errorf("got actions %s", got)
+	}
+	status, err := srv.renderers.transportStatus(context.Background(), info)
+	if err != nil || status != mpris.Playing {
+		t.Errorf("got %q, %v", status, err)
+	}
+}
@@ -9,20 +9,19 @@ import (
 type mediaReceiverRegistrarService struct {
 	*Server
 	upnp.Eventing
+	soapActions
 }
 
-func (mrrs *mediaReceiverRegistrarService) Handle(action string, argsXML []byte, r *http.Request) ([][2]string, error) {
-	switch action {
-	case "IsAuthorized", "IsValidated":
-		return [][2]string{
-			{"Result", "1"},
-		}, nil
-	case "RegisterDevice":
-		return [][2]string{
-			{"RegistrationRespMsg", mrrs.rootDeviceUUID},
-		}, nil
-		//		return nil, nil
-	default:
-		return nil, upnp.InvalidActionError
+// Returns the actions of the X_MS_MediaReceiverRegistrar service, which authorizes every device.
+func (mrrs *mediaReceiverRegistrarService) actions() soapActions {
+	authorized := newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+		return []soapArg{{Name: "Result", Value: "1"}}, nil
+	})
+	return soapActions{
+		"IsAuthorized": authorized,
+		"IsValidated":  authorized,
+		"RegisterDevice": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			return []soapArg{{Name: "RegistrationRespMsg", Value: mrrs.rootDeviceUUID}}, nil
+		}),
 	}
 }
@@ -0,0 +1,70 @@
+package dms
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Begins the object paths given to clients encoded. Object paths are absolute, so they never begin
+// with it themselves.
+const encodedObjectPathPrefix = "~"
+
+// Reports whether the object path is given to clients encoded, in ObjectIDs and in the queries of
+// resource URLs. That's when a name in it isn't valid UTF-8, such as one from an old system or a
+// filesystem with another encoding, or has control characters in it. They're escaped as bytes in
+// both, but renderers that unescape IDs to show or keep them, or that reencode URLs as UTF-8, can't
+// then give them back. Other paths are left readable, so that their IDs don't change.
+func objectPathNeedsEncoding(p string) bool {
+	if !utf8.ValidString(p) {
+		return true
+	}
+	return strings.IndexFunc(p, unicode.IsControl) != -1
+}
+
+// Returns the object path in the form it's given to clients: as it is, or if it needs encoding,
+// its bytes in unpadded base64url after encodedObjectPathPrefix, which are all left as they are by
+// URL escaping and XML.
+func encodeObjectPath(p string) string {
+	if !objectPathNeedsEncoding(p) {
+		return p
+	}
+	return encodedObjectPathPrefix + base64.RawURLEncoding.EncodeToString([]byte(p))
+}
+
+// Returns the object path a client gave as s, which it was given encoded or not.
+func decodeObjectPath(s string) string {
+	if !strings.HasPrefix(s, encodedObjectPathPrefix) {
+		return s
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s[len(encodedObjectPathPrefix):])
+	if err != nil || len(b) == 0 || b[0] != '/' {
+		return s
+	}
+	return string(b)
+}
+
+// Encodes the object path in the path parameter of the query of a resource URL, if it needs it.
+// Reports whether it did.
+func encodeResourceQuery(q url.Values) bool {
+	p := q.Get("path")
+	if !objectPathNeedsEncoding(p) {
+		return false
+	}
+	q.Set("path", encodeObjectPath(p))
+	return true
+}
+
+// Decodes the object path in the path parameter of the query of a request for a resource.
+// Reports whether it was encoded.
+func decodeResourceQuery(q url.Values) bool {
+	s := q.Get("path")
+	p := decodeObjectPath(s)
+	if p == s {
+		return false
+	}
+	q.Set("path", p)
+	return true
+}
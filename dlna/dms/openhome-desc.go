@@ -0,0 +1,871 @@
+package dms
+
+// The OpenHome Product service, with the sources of the renderer that dms offers it for.
+const openHomeProductDescription = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+	<specVersion>
+		<major>1</major>
+		<minor>0</minor>
+	</specVersion>
+	<actionList>
+		<action>
+			<name>Manufacturer</name>
+			<argumentList>
+				<argument>
+					<name>Name</name>
+					<direction>out</direction>
+					<relatedStateVariable>ManufacturerName</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Info</name>
+					<direction>out</direction>
+					<relatedStateVariable>ManufacturerInfo</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Url</name>
+					<direction>out</direction>
+					<relatedStateVariable>ManufacturerUrl</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>ImageUri</name>
+					<direction>out</direction>
+					<relatedStateVariable>ManufacturerImageUri</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>Model</name>
+			<argumentList>
+				<argument>
+					<name>Name</name>
+					<direction>out</direction>
+					<relatedStateVariable>ModelName</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Info</name>
+					<direction>out</direction>
+					<relatedStateVariable>ModelInfo</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Url</name>
+					<direction>out</direction>
+					<relatedStateVariable>ModelUrl</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>ImageUri</name>
+					<direction>out</direction>
+					<relatedStateVariable>ModelImageUri</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>Product</name>
+			<argumentList>
+				<argument>
+					<name>Room</name>
+					<direction>out</direction>
+					<relatedStateVariable>ProductRoom</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Name</name>
+					<direction>out</direction>
+					<relatedStateVariable>ProductName</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Info</name>
+					<direction>out</direction>
+					<relatedStateVariable>ProductInfo</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Url</name>
+					<direction>out</direction>
+					<relatedStateVariable>ProductUrl</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>ImageUri</name>
+					<direction>out</direction>
+					<relatedStateVariable>ProductImageUri</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>Standby</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>Standby</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>SetStandby</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>in</direction>
+					<relatedStateVariable>Standby</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>SourceCount</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>SourceCount</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>SourceXml</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>SourceXml</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>SourceIndex</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>SourceIndex</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>SetSourceIndex</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>in</direction>
+					<relatedStateVariable>SourceIndex</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>SetSourceIndexByName</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>in</direction>
+					<relatedStateVariable>SourceName</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>Source</name>
+			<argumentList>
+				<argument>
+					<name>Index</name>
+					<direction>in</direction>
+					<relatedStateVariable>SourceIndex</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>SystemName</name>
+					<direction>out</direction>
+					<relatedStateVariable>SourceName</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Type</name>
+					<direction>out</direction>
+					<relatedStateVariable>SourceType</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Name</name>
+					<direction>out</direction>
+					<relatedStateVariable>SourceName</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Visible</name>
+					<direction>out</direction>
+					<relatedStateVariable>SourceVisible</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>Attributes</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>Attributes</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>SourceXmlChangeCount</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>SourceXmlChangeCount</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+	</actionList>
+	<serviceStateTable>
+		<stateVariable sendEvents="yes">
+			<name>ManufacturerName</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>ManufacturerInfo</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>ManufacturerUrl</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>ManufacturerImageUri</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>ModelName</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>ModelInfo</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>ModelUrl</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>ModelImageUri</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>ProductRoom</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>ProductName</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>ProductInfo</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>ProductUrl</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>ProductImageUri</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>Standby</name>
+			<dataType>boolean</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>SourceIndex</name>
+			<dataType>ui4</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>SourceCount</name>
+			<dataType>ui4</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>SourceXml</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>Attributes</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>SourceXmlChangeCount</name>
+			<dataType>ui4</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>SourceName</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>SourceType</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>SourceVisible</name>
+			<dataType>boolean</dataType>
+		</stateVariable>
+	</serviceStateTable>
+</scpd>
+`
+
+// The OpenHome Playlist service, the queue of the renderer that dms offers it for.
+const openHomePlaylistDescription = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+	<specVersion>
+		<major>1</major>
+		<minor>0</minor>
+	</specVersion>
+	<actionList>
+		<action>
+			<name>Play</name>
+		</action>
+		<action>
+			<name>Pause</name>
+		</action>
+		<action>
+			<name>Stop</name>
+		</action>
+		<action>
+			<name>Next</name>
+		</action>
+		<action>
+			<name>Previous</name>
+		</action>
+		<action>
+			<name>SetRepeat</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>in</direction>
+					<relatedStateVariable>Repeat</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>Repeat</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>Repeat</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>SetShuffle</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>in</direction>
+					<relatedStateVariable>Shuffle</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>Shuffle</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>Shuffle</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>SeekSecondAbsolute</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>in</direction>
+					<relatedStateVariable>Absolute</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>SeekSecondRelative</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>in</direction>
+					<relatedStateVariable>Relative</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>SeekId</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>in</direction>
+					<relatedStateVariable>Id</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>SeekIndex</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>in</direction>
+					<relatedStateVariable>Index</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>TransportState</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>TransportState</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>Id</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>Id</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>Read</name>
+			<argumentList>
+				<argument>
+					<name>Id</name>
+					<direction>in</direction>
+					<relatedStateVariable>Id</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Uri</name>
+					<direction>out</direction>
+					<relatedStateVariable>Uri</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Metadata</name>
+					<direction>out</direction>
+					<relatedStateVariable>Metadata</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>ReadList</name>
+			<argumentList>
+				<argument>
+					<name>IdList</name>
+					<direction>in</direction>
+					<relatedStateVariable>IdList</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>TrackList</name>
+					<direction>out</direction>
+					<relatedStateVariable>TrackList</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>Insert</name>
+			<argumentList>
+				<argument>
+					<name>AfterId</name>
+					<direction>in</direction>
+					<relatedStateVariable>Id</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Uri</name>
+					<direction>in</direction>
+					<relatedStateVariable>Uri</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Metadata</name>
+					<direction>in</direction>
+					<relatedStateVariable>Metadata</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>NewId</name>
+					<direction>out</direction>
+					<relatedStateVariable>Id</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>DeleteId</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>in</direction>
+					<relatedStateVariable>Id</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>DeleteAll</name>
+		</action>
+		<action>
+			<name>TracksMax</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>TracksMax</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>IdArray</name>
+			<argumentList>
+				<argument>
+					<name>Token</name>
+					<direction>out</direction>
+					<relatedStateVariable>IdArrayToken</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Array</name>
+					<direction>out</direction>
+					<relatedStateVariable>IdArray</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>IdArrayChanged</name>
+			<argumentList>
+				<argument>
+					<name>Token</name>
+					<direction>in</direction>
+					<relatedStateVariable>IdArrayToken</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>IdArrayChanged</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>ProtocolInfo</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>ProtocolInfo</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+	</actionList>
+	<serviceStateTable>
+		<stateVariable sendEvents="yes">
+			<name>TransportState</name>
+			<dataType>string</dataType>
+			<allowedValueList>
+				<allowedValue>Playing</allowedValue>
+				<allowedValue>Paused</allowedValue>
+				<allowedValue>Stopped</allowedValue>
+				<allowedValue>Buffering</allowedValue>
+			</allowedValueList>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>Repeat</name>
+			<dataType>boolean</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>Shuffle</name>
+			<dataType>boolean</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>Id</name>
+			<dataType>ui4</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>IdArray</name>
+			<dataType>bin.base64</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>TracksMax</name>
+			<dataType>ui4</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>ProtocolInfo</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>Index</name>
+			<dataType>ui4</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>Relative</name>
+			<dataType>i4</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>Absolute</name>
+			<dataType>ui4</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>IdList</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>TrackList</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>Uri</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>Metadata</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>IdArrayToken</name>
+			<dataType>ui4</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>IdArrayChanged</name>
+			<dataType>boolean</dataType>
+		</stateVariable>
+	</serviceStateTable>
+</scpd>
+`
+
+// The OpenHome Radio service, with the RemoteStreams as its channels.
+const openHomeRadioDescription = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+	<specVersion>
+		<major>1</major>
+		<minor>0</minor>
+	</specVersion>
+	<actionList>
+		<action>
+			<name>Play</name>
+		</action>
+		<action>
+			<name>Pause</name>
+		</action>
+		<action>
+			<name>Stop</name>
+		</action>
+		<action>
+			<name>SeekSecondAbsolute</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>in</direction>
+					<relatedStateVariable>Absolute</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>SeekSecondRelative</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>in</direction>
+					<relatedStateVariable>Relative</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>Channel</name>
+			<argumentList>
+				<argument>
+					<name>Uri</name>
+					<direction>out</direction>
+					<relatedStateVariable>Uri</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Metadata</name>
+					<direction>out</direction>
+					<relatedStateVariable>Metadata</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>SetChannel</name>
+			<argumentList>
+				<argument>
+					<name>Uri</name>
+					<direction>in</direction>
+					<relatedStateVariable>Uri</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Metadata</name>
+					<direction>in</direction>
+					<relatedStateVariable>Metadata</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>TransportState</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>TransportState</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>Id</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>Id</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>SetId</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>in</direction>
+					<relatedStateVariable>Id</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Uri</name>
+					<direction>in</direction>
+					<relatedStateVariable>Uri</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>Read</name>
+			<argumentList>
+				<argument>
+					<name>Id</name>
+					<direction>in</direction>
+					<relatedStateVariable>Id</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Metadata</name>
+					<direction>out</direction>
+					<relatedStateVariable>Metadata</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>ReadList</name>
+			<argumentList>
+				<argument>
+					<name>IdList</name>
+					<direction>in</direction>
+					<relatedStateVariable>IdList</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>ChannelList</name>
+					<direction>out</direction>
+					<relatedStateVariable>ChannelList</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>IdArray</name>
+			<argumentList>
+				<argument>
+					<name>Token</name>
+					<direction>out</direction>
+					<relatedStateVariable>IdArrayToken</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Array</name>
+					<direction>out</direction>
+					<relatedStateVariable>IdArray</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>IdArrayChanged</name>
+			<argumentList>
+				<argument>
+					<name>Token</name>
+					<direction>in</direction>
+					<relatedStateVariable>IdArrayToken</relatedStateVariable>
+				</argument>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>IdArrayChanged</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>ChannelsMax</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>ChannelsMax</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+		<action>
+			<name>ProtocolInfo</name>
+			<argumentList>
+				<argument>
+					<name>Value</name>
+					<direction>out</direction>
+					<relatedStateVariable>ProtocolInfo</relatedStateVariable>
+				</argument>
+			</argumentList>
+		</action>
+	</actionList>
+	<serviceStateTable>
+		<stateVariable sendEvents="yes">
+			<name>Uri</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>Metadata</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>TransportState</name>
+			<dataType>string</dataType>
+			<allowedValueList>
+				<allowedValue>Playing</allowedValue>
+				<allowedValue>Paused</allowedValue>
+				<allowedValue>Stopped</allowedValue>
+				<allowedValue>Buffering</allowedValue>
+			</allowedValueList>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>Id</name>
+			<dataType>ui4</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>IdArray</name>
+			<dataType>bin.base64</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>ChannelsMax</name>
+			<dataType>ui4</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="yes">
+			<name>ProtocolInfo</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>Relative</name>
+			<dataType>i4</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>Absolute</name>
+			<dataType>ui4</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>IdList</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>ChannelList</name>
+			<dataType>string</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>IdArrayToken</name>
+			<dataType>ui4</dataType>
+		</stateVariable>
+		<stateVariable sendEvents="no">
+			<name>IdArrayChanged</name>
+			<dataType>boolean</dataType>
+		</stateVariable>
+	</serviceStateTable>
+</scpd>
+`
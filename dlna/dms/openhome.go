@@ -0,0 +1,1126 @@
+package dms
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/dlna"
+	"github.com/anacrolix/dms/mpris"
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// The OpenHome services, offered for the OpenHomeRenderer, so that OpenHome control points such as
+// Linn Kazoo and Lumin queue music and tune radio on it through dms.
+var openHomeServices = []*service{
+	{
+		Service: upnp.Service{
+			ServiceType: "urn:av-openhome-org:service:Product:1",
+			ServiceId:   "urn:av-openhome-org:serviceId:Product",
+			EventSubURL: "/evt/Product",
+		},
+		SCPD: openHomeProductDescription,
+	},
+	{
+		Service: upnp.Service{
+			ServiceType: "urn:av-openhome-org:service:Playlist:1",
+			ServiceId:   "urn:av-openhome-org:serviceId:Playlist",
+			EventSubURL: "/evt/Playlist",
+		},
+		SCPD: openHomePlaylistDescription,
+	},
+	{
+		Service: upnp.Service{
+			ServiceType: "urn:av-openhome-org:service:Radio:1",
+			ServiceId:   "urn:av-openhome-org:serviceId:Radio",
+			EventSubURL: "/evt/Radio",
+		},
+		SCPD: openHomeRadioDescription,
+	},
+}
+
+// Errors of the OpenHome Playlist and Radio services.
+const (
+	openHomeIDNotFoundErrorCode      = 800
+	openHomePlaylistFullErrorCode    = 801
+	openHomeIndexOutOfRangeErrorCode = 802
+)
+
+const (
+	// The most tracks the Playlist holds.
+	openHomeTracksMax = 1000
+	// How often the renderer is asked what it's doing while something's played on it, so that the
+	// Playlist moves on when a track ends.
+	openHomePollInterval = 2 * time.Second
+	// How long the renderer is given to start playing before it's taken to have finished.
+	openHomeStartGrace = 5 * time.Second
+	// What the Playlist and Radio accept: whatever the renderer does.
+	openHomeProtocolInfo = "http-get:*:*:*"
+)
+
+// The sources of the Product service, by index.
+const (
+	openHomePlaylistSource = iota
+	openHomeRadioSource
+)
+
+var openHomeSources = []string{"Playlist", "Radio"}
+
+// A track in the Playlist, or a channel of the Radio.
+type openHomeTrack struct {
+	id       uint32
+	uri      string
+	metadata string
+}
+
+// The state of the OpenHome services offered for the OpenHomeRenderer.
+type openHomePlayer struct {
+	mu      sync.Mutex
+	standby bool
+	// One of the openHome*Source constants.
+	source int
+	tracks []openHomeTrack
+	// The ID of the last track inserted. IDs start at 1, as 0 is before the first track.
+	lastID uint32
+	// The ID of the current track, or 0 if there isn't one.
+	trackID         uint32
+	repeat, shuffle bool
+	// Changed whenever the tracks are, so control points can tell whether their IdArray is current.
+	token uint32
+	// The Radio channel, and its ID, if it was set from one of the RemoteStreams.
+	channel openHomeTrack
+	// The TransportState of the source, one of the mpris PlaybackStatus values, which are the
+	// same. Empty until something's played.
+	state string
+	// When the renderer was last told to play.
+	started time.Time
+	// Serializes what's asked of the renderer, so that what it ends up doing was asked last.
+	playMu sync.Mutex
+	// Serializes events, so that subscribers are sent the latest state last.
+	eventMu sync.Mutex
+}
+
+// Returns the TransportState of the source. The caller holds mu.
+func (me *openHomePlayer) transportState(source int) string {
+	if me.source != source || me.state == "" {
+		return mpris.Stopped
+	}
+	return me.state
+}
+
+// Returns the index of the track with the ID in the Playlist, or -1. The caller holds mu.
+func (me *openHomePlayer) trackIndex(id uint32) int {
+	for i, t := range me.tracks {
+		if t.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the ID of the track delta tracks from the current one, following shuffle and repeat,
+// or 0 if the Playlist ends. The caller holds mu.
+func (me *openHomePlayer) nextTrack(delta int) uint32 {
+	n := len(me.tracks)
+	if n == 0 {
+		return 0
+	}
+	cur := me.trackIndex(me.trackID)
+	if me.shuffle && n > 1 {
+		i := rand.Intn(n - 1)
+		if i >= cur && cur >= 0 {
+			i++
+		}
+		return me.tracks[i].id
+	}
+	i := cur + delta
+	if cur < 0 {
+		i = 0
+	}
+	switch {
+	case i >= n && me.repeat:
+		i = 0
+	case i >= n:
+		return 0
+	case i < 0 && me.repeat:
+		i = n - 1
+	case i < 0:
+		i = 0
+	}
+	return me.tracks[i].id
+}
+
+// Returns the IdArray of the IDs: each as 4 big-endian bytes, in base64.
+func openHomeIDArray(ids []uint32) string {
+	b := make([]byte, 4*len(ids))
+	for i, id := range ids {
+		binary.BigEndian.PutUint32(b[4*i:], id)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// Returns the IDs in the space separated IdList of ReadList.
+func parseOpenHomeIDList(s string) (ret []uint32, err error) {
+	for _, f := range strings.Fields(s) {
+		id, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return nil, upnp.Errorf(upnp.ArgumentValueInvalidErrorCode, "bad Id %q", f)
+		}
+		ret = append(ret, uint32(id))
+	}
+	return
+}
+
+type openHomeEntry struct {
+	XMLName  xml.Name `xml:"Entry"`
+	ID       uint32   `xml:"Id"`
+	URI      string   `xml:"Uri,omitempty"`
+	Metadata string
+}
+
+// Returns the TrackList or ChannelList of ReadList, named by name.
+func openHomeEntryList(name string, entries []openHomeEntry) (string, error) {
+	b, err := xml.Marshal(struct {
+		XMLName xml.Name
+		Entries []openHomeEntry
+	}{xml.Name{Local: name}, entries})
+	return string(b), err
+}
+
+// Returns the OpenHomeRenderer, by IP or name, once it has announced itself.
+func (srv *Server) openHomeRenderer() (string, rendererInfo, error) {
+	for ip, info := range srv.renderers.infos() {
+		if (ip == srv.OpenHomeRenderer || info.name == srv.OpenHomeRenderer) && info.canPlay() {
+			return ip, info, nil
+		}
+	}
+	go srv.searchRenderers()
+	return "", rendererInfo{}, upnp.Errorf(upnp.ActionFailedErrorCode, "renderer %q hasn't been found", srv.OpenHomeRenderer)
+}
+
+// Plays the URI on the OpenHomeRenderer, or invokes the transport action if it's empty. The caller
+// holds playMu.
+func (srv *Server) openHomeDo(action, uri, metadata string) error {
+	ip, info, err := srv.openHomeRenderer()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), playToTimeout)
+	defer cancel()
+	if uri != "" {
+		err = srv.renderers.play(ctx, info, uri, metadata)
+	} else {
+		err = srv.renderers.transport(ctx, info, action)
+	}
+	if err != nil {
+		return upnp.Errorf(upnp.ActionFailedErrorCode, err.Error())
+	}
+	srv.Logger.Levelf(log.Debug, "%s on renderer at %v from OpenHome", action, ip)
+	return nil
+}
+
+// Changes the state of the OpenHome services, and sends it to their subscribers.
+func (srv *Server) openHomeUpdate(change func(me *openHomePlayer)) {
+	me := &srv.openHome
+	me.mu.Lock()
+	change(me)
+	me.mu.Unlock()
+	go srv.openHomeEvent("", "Product", "Playlist", "Radio")
+}
+
+// Plays the track of the Playlist with the ID. The caller holds playMu.
+func (srv *Server) openHomePlayTrack(id uint32) error {
+	me := &srv.openHome
+	me.mu.Lock()
+	i := me.trackIndex(id)
+	var t openHomeTrack
+	if i >= 0 {
+		t = me.tracks[i]
+	}
+	me.mu.Unlock()
+	if i < 0 {
+		return upnp.Errorf(openHomeIDNotFoundErrorCode, "no track with Id %d", id)
+	}
+	if err := srv.openHomeDo("Play", t.uri, t.metadata); err != nil {
+		return err
+	}
+	srv.openHomeUpdate(func(me *openHomePlayer) {
+		me.standby = false
+		me.source = openHomePlaylistSource
+		me.trackID = id
+		me.state = mpris.Playing
+		me.started = time.Now()
+	})
+	return nil
+}
+
+// Resumes the source if it's paused, or plays it from its current track or channel.
+func (srv *Server) openHomePlay(source int) error {
+	me := &srv.openHome
+	me.playMu.Lock()
+	defer me.playMu.Unlock()
+	me.mu.Lock()
+	paused := me.transportState(source) == mpris.Paused
+	id := me.trackID
+	if id == 0 || me.trackIndex(id) < 0 {
+		id = me.nextTrack(1)
+	}
+	channel := me.channel
+	me.mu.Unlock()
+	if paused {
+		if err := srv.openHomeDo("Play", "", ""); err != nil {
+			return err
+		}
+		srv.openHomeUpdate(func(me *openHomePlayer) {
+			me.state = mpris.Playing
+			me.started = time.Now()
+		})
+		return nil
+	}
+	if source == openHomePlaylistSource {
+		if id == 0 {
+			return nil
+		}
+		return srv.openHomePlayTrack(id)
+	}
+	if channel.uri == "" {
+		return nil
+	}
+	if err := srv.openHomeDo("Play", channel.uri, channel.metadata); err != nil {
+		return err
+	}
+	srv.openHomeUpdate(func(me *openHomePlayer) {
+		me.standby = false
+		me.source = openHomeRadioSource
+		me.state = mpris.Playing
+		me.started = time.Now()
+	})
+	return nil
+}
+
+// Pauses or stops the source, if it's what's played.
+func (srv *Server) openHomeTransport(source int, action string) error {
+	me := &srv.openHome
+	me.playMu.Lock()
+	defer me.playMu.Unlock()
+	me.mu.Lock()
+	state := me.transportState(source)
+	me.mu.Unlock()
+	if state == mpris.Stopped {
+		return nil
+	}
+	if err := srv.openHomeDo(action, "", ""); err != nil {
+		return err
+	}
+	srv.openHomeUpdate(func(me *openHomePlayer) {
+		me.state = mpris.Stopped
+		if action == "Pause" {
+			me.state = mpris.Paused
+		}
+	})
+	return nil
+}
+
+// Seeks within what the source is playing, to seconds from the start, or from where it is if
+// relative.
+func (srv *Server) openHomeSeek(source int, seconds int, relative bool) error {
+	me := &srv.openHome
+	me.playMu.Lock()
+	defer me.playMu.Unlock()
+	me.mu.Lock()
+	state := me.transportState(source)
+	me.mu.Unlock()
+	if state == mpris.Stopped {
+		return upnp.Errorf(upnp.ActionFailedErrorCode, "nothing is playing")
+	}
+	_, info, err := srv.openHomeRenderer()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), playToTimeout)
+	defer cancel()
+	if err := srv.renderers.seek(ctx, info, seconds, relative); err != nil {
+		return upnp.Errorf(upnp.ActionFailedErrorCode, err.Error())
+	}
+	return nil
+}
+
+// Seeks on the renderer with its AVTransport, or its OpenHome Playlist.
+func (me *renderers) seek(ctx context.Context, info rendererInfo, seconds int, relative bool) error {
+	if info.avTransport.control == nil {
+		action := "SeekSecondAbsolute"
+		if relative {
+			action = "SeekSecondRelative"
+		}
+		_, err := me.action(ctx, info.playlist, action, [2]string{"Value", strconv.Itoa(seconds)})
+		return err
+	}
+	target := time.Duration(seconds) * time.Second
+	if relative {
+		b, err := me.action(ctx, info.avTransport, "GetPositionInfo", [2]string{"InstanceID", "0"})
+		if err != nil {
+			return err
+		}
+		var resp struct {
+			RelTime string `xml:"Body>GetPositionInfoResponse>RelTime"`
+		}
+		if err := xml.Unmarshal(b, &resp); err != nil {
+			return fmt.Errorf("parsing GetPositionInfo response: %w", err)
+		}
+		pos, err := dlna.ParseNPTTime(resp.RelTime)
+		if err != nil {
+			return fmt.Errorf("parsing RelTime: %w", err)
+		}
+		if target += pos; target < 0 {
+			target = 0
+		}
+	}
+	_, err := me.action(ctx, info.avTransport, "Seek",
+		[2]string{"InstanceID", "0"},
+		[2]string{"Unit", "REL_TIME"},
+		[2]string{"Target", dlna.FormatNPTTime(target)},
+	)
+	return err
+}
+
+// Plays the track delta tracks from the current one, or stops if the Playlist ends.
+func (srv *Server) openHomeSkip(delta int) error {
+	me := &srv.openHome
+	me.playMu.Lock()
+	defer me.playMu.Unlock()
+	me.mu.Lock()
+	id := me.nextTrack(delta)
+	me.mu.Unlock()
+	if id != 0 {
+		return srv.openHomePlayTrack(id)
+	}
+	return srv.openHomeStopped()
+}
+
+// Stops the renderer if a source is played on it, such as when the source changes or it's put in
+// standby. The caller holds playMu.
+func (srv *Server) openHomeStopped() error {
+	me := &srv.openHome
+	me.mu.Lock()
+	playing := me.state != "" && me.state != mpris.Stopped
+	me.mu.Unlock()
+	if !playing {
+		return nil
+	}
+	if err := srv.openHomeDo("Stop", "", ""); err != nil {
+		return err
+	}
+	srv.openHomeUpdate(func(me *openHomePlayer) {
+		me.state = mpris.Stopped
+	})
+	return nil
+}
+
+// Returns the Radio channels, one for each of the RemoteStreams, with IDs from 1. Their metadata
+// has the URLs renderers reach the server at through host.
+func (srv *Server) openHomeChannels(host string) (ret []openHomeTrack) {
+	cds := srv.apiContentDirectory()
+	for i, rs := range srv.remoteStreams() {
+		item, ok := cds.remoteStreamItem(rs, i, host, "").(upnpav.Item)
+		if !ok {
+			continue
+		}
+		metadata, err := xml.Marshal(item)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, openHomeTrack{
+			id:       uint32(i + 1),
+			uri:      item.Res[0].URL,
+			metadata: didl_lite(string(metadata)),
+		})
+	}
+	return
+}
+
+// Returns the IDs of the Radio channels, and a token that changes when the RemoteStreams do.
+func (srv *Server) openHomeChannelIDs() (ids []uint32, token uint32) {
+	h := fnv.New32a()
+	for i, rs := range srv.remoteStreams() {
+		ids = append(ids, uint32(i+1))
+		fmt.Fprintf(h, "%s\x00%s\x00", rs.Title, rs.URL)
+	}
+	return ids, h.Sum32()
+}
+
+// Returns the evented state variables of the OpenHome service, by name, and their values.
+func (srv *Server) openHomeVariables(service string) [][2]string {
+	me := &srv.openHome
+	switch service {
+	case "Product":
+		name := srv.settings().FriendlyName
+		room := srv.OpenHomeRenderer
+		if _, info, err := srv.openHomeRenderer(); err == nil && info.name != "" {
+			room = info.name
+		}
+		sourceXML, _ := openHomeSourceXML()
+		me.mu.Lock()
+		defer me.mu.Unlock()
+		return [][2]string{
+			{"ManufacturerName", "Matt Joiner <anacrolix@gmail.com>"},
+			{"ManufacturerInfo", ""},
+			{"ManufacturerUrl", projectURL},
+			{"ManufacturerImageUri", ""},
+			{"ModelName", rootDeviceModelName},
+			{"ModelInfo", Version()},
+			{"ModelUrl", projectURL},
+			{"ModelImageUri", ""},
+			{"ProductRoom", room},
+			{"ProductName", name},
+			{"ProductInfo", ""},
+			{"ProductUrl", ""},
+			{"ProductImageUri", ""},
+			{"Standby", strconv.FormatBool(me.standby)},
+			{"SourceIndex", strconv.Itoa(me.source)},
+			{"SourceCount", strconv.Itoa(len(openHomeSources))},
+			{"SourceXml", sourceXML},
+			{"Attributes", ""},
+		}
+	case "Playlist":
+		me.mu.Lock()
+		defer me.mu.Unlock()
+		ids := make([]uint32, 0, len(me.tracks))
+		for _, t := range me.tracks {
+			ids = append(ids, t.id)
+		}
+		return [][2]string{
+			{"TransportState", me.transportState(openHomePlaylistSource)},
+			{"Repeat", strconv.FormatBool(me.repeat)},
+			{"Shuffle", strconv.FormatBool(me.shuffle)},
+			{"Id", fmt.Sprint(me.trackID)},
+			{"IdArray", openHomeIDArray(ids)},
+			{"TracksMax", strconv.Itoa(openHomeTracksMax)},
+			{"ProtocolInfo", openHomeProtocolInfo},
+		}
+	case "Radio":
+		ids, _ := srv.openHomeChannelIDs()
+		me.mu.Lock()
+		defer me.mu.Unlock()
+		return [][2]string{
+			{"Uri", me.channel.uri},
+			{"Metadata", me.channel.metadata},
+			{"TransportState", me.transportState(openHomeRadioSource)},
+			{"Id", fmt.Sprint(me.channel.id)},
+			{"IdArray", openHomeIDArray(ids)},
+			{"ChannelsMax", strconv.Itoa(len(ids))},
+			{"ProtocolInfo", openHomeProtocolInfo},
+		}
+	}
+	return nil
+}
+
+// Returns the value of the evented state variable of the OpenHome service.
+func (srv *Server) openHomeVariable(service, name string) string {
+	for _, v := range srv.openHomeVariables(service) {
+		if v[0] == name {
+			return v[1]
+		}
+	}
+	return ""
+}
+
+// Sends the evented state variables of the OpenHome services to their subscribers, or only to the
+// subscriber with sid, for its initial event.
+func (srv *Server) openHomeEvent(sid string, services ...string) {
+	me := &srv.openHome
+	me.eventMu.Lock()
+	defer me.eventMu.Unlock()
+	for _, name := range services {
+		service, ok := srv.services[name]
+		if !ok {
+			continue
+		}
+		notifications := service.Notifications(sid)
+		if len(notifications) == 0 {
+			continue
+		}
+		var props []upnp.Property
+		for _, v := range srv.openHomeVariables(name) {
+			props = append(props, upnp.Property{Variable: upnp.Variable{XMLName: xml.Name{Local: v[0]}, Value: v[1]}})
+		}
+		for _, n := range notifications {
+			srv.notify(n, props)
+		}
+	}
+}
+
+// Asks the renderer what it's doing while a source is played on it: when a Playlist track has
+// finished the next is played, and being paused or stopped from its own remote is followed.
+func (srv *Server) followOpenHome() {
+	me := &srv.openHome
+	me.playMu.Lock()
+	defer me.playMu.Unlock()
+	me.mu.Lock()
+	state, source, started := me.state, me.source, me.started
+	me.mu.Unlock()
+	if state == "" || state == mpris.Stopped || time.Since(started) < openHomeStartGrace {
+		return
+	}
+	ip, info, err := srv.openHomeRenderer()
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rendererFetchTimeout)
+	status, err := srv.renderers.transportStatus(ctx, info)
+	cancel()
+	if err != nil {
+		srv.Logger.Levelf(log.Debug, "error getting transport state of renderer at %v: %v", ip, err)
+		return
+	}
+	if status == state {
+		return
+	}
+	if status == mpris.Stopped && state == mpris.Playing && source == openHomePlaylistSource {
+		me.mu.Lock()
+		next := me.nextTrack(1)
+		me.mu.Unlock()
+		if next != 0 {
+			err := srv.openHomePlayTrack(next)
+			if err == nil {
+				return
+			}
+			srv.Logger.Levelf(log.Warning, "error playing next track on renderer at %v: %v", ip, err)
+		}
+	}
+	srv.openHomeUpdate(func(me *openHomePlayer) {
+		me.state = status
+	})
+}
+
+// Follows the OpenHomeRenderer until the server is closed, if there is one.
+func (srv *Server) pollOpenHome() {
+	if srv.OpenHomeRenderer == "" {
+		return
+	}
+	for {
+		select {
+		case <-srv.closed:
+			return
+		case <-time.After(openHomePollInterval):
+		}
+		srv.followOpenHome()
+	}
+}
+
+// Adds the OpenHome services to those handled, if there's an OpenHomeRenderer.
+func (s *Server) initOpenHomeServices() {
+	if s.OpenHomeRenderer == "" {
+		return
+	}
+	product := &openHomeProductService{Server: s}
+	product.soapActions = product.actions()
+	playlist := &openHomePlaylistService{Server: s}
+	playlist.soapActions = playlist.actions()
+	radio := &openHomeRadioService{Server: s}
+	radio.soapActions = radio.actions()
+	s.services["Product"] = product
+	s.services["Playlist"] = playlist
+	s.services["Radio"] = radio
+}
+
+// Handles event subscriptions to the OpenHome services, if there's an OpenHomeRenderer.
+func (server *Server) initOpenHomeMux(mux *http.ServeMux) {
+	if server.OpenHomeRenderer == "" {
+		return
+	}
+	for _, s := range openHomeServices {
+		name := s.ServiceId[strings.LastIndex(s.ServiceId, ":")+1:]
+		mux.HandleFunc(s.EventSubURL, func(w http.ResponseWriter, r *http.Request) {
+			server.serveEventSub(w, r, name, func(sid string) {
+				server.openHomeEvent(sid, name)
+			})
+		})
+	}
+}
+
+// Returns the SourceXml of the Product service.
+func openHomeSourceXML() (string, error) {
+	type source struct {
+		Name    string
+		Type    string
+		Visible bool
+	}
+	var sources struct {
+		XMLName xml.Name `xml:"SourceList"`
+		Sources []source `xml:"Source"`
+	}
+	for _, name := range openHomeSources {
+		sources.Sources = append(sources.Sources, source{name, name, true})
+	}
+	b, err := xml.Marshal(sources)
+	return string(b), err
+}
+
+type openHomeProductService struct {
+	*Server
+	upnp.Eventing
+	soapActions
+}
+
+type openHomeValue struct {
+	Value string `soap:"required"`
+}
+
+type openHomeSourceIndex struct {
+	Index int `soap:"required"`
+}
+
+// Returns an action answering with the evented state variables, named by the prefix and the
+// arguments.
+func (me *openHomeProductService) variables(prefix string, args ...string) soapAction {
+	return newSOAPAction(func(r *http.Request) (ret []soapArg, err error) {
+		for _, arg := range args {
+			ret = append(ret, soapArg{Name: arg, Value: me.openHomeVariable("Product", prefix+arg)})
+		}
+		return
+	})
+}
+
+// Changes the source to the one at the index, stopping the renderer if another was played.
+func (me *openHomeProductService) setSource(i int) error {
+	if i < 0 || i >= len(openHomeSources) {
+		return upnp.Errorf(openHomeIndexOutOfRangeErrorCode, "no source %d", i)
+	}
+	p := &me.openHome
+	p.playMu.Lock()
+	defer p.playMu.Unlock()
+	p.mu.Lock()
+	changed := p.source != i
+	p.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	if err := me.openHomeStopped(); err != nil {
+		return err
+	}
+	me.openHomeUpdate(func(p *openHomePlayer) {
+		p.source = i
+		p.standby = false
+	})
+	return nil
+}
+
+// Returns the actions of the OpenHome Product service, which has the Playlist and Radio as its
+// sources.
+func (me *openHomeProductService) actions() soapActions {
+	return soapActions{
+		"Manufacturer": me.variables("Manufacturer", "Name", "Info", "Url", "ImageUri"),
+		"Model":        me.variables("Model", "Name", "Info", "Url", "ImageUri"),
+		"Product":      me.variables("Product", "Room", "Name", "Info", "Url", "ImageUri"),
+		"Standby":      me.variables("", "Standby"),
+		"SourceCount":  me.variables("", "SourceCount"),
+		"SourceXml":    me.variables("", "SourceXml"),
+		"SourceIndex":  me.variables("", "SourceIndex"),
+		"Attributes":   me.variables("", "Attributes"),
+		"SourceXmlChangeCount": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			return []soapArg{{Name: "Value", Value: "0"}}, nil
+		}),
+		"SetStandby": newSOAPAction(func(args *openHomeValue, r *http.Request) ([]soapArg, error) {
+			standby, err := strconv.ParseBool(args.Value)
+			if err != nil {
+				return nil, upnp.Errorf(upnp.ArgumentValueInvalidErrorCode, "bad Value %q", args.Value)
+			}
+			p := &me.openHome
+			p.playMu.Lock()
+			defer p.playMu.Unlock()
+			if standby {
+				if err := me.openHomeStopped(); err != nil {
+					return nil, err
+				}
+			}
+			me.openHomeUpdate(func(p *openHomePlayer) {
+				p.standby = standby
+			})
+			return nil, nil
+		}),
+		"SetSourceIndex": newSOAPAction(func(args *openHomeValue, r *http.Request) ([]soapArg, error) {
+			i, err := strconv.Atoi(args.Value)
+			if err != nil {
+				return nil, upnp.Errorf(upnp.ArgumentValueInvalidErrorCode, "bad Value %q", args.Value)
+			}
+			return nil, me.setSource(i)
+		}),
+		"SetSourceIndexByName": newSOAPAction(func(args *openHomeValue, r *http.Request) ([]soapArg, error) {
+			for i, name := range openHomeSources {
+				if name == args.Value {
+					return nil, me.setSource(i)
+				}
+			}
+			return nil, upnp.Errorf(upnp.ArgumentValueInvalidErrorCode, "no source %q", args.Value)
+		}),
+		"Source": newSOAPAction(func(args *openHomeSourceIndex, r *http.Request) ([]soapArg, error) {
+			if args.Index < 0 || args.Index >= len(openHomeSources) {
+				return nil, upnp.Errorf(openHomeIndexOutOfRangeErrorCode, "no source %d", args.Index)
+			}
+			name := openHomeSources[args.Index]
+			return []soapArg{
+				{Name: "SystemName", Value: name},
+				{Name: "Type", Value: name},
+				{Name: "Name", Value: name},
+				{Name: "Visible", Value: "true"},
+			}, nil
+		}),
+	}
+}
+
+type openHomePlaylistService struct {
+	*Server
+	upnp.Eventing
+	soapActions
+}
+
+type openHomeID struct {
+	Value uint32 `soap:"required"`
+}
+
+type openHomeSeekSecond struct {
+	Value int `soap:"required"`
+}
+
+type openHomeRead struct {
+	ID uint32 `xml:"Id" soap:"required"`
+}
+
+type openHomeReadList struct {
+	IDList string `xml:"IdList" soap:"required"`
+}
+
+type openHomeIDArrayChanged struct {
+	Token uint32 `soap:"required"`
+}
+
+type openHomeInsert struct {
+	AfterID  uint32 `xml:"AfterId" soap:"required"`
+	URI      string `xml:"Uri" soap:"required"`
+	Metadata string `soap:"required"`
+}
+
+// Returns an action setting the Repeat or Shuffle of the Playlist.
+func (me *openHomePlaylistService) setMode(set func(p *openHomePlayer, on bool)) soapAction {
+	return newSOAPAction(func(args *openHomeValue, r *http.Request) ([]soapArg, error) {
+		on, err := strconv.ParseBool(args.Value)
+		if err != nil {
+			return nil, upnp.Errorf(upnp.ArgumentValueInvalidErrorCode, "bad Value %q", args.Value)
+		}
+		me.openHomeUpdate(func(p *openHomePlayer) {
+			set(p, on)
+		})
+		return nil, nil
+	})
+}
+
+// Returns an action answering with the evented state variable.
+func (me *openHomePlaylistService) variable(name string) soapAction {
+	return newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+		return []soapArg{{Name: "Value", Value: me.openHomeVariable("Playlist", name)}}, nil
+	})
+}
+
+// Returns the actions of the OpenHome Playlist service, a queue of tracks played on the renderer
+// one after another.
+func (me *openHomePlaylistService) actions() soapActions {
+	p := &me.openHome
+	return soapActions{
+		"Play": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			return nil, me.openHomePlay(openHomePlaylistSource)
+		}),
+		"Pause": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			return nil, me.openHomeTransport(openHomePlaylistSource, "Pause")
+		}),
+		"Stop": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			return nil, me.openHomeTransport(openHomePlaylistSource, "Stop")
+		}),
+		"Next": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			return nil, me.openHomeSkip(1)
+		}),
+		"Previous": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			return nil, me.openHomeSkip(-1)
+		}),
+		"SetRepeat": me.setMode(func(p *openHomePlayer, on bool) {
+			p.repeat = on
+		}),
+		"SetShuffle": me.setMode(func(p *openHomePlayer, on bool) {
+			p.shuffle = on
+		}),
+		"Repeat":         me.variable("Repeat"),
+		"Shuffle":        me.variable("Shuffle"),
+		"TransportState": me.variable("TransportState"),
+		"Id":             me.variable("Id"),
+		"TracksMax":      me.variable("TracksMax"),
+		"ProtocolInfo":   me.variable("ProtocolInfo"),
+		"SeekSecondAbsolute": newSOAPAction(func(args *openHomeSeekSecond, r *http.Request) ([]soapArg, error) {
+			return nil, me.openHomeSeek(openHomePlaylistSource, args.Value, false)
+		}),
+		"SeekSecondRelative": newSOAPAction(func(args *openHomeSeekSecond, r *http.Request) ([]soapArg, error) {
+			return nil, me.openHomeSeek(openHomePlaylistSource, args.Value, true)
+		}),
+		"SeekId": newSOAPAction(func(args *openHomeID, r *http.Request) ([]soapArg, error) {
+			p.playMu.Lock()
+			defer p.playMu.Unlock()
+			return nil, me.openHomePlayTrack(args.Value)
+		}),
+		"SeekIndex": newSOAPAction(func(args *openHomeID, r *http.Request) ([]soapArg, error) {
+			p.playMu.Lock()
+			defer p.playMu.Unlock()
+			p.mu.Lock()
+			var id uint32
+			if int(args.Value) < len(p.tracks) {
+				id = p.tracks[args.Value].id
+			}
+			p.mu.Unlock()
+			if id == 0 {
+				return nil, upnp.Errorf(openHomeIndexOutOfRangeErrorCode, "no track at index %d", args.Value)
+			}
+			return nil, me.openHomePlayTrack(id)
+		}),
+		"Read": newSOAPAction(func(args *openHomeRead, r *http.Request) ([]soapArg, error) {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			i := p.trackIndex(args.ID)
+			if i < 0 {
+				return nil, upnp.Errorf(openHomeIDNotFoundErrorCode, "no track with Id %d", args.ID)
+			}
+			return []soapArg{
+				{Name: "Uri", Value: p.tracks[i].uri},
+				{Name: "Metadata", Value: p.tracks[i].metadata},
+			}, nil
+		}),
+		"ReadList": newSOAPAction(func(args *openHomeReadList, r *http.Request) ([]soapArg, error) {
+			ids, err := parseOpenHomeIDList(args.IDList)
+			if err != nil {
+				return nil, err
+			}
+			var entries []openHomeEntry
+			p.mu.Lock()
+			for _, id := range ids {
+				// Tracks that have gone are left out.
+				if i := p.trackIndex(id); i >= 0 {
+					entries = append(entries, openHomeEntry{ID: id, URI: p.tracks[i].uri, Metadata: p.tracks[i].metadata})
+				}
+			}
+			p.mu.Unlock()
+			list, err := openHomeEntryList("TrackList", entries)
+			return []soapArg{{Name: "TrackList", Value: list}}, err
+		}),
+		"Insert": newSOAPAction(func(args *openHomeInsert, r *http.Request) ([]soapArg, error) {
+			var err error
+			var newID uint32
+			me.openHomeUpdate(func(p *openHomePlayer) {
+				i := 0
+				if args.AfterID != 0 {
+					if i = p.trackIndex(args.AfterID) + 1; i == 0 {
+						err = upnp.Errorf(openHomeIDNotFoundErrorCode, "no track with Id %d", args.AfterID)
+						return
+					}
+				}
+				if len(p.tracks) >= openHomeTracksMax {
+					err = upnp.Errorf(openHomePlaylistFullErrorCode, "playlist is full")
+					return
+				}
+				p.lastID++
+				newID = p.lastID
+				p.tracks = append(p.tracks[:i], append([]openHomeTrack{{newID, args.URI, args.Metadata}}, p.tracks[i:]...)...)
+				p.token++
+			})
+			if err != nil {
+				return nil, err
+			}
+			return []soapArg{{Name: "NewId", Value: fmt.Sprint(newID)}}, nil
+		}),
+		"DeleteId": newSOAPAction(func(args *openHomeID, r *http.Request) ([]soapArg, error) {
+			p.playMu.Lock()
+			defer p.playMu.Unlock()
+			p.mu.Lock()
+			i := p.trackIndex(args.Value)
+			current := args.Value == p.trackID && p.source == openHomePlaylistSource
+			p.mu.Unlock()
+			if i < 0 {
+				return nil, upnp.Errorf(openHomeIDNotFoundErrorCode, "no track with Id %d", args.Value)
+			}
+			if current {
+				if err := me.openHomeStopped(); err != nil {
+					return nil, err
+				}
+			}
+			me.openHomeUpdate(func(p *openHomePlayer) {
+				if i := p.trackIndex(args.Value); i >= 0 {
+					p.tracks = append(p.tracks[:i], p.tracks[i+1:]...)
+					p.token++
+				}
+				if p.trackID == args.Value {
+					p.trackID = 0
+				}
+			})
+			return nil, nil
+		}),
+		"DeleteAll": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			p.playMu.Lock()
+			defer p.playMu.Unlock()
+			p.mu.Lock()
+			playing := p.source == openHomePlaylistSource
+			p.mu.Unlock()
+			if playing {
+				if err := me.openHomeStopped(); err != nil {
+					return nil, err
+				}
+			}
+			me.openHomeUpdate(func(p *openHomePlayer) {
+				p.tracks = nil
+				p.trackID = 0
+				p.token++
+			})
+			return nil, nil
+		}),
+		"IdArray": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			p.mu.Lock()
+			token := p.token
+			p.mu.Unlock()
+			return []soapArg{
+				{Name: "Token", Value: fmt.Sprint(token)},
+				{Name: "Array", Value: me.openHomeVariable("Playlist", "IdArray")},
+			}, nil
+		}),
+		"IdArrayChanged": newSOAPAction(func(args *openHomeIDArrayChanged, r *http.Request) ([]soapArg, error) {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return []soapArg{{Name: "Value", Value: strconv.FormatBool(args.Token != p.token)}}, nil
+		}),
+	}
+}
+
+type openHomeRadioService struct {
+	*Server
+	upnp.Eventing
+	soapActions
+}
+
+type openHomeChannel struct {
+	URI      string `xml:"Uri" soap:"required"`
+	Metadata string `soap:"required"`
+}
+
+type openHomeSetID struct {
+	Value uint32 `soap:"required"`
+	URI   string `xml:"Uri" soap:"required"`
+}
+
+// Returns an action answering with the evented state variable.
+func (me *openHomeRadioService) variable(name string) soapAction {
+	return newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+		return []soapArg{{Name: "Value", Value: me.openHomeVariable("Radio", name)}}, nil
+	})
+}
+
+// Returns the channel of the RemoteStreams with the ID, with URLs reached through the host the
+// request was sent to.
+func (me *openHomeRadioService) channel(id uint32, r *http.Request) (openHomeTrack, error) {
+	for _, c := range me.openHomeChannels(r.Host) {
+		if c.id == id {
+			return c, nil
+		}
+	}
+	return openHomeTrack{}, upnp.Errorf(openHomeIDNotFoundErrorCode, "no channel with Id %d", id)
+}
+
+// Returns the actions of the OpenHome Radio service, which has the RemoteStreams as its channels.
+func (me *openHomeRadioService) actions() soapActions {
+	p := &me.openHome
+	return soapActions{
+		"Play": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			return nil, me.openHomePlay(openHomeRadioSource)
+		}),
+		"Pause": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			return nil, me.openHomeTransport(openHomeRadioSource, "Pause")
+		}),
+		"Stop": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			return nil, me.openHomeTransport(openHomeRadioSource, "Stop")
+		}),
+		"SeekSecondAbsolute": newSOAPAction(func(args *openHomeSeekSecond, r *http.Request) ([]soapArg, error) {
+			return nil, me.openHomeSeek(openHomeRadioSource, args.Value, false)
+		}),
+		"SeekSecondRelative": newSOAPAction(func(args *openHomeSeekSecond, r *http.Request) ([]soapArg, error) {
+			return nil, me.openHomeSeek(openHomeRadioSource, args.Value, true)
+		}),
+		"TransportState": me.variable("TransportState"),
+		"Id":             me.variable("Id"),
+		"ChannelsMax":    me.variable("ChannelsMax"),
+		"ProtocolInfo":   me.variable("ProtocolInfo"),
+		"Channel": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return []soapArg{
+				{Name: "Uri", Value: p.channel.uri},
+				{Name: "Metadata", Value: p.channel.metadata},
+			}, nil
+		}),
+		"SetChannel": newSOAPAction(func(args *openHomeChannel, r *http.Request) ([]soapArg, error) {
+			me.openHomeUpdate(func(p *openHomePlayer) {
+				p.channel = openHomeTrack{uri: args.URI, metadata: args.Metadata}
+			})
+			return nil, nil
+		}),
+		"SetId": newSOAPAction(func(args *openHomeSetID, r *http.Request) ([]soapArg, error) {
+			c, err := me.channel(args.Value, r)
+			if err != nil {
+				return nil, err
+			}
+			c.uri = args.URI
+			me.openHomeUpdate(func(p *openHomePlayer) {
+				p.channel = c
+			})
+			return nil, nil
+		}),
+		"Read": newSOAPAction(func(args *openHomeRead, r *http.Request) ([]soapArg, error) {
+			c, err := me.channel(args.ID, r)
+			if err != nil {
+				return nil, err
+			}
+			return []soapArg{{Name: "Metadata", Value: c.metadata}}, nil
+		}),
+		"ReadList": newSOAPAction(func(args *openHomeReadList, r *http.Request) ([]soapArg, error) {
+			ids, err := parseOpenHomeIDList(args.IDList)
+			if err != nil {
+				return nil, err
+			}
+			channels := me.openHomeChannels(r.Host)
+			var entries []openHomeEntry
+			for _, id := range ids {
+				for _, c := range channels {
+					if c.id == id {
+						entries = append(entries, openHomeEntry{ID: id, Metadata: c.metadata})
+					}
+				}
+			}
+			list, err := openHomeEntryList("ChannelList", entries)
+			return []soapArg{{Name: "ChannelList", Value: list}}, err
+		}),
+		"IdArray": newSOAPAction(func(r *http.Request) ([]soapArg, error) {
+			ids, token := me.openHomeChannelIDs()
+			return []soapArg{
+				{Name: "Token", Value: fmt.Sprint(token)},
+				{Name: "Array", Value: openHomeIDArray(ids)},
+			}, nil
+		}),
+		"IdArrayChanged": newSOAPAction(func(args *openHomeIDArrayChanged, r *http.Request) ([]soapArg, error) {
+			_, token := me.openHomeChannelIDs()
+			return []soapArg{{Name: "Value", Value: strconv.FormatBool(args.Token != token)}}, nil
+		}),
+	}
+}
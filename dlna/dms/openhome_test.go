@@ -0,0 +1,198 @@
+package dms
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/mpris"
+	"github.com/anacrolix/dms/upnp"
+)
+
+func TestOpenHomeNextTrack(t *testing.T) {
+	tracks := []openHomeTrack{{id: 3}, {id: 5}, {id: 9}}
+	for _, tc := range []struct {
+		current  uint32
+		delta    int
+		repeat   bool
+		expected uint32
+	}{
+		{0, 1, false, 3},
+		{3, 1, false, 5},
+		{9, 1, false, 0},
+		{9, 1, true, 3},
+		{5, -1, false, 3},
+		{3, -1, false, 3},
+		{3, -1, true, 9},
+		// The current track has been deleted.
+		{4, 1, false, 3},
+	} {
+		me := openHomePlayer{tracks: tracks, trackID: tc.current, repeat: tc.repeat}
+		if got := me.nextTrack(tc.delta); got != tc.expected {
+			t.Errorf("%+v: got %d", tc, got)
+		}
+	}
+	me := openHomePlayer{tracks: tracks, trackID: 5, shuffle: true}
+	for i := 0; i < 20; i++ {
+		if got := me.nextTrack(1); got == 5 || got == 0 {
+			t.Fatalf("shuffled to %d", got)
+		}
+	}
+	if got := (&openHomePlayer{}).nextTrack(1); got != 0 {
+		t.Errorf("got %d from an empty playlist", got)
+	}
+}
+
+func TestOpenHomeIDArray(t *testing.T) {
+	if got := openHomeIDArray([]uint32{1, 2}); got != "AAAAAQAAAAI=" {
+		t.Errorf("got %q", got)
+	}
+	if got := openHomeIDArray(nil); got != "" {
+		t.Errorf("got %q", got)
+	}
+	ids, err := parseOpenHomeIDList(" 1 2\t300 ")
+	if err != nil || len(ids) != 3 || ids[2] != 300 {
+		t.Errorf("got %v, %v", ids, err)
+	}
+	if _, err := parseOpenHomeIDList("1 x"); err == nil {
+		t.Error("parsed a bad IdList")
+	}
+}
+
+func TestOpenHomeServices(t *testing.T) {
+	srv := &Server{
+		Logger:           log.Default,
+		OpenHomeRenderer: "Hi-Fi",
+		RemoteStreams:    []RemoteStream{{Title: "Radio One", URL: "http://radio.example/one.mp3"}},
+	}
+	if err := srv.initServices(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.offeredServices()); n != len(services)+3 {
+		t.Errorf("offering %d services", n)
+	}
+	call := func(service, action, args string) ([]soapArg, error) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "http://192.168.1.2:1338"+serviceControlURL, nil)
+		return srv.services[service].(soapHandler).handleSOAP(action, []byte("<"+action+">"+args+"</"+action+">"), r)
+	}
+	value := func(service, action, args string) string {
+		t.Helper()
+		ret, err := call(service, action, args)
+		if err != nil {
+			t.Fatalf("%s#%s: %v", service, action, err)
+		}
+		if len(ret) == 0 {
+			return ""
+		}
+		return ret[len(ret)-1].Value
+	}
+	errorCode := func(err error) uint {
+		if e := upnp.ConvertError(err); e != nil {
+			return e.Code
+		}
+		return 0
+	}
+
+	// Nothing's played before the renderer has announced itself.
+	value("Playlist", "Insert", "<AfterId>0</AfterId><Uri>http://host/a.flac</Uri><Metadata>a</Metadata>")
+	if _, err := call("Playlist", "Play", ""); errorCode(err) != upnp.ActionFailedErrorCode {
+		t.Errorf("got %v", err)
+	}
+	avTransport, actions := newTestTransport(t, "urn:schemas-upnp-org:service:AVTransport:1", "STOPPED")
+	srv.renderers.byIP = map[string]*renderer{
+		"192.168.1.30": {rendererInfo: rendererInfo{name: "Hi-Fi", avTransport: avTransport}},
+	}
+
+	if id := value("Playlist", "Insert", "<AfterId>1</AfterId><Uri>http://host/b.flac</Uri><Metadata>b</Metadata>"); id != "2" {
+		t.Errorf("inserted %s", id)
+	}
+	if _, err := call("Playlist", "Insert", "<AfterId>7</AfterId><Uri>u</Uri><Metadata></Metadata>"); errorCode(err) != openHomeIDNotFoundErrorCode {
+		t.Errorf("got %v", err)
+	}
+	ret, _ := call("Playlist", "IdArray", "")
+	token := ret[0].Value
+	if array := ret[1].Value; token != "2" || array != "AAAAAQAAAAI=" {
+		t.Errorf("got IdArray %v", ret)
+	}
+	if list := value("Playlist", "ReadList", "<IdList>2 1 8</IdList>"); list != "<TrackList><Entry><Id>2</Id><Uri>http://host/b.flac</Uri><Metadata>b</Metadata></Entry><Entry><Id>1</Id><Uri>http://host/a.flac</Uri><Metadata>a</Metadata></Entry></TrackList>" {
+		t.Errorf("got TrackList %s", list)
+	}
+
+	value("Playlist", "Play", "")
+	if state, id := value("Playlist", "TransportState", ""), value("Playlist", "Id", ""); state != mpris.Playing || id != "1" {
+		t.Errorf("got %s, Id %s", state, id)
+	}
+	// The renderer is given time to start playing.
+	srv.followOpenHome()
+	if got := strings.Join(*actions, ","); got != "SetAVTransportURI,Play" {
+		t.Errorf("got actions %s", got)
+	}
+	// The renderer has finished the track, so the next is played, and then the playlist ends.
+	for _, expected := range []string{"2", "2"} {
+		srv.openHome.started = time.Now().Add(-time.Minute)
+		srv.followOpenHome()
+		if id := value("Playlist", "Id", ""); id != expected {
+			t.Errorf("got Id %s", id)
+		}
+	}
+	if got := strings.Join(*actions, ","); got != "SetAVTransportURI,Play,GetTransportInfo,SetAVTransportURI,Play,GetTransportInfo" {
+		t.Errorf("got actions %s", got)
+	}
+	if state := value("Playlist", "TransportState", ""); state != mpris.Stopped {
+		t.Errorf("got %s", state)
+	}
+	if value("Playlist", "IdArrayChanged", "<Token>"+token+"</Token>") != "false" {
+		t.Error("IdArray changed")
+	}
+	value("Playlist", "DeleteId", "<Value>1</Value>")
+	if value("Playlist", "IdArrayChanged", "<Token>"+token+"</Token>") != "true" {
+		t.Error("IdArray didn't change")
+	}
+	if _, err := call("Playlist", "SeekIndex", "<Value>1</Value>"); errorCode(err) != openHomeIndexOutOfRangeErrorCode {
+		t.Errorf("got %v", err)
+	}
+
+	if xml := value("Product", "SourceXml", ""); !strings.Contains(xml, "<Source><Name>Radio</Name><Type>Radio</Type><Visible>true</Visible></Source>") {
+		t.Errorf("got SourceXml %s", xml)
+	}
+	if ret, _ := call("Product", "Product", ""); ret[0].Value != "Hi-Fi" {
+		t.Errorf("got %v", ret)
+	}
+	value("Product", "SetSourceIndexByName", "<Value>Radio</Value>")
+	if index := value("Product", "SourceIndex", ""); index != "1" {
+		t.Errorf("got SourceIndex %s", index)
+	}
+
+	if n := value("Radio", "ChannelsMax", ""); n != "1" {
+		t.Errorf("got ChannelsMax %s", n)
+	}
+	if metadata := value("Radio", "Read", "<Id>1</Id>"); !strings.Contains(metadata, "Radio One") || !strings.Contains(metadata, "audioBroadcast") {
+		t.Errorf("got Metadata %s", metadata)
+	}
+	if _, err := call("Radio", "SetId", "<Value>2</Value><Uri>u</Uri>"); errorCode(err) != openHomeIDNotFoundErrorCode {
+		t.Errorf("got %v", err)
+	}
+	value("Radio", "SetId", "<Value>1</Value><Uri>http://radio.example/one.mp3</Uri>")
+	value("Radio", "Play", "")
+	if ret, _ := call("Radio", "Channel", ""); ret[0].Value != "http://radio.example/one.mp3" || !strings.Contains(ret[1].Value, "Radio One") {
+		t.Errorf("got %v", ret)
+	}
+	if state := value("Radio", "TransportState", ""); state != mpris.Playing {
+		t.Errorf("got %s", state)
+	}
+	if state := value("Playlist", "TransportState", ""); state != mpris.Stopped {
+		t.Errorf("got Playlist %s", state)
+	}
+	// Going into standby stops the renderer.
+	value("Product", "SetStandby", "<Value>true</Value>")
+	if got := (*actions)[len(*actions)-1]; got != "Stop" {
+		t.Errorf("got action %s", got)
+	}
+	if standby := value("Product", "Standby", ""); standby != "true" {
+		t.Errorf("got Standby %s", standby)
+	}
+}
@@ -0,0 +1,283 @@
+package dms
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+const (
+	parentalPath  = "/parental"
+	apiUnlockPath = "/api/unlock"
+	// How long clients stay unlocked if ParentalUnlockDuration isn't given.
+	defaultParentalUnlockDuration = time.Hour
+	// Wrong PINs in a row from a client after which it's refused unlocking for parentalPINBlock,
+	// so that a PIN can't be guessed.
+	parentalPINAttempts = 5
+	parentalPINBlock    = time.Minute
+	// How long a client's wrong PINs are remembered after its last.
+	parentalPINForget = time.Hour
+)
+
+// Clients unlocked to see the ProtectedContainers, by IP.
+type parentalLocks struct {
+	mu sync.Mutex
+	// When each unlocked client is locked again.
+	unlocked map[string]time.Time
+	// The wrong PINs given by each client unlocking, by IP.
+	failures map[string]parentalPINFailures
+}
+
+// Wrong PINs given in a row by a client, and until when it's refused unlocking after too many.
+type parentalPINFailures struct {
+	count        int
+	last         time.Time
+	blockedUntil time.Time
+}
+
+// A client that's unlocked, as listed in the web UI and API.
+type parentalUnlock struct {
+	IP    string
+	Until time.Time
+}
+
+// Checks the ProtectedContainers, which need a ParentalPIN to unlock.
+func (srv *Server) initProtectedContainers() error {
+	for _, c := range srv.ProtectedContainers {
+		if !path.IsAbs(c) || path.Clean(c) != c || c == "/" {
+			return fmt.Errorf("bad protected container %q", c)
+		}
+	}
+	if len(srv.ProtectedContainers) != 0 && len(srv.ParentalPIN) < 4 {
+		return errors.New("protected containers need a parental PIN of at least 4 characters")
+	}
+	if srv.ParentalUnlockDuration < 0 {
+		return fmt.Errorf("bad parental unlock duration %v", srv.ParentalUnlockDuration)
+	}
+	return nil
+}
+
+// Returns the ProtectedContainers, unless the client at the IP is unlocked.
+func (srv *Server) lockedContainers(ip string, now time.Time) []string {
+	protected := srv.settings().ProtectedContainers
+	if len(protected) == 0 {
+		return nil
+	}
+	l := &srv.parentalLocks
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Before(l.unlocked[ip]) {
+		return nil
+	}
+	delete(l.unlocked, ip)
+	return protected
+}
+
+// Unlocks the ProtectedContainers for the client at the IP for ParentalUnlockDuration, if the PIN
+// given by the client at from, which is unlocking it, is right. Wrong PINs are counted against
+// from, so one client guessing doesn't stop others unlocking. Renderers are told the containers
+// have changed, so they list them again.
+func (srv *Server) unlockClient(ip, from, pin string, now time.Time) error {
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("bad client address %q", ip)
+	}
+	s := srv.settings()
+	want, protected, d := s.ParentalPIN, s.ProtectedContainers, s.ParentalUnlockDuration
+	if len(protected) == 0 {
+		return errors.New("there are no protected containers")
+	}
+	if d == 0 {
+		d = defaultParentalUnlockDuration
+	}
+	l := &srv.parentalLocks
+	l.mu.Lock()
+	l.pruneFailures(now)
+	f := l.failures[from]
+	if now.Before(f.blockedUntil) {
+		l.mu.Unlock()
+		return fmt.Errorf("too many wrong PINs, try again after %s", f.blockedUntil.Format("15:04:05"))
+	}
+	if subtle.ConstantTimeCompare([]byte(pin), []byte(want)) != 1 {
+		f.count++
+		f.last = now
+		if f.count >= parentalPINAttempts {
+			f.count = 0
+			f.blockedUntil = now.Add(parentalPINBlock)
+		}
+		if l.failures == nil {
+			l.failures = make(map[string]parentalPINFailures)
+		}
+		l.failures[from] = f
+		l.mu.Unlock()
+		return errors.New("wrong PIN")
+	}
+	delete(l.failures, from)
+	if l.unlocked == nil {
+		l.unlocked = make(map[string]time.Time)
+	}
+	l.unlocked[ip] = now.Add(d)
+	l.mu.Unlock()
+	for _, c := range protected {
+		srv.containerChanged(c)
+	}
+	return nil
+}
+
+// Forgets the wrong PINs of clients that have given none for parentalPINForget, so that clients
+// that gave up aren't kept forever. Must be called with mu held.
+func (me *parentalLocks) pruneFailures(now time.Time) {
+	for ip, f := range me.failures {
+		if now.Sub(f.last) >= parentalPINForget && !now.Before(f.blockedUntil) {
+			delete(me.failures, ip)
+		}
+	}
+}
+
+// Locks the ProtectedContainers for the client at the IP again.
+func (srv *Server) lockClient(ip string) {
+	l := &srv.parentalLocks
+	l.mu.Lock()
+	delete(l.unlocked, ip)
+	l.mu.Unlock()
+	for _, c := range srv.settings().ProtectedContainers {
+		srv.containerChanged(c)
+	}
+}
+
+// Returns the clients that are unlocked, by IP.
+func (srv *Server) unlockedClients(now time.Time) (ret []parentalUnlock) {
+	l := &srv.parentalLocks
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, until := range l.unlocked {
+		if now.Before(until) {
+			ret = append(ret, parentalUnlock{ip, until})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].IP < ret[j].IP })
+	return
+}
+
+// Whether the object at the path is within one of the containers that are locked for the client.
+func (me ClientPrefs) inLocked(objectPath string) bool {
+	for _, c := range me.locked {
+		if strings.HasPrefix(objectPath, c+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the object at the path is one of the containers that are locked for the client, which
+// is listed as empty.
+func (me ClientPrefs) isLocked(objectPath string) bool {
+	for _, c := range me.locked {
+		if objectPath == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the object, such as an item in Recently Added, refers to media within a locked
+// container.
+func (me ClientPrefs) refersToLocked(obj interface{}) bool {
+	item, ok := obj.(upnpav.Item)
+	return ok && item.RefID != "" && me.inLocked(objectIDPath(item.RefID))
+}
+
+// Returns the objects the client may see, with locked containers empty, as Browse and Search
+// give them, for the web UI and API.
+func (me ClientPrefs) visible(objs []interface{}) []interface{} {
+	objs = me.filter(objs)
+	ret := make([]interface{}, 0, len(objs))
+	for _, obj := range objs {
+		ret = append(ret, me.arrange(obj))
+	}
+	return ret
+}
+
+// Lets clients be unlocked to see the ProtectedContainers with the PIN, and locked again.
+func (srv *Server) serveParental(w http.ResponseWriter, r *http.Request) {
+	if !srv.authorizeAPI(w, r, APIScopeBrowse) {
+		return
+	}
+	data := struct {
+		Clients  []clientsPageClient
+		Unlocked []parentalUnlock
+		Error    error
+	}{}
+	if r.Method == "POST" {
+		if !SameOrigin(r) {
+			http.Error(w, "cross-origin request", http.StatusForbidden)
+			return
+		}
+		ip := r.FormValue("ip")
+		if r.FormValue("lock") != "" {
+			srv.lockClient(ip)
+			srv.requestLogger(r).Printf("locked protected containers for %s", ip)
+		} else if data.Error = srv.unlockClient(ip, requestClientIP(r), r.FormValue("pin"), time.Now()); data.Error == nil {
+			srv.requestLogger(r).Printf("unlocked protected containers for %s", ip)
+		}
+	}
+	data.Clients = srv.clientsPageClients()
+	data.Unlocked = srv.unlockedClients(time.Now())
+	w.Header().Set("content-type", "text/html")
+	if err := parentalTmpl.Execute(w, data); err != nil {
+		srv.Logger.Print(err)
+	}
+}
+
+// The body of an unlock request to the API.
+type apiUnlock struct {
+	IP  string
+	PIN string
+}
+
+// Lists the unlocked clients, unlocks the one in the JSON apiUnlock in the body on POST, or locks
+// the one with the ip query parameter again on DELETE.
+func (me *Server) serveAPIUnlock(w http.ResponseWriter, r *http.Request) {
+	if !me.authorizeAPI(w, r, APIScopeBrowse) {
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		var req apiUnlock
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			me.writeAPIError(w, r, upnp.Errorf(upnp.ArgumentValueInvalidErrorCode, "bad unlock: %v", err))
+			return
+		}
+		if err := me.unlockClient(req.IP, requestClientIP(r), req.PIN, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		me.requestLogger(r).Printf("unlocked protected containers for %s", req.IP)
+	case "DELETE":
+		ip := r.URL.Query().Get("ip")
+		me.lockClient(ip)
+		me.requestLogger(r).Printf("locked protected containers for %s", ip)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ret := me.unlockedClients(time.Now())
+	if ret == nil {
+		ret = []parentalUnlock{}
+	}
+	me.writeAPIResponse(w, r, ret)
+}
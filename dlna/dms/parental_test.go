@@ -0,0 +1,153 @@
+package dms
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestParentalLocks(t *testing.T) {
+	srv := &Server{ProtectedContainers: []string{"/video/grown-ups"}, ParentalPIN: "4711"}
+	if err := srv.initProtectedContainers(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if srv.lockedContainers("192.168.1.30", now) == nil {
+		t.Fatal("not locked")
+	}
+	if srv.unlockClient("192.168.1.30", "192.168.1.20", "1234", now) == nil {
+		t.Fatal("unlocked with the wrong PIN")
+	}
+	if err := srv.unlockClient("192.168.1.30", "192.168.1.20", "4711", now); err != nil {
+		t.Fatal(err)
+	}
+	if srv.lockedContainers("192.168.1.30", now) != nil || srv.lockedContainers("192.168.1.31", now) == nil {
+		t.Error("wrong clients unlocked")
+	}
+	if srv.lockedContainers("192.168.1.30", now.Add(defaultParentalUnlockDuration)) == nil {
+		t.Error("still unlocked after the unlock duration")
+	}
+	// Wrong PINs block the client giving them, and not others.
+	for i := 0; i < parentalPINAttempts; i++ {
+		srv.unlockClient("192.168.1.31", "192.168.1.66", "0000", now)
+	}
+	if srv.unlockClient("192.168.1.31", "192.168.1.66", "4711", now) == nil {
+		t.Error("unlocked after too many wrong PINs")
+	}
+	if err := srv.unlockClient("192.168.1.32", "192.168.1.20", "4711", now); err != nil {
+		t.Errorf("blocked by another client's wrong PINs: %v", err)
+	}
+	if err := srv.unlockClient("192.168.1.31", "192.168.1.66", "4711", now.Add(parentalPINBlock)); err != nil {
+		t.Error(err)
+	}
+	// A client's wrong PINs are forgotten in time.
+	srv.unlockClient("192.168.1.31", "192.168.1.67", "0000", now)
+	srv.unlockClient("192.168.1.31", "192.168.1.20", "4711", now.Add(parentalPINForget))
+	if _, ok := srv.parentalLocks.failures["192.168.1.67"]; ok {
+		t.Error("wrong PINs not forgotten")
+	}
+
+	prefs := ClientPrefs{locked: []string{"/video/grown-ups"}}
+	for p, want := range map[string]bool{
+		"/video":                 true,
+		"/video/grown-ups":       true,
+		"/video/grown-ups/a.mkv": false,
+		"/video/grown-ups2":      true,
+	} {
+		if got := prefs.allowed(p); got != want {
+			t.Errorf("%s: got %v", p, got)
+		}
+	}
+	c := upnpav.Container{Object: upnpav.Object{ID: "%2Fvideo%2Fgrown-ups"}, ChildCount: 3}
+	if got := prefs.arrange(c).(upnpav.Container).ChildCount; got != 0 {
+		t.Errorf("locked container has %d children", got)
+	}
+	recent := upnpav.Item{Object: upnpav.Object{ID: "%2F%40added%2Fvideo%2Fvideo%2Fgrown-ups%2Fa.mkv", RefID: "%2Fvideo%2Fgrown-ups%2Fa.mkv"}}
+	if got := prefs.filter([]interface{}{c, recent}); len(got) != 1 {
+		t.Errorf("got %v", got)
+	}
+
+	for _, bad := range []*Server{
+		{ProtectedContainers: []string{"/video/grown-ups"}},
+		{ProtectedContainers: []string{"video"}, ParentalPIN: "4711"},
+	} {
+		if bad.initProtectedContainers() == nil {
+			t.Errorf("%q: no error", bad.ProtectedContainers)
+		}
+	}
+}
+
+// Locked containers are listed empty, and nothing in them is reachable, through the web UI and API
+// too.
+func TestParentalBrowse(t *testing.T) {
+	srv := newMemFSServer()
+	srv.ProtectedContainers = []string{"/Shows"}
+	srv.ParentalPIN = "4711"
+	if err := srv.initServices(); err != nil {
+		t.Fatal(err)
+	}
+	srv.metrics = newServerMetrics(srv)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	srv.HTTPConn = l
+	browse := func(handler func(*Server, http.ResponseWriter, *http.Request), target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		r.RemoteAddr = "192.168.1.20:4000"
+		w := httptest.NewRecorder()
+		handler(srv, w, r)
+		return w
+	}
+	apiBrowse := func(id string) (page apiPage, code int) {
+		w := browse((*Server).serveAPIBrowse, "/api/browse?id="+url.QueryEscape(id))
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return page, w.Code
+	}
+	shows := func(page apiPage) (ret apiObject) {
+		for _, o := range page.Objects {
+			if o.Title == "Shows" {
+				ret = o
+			}
+		}
+		return
+	}
+	page, _ := apiBrowse("0")
+	if c := shows(page); !c.Container || c.ChildCount != 0 {
+		t.Errorf("locked container listed as %+v", c)
+	}
+	if page, code := apiBrowse("/Shows"); len(page.Objects) != 0 {
+		t.Errorf("locked container has %v (%d)", page.Objects, code)
+	}
+	if _, code := apiBrowse("/Shows/a.mkv"); code != http.StatusNotFound {
+		t.Errorf("browsing within a locked container gave %d", code)
+	}
+	if w := browse((*Server).serveAPIItem, apiItemPath+"Shows/a.mkv"); w.Code != http.StatusNotFound {
+		t.Errorf("item within a locked container gave %d", w.Code)
+	}
+	if w := browse((*Server).serveBrowse, "/browse?id="+url.QueryEscape("/Shows")); strings.Contains(w.Body.String(), "a.mkv") {
+		t.Error("web UI lists a locked container's contents")
+	}
+	if err := srv.unlockClient("192.168.1.20", "192.168.1.20", "4711", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	page, _ = apiBrowse("0")
+	if c := shows(page); c.ChildCount != 1 {
+		t.Errorf("unlocked container listed as %+v", c)
+	}
+	if w := browse((*Server).serveBrowse, "/browse?id="+url.QueryEscape("/Shows")); !strings.Contains(w.Body.String(), "a.mkv") {
+		t.Error("web UI doesn't list an unlocked container's contents")
+	}
+}
@@ -0,0 +1,180 @@
+package dms
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/dms/dlna"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// MIME types of camera RAW files, by extension.
+var rawPhotoMimeTypes = map[string]string{
+	".arw": "image/x-sony-arw",
+	".cr2": "image/x-canon-cr2",
+	".cr3": "image/x-canon-cr3",
+	".dng": "image/x-adobe-dng",
+	".nef": "image/x-nikon-nef",
+	".orf": "image/x-olympus-orf",
+	".pef": "image/x-pentax-pef",
+	".raf": "image/x-fuji-raf",
+	".rw2": "image/x-panasonic-rw2",
+	".srw": "image/x-samsung-srw",
+}
+
+const (
+	// The most time between consecutive shots of a burst.
+	photoBurstGap = time.Second
+	// The fewest shots that make a burst, rather than a couple of photos taken in quick succession.
+	photoBurstMinShots = 3
+)
+
+// Splits the numbered names cameras give photos, such as "IMG_0042", into prefix and number.
+var photoSequenceRegexp = regexp.MustCompile(`^(.*?)(\d+)$`)
+
+func isRawPhoto(name string) bool {
+	_, ok := rawPhotoMimeTypes[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+func isJPEG(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg":
+		return true
+	}
+	return false
+}
+
+func photoStem(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// Groups RAW+JPEG pairs and bursts among the entries of a directory, so that each is listed as a
+// single item. Returns the entries to list, and the alternates of those that stand for a group,
+// keyed by name.
+func groupPhotos(fis []os.FileInfo) (list []os.FileInfo, alternates map[string][]os.FileInfo) {
+	alternates = make(map[string][]os.FileInfo)
+	grouped := make(map[string]bool)
+	// RAW files are alternates of the JPEG the camera saved alongside.
+	jpegs := make(map[string]os.FileInfo)
+	for _, fi := range fis {
+		if !fi.IsDir() && isJPEG(fi.Name()) {
+			jpegs[strings.ToLower(photoStem(fi.Name()))] = fi
+		}
+	}
+	for _, fi := range fis {
+		if fi.IsDir() || !isRawPhoto(fi.Name()) {
+			continue
+		}
+		if jpeg, ok := jpegs[strings.ToLower(photoStem(fi.Name()))]; ok {
+			alternates[jpeg.Name()] = append(alternates[jpeg.Name()], fi)
+			grouped[fi.Name()] = true
+		}
+	}
+	// Bursts are consecutively numbered JPEGs taken moments apart. The first shot stands for the
+	// rest.
+	type shot struct {
+		num int
+		fi  os.FileInfo
+	}
+	sequences := make(map[string][]shot)
+	for _, fi := range jpegs {
+		m := photoSequenceRegexp.FindStringSubmatch(photoStem(fi.Name()))
+		if m == nil {
+			continue
+		}
+		num, err := strconv.Atoi(m[2])
+		if err != nil {
+			continue
+		}
+		key := strings.ToLower(m[1] + filepath.Ext(fi.Name()))
+		sequences[key] = append(sequences[key], shot{num, fi})
+	}
+	for _, shots := range sequences {
+		sort.Slice(shots, func(i, j int) bool {
+			return shots[i].num < shots[j].num
+		})
+		for start := 0; start < len(shots); {
+			end := start + 1
+			for end < len(shots) && shots[end].num == shots[end-1].num+1 &&
+				absDuration(shots[end].fi.ModTime().Sub(shots[end-1].fi.ModTime())) <= photoBurstGap {
+				end++
+			}
+			if end-start >= photoBurstMinShots {
+				first := shots[start].fi.Name()
+				for _, s := range shots[start+1 : end] {
+					name := s.fi.Name()
+					alternates[first] = append(append(alternates[first], s.fi), alternates[name]...)
+					delete(alternates, name)
+					grouped[name] = true
+				}
+			}
+			start = end
+		}
+	}
+	for _, fi := range fis {
+		if !grouped[fi.Name()] {
+			list = append(list, fi)
+		}
+	}
+	return
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// Returns the alternates of the photo at o, if it stands for a group.
+func (me *Server) photoAlternates(o object) []os.FileInfo {
+	dir := o
+	dir.Path = path.Dir(o.Path)
+	fis, err := me.readObjectDir(dir)
+	if err != nil {
+		return nil
+	}
+	_, alternates := groupPhotos(fis)
+	return alternates[path.Base(o.Path)]
+}
+
+// Adds resources for the alternates of a photo to its item, after the photo itself, so that
+// renderers still pick the photo.
+func withPhotoAlternates(ret interface{}, dir object, alternates []os.FileInfo, host string) interface{} {
+	item, ok := ret.(upnpav.Item)
+	if !ok || len(alternates) == 0 || len(item.Res) == 0 {
+		return ret
+	}
+	res := append([]upnpav.Resource(nil), item.Res[0])
+	for _, fi := range alternates {
+		mimeType, err := MimeTypeByPath(fi.Name())
+		if err != nil {
+			continue
+		}
+		res = append(res, upnpav.Resource{
+			URL: (&url.URL{
+				Scheme: "http",
+				Host:   host,
+				Path:   resPath,
+				RawQuery: url.Values{
+					"path": {dir.child(fi.Name()).Path},
+				}.Encode(),
+			}).String(),
+			ProtocolInfo: fmt.Sprintf("http-get:*:%s:%s", mimeType, dlna.ContentFeatures{
+				SupportRange: true,
+			}.String()),
+			Size: uint64(fi.Size()),
+		})
+	}
+	item.Res = append(res, item.Res[1:]...)
+	return item
+}
@@ -0,0 +1,57 @@
+package dms
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGroupPhotos(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	photo := func(name string, at time.Duration) os.FileInfo {
+		return indexFileInfo{&indexEntry{Name: name, ModTime: t0.Add(at)}}
+	}
+	fis := []os.FileInfo{
+		photo("DSC_0001.JPG", 0),
+		photo("DSC_0001.NEF", 0),
+		photo("IMG_0100.jpg", time.Minute),
+		photo("IMG_0101.jpg", time.Minute+300*time.Millisecond),
+		photo("IMG_0101.cr2", time.Minute+300*time.Millisecond),
+		photo("IMG_0102.jpg", time.Minute+600*time.Millisecond),
+		// Too long after the burst.
+		photo("IMG_0103.jpg", time.Hour),
+		// Only two in quick succession.
+		photo("IMG_0200.jpg", 2*time.Hour),
+		photo("IMG_0201.jpg", 2*time.Hour),
+		photo("lonely.cr2", 0),
+	}
+	list, alternates := groupPhotos(fis)
+	var names []string
+	for _, fi := range list {
+		names = append(names, fi.Name())
+	}
+	expected := []string{"DSC_0001.JPG", "IMG_0100.jpg", "IMG_0103.jpg", "IMG_0200.jpg", "IMG_0201.jpg", "lonely.cr2"}
+	if len(names) != len(expected) {
+		t.Fatalf("listed %q, expected %q", names, expected)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Fatalf("listed %q, expected %q", names, expected)
+		}
+	}
+	alternateNames := func(name string) (ret []string) {
+		for _, fi := range alternates[name] {
+			ret = append(ret, fi.Name())
+		}
+		return
+	}
+	if a := alternateNames("DSC_0001.JPG"); len(a) != 1 || a[0] != "DSC_0001.NEF" {
+		t.Errorf("unexpected alternates %q", a)
+	}
+	if a := alternateNames("IMG_0100.jpg"); len(a) != 3 || a[0] != "IMG_0101.jpg" || a[1] != "IMG_0101.cr2" || a[2] != "IMG_0102.jpg" {
+		t.Errorf("unexpected alternates %q", a)
+	}
+	if len(alternates) != 2 {
+		t.Errorf("unexpected alternates %v", alternates)
+	}
+}
@@ -0,0 +1,282 @@
+package dms
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+const (
+	// Object path of the container of photos by where they were taken, in the top level. A
+	// directory of the same name in the shared directory is hidden by it.
+	placesPath  = "/@places"
+	placesTitle = "Places"
+)
+
+// Photos taken within a cell of a grid of tenths of a degree, about 10 km across.
+type place struct {
+	// Such as "48.9,2.4", for the object path of its container.
+	name  string
+	title string
+	// Object paths of the photos, by when they were taken.
+	photos []string
+}
+
+// Returns the cell of the grid a location is in.
+func placeOf(lat, lon float64) (name, title string) {
+	name = fmt.Sprintf("%.1f,%.1f", lat, lon)
+	ns, ew := "N", "E"
+	if lat < 0 {
+		ns, lat = "S", -lat
+	}
+	if lon < 0 {
+		ew, lon = "W", -lon
+	}
+	return name, fmt.Sprintf("%.1f°%s %.1f°%s", lat, ns, lon, ew)
+}
+
+// The places, from a scan of the index. They're kept a while, since the top level container needs
+// to know if there are any every time it's browsed.
+type placesCache struct {
+	mu      sync.Mutex
+	places  map[string]*place
+	expires time.Time
+}
+
+// Drops the places, such as when the shared directories change.
+func (me *placesCache) clear() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.places = nil
+}
+
+// Whether the places container is listed, which needs the index.
+func (srv *Server) photoPlaces() bool {
+	return srv.settings().PhotoPlaces && srv.index != nil
+}
+
+// Whether the object path is the places container or within it.
+func isPlacesPath(p string) bool {
+	return p == placesPath || strings.HasPrefix(p, placesPath+"/")
+}
+
+// Returns the photos in the index that have a location, by the name of their place.
+func (srv *Server) places() map[string]*place {
+	srv.placesCache.mu.Lock()
+	defer srv.placesCache.mu.Unlock()
+	now := time.Now()
+	if srv.placesCache.places != nil && now.Before(srv.placesCache.expires) {
+		return srv.placesCache.places
+	}
+	type photo struct {
+		path  string
+		taken time.Time
+	}
+	photos := make(map[string][]photo)
+	ret := make(map[string]*place)
+	err := srv.index.forEachEntry("/", true, func(dir string, e *indexEntry) bool {
+		if e.Metadata == nil || !e.Metadata.hasLocation() {
+			return true
+		}
+		name, title := placeOf(e.Metadata.Latitude, e.Metadata.Longitude)
+		if ret[name] == nil {
+			ret[name] = &place{name: name, title: title}
+		}
+		photos[name] = append(photos[name], photo{path.Join(dir, e.Name), e.Metadata.Date})
+		return true
+	})
+	if err != nil {
+		srv.Logger.Printf("error listing places: %v", err)
+		return nil
+	}
+	for name, p := range ret {
+		ps := photos[name]
+		sort.SliceStable(ps, func(i, j int) bool {
+			if !ps[i].taken.Equal(ps[j].taken) {
+				return ps[i].taken.Before(ps[j].taken)
+			}
+			return ps[i].path < ps[j].path
+		})
+		for _, photo := range ps {
+			p.photos = append(p.photos, photo.path)
+		}
+	}
+	srv.placesCache.places, srv.placesCache.expires = ret, now.Add(browseCacheTTL)
+	return ret
+}
+
+// Returns the number of top level objects the places container adds.
+func (srv *Server) placesChildCount() int {
+	if !srv.photoPlaces() || len(srv.places()) == 0 {
+		return 0
+	}
+	return 1
+}
+
+// Returns the places container, or nil if there are no photos with locations.
+func (me *contentDirectoryService) placesContainer() interface{} {
+	if !me.photoPlaces() {
+		return nil
+	}
+	places := me.places()
+	if len(places) == 0 {
+		return nil
+	}
+	o := object{Path: placesPath}
+	return upnpav.Container{
+		Object: upnpav.Object{
+			ID:         o.ID(),
+			ParentID:   o.ParentID(),
+			Restricted: 1,
+			Class:      "object.container",
+			Title:      me.localTitle(placesTitle),
+		},
+		ChildCount: len(places),
+	}
+}
+
+func placeContainer(p *place) upnpav.Container {
+	o := object{Path: path.Join(placesPath, p.name)}
+	return upnpav.Container{
+		Object: upnpav.Object{
+			ID:         o.ID(),
+			ParentID:   o.ParentID(),
+			Restricted: 1,
+			Class:      "object.container.album.photoAlbum",
+			Title:      p.title,
+		},
+		ChildCount: len(p.photos),
+	}
+}
+
+// Returns the containers of the places, by title.
+func (me *contentDirectoryService) placeContainers() (ret []interface{}) {
+	var places []*place
+	var titles []string
+	for _, p := range me.places() {
+		places = append(places, p)
+		titles = append(titles, p.title)
+	}
+	keys := collationKeys(me.collator(), titles)
+	sort.Sort(collatedPlaces{places, keys})
+	for _, p := range places {
+		ret = append(ret, placeContainer(p))
+	}
+	return
+}
+
+// Returns the item for a photo in a place, which refers to the photo where it is in the shared
+// directories.
+func (me *contentDirectoryService) placePhotoItem(p *place, photoPath, host, userAgent string) (ret interface{}, ok bool) {
+	photo, err := me.objectFromPath(photoPath)
+	if err != nil {
+		return
+	}
+	fi, indexed := me.index.stat(photoPath)
+	if !indexed {
+		if fi, err = me.contentFS().Stat(photo.FilePath()); err != nil {
+			return
+		}
+	}
+	obj, err := me.cdsObjectToUpnpavObject(photo, fi, host, userAgent)
+	if err != nil {
+		return
+	}
+	item, ok := obj.(upnpav.Item)
+	if !ok {
+		return
+	}
+	item.RefID = item.ID
+	item.ID = object{Path: path.Join(placesPath, p.name, photoPath)}.ID()
+	item.ParentID = placeContainer(p).ID
+	return item, true
+}
+
+// Returns the items of the photos in a place.
+func (me *contentDirectoryService) placePhotoItems(p *place, host, userAgent string) (ret []interface{}) {
+	for _, photoPath := range p.photos {
+		if item, ok := me.placePhotoItem(p, photoPath, host, userAgent); ok {
+			ret = append(ret, item)
+		}
+	}
+	return
+}
+
+// Splits an object path within the places container into the name of the place, and the object
+// path of the photo if it's within a place's container.
+func splitPlacePath(p string) (name, photoPath string) {
+	name, photoPath, _ = strings.Cut(strings.TrimPrefix(p, placesPath+"/"), "/")
+	if photoPath != "" {
+		photoPath = "/" + photoPath
+	}
+	return
+}
+
+// Returns the objects in a container within the places container.
+func (me *contentDirectoryService) readPlacesContainer(o object, host, userAgent string) ([]interface{}, error) {
+	if !me.photoPlaces() {
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no places")
+	}
+	if o.Path == placesPath {
+		return me.placeContainers(), nil
+	}
+	name, photoPath := splitPlacePath(o.Path)
+	p := me.places()[name]
+	if p == nil || photoPath != "" {
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such place")
+	}
+	return me.placePhotoItems(p, host, userAgent), nil
+}
+
+// Returns the object for an object path within the places container, as given to
+// BrowseMetadata.
+func (me *contentDirectoryService) placesObject(o object, host, userAgent string) (interface{}, error) {
+	if o.Path == placesPath {
+		if c := me.placesContainer(); c != nil {
+			return c, nil
+		}
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no places")
+	}
+	if !me.photoPlaces() {
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no places")
+	}
+	name, photoPath := splitPlacePath(o.Path)
+	p := me.places()[name]
+	if p == nil {
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such place")
+	}
+	if photoPath == "" {
+		return placeContainer(p), nil
+	}
+	for _, pp := range p.photos {
+		if pp == photoPath {
+			if item, ok := me.placePhotoItem(p, photoPath, host, userAgent); ok {
+				return item, nil
+			}
+		}
+	}
+	return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such photo in place")
+}
+
+// Places sorted by their collated titles.
+type collatedPlaces struct {
+	places []*place
+	keys   [][]byte
+}
+
+func (me collatedPlaces) Len() int { return len(me.places) }
+
+func (me collatedPlaces) Less(i, j int) bool {
+	return collatedLess(me.keys[i], me.keys[j], me.places[i].title, me.places[j].title)
+}
+
+func (me collatedPlaces) Swap(i, j int) {
+	me.places[i], me.places[j] = me.places[j], me.places[i]
+	me.keys[i], me.keys[j] = me.keys[j], me.keys[i]
+}
@@ -0,0 +1,20 @@
+package dms
+
+import "testing"
+
+func TestPlaceOf(t *testing.T) {
+	for _, c := range []struct {
+		lat, lon    float64
+		name, title string
+	}{
+		{48.856, 2.352, "48.9,2.4", "48.9°N 2.4°E"},
+		{-33.87, -70.66, "-33.9,-70.7", "33.9°S 70.7°W"},
+	} {
+		if name, title := placeOf(c.lat, c.lon); name != c.name || title != c.title {
+			t.Errorf("%v,%v: %q %q", c.lat, c.lon, name, title)
+		}
+	}
+	if name, photo := splitPlacePath(placesPath + "/48.9,2.4/Photos/a.jpg"); name != "48.9,2.4" || photo != "/Photos/a.jpg" {
+		t.Errorf("%q %q", name, photo)
+	}
+}
@@ -0,0 +1,211 @@
+package dms
+
+import (
+	"bufio"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// The most read of a playlist file.
+const maxPlaylistSize = 4 << 20
+
+func isPlaylistFile(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".m3u", ".m3u8", ".pls":
+		return true
+	}
+	return false
+}
+
+// Reads the locations of the entries of an M3U or PLS playlist, in order.
+func parsePlaylist(r io.Reader, ext string) (ret []string, err error) {
+	pls := strings.EqualFold(ext, ".pls")
+	// PLS entries are numbered, and needn't be in order.
+	numbered := make(map[int]string)
+	s := bufio.NewScanner(io.LimitReader(r, maxPlaylistSize))
+	s.Buffer(nil, 64<<10)
+	first := true
+	for s.Scan() {
+		line := s.Text()
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			first = false
+		}
+		line = strings.TrimSpace(line)
+		if !pls {
+			if line != "" && !strings.HasPrefix(line, "#") {
+				ret = append(ret, line)
+			}
+			continue
+		}
+		// [playlist]
+		// File1=...
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || len(key) < 5 || !strings.EqualFold(key[:4], "file") {
+			continue
+		}
+		n, err := strconv.Atoi(key[4:])
+		if err != nil {
+			continue
+		}
+		numbered[n] = strings.TrimSpace(value)
+	}
+	if err = s.Err(); err != nil {
+		return
+	}
+	if pls {
+		ns := make([]int, 0, len(numbered))
+		for n := range numbered {
+			ns = append(ns, n)
+		}
+		sort.Ints(ns)
+		for _, n := range ns {
+			ret = append(ret, numbered[n])
+		}
+	}
+	return
+}
+
+// Returns the local path of a playlist entry, resolved relative to the playlist's directory, or
+// false if it's remote.
+func playlistEntryFilePath(entry, playlistDir string) (string, bool) {
+	if strings.Contains(entry, "://") {
+		u, err := url.Parse(entry)
+		if err != nil || u.Scheme != "file" {
+			return "", false
+		}
+		entry = filepath.FromSlash(u.Path)
+	} else if runtime.GOOS != "windows" {
+		// Playlists made on Windows separate with backslashes.
+		entry = strings.ReplaceAll(entry, `\`, "/")
+	}
+	if !filepath.IsAbs(entry) {
+		entry = filepath.Join(playlistDir, entry)
+	}
+	return filepath.Clean(entry), true
+}
+
+// The local tracks of a playlist that are shared, in the playlist's order.
+func (me *Server) playlistTracks(o object) (ret []object, err error) {
+	filePath := o.FilePath()
+	f, err := me.contentFS().Open(filePath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	entries, err := parsePlaylist(f, filepath.Ext(filePath))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		trackPath, ok := playlistEntryFilePath(e, filepath.Dir(filePath))
+		if !ok {
+			continue
+		}
+		// Entries outside the shared directories aren't served.
+		track, ok := me.objectFromFilePath(trackPath)
+		if !ok {
+			continue
+		}
+		ret = append(ret, track)
+	}
+	return
+}
+
+// Splits the object path of an item within a playlist into that of the playlist and the index of
+// the entry.
+func splitPlaylistItemPath(p string) (playlistPath string, entry int, ok bool) {
+	dir, name := path.Split(p)
+	if !strings.HasPrefix(name, "@") || !isPlaylistFile(path.Clean(dir)) {
+		return
+	}
+	entry, err := strconv.Atoi(name[1:])
+	if err != nil || entry < 0 {
+		return
+	}
+	return path.Clean(dir), entry, true
+}
+
+// Returns the item for a track of a playlist, which refers to the track where it is in the shared
+// directories. Tracks that aren't media items are left out.
+func (me *contentDirectoryService) playlistItem(playlist object, entry int, track object, host, userAgent string) (ret interface{}, ok bool) {
+	fi, err := me.contentFS().Stat(track.FilePath())
+	if err != nil || !fi.Mode().IsRegular() || isPlaylistFile(fi.Name()) {
+		return
+	}
+	obj, err := me.cdsObjectToUpnpavObject(track, fi, host, userAgent)
+	if err != nil {
+		return
+	}
+	item, ok := obj.(upnpav.Item)
+	if !ok {
+		return
+	}
+	item.RefID = item.ID
+	item.ID = object{Path: path.Join(playlist.Path, "@"+strconv.Itoa(entry))}.ID()
+	item.ParentID = playlist.ID()
+	return item, true
+}
+
+// Returns the items for the tracks of a playlist container.
+func (me *contentDirectoryService) playlistItems(o object, host, userAgent string) (ret []interface{}, err error) {
+	tracks, err := me.playlistTracks(o)
+	if err != nil {
+		return
+	}
+	for i, track := range tracks {
+		if item, ok := me.playlistItem(o, i, track, host, userAgent); ok {
+			ret = append(ret, item)
+		}
+	}
+	return
+}
+
+// Returns the item for an object path within a playlist, as given to BrowseMetadata.
+func (me *contentDirectoryService) playlistItemObject(o object, host, userAgent string) (ret interface{}, ok bool) {
+	playlistPath, entry, ok := splitPlaylistItemPath(o.Path)
+	if !ok {
+		return
+	}
+	playlist, err := me.objectFromPath(playlistPath)
+	if err != nil {
+		return nil, false
+	}
+	if ignored, err := me.IgnorePath(playlist.FilePath()); err != nil || ignored {
+		return nil, false
+	}
+	tracks, err := me.playlistTracks(playlist)
+	if err != nil || entry >= len(tracks) {
+		return nil, false
+	}
+	return me.playlistItem(playlist, entry, tracks[entry], host, userAgent)
+}
+
+// Returns the container for a playlist file, or nil if none of its tracks are shared.
+func (me *contentDirectoryService) playlistContainer(o object, fi os.FileInfo, host, userAgent string) (ret interface{}, err error) {
+	items, err := me.playlistItems(o, host, userAgent)
+	if err != nil || len(items) == 0 {
+		return
+	}
+	title := strings.TrimSuffix(fi.Name(), filepath.Ext(fi.Name()))
+	return upnpav.Container{
+		Object: upnpav.Object{
+			ID:         o.ID(),
+			ParentID:   o.ParentID(),
+			Restricted: 1,
+			Class:      "object.container.playlistContainer",
+			Title:      title,
+			Date:       upnpav.Timestamp{Time: fi.ModTime()},
+		},
+		ChildCount: len(items),
+	}, nil
+}
@@ -0,0 +1,64 @@
+package dms
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePlaylist(t *testing.T) {
+	m3u := "\ufeff#EXTM3U\n#EXTINF:123,Artist - One\none.mp3\n\nhttp://radio.example/stream\n  sub\\two.flac  \n"
+	got, err := parsePlaylist(strings.NewReader(m3u), ".m3u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"one.mp3", "http://radio.example/stream", `sub\two.flac`}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("m3u: got %q, want %q", got, want)
+	}
+	pls := "[playlist]\nFile2=two.flac\nTitle2=Two\nFile10=ten.mp3\nfile1=one.mp3\nNumberOfEntries=3\n"
+	got, err = parsePlaylist(strings.NewReader(pls), ".PLS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"one.mp3", "two.flac", "ten.mp3"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("pls: got %q, want %q", got, want)
+	}
+}
+
+func TestPlaylistTracks(t *testing.T) {
+	root := t.TempDir()
+	lists := filepath.Join(root, "lists")
+	if err := os.Mkdir(lists, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	m3u := strings.Join([]string{
+		"../music/b.mp3",
+		filepath.Join(root, "music", "a.mp3"),
+		"file://" + filepath.ToSlash(filepath.Join(root, "music", "c.mp3")),
+		"../../outside.mp3",
+		"http://radio.example/stream",
+	}, "\n")
+	if err := os.WriteFile(filepath.Join(lists, "mix.m3u"), []byte(m3u), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{RootObjectPath: root}
+	tracks, err := srv.playlistTracks(object{Path: "/lists/mix.m3u", RootObjectPath: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, track := range tracks {
+		got = append(got, track.Path)
+	}
+	if want := []string{"/music/b.mp3", "/music/a.mp3", "/music/c.mp3"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if p, entry, ok := splitPlaylistItemPath("/lists/mix.m3u/@2"); !ok || p != "/lists/mix.m3u" || entry != 2 {
+		t.Errorf("split got %q %d %v", p, entry, ok)
+	}
+	if _, _, ok := splitPlaylistItemPath("/books/Dune.m4b/@2"); ok {
+		t.Error("split audiobook part as playlist entry")
+	}
+}
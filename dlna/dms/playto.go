@@ -0,0 +1,333 @@
+package dms
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/mpris"
+	"github.com/anacrolix/dms/ssdp"
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// Searched for so that renderers are found without waiting for their next announcement.
+var rendererSearchTargets = []string{
+	"urn:schemas-upnp-org:device:MediaRenderer:1",
+	"urn:av-openhome-org:service:Playlist:1",
+}
+
+const (
+	apiRenderersPath = "/api/renderers"
+	apiPlayPath      = "/api/play"
+	// How often renderers are searched for when they're listed.
+	rendererSearchInterval = time.Minute
+	// How long a renderer may take to start playing.
+	playToTimeout = 20 * time.Second
+)
+
+// Sends an M-SEARCH for renderers on each interface, unless one was sent recently. What they
+// reply with is handled like their announcements.
+func (srv *Server) searchRenderers() {
+	me := &srv.renderers
+	me.mu.Lock()
+	if time.Since(me.searched) < rendererSearchInterval {
+		me.mu.Unlock()
+		return
+	}
+	me.searched = time.Now()
+	me.mu.Unlock()
+	srv.mu.RLock()
+	ssdpServers := make([]*ssdp.Server, 0, len(srv.ssdpServers))
+	for s := range srv.ssdpServers {
+		ssdpServers = append(ssdpServers, s)
+	}
+	srv.mu.RUnlock()
+	for _, s := range ssdpServers {
+		for _, target := range rendererSearchTargets {
+			s.Search(target)
+		}
+	}
+}
+
+// A renderer that media can be played on, in the API and web UI.
+type apiRenderer struct {
+	// Its IP, which identifies it.
+	Address string
+	Name    string
+	// The number of formats it has said it accepts.
+	Formats int
+}
+
+// Returns the renderers that media can be played on, by name.
+func (srv *Server) playToRenderers() (ret []apiRenderer) {
+	for ip, info := range srv.renderers.infos() {
+		if !info.canPlay() {
+			continue
+		}
+		name := info.name
+		if name == "" {
+			name = ip
+		}
+		ret = append(ret, apiRenderer{Address: ip, Name: name, Formats: len(info.sink)})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Name != ret[j].Name {
+			return ret[i].Name < ret[j].Name
+		}
+		return ret[i].Address < ret[j].Address
+	})
+	return
+}
+
+// Returns the host and port the renderer at ip reaches the server at, for the URLs it's given.
+func (srv *Server) hostFor(ip net.IP) (string, error) {
+	// Nothing is sent; this finds the address of the interface the renderer is reached through.
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: ssdp.NetAddr.Port})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.UDPAddr)
+	return net.JoinHostPort(local.IP.String(), strconv.Itoa(srv.httpPort())), nil
+}
+
+// Returns the resource of the item to play on a renderer: the first it accepts, or the first if
+// what it accepts isn't known or it accepts none of them.
+func playToResource(item upnpav.Item, sink rendererSink) (upnpav.Resource, bool) {
+	if len(item.Res) == 0 {
+		return upnpav.Resource{}, false
+	}
+	for _, res := range item.Res {
+		if sink.accepts(res.ProtocolInfo) {
+			return res, true
+		}
+	}
+	return item.Res[0], true
+}
+
+// Plays the URI on the renderer with its AVTransport, or adds it to the OpenHome Playlist after
+// the track that's current and plays it from there.
+func (me *renderers) play(ctx context.Context, info rendererInfo, uri, metadata string) error {
+	if info.avTransport.control != nil {
+		if _, err := me.action(ctx, info.avTransport, "SetAVTransportURI",
+			[2]string{"InstanceID", "0"},
+			[2]string{"CurrentURI", uri},
+			[2]string{"CurrentURIMetaData", metadata},
+		); err != nil {
+			return err
+		}
+		_, err := me.action(ctx, info.avTransport, "Play",
+			[2]string{"InstanceID", "0"},
+			[2]string{"Speed", "1"},
+		)
+		return err
+	}
+	b, err := me.action(ctx, info.playlist, "Id")
+	if err != nil {
+		return err
+	}
+	var current struct {
+		Value string `xml:"Body>IdResponse>Value"`
+	}
+	if err := xml.Unmarshal(b, &current); err != nil {
+		return fmt.Errorf("parsing Id response: %w", err)
+	}
+	// 0 is before the first track, for an empty playlist.
+	if current.Value == "" {
+		current.Value = "0"
+	}
+	if b, err = me.action(ctx, info.playlist, "Insert",
+		[2]string{"AfterId", current.Value},
+		[2]string{"Uri", uri},
+		[2]string{"Metadata", metadata},
+	); err != nil {
+		return err
+	}
+	var inserted struct {
+		NewID string `xml:"Body>InsertResponse>NewId"`
+	}
+	if err := xml.Unmarshal(b, &inserted); err != nil {
+		return fmt.Errorf("parsing Insert response: %w", err)
+	}
+	if _, err := me.action(ctx, info.playlist, "SeekId", [2]string{"Value", inserted.NewID}); err != nil {
+		return err
+	}
+	_, err = me.action(ctx, info.playlist, "Play")
+	return err
+}
+
+// Plays the item on the renderer at ip, like a control point would. Returns the name of the
+// renderer.
+func (srv *Server) playTo(ctx context.Context, ip string, obj object) (string, error) {
+	info, ok := srv.renderers.info(ip)
+	if !ok || !info.canPlay() {
+		return "", upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no renderer at %q that media can be played on", ip)
+	}
+	name := info.name
+	if name == "" {
+		name = ip
+	}
+	host, err := srv.hostFor(net.ParseIP(ip))
+	if err != nil {
+		return name, upnp.Errorf(upnp.ActionFailedErrorCode, err.Error())
+	}
+	cds := srv.apiContentDirectory()
+	ret, err := cds.objectMetadata(obj, host, "")
+	if err != nil {
+		return name, err
+	}
+	item, ok := ret.(upnpav.Item)
+	if !ok {
+		return name, upnp.Errorf(upnp.ArgumentValueInvalidErrorCode, "only items can be played")
+	}
+	item, _ = sanitizeObject(srv.externalURLs(item, "")).(upnpav.Item)
+	res, ok := playToResource(item, info.sink)
+	if !ok {
+		return name, upnp.Errorf(upnp.ArgumentValueInvalidErrorCode, "%q has nothing to play", obj.Path)
+	}
+	// The metadata describes just the resource that's played.
+	item.Res = []upnpav.Resource{res}
+	metadata, err := xml.Marshal(item)
+	if err != nil {
+		return name, err
+	}
+	if err := srv.renderers.play(ctx, info, res.URL, didl_lite(string(metadata))); err != nil {
+		return name, upnp.Errorf(upnp.ActionFailedErrorCode, err.Error())
+	}
+	srv.setNowPlaying(ip, info, item, res)
+	return name, nil
+}
+
+// Invokes the transport action, such as "Play", "Pause" or "Stop", on the renderer's AVTransport,
+// or on its OpenHome Playlist, which has the same ones.
+func (me *renderers) transport(ctx context.Context, info rendererInfo, action string) error {
+	if info.avTransport.control == nil {
+		_, err := me.action(ctx, info.playlist, action)
+		return err
+	}
+	args := [][2]string{{"InstanceID", "0"}}
+	if action == "Play" {
+		args = append(args, [2]string{"Speed", "1"})
+	}
+	_, err := me.action(ctx, info.avTransport, action, args...)
+	return err
+}
+
+// Returns the mpris PlaybackStatus of the renderer, from the TransportState of its AVTransport
+// or OpenHome Playlist.
+func (me *renderers) transportStatus(ctx context.Context, info rendererInfo) (string, error) {
+	var state string
+	if info.avTransport.control != nil {
+		b, err := me.action(ctx, info.avTransport, "GetTransportInfo", [2]string{"InstanceID", "0"})
+		if err != nil {
+			return "", err
+		}
+		var resp struct {
+			State string `xml:"Body>GetTransportInfoResponse>CurrentTransportState"`
+		}
+		if err := xml.Unmarshal(b, &resp); err != nil {
+			return "", fmt.Errorf("parsing GetTransportInfo response: %w", err)
+		}
+		state = resp.State
+	} else {
+		b, err := me.action(ctx, info.playlist, "TransportState")
+		if err != nil {
+			return "", err
+		}
+		var resp struct {
+			Value string `xml:"Body>TransportStateResponse>Value"`
+		}
+		if err := xml.Unmarshal(b, &resp); err != nil {
+			return "", fmt.Errorf("parsing TransportState response: %w", err)
+		}
+		state = resp.Value
+	}
+	switch state {
+	case "PLAYING", "TRANSITIONING", "Playing", "Buffering":
+		return mpris.Playing, nil
+	case "PAUSED_PLAYBACK", "Paused":
+		return mpris.Paused, nil
+	}
+	return mpris.Stopped, nil
+}
+
+// Stops what the renderer at ip is playing.
+func (srv *Server) stopRenderer(ctx context.Context, ip string) error {
+	info, ok := srv.renderers.info(ip)
+	if !ok || !info.canPlay() {
+		return upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no renderer at %q that media can be played on", ip)
+	}
+	if err := srv.renderers.transport(ctx, info, "Stop"); err != nil {
+		return upnp.Errorf(upnp.ActionFailedErrorCode, err.Error())
+	}
+	srv.stoppedNowPlaying(ip)
+	return nil
+}
+
+// Lists the renderers that media can be played on, searching for more to be listed next time.
+func (me *Server) serveAPIRenderers(w http.ResponseWriter, r *http.Request) {
+	if !me.authorizeAPI(w, r, APIScopePlayback) {
+		return
+	}
+	go me.searchRenderers()
+	ret := me.playToRenderers()
+	if ret == nil {
+		ret = []apiRenderer{}
+	}
+	me.writeAPIResponse(w, r, ret)
+}
+
+type apiPlayRequest struct {
+	// The address of the renderer, as listed.
+	Renderer string
+	// The ID of the item.
+	ID string
+}
+
+// Plays the item of the JSON apiPlayRequest in the body on its renderer on POST, or stops the
+// renderer with the renderer query parameter on DELETE.
+func (me *Server) serveAPIPlay(w http.ResponseWriter, r *http.Request) {
+	if !me.authorizeAPI(w, r, APIScopePlayback) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), playToTimeout)
+	defer cancel()
+	switch r.Method {
+	case "POST":
+		var req apiPlayRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			me.writeAPIError(w, r, upnp.Errorf(upnp.ArgumentValueInvalidErrorCode, "bad request: %v", err))
+			return
+		}
+		obj, err := me.apiContentDirectory().objectFromID(req.ID)
+		if err != nil {
+			me.writeAPIError(w, r, upnp.Errorf(upnpav.NoSuchObjectErrorCode, err.Error()))
+			return
+		}
+		name, err := me.playTo(ctx, req.Renderer, obj)
+		if err != nil {
+			me.writeAPIError(w, r, err)
+			return
+		}
+		me.requestLogger(r).Levelf(log.Info, "playing %q on %q", obj.Path, name)
+	case "DELETE":
+		if err := me.stopRenderer(ctx, r.URL.Query().Get("renderer")); err != nil {
+			me.writeAPIError(w, r, err)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
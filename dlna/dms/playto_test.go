@@ -0,0 +1,77 @@
+package dms
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPlayOpenHomePlaylist(t *testing.T) {
+	var actions []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		_, action, _ := strings.Cut(strings.Trim(r.Header.Get("SOAPACTION"), `"`), "#")
+		actions = append(actions, action)
+		var resp string
+		switch action {
+		case "Id":
+			resp = `<Value>7</Value>`
+		case "Insert":
+			if !strings.Contains(string(b), "<AfterId>7</AfterId><Uri>http://host/res?path=%2Fa.flac</Uri>") {
+				t.Errorf("Insert %s", b)
+			}
+			resp = `<NewId>8</NewId>`
+		case "SeekId":
+			if !strings.Contains(string(b), "<Value>8</Value>") {
+				t.Errorf("SeekId %s", b)
+			}
+		}
+		io.WriteString(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:`+action+`Response xmlns:u="urn:av-openhome-org:service:Playlist:1">`+resp+`</u:`+action+`Response>
+</s:Body></s:Envelope>`)
+	}))
+	defer ts.Close()
+	control, _ := url.Parse(ts.URL + "/playlist")
+	info := rendererInfo{playlist: rendererService{"urn:av-openhome-org:service:Playlist:1", control}}
+	var rs renderers
+	if err := rs.play(context.Background(), info, "http://host/res?path=%2Fa.flac", didl_lite("")); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(actions, ","); got != "Id,Insert,SeekId,Play" {
+		t.Errorf("got actions %s", got)
+	}
+}
+
+// Serves a renderer's transport, recording the actions invoked and answering GetTransportInfo and
+// TransportState with state.
+func newTestTransport(t *testing.T, serviceType, state string) (rendererService, *[]string) {
+	var actions []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		_, action, _ := strings.Cut(strings.Trim(r.Header.Get("SOAPACTION"), `"`), "#")
+		actions = append(actions, action)
+		var resp string
+		switch action {
+		case "GetTransportInfo":
+			resp = `<CurrentTransportState>` + state + `</CurrentTransportState>`
+		case "TransportState":
+			resp = `<Value>` + state + `</Value>`
+		case "Play":
+			if strings.HasPrefix(serviceType, avTransportServiceTypePrefix) && !strings.Contains(string(b), "<Speed>1</Speed>") {
+				t.Errorf("Play %s", b)
+			}
+		}
+		io.WriteString(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:`+action+`Response xmlns:u="`+serviceType+`">`+resp+`</u:`+action+`Response>
+</s:Body></s:Envelope>`)
+	}))
+	t.Cleanup(ts.Close)
+	control, _ := url.Parse(ts.URL + "/control")
+	return rendererService{serviceType, control}, &actions
+}
@@ -0,0 +1,166 @@
+package dms
+
+import (
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/rrcache"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+const (
+	// How long a listing is served from the cache, since files in the directory may have changed
+	// without changing its modification time.
+	browseCacheTTL = time.Minute
+	// The most objects kept across the cached listings.
+	browseCacheCapacity = 50000
+	// Containers prefetched at once, so as not to swamp slow storage.
+	browsePrefetchWorkers = 2
+)
+
+// Listings differ by host, for the resource URLs, and by User-Agent, for quirks.
+type browseCacheKey struct {
+	path, host, userAgent string
+}
+
+type browseCacheEntry struct {
+	objs []interface{}
+	// Of the directory when it was listed.
+	modTime time.Time
+	expires time.Time
+}
+
+// Listings of containers, so that paging through a large one doesn't list and sort it again for
+// every page. With PrefetchBrowse, subcontainers are listed into it ahead of being browsed.
+type browseCache struct {
+	mu    sync.Mutex
+	cache *rrcache.RRCache
+	// Containers being prefetched, so that they aren't queued twice.
+	pending map[browseCacheKey]struct{}
+	workers chan struct{}
+}
+
+// Returns the cached listing, if the directory hasn't been modified since.
+func (me *browseCache) get(key browseCacheKey, modTime, now time.Time) ([]interface{}, bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.cache == nil {
+		return nil, false
+	}
+	v, ok := me.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	e := v.(browseCacheEntry)
+	if now.After(e.expires) || !e.modTime.Equal(modTime) {
+		return nil, false
+	}
+	return e.objs, true
+}
+
+func (me *browseCache) set(key browseCacheKey, objs []interface{}, modTime, now time.Time) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.cache == nil {
+		me.cache = rrcache.New(browseCacheCapacity)
+	}
+	me.cache.Set(key, browseCacheEntry{objs, modTime, now.Add(browseCacheTTL)}, int64(len(objs)+1))
+}
+
+// Drops the listings, such as when the shared directories change.
+func (me *browseCache) clear() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.cache = nil
+}
+
+// Marks the container as being prefetched, returning false if it already is.
+func (me *browseCache) startPrefetch(key browseCacheKey) bool {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if _, ok := me.pending[key]; ok {
+		return false
+	}
+	if me.pending == nil {
+		me.pending = make(map[browseCacheKey]struct{})
+		me.workers = make(chan struct{}, browsePrefetchWorkers)
+	}
+	me.pending[key] = struct{}{}
+	return true
+}
+
+func (me *browseCache) finishPrefetch(key browseCacheKey) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	delete(me.pending, key)
+}
+
+// Returns the modification time of the directory of the container, which changes when files are
+// added or removed. Containers that aren't directories have the zero time.
+func containerModTime(fsys FS, o object) time.Time {
+	fi, err := fsys.Stat(o.FilePath())
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// Returns the children of the container, from the cache if they've been listed recently.
+func (me *contentDirectoryService) cachedContainer(o object, host, userAgent string) ([]interface{}, error) {
+	// Recently Played and the watched containers change with streams, and Recently Added keeps its
+	// own cache.
+	if isRecentPath(o.Path) || isWatchedPath(o.Path) {
+		return me.readContainer(o, host, userAgent)
+	}
+	key := browseCacheKey{o.Path, host, userAgent}
+	modTime := containerModTime(me.contentFS(), o)
+	if objs, ok := me.browseCache.get(key, modTime, time.Now()); ok {
+		me.metrics.cacheLookup("browse", true)
+		return objs, nil
+	}
+	me.metrics.cacheLookup("browse", false)
+	objs, err := me.readContainer(o, host, userAgent)
+	if err == nil {
+		me.browseCache.set(key, objs, modTime, time.Now())
+	}
+	return objs, err
+}
+
+// Lists the containers on the page of objs that was browsed, and on the page after, in the
+// background, so that they're ready if the user opens one or scrolls on.
+func (me *contentDirectoryService) prefetchContainers(objs []interface{}, startingIndex, requestedCount int, host, userAgent string) {
+	if startingIndex > len(objs) {
+		return
+	}
+	objs = objs[startingIndex:]
+	if requestedCount != 0 && 2*requestedCount < len(objs) {
+		objs = objs[:2*requestedCount]
+	}
+	for _, obj := range objs {
+		c, ok := obj.(upnpav.Container)
+		if !ok {
+			continue
+		}
+		o, err := me.objectFromID(c.ID)
+		if err != nil {
+			continue
+		}
+		key := browseCacheKey{o.Path, host, userAgent}
+		if _, ok := me.browseCache.get(key, containerModTime(me.contentFS(), o), time.Now()); ok {
+			continue
+		}
+		if !me.browseCache.startPrefetch(key) {
+			continue
+		}
+		go func() {
+			defer me.browseCache.finishPrefetch(key)
+			me.browseCache.workers <- struct{}{}
+			defer func() { <-me.browseCache.workers }()
+			if _, err := me.cachedContainer(o, host, userAgent); err != nil {
+				me.Logger.Levelf(log.Debug, "error prefetching %q: %v", o.Path, err)
+			}
+		}()
+	}
+}
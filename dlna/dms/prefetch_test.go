@@ -0,0 +1,29 @@
+package dms
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBrowseCacheExpiry(t *testing.T) {
+	var c browseCache
+	key := browseCacheKey{"/a", "host:1338", ""}
+	now := time.Now()
+	modTime := now.Add(-time.Hour)
+	if _, ok := c.get(key, modTime, now); ok {
+		t.Fatal("empty cache hit")
+	}
+	c.set(key, []interface{}{"x"}, modTime, now)
+	if objs, ok := c.get(key, modTime, now.Add(browseCacheTTL/2)); !ok || len(objs) != 1 {
+		t.Fatalf("got %v, %v", objs, ok)
+	}
+	if _, ok := c.get(browseCacheKey{"/a", "other:1338", ""}, modTime, now); ok {
+		t.Error("hit for another host")
+	}
+	if _, ok := c.get(key, now, now); ok {
+		t.Error("hit after the directory was modified")
+	}
+	if _, ok := c.get(key, modTime, now.Add(browseCacheTTL+time.Second)); ok {
+		t.Error("hit after expiry")
+	}
+}
@@ -0,0 +1,124 @@
+package dms
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"sync"
+
+	"github.com/anacrolix/ffprobe"
+)
+
+// What ProblemFiles does with media files that can't be played, such as empty, truncated or DRM
+// protected ones.
+const (
+	// Leave them out of listings.
+	ProblemFilesHide = ""
+	// List them with "(unplayable)" after their titles.
+	ProblemFilesMark = "mark"
+	// List them as if they were fine.
+	ProblemFilesList = "list"
+)
+
+// What's put in brackets after the titles of unplayable files that are marked.
+const unplayableMark = "unplayable"
+
+// Codec tags of streams that are encrypted, such as iTunes' FairPlay and MP4's common encryption.
+var encryptedCodecTags = map[string]bool{"drms": true, "drmi": true, "enca": true, "encv": true}
+
+func (srv *Server) initProblemFiles() error {
+	switch srv.ProblemFiles {
+	case ProblemFilesHide, ProblemFilesMark, ProblemFilesList:
+		return nil
+	}
+	return fmt.Errorf("unknown problem files handling %q, want mark or list", srv.ProblemFiles)
+}
+
+func (srv *Server) problemFiles() string {
+	return srv.settings().ProblemFiles
+}
+
+// Returns why the media file that's been identified can't be played, or "" if it looks fine. It's
+// only known for files that were probed.
+func mediaProblem(f *MediaFile) string {
+	if !f.probed {
+		return ""
+	}
+	if f.FileInfo.Size() == 0 {
+		return "empty"
+	}
+	// Pictures ffprobe can't read, such as RAW photos, are still served as they are.
+	if mt := mimeType(f.MimeType); !mt.IsAudio() && !mt.IsVideo() {
+		return ""
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case f.probeError == errInvalidMediaData:
+		return "truncated or corrupt"
+	case errors.As(f.probeError, &exitErr):
+		return fmt.Sprintf("ffprobe failed: %v", f.probeError)
+	case f.probeError != nil:
+		// Not the file's fault.
+		return ""
+	}
+	if probeEncrypted(f.probeInfo) {
+		return "DRM protected"
+	}
+	return ""
+}
+
+func probeEncrypted(info *ffprobe.Info) bool {
+	if info == nil {
+		return false
+	}
+	for _, strm := range info.Streams {
+		if tag, _ := strm["codec_tag_string"].(string); encryptedCodecTags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// A media file that can't be played, for the status page and API.
+type problemFile struct {
+	Path    string
+	Problem string
+}
+
+// The media files found to have problems when they were identified, by path.
+type problemFileSet struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+// Records the problem in md of the file at path, or that it has none.
+func (me *problemFileSet) note(path string, md *Metadata) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if md.Problem == "" {
+		delete(me.files, path)
+		return
+	}
+	if me.files == nil {
+		me.files = make(map[string]string)
+	}
+	me.files[path] = md.Problem
+}
+
+// Returns the files with problems by path, forgetting those that are gone from fsys.
+func (me *problemFileSet) list(fsys FS) (ret []problemFile) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for p, problem := range me.files {
+		if _, err := fsys.Stat(p); err != nil {
+			delete(me.files, p)
+			continue
+		}
+		ret = append(ret, problemFile{p, problem})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Path < ret[j].Path
+	})
+	return
+}
@@ -0,0 +1,48 @@
+package dms
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/ffprobe"
+)
+
+func TestMediaProblem(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a.mp4")
+	os.WriteFile(p, []byte("x"), 0o644)
+	fi, _ := os.Stat(p)
+	drm := &ffprobe.Info{Streams: []map[string]interface{}{{"codec_tag_string": "drms"}}}
+	for _, c := range []struct {
+		mimeType string
+		probed   bool
+		info     *ffprobe.Info
+		err      error
+		want     string
+	}{
+		{"video/mp4", false, nil, nil, ""},
+		{"video/mp4", true, &ffprobe.Info{}, nil, ""},
+		{"video/mp4", true, nil, errInvalidMediaData, "truncated or corrupt"},
+		{"image/x-canon-cr2", true, nil, errInvalidMediaData, ""},
+		// Such as ffprobe not being able to run.
+		{"video/mp4", true, nil, errors.New("too many open files"), ""},
+		{"audio/mp4", true, drm, nil, "DRM protected"},
+	} {
+		f := &MediaFile{Path: p, FileInfo: fi, MimeType: c.mimeType, probed: c.probed, probeInfo: c.info, probeError: c.err}
+		if got := mediaProblem(f); got != c.want {
+			t.Errorf("%v: got %q, want %q", c, got, c.want)
+		}
+	}
+	var set problemFileSet
+	set.note(p, &Metadata{Problem: "empty"})
+	set.note(filepath.Join(dir, "gone.mp4"), &Metadata{Problem: "empty"})
+	if l := set.list(osFS{}); len(l) != 1 || l[0].Path != p {
+		t.Fatalf("listed %v", l)
+	}
+	set.note(p, &Metadata{})
+	if l := set.list(osFS{}); len(l) != 0 {
+		t.Fatalf("listed %v", l)
+	}
+}
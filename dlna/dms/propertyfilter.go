@@ -0,0 +1,150 @@
+package dms
+
+import (
+	"strings"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// The properties the Filter of a Browse or Search asks for, such as "dc:date,res,res@duration".
+// The ID, parent ID, title, class and restricted properties are always given, and nil asks for
+// everything.
+type propertyFilter map[string]bool
+
+// Parses the Filter of a Browse or Search. An empty Filter asks for everything, rather than only
+// the required properties, as control points that send one expect, as other servers have it.
+func parsePropertyFilter(s string) propertyFilter {
+	ret := make(propertyFilter)
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "*" {
+			return nil
+		}
+		if p != "" {
+			ret[p] = true
+		}
+	}
+	if len(ret) == 0 {
+		return nil
+	}
+	return ret
+}
+
+// Whether any of the names of a property are asked for, including with a namespace wildcard such
+// as "upnp:*".
+func (me propertyFilter) has(names ...string) bool {
+	if me == nil {
+		return true
+	}
+	for _, n := range names {
+		if me[n] {
+			return true
+		}
+		if ns, _, ok := strings.Cut(n, ":"); ok && me[ns+":*"] {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the resources are asked for, which giving any of their attributes does too.
+func (me propertyFilter) hasRes() bool {
+	if me.has("res") {
+		return true
+	}
+	for p := range me {
+		if strings.HasPrefix(p, "res@") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the object with only the properties asked for, as the last thing before it's sanitized.
+// Objects are cached, so they're copied rather than changed.
+func (me propertyFilter) arrange(obj interface{}) interface{} {
+	if me == nil {
+		return obj
+	}
+	switch o := obj.(type) {
+	case upnpav.Container:
+		o.Object = me.object(o.Object, "container")
+		o.OmitChildCount = !me.has("@childCount", "container@childCount")
+		return o
+	case upnpav.Item:
+		o.Object = me.object(o.Object, "item")
+		if !me.has("sec:dcmInfo") {
+			o.DCMInfo = ""
+		}
+		o.Res = me.resources(o.Res)
+		return o
+	}
+	return obj
+}
+
+func (me propertyFilter) object(o upnpav.Object, element string) upnpav.Object {
+	if !me.has("@refID", element+"@refID") {
+		o.RefID = ""
+	}
+	if !me.has("upnp:icon") {
+		o.Icon = ""
+	}
+	if !me.has("dc:date") {
+		o.Date = upnpav.Timestamp{}
+	}
+	if !me.has("upnp:artist") {
+		o.Artist = ""
+	}
+	if !me.has("upnp:album") {
+		o.Album = ""
+	}
+	if !me.has("upnp:genre") {
+		o.Genre = ""
+	}
+	if !me.has("dc:description") {
+		o.Description = ""
+	}
+	if !me.has("upnp:albumArtURI") {
+		o.AlbumArtURI = ""
+	}
+	if !me.has("upnp:seriesTitle") {
+		o.SeriesTitle = ""
+	}
+	if !me.has("upnp:episodeSeason") {
+		o.EpisodeSeason = 0
+	}
+	if !me.has("upnp:episodeNumber") {
+		o.EpisodeNumber = 0
+	}
+	return o
+}
+
+// Returns the resources with only the attributes asked for. The protocolInfo is always given.
+func (me propertyFilter) resources(res []upnpav.Resource) []upnpav.Resource {
+	if !me.hasRes() {
+		return nil
+	}
+	ret := make([]upnpav.Resource, len(res))
+	for i, r := range res {
+		if !me.has("res@size") {
+			r.Size = 0
+		}
+		if !me.has("res@bitrate") {
+			r.Bitrate = 0
+		}
+		if !me.has("res@duration") {
+			r.Duration = ""
+		}
+		if !me.has("res@resolution") {
+			r.Resolution = ""
+		}
+		if !me.has("res@sampleFrequency") {
+			r.SampleFrequency = 0
+		}
+		if !me.has("res@nrAudioChannels") {
+			r.NrAudioChannels = 0
+		}
+		ret[i] = r
+	}
+	return ret
+}
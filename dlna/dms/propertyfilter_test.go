@@ -0,0 +1,50 @@
+package dms
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestPropertyFilter(t *testing.T) {
+	date := upnpav.Timestamp{Time: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)}
+	item := upnpav.Item{
+		Object: upnpav.Object{ID: "%2Fa.mkv", ParentID: "0", Title: "A", Class: "object.item.videoItem", Date: date, Genre: "Drama", Artist: "B"},
+		Res:    []upnpav.Resource{{ProtocolInfo: "http-get:*:video/x-matroska:*", URL: "http://h/res", Size: 1000, Duration: "0:01:00.000"}},
+	}
+	container := upnpav.Container{Object: upnpav.Object{ID: "%2Fb", ParentID: "0", Title: "B", Class: "object.container", Date: date}, ChildCount: 0}
+	marshal := func(filter string, obj interface{}) string {
+		b, err := xml.Marshal(parsePropertyFilter(filter).arrange(obj))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	for _, c := range []struct {
+		filter, want string
+		obj          interface{}
+		without      []string
+	}{
+		{"*", `<dc:date>2020-01-02</dc:date>`, item, nil},
+		{"", `size="1000"`, item, nil},
+		{"dc:date,res@duration", `<res protocolInfo="http-get:*:video/x-matroska:*" duration="0:01:00.000">http://h/res</res>`, item, []string{"upnp:genre", "upnp:artist", "size="}},
+		{"upnp:*", `<upnp:genre>Drama</upnp:genre>`, item, []string{"dc:date", "<res"}},
+		{"dc:title", `<dc:title>A</dc:title>`, item, []string{"dc:date", "<res"}},
+		{"*", `<container id="%2Fb" parentID="0" restricted="0" searchable="0" childCount="0">`, container, nil},
+		{"@childCount", `childCount="0"`, container, []string{"dc:date"}},
+		{"dc:date", `<container id="%2Fb" parentID="0" restricted="0" searchable="0"><dc:title>B</dc:title><upnp:class>object.container</upnp:class><dc:date>2020-01-02</dc:date></container>`, container, nil},
+	} {
+		got := marshal(c.filter, c.obj)
+		if !strings.Contains(got, c.want) {
+			t.Errorf("%q: %s doesn't have %s", c.filter, got, c.want)
+		}
+		for _, s := range c.without {
+			if strings.Contains(got, s) {
+				t.Errorf("%q: %s has %s", c.filter, got, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package dms
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+const (
+	// Object paths of the containers of the newest media and of the media played last, in the top
+	// level. Directories of the same names in the shared directory are hidden by them.
+	recentlyAddedPath   = "/@added"
+	recentlyAddedTitle  = "Recently Added"
+	recentlyPlayedPath  = "/@played"
+	recentlyPlayedTitle = "Recently Played"
+)
+
+// The containers within Recently Added, by the type of their media, in the order they're listed.
+var recentlyAddedKinds = []struct {
+	mimeType string
+	title    string
+}{
+	{"video", "Videos"},
+	{"audio", "Music"},
+	{"image", "Photos"},
+}
+
+// The newest media in the index, from a scan of it. It's kept a while like the places, since the
+// top level container needs to know if there's any every time it's browsed.
+type recentlyAddedCache struct {
+	mu sync.Mutex
+	// Object paths of the newest files first, by the type of their media.
+	byKind  map[string][]string
+	expires time.Time
+}
+
+// Drops the newest media, such as when the shared directories change.
+func (me *recentlyAddedCache) clear() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.byKind = nil
+}
+
+// The media played most recently, newest first.
+type recentlyPlayed struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+// Puts the object path first, keeping at most max.
+func (me *recentlyPlayed) played(objectPath string, max int) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ret := append(make([]string, 0, len(me.paths)+1), objectPath)
+	for _, p := range me.paths {
+		if p != objectPath && len(ret) < max {
+			ret = append(ret, p)
+		}
+	}
+	me.paths = ret
+}
+
+func (me *recentlyPlayed) list(max int) []string {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if len(me.paths) > max {
+		me.paths = me.paths[:max]
+	}
+	return append([]string(nil), me.paths...)
+}
+
+// The number of media listed in each of the recent containers, or 0 if they aren't listed.
+func (srv *Server) recentItems() int {
+	return srv.settings().RecentItems
+}
+
+// Whether the object path is one of the recent containers or within them.
+func isRecentPath(p string) bool {
+	for _, c := range []string{recentlyAddedPath, recentlyPlayedPath} {
+		if p == c || strings.HasPrefix(p, c+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Notes that the media at the object path was played, for Recently Played.
+func (srv *Server) notePlayed(objectPath string) {
+	if n := srv.recentItems(); n != 0 && objectPath != "" && !isRecentPath(objectPath) {
+		srv.recentlyPlayed.played(path.Clean("/"+objectPath), n)
+	}
+}
+
+// Returns the object paths of the newest media in the index, newest first, by the type of their
+// media.
+func (srv *Server) recentlyAdded() map[string][]string {
+	c := &srv.recentlyAddedCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.byKind != nil && now.Before(c.expires) {
+		return c.byKind
+	}
+	type file struct {
+		path     string
+		modified time.Time
+	}
+	files := make(map[string][]file)
+	err := srv.index.forEachEntry("/", true, func(dir string, e *indexEntry) bool {
+		if !e.Mode.IsRegular() {
+			return true
+		}
+		mt, err := MimeTypeByPath(e.Name)
+		if err != nil || !mt.IsMedia() {
+			return true
+		}
+		files[mt.Type()] = append(files[mt.Type()], file{path.Join(dir, e.Name), e.ModTime})
+		return true
+	})
+	if err != nil {
+		srv.Logger.Printf("error listing recently added media: %v", err)
+		return nil
+	}
+	n := srv.recentItems()
+	ret := make(map[string][]string)
+	for kind, fs := range files {
+		sort.Slice(fs, func(i, j int) bool {
+			if !fs[i].modified.Equal(fs[j].modified) {
+				return fs[i].modified.After(fs[j].modified)
+			}
+			return fs[i].path < fs[j].path
+		})
+		if len(fs) > n {
+			fs = fs[:n]
+		}
+		for _, f := range fs {
+			ret[kind] = append(ret[kind], f.path)
+		}
+	}
+	c.byKind, c.expires = ret, now.Add(browseCacheTTL)
+	return ret
+}
+
+// Returns the containers in Recently Added, which are of the types of media there are.
+func (me *contentDirectoryService) recentlyAddedContainers() (ret []upnpav.Container) {
+	if me.recentItems() == 0 || me.index == nil {
+		return nil
+	}
+	byKind := me.recentlyAdded()
+	for _, k := range recentlyAddedKinds {
+		if len(byKind[k.mimeType]) == 0 {
+			continue
+		}
+		ret = append(ret, recentContainer(path.Join(recentlyAddedPath, k.mimeType), me.localTitle(k.title), len(byKind[k.mimeType])))
+	}
+	return
+}
+
+func recentContainer(objectPath, title string, childCount int) upnpav.Container {
+	o := object{Path: objectPath}
+	return upnpav.Container{
+		Object: upnpav.Object{
+			ID:         o.ID(),
+			ParentID:   o.ParentID(),
+			Restricted: 1,
+			Class:      "object.container",
+			Title:      title,
+		},
+		ChildCount: childCount,
+	}
+}
+
+// Returns the recent containers that have anything in them, for the top level.
+func (me *contentDirectoryService) recentContainers() (ret []interface{}) {
+	if cs := me.recentlyAddedContainers(); len(cs) != 0 {
+		ret = append(ret, recentContainer(recentlyAddedPath, me.localTitle(recentlyAddedTitle), len(cs)))
+	}
+	if n := me.recentItems(); n != 0 {
+		if played := me.recentlyPlayed.list(n); len(played) != 0 {
+			ret = append(ret, recentContainer(recentlyPlayedPath, me.localTitle(recentlyPlayedTitle), len(played)))
+		}
+	}
+	return
+}
+
+// Returns the number of top level objects the recent containers add.
+func (me *contentDirectoryService) recentChildCount() int {
+	return len(me.recentContainers())
+}
+
+// Returns the item for media in a container that gathers it from the library, such as a recent
+// one, which refers to the media where it is in the shared directories.
+func (me *contentDirectoryService) referringItem(containerPath, mediaPath, host, userAgent string) (ret interface{}, ok bool) {
+	media, err := me.objectFromPath(mediaPath)
+	if err != nil {
+		return
+	}
+	obj, err := me.objectMetadata(media, host, userAgent)
+	if err != nil {
+		return
+	}
+	item, ok := obj.(upnpav.Item)
+	if !ok {
+		return
+	}
+	item.RefID = item.ID
+	item.ID = object{Path: containerPath + mediaPath}.ID()
+	item.ParentID = object{Path: containerPath}.ID()
+	return item, true
+}
+
+// Returns the object paths of the media in a recent container, or false if there's no such
+// container.
+func (me *contentDirectoryService) recentMedia(containerPath string) ([]string, bool) {
+	n := me.recentItems()
+	if n == 0 {
+		return nil, false
+	}
+	if containerPath == recentlyPlayedPath {
+		return me.recentlyPlayed.list(n), true
+	}
+	if me.index == nil || path.Dir(containerPath) != recentlyAddedPath {
+		return nil, false
+	}
+	paths, ok := me.recentlyAdded()[path.Base(containerPath)]
+	return paths, ok
+}
+
+// Splits an object path within the recent containers into the container and the object path of
+// the media, if it's of media in one.
+func splitRecentPath(p string) (containerPath, mediaPath string) {
+	if rest := strings.TrimPrefix(p, recentlyPlayedPath); rest != p {
+		return recentlyPlayedPath, rest
+	}
+	kind, mediaPath, _ := strings.Cut(strings.TrimPrefix(p, recentlyAddedPath+"/"), "/")
+	if mediaPath != "" {
+		mediaPath = "/" + mediaPath
+	}
+	return path.Join(recentlyAddedPath, kind), mediaPath
+}
+
+// Returns the objects in a recent container.
+func (me *contentDirectoryService) readRecentContainer(o object, host, userAgent string) ([]interface{}, error) {
+	if o.Path == recentlyAddedPath && me.recentItems() != 0 {
+		var ret []interface{}
+		for _, c := range me.recentlyAddedContainers() {
+			ret = append(ret, c)
+		}
+		return ret, nil
+	}
+	paths, ok := me.recentMedia(o.Path)
+	if !ok {
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such recent container")
+	}
+	var ret []interface{}
+	for _, p := range paths {
+		if item, ok := me.referringItem(o.Path, p, host, userAgent); ok {
+			ret = append(ret, item)
+		}
+	}
+	return ret, nil
+}
+
+// Returns the object for an object path within the recent containers, as given to
+// BrowseMetadata.
+func (me *contentDirectoryService) recentObject(o object, host, userAgent string) (interface{}, error) {
+	if o.Path == recentlyAddedPath || o.Path == recentlyPlayedPath {
+		for _, c := range me.recentContainers() {
+			if c.(upnpav.Container).ID == o.ID() {
+				return c, nil
+			}
+		}
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such recent container")
+	}
+	containerPath, mediaPath := splitRecentPath(o.Path)
+	if mediaPath == "" {
+		for _, c := range me.recentlyAddedContainers() {
+			if c.ID == o.ID() {
+				return c, nil
+			}
+		}
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such recent container")
+	}
+	paths, _ := me.recentMedia(containerPath)
+	for _, p := range paths {
+		if p == mediaPath {
+			if item, ok := me.referringItem(containerPath, p, host, userAgent); ok {
+				return item, nil
+			}
+		}
+	}
+	return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such recent media")
+}
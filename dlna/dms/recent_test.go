@@ -0,0 +1,32 @@
+package dms
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRecentlyPlayed(t *testing.T) {
+	var rp recentlyPlayed
+	for _, p := range []string{"/a.mkv", "/b.mp3", "/a.mkv", "/c.flac"} {
+		rp.played(p, 3)
+	}
+	if got := rp.list(3); !reflect.DeepEqual(got, []string{"/c.flac", "/a.mkv", "/b.mp3"}) {
+		t.Fatalf("got %q", got)
+	}
+	rp.played("/d.jpg", 3)
+	if got := rp.list(2); !reflect.DeepEqual(got, []string{"/d.jpg", "/c.flac"}) {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestSplitRecentPath(t *testing.T) {
+	for p, want := range map[string][2]string{
+		"/@played/Films/Heat.mkv":      {recentlyPlayedPath, "/Films/Heat.mkv"},
+		"/@added/video":                {"/@added/video", ""},
+		"/@added/audio/Music/a b.flac": {"/@added/audio", "/Music/a b.flac"},
+	} {
+		if c, m := splitRecentPath(p); c != want[0] || m != want[1] {
+			t.Errorf("%q split into %q, %q", p, c, m)
+		}
+	}
+}
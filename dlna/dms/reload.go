@@ -0,0 +1,356 @@
+package dms
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/anacrolix/log"
+	"golang.org/x/text/language"
+
+	"github.com/anacrolix/dms/ssdp"
+	"github.com/anacrolix/dms/transcode"
+)
+
+// The settings of a Server that Reload can change, as of the last Init or Reload, under the names
+// of its fields. Requests read them from this snapshot, which Reload replaces whole rather than
+// changing, so that they never see a reload half done. Its slices and maps are never changed.
+type reloadableSettings struct {
+	FriendlyName           string
+	RootObjectPath         string
+	RootDirs               []RootDir
+	LogHeaders             bool
+	NoTranscode            bool
+	ForceTranscodeTo       string
+	NoProbe                bool
+	NoPhotoGrouping        bool
+	PrefetchBrowse         bool
+	Icons                  []Icon
+	StallEventSubscribe    bool
+	InterfacePriority      []string
+	IgnoreHidden           bool
+	IgnoreUnreadable       bool
+	IgnorePaths            []string
+	IgnoreNomedia          bool
+	IncludePatterns        []string
+	ExcludePatterns        []string
+	AllowedIpNets          []*net.IPNet
+	AllowDynamicStreams    bool
+	TranscodeLogPattern    string
+	CheckUpdates           bool
+	LPCMUserAgents         []string
+	RemoteStreams          []RemoteStream
+	StrmProxyUserAgents    []string
+	MetadataProviders      []string
+	Hooks                  map[string][]string
+	ImageCacheDir          string
+	SimulatedLatency       time.Duration
+	SimulatedKbps          int
+	PhotoPlaces            bool
+	AudioProfiles          []AudioProfile
+	HWAccel                transcode.HWAccel
+	IncompleteFiles        string
+	TranscodeCacheDir      string
+	TranscodeCacheSize     int64
+	StreamKbps             int
+	TotalStreamKbps        int
+	MaxStreams             int
+	ShutdownTimeout        time.Duration
+	SOAPDumpClients        []string
+	SOAPDumpDir            string
+	SSDPDumpPath           string
+	ProblemFiles           string
+	RecentItems            int
+	KeepMissing            time.Duration
+	AllowUpload            bool
+	UploadDir              string
+	AllowDelete            bool
+	DeleteIpNets           []*net.IPNet
+	AccessLogFormat        string
+	SSDPAllowInterfaces    []string
+	SSDPSkipVirtual        bool
+	WebUsers               []WebUser
+	WebUIAuth              map[string]string
+	ClientRules            []ClientRule
+	ProtectedContainers    []string
+	ParentalPIN            string
+	ParentalUnlockDuration time.Duration
+	Locale                 string
+	GeneratedTitles        map[string]string
+	MimeTypeOverrides      []MimeTypeOverride
+	ClassContainers        bool
+	TVShows                bool
+	WatchedPrefix          string
+	WatchedContainers      bool
+	// Compiled from IncludePatterns and ExcludePatterns.
+	includePatterns, excludePatterns namePatterns
+	// Compiled from Locale and GeneratedTitles.
+	localeTag    language.Tag
+	localeTitles map[string]string
+}
+
+// Returns the snapshot of the settings.
+func (srv *Server) settings() *reloadableSettings {
+	if s := srv.reloadable.Load(); s != nil {
+		return s
+	}
+	// Not initialized, such as in tests.
+	return srv.takeSettings()
+}
+
+// Takes a snapshot of the settings from the fields of srv, once the init functions have checked
+// and compiled them.
+func (srv *Server) takeSettings() *reloadableSettings {
+	return &reloadableSettings{
+		FriendlyName:           srv.FriendlyName,
+		RootObjectPath:         srv.RootObjectPath,
+		RootDirs:               srv.RootDirs,
+		LogHeaders:             srv.LogHeaders,
+		NoTranscode:            srv.NoTranscode,
+		ForceTranscodeTo:       srv.ForceTranscodeTo,
+		NoProbe:                srv.NoProbe,
+		NoPhotoGrouping:        srv.NoPhotoGrouping,
+		PrefetchBrowse:         srv.PrefetchBrowse,
+		Icons:                  srv.Icons,
+		StallEventSubscribe:    srv.StallEventSubscribe,
+		InterfacePriority:      srv.InterfacePriority,
+		IgnoreHidden:           srv.IgnoreHidden,
+		IgnoreUnreadable:       srv.IgnoreUnreadable,
+		IgnorePaths:            srv.IgnorePaths,
+		IgnoreNomedia:          srv.IgnoreNomedia,
+		IncludePatterns:        srv.IncludePatterns,
+		ExcludePatterns:        srv.ExcludePatterns,
+		AllowedIpNets:          srv.AllowedIpNets,
+		AllowDynamicStreams:    srv.AllowDynamicStreams,
+		TranscodeLogPattern:    srv.TranscodeLogPattern,
+		CheckUpdates:           srv.CheckUpdates,
+		LPCMUserAgents:         srv.LPCMUserAgents,
+		RemoteStreams:          srv.RemoteStreams,
+		StrmProxyUserAgents:    srv.StrmProxyUserAgents,
+		MetadataProviders:      srv.MetadataProviders,
+		Hooks:                  srv.Hooks,
+		ImageCacheDir:          srv.ImageCacheDir,
+		SimulatedLatency:       srv.SimulatedLatency,
+		SimulatedKbps:          srv.SimulatedKbps,
+		PhotoPlaces:            srv.PhotoPlaces,
+		AudioProfiles:          srv.AudioProfiles,
+		HWAccel:                srv.HWAccel,
+		IncompleteFiles:        srv.IncompleteFiles,
+		TranscodeCacheDir:      srv.TranscodeCacheDir,
+		TranscodeCacheSize:     srv.TranscodeCacheSize,
+		StreamKbps:             srv.StreamKbps,
+		TotalStreamKbps:        srv.TotalStreamKbps,
+		MaxStreams:             srv.MaxStreams,
+		ShutdownTimeout:        srv.ShutdownTimeout,
+		SOAPDumpClients:        srv.SOAPDumpClients,
+		SOAPDumpDir:            srv.SOAPDumpDir,
+		SSDPDumpPath:           srv.SSDPDumpPath,
+		ProblemFiles:           srv.ProblemFiles,
+		RecentItems:            srv.RecentItems,
+		KeepMissing:            srv.KeepMissing,
+		AllowUpload:            srv.AllowUpload,
+		UploadDir:              srv.UploadDir,
+		AllowDelete:            srv.AllowDelete,
+		DeleteIpNets:           srv.DeleteIpNets,
+		AccessLogFormat:        srv.AccessLogFormat,
+		SSDPAllowInterfaces:    srv.SSDPAllowInterfaces,
+		SSDPSkipVirtual:        srv.SSDPSkipVirtual,
+		WebUsers:               srv.WebUsers,
+		WebUIAuth:              srv.WebUIAuth,
+		ClientRules:            srv.ClientRules,
+		ProtectedContainers:    srv.ProtectedContainers,
+		ParentalPIN:            srv.ParentalPIN,
+		ParentalUnlockDuration: srv.ParentalUnlockDuration,
+		Locale:                 srv.Locale,
+		GeneratedTitles:        srv.GeneratedTitles,
+		MimeTypeOverrides:      srv.MimeTypeOverrides,
+		ClassContainers:        srv.ClassContainers,
+		TVShows:                srv.TVShows,
+		WatchedPrefix:          srv.WatchedPrefix,
+		WatchedContainers:      srv.WatchedContainers,
+		includePatterns:        srv.includePatterns,
+		excludePatterns:        srv.excludePatterns,
+		localeTag:              srv.localeTag,
+		localeTitles:           srv.localeTitles,
+	}
+}
+
+// Sets the fields of srv to the settings, for Reload to change.
+func (s *reloadableSettings) apply(srv *Server) {
+	srv.FriendlyName = s.FriendlyName
+	srv.RootObjectPath = s.RootObjectPath
+	srv.RootDirs = s.RootDirs
+	srv.LogHeaders = s.LogHeaders
+	srv.NoTranscode = s.NoTranscode
+	srv.ForceTranscodeTo = s.ForceTranscodeTo
+	srv.NoProbe = s.NoProbe
+	srv.NoPhotoGrouping = s.NoPhotoGrouping
+	srv.PrefetchBrowse = s.PrefetchBrowse
+	srv.Icons = s.Icons
+	srv.StallEventSubscribe = s.StallEventSubscribe
+	srv.InterfacePriority = s.InterfacePriority
+	srv.IgnoreHidden = s.IgnoreHidden
+	srv.IgnoreUnreadable = s.IgnoreUnreadable
+	srv.IgnorePaths = s.IgnorePaths
+	srv.IgnoreNomedia = s.IgnoreNomedia
+	srv.IncludePatterns = s.IncludePatterns
+	srv.ExcludePatterns = s.ExcludePatterns
+	srv.AllowedIpNets = s.AllowedIpNets
+	srv.AllowDynamicStreams = s.AllowDynamicStreams
+	srv.TranscodeLogPattern = s.TranscodeLogPattern
+	srv.CheckUpdates = s.CheckUpdates
+	srv.LPCMUserAgents = s.LPCMUserAgents
+	srv.RemoteStreams = s.RemoteStreams
+	srv.StrmProxyUserAgents = s.StrmProxyUserAgents
+	srv.MetadataProviders = s.MetadataProviders
+	srv.Hooks = s.Hooks
+	srv.ImageCacheDir = s.ImageCacheDir
+	srv.SimulatedLatency = s.SimulatedLatency
+	srv.SimulatedKbps = s.SimulatedKbps
+	srv.PhotoPlaces = s.PhotoPlaces
+	srv.AudioProfiles = s.AudioProfiles
+	srv.HWAccel = s.HWAccel
+	srv.IncompleteFiles = s.IncompleteFiles
+	srv.TranscodeCacheDir = s.TranscodeCacheDir
+	srv.TranscodeCacheSize = s.TranscodeCacheSize
+	srv.StreamKbps = s.StreamKbps
+	srv.TotalStreamKbps = s.TotalStreamKbps
+	srv.MaxStreams = s.MaxStreams
+	srv.ShutdownTimeout = s.ShutdownTimeout
+	srv.SOAPDumpClients = s.SOAPDumpClients
+	srv.SOAPDumpDir = s.SOAPDumpDir
+	srv.SSDPDumpPath = s.SSDPDumpPath
+	srv.ProblemFiles = s.ProblemFiles
+	srv.RecentItems = s.RecentItems
+	srv.KeepMissing = s.KeepMissing
+	srv.AllowUpload = s.AllowUpload
+	srv.UploadDir = s.UploadDir
+	srv.AllowDelete = s.AllowDelete
+	srv.DeleteIpNets = s.DeleteIpNets
+	srv.AccessLogFormat = s.AccessLogFormat
+	srv.SSDPAllowInterfaces = s.SSDPAllowInterfaces
+	srv.SSDPSkipVirtual = s.SSDPSkipVirtual
+	srv.WebUsers = s.WebUsers
+	srv.WebUIAuth = s.WebUIAuth
+	srv.ClientRules = s.ClientRules
+	srv.ProtectedContainers = s.ProtectedContainers
+	srv.ParentalPIN = s.ParentalPIN
+	srv.ParentalUnlockDuration = s.ParentalUnlockDuration
+	srv.Locale = s.Locale
+	srv.GeneratedTitles = s.GeneratedTitles
+	srv.MimeTypeOverrides = s.MimeTypeOverrides
+	srv.ClassContainers = s.ClassContainers
+	srv.TVShows = s.TVShows
+	srv.WatchedPrefix = s.WatchedPrefix
+	srv.WatchedContainers = s.WatchedContainers
+}
+
+// Reload applies changes that f makes to the settings of a running Server: the fields of
+// reloadableSettings. f is given a Server with those fields set to the current settings, and
+// changes to other fields are ignored. If they're all valid, they replace the snapshot requests
+// read, so an error leaves the Server as it was. The Server's own fields keep what it was started
+// with. If the device description is affected, it's regenerated and control points are told to
+// refetch it with ssdp:update. The device UUID is kept, even if FriendlyName changes.
+func (srv *Server) Reload(f func(*Server)) (err error) {
+	srv.mu.Lock()
+	// The init functions check the settings against these, and may log.
+	next := &Server{AdminConn: srv.AdminConn, Logger: srv.Logger}
+	srv.settings().apply(next)
+	// The init functions change these in place.
+	next.RootDirs = append([]RootDir(nil), next.RootDirs...)
+	next.ClientRules = append([]ClientRule(nil), next.ClientRules...)
+	f(next)
+	if next.FriendlyName == "" {
+		next.FriendlyName = getDefaultFriendlyName()
+	}
+	if err = next.initRootDirs(); err == nil {
+		err = next.initMetadataProviders()
+	}
+	if err == nil {
+		err = next.initHooks()
+	}
+	if err == nil {
+		err = next.initNamePatterns()
+	}
+	if err == nil {
+		err = next.initRemoteStreams()
+	}
+	if err == nil {
+		err = next.initAudioProfiles()
+	}
+	if err == nil {
+		err = next.HWAccel.Check()
+	}
+	if err == nil {
+		err = next.initIncompleteFiles()
+	}
+	if err == nil {
+		err = next.initProblemFiles()
+	}
+	if err == nil {
+		err = next.initAccessLog()
+	}
+	if err == nil {
+		err = next.initSSDPAllowInterfaces()
+	}
+	if err == nil {
+		err = next.initWebUsers()
+	}
+	if err == nil {
+		err = next.initClientRules()
+	}
+	if err == nil {
+		err = next.initProtectedContainers()
+	}
+	if err == nil {
+		err = next.initLocale()
+	}
+	if err == nil {
+		err = next.initMimeTypeOverrides()
+	}
+	if err != nil {
+		srv.mu.Unlock()
+		return
+	}
+	prev, prevShared := srv.settings(), srv.sharedDirs()
+	srv.reloadable.Store(next.takeSettings())
+	srv.shared.Store(next.sharedDirs())
+	oldDescXML, oldConfigID := srv.rootDescXML, srv.configID
+	srv.rootDescXML, srv.configID, err = srv.makeRootDescXML()
+	if err != nil {
+		srv.reloadable.Store(prev)
+		srv.shared.Store(prevShared)
+		srv.rootDescXML, srv.configID = oldDescXML, oldConfigID
+		srv.mu.Unlock()
+		return
+	}
+	changed := !bytes.Equal(oldDescXML, srv.rootDescXML)
+	configID := srv.configID
+	if changed {
+		// ssdp:update moves the running SSDP servers to the next boot ID, and new ones must
+		// start there too.
+		srv.bootID++
+	}
+	ssdpServers := make([]*ssdp.Server, 0, len(srv.ssdpServers))
+	for s := range srv.ssdpServers {
+		ssdpServers = append(ssdpServers, s)
+	}
+	srv.mu.Unlock()
+	srv.warnSimulatedNetwork()
+	// Listings depend on the shared directories and options such as NoPhotoGrouping.
+	srv.clearListingCaches()
+	if srv.index != nil {
+		// The shared directories may have changed.
+		srv.index.rescan("/", true)
+	}
+	if !changed {
+		return
+	}
+	srv.Logger.Levelf(log.Info, "device description changed, sending ssdp:update")
+	for _, s := range ssdpServers {
+		if err := s.Update(configID); err != nil {
+			srv.Logger.Printf("error sending ssdp:update on %q: %v", s.Interface.Name, err)
+		}
+	}
+	return nil
+}
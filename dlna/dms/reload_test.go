@@ -0,0 +1,97 @@
+package dms
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	srv := newMemFSServer()
+	srv.FriendlyName = "Den"
+	srv.AccessLogFormat = AccessLogFields
+	srv.IncompleteFiles = IncompleteFilesServe
+	srv.ProblemFiles = ProblemFilesMark
+	if err := srv.initRootDirs(); err != nil {
+		t.Fatal(err)
+	}
+	// One invalid setting leaves everything as it was.
+	err := srv.Reload(func(srv *Server) {
+		srv.FriendlyName = "Lounge"
+		srv.RootObjectPath = "/other"
+		srv.IncludePatterns = []string{"re:("}
+	})
+	if err == nil {
+		t.Fatal("reloaded a bad include pattern")
+	}
+	if s := srv.settings(); s.FriendlyName != "Den" || s.RootObjectPath != "/media" || s.IncludePatterns != nil {
+		t.Fatalf("half applied: %q %q %q", s.FriendlyName, s.RootObjectPath, s.IncludePatterns)
+	}
+	if got := srv.sharedDirs().rootObjectPath; got != "/media" {
+		t.Fatalf("shared directory is %q", got)
+	}
+	if err := srv.Reload(func(srv *Server) {
+		srv.FriendlyName = "Lounge"
+		srv.RootObjectPath = "/other"
+		srv.IncludePatterns = []string{"*.mkv"}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if s := srv.settings(); s.FriendlyName != "Lounge" || srv.sharedDirs().rootObjectPath != "/other" || srv.filterPath("/media/film.mp4") == "" {
+		t.Fatalf("not applied: %q %q", s.FriendlyName, srv.sharedDirs().rootObjectPath)
+	}
+	// What it was started with is kept.
+	if srv.FriendlyName != "Den" {
+		t.Errorf("Server field changed to %q", srv.FriendlyName)
+	}
+}
+
+// Requests read the shared directories and the other settings while they're reloaded, which the
+// race detector checks.
+func TestReloadSharedDirsRace(t *testing.T) {
+	srv := newMemFSServer()
+	srv.AccessLogFormat = AccessLogFields
+	srv.IncompleteFiles = IncompleteFilesServe
+	srv.ProblemFiles = ProblemFilesMark
+	if err := srv.initRootDirs(); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			srv.objectFromPath("/a/film.mp4")
+			srv.objectFromFilePath("/media/film.mp4")
+			srv.sharedDirOf("/media/film.mp4")
+			srv.filePath("/film.mp4")
+			srv.IgnorePath("/media/film.mp4")
+			srv.localTitle("Music")
+			srv.streamRateLimits()
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		i := i
+		if err := srv.Reload(func(srv *Server) {
+			srv.IgnorePaths = []string{"tmp"}
+			srv.StreamKbps = i
+			srv.IgnoreUnreadable = i%2 == 0
+			srv.GeneratedTitles = map[string]string{"Music": fmt.Sprint("Lieder ", i)}
+			if i%2 == 0 {
+				srv.RootDirs = []RootDir{{Path: "/media", Name: "a"}, {Path: "/other", Name: "b"}}
+			} else {
+				srv.RootDirs = nil
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,67 @@
+package dms
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// How long fetching from a remote server waits to connect, and then for the response's
+	// headers.
+	remoteConnectTimeout  = 10 * time.Second
+	remoteResponseTimeout = 30 * time.Second
+	// How long the body of a remote response can send nothing before the fetch is given up on.
+	// There's no limit on the whole of it, since media can take hours to stream.
+	remoteStallTimeout = time.Minute
+	// The most redirects followed by a fetch.
+	maxRemoteRedirects = 5
+)
+
+var remoteTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           (&net.Dialer{Timeout: remoteConnectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+	TLSHandshakeTimeout:   remoteConnectTimeout,
+	ResponseHeaderTimeout: remoteResponseTimeout,
+	IdleConnTimeout:       90 * time.Second,
+}
+
+// Returns a client for fetching from remote servers, such as remote media for renderers and
+// uploads from control points. It follows at most maxRemoteRedirects redirects, and only to URLs
+// that allowed, if it's given, returns nil for, so that a server can't redirect a fetch somewhere
+// it wasn't meant to go.
+func newRemoteClient(allowed func(*url.URL) error) *http.Client {
+	return &http.Client{
+		Transport: remoteTransport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRemoteRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRemoteRedirects)
+			}
+			if allowed == nil {
+				return nil
+			}
+			if err := allowed(req.URL); err != nil {
+				return fmt.Errorf("redirected to %q: %w", req.URL, err)
+			}
+			return nil
+		},
+	}
+}
+
+// Wraps the body of a response from a remote server to call cancel, which cancels the request's
+// context, when a read waits on it for remoteStallTimeout. Only reads are timed, so a renderer
+// that's paused, and isn't taking what's read, doesn't stop it.
+type stallTimeoutReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (me stallTimeoutReader) Read(b []byte) (int, error) {
+	timer := time.AfterFunc(remoteStallTimeout, me.cancel)
+	defer timer.Stop()
+	return me.r.Read(b)
+}
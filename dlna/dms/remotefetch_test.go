@@ -0,0 +1,52 @@
+package dms
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRemoteClientRedirects(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/")); {
+		case r.URL.Path == "/elsewhere":
+			http.Redirect(w, r, "http://example.invalid/", http.StatusFound)
+		case n > 0:
+			http.Redirect(w, r, "/"+strconv.Itoa(n-1), http.StatusFound)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer ts.Close()
+	errElsewhere := errors.New("elsewhere")
+	client := newRemoteClient(func(u *url.URL) error {
+		if u.Host != strings.TrimPrefix(ts.URL, "http://") {
+			return errElsewhere
+		}
+		return nil
+	})
+	for _, tc := range []struct {
+		path string
+		ok   bool
+	}{
+		{"/0", true},
+		{"/" + strconv.Itoa(maxRemoteRedirects), true},
+		{"/" + strconv.Itoa(maxRemoteRedirects+1), false},
+		{"/elsewhere", false},
+	} {
+		resp, err := client.Get(ts.URL + tc.path)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got error %v, want ok %v", tc.path, err, tc.ok)
+		}
+		if tc.path == "/elsewhere" && !errors.Is(err, errElsewhere) {
+			t.Errorf("%s: got error %v, want %v", tc.path, err, errElsewhere)
+		}
+	}
+}
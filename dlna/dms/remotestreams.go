@@ -0,0 +1,165 @@
+package dms
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/dms/dlna"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// Remote media, such as internet radio or IPTV, listed in the streams container.
+type RemoteStream struct {
+	Title string
+	// An http or https URL.
+	URL string
+	// Such as audio/mpeg. If empty, it's guessed from the URL's extension.
+	MimeType string
+	// Send the media through the server for every renderer, such as for URLs only the server can
+	// reach. Otherwise only renderers matched by StrmProxyUserAgents get it through the server,
+	// and the rest are given the URL.
+	Proxy bool
+}
+
+const (
+	// Object path of the container of the RemoteStreams, in the top level. A directory of the same
+	// name in the shared directory is hidden by it.
+	remoteStreamsPath  = "/@streams"
+	remoteStreamsTitle = "Streams"
+)
+
+func (rs RemoteStream) mimeType(u *url.URL) mimeType {
+	if rs.MimeType != "" {
+		return mimeType(rs.MimeType)
+	}
+	return streamURLMimeType(u)
+}
+
+// Checks the remote streams have titles and URLs that can be served.
+func (srv *Server) initRemoteStreams() error {
+	for _, rs := range srv.RemoteStreams {
+		if rs.Title == "" {
+			return fmt.Errorf("remote stream %q has no title", rs.URL)
+		}
+		if _, err := parseStreamURL(rs.URL); err != nil {
+			return fmt.Errorf("remote stream %q: %w", rs.Title, err)
+		}
+		if mt := mimeType(rs.MimeType); mt != "" && !mt.IsAudio() && !mt.IsVideo() {
+			return fmt.Errorf("remote stream %q: %q isn't an audio or video MIME type", rs.Title, rs.MimeType)
+		}
+	}
+	return nil
+}
+
+func (srv *Server) remoteStreams() []RemoteStream {
+	return srv.settings().RemoteStreams
+}
+
+// Returns the remote stream at an object path within the streams container, and its index.
+func (srv *Server) remoteStream(p string) (rs RemoteStream, i int, ok bool) {
+	dir, name := path.Split(p)
+	if path.Clean(dir) != remoteStreamsPath {
+		return
+	}
+	i, err := strconv.Atoi(name)
+	if err != nil || strconv.Itoa(i) != name {
+		return
+	}
+	streams := srv.remoteStreams()
+	if i < 0 || i >= len(streams) {
+		return
+	}
+	return streams[i], i, true
+}
+
+// Whether the object path is the streams container or within it.
+func isRemoteStreamsPath(p string) bool {
+	return p == remoteStreamsPath || strings.HasPrefix(p, remoteStreamsPath+"/")
+}
+
+// Returns the number of top level objects the streams container adds.
+func (srv *Server) remoteStreamsChildCount() int {
+	if len(srv.remoteStreams()) == 0 {
+		return 0
+	}
+	return 1
+}
+
+// Returns the container of the remote streams, or nil if there are none.
+func (me *contentDirectoryService) remoteStreamsContainer() interface{} {
+	streams := me.remoteStreams()
+	if len(streams) == 0 {
+		return nil
+	}
+	o := object{Path: remoteStreamsPath}
+	return upnpav.Container{
+		Object: upnpav.Object{
+			ID:         o.ID(),
+			ParentID:   o.ParentID(),
+			Restricted: 1,
+			Class:      "object.container",
+			Title:      me.localTitle(remoteStreamsTitle),
+		},
+		ChildCount: len(streams),
+	}
+}
+
+// Returns the item for a remote stream. Renderers are given its URL, unless it's proxied for them.
+func (me *contentDirectoryService) remoteStreamItem(rs RemoteStream, i int, host, userAgent string) interface{} {
+	u, err := parseStreamURL(rs.URL)
+	if err != nil {
+		return nil
+	}
+	o := object{Path: path.Join(remoteStreamsPath, strconv.Itoa(i))}
+	mimeType := rs.mimeType(u)
+	resURL := u.String()
+	if rs.Proxy || me.proxyStreamURL(userAgent) {
+		resURL = (&url.URL{
+			Scheme: "http",
+			Host:   host,
+			Path:   resPath,
+			RawQuery: url.Values{
+				"path": {o.Path},
+			}.Encode(),
+		}).String()
+	}
+	return upnpav.Item{
+		Object: upnpav.Object{
+			ID:         o.ID(),
+			ParentID:   o.ParentID(),
+			Restricted: 1,
+			Class:      "object.item." + mimeType.Type() + "Item." + mimeType.Type() + "Broadcast",
+			Title:      rs.Title,
+		},
+		Res: []upnpav.Resource{{
+			URL: resURL,
+			// Live streams can't be seeked.
+			ProtocolInfo: fmt.Sprintf("http-get:*:%s:%s", mimeType, dlna.ContentFeatures{}.String()),
+		}},
+	}
+}
+
+// Returns the items of the streams container.
+func (me *contentDirectoryService) remoteStreamItems(host, userAgent string) (ret []interface{}) {
+	for i, rs := range me.remoteStreams() {
+		if item := me.remoteStreamItem(rs, i, host, userAgent); item != nil {
+			ret = append(ret, item)
+		}
+	}
+	return
+}
+
+// Serves a remote stream that's proxied, or redirects to it for renderers that were given the
+// resource URL from before it stopped being proxied.
+func (me *Server) serveRemoteStream(w http.ResponseWriter, r *http.Request, rs RemoteStream) {
+	u, err := parseStreamURL(rs.URL)
+	if err != nil {
+		me.resourceError(w, r, resourceInternalError, err)
+		return
+	}
+	me.serveRemoteMedia(w, r, u, rs.Proxy || me.proxyStreamURL(r.UserAgent()))
+}
@@ -0,0 +1,72 @@
+package dms
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestRemoteStreams(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.mp3"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		RootObjectPath: root,
+		NoProbe:        true,
+		Logger:         log.Default,
+		RemoteStreams: []RemoteStream{
+			{Title: "Radio", URL: "http://radio.example/live", MimeType: "audio/mpeg"},
+			{Title: "Camera", URL: "http://10.0.0.5/cam.ts", Proxy: true},
+		},
+		StrmProxyUserAgents: []string{"OldTV"},
+	}
+	if err := srv.initRemoteStreams(); err != nil {
+		t.Fatal(err)
+	}
+	cds := &contentDirectoryService{Server: srv}
+	top, err := cds.readContainer(object{Path: "/", RootObjectPath: root}, "host:1338", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || top[0].(upnpav.Container).Title != remoteStreamsTitle {
+		t.Fatalf("top level %v", top)
+	}
+	o, err := srv.objectFromPath(remoteStreamsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resURL := func(userAgent string, i int) string {
+		items, err := cds.readContainer(o, "host:1338", userAgent)
+		if err != nil || len(items) != 2 {
+			t.Fatalf("got %v, %v", items, err)
+		}
+		item := items[i].(upnpav.Item)
+		if i == 0 && item.Class != "object.item.audioItem.audioBroadcast" {
+			t.Errorf("class %q", item.Class)
+		}
+		return item.Res[0].URL
+	}
+	if got := resURL("", 0); got != "http://radio.example/live" {
+		t.Errorf("direct URL %q", got)
+	}
+	proxied := "http://host:1338/res?path=" + url.QueryEscape(remoteStreamsPath+"/0")
+	if got := resURL("OldTV/1.0", 0); got != proxied {
+		t.Errorf("URL for proxied renderer %q", got)
+	}
+	if got := resURL("", 1); got != "http://host:1338/res?path="+url.QueryEscape(remoteStreamsPath+"/1") {
+		t.Errorf("proxied stream URL %q", got)
+	}
+	if _, _, ok := srv.remoteStream(remoteStreamsPath + "/2"); ok {
+		t.Error("stream past the end")
+	}
+	srv.RemoteStreams = []RemoteStream{{Title: "Local", URL: "/mnt/a.mkv"}}
+	if err := srv.initRemoteStreams(); err == nil {
+		t.Error("local path accepted")
+	}
+}
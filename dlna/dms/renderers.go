@@ -0,0 +1,418 @@
+package dms
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+const (
+	// How long what a renderer accepts is kept before it's fetched again on its next
+	// announcement.
+	rendererSinkTTL = time.Hour
+	// How long fetching it may take.
+	rendererFetchTimeout = 10 * time.Second
+	// The most read of a renderer's description and responses.
+	rendererMaxResponse = 1 << 20
+)
+
+const (
+	mediaRendererDeviceTypePrefix      = "urn:schemas-upnp-org:device:MediaRenderer:"
+	connectionManagerServiceTypePrefix = "urn:schemas-upnp-org:service:ConnectionManager:"
+	avTransportServiceTypePrefix       = "urn:schemas-upnp-org:service:AVTransport:"
+	// The queue of OpenHome renderers, such as Linn streamers, which often have no AVTransport.
+	openHomePlaylistServiceTypePrefix = "urn:av-openhome-org:service:Playlist:"
+)
+
+// A protocolInfo, such as "http-get:*:audio/L16;rate=48000;channels=2:DLNA.ORG_PN=LPCM", in the
+// parts that are matched between a resource and a renderer.
+type protocolInfo struct {
+	protocol string
+	// Lower case, without parameters.
+	mimeType string
+	// Such as rate and channels, with lower case names.
+	params map[string]string
+}
+
+func parseProtocolInfo(s string) (ret protocolInfo, ok bool) {
+	fields := strings.SplitN(s, ":", 4)
+	if len(fields) < 3 {
+		return
+	}
+	ret.protocol = fields[0]
+	parts := strings.Split(fields[2], ";")
+	ret.mimeType = strings.ToLower(strings.TrimSpace(parts[0]))
+	for _, p := range parts[1:] {
+		name, value, _ := strings.Cut(p, "=")
+		if ret.params == nil {
+			ret.params = make(map[string]string)
+		}
+		ret.params[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	return ret, true
+}
+
+// What a renderer accepts, from the Sink of its ConnectionManager.
+type rendererSink []protocolInfo
+
+// What renderers matched by LPCMUserAgents are taken to accept.
+var lpcmRendererSink = parseRendererSink("http-get:*:audio/L16:*,http-get:*:audio/mpeg:*")
+
+func parseRendererSink(s string) (ret rendererSink) {
+	for _, f := range strings.Split(s, ",") {
+		if pi, ok := parseProtocolInfo(strings.TrimSpace(f)); ok {
+			ret = append(ret, pi)
+		}
+	}
+	return
+}
+
+// Reports whether the renderer accepts resources with the protocolInfo. Parameters, such as the
+// rate of L16, must match where both give them.
+func (me rendererSink) accepts(s string) bool {
+	res, ok := parseProtocolInfo(s)
+	if !ok {
+		return false
+	}
+sink:
+	for _, pi := range me {
+		if pi.protocol != "*" && pi.protocol != res.protocol {
+			continue
+		}
+		if pi.mimeType != "*" && pi.mimeType != res.mimeType {
+			continue
+		}
+		for name, value := range pi.params {
+			if resValue, ok := res.params[name]; ok && resValue != value {
+				continue sink
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Returns obj with the resources of audio items that the renderer accepts first, so that
+// renderers that play the first they're given play one they can, such as speakers that only take
+// 48kHz PCM given a hi-res file. Objects are cached, so they're copied rather than changed.
+func (me rendererSink) arrange(obj interface{}) interface{} {
+	item, ok := obj.(upnpav.Item)
+	if !ok || len(me) == 0 || !strings.HasPrefix(item.Class, "object.item.audioItem") {
+		return obj
+	}
+	res := make([]upnpav.Resource, 0, len(item.Res))
+	for _, r := range item.Res {
+		if me.accepts(r.ProtocolInfo) {
+			res = append(res, r)
+		}
+	}
+	for _, r := range item.Res {
+		if !me.accepts(r.ProtocolInfo) {
+			res = append(res, r)
+		}
+	}
+	item.Res = res
+	return item
+}
+
+// What's known of a renderer from its description and ConnectionManager.
+type rendererInfo struct {
+	name string
+	sink rendererSink
+	// The AVTransport that media can be played with, if it has one.
+	avTransport rendererService
+	// The OpenHome Playlist, for renderers without an AVTransport.
+	playlist rendererService
+}
+
+// Reports whether media can be played on the renderer.
+func (me rendererInfo) canPlay() bool {
+	return me.avTransport.control != nil || me.playlist.control != nil
+}
+
+type rendererService struct {
+	serviceType string
+	control     *url.URL
+}
+
+type renderer struct {
+	location string
+	rendererInfo
+	fetched  time.Time
+	fetching bool
+}
+
+// Renderers that have announced themselves, by IP, and what they accept.
+type renderers struct {
+	mu    sync.Mutex
+	byIP  map[string]*renderer
+	httpc http.Client
+	// When they were last searched for.
+	searched time.Time
+}
+
+// Returns what the renderer at ip accepts, if it has announced itself.
+func (me *renderers) sink(ip string) rendererSink {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if r := me.byIP[ip]; r != nil {
+		return r.sink
+	}
+	return nil
+}
+
+// Returns what's known of the renderer at ip, if it has announced itself.
+func (me *renderers) info(ip string) (rendererInfo, bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if r := me.byIP[ip]; r != nil {
+		return r.rendererInfo, true
+	}
+	return rendererInfo{}, false
+}
+
+// Returns what's known of each renderer that has announced itself, by IP.
+func (me *renderers) infos() map[string]rendererInfo {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ret := make(map[string]rendererInfo, len(me.byIP))
+	for ip, r := range me.byIP {
+		ret[ip] = r.rendererInfo
+	}
+	return ret
+}
+
+// Returns what each renderer that has announced itself accepts, by IP.
+func (me *renderers) sinks() map[string]rendererSink {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ret := make(map[string]rendererSink, len(me.byIP))
+	for ip, r := range me.byIP {
+		if len(r.sink) != 0 {
+			ret[ip] = r.sink
+		}
+	}
+	return ret
+}
+
+// Returns what the client making the request accepts, if it's matched by LPCMUserAgents or is a
+// renderer that has announced itself.
+func (srv *Server) rendererSink(r *http.Request) rendererSink {
+	if matchUserAgent(srv.settings().LPCMUserAgents, r.UserAgent()) {
+		return lpcmRendererSink
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return srv.renderers.sink(host)
+}
+
+// Handles SSDP announcements from other devices, fetching what media renderers and OpenHome
+// renderers accept so that audio can be offered to them in a format they take, and how to play
+// media on them.
+func (srv *Server) rendererAnnounced(req *http.Request, sender *net.UDPAddr) {
+	nt := req.Header.Get("nt")
+	if !strings.HasPrefix(nt, mediaRendererDeviceTypePrefix) && !strings.HasPrefix(nt, openHomePlaylistServiceTypePrefix) {
+		return
+	}
+	ip := sender.IP.String()
+	me := &srv.renderers
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if req.Header.Get("nts") == "ssdp:byebye" {
+		delete(me.byIP, ip)
+		return
+	}
+	location := req.Header.Get("location")
+	u, err := url.Parse(location)
+	// Only the sender's own description is fetched, so announcements can't direct requests
+	// elsewhere.
+	if err != nil || u.Scheme != "http" || !net.ParseIP(u.Hostname()).Equal(sender.IP) {
+		return
+	}
+	r := me.byIP[ip]
+	if r != nil && r.location == location && (r.fetching || time.Since(r.fetched) < rendererSinkTTL) {
+		return
+	}
+	if r == nil {
+		r = &renderer{}
+		if me.byIP == nil {
+			me.byIP = make(map[string]*renderer)
+		}
+		me.byIP[ip] = r
+	}
+	r.location = location
+	r.fetching = true
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), rendererFetchTimeout)
+		defer cancel()
+		info, err := me.fetchInfo(ctx, u)
+		if err != nil {
+			srv.Logger.Levelf(log.Debug, "error fetching protocol info of renderer at %v: %v", ip, err)
+		} else {
+			srv.Logger.Levelf(log.Debug, "renderer %q at %v accepts %d formats", info.name, ip, len(info.sink))
+		}
+		me.mu.Lock()
+		defer me.mu.Unlock()
+		r.fetching = false
+		r.fetched = time.Now()
+		if info.name != "" || info.canPlay() {
+			r.name, r.avTransport, r.playlist = info.name, info.avTransport, info.playlist
+		}
+		if err == nil {
+			r.sink = info.sink
+		}
+	}()
+}
+
+type rendererDevice struct {
+	FriendlyName string `xml:"friendlyName"`
+	Services     []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []rendererDevice `xml:"deviceList>device"`
+}
+
+// Returns the control URL of the first service of the type in the device or those embedded in it.
+func (me rendererDevice) service(serviceTypePrefix string) (serviceType, controlURL string) {
+	for _, s := range me.Services {
+		if strings.HasPrefix(s.ServiceType, serviceTypePrefix) {
+			return s.ServiceType, s.ControlURL
+		}
+	}
+	for _, d := range me.Devices {
+		if serviceType, controlURL = d.service(serviceTypePrefix); controlURL != "" {
+			return
+		}
+	}
+	return
+}
+
+func (me *renderers) do(req *http.Request) ([]byte, error) {
+	resp, err := me.httpc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, rendererMaxResponse))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Failed actions give the reason in a SOAP fault.
+		var fault struct {
+			Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+			Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+		}
+		if xml.Unmarshal(b, &fault) == nil && fault.Code != 0 {
+			return nil, fmt.Errorf("%s: %s: error %d %s", req.URL, resp.Status, fault.Code, fault.Description)
+		}
+		return nil, fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	return b, nil
+}
+
+// Invokes the SOAP action on the renderer's service, returning the response.
+func (me *renderers) action(ctx context.Context, service rendererService, action string, args ...[2]string) ([]byte, error) {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%s xmlns:u="%s">`, action, xmlEscape(service.serviceType))
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>%s</%s>", arg[0], xmlEscape(arg[1]), arg[0])
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+	req, err := http.NewRequestWithContext(ctx, "POST", service.control.String(), &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPACTION", fmt.Sprintf(`"%s#%s"`, service.serviceType, action))
+	return me.do(req)
+}
+
+// Fetches the renderer's description from location, and asks its ConnectionManager what it
+// accepts. What's in the description is returned even if that fails.
+func (me *renderers) fetchInfo(ctx context.Context, location *url.URL) (ret rendererInfo, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", location.String(), nil)
+	if err != nil {
+		return
+	}
+	b, err := me.do(req)
+	if err != nil {
+		return
+	}
+	var desc struct {
+		URLBase string         `xml:"URLBase"`
+		Device  rendererDevice `xml:"device"`
+	}
+	if err = xml.Unmarshal(b, &desc); err != nil {
+		err = fmt.Errorf("parsing description: %w", err)
+		return
+	}
+	ret.name = desc.Device.FriendlyName
+	base := location
+	if desc.URLBase != "" {
+		if base, err = location.Parse(desc.URLBase); err != nil {
+			return
+		}
+	}
+	// Only the renderer's own services are used, so descriptions can't direct requests elsewhere.
+	service := func(serviceTypePrefix string) (rendererService, error) {
+		serviceType, controlURL := desc.Device.service(serviceTypePrefix)
+		if controlURL == "" {
+			return rendererService{}, nil
+		}
+		control, err := base.Parse(controlURL)
+		if err != nil {
+			return rendererService{}, err
+		}
+		if control.Host != location.Host {
+			return rendererService{}, fmt.Errorf("control URL %q isn't on the renderer", control)
+		}
+		return rendererService{serviceType, control}, nil
+	}
+	// Renderers without them can still be offered audio they accept, and OpenHome ones without a
+	// ConnectionManager can still be played on.
+	ret.avTransport, _ = service(avTransportServiceTypePrefix)
+	ret.playlist, _ = service(openHomePlaylistServiceTypePrefix)
+	cm, err := service(connectionManagerServiceTypePrefix)
+	if err != nil {
+		return
+	}
+	if cm.control == nil {
+		err = fmt.Errorf("no ConnectionManager in description")
+		return
+	}
+	if b, err = me.action(ctx, cm, "GetProtocolInfo"); err != nil {
+		return
+	}
+	var resp struct {
+		Sink string `xml:"Body>GetProtocolInfoResponse>Sink"`
+	}
+	if err = xml.Unmarshal(b, &resp); err != nil {
+		err = fmt.Errorf("parsing GetProtocolInfo response: %w", err)
+		return
+	}
+	ret.sink = parseRendererSink(resp.Sink)
+	return
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
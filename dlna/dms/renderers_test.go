@@ -0,0 +1,166 @@
+package dms
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestRendererSinkArrange(t *testing.T) {
+	// A speaker that only takes 48kHz PCM and MP3.
+	sink := parseRendererSink("http-get:*:audio/L16;rate=48000;channels=2:DLNA.ORG_PN=LPCM,http-get:*:audio/mpeg:*")
+	md := Metadata{SampleRate: 96000, AudioChannels: 2}
+	item := upnpav.Item{
+		Object: upnpav.Object{Class: "object.item.audioItem"},
+		Res: append([]upnpav.Resource{{ProtocolInfo: "http-get:*:audio/flac:*"}},
+			audioTranscodeResources("host", "/a.flac", "audio/flac", md, "")...),
+	}
+	arranged := sink.arrange(item).(upnpav.Item)
+	var got []string
+	for _, r := range arranged.Res {
+		got = append(got, strings.SplitN(r.ProtocolInfo, ":", 4)[2])
+	}
+	want := []string{
+		"audio/L16;rate=48000;channels=2",
+		"audio/mpeg",
+		"audio/flac",
+		"audio/flac",
+		"audio/wav",
+		"audio/L16;rate=44100;channels=2",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if item.Res[0].ProtocolInfo != "http-get:*:audio/flac:*" {
+		t.Error("cached item changed")
+	}
+	u, err := url.Parse(arranged.Res[0].URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := u.Query(); q.Get("transcode") != "lpcm" || q.Get("rate") != "48000" || q.Get("channels") != "2" {
+		t.Errorf("L16 resource URL %q", u)
+	}
+}
+
+func TestFetchRendererInfo(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+<deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+<friendlyName>Living Room</friendlyName>
+<serviceList>
+<service><serviceType>urn:schemas-upnp-org:service:RenderingControl:1</serviceType><controlURL>/rc</controlURL></service>
+<service><serviceType>urn:schemas-upnp-org:service:ConnectionManager:1</serviceType><controlURL>cm</controlURL></service>
+<service><serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType><controlURL>/avt</controlURL></service>
+</serviceList></device></root>`)
+	})
+	mux.HandleFunc("/cm", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("SOAPACTION") != `"urn:schemas-upnp-org:service:ConnectionManager:1#GetProtocolInfo"` {
+			http.Error(w, "bad action", http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:GetProtocolInfoResponse xmlns:u="urn:schemas-upnp-org:service:ConnectionManager:1">
+<Source></Source><Sink>http-get:*:audio/L16;rate=48000;channels=2:*,http-get:*:audio/mpeg:*</Sink>
+</u:GetProtocolInfoResponse></s:Body></s:Envelope>`)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	location, _ := url.Parse(ts.URL + "/desc.xml")
+	var rs renderers
+	info, err := rs.fetchInfo(context.Background(), location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.name != "Living Room" {
+		t.Errorf("got name %q", info.name)
+	}
+	if c := info.avTransport.control; c == nil || c.String() != ts.URL+"/avt" {
+		t.Errorf("got AVTransport control URL %v", c)
+	}
+	sink := info.sink
+	if len(sink) != 2 {
+		t.Fatalf("got sink %v", sink)
+	}
+	if !sink.accepts("http-get:*:audio/L16;rate=48000;channels=2:DLNA.ORG_PN=LPCM") {
+		t.Error("48kHz L16 not accepted")
+	}
+	if sink.accepts("http-get:*:audio/L16;rate=44100;channels=2:DLNA.ORG_PN=LPCM") {
+		t.Error("44.1kHz L16 accepted")
+	}
+}
+
+func TestRendererAction(t *testing.T) {
+	var got struct {
+		URI      string `xml:"Body>SetAVTransportURI>CurrentURI"`
+		Metadata string `xml:"Body>SetAVTransportURI>CurrentURIMetaData"`
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("SOAPACTION") == `"urn:schemas-upnp-org:service:AVTransport:1#Play"` {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>
+<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>714</errorCode><errorDescription>Illegal MIME-type</errorDescription></UPnPError></detail>
+</s:Fault></s:Body></s:Envelope>`)
+			return
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+	control, _ := url.Parse(ts.URL + "/avt")
+	avt := rendererService{"urn:schemas-upnp-org:service:AVTransport:1", control}
+	var rs renderers
+	metadata := didl_lite(`<item id="1"><dc:title>Tom &amp; Jerry</dc:title></item>`)
+	if _, err := rs.action(context.Background(), avt, "SetAVTransportURI",
+		[2]string{"InstanceID", "0"},
+		[2]string{"CurrentURI", "http://host/res?path=a&b"},
+		[2]string{"CurrentURIMetaData", metadata},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if got.URI != "http://host/res?path=a&b" || got.Metadata != metadata {
+		t.Errorf("got %+v", got)
+	}
+	_, err := rs.action(context.Background(), avt, "Play", [2]string{"InstanceID", "0"}, [2]string{"Speed", "1"})
+	if err == nil || !strings.Contains(err.Error(), "714 Illegal MIME-type") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestLPCMUserAgents(t *testing.T) {
+	srv := &Server{LPCMUserAgents: []string{"Certified/1.0"}}
+	r := httptest.NewRequest("POST", "/ctl", nil)
+	r.Header.Set("User-Agent", "Speaker Certified/1.0 DLNADOC/1.50")
+	sink := srv.rendererSink(r)
+	item := upnpav.Item{
+		Object: upnpav.Object{Class: "object.item.audioItem.musicTrack"},
+		Res: append([]upnpav.Resource{{ProtocolInfo: "http-get:*:audio/x-ms-wma:*"}},
+			audioTranscodeResources("host", "/a.wma", "audio/x-ms-wma", Metadata{SampleRate: 44100, AudioChannels: 2}, "")...),
+	}
+	first := sink.arrange(item).(upnpav.Item).Res[0].ProtocolInfo
+	if want := "http-get:*:audio/L16;rate=44100;channels=2:DLNA.ORG_PN=LPCM;"; !strings.HasPrefix(first, want) {
+		t.Errorf("first resource %q", first)
+	}
+	r.Header.Set("User-Agent", "Other")
+	if srv.rendererSink(r) != nil {
+		t.Error("other renderer matched")
+	}
+	lpcm, _ := findAudioTranscode("lpcm")
+	if p := lpcm.profileName(96000, 2); p != "" {
+		t.Errorf("96kHz L16 has profile %q", p)
+	}
+}
@@ -0,0 +1,75 @@
+package dms
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+const apiRescanPath = "/api/rescan"
+
+// Drops the cached listings of containers, so that they're read again.
+func (srv *Server) clearListingCaches() {
+	srv.browseCache.clear()
+	srv.didlCache.clear()
+	srv.placesCache.clear()
+	srv.recentlyAddedCache.clear()
+	srv.classMediaCache.clear()
+	srv.showsCache.clear()
+}
+
+// Rescans the directory at the object path, such as "/" for everything shared, and those below
+// it, for changes that aren't otherwise seen, such as on network filesystems that don't send change
+// notifications. Listings are read again, and control points subscribed to the ContentDirectory's
+// events are sent ContainerUpdateIDs: with an index, of the containers the scan finds changed,
+// and otherwise of the directory, since anything below it may have.
+func (srv *Server) Rescan(objectPath string) error {
+	o, err := srv.objectFromPath(path.Clean("/" + objectPath))
+	if err != nil {
+		return err
+	}
+	if !srv.isRootDirsContainer(o) {
+		if o.RootObjectPath == "" {
+			// Such as Recently Added, which isn't in the filesystem.
+			return fmt.Errorf("%q isn't a shared directory", o.Path)
+		}
+		fi, err := srv.contentFS().Stat(o.FilePath())
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%q isn't a directory", o.Path)
+		}
+	}
+	srv.clearListingCaches()
+	if srv.index != nil {
+		srv.index.rescan(o.Path, true)
+		return nil
+	}
+	srv.containerChanged(o.Path)
+	return nil
+}
+
+// Rescans the directory with the path query parameter, or everything shared, on POST.
+func (me *Server) serveAPIRescan(w http.ResponseWriter, r *http.Request) {
+	if !me.authorizeAPI(w, r, APIScopeAdmin) {
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := path.Clean("/" + decodeObjectPath(r.URL.Query().Get("path")))
+	if err := me.Rescan(p); err != nil {
+		me.writeAPIError(w, r, upnp.Errorf(upnpav.NoSuchObjectErrorCode, err.Error()))
+		return
+	}
+	me.requestLogger(r).Levelf(log.Info, "rescanning %q", p)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,50 @@
+package dms
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Without an index, rescanning changes the SystemUpdateID, so control points browse again.
+func TestRescan(t *testing.T) {
+	srv := newMemFSServer()
+	srv.metrics = newServerMetrics(srv)
+	mux := http.NewServeMux()
+	srv.initMux(mux)
+	origin := "http://example.com"
+	post := func(method, query string) int {
+		r := httptest.NewRequest(method, apiRescanPath+query, nil)
+		r.RemoteAddr = "192.168.1.20:4000"
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+	before := srv.updateIDs.systemID()
+	if code := post("POST", ""); code != http.StatusNoContent {
+		t.Fatalf("rescan got %d", code)
+	}
+	if code := post("POST", "?path=/Shows"); code != http.StatusNoContent {
+		t.Fatalf("rescan of a directory got %d", code)
+	}
+	if got := srv.updateIDs.systemID(); got != before+2 {
+		t.Errorf("SystemUpdateID went from %d to %d", before, got)
+	}
+	for _, q := range []string{"?path=/film.mp4", "?path=/missing"} {
+		if code := post("POST", q); code != http.StatusNotFound {
+			t.Errorf("rescan %s got %d", q, code)
+		}
+	}
+	if code := post("GET", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET got %d", code)
+	}
+	// From a page on another site, which a browser sends credentials with.
+	origin = "http://evil.example"
+	if code := post("POST", ""); code != http.StatusForbidden {
+		t.Errorf("cross-origin rescan got %d", code)
+	}
+	if code := post("GET", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("cross-origin GET got %d", code)
+	}
+}
@@ -0,0 +1,117 @@
+package dms
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/dlna"
+)
+
+// Why a request for a media resource failed. Failures are counted by cause in the metrics.
+type resourceErrorCause string
+
+const (
+	resourceNotFound        resourceErrorCause = "not_found"
+	resourceForbidden       resourceErrorCause = "forbidden"
+	resourceBadRequest      resourceErrorCause = "bad_request"
+	resourceDisabled        resourceErrorCause = "disabled"
+	resourceTranscodeFailed resourceErrorCause = "transcode_failed"
+	resourceUpstreamFailed  resourceErrorCause = "upstream_failed"
+	resourceBusy            resourceErrorCause = "busy"
+	resourceUnavailable     resourceErrorCause = "unavailable"
+	resourceInternalError   resourceErrorCause = "internal"
+)
+
+func (me resourceErrorCause) statusCode() int {
+	switch me {
+	case resourceNotFound, resourceDisabled:
+		return http.StatusNotFound
+	case resourceForbidden:
+		return http.StatusForbidden
+	case resourceBadRequest:
+		return http.StatusBadRequest
+	case resourceTranscodeFailed, resourceBusy, resourceUnavailable:
+		// DLNA renderers take this as the server being unable to produce the content for now,
+		// rather than the content being broken.
+		return http.StatusServiceUnavailable
+	case resourceUpstreamFailed:
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// Returns the cause for an error opening or statting a file.
+func fileErrorCause(err error) resourceErrorCause {
+	switch {
+	case errors.Is(err, errFSUnavailable):
+		return resourceUnavailable
+	case errors.Is(err, os.ErrNotExist):
+		return resourceNotFound
+	case errors.Is(err, os.ErrPermission):
+		return resourceForbidden
+	}
+	return resourceInternalError
+}
+
+// Whether the client is a web browser, rather than a renderer.
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// Responds to a failed request for a media resource, and counts the failure. Renderers act on the
+// status code, and get the reason as plain text. Browsers get a page with the session ID to look
+// for in the log.
+func (me *Server) resourceError(w http.ResponseWriter, r *http.Request, cause resourceErrorCause, err error) {
+	code := cause.statusCode()
+	me.metrics.resourceErrors.WithLabelValues(string(cause)).Inc()
+	setRequestFailure(r, err)
+	me.requestLogger(r).Levelf(log.Info, "%s %s failed with %d: %v", r.Method, r.URL.RequestURI(), code, err)
+	// Headers describing the media that would have been served no longer apply.
+	h := w.Header()
+	if cause == resourceUnavailable {
+		h.Set("Retry-After", strconv.Itoa(int(fsUnavailableFor.Seconds())))
+	}
+	for _, k := range []string{
+		dlna.ContentFeaturesDomain,
+		dlna.TransferModeDomain,
+		dlna.TimeSeekRangeDomain,
+		"Content-Disposition",
+		"Content-Duration",
+		"X-Content-Duration",
+	} {
+		h.Del(k)
+	}
+	msg := err.Error()
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		// Don't reveal where the media is kept.
+		msg = pathErr.Err.Error()
+	}
+	if !acceptsHTML(r) {
+		http.Error(w, msg, code)
+		return
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	tmplErr := errorTmpl.Execute(w, struct {
+		Code    int
+		Status  string
+		Message string
+		Session string
+	}{
+		Code:    code,
+		Status:  http.StatusText(code),
+		Message: msg,
+		Session: requestSession(r),
+	})
+	if tmplErr != nil {
+		me.Logger.Print(tmplErr)
+	}
+}
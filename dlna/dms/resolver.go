@@ -0,0 +1,183 @@
+package dms
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// The paths of the resources that name media by its object path in their queries, which a
+// ResourceResolver maps.
+var resolvedResourcePaths = map[string]bool{
+	resPath:       true,
+	audiobookPath: true,
+	archivePath:   true,
+	discPath:      true,
+	iconPath:      true,
+	subtitlePath:  true,
+	imagePath:     true,
+	folderArtPath: true,
+}
+
+// Maps the queries of the URLs of resources, which name media by its object path, to those given
+// to clients, and back. It's for deployments that don't want the media tree guessed or scraped
+// from URLs, such as by signing them or naming media by opaque IDs.
+type ResourceResolver interface {
+	// Returns the query to give clients for the URL with path urlPath and query q. It's called
+	// each time the URL is given to a client.
+	ExternalQuery(urlPath string, q url.Values) url.Values
+	// Returns the query the URL a client requested was made from, or an error if it isn't valid,
+	// such as when it's expired.
+	InternalQuery(urlPath string, q url.Values) (url.Values, error)
+}
+
+// Signs the URLs of resources with an HMAC of their path, query and when they expire, so that
+// only URLs the server gave out recently are served.
+type SignedResourceURLs struct {
+	Key []byte
+	// How long URLs are valid after they're given to clients. Seeking requests the URL again, so
+	// it should be longer than anything will be played for.
+	Expiry time.Duration
+}
+
+const (
+	resourceURLExpiresParam   = "expires"
+	resourceURLSignatureParam = "sig"
+)
+
+var (
+	errResourceURLUnsigned = errors.New("URL isn't signed")
+	errResourceURLExpired  = errors.New("URL has expired")
+	errResourceURLBadSig   = errors.New("URL signature is wrong")
+)
+
+func (me *SignedResourceURLs) signature(urlPath string, q url.Values) string {
+	h := hmac.New(sha256.New, me.Key)
+	// The query is encoded with its keys in order, so it's the same when it's checked.
+	h.Write([]byte(urlPath + "?" + q.Encode()))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (me *SignedResourceURLs) ExternalQuery(urlPath string, q url.Values) url.Values {
+	return me.sign(urlPath, q, time.Now().Add(me.Expiry))
+}
+
+func (me *SignedResourceURLs) sign(urlPath string, q url.Values, expires time.Time) url.Values {
+	ret := make(url.Values, len(q)+2)
+	for k, v := range q {
+		ret[k] = v
+	}
+	ret.Set(resourceURLExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	ret.Set(resourceURLSignatureParam, me.signature(urlPath, ret))
+	return ret
+}
+
+func (me *SignedResourceURLs) InternalQuery(urlPath string, q url.Values) (url.Values, error) {
+	return me.check(urlPath, q, time.Now())
+}
+
+func (me *SignedResourceURLs) check(urlPath string, q url.Values, now time.Time) (url.Values, error) {
+	sig := q.Get(resourceURLSignatureParam)
+	if sig == "" {
+		return nil, errResourceURLUnsigned
+	}
+	ret := make(url.Values, len(q))
+	for k, v := range q {
+		if k != resourceURLSignatureParam {
+			ret[k] = v
+		}
+	}
+	if !hmac.Equal([]byte(sig), []byte(me.signature(urlPath, ret))) {
+		return nil, errResourceURLBadSig
+	}
+	expires, err := strconv.ParseInt(ret.Get(resourceURLExpiresParam), 10, 64)
+	if err != nil || now.Unix() > expires {
+		return nil, errResourceURLExpired
+	}
+	ret.Del(resourceURLExpiresParam)
+	return ret, nil
+}
+
+// Returns the URL as it's given to the client with the User-Agent.
+func (srv *Server) externalURL(s, userAgent string) string {
+	if s == "" {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil || !resolvedResourcePaths[u.Path] {
+		return s
+	}
+	srv.addClientParam(u, userAgent)
+	q := u.Query()
+	encoded := encodeResourceQuery(q)
+	if srv.ResourceResolver != nil {
+		q = srv.ResourceResolver.ExternalQuery(u.Path, q)
+	}
+	if encoded || srv.ResourceResolver != nil {
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// Returns the upnpav.Container or upnpav.Item with its URLs as they're given to the client with
+// the User-Agent. Objects are cached, so they're copied rather than changed.
+func (srv *Server) externalURLs(obj interface{}, userAgent string) interface{} {
+	switch o := obj.(type) {
+	case upnpav.Container:
+		o.Icon = srv.externalURL(o.Icon, userAgent)
+		o.AlbumArtURI = srv.externalURL(o.AlbumArtURI, userAgent)
+		return o
+	case upnpav.Item:
+		o.Icon = srv.externalURL(o.Icon, userAgent)
+		o.AlbumArtURI = srv.externalURL(o.AlbumArtURI, userAgent)
+		res := make([]upnpav.Resource, len(o.Res))
+		for i, r := range o.Res {
+			r.URL = srv.externalURL(r.URL, userAgent)
+			res[i] = r
+		}
+		o.Res = res
+		return o
+	}
+	return obj
+}
+
+// Gives the URLs of the objects of a page of the API as they're given to the client with the
+// User-Agent.
+func (srv *Server) externalAPIURLs(objs []apiObject, userAgent string) {
+	for i := range objs {
+		o := &objs[i]
+		o.Icon = srv.externalURL(o.Icon, userAgent)
+		o.AlbumArtURI = srv.externalURL(o.AlbumArtURI, userAgent)
+		for j := range o.Res {
+			o.Res[j].URL = srv.externalURL(o.Res[j].URL, userAgent)
+		}
+	}
+}
+
+// Maps the query of a request for a resource back to what the server made it from, with its object
+// path decoded, responding with 403 Forbidden if it isn't valid.
+func (srv *Server) resolveResourceRequest(w http.ResponseWriter, r *http.Request) bool {
+	if !resolvedResourcePaths[r.URL.Path] {
+		return true
+	}
+	q := r.URL.Query()
+	if srv.ResourceResolver != nil {
+		var err error
+		q, err = srv.ResourceResolver.InternalQuery(r.URL.Path, q)
+		if err != nil {
+			srv.resourceError(w, r, resourceForbidden, err)
+			return false
+		}
+	}
+	if decodeResourceQuery(q) || srv.ResourceResolver != nil {
+		r.URL.RawQuery = q.Encode()
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package dms
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignedResourceURLs(t *testing.T) {
+	s := &SignedResourceURLs{Key: []byte("key")}
+	now := time.Now()
+	q := url.Values{"path": {"/Films/a.mkv"}, "transcode": {"t"}}
+	signed := s.sign(resPath, q, now.Add(time.Hour))
+	got, err := s.check(resPath, signed, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Encode() != q.Encode() {
+		t.Fatalf("got %v", got)
+	}
+	if _, err := s.check(resPath, signed, now.Add(2*time.Hour)); err != errResourceURLExpired {
+		t.Fatalf("expired URL gave %v", err)
+	}
+	if _, err := s.check(iconPath, signed, now); err != errResourceURLBadSig {
+		t.Fatalf("URL for another resource gave %v", err)
+	}
+	signed.Set("path", "/Films/b.mkv")
+	if _, err := s.check(resPath, signed, now); err != errResourceURLBadSig {
+		t.Fatalf("changed URL gave %v", err)
+	}
+	if _, err := s.check(resPath, q, now); err != errResourceURLUnsigned {
+		t.Fatalf("unsigned URL gave %v", err)
+	}
+}
+
+// Object paths that need encoding are encoded in the URLs given to clients, and decoded in
+// requests for them, signed or not.
+func TestEncodedResourcePaths(t *testing.T) {
+	for _, srv := range []*Server{{}, {ResourceResolver: &SignedResourceURLs{Key: []byte("key"), Expiry: time.Hour}}} {
+		for _, p := range []string{"/Films/Heat (1995).mkv", "/Musique/Caf\xe9.flac", "/Films/a\nb.mkv"} {
+			u := srv.externalURL(resPath+"?"+url.Values{"path": {p}}.Encode(), "")
+			r := httptest.NewRequest("GET", u, nil)
+			if objectPathNeedsEncoding(p) != (r.URL.Query().Get("path") != p) {
+				t.Errorf("%q given as %q", p, u)
+			}
+			w := httptest.NewRecorder()
+			if !srv.resolveResourceRequest(w, r) {
+				t.Fatalf("%q refused with %d", u, w.Code)
+			}
+			if got := r.URL.Query().Get("path"); got != p {
+				t.Errorf("%q requested as %q", p, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package dms
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// A directory shared as its own top-level container, for servers with several.
+type RootDir struct {
+	// Location in the local filesystem.
+	Path string
+	// Title of the container, and the first element of the object paths within it. Defaults to the
+	// base name of Path.
+	Name string
+	// If not empty, only media of these types ("video", "audio" or "image") is shown.
+	MediaTypes []string
+}
+
+func (rd *RootDir) allowsMediaType(t string) bool {
+	if len(rd.MediaTypes) == 0 {
+		return true
+	}
+	for _, mt := range rd.MediaTypes {
+		if mt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// The shared directories, and the paths ignored in them, as of the last Init or Reload. Requests
+// read them from this snapshot, since Reload replaces them while requests are being served. Its
+// slices are never changed.
+type sharedDirs struct {
+	rootObjectPath string
+	rootDirs       []RootDir
+	ignorePaths    []string
+}
+
+// Returns the snapshot of the shared directories.
+func (srv *Server) sharedDirs() *sharedDirs {
+	if sd := srv.shared.Load(); sd != nil {
+		return sd
+	}
+	// Not initialized, such as in tests.
+	return &sharedDirs{srv.RootObjectPath, srv.RootDirs, srv.IgnorePaths}
+}
+
+// Fills in default names and checks the root dirs can be told apart, then takes the snapshot of
+// the shared directories.
+func (srv *Server) initRootDirs() error {
+	names := make(map[string]bool, len(srv.RootDirs))
+	for i := range srv.RootDirs {
+		rd := &srv.RootDirs[i]
+		rd.Path = filepath.Clean(rd.Path)
+		if rd.Name == "" {
+			rd.Name = filepath.Base(rd.Path)
+		}
+		if strings.Contains(rd.Name, "/") || rd.Name == "." || rd.Name == ".." {
+			return fmt.Errorf("invalid name %q for root dir %q", rd.Name, rd.Path)
+		}
+		if names[rd.Name] {
+			return fmt.Errorf("root dir %q has the same name as another: %q", rd.Path, rd.Name)
+		}
+		names[rd.Name] = true
+	}
+	srv.shared.Store(&sharedDirs{srv.RootObjectPath, srv.RootDirs, srv.IgnorePaths})
+	return nil
+}
+
+func (sd *sharedDirs) rootDir(name string) *RootDir {
+	for i := range sd.rootDirs {
+		if sd.rootDirs[i].Name == name {
+			return &sd.rootDirs[i]
+		}
+	}
+	return nil
+}
+
+// Splits an object path into its first element and the remainder, such as "/a/b/c" into "a" and
+// "/b/c".
+func splitRootPath(p string) (name, rest string) {
+	p = strings.TrimPrefix(p, "/")
+	if i := strings.IndexByte(p, '/'); i != -1 {
+		return p[:i], p[i:]
+	}
+	return p, "/"
+}
+
+// Resolves a cleaned, absolute object path to an object, including the root dir it's in when there
+// are several.
+func (srv *Server) objectFromPath(p string) (o object, err error) {
+	o.Path = p
+	if isRemoteStreamsPath(p) || isPlacesPath(p) || isRecentPath(p) || isClassPath(p) || isShowsPath(p) || isWatchedPath(p) {
+		// The streams, places, recent, class, TV shows and watched containers and their items,
+		// which aren't in the filesystem.
+		return
+	}
+	sd := srv.sharedDirs()
+	if len(sd.rootDirs) == 0 {
+		o.RootObjectPath = sd.rootObjectPath
+		return
+	}
+	if p == "/" {
+		// The container holding the root dirs, which doesn't exist in the filesystem.
+		return
+	}
+	name, _ := splitRootPath(p)
+	o.root = sd.rootDir(name)
+	if o.root == nil {
+		err = fmt.Errorf("no root dir named %q", name)
+		return
+	}
+	o.RootObjectPath = o.root.Path
+	return
+}
+
+// Returns the object for a path in the local filesystem, if it's within the shared directories.
+func (srv *Server) objectFromFilePath(filePath string) (o object, ok bool) {
+	rel := func(root string) (string, bool) {
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", false
+		}
+		return filepath.ToSlash(rel), true
+	}
+	sd := srv.sharedDirs()
+	if len(sd.rootDirs) == 0 {
+		p, ok := rel(sd.rootObjectPath)
+		return object{Path: path.Join("/", p), RootObjectPath: sd.rootObjectPath}, ok
+	}
+	for i := range sd.rootDirs {
+		rd := &sd.rootDirs[i]
+		if p, ok := rel(rd.Path); ok {
+			return object{Path: path.Join("/", rd.Name, p), RootObjectPath: rd.Path, root: rd}, true
+		}
+	}
+	return
+}
+
+// Whether the object is the virtual container listing the root dirs.
+func (srv *Server) isRootDirsContainer(o object) bool {
+	return o.IsRoot() && len(srv.sharedDirs().rootDirs) != 0
+}
+
+// Returns a container for each root dir.
+func (me *contentDirectoryService) rootDirContainers(host, userAgent string) (ret []interface{}) {
+	sd := me.sharedDirs()
+	for i := range sd.rootDirs {
+		rd := &sd.rootDirs[i]
+		o := object{
+			Path:           path.Join("/", rd.Name),
+			RootObjectPath: rd.Path,
+			root:           rd,
+		}
+		ret = append(ret, upnpav.Container{
+			Object: upnpav.Object{
+				ID:          o.ID(),
+				ParentID:    o.ParentID(),
+				Restricted:  1,
+				Class:       "object.container.storageFolder",
+				Title:       rd.Name,
+				AlbumArtURI: folderArtURL(host, o.Path),
+			},
+			ChildCount: me.objectChildCount(o),
+		})
+	}
+	return
+}
@@ -0,0 +1,148 @@
+package dms
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// Returns text from file names and tags as renderers can show it. Bytes that aren't UTF-8, such as
+// from names written in a legacy encoding, are taken to be Windows-1252, which Latin-1 is nearly all
+// of. Whitespace such as newlines becomes spaces, and other control characters, which XML can't
+// carry and some TVs choke on, are dropped. It's normalized to NFC, as decomposed accents, such as
+// in names from macOS, are drawn apart by some renderers.
+func sanitizeText(s string) string {
+	if isSanitizedText(s) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			r = charmap.Windows1252.DecodeByte(s[i])
+		}
+		i += size
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+			b.WriteByte(' ')
+		case unicode.IsControl(r) || r == 0xfffe || r == 0xffff:
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return norm.NFC.String(b.String())
+}
+
+// Whether sanitizeText would leave s as it is.
+func isSanitizedText(s string) bool {
+	for _, r := range s {
+		if r == utf8.RuneError || unicode.IsControl(r) || r == 0xfffe || r == 0xffff {
+			return false
+		}
+	}
+	return norm.NFC.IsNormalString(s)
+}
+
+// Returns the URL with the bytes that can't be in one percent-encoded, such as spaces and non-ASCII
+// in those of remote streams from the config. Escapes that are already there are kept.
+func sanitizeURL(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%' && i+2 < len(s) && isHexDigit(s[i+1]) && isHexDigit(s[i+2]):
+			b.WriteByte(c)
+		case c <= ' ' || c >= 0x7f || strings.IndexByte("\"%<>\\^`{|}", c) != -1:
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func sanitizeObjectFields(o upnpav.Object) upnpav.Object {
+	o.Title = sanitizeText(o.Title)
+	o.Artist = sanitizeText(o.Artist)
+	o.Album = sanitizeText(o.Album)
+	o.Genre = sanitizeText(o.Genre)
+	o.Description = sanitizeText(o.Description)
+	o.Icon = sanitizeURL(o.Icon)
+	o.AlbumArtURI = sanitizeURL(o.AlbumArtURI)
+	return o
+}
+
+// Returns the DIDL-Lite object with its text and URLs sanitized, as the last thing before it's
+// encoded. Objects are cached, so they're copied rather than changed. ObjectIDs are percent-encoded
+// object paths, so they need nothing.
+func sanitizeObject(obj interface{}) interface{} {
+	switch o := obj.(type) {
+	case upnpav.Container:
+		o.Object = sanitizeObjectFields(o.Object)
+		return o
+	case upnpav.Item:
+		o.Object = sanitizeObjectFields(o.Object)
+		res := make([]upnpav.Resource, len(o.Res))
+		for i, r := range o.Res {
+			r.URL = sanitizeURL(r.URL)
+			res[i] = r
+		}
+		o.Res = res
+		return o
+	}
+	return obj
+}
+
+// Returns a Content-Disposition for downloading a file of the name. Names that aren't plain ASCII
+// are given in UTF-8 as RFC 6266 has them, after a fallback for clients that don't take that.
+func attachmentDisposition(name string) string {
+	name = sanitizeText(name)
+	fallback := strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	if fallback == name {
+		return `attachment; filename="` + name + `"`
+	}
+	var encoded strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) != -1 {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback, encoded.String())
+}
+
+// Serves the file like http.ServeFile, which refuses names that aren't UTF-8, such as those in a
+// legacy encoding.
+func (srv *Server) serveFile(w http.ResponseWriter, r *http.Request, filePath string) {
+	f, err := srv.contentFS().Open(filePath)
+	if err != nil {
+		srv.resourceError(w, r, fileErrorCause(err), err)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		srv.resourceError(w, r, fileErrorCause(err), err)
+		return
+	}
+	http.ServeContent(w, r, filepath.Base(filePath), fi.ModTime(), f)
+}
@@ -0,0 +1,110 @@
+package dms
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/url"
+	"testing"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestSanitizeText(t *testing.T) {
+	for in, want := range map[string]string{
+		`a&b<c>"d'`:       `a&b<c>"d'`,
+		"Caf\xe9 \x80":    "Café €",
+		"café \xff":       "café ÿ",
+		"E\u0301te\u0301": "Été",
+		"ctl\x01x\x7f":    "ctlx",
+		"two\r\nlines\t":  "two  lines ",
+		"\ufffe\u0085ok":  "ok",
+		"東京":              "東京",
+	} {
+		if got := sanitizeText(in); got != want {
+			t.Errorf("%q: got %q", in, got)
+		}
+	}
+}
+
+func TestSanitizeURL(t *testing.T) {
+	for in, want := range map[string]string{
+		"http://h/res?path=%2Fa%26b.mp3": "http://h/res?path=%2Fa%26b.mp3",
+		"http://radio/my stream.mp3":     "http://radio/my%20stream.mp3",
+		"http://radio/café<1>":           "http://radio/caf%C3%A9%3C1%3E",
+		"http://radio/100%":              "http://radio/100%25",
+	} {
+		if got := sanitizeURL(in); got != want {
+			t.Errorf("%q: got %q", in, got)
+		}
+	}
+}
+
+func TestAttachmentDisposition(t *testing.T) {
+	for in, want := range map[string]string{
+		"Heat.mkv":    `attachment; filename="Heat.mkv"`,
+		`a"b.mkv`:     `attachment; filename="a_b.mkv"; filename*=UTF-8''a%22b.mkv`,
+		"caf\xe9.mkv": `attachment; filename="caf_.mkv"; filename*=UTF-8''caf%C3%A9.mkv`,
+	} {
+		if got := attachmentDisposition(in); got != want {
+			t.Errorf("%q: got %s", in, got)
+		}
+	}
+}
+
+// File names that TVs have been given malformed DIDL-Lite for, and shown empty folders.
+func TestHostileDIDL(t *testing.T) {
+	for _, name := range []string{
+		`a&b<c>"d'.mp3`,
+		"bad\xff\xfe.mp3",
+		"ctl\x01x.mp3",
+		"pct%41 #?.mp3",
+		"plus+semi;.mp3",
+		"]]>&#34;.mp3",
+	} {
+		o := object{Path: "/" + name}
+		item := upnpav.Item{
+			Object: upnpav.Object{ID: o.ID(), ParentID: o.ParentID(), Title: name, Class: "object.item.audioItem"},
+			Res: []upnpav.Resource{{
+				URL:          "http://192.168.1.10:1338" + resPath + "?" + url.Values{"path": {o.Path}}.Encode(),
+				ProtocolInfo: "http-get:*:audio/mpeg:*",
+			}},
+		}
+		didl, err := xml.Marshal(sanitizeObject(item))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body bytes.Buffer
+		if err := writeSOAPResponse(&body, upnp.SoapAction{Action: "Browse"}, []soapArg{{Name: "Result", Value: didl_lite(string(didl))}}); err != nil {
+			t.Fatal(err)
+		}
+		var env struct {
+			Result string `xml:"Body>BrowseResponse>Result"`
+		}
+		if err := xml.Unmarshal(body.Bytes(), &env); err != nil {
+			t.Errorf("%q: SOAP: %v", name, err)
+			continue
+		}
+		var got struct {
+			Item struct {
+				ID    string `xml:"id,attr"`
+				Title string `xml:"title"`
+				Res   string `xml:"res"`
+			} `xml:"item"`
+		}
+		if err := xml.Unmarshal([]byte(env.Result), &got); err != nil {
+			t.Errorf("%q: DIDL-Lite: %v", name, err)
+			continue
+		}
+		if got.Item.Title != sanitizeText(name) {
+			t.Errorf("%q: got title %q", name, got.Item.Title)
+		}
+		if objectIDPath(got.Item.ID) != o.Path {
+			t.Errorf("%q: got ID %q", name, got.Item.ID)
+		}
+		u, err := url.Parse(got.Item.Res)
+		if err != nil || u.Query().Get("path") != o.Path {
+			t.Errorf("%q: got res %q", name, got.Item.Res)
+		}
+	}
+}
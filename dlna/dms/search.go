@@ -0,0 +1,288 @@
+package dms
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// Properties that Search can match on.
+const searchCapabilities = "@id,@parentID,dc:title,upnp:class"
+
+// A parsed ContentDirectory SearchCriteria expression.
+type searchCriteria interface {
+	// Reports whether an object with the given property values matches.
+	match(props map[string]string) bool
+}
+
+type searchAll struct{}
+
+func (searchAll) match(map[string]string) bool { return true }
+
+type searchLogical struct {
+	and         bool
+	left, right searchCriteria
+}
+
+func (me searchLogical) match(props map[string]string) bool {
+	if me.and {
+		return me.left.match(props) && me.right.match(props)
+	}
+	return me.left.match(props) || me.right.match(props)
+}
+
+type searchRelation struct {
+	property, op, value string
+}
+
+func (me searchRelation) match(props map[string]string) bool {
+	v, ok := props[me.property]
+	if me.op == "exists" {
+		return ok == (me.value == "true")
+	}
+	if !ok {
+		return false
+	}
+	// Comparisons aren't case-sensitive, which is what users expect for titles.
+	v, want := strings.ToLower(v), strings.ToLower(me.value)
+	switch me.op {
+	case "=":
+		return v == want
+	case "!=":
+		return v != want
+	case "<":
+		return v < want
+	case "<=":
+		return v <= want
+	case ">":
+		return v > want
+	case ">=":
+		return v >= want
+	case "contains":
+		return strings.Contains(v, want)
+	case "doesNotContain":
+		return !strings.Contains(v, want)
+	case "startsWith":
+		return strings.HasPrefix(v, want)
+	case "derivedfrom":
+		return v == want || strings.HasPrefix(v, want+".")
+	}
+	return false
+}
+
+var searchOps = map[string]bool{
+	"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"contains": true, "doesNotContain": true, "startsWith": true, "derivedfrom": true,
+	"exists": true,
+}
+
+func tokenizeSearchCriteria(s string) (tokens []string, err error) {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case c == '"':
+			// Keep the quote so quoted values can be told apart from other tokens.
+			var b strings.Builder
+			b.WriteByte('"')
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			i++
+			tokens = append(tokens, b.String())
+		case strings.IndexByte("=!<>", c) != -1:
+			j := i + 1
+			for j < len(s) && s[j] == '=' {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && strings.IndexByte(`()"=!<>`, s[j]) == -1 {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return
+}
+
+// Parses a SearchCriteria string as defined by the ContentDirectory spec, where "and" binds more
+// tightly than "or".
+func parseSearchCriteria(s string) (searchCriteria, error) {
+	if strings.TrimSpace(s) == "*" || strings.TrimSpace(s) == "" {
+		return searchAll{}, nil
+	}
+	tokens, err := tokenizeSearchCriteria(s)
+	if err != nil {
+		return nil, err
+	}
+	p := searchParser{tokens: tokens}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if len(p.tokens) != 0 {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[0])
+	}
+	return c, nil
+}
+
+type searchParser struct {
+	tokens []string
+}
+
+func (me *searchParser) next() (string, error) {
+	if len(me.tokens) == 0 {
+		return "", fmt.Errorf("unexpected end of criteria")
+	}
+	t := me.tokens[0]
+	me.tokens = me.tokens[1:]
+	return t, nil
+}
+
+func (me *searchParser) peekIs(word string) bool {
+	return len(me.tokens) != 0 && strings.EqualFold(me.tokens[0], word)
+}
+
+func (me *searchParser) parseOr() (searchCriteria, error) {
+	left, err := me.parseAnd()
+	for err == nil && me.peekIs("or") {
+		me.tokens = me.tokens[1:]
+		var right searchCriteria
+		right, err = me.parseAnd()
+		left = searchLogical{false, left, right}
+	}
+	return left, err
+}
+
+func (me *searchParser) parseAnd() (searchCriteria, error) {
+	left, err := me.parseExpr()
+	for err == nil && me.peekIs("and") {
+		me.tokens = me.tokens[1:]
+		var right searchCriteria
+		right, err = me.parseExpr()
+		left = searchLogical{true, left, right}
+	}
+	return left, err
+}
+
+func (me *searchParser) parseExpr() (searchCriteria, error) {
+	t, err := me.next()
+	if err != nil {
+		return nil, err
+	}
+	if t == "(" {
+		c, err := me.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t, err := me.next(); err != nil || t != ")" {
+			return nil, fmt.Errorf("expected )")
+		}
+		return c, nil
+	}
+	rel := searchRelation{property: t}
+	if rel.op, err = me.next(); err != nil {
+		return nil, err
+	}
+	if !searchOps[rel.op] {
+		return nil, fmt.Errorf("unknown operator %q", rel.op)
+	}
+	if rel.value, err = me.next(); err != nil {
+		return nil, err
+	}
+	if rel.op == "exists" {
+		if rel.value != "true" && rel.value != "false" {
+			return nil, fmt.Errorf("exists requires true or false")
+		}
+	} else if !strings.HasPrefix(rel.value, `"`) {
+		return nil, fmt.Errorf("expected quoted value after %q", rel.op)
+	} else {
+		rel.value = rel.value[1:]
+	}
+	return rel, nil
+}
+
+// Returns the properties of a upnpav.Item or upnpav.Container that search criteria can refer to.
+func searchProperties(obj interface{}) map[string]string {
+	var o *upnpav.Object
+	switch obj := obj.(type) {
+	case upnpav.Item:
+		o = &obj.Object
+	case upnpav.Container:
+		o = &obj.Object
+	default:
+		return nil
+	}
+	return map[string]string{
+		"@id":        o.ID,
+		"@parentID":  o.ParentID,
+		"dc:title":   o.Title,
+		"upnp:class": o.Class,
+	}
+}
+
+// Returns the objects below o that match the criteria, from the index.
+func (me *contentDirectoryService) searchContainer(
+	o object,
+	crit searchCriteria,
+	host, userAgent string,
+) (ret []interface{}, err error) {
+	var dirs []string
+	entries := make(map[string][]os.FileInfo)
+	// Turning entries into objects reads the index too, which mustn't be done while it's held open.
+	err = me.index.forEachEntry(o.Path, true, func(dir string, e *indexEntry) bool {
+		if _, ok := entries[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		entries[dir] = append(entries[dir], indexFileInfo{e})
+		return true
+	})
+	if err != nil {
+		return
+	}
+	s := me.settings()
+	for _, dir := range dirs {
+		if !s.NoTranscode && isDiscContentPath(dir) {
+			continue
+		}
+		dirObject, err := me.objectFromPath(dir)
+		if err != nil {
+			continue
+		}
+		fis := entries[dir]
+		var alternates map[string][]os.FileInfo
+		if !s.NoPhotoGrouping {
+			fis, alternates = groupPhotos(fis)
+		}
+		for _, fi := range fis {
+			child := dirObject.child(fi.Name())
+			obj, err := me.cdsObjectToUpnpavObject(child, fi, host, userAgent)
+			if err != nil {
+				me.Logger.Printf("error with %s: %s", child.FilePath(), err)
+				continue
+			}
+			if obj != nil && crit.match(searchProperties(obj)) {
+				ret = append(ret, withPhotoAlternates(obj, dirObject, alternates[fi.Name()], host))
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,47 @@
+package dms
+
+import (
+	"testing"
+)
+
+func TestSearchCriteria(t *testing.T) {
+	video := map[string]string{
+		"dc:title":   "The Big Lebowski",
+		"upnp:class": "object.item.videoItem",
+	}
+	for _, c := range []struct {
+		criteria string
+		match    bool
+	}{
+		{`*`, true},
+		{`upnp:class derivedfrom "object.item"`, true},
+		{`upnp:class derivedfrom "object.item.video"`, false},
+		{`upnp:class = "object.item.videoItem" and dc:title contains "lebowski"`, true},
+		{`(upnp:class derivedfrom "object.item.audioItem" and dc:title contains "big") or dc:title startsWith "the"`, true},
+		{`upnp:class derivedfrom "object.item.audioItem" and dc:title contains "big" or dc:title = "x"`, false},
+		{`dc:title doesNotContain "big"`, false},
+		{`dc:creator exists false and dc:title exists true`, true},
+		{`dc:title="The Big Lebowski"`, true},
+		{`dc:title = "say \"hi\""`, false},
+	} {
+		crit, err := parseSearchCriteria(c.criteria)
+		if err != nil {
+			t.Errorf("%s: %v", c.criteria, err)
+			continue
+		}
+		if crit.match(video) != c.match {
+			t.Errorf("%s: expected match %v", c.criteria, c.match)
+		}
+	}
+	for _, bad := range []string{
+		`dc:title contains`,
+		`dc:title like "x"`,
+		`(dc:title = "x"`,
+		`dc:title = x`,
+		`dc:title = "x`,
+	} {
+		if _, err := parseSearchCriteria(bad); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
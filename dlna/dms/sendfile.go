@@ -0,0 +1,44 @@
+package dms
+
+import (
+	"io"
+	"math"
+)
+
+// The most the ReadFrom of the response writers and connections copies at once, so that what they
+// do between writes, such as counting what's been streamed or extending the write deadline, is done
+// as they go.
+const readFromChunkSize = 1 << 20
+
+// Copies src to dst in chunks, calling each with the size of each once it's copied. An *os.File, or
+// the io.LimitedReader of one that http.ServeContent copies from, stays what each chunk is read
+// from, so that the ReadFrom of a TCP connection under dst can still send it with sendfile rather
+// than copying it through a buffer. Response writers that wrap another should copy with this in
+// their ReadFrom, or with io.Copy to the one they wrap, as io.Copy to themselves would hide it.
+func copyInChunks(dst io.Writer, src io.Reader, each func(n int64) error) (written int64, err error) {
+	remaining := int64(math.MaxInt64)
+	if lr, ok := src.(*io.LimitedReader); ok {
+		src, remaining = lr.R, lr.N
+		defer func() { lr.N -= written }()
+	}
+	for remaining > 0 {
+		chunk := &io.LimitedReader{R: src, N: readFromChunkSize}
+		if chunk.N > remaining {
+			chunk.N = remaining
+		}
+		var n int64
+		n, err = io.Copy(dst, chunk)
+		written += n
+		remaining -= n
+		if n > 0 {
+			if eachErr := each(n); err == nil {
+				err = eachErr
+			}
+		}
+		// A chunk that isn't used up is the end of src.
+		if err != nil || chunk.N > 0 {
+			return
+		}
+	}
+	return
+}
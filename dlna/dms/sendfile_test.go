@@ -0,0 +1,137 @@
+package dms
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stands in for the response writer of net/http, noting whether each ReadFrom could send a file.
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	files, others int
+	afterRead     func()
+}
+
+func (me *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	file := src
+	if lr, ok := src.(*io.LimitedReader); ok {
+		file = lr.R
+	}
+	if _, ok := file.(*os.File); ok {
+		me.files++
+	} else {
+		me.others++
+	}
+	n, err := io.Copy(me.ResponseRecorder, src)
+	if me.afterRead != nil {
+		me.afterRead()
+	}
+	return n, err
+}
+
+func writeTestFile(t testing.TB, size int) (string, []byte) {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	p := filepath.Join(t.TempDir(), "a.mkv")
+	if err := os.WriteFile(p, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p, data
+}
+
+// Files served through the response writers that wrap net/http's must reach its ReadFrom, or
+// they're copied through a buffer rather than sent with sendfile.
+func TestReadFromKeepsFile(t *testing.T) {
+	p, data := writeTestFile(t, 5*readFromChunkSize/2)
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	aw := &accessLogResponseWriter{ResponseWriter: rec}
+	s := &activeStream{}
+	w := &countingResponseWriter{&mitmRespWriter{ResponseWriter: aw}, prometheus.NewCounter(prometheus.CounterOpts{Name: "bytes"}), s}
+	http.ServeContent(w, httptest.NewRequest("GET", "/res", nil), "a.mkv", time.Time{}, f)
+	if !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Fatalf("got %d bytes", rec.Body.Len())
+	}
+	if rec.files != 3 || rec.others != 0 {
+		t.Errorf("%d chunks from the file, %d from something else", rec.files, rec.others)
+	}
+	if s.Bytes() != int64(len(data)) || aw.written != int64(len(data)) {
+		t.Errorf("counted %d and logged %d bytes", s.Bytes(), aw.written)
+	}
+
+	// Streams stopped through the API stop between chunks.
+	f.Seek(0, io.SeekStart)
+	s = &activeStream{}
+	rec = &readFromRecorder{ResponseRecorder: httptest.NewRecorder(), afterRead: func() { s.stopped = 1 }}
+	w = &countingResponseWriter{rec, prometheus.NewCounter(prometheus.CounterOpts{Name: "bytes"}), s}
+	if n, err := w.ReadFrom(f); err != errStreamStopped || n != readFromChunkSize {
+		t.Errorf("stopped stream: %d, %v", n, err)
+	}
+}
+
+// Downloads of a file over loopback, served through what wraps responses and connections, and
+// without them. They should be about as fast, unless something in the first hides the file from
+// sendfile and copies it through a buffer, which small NAS boxes can't do at gigabit speeds.
+func BenchmarkServeFile(b *testing.B) {
+	p, data := writeTestFile(b, 64<<20)
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		f, err := os.Open(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		http.ServeContent(w, r, "a.mkv", time.Time{}, f)
+	}
+	for _, bc := range []struct {
+		name    string
+		wrapped bool
+	}{{"wrapped", true}, {"plain", false}} {
+		b.Run(bc.name, func(b *testing.B) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			h := http.HandlerFunc(serve)
+			if bc.wrapped {
+				ln = stalledWriteListener{ln, httpStalledWriteTimeout}
+				streamed := prometheus.NewCounter(prometheus.CounterOpts{Name: "bytes"})
+				h = func(w http.ResponseWriter, r *http.Request) {
+					w = &accessLogResponseWriter{ResponseWriter: w}
+					serve(&countingResponseWriter{&mitmRespWriter{ResponseWriter: w}, streamed, &activeStream{}}, r)
+				}
+			}
+			srv := &http.Server{Handler: h}
+			go srv.Serve(ln)
+			defer srv.Close()
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get("http://" + ln.Addr().String() + "/a.mkv")
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil || n != int64(len(data)) {
+					b.Fatal(n, err)
+				}
+			}
+		})
+	}
+}
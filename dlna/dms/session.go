@@ -0,0 +1,153 @@
+package dms
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// A session is a run of requests from the same client, that ends after this long without any.
+const sessionIdleTimeout = 10 * time.Minute
+
+type sessionKey struct {
+	IP        string
+	UserAgent string
+}
+
+type session struct {
+	ID       string
+	Started  time.Time
+	LastSeen time.Time
+}
+
+// Assigns session IDs to clients. Renderers don't have any notion of a session, so a client is
+// identified by its address and User-Agent.
+type sessionTracker struct {
+	mu        sync.Mutex
+	sessions  map[sessionKey]*session
+	lastPrune time.Time
+}
+
+// Returns the ID of the current session for the client, starting a new one if necessary, and
+// whether it did.
+func (me *sessionTracker) touch(key sessionKey, now time.Time) (id string, started bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if now.Sub(me.lastPrune) >= sessionIdleTimeout {
+		for k, s := range me.sessions {
+			if now.Sub(s.LastSeen) >= sessionIdleTimeout {
+				delete(me.sessions, k)
+			}
+		}
+		me.lastPrune = now
+	}
+	s, ok := me.sessions[key]
+	if !ok || now.Sub(s.LastSeen) >= sessionIdleTimeout {
+		var b [4]byte
+		rand.Read(b[:])
+		s = &session{
+			ID:      hex.EncodeToString(b[:]),
+			Started: now,
+		}
+		if me.sessions == nil {
+			me.sessions = make(map[sessionKey]*session)
+		}
+		me.sessions[key] = s
+		started = true
+	}
+	s.LastSeen = now
+	return s.ID, started
+}
+
+// A client and its current session, for the status page.
+type clientSession struct {
+	sessionKey
+	session
+}
+
+// Returns the clients seen within sessionIdleTimeout, most recently seen first.
+func (me *sessionTracker) recent(now time.Time) (ret []clientSession) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for k, s := range me.sessions {
+		if now.Sub(s.LastSeen) < sessionIdleTimeout {
+			ret = append(ret, clientSession{k, *s})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].LastSeen.After(ret[j].LastSeen)
+	})
+	return
+}
+
+// Returns the client's address without the port or IPv6 zone.
+func requestClientIP(r *http.Request) string {
+	clientIp, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if zoneDelimiterIdx := strings.Index(clientIp, "%"); zoneDelimiterIdx != -1 {
+		// IPv6 addresses may have the form address%zone (e.g. ::1%eth0)
+		clientIp = clientIp[:zoneDelimiterIdx]
+	}
+	return clientIp
+}
+
+type requestContextKey struct{}
+
+// Per-request state added to the request context.
+type requestContext struct {
+	clientLogTag
+	logger log.Logger
+	// What the access log says of the request: the transcode it was served with, and why it
+	// failed.
+	transcode string
+	failure   error
+	// Set once the request's login has been checked.
+	webUserLogin *webUserLogin
+}
+
+// Returns the request with a logger that tags messages with the client and its session.
+func (me *Server) withRequestContext(r *http.Request) *http.Request {
+	rc := &requestContext{}
+	rc.IP = requestClientIP(r)
+	var started bool
+	now := time.Now()
+	rc.Session, started = me.sessions.touch(sessionKey{rc.IP, r.UserAgent()}, now)
+	me.devices.seen(rc.IP, deviceSeenHTTP, r.UserAgent(), now)
+	if started {
+		me.runHooks(HookDeviceDiscovered, map[string]string{
+			"CLIENT_IP":  rc.IP,
+			"USER_AGENT": r.UserAgent(),
+			"SESSION":    rc.Session,
+		})
+	}
+	tag := rc.clientLogTag
+	rc.logger = me.Logger.WithContextText(fmt.Sprintf("%s [%s]", tag.IP, tag.Session)).WithMap(
+		func(m log.Msg) log.Msg {
+			return m.WithValues(tag)
+		})
+	return r.WithContext(context.WithValue(r.Context(), requestContextKey{}, rc))
+}
+
+// Returns the logger for messages about the request.
+func (me *Server) requestLogger(r *http.Request) log.Logger {
+	if rc, ok := r.Context().Value(requestContextKey{}).(*requestContext); ok {
+		return rc.logger
+	}
+	return me.Logger
+}
+
+// Returns the session ID the request was assigned, or "" if there isn't one.
+func requestSession(r *http.Request) string {
+	if rc, ok := r.Context().Value(requestContextKey{}).(*requestContext); ok {
+		return rc.Session
+	}
+	return ""
+}
@@ -0,0 +1,74 @@
+package dms
+
+import (
+	"net/http"
+	"strings"
+)
+
+const settingsPath = "/settings"
+
+// Settings that can be changed from the web UI.
+type Settings struct {
+	FriendlyName string
+	// The shared directories as -path gives them: a directory, or Name=directory.
+	Paths []string
+	// The audio profiles as -audioProfile gives them: a User-Agent substring=formats.
+	AudioProfiles []string
+}
+
+// Changes the settings from the web UI, such as by editing the config file the server was started
+// with and reloading it.
+type SettingsEditor interface {
+	Settings() Settings
+	// Checks and applies the settings, leaving them as they were if they can't be.
+	SetSettings(Settings) error
+}
+
+// Splits the lines of a textarea into its non-empty ones.
+func formLines(s string) (ret []string) {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			ret = append(ret, line)
+		}
+	}
+	return
+}
+
+// Shows the settings that can be changed from the web UI, and applies them on POST.
+func (srv *Server) serveSettings(w http.ResponseWriter, r *http.Request) {
+	if !srv.authorizeAPI(w, r, APIScopeAdmin) {
+		return
+	}
+	if ok, err := srv.loginConfigured(); err != nil || !ok {
+		http.Error(w, "the settings can only be changed once there's a web user or an API token added by the operator", http.StatusForbidden)
+		return
+	}
+	data := struct {
+		Editable bool
+		Settings Settings
+		Saved    bool
+		Error    error
+	}{
+		Editable: srv.SettingsEditor != nil,
+	}
+	if srv.SettingsEditor != nil {
+		data.Settings = srv.SettingsEditor.Settings()
+		if r.Method == "POST" {
+			// What was entered is shown again if it can't be applied, to be corrected.
+			data.Settings = Settings{
+				FriendlyName:  strings.TrimSpace(r.FormValue("friendlyName")),
+				Paths:         formLines(r.FormValue("paths")),
+				AudioProfiles: formLines(r.FormValue("audioProfiles")),
+			}
+			data.Error = srv.SettingsEditor.SetSettings(data.Settings)
+			if data.Error == nil {
+				data.Saved = true
+				srv.requestLogger(r).Printf("changed settings")
+			}
+		}
+	}
+	w.Header().Set("content-type", "text/html")
+	if err := settingsTmpl.Execute(w, data); err != nil {
+		srv.Logger.Print(err)
+	}
+}
@@ -0,0 +1,114 @@
+package dms
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testSettingsEditor struct {
+	settings Settings
+	set      []Settings
+}
+
+func (me *testSettingsEditor) Settings() Settings {
+	return me.settings
+}
+
+func (me *testSettingsEditor) SetSettings(s Settings) error {
+	me.set = append(me.set, s)
+	if len(s.Paths) == 0 {
+		return errors.New("no shared directories")
+	}
+	me.settings = s
+	return nil
+}
+
+func TestSettingsPage(t *testing.T) {
+	editor := &testSettingsEditor{settings: Settings{FriendlyName: "Den", Paths: []string{"/media"}}}
+	srv := newMemFSServer()
+	srv.SettingsEditor = editor
+	srv.metrics = newServerMetrics(srv)
+	mux := http.NewServeMux()
+	srv.initWebUIMux(mux)
+	serve := func(method string, form url.Values, user, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, settingsPath, strings.NewReader(form.Encode()))
+		r.RemoteAddr = "192.168.1.20:4000"
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if user != "" {
+			r.SetBasicAuth(user, "secret")
+		}
+		if origin == "" {
+			// Browsers send it with forms from dms's own pages too.
+			origin = "http://" + r.Host
+		}
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	form := url.Values{"friendlyName": {"Lounge"}, "paths": {"/media\nFilms=/films"}}
+	// Until there's someone to log in as, anyone on the network could change what's shared.
+	for _, method := range []string{"GET", "POST"} {
+		if w := serve(method, form, "", ""); w.Code != http.StatusForbidden {
+			t.Errorf("%s without a web user got %d", method, w.Code)
+		}
+	}
+	// Nor does a token nobody's known to have added.
+	if err := srv.apiTokens.Load(filepath.Join(t.TempDir(), "tokens.json")); err != nil {
+		t.Fatal(err)
+	}
+	token, err := srv.apiTokens.Add("old", []string{APIScopeAdmin}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", settingsPath, nil)
+	r.RemoteAddr = "192.168.1.20:4000"
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("GET with a token of unknown origin got %d", w.Code)
+	}
+	if err := srv.apiTokens.Revoke("old"); err != nil {
+		t.Fatal(err)
+	}
+	srv.WebUsers = []WebUser{
+		{Name: "admin", Password: "secret", Scopes: []string{APIScopeAdmin}},
+		{Name: "guest", Password: "secret", Scopes: []string{APIScopeBrowse}},
+	}
+	if w := serve("GET", nil, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET without logging in got %d", w.Code)
+	}
+	if w := serve("POST", form, "guest", ""); w.Code != http.StatusForbidden {
+		t.Errorf("POST by a browse user got %d", w.Code)
+	}
+	if w := serve("POST", form, "admin", "http://evil.example"); w.Code != http.StatusForbidden {
+		t.Errorf("cross-origin POST got %d", w.Code)
+	}
+	if len(editor.set) != 0 {
+		t.Fatalf("settings set by refused requests: %q", editor.set)
+	}
+	if w := serve("GET", nil, "admin", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Den") {
+		t.Errorf("GET got %d: %s", w.Code, w.Body)
+	}
+	// What can't be applied is shown again to be corrected.
+	bad := url.Values{"friendlyName": {"Attic"}}
+	if w := serve("POST", bad, "admin", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "no shared directories") || !strings.Contains(w.Body.String(), "Attic") {
+		t.Errorf("bad POST got %d: %s", w.Code, w.Body)
+	}
+	if editor.settings.FriendlyName != "Den" {
+		t.Errorf("bad settings applied: %+v", editor.settings)
+	}
+	if w := serve("POST", form, "admin", ""); w.Code != http.StatusOK {
+		t.Errorf("POST got %d: %s", w.Code, w.Body)
+	}
+	want := Settings{FriendlyName: "Lounge", Paths: []string{"/media", "Films=/films"}}
+	if got := editor.settings; got.FriendlyName != want.FriendlyName || strings.Join(got.Paths, ",") != strings.Join(want.Paths, ",") {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,45 @@
+package dms
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// Returns the latency and bandwidth to simulate, if any.
+func (srv *Server) simulatedNetwork() (latency time.Duration, kbps int) {
+	s := srv.settings()
+	return s.SimulatedLatency, s.SimulatedKbps
+}
+
+// Warns that responses are being slowed, so that it isn't left on by accident.
+func (srv *Server) warnSimulatedNetwork() {
+	latency, kbps := srv.simulatedNetwork()
+	if latency > 0 || kbps > 0 {
+		srv.Logger.Levelf(log.Warning, "simulating a slow network: %v latency, %d kbit/s", latency, kbps)
+	}
+}
+
+// Delays the request by SimulatedLatency, and returns w limited to SimulatedKbps. It's false if
+// the request was canceled while delayed.
+func (srv *Server) simulateNetwork(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, bool) {
+	latency, kbps := srv.simulatedNetwork()
+	if latency > 0 {
+		t := time.NewTimer(latency)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			return w, false
+		}
+	}
+	if kbps > 0 {
+		w = &throttledResponseWriter{
+			ResponseWriter: w,
+			ctx:            r.Context(),
+			buckets:        []*tokenBucket{newTokenBucket(kbps)},
+		}
+	}
+	return w, true
+}
@@ -0,0 +1,32 @@
+package dms
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSimulateNetwork(t *testing.T) {
+	srv := &Server{SimulatedLatency: 50 * time.Millisecond, SimulatedKbps: 160}
+	r := httptest.NewRequest("GET", "/res", nil)
+	rec := httptest.NewRecorder()
+	started := time.Now()
+	w, ok := srv.simulateNetwork(rec, r)
+	if !ok {
+		t.Fatal("not ok")
+	}
+	if d := time.Since(started); d < srv.SimulatedLatency {
+		t.Errorf("delayed %v", d)
+	}
+	// 20000 bytes a second.
+	started = time.Now()
+	if n, err := w.Write(make([]byte, 4000)); n != 4000 || err != nil {
+		t.Fatalf("wrote %d: %v", n, err)
+	}
+	if d := time.Since(started); d < 190*time.Millisecond {
+		t.Errorf("4000 bytes written in %v", d)
+	}
+	if rec.Body.Len() != 4000 {
+		t.Errorf("body of %d bytes", rec.Body.Len())
+	}
+}
@@ -0,0 +1,130 @@
+package dms
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/log"
+)
+
+// The actions of a UPnP service by name. Services embed it to handle their control requests, so
+// that unknown actions and malformed arguments are answered with the same UPnP errors by each.
+type soapActions map[string]soapAction
+
+// A handler of a SOAP action, and the type its arguments are unmarshalled into, if it takes any.
+type soapAction struct {
+	handle reflect.Value
+	args   reflect.Type
+	// The names of the arguments requests must give.
+	required []string
+}
+
+var (
+	soapResultType  = reflect.TypeOf([]soapArg(nil))
+	errorType       = reflect.TypeOf((*error)(nil)).Elem()
+	httpRequestType = reflect.TypeOf((*http.Request)(nil))
+)
+
+// Returns the action handled by fn, which is a func(r *http.Request) ([]soapArg, error), or a
+// func(args *T, r *http.Request) ([]soapArg, error), where T is a struct the arguments of requests
+// are unmarshalled into. Arguments that requests must give are the fields tagged soap:"required".
+func newSOAPAction(fn interface{}) (ret soapAction) {
+	ret.handle = reflect.ValueOf(fn)
+	t := ret.handle.Type()
+	if t.Kind() != reflect.Func || t.NumIn() < 1 || t.NumIn() > 2 || t.In(t.NumIn()-1) != httpRequestType ||
+		t.NumOut() != 2 || t.Out(0) != soapResultType || t.Out(1) != errorType {
+		log.Panicf("bad SOAP action handler type %v", t)
+	}
+	if t.NumIn() == 1 {
+		return
+	}
+	if t.In(0).Kind() != reflect.Ptr || t.In(0).Elem().Kind() != reflect.Struct {
+		log.Panicf("bad SOAP action arguments type %v", t.In(0))
+	}
+	ret.args = t.In(0).Elem()
+	for i := 0; i < ret.args.NumField(); i++ {
+		f := ret.args.Field(i)
+		if f.Tag.Get("soap") != "required" {
+			continue
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("xml"), ",")[0]; tag != "" {
+			name = tag
+		}
+		ret.required = append(ret.required, name)
+	}
+	return
+}
+
+// Unmarshals the arguments of the action request, and calls the handler with them.
+func (me soapAction) call(argsXML []byte, r *http.Request) ([]soapArg, error) {
+	in := []reflect.Value{reflect.ValueOf(r)}
+	if me.args != nil {
+		args := reflect.New(me.args)
+		if err := xml.Unmarshal(argsXML, args.Interface()); err != nil {
+			return nil, upnp.Errorf(upnp.InvalidArgsErrorCode, "Invalid Args: %v", err)
+		}
+		if len(me.required) != 0 {
+			given, err := soapArgNames(argsXML)
+			if err != nil {
+				return nil, upnp.Errorf(upnp.InvalidArgsErrorCode, "Invalid Args: %v", err)
+			}
+			for _, name := range me.required {
+				if !given[name] {
+					return nil, upnp.Errorf(upnp.InvalidArgsErrorCode, "Invalid Args: no %s", name)
+				}
+			}
+		}
+		in = append([]reflect.Value{args}, in...)
+	}
+	out := me.handle.Call(in)
+	err, _ := out[1].Interface().(error)
+	return out[0].Interface().([]soapArg), err
+}
+
+// Returns the names of the arguments given in the XML of an action request.
+func soapArgNames(argsXML []byte) (map[string]bool, error) {
+	ret := make(map[string]bool)
+	d := xml.NewDecoder(bytes.NewReader(argsXML))
+	depth := 0
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			depth++
+			// The action's element holds its arguments.
+			if depth == 2 {
+				ret[t.Name.Local] = true
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+func (me soapActions) handleSOAP(action string, argsXML []byte, r *http.Request) ([]soapArg, error) {
+	a, ok := me[action]
+	if !ok {
+		return nil, upnp.InvalidActionError
+	}
+	return a.call(argsXML, r)
+}
+
+func (me soapActions) Handle(action string, argsXML []byte, r *http.Request) ([][2]string, error) {
+	args, err := me.handleSOAP(action, argsXML, r)
+	if err != nil {
+		return nil, err
+	}
+	return soapArgStrings(args)
+}
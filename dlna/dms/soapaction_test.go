@@ -0,0 +1,54 @@
+package dms
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestSOAPActions(t *testing.T) {
+	var got *browse
+	actions := soapActions{
+		"Browse": newSOAPAction(func(args *browse, r *http.Request) ([]soapArg, error) {
+			got = args
+			return []soapArg{{Name: "NumberReturned", Value: "0"}}, nil
+		}),
+	}
+	r := httptest.NewRequest("POST", "/ctl/ContentDir", nil)
+	const u = `<u:Browse xmlns:u="urn:schemas-upnp-org:service:ContentDirectory:1">`
+	for _, c := range []struct {
+		action, argsXML string
+		code            uint
+	}{
+		{"Browse", u + `<ObjectID>0</ObjectID><BrowseFlag>BrowseDirectChildren</BrowseFlag><StartingIndex>5</StartingIndex></u:Browse>`, 0},
+		{"Browse", u + `<ObjectID>0</ObjectID><BrowseFlag>BrowseMetadata</BrowseFlag><StartingIndex>five</StartingIndex></u:Browse>`, upnp.InvalidArgsErrorCode},
+		{"Browse", u + `<BrowseFlag>BrowseMetadata</BrowseFlag></u:Browse>`, upnp.InvalidArgsErrorCode},
+		{"Browse", ``, upnp.InvalidArgsErrorCode},
+		{"Destroy", u + `</u:Browse>`, upnp.InvalidActionErrorCode},
+	} {
+		got = nil
+		args, err := actions.handleSOAP(c.action, []byte(c.argsXML), r)
+		if err != nil {
+			if upnp.ConvertError(err).Code != c.code {
+				t.Errorf("%s %q: got %v", c.action, c.argsXML, err)
+			}
+		} else if c.code != 0 || len(args) != 1 || got.ObjectID != "0" || got.StartingIndex != 5 {
+			t.Errorf("%s %q: got %v, %+v", c.action, c.argsXML, args, got)
+		}
+	}
+}
+
+func TestWriteSOAPFault(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeSOAPFault(&b, upnp.Errorf(upnpav.NoSuchObjectErrorCode, `no "a&b"`)); err != nil {
+		t.Fatal(err)
+	}
+	want := soapEnvelopeStart + `<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>701</errorCode><errorDescription>no "a&amp;b"</errorDescription></UPnPError></detail></s:Fault>` + soapEnvelopeEnd
+	if b.String() != want {
+		t.Errorf("got %s", b.String())
+	}
+}
@@ -0,0 +1,76 @@
+package dms
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The most a client's SOAP dump grows to before it's rotated. The previous one is kept, so a client
+// takes up to twice this.
+const soapDumpFileSize = 4 << 20
+
+// Serializes writes to the SOAP dumps, and their rotation.
+type soapDumper struct {
+	mu sync.Mutex
+}
+
+// Returns the file the SOAP of the request's client is dumped to, or "" if it isn't dumped.
+func (srv *Server) soapDumpPath(r *http.Request) string {
+	s := srv.settings()
+	if s.SOAPDumpDir == "" {
+		return ""
+	}
+	ip := requestClientIP(r)
+	for _, c := range s.SOAPDumpClients {
+		if c == ip {
+			// Windows doesn't allow the colons of IPv6 addresses in names.
+			return filepath.Join(s.SOAPDumpDir, strings.Replace(ip, ":", "_", -1)+".log")
+		}
+	}
+	return ""
+}
+
+// Appends a SOAP request and its response to the dump at dumpPath, as they were on the wire,
+// rotating it first if it would grow too big.
+func (srv *Server) dumpSOAP(dumpPath string, r *http.Request, reqBody []byte, respHeader http.Header, code int, respBody []byte) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "=== %s %s\r\n", time.Now().Format(time.RFC3339Nano), r.RemoteAddr)
+	fmt.Fprintf(&buf, "%s %s %s\r\nHost: %s\r\n", r.Method, r.RequestURI, r.Proto, r.Host)
+	r.Header.Write(&buf)
+	fmt.Fprintf(&buf, "\r\n%s\r\n\r\n", reqBody)
+	fmt.Fprintf(&buf, "%s %d %s\r\n", r.Proto, code, http.StatusText(code))
+	respHeader.Write(&buf)
+	fmt.Fprintf(&buf, "\r\n%s\r\n\r\n", respBody)
+	me := &srv.soapDumper
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return appendRotated(dumpPath, buf.Bytes(), soapDumpFileSize)
+}
+
+// Appends b to the file at path, first renaming it with a .1 suffix, replacing any previous one,
+// if it would grow beyond size.
+func appendRotated(path string, b []byte, size int64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Size()+int64(len(b)) > size {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
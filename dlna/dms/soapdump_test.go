@@ -0,0 +1,40 @@
+package dms
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSOAPDump(t *testing.T) {
+	dir := t.TempDir()
+	srv := &Server{SOAPDumpClients: []string{"192.168.1.23"}, SOAPDumpDir: dir}
+	r := httptest.NewRequest("POST", "/ctl", nil)
+	r.RemoteAddr = "192.168.1.24:1234"
+	if p := srv.soapDumpPath(r); p != "" {
+		t.Fatalf("dumping other client to %q", p)
+	}
+	r.RemoteAddr = "192.168.1.23:1234"
+	p := srv.soapDumpPath(r)
+	if p != filepath.Join(dir, "192.168.1.23.log") {
+		t.Fatalf("dumping to %q", p)
+	}
+	big := strings.Repeat("x", soapDumpFileSize/2)
+	for i := 0; i < 3; i++ {
+		if err := srv.dumpSOAP(p, r, []byte(big), http.Header{}, 200, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{p, p + ".1"} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > soapDumpFileSize {
+			t.Fatalf("%s is %d bytes", name, fi.Size())
+		}
+	}
+}
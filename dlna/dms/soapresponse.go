@@ -0,0 +1,227 @@
+package dms
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/anacrolix/dms/upnp"
+)
+
+// An argument of a SOAP response. Its value is written by write as the response is, if it's set,
+// for values too large to build in memory first, such as the DIDL-Lite of Browse results.
+type soapArg struct {
+	Name  string
+	Value string
+	write func(w io.Writer) error
+}
+
+// Implemented by services that write the arguments of some responses as they're encoded, rather
+// than returning them from Handle, such as those with soapActions.
+type soapHandler interface {
+	handleSOAP(action string, argsXML []byte, r *http.Request) ([]soapArg, error)
+}
+
+func soapArgs(args [][2]string) []soapArg {
+	ret := make([]soapArg, 0, len(args))
+	for _, arg := range args {
+		ret = append(ret, soapArg{Name: arg[0], Value: arg[1]})
+	}
+	return ret
+}
+
+// Returns the arguments with the values of those that are written as they're encoded in full.
+func soapArgStrings(args []soapArg) ([][2]string, error) {
+	ret := make([][2]string, 0, len(args))
+	for _, arg := range args {
+		value := arg.Value
+		if arg.write != nil {
+			var b strings.Builder
+			if err := arg.write(&b); err != nil {
+				return nil, err
+			}
+			value = b.String()
+		}
+		ret = append(ret, [2]string{arg.Name, value})
+	}
+	return ret, nil
+}
+
+const (
+	soapEnvelopeStart = `<?xml version="1.0" encoding="utf-8" standalone="yes"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`
+	soapEnvelopeEnd   = `</s:Body></s:Envelope>`
+)
+
+// Writes the response to the action, in its envelope, with the values of the arguments written as
+// they're encoded.
+func writeSOAPResponse(w io.Writer, sa upnp.SoapAction, args []soapArg) error {
+	if _, err := fmt.Fprintf(w, `%s<u:%sResponse xmlns:u="%s">`, soapEnvelopeStart, sa.Action, sa.ServiceURN.String()); err != nil {
+		return err
+	}
+	for i, arg := range args {
+		sep := ""
+		if i != 0 {
+			sep = "\n"
+		}
+		if _, err := fmt.Fprintf(w, "%s<%s>", sep, arg.Name); err != nil {
+			return err
+		}
+		text := &xmlTextWriter{w: w}
+		var err error
+		if arg.write != nil {
+			err = arg.write(text)
+		} else {
+			_, err = io.WriteString(text, arg.Value)
+		}
+		if err == nil {
+			err = text.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "</%s>", arg.Name); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "</u:%sResponse>%s", sa.Action, soapEnvelopeEnd)
+	return err
+}
+
+// Writes the fault for a failed action, in its envelope, with the UPnP error in its detail as the
+// UPnP Device Architecture gives it.
+func writeSOAPFault(w io.Writer, upnpErr *upnp.Error) error {
+	if _, err := fmt.Fprintf(w, `%s<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>`, soapEnvelopeStart, upnpErr.Code); err != nil {
+		return err
+	}
+	text := &xmlTextWriter{w: w}
+	_, err := io.WriteString(text, upnpErr.Desc)
+	if err == nil {
+		err = text.Close()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "</errorDescription></UPnPError></detail></s:Fault>%s", soapEnvelopeEnd)
+	return err
+}
+
+// Escapes what's written through it as XML character data, as encoding/xml does, except for
+// double quotes: Samsung Frame TVs don't display an empty content directory unless they're left
+// as they are. Runes split between writes are escaped once they're whole.
+type xmlTextWriter struct {
+	w       io.Writer
+	partial []byte
+	buf     []byte
+}
+
+func (me *xmlTextWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(me.partial) != 0 {
+		p = append(me.partial, p...)
+		me.partial = nil
+	}
+	me.buf = me.buf[:0]
+	for len(p) > 0 {
+		if !utf8.FullRune(p) {
+			me.partial = append(me.partial, p...)
+			break
+		}
+		_, size := utf8.DecodeRune(p)
+		me.buf = appendXMLText(me.buf, p[:size])
+		p = p[size:]
+	}
+	if _, err := me.w.Write(me.buf); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Writes what's left of a rune split between writes, which never became whole.
+func (me *xmlTextWriter) Close() error {
+	if len(me.partial) == 0 {
+		return nil
+	}
+	me.partial = nil
+	_, err := io.WriteString(me.w, "\uFFFD")
+	return err
+}
+
+// Appends the rune encoded in raw, escaped.
+func appendXMLText(b []byte, raw []byte) []byte {
+	r, size := utf8.DecodeRune(raw)
+	switch {
+	case r == '&':
+		return append(b, "&amp;"...)
+	case r == '<':
+		return append(b, "&lt;"...)
+	case r == '>':
+		return append(b, "&gt;"...)
+	case r == '\'':
+		return append(b, "&#39;"...)
+	case r == '\t':
+		return append(b, "&#x9;"...)
+	case r == '\n':
+		return append(b, "&#xA;"...)
+	case r == '\r':
+		return append(b, "&#xD;"...)
+	case !isXMLChar(r) || r == utf8.RuneError && size == 1:
+		return append(b, "\uFFFD"...)
+	}
+	return append(b, raw...)
+}
+
+// Whether the rune may be in an XML document.
+func isXMLChar(r rune) bool {
+	return r == 0x09 || r == 0x0a || r == 0x0d ||
+		r >= 0x20 && r <= 0xd7ff ||
+		r >= 0xe000 && r <= 0xfffd ||
+		r >= 0x10000 && r <= 0x10ffff
+}
+
+// Replaces old with new in what's written through it, even where it's split between writes, by
+// holding back what might be the start of it until the next write, or Close. It writes what's
+// written as it is if old is empty.
+type replacingWriter struct {
+	w        io.Writer
+	old, new []byte
+	pending  []byte
+}
+
+func (me *replacingWriter) Write(p []byte) (int, error) {
+	if len(me.old) == 0 {
+		return me.w.Write(p)
+	}
+	me.pending = append(me.pending, p...)
+	var out []byte
+	for {
+		i := bytes.Index(me.pending, me.old)
+		if i < 0 {
+			break
+		}
+		out = append(out, me.pending[:i]...)
+		out = append(out, me.new...)
+		me.pending = me.pending[i+len(me.old):]
+	}
+	if keep := len(me.old) - 1; len(me.pending) > keep {
+		out = append(out, me.pending[:len(me.pending)-keep]...)
+		me.pending = append(me.pending[:0:0], me.pending[len(me.pending)-keep:]...)
+	}
+	if len(out) != 0 {
+		if _, err := me.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (me *replacingWriter) Close() error {
+	if len(me.pending) == 0 {
+		return nil
+	}
+	_, err := me.w.Write(me.pending)
+	me.pending = nil
+	return err
+}
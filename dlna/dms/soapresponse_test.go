@@ -0,0 +1,40 @@
+package dms
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/anacrolix/dms/upnp"
+)
+
+func TestWriteSOAPResponse(t *testing.T) {
+	const value = `<item title="Tom & Jerry's">東京 é` + "\t\x01\xff</item>"
+	sa, err := upnp.ParseActionHTTPHeader(`"urn:schemas-upnp-org:service:ContentDirectory:1#Browse"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var whole, streamed bytes.Buffer
+	if err := writeSOAPResponse(&whole, sa, []soapArg{{Name: "Result", Value: value}, {Name: "TotalMatches", Value: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Written a byte at a time, so that runes are split between writes.
+	write := func(w io.Writer) error {
+		for i := 0; i < len(value); i++ {
+			if _, err := w.Write([]byte{value[i]}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := writeSOAPResponse(&streamed, sa, []soapArg{{Name: "Result", write: write}, {Name: "TotalMatches", Value: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	want := soapEnvelopeStart + `<u:BrowseResponse xmlns:u="urn:schemas-upnp-org:service:ContentDirectory:1"><Result>&lt;item title="Tom &amp; Jerry&#39;s"&gt;東京 é&#x9;` + "\uFFFD\uFFFD" + `&lt;/item&gt;</Result>` + "\n" + `<TotalMatches>1</TotalMatches></u:BrowseResponse>` + soapEnvelopeEnd
+	if whole.String() != want {
+		t.Errorf("got %s", whole.String())
+	}
+	if streamed.String() != want {
+		t.Errorf("streamed %s", streamed.String())
+	}
+}
@@ -0,0 +1,120 @@
+package dms
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// The properties Browse and Search results can be sorted by, as given by GetSortCapabilities.
+const sortCapabilities = "dc:title,dc:date,upnp:class,upnp:artist,upnp:album,upnp:genre"
+
+// A property of the SortCriteria of a Browse or Search.
+type sortKey struct {
+	property   string
+	descending bool
+}
+
+// Parses the SortCriteria of a Browse or Search, such as "+upnp:class,-dc:date", returning
+// UnsupportedSortCriteriaErrorCode for properties that aren't in sortCapabilities. Properties
+// without a direction, which some clients send, are sorted in ascending order.
+func parseSortCriteria(s string) (ret []sortKey, err error) {
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		var key sortKey
+		switch field[0] {
+		case '-':
+			key.descending = true
+			fallthrough
+		case '+':
+			field = field[1:]
+		}
+		key.property = field
+		if !sortCapability(field) {
+			return nil, upnp.Errorf(upnpav.UnsupportedSortCriteriaErrorCode, "unsupported sort property %q", field)
+		}
+		ret = append(ret, key)
+	}
+	return
+}
+
+func sortCapability(property string) bool {
+	for _, c := range strings.Split(sortCapabilities, ",") {
+		if c == property {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the property of a upnpav.Item or upnpav.Container as it's compared in sorting by it,
+// which for text is its collation key.
+func sortValue(obj interface{}, property string, collationKey func(string) []byte) []byte {
+	var o *upnpav.Object
+	switch obj := obj.(type) {
+	case upnpav.Item:
+		o = &obj.Object
+	case upnpav.Container:
+		o = &obj.Object
+	default:
+		return nil
+	}
+	switch property {
+	case "dc:title":
+		return collationKey(o.Title)
+	case "dc:date":
+		return []byte(o.Date.UTC().Format("2006-01-02T15:04:05.000000000"))
+	case "upnp:class":
+		return []byte(o.Class)
+	case "upnp:artist":
+		return collationKey(o.Artist)
+	case "upnp:album":
+		return collationKey(o.Album)
+	case "upnp:genre":
+		return collationKey(o.Genre)
+	}
+	return nil
+}
+
+// Returns the objects sorted by the keys, in a new slice as they may be cached, or objs if there
+// are no keys. Objects that compare the same stay in the order they were in.
+func (me *Server) sortObjects(objs []interface{}, keys []sortKey) []interface{} {
+	if len(keys) == 0 {
+		return objs
+	}
+	c := me.collator()
+	values := make([][][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = make([][]byte, len(objs))
+		for j, obj := range objs {
+			values[i][j] = sortValue(obj, key.property, func(s string) []byte {
+				return collationKeys(c, []string{s})[0]
+			})
+		}
+	}
+	order := make([]int, len(objs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		for k, key := range keys {
+			c := bytes.Compare(values[k][order[i]], values[k][order[j]])
+			if c == 0 {
+				continue
+			}
+			return c < 0 != key.descending
+		}
+		return false
+	})
+	ret := make([]interface{}, len(objs))
+	for i, j := range order {
+		ret[i] = objs[j]
+	}
+	return ret
+}
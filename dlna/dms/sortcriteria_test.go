@@ -0,0 +1,64 @@
+package dms
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestParseSortCriteria(t *testing.T) {
+	keys, err := parseSortCriteria("+upnp:class, -dc:date,dc:title")
+	if err != nil || len(keys) != 3 || keys[0] != (sortKey{"upnp:class", false}) || keys[1] != (sortKey{"dc:date", true}) || keys[2] != (sortKey{"dc:title", false}) {
+		t.Errorf("got %v, %v", keys, err)
+	}
+	if keys, err := parseSortCriteria(""); err != nil || keys != nil {
+		t.Errorf("got %v, %v", keys, err)
+	}
+	if _, err := parseSortCriteria("+dc:title,+upnp:rating"); upnp.ConvertError(err).Code != upnpav.UnsupportedSortCriteriaErrorCode {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSortObjects(t *testing.T) {
+	day := func(d int) upnpav.Timestamp {
+		return upnpav.Timestamp{Time: time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC)}
+	}
+	objs := []interface{}{
+		upnpav.Container{Object: upnpav.Object{Title: "Zebra", Class: "object.container", Date: day(1)}},
+		upnpav.Item{Object: upnpav.Object{Title: "éclair", Class: "object.item", Date: day(3)}},
+		upnpav.Item{Object: upnpav.Object{Title: "Apple", Class: "object.item", Date: day(2)}},
+		upnpav.Item{Object: upnpav.Object{Title: "banana", Class: "object.item", Date: day(3)}},
+	}
+	srv := &Server{}
+	title := func(objs []interface{}) (ret []string) {
+		for _, obj := range objs {
+			switch obj := obj.(type) {
+			case upnpav.Item:
+				ret = append(ret, obj.Title)
+			case upnpav.Container:
+				ret = append(ret, obj.Title)
+			}
+		}
+		return
+	}
+	for criteria, want := range map[string]string{
+		"+dc:title":             "[Apple banana éclair Zebra]",
+		"-dc:date,+dc:title":    "[banana éclair Apple Zebra]",
+		"-upnp:class":           "[éclair Apple banana Zebra]",
+		"+upnp:class,-dc:title": "[Zebra éclair banana Apple]",
+	} {
+		keys, err := parseSortCriteria(criteria)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(title(srv.sortObjects(objs, keys))); got != want {
+			t.Errorf("%s: got %s", criteria, got)
+		}
+	}
+	if title(objs)[0] != "Zebra" {
+		t.Error("objects sorted in place")
+	}
+}
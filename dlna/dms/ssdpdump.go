@@ -0,0 +1,59 @@
+package dms
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+)
+
+// The most the SSDP dump grows to before it's rotated, keeping the previous one.
+const ssdpDumpFileSize = 4 << 20
+
+// An SSDP message received or sent, as a line of the SSDP dump.
+type ssdpDumpEntry struct {
+	Time      time.Time `json:"time"`
+	Interface string    `json:"interface"`
+	// "received" or "sent".
+	Direction string `json:"direction"`
+	// The address the message is from if it was received, otherwise the one it was sent to.
+	Addr    string `json:"addr"`
+	Message string `json:"message"`
+}
+
+// Serializes writes to the SSDP dump, and its rotation.
+type ssdpDumper struct {
+	mu sync.Mutex
+}
+
+func (srv *Server) ssdpDumpPath() string {
+	return srv.settings().SSDPDumpPath
+}
+
+// Appends an SSDP message received or sent on the interface to SSDPDumpPath, if there is one.
+func (srv *Server) dumpSSDP(ifName string, sent bool, msg []byte, addr *net.UDPAddr) {
+	dumpPath := srv.ssdpDumpPath()
+	if dumpPath == "" {
+		return
+	}
+	e := ssdpDumpEntry{
+		Time:      time.Now(),
+		Interface: ifName,
+		Direction: "received",
+		Addr:      addr.String(),
+		Message:   string(msg),
+	}
+	if sent {
+		e.Direction = "sent"
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	me := &srv.ssdpDumper
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if err := appendRotated(dumpPath, append(b, '\n'), ssdpDumpFileSize); err != nil {
+		srv.Logger.Printf("error dumping SSDP: %v", err)
+	}
+}
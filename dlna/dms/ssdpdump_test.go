@@ -0,0 +1,44 @@
+package dms
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSSDPDump(t *testing.T) {
+	srv := &Server{}
+	addr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 23), Port: 1900}
+	// Nothing is dumped without a path.
+	srv.dumpSSDP("eth0", false, []byte("M-SEARCH * HTTP/1.1\r\n\r\n"), addr)
+	p := filepath.Join(t.TempDir(), "ssdp.log")
+	srv.SSDPDumpPath = p
+	srv.dumpSSDP("eth0", false, []byte("M-SEARCH * HTTP/1.1\r\n\r\n"), addr)
+	srv.dumpSSDP("eth0", true, []byte("HTTP/1.1 200 OK\r\n\r\n"), addr)
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []ssdpDumpEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e ssdpDumpEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d entries", len(got))
+	}
+	if e := got[0]; e.Direction != "received" || e.Interface != "eth0" || e.Addr != "192.168.1.23:1900" || e.Message != "M-SEARCH * HTTP/1.1\r\n\r\n" {
+		t.Fatalf("got %+v", e)
+	}
+	if e := got[1]; e.Direction != "sent" || e.Time.Before(got[0].Time) {
+		t.Fatalf("got %+v", e)
+	}
+}
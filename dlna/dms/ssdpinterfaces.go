@@ -0,0 +1,235 @@
+package dms
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/ssdp"
+)
+
+const (
+	// How often the interfaces are looked at for SSDP servers to start or stop, besides when
+	// netlink says they've changed.
+	ssdpInterfacePollInterval = 10 * time.Second
+	// How long an SSDP server that stopped by itself, or couldn't start, is left before it's tried
+	// again, unless its interface's addresses change.
+	ssdpRetryInterval = 5 * time.Minute
+	// How long changes to the interfaces are let settle, such as Wi-Fi coming up and then getting
+	// its addresses, before they're acted on.
+	ssdpInterfaceSettleDelay = time.Second
+)
+
+// Identifies the SSDP server on an interface for an address family.
+type ssdpKey struct {
+	name string
+	ipv6 bool
+}
+
+// An interface SSDP should be running on, as it is now.
+type ssdpTarget struct {
+	if_ net.Interface
+	// Its addresses, so that its server is restarted when they change.
+	addrs string
+}
+
+// An SSDP server started on an interface.
+type ssdpRunner struct {
+	addrs string
+	stop  chan struct{}
+	done  chan struct{}
+	// When it was seen to have stopped by itself.
+	ended time.Time
+}
+
+func (me *ssdpRunner) close() {
+	close(me.stop)
+	<-me.done
+}
+
+// Returns the addresses of the interface as a string to compare.
+func interfaceAddrsKey(if_ net.Interface) (string, error) {
+	addrs, err := if_.Addrs()
+	if err != nil {
+		return "", err
+	}
+	ss := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		ss = append(ss, a.String())
+	}
+	sort.Strings(ss)
+	return strings.Join(ss, " "), nil
+}
+
+// Checks the patterns of SSDPAllowInterfaces.
+func (srv *Server) initSSDPAllowInterfaces() error {
+	for _, pattern := range srv.SSDPAllowInterfaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad SSDP interface pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Reports whether to announce on the interface, as its flags are now. Announcements on loopback
+// and tunnels such as tun0 don't reach control points, and with SSDPSkipVirtual, those on Docker's
+// and VMs' bridges, which would tell containers about media, are skipped too. SSDPAllowInterfaces
+// overrides all but the interface being up.
+func (me *Server) ssdpEligible(if_ net.Interface) bool {
+	if if_.Flags&net.FlagUp == 0 {
+		return false
+	}
+	s := me.settings()
+	allow, skipVirtual := s.SSDPAllowInterfaces, s.SSDPSkipVirtual
+	for _, pattern := range allow {
+		if ok, _ := path.Match(pattern, if_.Name); ok {
+			return true
+		}
+	}
+	if if_.Flags&net.FlagMulticast == 0 || if_.Flags&(net.FlagLoopback|net.FlagPointToPoint) != 0 {
+		return false
+	}
+	return !skipVirtual || !isVirtualInterface(if_.Name)
+}
+
+// Returns the SSDP servers there should be: on each of the Interfaces that's eligible and that the
+// HTTP listener can be reached at, for each family it serves. The interfaces are looked up again by
+// name, as they may have gone and come back since they were chosen, such as Wi-Fi.
+func (me *Server) ssdpTargets() map[ssdpKey]ssdpTarget {
+	ret := make(map[ssdpKey]ssdpTarget)
+	for _, chosen := range me.Interfaces {
+		if_, err := net.InterfaceByName(chosen.Name)
+		if err != nil || !me.ssdpEligible(*if_) || !me.httpServesInterface(*if_) {
+			continue
+		}
+		addrs, err := interfaceAddrsKey(*if_)
+		if err != nil {
+			continue
+		}
+		for _, ipv6 := range []bool{false, true} {
+			if !me.httpServesFamily(ipv6) {
+				continue
+			}
+			// Unlike IPv4, IPv6 won't send multicast over interfaces that don't claim to support
+			// it, such as loopback on Linux, even if they're allowed.
+			if ipv6 && if_.Flags&net.FlagMulticast == 0 {
+				continue
+			}
+			ret[ssdpKey{if_.Name, ipv6}] = ssdpTarget{*if_, addrs}
+		}
+	}
+	return ret
+}
+
+// Stops the SSDP servers of interfaces that have gone down or whose addresses have changed, and
+// starts those that are missing, which includes those that are restarted.
+func (me *Server) updateSSDPServers(running map[ssdpKey]*ssdpRunner, now time.Time) {
+	targets := me.ssdpTargets()
+	// The names of the interfaces whose servers were stopped because their addresses changed.
+	readdressed := make(map[string]bool)
+	for key, r := range running {
+		if t, ok := targets[key]; !ok || t.addrs != r.addrs {
+			// Closing sends ssdp:byebye, so control points drop the old LOCATION rather than
+			// waiting for it to expire.
+			r.close()
+			delete(running, key)
+			if ok {
+				readdressed[key.name] = true
+			}
+			continue
+		}
+		select {
+		case <-r.done:
+			if r.ended.IsZero() {
+				r.ended = now
+			}
+			if now.Sub(r.ended) >= ssdpRetryInterval {
+				delete(running, key)
+			}
+		default:
+		}
+	}
+	if len(readdressed) != 0 {
+		me.ssdpReaddressed(readdressed)
+	}
+	for key, t := range targets {
+		if _, ok := running[key]; ok {
+			continue
+		}
+		r := &ssdpRunner{
+			addrs: t.addrs,
+			stop:  make(chan struct{}),
+			done:  make(chan struct{}),
+		}
+		go func(if_ net.Interface, ipv6 bool) {
+			defer close(r.done)
+			me.ssdpInterface(if_, ipv6, r.stop)
+		}(t.if_, key.ipv6)
+		running[key] = r
+	}
+}
+
+// Moves to the next boot ID after interfaces' addresses have changed, as UPnP 1.1 requires, so
+// control points know the LOCATIONs announced before are gone. The servers on the other interfaces
+// send ssdp:update to move to it, and those restarted on the interfaces announce their new
+// LOCATIONs with it as soon as they start.
+func (me *Server) ssdpReaddressed(interfaces map[string]bool) {
+	me.mu.Lock()
+	me.bootID++
+	configID := me.configID
+	ssdpServers := make([]*ssdp.Server, 0, len(me.ssdpServers))
+	for s := range me.ssdpServers {
+		ssdpServers = append(ssdpServers, s)
+	}
+	me.mu.Unlock()
+	names := make([]string, 0, len(interfaces))
+	for name := range interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	me.Logger.Levelf(log.Info, "addresses of %s changed, announcing the new locations", strings.Join(names, ", "))
+	for _, s := range ssdpServers {
+		if err := s.Update(configID); err != nil {
+			me.Logger.Printf("error sending ssdp:update on %q: %v", s.Interface.Name, err)
+		}
+	}
+}
+
+// Runs SSDP on the interfaces until the server is closed, starting and stopping it as they come
+// and go.
+func (me *Server) doSSDP() {
+	changed, stopWatching := watchInterfaces()
+	defer stopWatching()
+	running := make(map[ssdpKey]*ssdpRunner)
+	defer func() {
+		for _, r := range running {
+			r.close()
+		}
+	}()
+	ticker := time.NewTicker(ssdpInterfacePollInterval)
+	defer ticker.Stop()
+	for {
+		me.updateSSDPServers(running, time.Now())
+		select {
+		case <-me.closed:
+			return
+		case <-ticker.C:
+		case <-changed:
+			select {
+			case <-me.closed:
+				return
+			case <-time.After(ssdpInterfaceSettleDelay):
+			}
+			// What changed while settling is seen now.
+			select {
+			case <-changed:
+			default:
+			}
+		}
+	}
+}
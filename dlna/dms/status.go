@@ -0,0 +1,320 @@
+package dms
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// A media stream being served, for the status page.
+type activeStream struct {
+	clientLogTag
+	// Identifies the stream to the API, such as to stop it.
+	ID        string
+	UserAgent string
+	// The object path requested.
+	Path    string
+	Started time.Time
+	// The transcode being streamed, if any.
+	transcode atomic.Value
+	// Sent so far. atomic.Int64 is aligned for atomic access on 32-bit platforms too.
+	bytes atomic.Int64
+	// Set when the stream is to be stopped.
+	stopped int32
+}
+
+func (me *activeStream) Transcode() string {
+	s, _ := me.transcode.Load().(string)
+	return s
+}
+
+func (me *activeStream) Bytes() int64 {
+	return me.bytes.Load()
+}
+
+// Makes further writes of the stream fail, so that its handler gives up.
+func (me *activeStream) stop() {
+	atomic.StoreInt32(&me.stopped, 1)
+}
+
+func (me *activeStream) isStopped() bool {
+	return atomic.LoadInt32(&me.stopped) != 0
+}
+
+type activeStreamKey struct{}
+
+// The media streams currently being served.
+type activeStreams struct {
+	mu sync.Mutex
+	m  map[*activeStream]struct{}
+}
+
+func (me *activeStreams) add(s *activeStream) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.m == nil {
+		me.m = make(map[*activeStream]struct{})
+	}
+	me.m[s] = struct{}{}
+}
+
+func (me *activeStreams) remove(s *activeStream) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	delete(me.m, s)
+}
+
+// Stops the stream with the ID, returning false if there's none.
+func (me *activeStreams) stop(id string) bool {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for s := range me.m {
+		if s.ID == id {
+			s.stop()
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the streams, oldest first.
+func (me *activeStreams) list() (ret []*activeStream) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for s := range me.m {
+		ret = append(ret, s)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Started.Before(ret[j].Started)
+	})
+	return
+}
+
+// Wraps a handler that serves media, to track the streams and the bytes served.
+func (me *Server) streamHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			h(w, r)
+			return
+		}
+		if !me.streamLimiter.start(r.Context(), me.maxStreams(), streamQueueTimeout) {
+			if r.Context().Err() == nil {
+				w.Header().Set("Retry-After", streamRetryAfterHeader)
+				me.resourceError(w, r, resourceBusy, fmt.Errorf("more than %d streams", me.maxStreams()))
+			}
+			return
+		}
+		defer me.streamLimiter.end()
+		var id [4]byte
+		rand.Read(id[:])
+		s := &activeStream{
+			ID:        hex.EncodeToString(id[:]),
+			UserAgent: r.UserAgent(),
+			Path:      r.URL.Query().Get("path"),
+			Started:   time.Now(),
+		}
+		s.IP = requestClientIP(r)
+		s.Session = requestSession(r)
+		me.streams.add(s)
+		defer me.streams.remove(s)
+		hookData := func() map[string]string {
+			return map[string]string{
+				"STREAM_ID":  s.ID,
+				"CLIENT_IP":  s.IP,
+				"USER_AGENT": s.UserAgent,
+				"SESSION":    s.Session,
+				"PATH":       s.Path,
+			}
+		}
+		me.runHooks(HookStreamStart, hookData())
+		me.notePlayed(s.Path)
+		defer func() {
+			data := hookData()
+			data["TRANSCODE"] = s.Transcode()
+			data["BYTES"] = strconv.FormatInt(s.Bytes(), 10)
+			data["DURATION"] = strconv.FormatFloat(time.Since(s.Started).Seconds(), 'f', 0, 64)
+			me.runHooks(HookStreamStop, data)
+		}()
+		me.metrics.activeStreams.Inc()
+		defer me.metrics.activeStreams.Dec()
+		r = r.WithContext(context.WithValue(r.Context(), activeStreamKey{}, s))
+		h(&countingResponseWriter{me.throttleStream(w, r), me.metrics.streamedBytes, s}, r)
+		me.noteStreamPosition(r, s)
+	}
+}
+
+// Marks a transcode session as running for the request until the returned func is called.
+func (me *Server) transcodeStarted(r *http.Request, name string) (finished func()) {
+	if s, ok := r.Context().Value(activeStreamKey{}).(*activeStream); ok {
+		s.transcode.Store(name)
+	}
+	return me.metrics.transcodeStarted(name)
+}
+
+type statusInterface struct {
+	Name  string
+	Addrs []string
+	// Whether SSDP is running on the interface.
+	SSDP bool
+}
+
+// Returns the interfaces the server was given, and whether it's advertising on them.
+func (me *Server) statusInterfaces() (ret []statusInterface) {
+	me.mu.RLock()
+	advertised := make(map[string]bool, len(me.ssdpServers))
+	for s := range me.ssdpServers {
+		advertised[s.Interface.Name] = true
+	}
+	me.mu.RUnlock()
+	for _, if_ := range me.Interfaces {
+		si := statusInterface{
+			Name: if_.Name,
+			SSDP: advertised[if_.Name],
+		}
+		addrs, _ := if_.Addrs()
+		for _, a := range addrs {
+			si.Addrs = append(si.Addrs, a.String())
+		}
+		ret = append(ret, si)
+	}
+	return
+}
+
+func (me *Server) serveStatus(w http.ResponseWriter, r *http.Request) {
+	friendlyName := me.settings().FriendlyName
+	now := time.Now()
+	w.Header().Set("content-type", "text/html")
+	err := statusTmpl.Execute(w, struct {
+		FriendlyName string
+		UUID         string
+		Version      string
+		NewRelease   string
+		ReleasesURL  string
+		HTTPAddr     string
+		Started      time.Time
+		Interfaces   []statusInterface
+		Clients      []clientSession
+		Devices      []device
+		Streams      []*activeStream
+		Disks        []diskStatus
+		Warnings     []string
+		Problems     []problemFile
+	}{
+		FriendlyName: friendlyName,
+		UUID:         me.rootDeviceUUID,
+		Version:      Version(),
+		NewRelease:   me.updates.get(),
+		ReleasesURL:  releasesPageURL,
+		HTTPAddr:     me.HTTPConn.Addr().String(),
+		Started:      startTime,
+		Interfaces:   me.statusInterfaces(),
+		Clients:      me.sessions.recent(now),
+		Devices:      me.listDevices(now),
+		Streams:      me.streams.list(),
+		Disks:        me.disks.list(),
+		Warnings:     append(me.diskWarnings(), me.fsWarnings()...),
+		Problems:     me.problems.list(me.contentFS()),
+	})
+	if err != nil {
+		me.Logger.Print(err)
+	}
+}
+
+// Returns the host for links to the DLNA listener, which the web UI may not have been reached
+// through.
+func (me *Server) dlnaHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(me.httpPort()))
+}
+
+// Shows the ContentDirectory as a renderer would see it.
+func (me *Server) serveBrowse(w http.ResponseWriter, r *http.Request) {
+	cds := me.services["ContentDirectory"].(*contentDirectoryService)
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		id = "0"
+	}
+	prefs := me.requestClientPrefs(r)
+	o, err := cds.objectFromID(id)
+	if err == nil && !prefs.allowed(o.Path) {
+		err = errors.New("not in the containers the client may browse")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	objs, err := cds.directChildren(o, me.dlnaHost(r), r.UserAgent())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	books := me.requestAudiobooks(r)
+	objs = cds.clientAudiobookItems(o, objs, books, me.dlnaHost(r))
+	data := struct {
+		Path       string
+		ParentID   string
+		Containers []upnpav.Container
+		Items      []upnpav.Item
+		// What items can be played on.
+		Renderers []apiRenderer
+		Playing   string
+		Error     error
+	}{
+		Path:      o.Path,
+		Renderers: me.playToRenderers(),
+	}
+	go me.searchRenderers()
+	if r.Method == "POST" {
+		if !me.authorizeAPI(w, r, APIScopePlayback) {
+			return
+		}
+		var name string
+		item, err := cds.objectFromID(r.FormValue("item"))
+		if err == nil && !prefs.allowed(item.Path) {
+			err = errors.New("not in the containers the client may browse")
+		}
+		if err == nil {
+			ctx, cancel := context.WithTimeout(r.Context(), playToTimeout)
+			name, err = me.playTo(ctx, r.FormValue("renderer"), item)
+			cancel()
+		}
+		if err != nil {
+			data.Error = err
+		} else {
+			data.Playing = fmt.Sprintf("%s on %s", path.Base(item.Path), name)
+			me.requestLogger(r).Levelf(log.Info, "playing %q on %q", item.Path, name)
+		}
+	}
+	if !o.IsRoot() {
+		data.ParentID = o.ParentID()
+	}
+	for _, obj := range prefs.visible(objs) {
+		switch obj := me.externalURLs(books.arrange(obj), r.UserAgent()).(type) {
+		case upnpav.Container:
+			data.Containers = append(data.Containers, obj)
+		case upnpav.Item:
+			data.Items = append(data.Items, obj)
+		}
+	}
+	w.Header().Set("content-type", "text/html")
+	if err := browseTmpl.Execute(w, data); err != nil {
+		me.Logger.Print(err)
+	}
+}
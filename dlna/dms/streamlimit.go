@@ -0,0 +1,109 @@
+package dms
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a stream beyond MaxStreams waits for another to end, before it's refused.
+	streamQueueTimeout = 5 * time.Second
+	// When refused streams are told to try again.
+	streamRetryAfter = 10 * time.Second
+	// How long a connection may be kept open between requests.
+	httpIdleTimeout = 2 * time.Minute
+	// How long a client has to send the headers of a request.
+	httpReadHeaderTimeout = 30 * time.Second
+	// How long a write to a client may block before the connection is closed, such as when a
+	// renderer stops reading a stream without closing it.
+	httpStalledWriteTimeout = 5 * time.Minute
+)
+
+// Counts the streams being served, for MaxStreams.
+type streamLimiter struct {
+	mu     sync.Mutex
+	active int
+	// Closed and replaced when a stream ends, to wake those waiting.
+	ended chan struct{}
+}
+
+// Waits until fewer than max streams are being served, and counts another. It's false if none
+// ended in time. A max of 0 is no limit.
+func (me *streamLimiter) start(ctx context.Context, max int, timeout time.Duration) bool {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		me.mu.Lock()
+		if max <= 0 || me.active < max {
+			me.active++
+			me.mu.Unlock()
+			return true
+		}
+		if me.ended == nil {
+			me.ended = make(chan struct{})
+		}
+		ended := me.ended
+		me.mu.Unlock()
+		select {
+		case <-ended:
+		case <-t.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (me *streamLimiter) end() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.active--
+	if me.ended != nil {
+		close(me.ended)
+		me.ended = nil
+	}
+}
+
+func (srv *Server) maxStreams() int {
+	return srv.settings().MaxStreams
+}
+
+// The value of Retry-After for refused streams.
+var streamRetryAfterHeader = strconv.Itoa(int(streamRetryAfter / time.Second))
+
+// Accepts connections that are closed when a write to them blocks for too long.
+type stalledWriteListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (me stalledWriteListener) Accept() (net.Conn, error) {
+	c, err := me.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return stalledWriteConn{c, me.timeout}, nil
+}
+
+type stalledWriteConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (me stalledWriteConn) Write(b []byte) (int, error) {
+	me.Conn.SetWriteDeadline(time.Now().Add(me.timeout))
+	return me.Conn.Write(b)
+}
+
+// Passes files on to the connection's ReadFrom, which sends them with sendfile, extending the
+// deadline for each chunk.
+func (me stalledWriteConn) ReadFrom(src io.Reader) (int64, error) {
+	me.Conn.SetWriteDeadline(time.Now().Add(me.timeout))
+	return copyInChunks(me.Conn, src, func(int64) error {
+		return me.Conn.SetWriteDeadline(time.Now().Add(me.timeout))
+	})
+}
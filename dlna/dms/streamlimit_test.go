@@ -0,0 +1,112 @@
+package dms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStreamLimiter(t *testing.T) {
+	var sl streamLimiter
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if !sl.start(ctx, 2, 0) {
+			t.Fatalf("stream %d refused", i)
+		}
+	}
+	if sl.start(ctx, 2, 10*time.Millisecond) {
+		t.Fatal("third stream started")
+	}
+	// One waiting starts when another ends.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sl.end()
+	}()
+	if !sl.start(ctx, 2, time.Second) {
+		t.Fatal("waiting stream refused")
+	}
+	if !sl.start(ctx, 0, 0) {
+		t.Fatal("refused without a limit")
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if sl.start(cancelled, 3, time.Second) {
+		t.Fatal("started with its context cancelled")
+	}
+}
+
+func TestStalledWriteConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l = stalledWriteListener{l, 50 * time.Millisecond}
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client never reads, so writes block once the buffers are full.
+	defer client.Close()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	done := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1<<16)
+		for {
+			if _, err := c.Write(b); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("got %v, want the deadline exceeded", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stalled write wasn't timed out")
+	}
+}
+
+// A connection that records what's sent through its own ReadFrom, and its write deadlines.
+type readFromConn struct {
+	net.Conn
+	readFrom  bytes.Buffer
+	deadlines int
+}
+
+func (me *readFromConn) ReadFrom(r io.Reader) (int64, error) {
+	return me.readFrom.ReadFrom(r)
+}
+
+func (me *readFromConn) SetWriteDeadline(time.Time) error {
+	me.deadlines++
+	return nil
+}
+
+func TestStalledWriteConnReadFrom(t *testing.T) {
+	rc := &readFromConn{}
+	c := stalledWriteConn{rc, time.Minute}
+	data := bytes.Repeat([]byte("x"), 2*readFromChunkSize+1)
+	n, err := c.ReadFrom(bytes.NewReader(data))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	if !bytes.Equal(rc.readFrom.Bytes(), data) {
+		t.Fatal("not sent through the connection's ReadFrom")
+	}
+	// Once before, and after each of the three chunks.
+	if rc.deadlines != 4 {
+		t.Fatalf("deadline set %d times, want 4", rc.deadlines)
+	}
+}
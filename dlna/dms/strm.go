@@ -0,0 +1,202 @@
+package dms
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/anacrolix/dms/dlna"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+// Extensions of files holding the URL of remote media: Kodi's .strm, and Windows Internet
+// shortcuts.
+const (
+	strmSuffix        = ".strm"
+	urlShortcutSuffix = ".url"
+)
+
+// Used for remote media whose URL doesn't give it away.
+const defaultStreamMimeType mimeType = "video/mpeg"
+
+func isStreamURLFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case strmSuffix, urlShortcutSuffix:
+		return true
+	}
+	return false
+}
+
+// Reads the URL from a .strm or .url file. It's read afresh for every request, so that the file can
+// be updated as the remote URL changes.
+func readStreamURL(fsys FS, filePath string) (*url.URL, error) {
+	f, err := fsys.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	shortcut := strings.EqualFold(filepath.Ext(filePath), urlShortcutSuffix)
+	s := bufio.NewScanner(io.LimitReader(f, 64<<10))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if shortcut {
+			// [InternetShortcut]
+			// URL=http://...
+			if len(line) < 4 || !strings.EqualFold(line[:4], "URL=") {
+				continue
+			}
+			line = line[4:]
+		} else if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return parseStreamURL(line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no URL")
+}
+
+// Parses the URL of remote media, which must be http or https.
+func parseStreamURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	// Kodi also allows plugin:// and local paths, which mean nothing to renderers, and shouldn't
+	// be fetched on their behalf.
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	return u, nil
+}
+
+// Returns the MIME type of the remote media, going by the URL's extension.
+func streamURLMimeType(u *url.URL) mimeType {
+	if mt := mimeTypeByBaseName(path.Base(u.Path)); mt.IsVideo() || mt.IsAudio() {
+		return mt
+	}
+	return defaultStreamMimeType
+}
+
+func (me *contentDirectoryService) streamURLFileToUpnpavObject(cdsObject object, fileInfo os.FileInfo, host string) (ret interface{}, err error) {
+	u, err := readStreamURL(me.contentFS(), cdsObject.FilePath())
+	if err != nil {
+		me.Logger.Printf("%s ignored: %v", cdsObject.FilePath(), err)
+		return nil, nil
+	}
+	mimeType := streamURLMimeType(u)
+	if cdsObject.root != nil && !cdsObject.root.allowsMediaType(mimeType.Type()) {
+		return
+	}
+	return upnpav.Item{
+		Object: upnpav.Object{
+			ID:         cdsObject.ID(),
+			Restricted: 1,
+			ParentID:   cdsObject.ParentID(),
+			Class:      "object.item." + mimeType.Type() + "Item",
+			Title:      strings.TrimSuffix(fileInfo.Name(), filepath.Ext(fileInfo.Name())),
+		},
+		Res: []upnpav.Resource{{
+			URL: (&url.URL{
+				Scheme: "http",
+				Host:   host,
+				Path:   resPath,
+				RawQuery: url.Values{
+					"path": {cdsObject.Path},
+				}.Encode(),
+			}).String(),
+			// Whether the remote end supports ranges isn't known until it's requested.
+			ProtocolInfo: fmt.Sprintf("http-get:*:%s:%s", mimeType, dlna.ContentFeatures{}.String()),
+		}},
+	}, nil
+}
+
+// Whether to fetch remote media for the renderer with the User-Agent, rather than redirecting it
+// or giving it the URL, going by StrmProxyUserAgents.
+func (me *Server) proxyStreamURL(userAgent string) bool {
+	return matchUserAgent(me.settings().StrmProxyUserAgents, userAgent)
+}
+
+// Whether the User-Agent contains any of the substrings in userAgents, or they include "*".
+func matchUserAgent(userAgents []string, userAgent string) bool {
+	for _, ua := range userAgents {
+		if ua == "*" || ua != "" && strings.Contains(userAgent, ua) {
+			return true
+		}
+	}
+	return false
+}
+
+// Headers of the remote response passed on to the renderer when proxying.
+var proxiedStreamHeaders = []string{
+	"Accept-Ranges",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"Last-Modified",
+	"ETag",
+}
+
+// Serves the remote media a .strm or .url file points to, by redirecting the renderer to it, or
+// for renderers that don't follow redirects, proxying it.
+func (me *Server) serveStreamURL(w http.ResponseWriter, r *http.Request, filePath string) {
+	u, err := readStreamURL(me.contentFS(), filePath)
+	if err != nil {
+		me.resourceError(w, r, resourceInternalError, err)
+		return
+	}
+	me.serveRemoteMedia(w, r, u, me.proxyStreamURL(r.UserAgent()))
+}
+
+// Fetches remote media for renderers. Redirects are followed only to http and https URLs, as
+// .strm files are limited to.
+var remoteMediaClient = newRemoteClient(func(u *url.URL) error {
+	_, err := parseStreamURL(u.String())
+	return err
+})
+
+// Redirects the renderer to the remote media at u, or if proxy is set, fetches it for the
+// renderer.
+func (me *Server) serveRemoteMedia(w http.ResponseWriter, r *http.Request, u *url.URL, proxy bool) {
+	if !proxy {
+		http.Redirect(w, r, u.String(), http.StatusFound)
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, r.Method, u.String(), nil)
+	if err != nil {
+		me.resourceError(w, r, resourceInternalError, err)
+		return
+	}
+	if rng := r.Header.Get("Range"); rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	resp, err := remoteMediaClient.Do(req)
+	if err != nil {
+		me.resourceError(w, r, resourceUpstreamFailed, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		me.resourceError(w, r, resourceUpstreamFailed, fmt.Errorf("remote responded %s", resp.Status))
+		return
+	}
+	for _, k := range proxiedStreamHeaders {
+		if v := resp.Header.Get(k); v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+	w.Header().Set(dlna.TransferModeDomain, "Streaming")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, stallTimeoutReader{resp.Body, cancel})
+}
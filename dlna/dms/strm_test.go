@@ -0,0 +1,37 @@
+package dms
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadStreamURL(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name, content, want string
+	}{
+		{"a.strm", "# a comment\n\nhttp://example.com/a.mkv\n", "http://example.com/a.mkv"},
+		{"b.url", "[InternetShortcut]\r\nIconIndex=0\r\nURL=https://example.com/b.mp3\r\n", "https://example.com/b.mp3"},
+		{"c.strm", "plugin://plugin.video.foo/?play=1\n", ""},
+		{"d.strm", "/mnt/media/d.mkv\n", ""},
+		{"e.url", "[InternetShortcut]\r\n", ""},
+	} {
+		filePath := filepath.Join(dir, tc.name)
+		if err := os.WriteFile(filePath, []byte(tc.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		u, err := readStreamURL(osFS{}, filePath)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: got %s, want error", tc.name, u)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if u.String() != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, u, tc.want)
+		}
+	}
+}
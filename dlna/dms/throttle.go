@@ -0,0 +1,139 @@
+package dms
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How many writes a second a throttled response is split into, so that it arrives at a steady
+// rate rather than in bursts.
+const throttleWritesPerSecond = 10
+
+// Lets bytes through at a rate, with a burst of what's let through in one write of a throttled
+// response. It starts empty, so a response doesn't start with a burst.
+type tokenBucket struct {
+	mu             sync.Mutex
+	bytesPerSecond float64
+	tokens         float64
+	last           time.Time
+}
+
+func newTokenBucket(kbps int) *tokenBucket {
+	me := &tokenBucket{}
+	me.setRate(kbps)
+	return me
+}
+
+func (me *tokenBucket) setRate(kbps int) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.bytesPerSecond = float64(kbps) * 1000 / 8
+}
+
+// The most that's let through at once.
+func (me *tokenBucket) burst() int {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if b := int(me.bytesPerSecond / throttleWritesPerSecond); b > 1 {
+		return b
+	}
+	return 1
+}
+
+// Takes n bytes from the bucket, returning how long to wait before sending them. Bytes taken
+// while others wait are let through after them.
+func (me *tokenBucket) take(n int, now time.Time) time.Duration {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.last.IsZero() {
+		me.last = now
+	}
+	me.tokens += now.Sub(me.last).Seconds() * me.bytesPerSecond
+	me.last = now
+	if burst := me.bytesPerSecond / throttleWritesPerSecond; me.tokens > burst {
+		me.tokens = burst
+	}
+	me.tokens -= float64(n)
+	if me.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-me.tokens / me.bytesPerSecond * float64(time.Second))
+}
+
+// Returns the limits on the rate of each stream and of all of them, in kilobits a second.
+func (srv *Server) streamRateLimits() (streamKbps, totalKbps int) {
+	s := srv.settings()
+	return s.StreamKbps, s.TotalStreamKbps
+}
+
+// Returns w limited to StreamKbps, and to its share of TotalStreamKbps with the other streams.
+func (srv *Server) throttleStream(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	streamKbps, totalKbps := srv.streamRateLimits()
+	var buckets []*tokenBucket
+	if streamKbps > 0 {
+		buckets = append(buckets, newTokenBucket(streamKbps))
+	}
+	if totalKbps > 0 {
+		srv.totalStreamBucket.setRate(totalKbps)
+		buckets = append(buckets, &srv.totalStreamBucket)
+	}
+	if buckets == nil {
+		return w
+	}
+	return &throttledResponseWriter{ResponseWriter: w, ctx: r.Context(), buckets: buckets}
+}
+
+// Writes no faster than its token buckets let it.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	buckets []*tokenBucket
+}
+
+func (me *throttledResponseWriter) Write(b []byte) (n int, err error) {
+	chunk := me.buckets[0].burst()
+	for _, tb := range me.buckets[1:] {
+		if c := tb.burst(); c < chunk {
+			chunk = c
+		}
+	}
+	for len(b) > 0 {
+		m := len(b)
+		if m > chunk {
+			m = chunk
+		}
+		// Wait until the slowest bucket lets it through.
+		var wait time.Duration
+		now := time.Now()
+		for _, tb := range me.buckets {
+			if d := tb.take(m, now); d > wait {
+				wait = d
+			}
+		}
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-me.ctx.Done():
+				t.Stop()
+				return n, me.ctx.Err()
+			}
+		}
+		m, err = me.ResponseWriter.Write(b[:m])
+		n += m
+		if err != nil {
+			return
+		}
+		b = b[m:]
+		if f, ok := me.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	return
+}
+
+func (me *throttledResponseWriter) CloseNotify() <-chan bool {
+	return me.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
@@ -0,0 +1,46 @@
+package dms
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottleStreamTotal(t *testing.T) {
+	// 20000 bytes a second, shared by the streams.
+	srv := &Server{TotalStreamKbps: 160}
+	started := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			w := srv.throttleStream(rec, httptest.NewRequest("GET", "/res", nil))
+			if n, err := w.Write(make([]byte, 2000)); n != 2000 || err != nil {
+				t.Errorf("wrote %d: %v", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(started); d < 190*time.Millisecond {
+		t.Errorf("4000 bytes written in %v", d)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	tb := newTokenBucket(80)
+	now := time.Now()
+	if d := tb.take(1000, now); d != 100*time.Millisecond {
+		t.Errorf("waiting %v", d)
+	}
+	// What's taken while others wait waits after them.
+	if d := tb.take(1000, now); d != 200*time.Millisecond {
+		t.Errorf("waiting %v", d)
+	}
+	// An idle bucket fills no further than its burst.
+	if d := tb.take(2000, now.Add(time.Minute)); d != 100*time.Millisecond {
+		t.Errorf("waiting %v", d)
+	}
+}
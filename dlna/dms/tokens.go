@@ -0,0 +1,395 @@
+package dms
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What an API token may do. The admin scope allows everything.
+const (
+	APIScopeBrowse   = "browse"
+	APIScopePlayback = "playback"
+	APIScopeAdmin    = "admin"
+)
+
+// The API scopes, from least to most privileged.
+var APIScopes = []string{APIScopeBrowse, APIScopePlayback, APIScopeAdmin}
+
+var apiTokenNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// A credential for the REST API, such as one for a home automation integration.
+type APIToken struct {
+	Name   string
+	Scopes []string
+	// The SHA-256 of the token, in hex. The token itself isn't kept.
+	Hash    string
+	Created time.Time
+	// Who added the token: the command line, or the web user or token that added it from the web
+	// UI or API.
+	CreatedBy string
+}
+
+func (me APIToken) allows(scope string) bool {
+	return scopesAllow(me.Scopes, scope)
+}
+
+func scopesAllow(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope || s == APIScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func hashAPIToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// The API tokens, persisted in a file so that they can be managed from the command line while the
+// server is running. Until a token is added, the API is open to allowed clients.
+type APITokens struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	tokens  []APIToken
+}
+
+// Loads the tokens from the file at path, which needn't exist yet.
+func (me *APITokens) Load(path string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.path = path
+	me.modTime = time.Time{}
+	me.tokens = nil
+	return me.refresh()
+}
+
+// Rereads the file if it changed since it was last read.
+func (me *APITokens) refresh() error {
+	if me.path == "" {
+		return nil
+	}
+	fi, err := os.Stat(me.path)
+	if os.IsNotExist(err) {
+		me.tokens = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(me.modTime) {
+		return nil
+	}
+	b, err := os.ReadFile(me.path)
+	if err != nil {
+		return err
+	}
+	var tokens []APIToken
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return fmt.Errorf("parsing %q: %w", me.path, err)
+	}
+	me.tokens = tokens
+	me.modTime = fi.ModTime()
+	return nil
+}
+
+func (me *APITokens) save() error {
+	if me.path == "" {
+		return errors.New("no API tokens file")
+	}
+	b, err := json.MarshalIndent(me.tokens, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(me.path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(me.path), filepath.Base(me.path))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), me.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if fi, err := os.Stat(me.path); err == nil {
+		me.modTime = fi.ModTime()
+	}
+	return nil
+}
+
+// Returns the tokens, by name.
+func (me *APITokens) List() ([]APIToken, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	err := me.refresh()
+	ret := append([]APIToken(nil), me.tokens...)
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, err
+}
+
+// Creates a token with the given name and scopes, added by createdBy, returning the token, which
+// can't be recovered later.
+func (me *APITokens) Add(name string, scopes []string, createdBy string) (token string, err error) {
+	if !apiTokenNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("bad token name %q: use letters, digits, '.', '-' and '_'", name)
+	}
+	if len(scopes) == 0 {
+		return "", errors.New("no scopes")
+	}
+	for _, s := range scopes {
+		if !isAPIScope(s) {
+			return "", fmt.Errorf("unknown scope %q, have %q", s, APIScopes)
+		}
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if err := me.refresh(); err != nil {
+		return "", err
+	}
+	for _, t := range me.tokens {
+		if t.Name == name {
+			return "", fmt.Errorf("token %q already exists", name)
+		}
+	}
+	var b [24]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	token = "dms_" + hex.EncodeToString(b[:])
+	me.tokens = append(me.tokens, APIToken{
+		Name:      name,
+		Scopes:    scopes,
+		Hash:      hashAPIToken(token),
+		Created:   time.Now(),
+		CreatedBy: createdBy,
+	})
+	return token, me.save()
+}
+
+// Deletes the named token.
+func (me *APITokens) Revoke(name string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if err := me.refresh(); err != nil {
+		return err
+	}
+	for i, t := range me.tokens {
+		if t.Name == name {
+			me.tokens = append(me.tokens[:i:i], me.tokens[i+1:]...)
+			return me.save()
+		}
+	}
+	return fmt.Errorf("no token %q", name)
+}
+
+func isAPIScope(s string) bool {
+	for _, scope := range APIScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the token with the given value, if any, and whether tokens are required at all.
+func (me *APITokens) lookup(token string) (t APIToken, found, required bool, err error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if err = me.refresh(); err != nil {
+		// Fail closed, since the file may have had tokens.
+		return t, false, true, err
+	}
+	if len(me.tokens) == 0 {
+		return t, false, false, nil
+	}
+	hash := hashAPIToken(token)
+	for _, t := range me.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			return t, true, true, nil
+		}
+	}
+	return t, false, true, nil
+}
+
+// Reports whether there are any tokens known to have been added by the operator, from the command
+// line or by someone logged in. Tokens from before that was recorded could have been added by anyone
+// on the network, while the API was open.
+func (me *APITokens) anyFromOperator() (bool, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if err := me.refresh(); err != nil {
+		return false, err
+	}
+	for _, t := range me.tokens {
+		if t.CreatedBy != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Reports whether the web UI and API require a login or a token, because there are WebUsers or
+// API tokens added by the operator. Those that can change what's shared, or delete media, aren't
+// open to everyone on the network like the rest, so they're refused until there are.
+func (me *Server) loginConfigured() (bool, error) {
+	if len(me.settings().WebUsers) != 0 {
+		return true, nil
+	}
+	return me.apiTokens.anyFromOperator()
+}
+
+// Returns the token given with the request, as a bearer token, or as the password of basic auth,
+// which browsers prompt for.
+func requestAPIToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	_, password, _ := r.BasicAuth()
+	return password
+}
+
+// Reports whether the request may use the API for scope, responding with an error if it may not.
+// Those that change things mustn't be from other sites.
+func (me *Server) authorizeAPI(w http.ResponseWriter, r *http.Request, scope string) bool {
+	if !me.allowClient(w, r) {
+		return false
+	}
+	if r.Method != "GET" && r.Method != "HEAD" && !SameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return false
+	}
+	return me.authorize(w, r, scope)
+}
+
+// Reports whether the request logged in as a WebUser, or gave an API token, that allows scope, or
+// whether neither are required, responding with an error if not.
+func (me *Server) authorize(w http.ResponseWriter, r *http.Request, scope string) bool {
+	_, ok := me.checkCredentials(w, r, scope, false)
+	return ok
+}
+
+// Like authorize, but a login or token is needed even before there are WebUsers or API tokens.
+// Returns who the request is from, as the CreatedBy of the tokens it adds.
+func (me *Server) checkCredentials(w http.ResponseWriter, r *http.Request, scope string, required bool) (by string, ok bool) {
+	user, loggedIn, stale := me.requestWebUser(r, time.Now())
+	if loggedIn {
+		if !user.allows(scope) {
+			http.Error(w, fmt.Sprintf("user %q lacks the %s scope", user.Name, scope), http.StatusForbidden)
+			return "", false
+		}
+		return "web user " + user.Name, true
+	}
+	token := requestAPIToken(r)
+	t, found, configured, err := me.apiTokens.lookup(token)
+	if err != nil {
+		me.requestLogger(r).Printf("error reading API tokens: %v", err)
+		http.Error(w, "error reading API tokens", http.StatusInternalServerError)
+		return "", false
+	}
+	configured = configured || len(me.settings().WebUsers) != 0
+	switch {
+	case !configured && !required:
+		return "", true
+	case !configured:
+		me.challengeLogin(w, stale)
+		http.Error(w, "add the first API token with -addApiToken, or log in as a web user", http.StatusUnauthorized)
+		return "", false
+	case !found:
+		if r.Header.Get("Authorization") != "" && !stale {
+			me.requestLogger(r).Printf("bad login or API token")
+		}
+		me.challengeLogin(w, stale)
+		http.Error(w, "login or API token required", http.StatusUnauthorized)
+		return "", false
+	case !t.allows(scope):
+		http.Error(w, fmt.Sprintf("token %q lacks the %s scope", t.Name, scope), http.StatusForbidden)
+		return "", false
+	}
+	return "token " + t.Name, true
+}
+
+// Reports whether the request may manage API tokens, returning who it's from, or responds with an
+// error. Unlike the rest of the API, it's never open: anyone could add an admin token for
+// themselves otherwise. The first token is added with -addApiToken, or by a WebUser.
+func (me *Server) authorizeTokens(w http.ResponseWriter, r *http.Request) (by string, ok bool) {
+	if !me.allowClient(w, r) {
+		return "", false
+	}
+	if r.Method != "GET" && r.Method != "HEAD" && !SameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return "", false
+	}
+	return me.checkCredentials(w, r, APIScopeAdmin, true)
+}
+
+// Lets API tokens be added and revoked from a browser, which prompts for an admin login or token.
+func (me *Server) serveTokens(w http.ResponseWriter, r *http.Request) {
+	by, ok := me.authorizeTokens(w, r)
+	if !ok {
+		return
+	}
+	data := struct {
+		Tokens            []APIToken
+		Scopes            []string
+		NewName, NewToken string
+		Error             error
+	}{
+		Scopes: APIScopes,
+	}
+	if r.Method == "POST" {
+		if !SameOrigin(r) {
+			http.Error(w, "cross-origin request", http.StatusForbidden)
+			return
+		}
+		name := r.FormValue("name")
+		if r.FormValue("revoke") != "" {
+			data.Error = me.apiTokens.Revoke(name)
+			if data.Error == nil {
+				me.requestLogger(r).Printf("revoked API token %q", name)
+			}
+		} else {
+			scopes := r.Form["scope"]
+			data.NewToken, data.Error = me.apiTokens.Add(name, scopes, by)
+			if data.Error == nil {
+				data.NewName = name
+				me.requestLogger(r).Printf("added API token %q with scopes %q", name, scopes)
+			}
+		}
+	}
+	tokens, err := me.apiTokens.List()
+	if data.Error == nil {
+		data.Error = err
+	}
+	data.Tokens = tokens
+	w.Header().Set("content-type", "text/html")
+	// The new token mustn't linger in caches.
+	w.Header().Set("Cache-Control", "no-store")
+	if err := tokensTmpl.Execute(w, data); err != nil {
+		me.Logger.Print(err)
+	}
+}
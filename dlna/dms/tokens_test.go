@@ -0,0 +1,121 @@
+package dms
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/log"
+)
+
+func TestAPITokens(t *testing.T) {
+	var tokens APITokens
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if err := tokens.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, required, _ := tokens.lookup(""); required {
+		t.Fatal("tokens required before any were added")
+	}
+	browse, err := tokens.Add("ha", []string{APIScopeBrowse}, "command line")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Add("ha", []string{APIScopeAdmin}, "command line"); err == nil {
+		t.Error("added a token with a duplicate name")
+	}
+	if _, err := tokens.Add("x", []string{"root"}, "command line"); err == nil {
+		t.Error("added a token with an unknown scope")
+	}
+	// Another process, such as the command line, sees the token.
+	var other APITokens
+	if err := other.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	tok, found, required, err := other.lookup(browse)
+	if err != nil || !found || !required {
+		t.Fatalf("lookup: %v, %v, %v", found, required, err)
+	}
+	if !tok.allows(APIScopeBrowse) || tok.allows(APIScopePlayback) || tok.allows(APIScopeAdmin) {
+		t.Errorf("wrong scopes allowed for %q", tok.Scopes)
+	}
+	if _, found, _, _ := other.lookup("dms_wrong"); found {
+		t.Error("found a wrong token")
+	}
+	if err := tokens.Revoke("ha"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.Revoke("ha"); err == nil {
+		t.Error("revoked a missing token")
+	}
+}
+
+func TestAPITokenAllows(t *testing.T) {
+	admin := APIToken{Scopes: []string{APIScopeAdmin}}
+	for _, s := range APIScopes {
+		if !admin.allows(s) {
+			t.Errorf("admin doesn't allow %s", s)
+		}
+	}
+}
+
+func TestServeTokens(t *testing.T) {
+	srv := &Server{Logger: log.Default}
+	if err := srv.apiTokens.Load(filepath.Join(t.TempDir(), "tokens.json")); err != nil {
+		t.Fatal(err)
+	}
+	post := func(handler http.HandlerFunc, target, body, user, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", target, strings.NewReader(body))
+		r.RemoteAddr = "192.168.1.20:4000"
+		r.Header.Set("Origin", "http://"+r.Host)
+		if target == tokensPath {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if user != "" {
+			r.SetBasicAuth(user, "secret")
+		}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	// Anyone on the network could otherwise add an admin token for themselves while there are none.
+	if w := post(srv.serveTokens, tokensPath, "name=evil&scope=admin", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("adding the first token from the page got %d", w.Code)
+	}
+	if w := post(srv.serveAPITokens, apiTokensPath, `{"Name":"evil","Scopes":["admin"]}`, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("adding the first token with the API got %d", w.Code)
+	}
+	if tokens, _ := srv.apiTokens.List(); len(tokens) != 0 {
+		t.Fatalf("added %v", tokens)
+	}
+
+	srv.WebUsers = []WebUser{
+		{Name: "admin", Password: "secret", Scopes: []string{APIScopeAdmin}},
+		{Name: "guest", Password: "secret", Scopes: []string{APIScopeBrowse}},
+	}
+	if w := post(srv.serveTokens, tokensPath, "name=guest&scope=admin", "guest", ""); w.Code != http.StatusForbidden {
+		t.Errorf("adding a token as a browse user got %d", w.Code)
+	}
+	w := post(srv.serveAPITokens, apiTokensPath, `{"Name":"ha","Scopes":["admin"]}`, "admin", "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("adding a token as an admin user got %d: %s", w.Code, w.Body)
+	}
+	var created apiToken
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || created.Token == "" || created.CreatedBy != "web user admin" {
+		t.Fatalf("got %+v, %v", created, err)
+	}
+	srv.WebUsers = nil
+	if w := post(srv.serveTokens, tokensPath, "name=other&scope=browse", "", created.Token); w.Code != http.StatusOK {
+		t.Errorf("adding a token with an admin token got %d", w.Code)
+	}
+	tokens, err := srv.apiTokens.List()
+	if err != nil || len(tokens) != 2 || tokens[1].Name != "other" || tokens[1].CreatedBy != "token ha" {
+		t.Errorf("got %+v, %v", tokens, err)
+	}
+}
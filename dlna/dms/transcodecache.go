@@ -0,0 +1,243 @@
+package dms
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+const (
+	transcodeCacheDiskName = "transcode cache"
+	// Suffix of transcodes still being written to the cache.
+	transcodeCachePartialSuffix = ".partial"
+	// How often requests reading a transcode being written to the cache check for more of it.
+	transcodeCachePollInterval = 250 * time.Millisecond
+)
+
+var errTranscodeAbandoned = errors.New("transcode abandoned")
+
+// Transcodes being written to TranscodeCacheDir. Requests for one that's being written read it as
+// it's written, rather than starting another.
+type transcodeCache struct {
+	mu      sync.Mutex
+	running map[string]*cachingTranscode
+}
+
+// A transcode being written to the cache.
+type cachingTranscode struct {
+	partialPath string
+	// Closed when it's finished, with err set if it failed or was abandoned.
+	done chan struct{}
+	err  error
+	// Requests reading it. When the last one goes before it's finished, it's stopped.
+	readers int
+	stopped bool
+	output  io.ReadCloser
+}
+
+// Returns the cache's directory, or "" if transcodes aren't cached, and its size limit in bytes.
+func (srv *Server) transcodeCacheSettings() (dir string, limit int64) {
+	if srv.disks.low(transcodeCacheDiskName) {
+		return "", 0
+	}
+	s := srv.settings()
+	return s.TranscodeCacheDir, s.TranscodeCacheSize
+}
+
+// Returns the name a transcode of the file is cached under. It's from the file's modification time
+// and size too, so that a changed file is transcoded again. The query gives the rate and channels of
+// audio transcodes.
+func transcodeCacheName(filePath string, fi os.FileInfo, tsname string, query url.Values) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%s\x00%s\x00%s",
+		filePath, fi.ModTime().UnixNano(), fi.Size(), tsname, query.Get("rate"), query.Get("channels"))))
+	return hex.EncodeToString(h[:])
+}
+
+// Returns a reader of the cached transcode, from the cache if it's there or being written to it,
+// or otherwise from a transcode started with start and written to the cache as it goes.
+func (srv *Server) cachedTranscode(ctx context.Context, dir, name string, start func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	me := &srv.transcodeCache
+	cachePath := filepath.Join(dir, name)
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if f, err := os.Open(cachePath); err == nil {
+		srv.metrics.cacheLookup("transcode", true)
+		// Its modification time is when it was last used, for eviction.
+		now := time.Now()
+		os.Chtimes(cachePath, now, now)
+		return f, nil
+	}
+	ct := me.running[name]
+	srv.metrics.cacheLookup("transcode", ct != nil)
+	if ct == nil {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, err
+		}
+		partial, err := os.Create(cachePath + transcodeCachePartialSuffix)
+		if err != nil {
+			return nil, err
+		}
+		output, err := start()
+		if err != nil {
+			partial.Close()
+			os.Remove(partial.Name())
+			return nil, err
+		}
+		ct = &cachingTranscode{
+			partialPath: partial.Name(),
+			done:        make(chan struct{}),
+			output:      output,
+		}
+		if me.running == nil {
+			me.running = make(map[string]*cachingTranscode)
+		}
+		me.running[name] = ct
+		go srv.writeCachedTranscode(ct, partial, dir, name)
+	}
+	f, err := os.Open(ct.partialPath)
+	if err != nil {
+		return nil, err
+	}
+	ct.readers++
+	return &cachingTranscodeReader{ctx: ctx, f: f, ct: ct, cache: me}, nil
+}
+
+// Copies the transcode's output to the cache, and moves it into place once it's complete.
+func (srv *Server) writeCachedTranscode(ct *cachingTranscode, partial *os.File, dir, name string) {
+	n, err := io.Copy(partial, ct.output)
+	if closeErr := partial.Close(); err == nil {
+		err = closeErr
+	}
+	ct.output.Close()
+	me := &srv.transcodeCache
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if ct.stopped {
+		err = errTranscodeAbandoned
+	} else if err == nil && n == 0 {
+		err = errors.New("transcode gave no output")
+	}
+	if err == nil {
+		err = os.Rename(ct.partialPath, filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(ct.partialPath)
+	}
+	ct.err = err
+	delete(me.running, name)
+	close(ct.done)
+	if err != nil {
+		return
+	}
+	_, limit := srv.transcodeCacheSettings()
+	if err := me.evict(dir, limit); err != nil {
+		srv.Logger.Levelf(log.Warning, "error evicting from transcode cache: %v", err)
+	}
+}
+
+// Deletes the least recently used transcodes until the cache is within limit bytes, and partial
+// ones left from before a restart. It's called with mu held.
+func (me *transcodeCache) evict(dir string, limit int64) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	type cached struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var files []cached
+	var total int64
+	for _, e := range entries {
+		if name := strings.TrimSuffix(e.Name(), transcodeCachePartialSuffix); name != e.Name() {
+			if me.running[name] == nil {
+				os.Remove(filepath.Join(dir, e.Name()))
+			}
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, cached{filepath.Join(dir, e.Name()), fi.Size(), fi.ModTime()})
+		total += fi.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].used.Before(files[j].used)
+	})
+	for ; total > limit && len(files) != 0; files = files[1:] {
+		if err := os.Remove(files[0].path); err != nil {
+			return err
+		}
+		total -= files[0].size
+	}
+	return nil
+}
+
+// Reads a transcode as it's written to the cache.
+type cachingTranscodeReader struct {
+	ctx    context.Context
+	f      *os.File
+	ct     *cachingTranscode
+	cache  *transcodeCache
+	closed bool
+}
+
+func (me *cachingTranscodeReader) Read(b []byte) (n int, err error) {
+	for {
+		n, err = me.f.Read(b)
+		if n != 0 || err != io.EOF {
+			return
+		}
+		t := time.NewTimer(transcodeCachePollInterval)
+		select {
+		case <-me.ct.done:
+			t.Stop()
+			// What was written before it finished may not have been read yet.
+			if n, err = me.f.Read(b); n != 0 || err != io.EOF {
+				return
+			}
+			if me.ct.err != nil {
+				return 0, me.ct.err
+			}
+			return 0, io.EOF
+		case <-me.ctx.Done():
+			t.Stop()
+			return 0, me.ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Stops the transcode if no other request is reading it and it isn't finished.
+func (me *cachingTranscodeReader) Close() error {
+	me.cache.mu.Lock()
+	defer me.cache.mu.Unlock()
+	if me.closed {
+		return nil
+	}
+	me.closed = true
+	me.ct.readers--
+	if me.ct.readers == 0 {
+		select {
+		case <-me.ct.done:
+		default:
+			me.ct.stopped = true
+			me.ct.output.Close()
+		}
+	}
+	return me.f.Close()
+}
@@ -0,0 +1,100 @@
+package dms
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCachedTranscode(t *testing.T) {
+	srv := &Server{TranscodeCacheSize: 1 << 20}
+	srv.metrics = newServerMetrics(srv)
+	dir := t.TempDir()
+	pr, pw := io.Pipe()
+	starts := 0
+	start := func() (io.ReadCloser, error) {
+		starts++
+		return pr, nil
+	}
+	ctx := context.Background()
+	a, err := srv.cachedTranscode(ctx, dir, "x", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := srv.cachedTranscode(ctx, dir, "x", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		pw.Write([]byte("hello "))
+		pw.Write([]byte("world"))
+		pw.Close()
+	}()
+	for _, r := range []io.ReadCloser{a, b} {
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(got) != "hello world" {
+			t.Fatalf("got %q, %v", got, err)
+		}
+	}
+	// Once it's complete, it's read from the cache without starting another.
+	c, err := srv.cachedTranscode(ctx, dir, "x", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(c)
+	c.Close()
+	if string(got) != "hello world" || starts != 1 {
+		t.Fatalf("got %q after %v starts", got, starts)
+	}
+}
+
+func TestCachedTranscodeAbandoned(t *testing.T) {
+	srv := &Server{}
+	srv.metrics = newServerMetrics(srv)
+	dir := t.TempDir()
+	pr, pw := io.Pipe()
+	r, err := srv.cachedTranscode(context.Background(), dir, "x", func() (io.ReadCloser, error) {
+		return pr, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw.Write([]byte("hel"))
+	ct := srv.transcodeCache.running["x"]
+	r.Close()
+	if _, err := pw.Write([]byte("lo")); err == nil {
+		t.Fatal("transcode not stopped")
+	}
+	<-ct.done
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("left %v", entries)
+	}
+}
+
+func TestTranscodeCacheEvict(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, name := range []string{"old", "mid", "new"} {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, make([]byte, 100), 0o600)
+		used := now.Add(time.Duration(i) * time.Hour)
+		os.Chtimes(p, used, used)
+	}
+	os.WriteFile(filepath.Join(dir, "stale"+transcodeCachePartialSuffix), nil, 0o600)
+	var c transcodeCache
+	if err := c.evict(dir, 200); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if len(names) != 2 || names[0] != "mid" || names[1] != "new" {
+		t.Fatalf("left %v", names)
+	}
+}
@@ -0,0 +1,364 @@
+package dms
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+const (
+	// Object path of the container of the episodes of TV shows, by series and season, in the top
+	// level. A directory of the same name in the shared directory is hidden by it.
+	showsPath     = "/@shows"
+	showsTitle    = "TV Shows"
+	seasonTitle   = "Season"
+	specialsTitle = "Specials"
+)
+
+var (
+	// Matches the names of episode files, such as "The.Office.S02E05.Halloween.720p", or
+	// "Twin Peaks 1x02 Traces to Nowhere", giving the series, season, episode and title. The
+	// series and title may be empty.
+	episodeNamePattern = regexp.MustCompile(`(?i)^(?:(.*?)[\s._-]+)?(?:s(\d{1,2})[\s._-]*e(\d{1,3})(?:-?e\d{1,3}|-\d{1,3})*|(\d{1,2})x(\d{2,3}))(?:[\s._-]+(.*))?$`)
+	// Matches where the release details that follow the titles in file names start.
+	releaseDetailsPattern = regexp.MustCompile(`(?i)[\s._-]*\b(?:\d{3,4}[pi]|hdtv|web(?:-?dl|-?rip)?|bluray|brrip|bdrip|dvdrip|x26[45]|h\.?26[45]|hevc|xvid|proper|repack)\b.*$`)
+	// Matches the names of season folders, whose parent folders are named after the series.
+	seasonDirPattern = regexp.MustCompile(`(?i)^(?:season|series|staffel|saison|temporada|s)[\s._-]*\d+$|^specials$`)
+)
+
+// An episode of a TV show, from its metadata or its file name.
+type episode struct {
+	// The object path of the media.
+	path           string
+	series         string
+	season, number int
+	title          string
+}
+
+// Returns the title of the episode in the TV Shows container, such as "S02E05 Halloween".
+func (me episode) displayTitle() string {
+	ret := fmt.Sprintf("S%02dE%02d", me.season, me.number)
+	if me.title != "" {
+		ret += " " + me.title
+	}
+	return ret
+}
+
+// Turns the separators in a file name into spaces, and drops the release details, such as
+// "Halloween.720p.HDTV" to "Halloween".
+func cleanEpisodeName(s string) string {
+	s = releaseDetailsPattern.ReplaceAllString(s, "")
+	s = strings.NewReplacer(".", " ", "_", " ").Replace(s)
+	return strings.Trim(strings.Join(strings.Fields(s), " "), " -")
+}
+
+// Parses the episode from the object path of a video, using the folders it's in for the series
+// if its name doesn't give it.
+func parseEpisode(objectPath string) (ret episode, ok bool) {
+	name := path.Base(objectPath)
+	m := episodeNamePattern.FindStringSubmatch(strings.TrimSuffix(name, path.Ext(name)))
+	if m == nil {
+		return
+	}
+	ret.path = objectPath
+	ret.series = cleanEpisodeName(m[1])
+	season, number := m[2], m[3]
+	if season == "" {
+		season, number = m[4], m[5]
+	}
+	ret.season, _ = strconv.Atoi(season)
+	ret.number, _ = strconv.Atoi(number)
+	ret.title = cleanEpisodeName(m[6])
+	for dir := path.Dir(objectPath); ret.series == "" && dir != "/"; dir = path.Dir(dir) {
+		if base := path.Base(dir); !seasonDirPattern.MatchString(base) {
+			ret.series = cleanEpisodeName(base)
+		}
+	}
+	return ret, ret.series != ""
+}
+
+// Returns the episode a video is of, preferring its metadata, such as from an NFO file, to its
+// file name.
+func episodeOf(objectPath string, md *Metadata) (ret episode, ok bool) {
+	ret, ok = parseEpisode(objectPath)
+	if md == nil {
+		return
+	}
+	if md.Series != "" {
+		ret.series = md.Series
+	}
+	if md.Episode != 0 {
+		ret.season, ret.number = md.Season, md.Episode
+		ok = ok || ret.series != ""
+	}
+	if md.Title != "" {
+		ret.title = md.Title
+	}
+	ret.path = objectPath
+	return ret, ok && ret.series != ""
+}
+
+// A series in the TV Shows container.
+type show struct {
+	// The name of the series in object paths, which is its title without slashes.
+	name  string
+	title string
+	// The episodes by season, in order.
+	seasons map[int][]episode
+}
+
+// Returns the season numbers of the show, in order.
+func (me *show) seasonNumbers() (ret []int) {
+	for n := range me.seasons {
+		ret = append(ret, n)
+	}
+	sort.Ints(ret)
+	return
+}
+
+// The TV shows in the index, from a scan of it. It's kept a while like the places, since the top
+// level container needs to know if there's any every time it's browsed.
+type showsCache struct {
+	mu      sync.Mutex
+	shows   map[string]*show
+	expires time.Time
+}
+
+// Drops the shows, such as when the shared directories change.
+func (me *showsCache) clear() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.shows = nil
+}
+
+// Whether the TV Shows container is listed, which needs the index.
+func (srv *Server) tvShows() bool {
+	return srv.settings().TVShows && srv.index != nil
+}
+
+// Whether the object path is the TV Shows container or within it.
+func isShowsPath(p string) bool {
+	return p == showsPath || strings.HasPrefix(p, showsPath+"/")
+}
+
+// Returns the shows of the videos in the index, by name. Series whose titles differ only in case
+// are one show.
+func (srv *Server) shows() map[string]*show {
+	c := &srv.showsCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.shows != nil && now.Before(c.expires) {
+		return c.shows
+	}
+	byTitle := make(map[string]*show)
+	err := srv.index.forEachEntry("/", true, func(dir string, e *indexEntry) bool {
+		if !e.Mode.IsRegular() {
+			return true
+		}
+		if mt, err := MimeTypeByPath(e.Name); err != nil || !mt.IsVideo() {
+			return true
+		}
+		ep, ok := episodeOf(path.Join(dir, e.Name), e.Metadata)
+		if !ok {
+			return true
+		}
+		key := strings.ToLower(ep.series)
+		s := byTitle[key]
+		if s == nil {
+			s = &show{
+				name:    strings.ReplaceAll(ep.series, "/", "-"),
+				title:   ep.series,
+				seasons: make(map[int][]episode),
+			}
+			byTitle[key] = s
+		}
+		s.seasons[ep.season] = append(s.seasons[ep.season], ep)
+		return true
+	})
+	if err != nil {
+		srv.Logger.Printf("error listing TV shows: %v", err)
+		return nil
+	}
+	ret := make(map[string]*show, len(byTitle))
+	for _, s := range byTitle {
+		for _, eps := range s.seasons {
+			sort.Slice(eps, func(i, j int) bool {
+				if eps[i].number != eps[j].number {
+					return eps[i].number < eps[j].number
+				}
+				return eps[i].path < eps[j].path
+			})
+		}
+		ret[s.name] = s
+	}
+	c.shows, c.expires = ret, now.Add(browseCacheTTL)
+	return ret
+}
+
+// Returns the number of top level objects the TV Shows container adds.
+func (srv *Server) showsChildCount() int {
+	if !srv.tvShows() || len(srv.shows()) == 0 {
+		return 0
+	}
+	return 1
+}
+
+// Returns the TV Shows container, or nil if there are no episodes.
+func (me *contentDirectoryService) showsContainer() interface{} {
+	if !me.tvShows() {
+		return nil
+	}
+	shows := me.shows()
+	if len(shows) == 0 {
+		return nil
+	}
+	return showsObjectContainer(showsPath, me.localTitle(showsTitle), "object.container", len(shows))
+}
+
+func showsObjectContainer(objectPath, title, class string, childCount int) upnpav.Container {
+	o := object{Path: objectPath}
+	return upnpav.Container{
+		Object: upnpav.Object{
+			ID:         o.ID(),
+			ParentID:   o.ParentID(),
+			Restricted: 1,
+			Class:      class,
+			Title:      title,
+		},
+		ChildCount: childCount,
+	}
+}
+
+func showContainer(s *show) upnpav.Container {
+	return showsObjectContainer(path.Join(showsPath, s.name), s.title, "object.container.album.videoAlbum", len(s.seasons))
+}
+
+// Returns the container of a season of a show, titled like "Season 2", or Specials for season 0.
+func (me *contentDirectoryService) seasonContainer(s *show, season int) upnpav.Container {
+	title := fmt.Sprintf("%s %d", me.localTitle(seasonTitle), season)
+	if season == 0 {
+		title = me.localTitle(specialsTitle)
+	}
+	c := showsObjectContainer(path.Join(showsPath, s.name, strconv.Itoa(season)), title, "object.container.album.videoAlbum", len(s.seasons[season]))
+	c.SeriesTitle = s.title
+	c.EpisodeSeason = season
+	return c
+}
+
+// Returns the item for an episode in its season's container, which refers to the video where it
+// is in the shared directories.
+func (me *contentDirectoryService) episodeItem(s *show, ep episode, host, userAgent string) (interface{}, bool) {
+	obj, ok := me.referringItem(path.Join(showsPath, s.name, strconv.Itoa(ep.season)), ep.path, host, userAgent)
+	if !ok {
+		return nil, false
+	}
+	item := obj.(upnpav.Item)
+	item.Title = ep.displayTitle()
+	item.SeriesTitle = s.title
+	item.EpisodeSeason = ep.season
+	item.EpisodeNumber = ep.number
+	return item, true
+}
+
+// Splits an object path within the TV Shows container into the name of the show, its season, and
+// the object path of the video if it's of an episode.
+func splitShowsPath(p string) (name, season, mediaPath string) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(p, showsPath+"/"), "/")
+	season, mediaPath, _ = strings.Cut(rest, "/")
+	if mediaPath != "" {
+		mediaPath = "/" + mediaPath
+	}
+	return
+}
+
+// Returns the show and season at an object path within the TV Shows container. The season is -1
+// for the show's own container.
+func (me *contentDirectoryService) showsPathSeason(p string) (s *show, season int, mediaPath string, err error) {
+	name, seasonStr, mediaPath := splitShowsPath(p)
+	s = me.shows()[name]
+	if s == nil {
+		return nil, 0, "", upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such show")
+	}
+	if seasonStr == "" {
+		return s, -1, "", nil
+	}
+	season, err = strconv.Atoi(seasonStr)
+	if err != nil || s.seasons[season] == nil || strconv.Itoa(season) != seasonStr {
+		return nil, 0, "", upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such season")
+	}
+	return
+}
+
+// Returns the objects in a container within the TV Shows container: the shows by title, their
+// seasons in order, and the episodes of seasons by number.
+func (me *contentDirectoryService) readShowsContainer(o object, host, userAgent string) (ret []interface{}, err error) {
+	if !me.tvShows() {
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no TV shows")
+	}
+	if o.Path == showsPath {
+		for _, s := range me.shows() {
+			ret = append(ret, showContainer(s))
+		}
+		return me.sortObjects(ret, []sortKey{{property: "dc:title"}}), nil
+	}
+	s, season, mediaPath, err := me.showsPathSeason(o.Path)
+	if err != nil {
+		return nil, err
+	}
+	if mediaPath != "" {
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "not a container")
+	}
+	if season < 0 {
+		for _, n := range s.seasonNumbers() {
+			ret = append(ret, me.seasonContainer(s, n))
+		}
+		return
+	}
+	for _, ep := range s.seasons[season] {
+		if item, ok := me.episodeItem(s, ep, host, userAgent); ok {
+			ret = append(ret, item)
+		}
+	}
+	return
+}
+
+// Returns the object for an object path within the TV Shows container, as given to
+// BrowseMetadata.
+func (me *contentDirectoryService) showsObject(o object, host, userAgent string) (interface{}, error) {
+	if o.Path == showsPath {
+		if c := me.showsContainer(); c != nil {
+			return c, nil
+		}
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no TV shows")
+	}
+	if !me.tvShows() {
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no TV shows")
+	}
+	s, season, mediaPath, err := me.showsPathSeason(o.Path)
+	if err != nil {
+		return nil, err
+	}
+	if season < 0 {
+		return showContainer(s), nil
+	}
+	if mediaPath == "" {
+		return me.seasonContainer(s, season), nil
+	}
+	for _, ep := range s.seasons[season] {
+		if ep.path == mediaPath {
+			if item, ok := me.episodeItem(s, ep, host, userAgent); ok {
+				return item, nil
+			}
+		}
+	}
+	return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such episode")
+}
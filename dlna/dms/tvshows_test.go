@@ -0,0 +1,45 @@
+package dms
+
+import (
+	"testing"
+)
+
+func TestParseEpisode(t *testing.T) {
+	for _, c := range []struct {
+		path string
+		want episode
+		ok   bool
+	}{
+		{"/TV/The.Office.S02E05.Halloween.720p.HDTV.x264.mkv", episode{series: "The Office", season: 2, number: 5, title: "Halloween"}, true},
+		{"/Twin Peaks 1x02 - Traces to Nowhere.avi", episode{series: "Twin Peaks", season: 1, number: 2, title: "Traces to Nowhere"}, true},
+		{"/Shows/Fargo/Season 3/s03e01.mkv", episode{series: "Fargo", season: 3, number: 1}, true},
+		{"/Shows/Fargo/Specials/S00E01 - Making of.mkv", episode{series: "Fargo", number: 1, title: "Making of"}, true},
+		{"/Show_Name_S01E01E02.mkv", episode{series: "Show Name", season: 1, number: 1}, true},
+		{"/Films/Heat.1995.1080p.mkv", episode{}, false},
+		{"/Films/2001x1080.mkv", episode{}, false},
+		{"/S01E01.mkv", episode{}, false},
+	} {
+		got, ok := parseEpisode(c.path)
+		if ok != c.ok {
+			t.Errorf("%s: got ok %v", c.path, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		c.want.path = c.path
+		if got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.path, got, c.want)
+		}
+	}
+}
+
+func TestEpisodeOfMetadata(t *testing.T) {
+	ep, ok := episodeOf("/Shows/tp/Episode 2.mkv", &Metadata{Series: "Twin Peaks", Season: 1, Episode: 2, Title: "Traces to Nowhere"})
+	if !ok || ep.displayTitle() != "S01E02 Traces to Nowhere" || ep.series != "Twin Peaks" {
+		t.Errorf("got %+v, %v", ep, ok)
+	}
+	if _, ok := episodeOf("/Films/Heat.mkv", &Metadata{Title: "Heat"}); ok {
+		t.Error("film is an episode")
+	}
+}
@@ -0,0 +1,510 @@
+package dms
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+	"github.com/anacrolix/log"
+)
+
+const (
+	uploadPath     = "/upload"
+	uploadDiskName = "uploads"
+	// How long a control point has to send the file of an object it created.
+	uploadExpiry = time.Hour
+	// For CreateObject, the container that the server picks.
+	anyContainerID = "DLNA.ORG_AnyContainer"
+	// ContentDirectory errors for CreateObject and ImportResource.
+	restrictedParentErrorCode     = 713
+	badMetadataErrorCode          = 712
+	noSuchDestinationErrorCode    = 718
+	noSuchFileTransferErrorCode   = 717
+	restrictedObjectErrorCode     = 711
+	noSuchSourceResourceErrorCode = 714
+)
+
+// Extensions for the types of media uploaded without one, where mime.ExtensionsByType would give
+// an unusual one first.
+var uploadExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+	"audio/mpeg":      ".mp3",
+	"audio/mp4":       ".m4a",
+}
+
+// An object created by CreateObject, waiting for its file to be sent to its importUri.
+type pendingUpload struct {
+	name    string
+	created time.Time
+}
+
+// Statuses of ImportResource transfers, for GetTransferProgress.
+const (
+	transferInProgress = "IN_PROGRESS"
+	transferStopped    = "STOPPED"
+	transferError      = "ERROR"
+	transferCompleted  = "COMPLETED"
+)
+
+// An ImportResource transfer, the server fetching the file of an upload from the control point.
+type uploadTransfer struct {
+	status string
+	// Bytes received, and the size of the file, or 0 if it isn't known.
+	length, total int64
+	stop          context.CancelFunc
+	// When it stopped being in progress.
+	finished time.Time
+}
+
+// Uploads from control points that push media to the server, such as cameras and phones.
+type uploads struct {
+	mu sync.Mutex
+	// By the token in their importUri.
+	pending      map[string]*pendingUpload
+	transfers    map[uint32]*uploadTransfer
+	lastTransfer uint32
+}
+
+// Reserves a file name in dir for an upload like name, returning the token for its importUri.
+func (me *uploads) add(dir, name string) (token, reserved string) {
+	var b [8]byte
+	rand.Read(b[:])
+	token = hex.EncodeToString(b[:])
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.pending == nil {
+		me.pending = make(map[string]*pendingUpload)
+	}
+	taken := make(map[string]bool)
+	for t, p := range me.pending {
+		if time.Since(p.created) > uploadExpiry {
+			delete(me.pending, t)
+		} else {
+			taken[p.name] = true
+		}
+	}
+	reserved = unusedFileName(dir, name, taken)
+	me.pending[token] = &pendingUpload{reserved, time.Now()}
+	return
+}
+
+// Takes the upload with the token, so its file is only received once.
+func (me *uploads) take(token string) (*pendingUpload, bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	p, ok := me.pending[token]
+	delete(me.pending, token)
+	if !ok || time.Since(p.created) > uploadExpiry {
+		return nil, false
+	}
+	return p, true
+}
+
+func (me *uploads) addTransfer(t *uploadTransfer) uint32 {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.transfers == nil {
+		me.transfers = make(map[uint32]*uploadTransfer)
+	}
+	// Transfers are kept for their progress to be got for a while after they finish.
+	for id, t := range me.transfers {
+		if t.status != transferInProgress && time.Since(t.finished) > uploadExpiry {
+			delete(me.transfers, id)
+		}
+	}
+	me.lastTransfer++
+	me.transfers[me.lastTransfer] = t
+	return me.lastTransfer
+}
+
+// Returns a copy of the transfer, for its progress.
+func (me *uploads) transfer(id uint32) (t uploadTransfer, ok bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	p, ok := me.transfers[id]
+	if ok {
+		t = *p
+	}
+	return
+}
+
+func (me *uploads) updateTransfer(t *uploadTransfer, f func(*uploadTransfer)) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	f(t)
+}
+
+// Returns name, or name with a number before its extension, such that there's no file of that
+// name in dir and it's not taken.
+func unusedFileName(dir, name string, taken map[string]bool) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(filepath.Join(dir, name)); os.IsNotExist(err) && !taken[name] {
+			return name
+		}
+		name = fmt.Sprintf("%s (%d)%s", base, i+1, ext)
+	}
+}
+
+// Returns the file name for an upload titled title, of the MIME type in protocolInfo, or false if
+// it isn't media.
+func uploadFileName(title, protocolInfo string) (string, bool) {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(title))
+	name = strings.TrimLeft(name, ".")
+	if mt := mimeTypeByBaseName(name); mt.IsMedia() {
+		return name, true
+	}
+	fields := strings.Split(protocolInfo, ":")
+	if len(fields) < 3 || !mimeType(fields[2]).IsMedia() {
+		return "", false
+	}
+	ext, ok := uploadExtensions[fields[2]]
+	if !ok {
+		exts, _ := mime.ExtensionsByType(fields[2])
+		if len(exts) == 0 {
+			return "", false
+		}
+		ext = exts[0]
+	}
+	if name == "" {
+		name = "upload"
+	}
+	return name + ext, true
+}
+
+// Returns the directory uploads are saved to, or "" if they aren't allowed.
+func (srv *Server) uploadDir() string {
+	s := srv.settings()
+	if !s.AllowUpload {
+		return ""
+	}
+	return s.UploadDir
+}
+
+// The DIDL-Lite of a CreateObject request. Elements are matched by their names without the
+// namespaces.
+type createObjectElements struct {
+	Items []struct {
+		Title string `xml:"title"`
+		Class string `xml:"class"`
+		Res   []struct {
+			ProtocolInfo string `xml:"protocolInfo,attr"`
+		} `xml:"res"`
+	} `xml:"item"`
+}
+
+type createObject struct {
+	ContainerID string `soap:"required"`
+	Elements    string `soap:"required"`
+}
+
+// Creates an item for a file a control point is about to upload, in the upload directory. It
+// gives the item's res an importUri to send the file to, with HTTP POST or ImportResource.
+func (me *contentDirectoryService) createObject(args *createObject, host string) ([]soapArg, error) {
+	dir := me.uploadDir()
+	if dir == "" {
+		return nil, upnp.Errorf(restrictedParentErrorCode, "uploads aren't allowed")
+	}
+	var elements createObjectElements
+	if err := xml.Unmarshal([]byte(args.Elements), &elements); err != nil || len(elements.Items) != 1 {
+		return nil, upnp.Errorf(badMetadataErrorCode, "want one item to create")
+	}
+	item := elements.Items[0]
+	var protocolInfo string
+	if len(item.Res) != 0 {
+		protocolInfo = item.Res[0].ProtocolInfo
+	}
+	name, ok := uploadFileName(item.Title, protocolInfo)
+	if !ok {
+		return nil, upnp.Errorf(badMetadataErrorCode, "%q isn't media", item.Title)
+	}
+	token, name := me.uploads.add(dir, name)
+	// The item is where the file will be, if that's shared.
+	parentID := args.ContainerID
+	id := url.QueryEscape(path.Join(uploadPath, token))
+	if o, ok := me.objectFromFilePath(filepath.Join(dir, name)); ok {
+		id, parentID = o.ID(), o.ParentID()
+	}
+	if parentID == anyContainerID {
+		parentID = "0"
+	}
+	importURI := (&url.URL{
+		Scheme:   "http",
+		Host:     host,
+		Path:     uploadPath,
+		RawQuery: url.Values{"id": {token}}.Encode(),
+	}).String()
+	class := item.Class
+	if class == "" {
+		class = "object.item"
+	}
+	result, err := xml.Marshal(upnpav.Item{
+		Object: upnpav.Object{
+			ID:       id,
+			ParentID: parentID,
+			Title:    sanitizeText(strings.TrimSuffix(name, filepath.Ext(name))),
+			Class:    class,
+			Date:     upnpav.Timestamp{Time: time.Now()},
+		},
+		Res: []upnpav.Resource{{ProtocolInfo: protocolInfo}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The importUri attribute isn't part of Resource, since it's only for uploads.
+	res := strings.Replace(string(result), "<res ", `<res importUri="`+xmlEscapeAttr(importURI)+`" `, 1)
+	me.Logger.Levelf(log.Info, "created upload of %q", name)
+	return []soapArg{
+		{Name: "ObjectID", Value: id},
+		{Name: "Result", Value: didl_lite(res)},
+	}, nil
+}
+
+func xmlEscapeAttr(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// Saves the file of an upload from r, returning its size.
+func (srv *Server) saveUpload(dir string, p *pendingUpload, r io.Reader) (n int64, err error) {
+	if srv.disks.low(uploadDiskName) {
+		return 0, errors.New("low on space")
+	}
+	f, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return
+	}
+	// Temporary files are only readable by their owner.
+	err = f.Chmod(0o644)
+	if err == nil {
+		n, err = io.Copy(f, r)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// Another file may have been given the name meanwhile.
+		name := unusedFileName(dir, p.name, nil)
+		err = os.Rename(f.Name(), filepath.Join(dir, name))
+		p.name = name
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return
+}
+
+// Receives the file of an object created with CreateObject, sent to its importUri.
+func (srv *Server) serveUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// The importUri is all that's needed otherwise, and anyone on the network could take it.
+	if ok, err := srv.loginConfigured(); err != nil || !ok {
+		http.Error(w, "uploads need a web user or an API token added by the operator", http.StatusForbidden)
+		return
+	}
+	if !srv.authorizeAPI(w, r, APIScopeAdmin) {
+		return
+	}
+	dir := srv.uploadDir()
+	if dir == "" {
+		srv.resourceError(w, r, resourceDisabled, errors.New("uploads aren't allowed"))
+		return
+	}
+	p, ok := srv.uploads.take(r.URL.Query().Get("id"))
+	if !ok {
+		srv.resourceError(w, r, resourceNotFound, errors.New("no such upload"))
+		return
+	}
+	n, err := srv.saveUpload(dir, p, r.Body)
+	if err != nil {
+		srv.resourceError(w, r, resourceInternalError, fmt.Errorf("saving upload: %w", err))
+		return
+	}
+	srv.requestLogger(r).Printf("received upload of %q, %d bytes", p.name, n)
+	w.WriteHeader(http.StatusCreated)
+}
+
+type importResource struct {
+	SourceURI      string `soap:"required"`
+	DestinationURI string `soap:"required"`
+}
+
+// Fetches the file of an object created with CreateObject from the control point, which gives
+// the URL it serves it at and the object's importUri. Only URLs on the control point itself are
+// fetched, so that the server can't be used to reach others.
+func (me *contentDirectoryService) importResource(args *importResource, r *http.Request) ([]soapArg, error) {
+	dir := me.uploadDir()
+	if dir == "" {
+		return nil, upnp.Errorf(restrictedObjectErrorCode, "uploads aren't allowed")
+	}
+	clientIP := requestClientIP(r)
+	src, err := url.Parse(args.SourceURI)
+	if err == nil {
+		err = uploadSourceAllowed(src, clientIP)
+	}
+	if err != nil {
+		return nil, upnp.Errorf(noSuchSourceResourceErrorCode, "source %q isn't on the control point", args.SourceURI)
+	}
+	dest, err := url.Parse(args.DestinationURI)
+	if err != nil || dest.Path != uploadPath {
+		return nil, upnp.Errorf(noSuchDestinationErrorCode, "no such destination %q", args.DestinationURI)
+	}
+	p, ok := me.uploads.take(dest.Query().Get("id"))
+	if !ok {
+		return nil, upnp.Errorf(noSuchDestinationErrorCode, "no such destination %q", args.DestinationURI)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	t := &uploadTransfer{status: transferInProgress, stop: stop}
+	id := me.uploads.addTransfer(t)
+	logger := me.requestLogger(r)
+	go func() {
+		defer stop()
+		err := me.fetchUpload(ctx, src.String(), clientIP, dir, p, t)
+		me.uploads.updateTransfer(t, func(t *uploadTransfer) {
+			t.finished = time.Now()
+			switch {
+			case ctx.Err() != nil:
+				t.status = transferStopped
+			case err != nil:
+				t.status = transferError
+			default:
+				t.status = transferCompleted
+			}
+		})
+		if err != nil {
+			logger.Levelf(log.Warning, "error importing upload of %q: %v", p.name, err)
+			return
+		}
+		logger.Printf("imported upload of %q", p.name)
+	}()
+	return []soapArg{{Name: "TransferID", Value: strconv.FormatUint(uint64(id), 10)}}, nil
+}
+
+// Reports why the URL can't be fetched an upload from, for the control point at clientIP: it must
+// be an http URL on the control point itself.
+func uploadSourceAllowed(u *url.URL, clientIP string) error {
+	if u.Scheme != "http" || !net.ParseIP(u.Hostname()).Equal(net.ParseIP(clientIP)) {
+		return errors.New("not on the control point")
+	}
+	return nil
+}
+
+// Fetches the upload from src on the control point at clientIP. Redirects are only followed to
+// the control point too.
+func (srv *Server) fetchUpload(ctx context.Context, src, clientIP, dir string, p *pendingUpload, t *uploadTransfer) error {
+	client := newRemoteClient(func(u *url.URL) error {
+		return uploadSourceAllowed(u, clientIP)
+	})
+	// A stall is an error, unlike the transfer being stopped with ctx.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", src, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %q: %s", src, resp.Status)
+	}
+	srv.uploads.updateTransfer(t, func(t *uploadTransfer) {
+		if resp.ContentLength > 0 {
+			t.total = resp.ContentLength
+		}
+	})
+	_, err = srv.saveUpload(dir, p, &transferReader{stallTimeoutReader{resp.Body, cancel}, &srv.uploads, t})
+	return err
+}
+
+// Counts the bytes of an ImportResource transfer as they're received.
+type transferReader struct {
+	r       io.Reader
+	uploads *uploads
+	t       *uploadTransfer
+}
+
+func (me *transferReader) Read(b []byte) (n int, err error) {
+	n, err = me.r.Read(b)
+	me.uploads.updateTransfer(me.t, func(t *uploadTransfer) {
+		t.length += int64(n)
+	})
+	return
+}
+
+// The argument of GetTransferProgress and StopTransferResource.
+type transferID struct {
+	TransferID string `soap:"required"`
+}
+
+func (args *transferID) parse() (uint32, error) {
+	id, err := strconv.ParseUint(args.TransferID, 10, 32)
+	if err != nil {
+		return 0, upnp.Errorf(noSuchFileTransferErrorCode, "no such transfer %q", args.TransferID)
+	}
+	return uint32(id), nil
+}
+
+func (me *contentDirectoryService) getTransferProgress(args *transferID) ([]soapArg, error) {
+	id, err := args.parse()
+	if err != nil {
+		return nil, err
+	}
+	t, ok := me.uploads.transfer(id)
+	if !ok {
+		return nil, upnp.Errorf(noSuchFileTransferErrorCode, "no such transfer %d", id)
+	}
+	return []soapArg{
+		{Name: "TransferStatus", Value: t.status},
+		{Name: "TransferLength", Value: strconv.FormatInt(t.length, 10)},
+		{Name: "TransferTotal", Value: strconv.FormatInt(t.total, 10)},
+	}, nil
+}
+
+func (me *contentDirectoryService) stopTransferResource(args *transferID) ([]soapArg, error) {
+	id, err := args.parse()
+	if err != nil {
+		return nil, err
+	}
+	t, ok := me.uploads.transfer(id)
+	if !ok {
+		return nil, upnp.Errorf(noSuchFileTransferErrorCode, "no such transfer %d", id)
+	}
+	if t.status != transferInProgress {
+		return nil, upnp.Errorf(noSuchFileTransferErrorCode, "transfer %d isn't in progress", id)
+	}
+	t.stop()
+	return []soapArg{}, nil
+}
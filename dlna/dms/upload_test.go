@@ -0,0 +1,104 @@
+package dms
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/log"
+)
+
+func TestUploadFileName(t *testing.T) {
+	for _, c := range []struct {
+		title, protocolInfo string
+		want                string
+		ok                  bool
+	}{
+		{"IMG_0001", "http-get:*:image/jpeg:*", "IMG_0001.jpg", true},
+		{"clip.MOV", "http-get:*:video/quicktime:*", "clip.MOV", true},
+		{"clip.mp4", "", "clip.mp4", true},
+		{"../../etc/passwd", "http-get:*:video/mp4:*", "_.._etc_passwd.mp4", true},
+		{"", "http-get:*:audio/mpeg:*", "upload.mp3", true},
+		{"notes", "http-get:*:text/plain:*", "", false},
+		{"notes.txt", "", "", false},
+	} {
+		got, ok := uploadFileName(c.title, c.protocolInfo)
+		if got != c.want || ok != c.ok {
+			t.Errorf("%q, %q: got %q, %v, want %q, %v", c.title, c.protocolInfo, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestUnusedFileName(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.jpg"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := unusedFileName(dir, "b.jpg", nil); got != "b.jpg" {
+		t.Errorf("got %q", got)
+	}
+	if got := unusedFileName(dir, "a.jpg", map[string]bool{"a (2).jpg": true}); got != "a (3).jpg" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestServeUpload(t *testing.T) {
+	dir := t.TempDir()
+	srv := &Server{AllowUpload: true, UploadDir: dir, Logger: log.Default}
+	srv.metrics = newServerMetrics(srv)
+	token, name := srv.uploads.add(dir, "clip.mp4")
+	var apiToken string
+	put := func(user string) int {
+		r := httptest.NewRequest("PUT", uploadPath+"?id="+token, strings.NewReader("clip"))
+		r.RemoteAddr = "192.168.1.20:4000"
+		r.Header.Set("Origin", "http://"+r.Host)
+		if user != "" {
+			r.SetBasicAuth(user, "secret")
+		}
+		if apiToken != "" {
+			r.Header.Set("Authorization", "Bearer "+apiToken)
+		}
+		w := httptest.NewRecorder()
+		srv.serveUpload(w, r)
+		return w.Code
+	}
+	// Anyone could send a file to the importUri otherwise.
+	if code := put(""); code != http.StatusForbidden {
+		t.Errorf("upload without a web user got %d", code)
+	}
+	// Nor with a token nobody's known to have added.
+	if err := srv.apiTokens.Load(filepath.Join(t.TempDir(), "tokens.json")); err != nil {
+		t.Fatal(err)
+	}
+	apiToken, err := srv.apiTokens.Add("old", []string{APIScopeAdmin}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := put(""); code != http.StatusForbidden {
+		t.Errorf("upload with a token of unknown origin got %d", code)
+	}
+	apiToken = ""
+	srv.WebUsers = []WebUser{
+		{Name: "admin", Password: "secret", Scopes: []string{APIScopeAdmin}},
+		{Name: "guest", Password: "secret", Scopes: []string{APIScopeBrowse}},
+	}
+	if code := put(""); code != http.StatusUnauthorized {
+		t.Errorf("upload without logging in got %d", code)
+	}
+	if code := put("guest"); code != http.StatusForbidden {
+		t.Errorf("upload by a browse user got %d", code)
+	}
+	if code := put("admin"); code != http.StatusCreated {
+		t.Fatalf("upload got %d", code)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != "clip" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+	// The importUri can only be used once.
+	if code := put("admin"); code != http.StatusNotFound {
+		t.Errorf("second upload got %d", code)
+	}
+}
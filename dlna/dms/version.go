@@ -0,0 +1,179 @@
+package dms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// Set when building releases, with -ldflags "-X github.com/anacrolix/dms/dlna/dms.version=v1.6.0".
+var version string
+
+// Returns the version of dms, such as v1.6.0. Without one set at build time it's that of the
+// module, as when installed with go install, or "devel".
+func Version() string {
+	if version != "" {
+		return version
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Path == "github.com/anacrolix/dms" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		return bi.Main.Version
+	}
+	return "devel"
+}
+
+const (
+	// Where the latest release is asked for. Nothing identifying the server is sent.
+	latestReleaseURL = "https://api.github.com/repos/anacrolix/dms/releases/latest"
+	// Where the new release is linked to in the web UI.
+	releasesPageURL     = "https://github.com/anacrolix/dms/releases"
+	updateCheckInterval = 24 * time.Hour
+	// How often whether it's time to check, or checking has been enabled, is looked at.
+	updateCheckTick    = time.Hour
+	updateCheckTimeout = 30 * time.Second
+)
+
+// The result of checking for a newer release.
+type updateCheck struct {
+	mu      sync.Mutex
+	checked time.Time
+	// The tag of the latest release if it's newer than the running version.
+	newRelease string
+	url        string
+	httpc      http.Client
+}
+
+func (me *updateCheck) get() string {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.newRelease
+}
+
+// Asks for the tag of the latest release. Only a plain User-Agent goes with it.
+func (me *updateCheck) fetchLatest(ctx context.Context) (string, error) {
+	url := me.url
+	if url == "" {
+		url = latestReleaseURL
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", userAgentProduct)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := me.httpc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&release); err != nil {
+		return "", err
+	}
+	if release.TagName == "" {
+		return "", fmt.Errorf("no tag in latest release")
+	}
+	return release.TagName, nil
+}
+
+// Checks for a newer release than the running version if CheckUpdates is set and it hasn't been
+// checked for a day.
+func (srv *Server) checkUpdate() {
+	enabled := srv.settings().CheckUpdates
+	me := &srv.updates
+	me.mu.Lock()
+	due := time.Since(me.checked) >= updateCheckInterval
+	if enabled && due {
+		me.checked = time.Now()
+	}
+	me.mu.Unlock()
+	if !enabled || !due {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), updateCheckTimeout)
+	defer cancel()
+	latest, err := me.fetchLatest(ctx)
+	if err != nil {
+		srv.Logger.Levelf(log.Debug, "error checking for a new release: %v", err)
+		return
+	}
+	var newRelease string
+	if c, ok := compareVersions(latest, Version()); ok && c > 0 {
+		newRelease = latest
+	}
+	me.mu.Lock()
+	old := me.newRelease
+	me.newRelease = newRelease
+	me.mu.Unlock()
+	if newRelease != "" && newRelease != old {
+		srv.Logger.Levelf(log.Info, "new release %s available, running %s", newRelease, Version())
+	}
+}
+
+func (srv *Server) monitorUpdates() {
+	ticker := time.NewTicker(updateCheckTick)
+	defer ticker.Stop()
+	for {
+		srv.checkUpdate()
+		select {
+		case <-srv.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Parses a version such as v1.6.0 or v1.6.1-0.20240101000000-abcdef, into its major, minor and
+// patch numbers and whether it's a prerelease.
+func parseVersion(s string) (nums [3]int, prerelease bool, ok bool) {
+	s = strings.TrimPrefix(s, "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, pre, _ := strings.Cut(s, "-")
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return
+		}
+		nums[i] = n
+	}
+	return nums, pre != "", true
+}
+
+// Compares versions, returning a positive number if a is newer than b. Prereleases of the same
+// version are taken to be equal. It's false if either isn't a version, such as "devel".
+func compareVersions(a, b string) (int, bool) {
+	an, apre, aok := parseVersion(a)
+	bn, bpre, bok := parseVersion(b)
+	if !aok || !bok {
+		return 0, false
+	}
+	for i := range an {
+		if an[i] != bn[i] {
+			return an[i] - bn[i], true
+		}
+	}
+	switch {
+	case apre && !bpre:
+		return -1, true
+	case !apre && bpre:
+		return 1, true
+	}
+	return 0, true
+}
@@ -0,0 +1,60 @@
+package dms
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anacrolix/log"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+		ok   bool
+	}{
+		{"v1.6.0", "v1.5.2", 1, true},
+		{"v1.5.2", "v1.6.0", -1, true},
+		{"v1.6.0", "v1.6.0", 0, true},
+		{"v1.10.0", "v1.9.0", 1, true},
+		{"v1.6.1", "v1.6.1-0.20240101000000-abcdef012345", 1, true},
+		{"v1.6.0", "v1.6.1-0.20240101000000-abcdef012345+dirty", -1, true},
+		{"v1.6.0", "devel", 0, false},
+	} {
+		c, ok := compareVersions(tc.a, tc.b)
+		if ok != tc.ok || (c > 0) != (tc.want > 0) || (c < 0) != (tc.want < 0) {
+			t.Errorf("compareVersions(%q, %q) = %d, %v", tc.a, tc.b, c, ok)
+		}
+	}
+}
+
+func TestCheckUpdate(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if len(r.URL.RawQuery) != 0 || r.Header.Get("User-Agent") != userAgentProduct || len(r.Cookies()) != 0 {
+			t.Errorf("identifying request: %v %v", r.URL, r.Header)
+		}
+		io.WriteString(w, `{"tag_name": "v999.0.0", "html_url": "https://example.com"}`)
+	}))
+	defer ts.Close()
+	version = "v1.0.0"
+	defer func() { version = "" }()
+	srv := &Server{Logger: log.Default}
+	srv.updates.url = ts.URL
+	srv.checkUpdate()
+	if requests != 0 {
+		t.Fatal("checked without CheckUpdates")
+	}
+	srv.CheckUpdates = true
+	srv.checkUpdate()
+	if got := srv.updates.get(); got != "v999.0.0" {
+		t.Errorf("new release %q", got)
+	}
+	srv.checkUpdate()
+	if requests != 1 {
+		t.Errorf("checked %d times within a day", requests)
+	}
+}
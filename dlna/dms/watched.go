@@ -0,0 +1,338 @@
+package dms
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dms/upnp"
+	"github.com/anacrolix/dms/upnpav"
+)
+
+const (
+	apiWatchedPath = "/api/watched"
+	// Object paths of the containers of the videos that have been watched and those that haven't,
+	// in the top level. Directories of the same names in the shared directory are hidden by them.
+	watchedPath    = "/@watched"
+	watchedTitle   = "Watched"
+	unwatchedPath  = "/@unwatched"
+	unwatchedTitle = "Unwatched"
+)
+
+// A video that was streamed to the end, or marked as watched through the API.
+type watchedItem struct {
+	// The object path of the item.
+	Path    string
+	Watched time.Time
+}
+
+// The videos that have been watched, by object path. Renderers have no way of keeping track of
+// this themselves, so it's recorded for the whole server rather than for each client.
+type watchedItems struct {
+	mu sync.Mutex
+	// File the watched items are persisted in, if any.
+	path  string
+	items map[string]time.Time
+	// Counts the changes, so that pages of titles arranged by them can be kept until the next.
+	changed uint64
+}
+
+func (me *watchedItems) load(path string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.path = path
+	me.items = make(map[string]time.Time)
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var items []watchedItem
+	if err := json.Unmarshal(b, &items); err != nil {
+		return err
+	}
+	for _, i := range items {
+		me.items[i.Path] = i.Watched
+	}
+	return nil
+}
+
+// Marks the item at the object path as watched, or as not watched. It returns false if that
+// didn't change anything.
+func (me *watchedItems) set(objectPath string, watched bool) (bool, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if _, ok := me.items[objectPath]; ok == watched {
+		return false, nil
+	}
+	if watched {
+		me.items[objectPath] = time.Now()
+	} else {
+		delete(me.items, objectPath)
+	}
+	me.changed++
+	return true, me.save()
+}
+
+// Returns the number of changes made, which differs whenever the watched items do.
+func (me *watchedItems) changes() uint64 {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.changed
+}
+
+func (me *watchedItems) has(objectPath string) bool {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	_, ok := me.items[objectPath]
+	return ok
+}
+
+// Returns the watched items, the most recently watched first.
+func (me *watchedItems) list() (ret []watchedItem) {
+	me.mu.Lock()
+	for p, t := range me.items {
+		ret = append(ret, watchedItem{p, t})
+	}
+	me.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if !ret[i].Watched.Equal(ret[j].Watched) {
+			return ret[i].Watched.After(ret[j].Watched)
+		}
+		return ret[i].Path < ret[j].Path
+	})
+	return
+}
+
+func (me *watchedItems) save() error {
+	if me.path == "" {
+		return nil
+	}
+	items := make([]watchedItem, 0, len(me.items))
+	for p, t := range me.items {
+		items = append(items, watchedItem{p, t})
+	}
+	b, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(me.path), 0o750); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(me.path), filepath.Base(me.path))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), me.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Prefixes the titles of watched items with WatchedPrefix.
+type watchedMarks struct {
+	items  *watchedItems
+	prefix string
+}
+
+func (me watchedMarks) arrange(obj interface{}) interface{} {
+	item, ok := obj.(upnpav.Item)
+	if !ok || me.prefix == "" {
+		return obj
+	}
+	// Items listed elsewhere too, such as in Recently Played, refer to the item they are.
+	id := item.ID
+	if item.RefID != "" {
+		id = item.RefID
+	}
+	if !me.items.has(objectIDPath(id)) {
+		return obj
+	}
+	item.Title = me.prefix + item.Title
+	return item
+}
+
+func (srv *Server) watchedMarks() watchedMarks {
+	return watchedMarks{&srv.watched, srv.settings().WatchedPrefix}
+}
+
+// Sets Watched in the API objects of the items that have been watched.
+func (srv *Server) watchedAPIObjects(objs []apiObject) {
+	for i := range objs {
+		o := &objs[i]
+		id := o.ID
+		if o.RefID != "" {
+			id = o.RefID
+		}
+		o.Watched = !o.Container && srv.watched.has(objectIDPath(id))
+	}
+}
+
+// Whether the Watched and Unwatched containers are listed.
+func (srv *Server) watchedContainersListed() bool {
+	return srv.settings().WatchedContainers
+}
+
+// Whether the object path is one of the watched containers or within them.
+func isWatchedPath(p string) bool {
+	for _, c := range []string{watchedPath, unwatchedPath} {
+		if p == c || strings.HasPrefix(p, c+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the object paths of the videos in the Watched or Unwatched container, or false if
+// there's no such container. Unwatched videos are those in the index, so it needs it.
+func (me *contentDirectoryService) watchedMedia(containerPath string) ([]string, bool) {
+	if !me.watchedContainersListed() {
+		return nil, false
+	}
+	switch containerPath {
+	case watchedPath:
+		var ret []string
+		for _, i := range me.watched.list() {
+			ret = append(ret, i.Path)
+		}
+		return ret, true
+	case unwatchedPath:
+		if me.index == nil {
+			return nil, false
+		}
+		var ret []string
+		for _, p := range me.classMedia()["video"] {
+			if !me.watched.has(p) {
+				ret = append(ret, p)
+			}
+		}
+		return ret, true
+	}
+	return nil, false
+}
+
+// Returns the watched containers that have anything in them, for the top level.
+func (me *contentDirectoryService) watchedContainers() (ret []interface{}) {
+	for _, c := range []struct{ path, title string }{
+		{watchedPath, watchedTitle},
+		{unwatchedPath, unwatchedTitle},
+	} {
+		if paths, _ := me.watchedMedia(c.path); len(paths) != 0 {
+			ret = append(ret, recentContainer(c.path, me.localTitle(c.title), len(paths)))
+		}
+	}
+	return
+}
+
+// Returns the number of top level objects the watched containers add.
+func (me *contentDirectoryService) watchedChildCount() int {
+	return len(me.watchedContainers())
+}
+
+// Splits an object path within the watched containers into the container and the object path of
+// the media, if it's of media in one.
+func splitWatchedPath(p string) (containerPath, mediaPath string) {
+	for _, c := range []string{watchedPath, unwatchedPath} {
+		if rest := strings.TrimPrefix(p, c); rest != p {
+			return c, rest
+		}
+	}
+	return p, ""
+}
+
+// Returns the items in a watched container, the most recently watched first, or the unwatched
+// ones by title.
+func (me *contentDirectoryService) readWatchedContainer(o object, host, userAgent string) ([]interface{}, error) {
+	paths, ok := me.watchedMedia(o.Path)
+	if !ok {
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such watched container")
+	}
+	var ret []interface{}
+	for _, p := range paths {
+		if item, ok := me.referringItem(o.Path, p, host, userAgent); ok {
+			ret = append(ret, item)
+		}
+	}
+	if o.Path == unwatchedPath {
+		ret = me.sortObjects(ret, []sortKey{{property: "dc:title"}})
+	}
+	return ret, nil
+}
+
+// Returns the object for an object path within the watched containers, as given to
+// BrowseMetadata.
+func (me *contentDirectoryService) watchedObject(o object, host, userAgent string) (interface{}, error) {
+	containerPath, mediaPath := splitWatchedPath(o.Path)
+	if mediaPath == "" {
+		for _, c := range me.watchedContainers() {
+			if c.(upnpav.Container).ID == o.ID() {
+				return c, nil
+			}
+		}
+		return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such watched container")
+	}
+	paths, _ := me.watchedMedia(containerPath)
+	for _, p := range paths {
+		if p == mediaPath {
+			if item, ok := me.referringItem(containerPath, p, host, userAgent); ok {
+				return item, nil
+			}
+		}
+	}
+	return nil, upnp.Errorf(upnpav.NoSuchObjectErrorCode, "no such watched media")
+}
+
+// Lists the watched items, or whether the item with the path query parameter was watched. PUT
+// marks the item as watched, and DELETE as not watched.
+func (me *Server) serveAPIWatched(w http.ResponseWriter, r *http.Request) {
+	if !me.authorizeAPI(w, r, APIScopePlayback) {
+		return
+	}
+	p := ""
+	if q := r.URL.Query().Get("path"); q != "" {
+		p = path.Clean("/" + decodeObjectPath(q))
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT", "DELETE":
+		if p == "" || p == "/" {
+			me.writeAPIError(w, r, upnp.Errorf(upnp.ArgumentValueInvalidErrorCode, "no path"))
+			return
+		}
+		if _, err := me.watched.set(p, r.Method == "PUT"); err != nil {
+			me.writeAPIError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ret := []watchedItem{}
+	for _, i := range me.watched.list() {
+		if p == "" || i.Path == p {
+			ret = append(ret, i)
+		}
+	}
+	me.writeAPIResponse(w, r, ret)
+}
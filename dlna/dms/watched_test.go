@@ -0,0 +1,41 @@
+package dms
+
+import (
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/dms/upnpav"
+)
+
+func TestWatchedItems(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "watched.json")
+	var w watchedItems
+	if err := w.load(p); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := w.set("/Films/a.mkv", true); !ok || err != nil {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	if ok, _ := w.set("/Films/a.mkv", true); ok {
+		t.Error("watched twice")
+	}
+	w.set("/Films/b.mkv", true)
+	w.set("/Films/b.mkv", false)
+	var loaded watchedItems
+	if err := loaded.load(p); err != nil {
+		t.Fatal(err)
+	}
+	if l := loaded.list(); len(l) != 1 || l[0].Path != "/Films/a.mkv" {
+		t.Errorf("loaded %v", l)
+	}
+	marks := watchedMarks{&loaded, "* "}
+	item := upnpav.Item{Object: upnpav.Object{ID: url.QueryEscape(recentlyPlayedPath + "/Films/a.mkv"), RefID: url.QueryEscape("/Films/a.mkv"), Title: "A"}}
+	if got := marks.arrange(item).(upnpav.Item).Title; got != "* A" {
+		t.Errorf("got %q", got)
+	}
+	item.ID, item.RefID = url.QueryEscape("/Films/b.mkv"), ""
+	if got := marks.arrange(item).(upnpav.Item).Title; got != "A" {
+		t.Errorf("unwatched item titled %q", got)
+	}
+}
@@ -0,0 +1,352 @@
+package dms
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// A person who uses the web UI and API, logging in with a password by Basic or Digest
+// authentication, as browsers prompt for.
+type WebUser struct {
+	Name     string
+	Password string
+	// What the user may do, as for API tokens.
+	Scopes []string
+}
+
+func (me WebUser) allows(scope string) bool {
+	return scopesAllow(me.Scopes, scope)
+}
+
+// Reports whether the request isn't from a page on another site. Browsers send the credentials
+// they have for dms, and its cookies, with forms and requests from other sites too, so those that
+// change things check this, including the setup page. It goes by the Origin, or else by
+// Sec-Fetch-Site or the Referer. Requests that change things without any of them are refused,
+// unless they have a bearer token, which browsers don't send by themselves.
+func SameOrigin(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return origin == "http://"+r.Host || origin == "https://"+r.Host
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "":
+	case "same-origin", "none":
+		return true
+	default:
+		return false
+	}
+	if referer := r.Header.Get("Referer"); referer != "" {
+		u, err := url.Parse(referer)
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host == r.Host
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	return len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ")
+}
+
+// WebUIAuth value for a path anyone allowed may use without logging in.
+const WebUIAuthNone = "none"
+
+const (
+	webAuthRealm = "dms"
+	// How long a Digest nonce is good for, after which browsers are told to retry with a new one
+	// without prompting again.
+	digestNonceLifetime = 10 * time.Minute
+)
+
+// The scopes web UI paths require once there are WebUsers, where it's not browse.
+var defaultWebUIAuth = map[string]string{
+	// Logs show what clients are at, and where things are on disk.
+	logPath: APIScopeAdmin,
+	// Uploads add files to the shared directories.
+	uploadPath: APIScopeAdmin,
+}
+
+func (srv *Server) initWebUsers() error {
+	// It can be reached from beyond the LAN, where the web UI mustn't be open.
+	if srv.AdminConn != nil && len(srv.WebUsers) == 0 {
+		return errors.New("AdminConn requires WebUsers")
+	}
+	names := make(map[string]bool, len(srv.WebUsers))
+	for _, u := range srv.WebUsers {
+		if u.Name == "" || strings.ContainsAny(u.Name, ":\\\"") {
+			return fmt.Errorf("bad web user name %q", u.Name)
+		}
+		if names[u.Name] {
+			return fmt.Errorf("web user %q is given twice", u.Name)
+		}
+		names[u.Name] = true
+		if u.Password == "" {
+			return fmt.Errorf("web user %q has no password", u.Name)
+		}
+		for _, s := range u.Scopes {
+			if !isAPIScope(s) {
+				return fmt.Errorf("web user %q has unknown scope %q", u.Name, s)
+			}
+		}
+	}
+	for path, scope := range srv.WebUIAuth {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("bad web UI path %q", path)
+		}
+		if scope != WebUIAuthNone && !isAPIScope(scope) {
+			return fmt.Errorf("unknown scope %q for %s, want %s or %s", scope, path, strings.Join(APIScopes, ", "), WebUIAuthNone)
+		}
+	}
+	return nil
+}
+
+// Returns the scope the web UI path, as it's routed, requires.
+func webUIScope(auth map[string]string, pattern string) string {
+	if s, ok := auth[pattern]; ok {
+		return s
+	}
+	if s, ok := defaultWebUIAuth[pattern]; ok {
+		return s
+	}
+	return APIScopeBrowse
+}
+
+// Reports whether the web UI request may be served, asking for a login if it may not. Until there
+// are WebUsers, the web UI is open, and only the API checks for tokens.
+func (me *Server) authorizeWebUI(w http.ResponseWriter, r *http.Request) bool {
+	_, pattern := me.webUIServeMux.Handler(r)
+	s := me.settings()
+	users := len(s.WebUsers)
+	scope := webUIScope(s.WebUIAuth, pattern)
+	if users == 0 || scope == WebUIAuthNone {
+		return true
+	}
+	return me.authorize(w, r, scope)
+}
+
+// Reports whether the request to AdminConn may be served, asking for a login if it may not. It can
+// be reached from beyond the LAN, so every path needs a login or token, even those WebUIAuth leaves
+// open.
+func (me *Server) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	_, pattern := me.adminServeMux.Handler(r)
+	scope := webUIScope(me.settings().WebUIAuth, pattern)
+	if scope == WebUIAuthNone {
+		scope = APIScopeBrowse
+	}
+	_, ok := me.checkCredentials(w, r, scope, true)
+	return ok
+}
+
+// The highest nonce-count each Digest nonce has been used with. Each use of a nonce must count
+// higher than the last, so that a request that's been seen can't be replayed. Nonces are forgotten
+// once they expire, when they're refused anyway.
+type digestNonceCounts struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+	swept  time.Time
+}
+
+// Records a use of the nonce with the count, reporting whether it's higher than the nonce's last.
+func (me *digestNonceCounts) use(nonce string, nc uint64, now time.Time) bool {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if now.Sub(me.swept) >= digestNonceLifetime {
+		for n := range me.counts {
+			if made, ok := digestNonceTime(n); !ok || now.Sub(made) >= digestNonceLifetime {
+				delete(me.counts, n)
+			}
+		}
+		me.swept = now
+	}
+	if last, ok := me.counts[nonce]; ok && nc <= last {
+		return false
+	}
+	if me.counts == nil {
+		me.counts = make(map[string]uint64)
+	}
+	me.counts[nonce] = nc
+	return true
+}
+
+// What requestWebUser found, kept with the request, since a request can be authorized more than
+// once, and its Digest nonce-count can only be used once.
+type webUserLogin struct {
+	user      WebUser
+	ok, stale bool
+}
+
+// Returns the WebUser the request logged in as, and whether it was a Digest login with a nonce that
+// has expired, or has been used with as high a nonce-count, which browsers retry with a new nonce.
+func (me *Server) requestWebUser(r *http.Request, now time.Time) (user WebUser, ok, stale bool) {
+	rc, _ := r.Context().Value(requestContextKey{}).(*requestContext)
+	if rc != nil && rc.webUserLogin != nil {
+		l := rc.webUserLogin
+		return l.user, l.ok, l.stale
+	}
+	user, ok, stale = me.checkWebUserLogin(r, now)
+	if rc != nil {
+		rc.webUserLogin = &webUserLogin{user, ok, stale}
+	}
+	return
+}
+
+func (me *Server) checkWebUserLogin(r *http.Request, now time.Time) (user WebUser, ok, stale bool) {
+	users := me.settings().WebUsers
+	find := func(name string) (WebUser, bool) {
+		for _, u := range users {
+			if u.Name == name {
+				return u, true
+			}
+		}
+		return WebUser{}, false
+	}
+	if name, password, basic := r.BasicAuth(); basic {
+		u, found := find(name)
+		return u, found && subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1, false
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Digest ") {
+		return
+	}
+	params := parseAuthParams(auth[7:])
+	u, found := find(params["username"])
+	if !found || params["realm"] != webAuthRealm || params["uri"] != r.RequestURI || params["qop"] != "auth" {
+		return
+	}
+	if !me.validDigestNonce(params["nonce"], now) {
+		// Browsers retry with the new nonce if told it's stale, rather than prompting.
+		return u, false, me.validDigestNonce(params["nonce"], time.Time{})
+	}
+	newHash := digestHash(params["algorithm"])
+	if newHash == nil {
+		return
+	}
+	h := func(s string) string {
+		hash := newHash()
+		hash.Write([]byte(s))
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+	ha1 := h(u.Name + ":" + webAuthRealm + ":" + u.Password)
+	ha2 := h(r.Method + ":" + params["uri"])
+	want := h(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2}, ":"))
+	if subtle.ConstantTimeCompare([]byte(want), []byte(params["response"])) != 1 {
+		return
+	}
+	nc, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil {
+		return
+	}
+	if !me.digestNonceCounts.use(params["nonce"], nc, now) {
+		me.requestLogger(r).Levelf(log.Warning, "Digest nonce-count %s of %q was used before", params["nc"], u.Name)
+		return u, false, true
+	}
+	return u, true, false
+}
+
+// Returns the hash of a Digest algorithm, or nil if it's not one that's supported.
+func digestHash(algorithm string) func() hash.Hash {
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+// Makes the key Digest nonces are signed with. Logins carry over reloads, but not restarts.
+func (srv *Server) initDigestKey() error {
+	srv.digestKey = make([]byte, 32)
+	_, err := rand.Read(srv.digestKey)
+	return err
+}
+
+// Returns a nonce for Digest authentication: the time it was made, signed, so that nothing needs
+// to be kept to check it.
+func (me *Server) digestNonce(now time.Time) string {
+	t := strconv.FormatInt(now.Unix(), 16)
+	mac := hmac.New(sha256.New, me.digestKey)
+	mac.Write([]byte(t))
+	return t + "." + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Returns the time a nonce made by digestNonce was made.
+func digestNonceTime(nonce string) (time.Time, bool) {
+	t, _, ok := strings.Cut(nonce, ".")
+	unix, err := strconv.ParseInt(t, 16, 64)
+	return time.Unix(unix, 0), ok && err == nil
+}
+
+// Reports whether the nonce was made by digestNonce, and hasn't expired by now, unless now is zero.
+func (me *Server) validDigestNonce(nonce string, now time.Time) bool {
+	made, ok := digestNonceTime(nonce)
+	if !ok || !hmac.Equal([]byte(nonce), []byte(me.digestNonce(made))) {
+		return false
+	}
+	return now.IsZero() || now.Sub(made) < digestNonceLifetime
+}
+
+// Asks for a login, by Digest, which doesn't send the password, or Basic, or an API token.
+func (me *Server) challengeLogin(w http.ResponseWriter, stale bool) {
+	users := len(me.settings().WebUsers)
+	if users != 0 {
+		nonce := me.digestNonce(time.Now())
+		for _, algorithm := range []string{"SHA-256", "MD5"} {
+			w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=%s, nonce="%s", stale=%t`, webAuthRealm, algorithm, nonce, stale))
+		}
+	}
+	w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, webAuthRealm))
+	w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, webAuthRealm))
+}
+
+// Parses the comma separated key=value parameters of an Authorization header, whose values may be
+// quoted.
+func parseAuthParams(s string) map[string]string {
+	ret := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq == -1 {
+			return ret
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " ")
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			value = b.String()
+			if i < len(s) {
+				i++
+			}
+			s = s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end == -1 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		ret[key] = value
+	}
+}
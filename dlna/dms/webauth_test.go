@@ -0,0 +1,174 @@
+package dms
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+func TestParseAuthParams(t *testing.T) {
+	got := parseAuthParams(`username="alice", realm="dms", nonce="a.b", uri="/status?a=1,2", qop=auth, nc=00000001, cnonce="x\"y"`)
+	want := map[string]string{
+		"username": "alice",
+		"realm":    "dms",
+		"nonce":    "a.b",
+		"uri":      "/status?a=1,2",
+		"qop":      "auth",
+		"nc":       "00000001",
+		"cnonce":   `x"y`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestRequestWebUser(t *testing.T) {
+	srv := &Server{WebUsers: []WebUser{{Name: "alice", Password: "secret", Scopes: []string{APIScopeBrowse}}}, Logger: log.Default}
+	if err := srv.initDigestKey(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	md5Hex := func(s string) string {
+		h := md5.Sum([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	digest := func(password, nonce, nc string) string {
+		ha1 := md5Hex("alice:dms:" + password)
+		ha2 := md5Hex("GET:/status")
+		response := md5Hex(ha1 + ":" + nonce + ":" + nc + ":abc:auth:" + ha2)
+		return fmt.Sprintf(`Digest username="alice", realm="dms", nonce="%s", uri="/status", qop=auth, nc=%s, cnonce="abc", response="%s"`, nonce, nc, response)
+	}
+	nonce := srv.digestNonce(now)
+	old := srv.digestNonce(now.Add(-digestNonceLifetime - time.Second))
+	for _, c := range []struct {
+		auth      string
+		ok, stale bool
+	}{
+		{digest("secret", nonce, "00000001"), true, false},
+		{digest("wrong", nonce, "00000002"), false, false},
+		// Replayed, and sent out of order.
+		{digest("secret", nonce, "00000001"), false, true},
+		{digest("secret", nonce, "00000003"), true, false},
+		{digest("secret", nonce, "00000002"), false, true},
+		{digest("secret", nonce, "0000000a"), true, false},
+		{digest("secret", nonce, "not hex"), false, false},
+		{digest("secret", old, "00000001"), false, true},
+		{digest("secret", "5f000000.0123", "00000001"), false, false},
+		{"Basic YWxpY2U6c2VjcmV0", true, false},
+		{"Basic YWxpY2U6d3Jvbmc=", false, false},
+		{"Bearer dms_abc", false, false},
+	} {
+		r := httptest.NewRequest("GET", "/status", nil)
+		r.Header.Set("Authorization", c.auth)
+		// A request is authorized again by handlers that check its scope themselves.
+		r = srv.withRequestContext(r)
+		for i := 0; i < 2; i++ {
+			u, ok, stale := srv.requestWebUser(r, now)
+			if ok != c.ok || stale != c.stale || ok && u.Name != "alice" {
+				t.Errorf("%s: got %v, %v, %v", c.auth, u.Name, ok, stale)
+			}
+		}
+	}
+}
+
+func TestWebUIScope(t *testing.T) {
+	auth := map[string]string{metricsPath: WebUIAuthNone, statusPath: APIScopeAdmin}
+	for pattern, want := range map[string]string{
+		metricsPath: WebUIAuthNone,
+		statusPath:  APIScopeAdmin,
+		logPath:     APIScopeAdmin,
+		browsePath:  APIScopeBrowse,
+	} {
+		if got := webUIScope(auth, pattern); got != want {
+			t.Errorf("%s: got %q", pattern, got)
+		}
+	}
+}
+
+func TestAuthorizeAdmin(t *testing.T) {
+	srv := &Server{Logger: log.Default, AdminConn: dummyListener{}}
+	if err := srv.initWebUsers(); err == nil {
+		t.Fatal("AdminConn allowed without WebUsers")
+	}
+	srv.WebUsers = []WebUser{{Name: "guest", Password: "secret", Scopes: []string{APIScopeBrowse}}}
+	srv.WebUIAuth = map[string]string{metricsPath: WebUIAuthNone}
+	if err := srv.initWebUsers(); err != nil {
+		t.Fatal(err)
+	}
+	srv.metrics = newServerMetrics(srv)
+	srv.adminServeMux = http.NewServeMux()
+	srv.initWebUIMux(srv.adminServeMux)
+	for _, tc := range []struct {
+		path, user string
+		expected   int
+	}{
+		{statusPath, "", http.StatusUnauthorized},
+		{browsePath, "", http.StatusUnauthorized},
+		{logPath, "", http.StatusUnauthorized},
+		// Left open on the LAN, but not beyond it.
+		{metricsPath, "", http.StatusUnauthorized},
+		{metricsPath, "guest", http.StatusOK},
+		{statusPath, "guest", http.StatusOK},
+		{logPath, "guest", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, "secret")
+		}
+		w := httptest.NewRecorder()
+		if srv.authorizeAdmin(w, r) {
+			w.WriteHeader(http.StatusOK)
+		}
+		if w.Code != tc.expected {
+			t.Errorf("%+v: got %d", tc, w.Code)
+		}
+	}
+	// Should the WebUsers be taken away, it's closed rather than open.
+	srv.WebUsers = nil
+	w := httptest.NewRecorder()
+	if srv.authorizeAdmin(w, httptest.NewRequest("GET", statusPath, nil)) {
+		t.Error("served without WebUsers")
+	}
+}
+
+type dummyListener struct{ net.Listener }
+
+func TestSameOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		method, header, value string
+		want                  bool
+	}{
+		{"POST", "Origin", "http://dms.local:1338", true},
+		{"POST", "Origin", "https://dms.local:1338", true},
+		{"POST", "Origin", "http://dms.local", false},
+		{"POST", "Origin", "http://evil.example", false},
+		{"POST", "Origin", "null", false},
+		{"POST", "Sec-Fetch-Site", "same-origin", true},
+		{"POST", "Sec-Fetch-Site", "cross-site", false},
+		{"POST", "Sec-Fetch-Site", "same-site", false},
+		{"POST", "Referer", "http://dms.local:1338/settings", true},
+		{"POST", "Referer", "http://evil.example/dms.local:1338", false},
+		{"POST", "Referer", "javascript://dms.local:1338", false},
+		// Stripped of everything that says where it's from.
+		{"POST", "", "", false},
+		{"POST", "Authorization", "Basic YWRtaW46c2VjcmV0", false},
+		{"POST", "Authorization", "Bearer dms_123", true},
+		{"GET", "", "", true},
+	} {
+		r := httptest.NewRequest(tc.method, "http://dms.local:1338/api/rescan", nil)
+		if tc.header != "" {
+			r.Header.Set(tc.header, tc.value)
+		}
+		if got := SameOrigin(r); got != tc.want {
+			t.Errorf("%s %s %q: got %v, want %v", tc.method, tc.header, tc.value, got, tc.want)
+		}
+	}
+}
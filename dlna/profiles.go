@@ -0,0 +1,228 @@
+package dlna
+
+import (
+	"strings"
+)
+
+// What a media file's DLNA profile depends on, in the terms ffprobe reports them.
+type MediaInfo struct {
+	// The container's format names, such as "mov,mp4,m4a,3gp,3g2,mj2" or "mpegts".
+	Format string
+	// Codec names, such as "h264" and "aac". Empty if the file has no such stream.
+	VideoCodec string
+	AudioCodec string
+	// The video codec's profile, such as "High" for H.264.
+	VideoProfile  string
+	Width, Height int
+	AudioChannels int
+	SampleRate    int
+}
+
+func (me MediaInfo) isFormat(names ...string) bool {
+	for _, f := range strings.Split(me.Format, ",") {
+		for _, n := range names {
+			if f == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether the video fits standard definition, which is what the _SD profiles allow.
+func (me MediaInfo) sd() bool {
+	return me.Width <= 720 && me.Height <= 576
+}
+
+func (me MediaInfo) fits(width, height int) bool {
+	return me.Width <= width && me.Height <= height
+}
+
+// Returns the name of the DLNA media format profile for DLNA.ORG_PN, such as
+// "AVC_MP4_MP_SD_AAC_MULT5", or "" if the file doesn't conform to one that is known. Strict
+// renderers reject resources whose protocolInfo lacks a profile they recognize.
+func ProfileName(mi MediaInfo) string {
+	switch {
+	case mi.VideoCodec != "" && mi.isFormat("image2", "jpeg_pipe", "png_pipe", "gif"):
+		return imageProfileName(mi)
+	case mi.VideoCodec != "":
+		return videoProfileName(mi)
+	case mi.AudioCodec != "":
+		return audioProfileName(mi)
+	}
+	return ""
+}
+
+func imageProfileName(mi MediaInfo) string {
+	switch mi.VideoCodec {
+	case "mjpeg":
+		switch {
+		case mi.fits(640, 480):
+			return "JPEG_SM"
+		case mi.fits(1024, 768):
+			return "JPEG_MED"
+		case mi.fits(4096, 4096):
+			return "JPEG_LRG"
+		}
+	case "png":
+		if mi.fits(4096, 4096) {
+			return "PNG_LRG"
+		}
+	case "gif":
+		if mi.fits(1600, 1200) {
+			return "GIF_LRG"
+		}
+	}
+	return ""
+}
+
+// The suffix of the AVC profiles for the audio they're allowed.
+func avcAudioSuffix(mi MediaInfo) string {
+	switch mi.AudioCodec {
+	case "aac":
+		if mi.AudioChannels <= 2 {
+			return "AAC"
+		}
+		if mi.AudioChannels <= 6 {
+			return "AAC_MULT5"
+		}
+	case "ac3":
+		return "AC3"
+	case "mp3":
+		return "MPEG1_L3"
+	}
+	return ""
+}
+
+func videoProfileName(mi MediaInfo) string {
+	switch {
+	case mi.VideoCodec == "mpeg2video" && mi.isFormat("mpegts"):
+		if mi.AudioCodec != "" && mi.AudioCodec != "ac3" && mi.AudioCodec != "mp2" {
+			return ""
+		}
+		switch {
+		case !mi.sd():
+			return "MPEG_TS_HD_NA"
+		case mi.Height == 576:
+			return "MPEG_TS_SD_EU"
+		}
+		return "MPEG_TS_SD_NA"
+	case mi.VideoCodec == "mpeg2video" && mi.isFormat("mpeg"):
+		if !mi.sd() {
+			return ""
+		}
+		if mi.Height == 576 {
+			return "MPEG_PS_PAL"
+		}
+		return "MPEG_PS_NTSC"
+	case mi.VideoCodec == "mpeg1video" && mi.isFormat("mpeg"):
+		return "MPEG1"
+	case mi.VideoCodec == "h264" && mi.isFormat("mp4"):
+		return avcMP4ProfileName(mi)
+	case mi.VideoCodec == "h264" && mi.isFormat("mpegts"):
+		audio := avcAudioSuffix(mi)
+		if audio == "" {
+			return ""
+		}
+		if audio == "AAC" {
+			audio = "AAC_MULT5"
+		}
+		level := "SD"
+		if !mi.sd() {
+			level = "HD"
+		}
+		if mi.VideoProfile == "High" {
+			return "AVC_TS_HP_" + level + "_" + audio
+		}
+		return "AVC_TS_MP_" + level + "_" + audio
+	case mi.VideoCodec == "mpeg4" && mi.isFormat("mp4"):
+		if mi.AudioCodec != "aac" && mi.AudioCodec != "" {
+			return ""
+		}
+		if mi.VideoProfile == "Simple Profile" && mi.fits(352, 288) {
+			return "MPEG4_P2_MP4_SP_AAC"
+		}
+		if mi.sd() {
+			return "MPEG4_P2_MP4_ASP_AAC"
+		}
+	case mi.VideoCodec == "wmv3" && mi.isFormat("asf"):
+		if mi.AudioCodec == "wmapro" {
+			if mi.fits(1920, 1080) {
+				return "WMVHIGH_PRO"
+			}
+			return ""
+		}
+		switch {
+		case mi.AudioCodec != "wmav1" && mi.AudioCodec != "wmav2" && mi.AudioCodec != "":
+		case mi.sd():
+			return "WMVMED_FULL"
+		case mi.fits(1920, 1080):
+			return "WMVHIGH_FULL"
+		}
+	}
+	return ""
+}
+
+func avcMP4ProfileName(mi MediaInfo) string {
+	audio := avcAudioSuffix(mi)
+	switch {
+	case audio == "":
+		return ""
+	case mi.VideoProfile == "High":
+		if !mi.sd() && mi.AudioCodec == "aac" {
+			return "AVC_MP4_HP_HD_AAC"
+		}
+		return ""
+	case mi.sd():
+		if audio == "AAC" {
+			audio = "AAC_MULT5"
+		}
+		return "AVC_MP4_MP_SD_" + audio
+	case mi.AudioCodec != "aac":
+		return ""
+	case mi.fits(1280, 720):
+		return "AVC_MP4_MP_HD_720p_AAC"
+	case mi.fits(1920, 1080):
+		return "AVC_MP4_MP_HD_1080i_AAC"
+	}
+	return ""
+}
+
+func audioProfileName(mi MediaInfo) string {
+	stereo := mi.AudioChannels <= 2
+	switch mi.AudioCodec {
+	case "mp3":
+		switch mi.SampleRate {
+		case 32000, 44100, 48000:
+			return "MP3"
+		}
+		return "MP3X"
+	case "aac":
+		switch {
+		case mi.isFormat("mp4"):
+			if stereo && mi.SampleRate <= 48000 {
+				return "AAC_ISO_320"
+			}
+			return "AAC_MULT5_ISO"
+		case mi.isFormat("aac"):
+			if stereo && mi.SampleRate <= 48000 {
+				return "AAC_ADTS_320"
+			}
+			return "AAC_MULT5_ADTS"
+		}
+	case "ac3":
+		return "AC3"
+	case "wmav1", "wmav2":
+		if stereo && mi.SampleRate <= 48000 {
+			return "WMABASE"
+		}
+		return "WMAFULL"
+	case "wmapro":
+		return "WMAPRO"
+	case "pcm_s16be":
+		if stereo {
+			return "LPCM"
+		}
+	}
+	return ""
+}
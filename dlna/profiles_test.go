@@ -0,0 +1,33 @@
+package dlna
+
+import (
+	"testing"
+)
+
+func TestProfileName(t *testing.T) {
+	const mp4 = "mov,mp4,m4a,3gp,3g2,mj2"
+	for _, c := range []struct {
+		mi   MediaInfo
+		want string
+	}{
+		{MediaInfo{Format: mp4, VideoCodec: "h264", VideoProfile: "Main", Width: 720, Height: 480, AudioCodec: "aac", AudioChannels: 2}, "AVC_MP4_MP_SD_AAC_MULT5"},
+		{MediaInfo{Format: mp4, VideoCodec: "h264", VideoProfile: "Main", Width: 1280, Height: 720, AudioCodec: "aac", AudioChannels: 2}, "AVC_MP4_MP_HD_720p_AAC"},
+		{MediaInfo{Format: mp4, VideoCodec: "h264", VideoProfile: "High", Width: 1920, Height: 1080, AudioCodec: "aac", AudioChannels: 6}, "AVC_MP4_HP_HD_AAC"},
+		{MediaInfo{Format: mp4, VideoCodec: "h264", VideoProfile: "Main", Width: 720, Height: 480, AudioCodec: "opus", AudioChannels: 2}, ""},
+		{MediaInfo{Format: "mpegts", VideoCodec: "mpeg2video", Width: 1920, Height: 1080, AudioCodec: "ac3", AudioChannels: 6}, "MPEG_TS_HD_NA"},
+		{MediaInfo{Format: "mpegts", VideoCodec: "h264", VideoProfile: "High", Width: 1920, Height: 1080, AudioCodec: "ac3"}, "AVC_TS_HP_HD_AC3"},
+		{MediaInfo{Format: "mpeg", VideoCodec: "mpeg2video", Width: 720, Height: 576, AudioCodec: "mp2"}, "MPEG_PS_PAL"},
+		{MediaInfo{Format: "matroska,webm", VideoCodec: "h264", Width: 1920, Height: 1080, AudioCodec: "aac"}, ""},
+		{MediaInfo{Format: "mp3", AudioCodec: "mp3", AudioChannels: 2, SampleRate: 44100}, "MP3"},
+		{MediaInfo{Format: "mp3", AudioCodec: "mp3", AudioChannels: 1, SampleRate: 22050}, "MP3X"},
+		{MediaInfo{Format: mp4, AudioCodec: "aac", AudioChannels: 2, SampleRate: 44100}, "AAC_ISO_320"},
+		{MediaInfo{Format: "flac", AudioCodec: "flac", AudioChannels: 2, SampleRate: 44100}, ""},
+		{MediaInfo{Format: "image2", VideoCodec: "mjpeg", Width: 4000, Height: 3000}, "JPEG_LRG"},
+		{MediaInfo{Format: "image2", VideoCodec: "mjpeg", Width: 640, Height: 480}, "JPEG_SM"},
+		{MediaInfo{Format: "png_pipe", VideoCodec: "png", Width: 800, Height: 600}, "PNG_LRG"},
+	} {
+		if got := ProfileName(c.mi); got != c.want {
+			t.Errorf("%+v: got %q, want %q", c.mi, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+func getDefaultHttpsCertDir() string {
+	_user, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(_user.HomeDir, ".dms", "https")
+}
+
+// Loads the certificate to serve HTTPS with. Without HttpsCert and HttpsKey, a self-signed one is
+// used, made on the first run and kept in the default directory, so that clients that have been
+// told to trust it keep doing so.
+func (config *dmsConfig) httpsCertificate() (tls.Certificate, error) {
+	if config.HttpsCert != "" || config.HttpsKey != "" {
+		if config.HttpsCert == "" || config.HttpsKey == "" {
+			return tls.Certificate{}, errors.New("httpsCert and httpsKey must be given together")
+		}
+		return tls.LoadX509KeyPair(config.HttpsCert, config.HttpsKey)
+	}
+	dir := getDefaultHttpsCertDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if !errors.Is(err, os.ErrNotExist) {
+		return cert, err
+	}
+	if err := writeSelfSignedCertificate(certPath, keyPath); err != nil {
+		return tls.Certificate{}, fmt.Errorf("making self-signed certificate: %w", err)
+	}
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+// Writes a certificate and key for the host's name and addresses, signed by itself.
+func writeSelfSignedCertificate(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "dms " + hostname},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	// The addresses at the time, which is as good as it gets for clients that go by address.
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(certPath), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+// Opens the listener for HTTPS, and loads its certificate.
+func (config *dmsConfig) httpsListener() (net.Listener, *tls.Config, error) {
+	cert, err := config.httpsCertificate()
+	if err != nil {
+		return nil, nil, err
+	}
+	ln, err := net.Listen("tcp", config.Https)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ln, &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
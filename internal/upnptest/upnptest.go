@@ -0,0 +1,491 @@
+// Package upnptest is a minimal UPnP control point for end-to-end tests of the server: it finds
+// devices with M-SEARCH, fetches their descriptions, browses a ContentDirectory with SOAP, and
+// subscribes to services' events with GENA, as renderers and control points on the network do.
+package upnptest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/dms/upnp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	ssdpAddr = "239.255.255.250:1900"
+	// The most a device is asked to wait before answering a search, at random, in seconds.
+	searchMX = 1
+	// How often a search is sent again while there's no answer, as UDP may lose it.
+	searchInterval = time.Second
+	// The most that's read of a response.
+	maxResponse = 1 << 20
+	// How many events a subscription keeps that haven't been received.
+	eventBuffer = 16
+)
+
+// A control point that searches, and receives events, on an interface, such as the loopback one.
+type ControlPoint struct {
+	Interface net.Interface
+	// Used for the HTTP requests. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+func (me *ControlPoint) client() *http.Client {
+	if me.Client == nil {
+		return http.DefaultClient
+	}
+	return me.Client
+}
+
+// A response to an M-SEARCH.
+type SearchResponse struct {
+	Location string
+	// Such as "uuid:...::urn:schemas-upnp-org:device:MediaServer:1".
+	USN    string
+	Server string
+	Header http.Header
+	From   *net.UDPAddr
+}
+
+// Sends an M-SEARCH for the target, such as a device type, a UUID or "ssdp:all", to the multicast
+// group on the interface, and returns the first answer of that type. It returns an error if there
+// isn't one within the timeout.
+func (me *ControlPoint) Search(target string, timeout time.Duration) (*SearchResponse, error) {
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is bound to the interface's address, so that searches go out from it, and the
+	// server sees a sender it can reach.
+	laddr, err := me.ipv4Addr()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: laddr})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	p := ipv4.NewPacketConn(conn)
+	if err := p.SetMulticastInterface(&me.Interface); err != nil {
+		return nil, err
+	}
+	if err := p.SetMulticastLoopback(true); err != nil {
+		return nil, err
+	}
+	msg := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\nHOST: %s\r\nMAN: \"ssdp:discover\"\r\nMX: %d\r\nST: %s\r\n\r\n", ssdpAddr, searchMX, target)
+	deadline := time.Now().Add(timeout)
+	b := make([]byte, 65536)
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteTo([]byte(msg), group); err != nil {
+			return nil, err
+		}
+		next := time.Now().Add(searchInterval)
+		if next.After(deadline) {
+			next = deadline
+		}
+		conn.SetReadDeadline(next)
+		for {
+			n, from, err := conn.ReadFromUDP(b)
+			if isTimeout(err) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b[:n])), nil)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				continue
+			}
+			if target != "ssdp:all" && resp.Header.Get("ST") != target {
+				continue
+			}
+			return &SearchResponse{
+				Location: resp.Header.Get("LOCATION"),
+				USN:      resp.Header.Get("USN"),
+				Server:   resp.Header.Get("SERVER"),
+				Header:   resp.Header,
+				From:     from,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("no answer to search for %s within %v", target, timeout)
+}
+
+// Returns the first IPv4 address of the interface.
+func (me *ControlPoint) ipv4Addr() (net.IP, error) {
+	addrs, err := me.Interface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("no IPv4 address on %s", me.Interface.Name)
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// A device's description, and the location it was fetched from, which its URLs are relative to.
+type Device struct {
+	upnp.DeviceDesc
+	Location *url.URL
+}
+
+// A service of a device, with its URLs resolved.
+type Service struct {
+	// Such as "urn:schemas-upnp-org:service:ContentDirectory:1".
+	Type        string
+	SCPDURL     *url.URL
+	ControlURL  *url.URL
+	EventSubURL *url.URL
+}
+
+// Fetches the device description at the location.
+func (me *ControlPoint) Describe(location string) (*Device, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := me.client().Get(location)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	ret := &Device{Location: u}
+	if err := xml.Unmarshal(b, &ret.DeviceDesc); err != nil {
+		return nil, fmt.Errorf("parsing description: %w", err)
+	}
+	return ret, nil
+}
+
+// Returns the service of the type, such as "ContentDirectory", of any version.
+func (me *Device) Service(serviceType string) (*Service, error) {
+	for _, s := range me.Device.ServiceList {
+		urn, err := upnp.ParseServiceType(s.ServiceType)
+		if err != nil || urn.Type != serviceType {
+			continue
+		}
+		ret := &Service{Type: s.ServiceType}
+		for _, u := range []struct {
+			to  **url.URL
+			ref string
+		}{
+			{&ret.SCPDURL, s.SCPDURL},
+			{&ret.ControlURL, s.ControlURL},
+			{&ret.EventSubURL, s.EventSubURL},
+		} {
+			if *u.to, err = me.Location.Parse(u.ref); err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("no %s service in description", serviceType)
+}
+
+// Reads the body of a response, returning an error if it isn't 200 OK.
+func readResponse(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return b, fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL, resp.Status)
+	}
+	return b, nil
+}
+
+// Invokes the SOAP action on the service with the input arguments, in order, returning the output
+// arguments by name. Errors the action fails with are returned as *upnp.Error.
+func (me *ControlPoint) Call(s *Service, action string, args ...[2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%s xmlns:u="%s">`, action, s.Type)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+	req, err := http.NewRequest("POST", s.ControlURL.String(), &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPACTION", fmt.Sprintf(`"%s#%s"`, s.Type, action))
+	resp, err := me.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readResponse(resp)
+	var envelope struct {
+		Body struct {
+			Response struct {
+				Args []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:",any"`
+			ErrorCode        uint   `xml:"Fault>detail>UPnPError>errorCode"`
+			ErrorDescription string `xml:"Fault>detail>UPnPError>errorDescription"`
+		}
+	}
+	if xmlErr := xml.Unmarshal(b, &envelope); xmlErr == nil && envelope.Body.ErrorCode != 0 {
+		return nil, upnp.Errorf(envelope.Body.ErrorCode, "%s", envelope.Body.ErrorDescription)
+	} else if err == nil {
+		err = xmlErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string)
+	for _, arg := range envelope.Body.Response.Args {
+		ret[arg.XMLName.Local] = arg.Value
+	}
+	return ret, nil
+}
+
+// An object in the result of a Browse.
+type Object struct {
+	ID         string     `xml:"id,attr"`
+	ParentID   string     `xml:"parentID,attr"`
+	ChildCount int        `xml:"childCount,attr"`
+	Title      string     `xml:"title"`
+	Class      string     `xml:"class"`
+	Res        []Resource `xml:"res"`
+	// Whether it's a container rather than an item.
+	Container bool `xml:"-"`
+}
+
+// A resource of an object, to stream it from.
+type Resource struct {
+	ProtocolInfo string `xml:"protocolInfo,attr"`
+	Size         uint64 `xml:"size,attr"`
+	URL          string `xml:",chardata"`
+}
+
+// The output of a Browse.
+type BrowseResult struct {
+	// In the order they're given.
+	Objects      []Object
+	TotalMatches int
+	UpdateID     int
+}
+
+// Browses the ContentDirectory service for a page of the children of the object, or with metadata
+// true, for the object itself. A count of 0 asks for all of them.
+func (me *ControlPoint) Browse(cds *Service, objectID string, metadata bool, start, count int) (*BrowseResult, error) {
+	flag := "BrowseDirectChildren"
+	if metadata {
+		flag = "BrowseMetadata"
+	}
+	out, err := me.Call(cds, "Browse",
+		[2]string{"ObjectID", objectID},
+		[2]string{"BrowseFlag", flag},
+		[2]string{"Filter", "*"},
+		[2]string{"StartingIndex", strconv.Itoa(start)},
+		[2]string{"RequestedCount", strconv.Itoa(count)},
+		[2]string{"SortCriteria", ""},
+	)
+	if err != nil {
+		return nil, err
+	}
+	ret := &BrowseResult{}
+	if ret.TotalMatches, err = strconv.Atoi(out["TotalMatches"]); err != nil {
+		return nil, fmt.Errorf("TotalMatches: %w", err)
+	}
+	if ret.UpdateID, err = strconv.Atoi(out["UpdateID"]); err != nil {
+		return nil, fmt.Errorf("UpdateID: %w", err)
+	}
+	if ret.Objects, err = parseDIDL(out["Result"]); err != nil {
+		return nil, fmt.Errorf("parsing Result: %w", err)
+	}
+	if n, err := strconv.Atoi(out["NumberReturned"]); err != nil || n != len(ret.Objects) {
+		return nil, fmt.Errorf("NumberReturned %q with %d objects", out["NumberReturned"], len(ret.Objects))
+	}
+	return ret, nil
+}
+
+// Returns the containers and items of DIDL-Lite in order.
+func parseDIDL(didl string) (ret []Object, err error) {
+	d := xml.NewDecoder(strings.NewReader(didl))
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := t.(xml.StartElement)
+		if !ok || start.Name.Local != "container" && start.Name.Local != "item" {
+			continue
+		}
+		var o Object
+		if err := d.DecodeElement(&o, &start); err != nil {
+			return nil, err
+		}
+		o.Container = start.Name.Local == "container"
+		ret = append(ret, o)
+	}
+}
+
+// An event sent to a subscription.
+type Event struct {
+	Seq uint32
+	// The values of the variables, by name.
+	Properties map[string]string
+}
+
+// A subscription to a service's events.
+type Subscription struct {
+	SID string
+	// The events received. Those that arrive while eventBuffer others are waiting are dropped.
+	Events <-chan Event
+
+	cp   *ControlPoint
+	s    *Service
+	http *http.Server
+	// Closed once SID is set, as events can come as soon as the SUBSCRIBE is answered.
+	subscribed chan struct{}
+}
+
+// Subscribes to the service's events with GENA, receiving them on an HTTP server on the address the
+// host reaches the service from, until the subscription is closed.
+func (me *ControlPoint) Subscribe(s *Service, timeout time.Duration) (*Subscription, error) {
+	local, err := localAddrTo(s.EventSubURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(local.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan Event, eventBuffer)
+	ret := &Subscription{Events: events, cp: me, s: s, subscribed: make(chan struct{})}
+	ret.http = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-ret.subscribed
+		e, err := readEvent(r)
+		if err == nil && r.Header.Get("SID") != ret.SID {
+			err = fmt.Errorf("unknown SID %q", r.Header.Get("SID"))
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), http.StatusPreconditionFailed)
+			return
+		}
+		select {
+		case events <- e:
+		default:
+		}
+	})}
+	go ret.http.Serve(l)
+	req, err := http.NewRequest("SUBSCRIBE", s.EventSubURL.String(), nil)
+	if err != nil {
+		ret.http.Close()
+		return nil, err
+	}
+	req.Header.Set("CALLBACK", fmt.Sprintf("<http://%s/>", l.Addr()))
+	req.Header.Set("NT", "upnp:event")
+	req.Header.Set("TIMEOUT", fmt.Sprintf("Second-%d", timeout/time.Second))
+	ret.SID, err = me.subscribe(req)
+	close(ret.subscribed)
+	if err != nil {
+		ret.http.Close()
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (me *ControlPoint) subscribe(req *http.Request) (string, error) {
+	resp, err := me.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	if _, err := readResponse(resp); err != nil {
+		return "", err
+	}
+	sid := resp.Header.Get("SID")
+	if sid == "" {
+		return "", errors.New("no SID in response to SUBSCRIBE")
+	}
+	return sid, nil
+}
+
+// Returns the local address the host reaches hostport from. Nothing is sent.
+func localAddrTo(hostport string) (net.IP, error) {
+	c, err := net.Dial("udp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func readEvent(r *http.Request) (e Event, err error) {
+	if r.Method != "NOTIFY" || r.Header.Get("NT") != "upnp:event" || r.Header.Get("NTS") != "upnp:propchange" {
+		return e, fmt.Errorf("not an event: %s %s", r.Method, r.Header.Get("NTS"))
+	}
+	seq, err := strconv.ParseUint(r.Header.Get("SEQ"), 10, 32)
+	if err != nil {
+		return e, fmt.Errorf("SEQ: %w", err)
+	}
+	e.Seq = uint32(seq)
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxResponse))
+	if err != nil {
+		return e, err
+	}
+	var ps struct {
+		Properties []struct {
+			Variables []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:"property"`
+	}
+	if err := xml.Unmarshal(b, &ps); err != nil {
+		return e, err
+	}
+	e.Properties = make(map[string]string)
+	for _, p := range ps.Properties {
+		for _, v := range p.Variables {
+			e.Properties[v.XMLName.Local] = v.Value
+		}
+	}
+	return e, nil
+}
+
+// Unsubscribes, and stops receiving events.
+func (me *Subscription) Close() error {
+	defer me.http.Close()
+	req, err := http.NewRequest("UNSUBSCRIBE", me.s.EventSubURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("SID", me.SID)
+	resp, err := me.cp.client().Do(req)
+	if err != nil {
+		return err
+	}
+	_, err = readResponse(resp)
+	return err
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
@@ -14,11 +16,13 @@ import (
 	"os"
 	"os/signal"
 	"os/user"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -27,6 +31,8 @@ import (
 
 	"github.com/anacrolix/dms/dlna/dms"
 	"github.com/anacrolix/dms/rrcache"
+	"github.com/anacrolix/dms/ssdp"
+	"github.com/anacrolix/dms/transcode"
 )
 
 //go:embed "data/VGC Sonic.png"
@@ -34,7 +40,9 @@ var defaultIcon []byte
 
 type dmsConfig struct {
 	Path                string
+	Paths               []dms.RootDir
 	IfName              string
+	IfNames             []string
 	Http                string
 	FriendlyName        string
 	DeviceIcon          string
@@ -44,42 +52,369 @@ type dmsConfig struct {
 	NoTranscode         bool
 	ForceTranscodeTo    string
 	NoProbe             bool
+	NoPhotoGrouping     bool
+	PrefetchBrowse      bool
 	StallEventSubscribe bool
 	NotifyInterval      time.Duration
+	InterfacePriority   []string
+	StrmProxyUserAgents []string
+	LPCMUserAgents      []string
+	CheckUpdates        bool
+	RemoteStreams       []dms.RemoteStream
+	OpenHomeRenderer    string
+	ImageCacheDir       string
+	SimulatedLatency    time.Duration
+	SimulatedKbps       int
+	StreamKbps          int
+	TotalStreamKbps     int
+	MaxStreams          int
+	ShutdownTimeout     time.Duration
+	SOAPDumpClients     []string
+	SOAPDumpDir         string
+	PhotoPlaces         bool
+	RecentItems         int
+	KeepMissing         time.Duration
+	AllowUpload         bool
+	UploadDir           string
+	AllowDelete         bool
+	DeleteIps           string
+	DeleteIpNets        []*net.IPNet `json:"-"`
+	NotifyAddrs         []string
+	AudioProfiles       []dms.AudioProfile
+	HWAccel             transcode.HWAccel
+	IncompleteFiles     string
+	ProblemFiles        string
+	ResourceURLExpiry   time.Duration
+	ResourceURLKey      string
+	User                string
+	Group               string
+	TranscodeCacheDir   string
+	// Megabytes of transcodes to keep in TranscodeCacheDir.
+	TranscodeCacheSize  int
 	IgnoreHidden        bool
 	IgnoreUnreadable    bool
 	IgnorePaths         []string
-	AllowedIpNets       []*net.IPNet
+	IgnoreNomedia       bool
+	IncludePatterns     []string
+	ExcludePatterns     []string
+	AllowedIps          string
+	AllowedIpNets       []*net.IPNet `json:"-"`
 	AllowDynamicStreams bool
 	TranscodeLogPattern string
+	LogLevel            string
+	AdminHttp           string
+	AcmeHosts           []string
+	AcmeEmail           string
+	AcmeCacheDir        string
+	IndexPath           string
+	MetadataProviders   []string
+	// Where to keep the positions listeners are up to in audiobooks.
+	AudiobookPositionsPath string
+	// Where to keep the tokens for the REST API.
+	APITokensPath string
+	// Where to keep how far clients got through what they played.
+	BookmarksPath string
+	// Where to keep the display preferences of clients.
+	ClientPrefsPath string
+	// Shell commands to run on events, by event.
+	Hooks map[string][]string
+	// File to log each HTTP request to, in AccessLogFormat. Changing it requires a restart.
+	AccessLog       string
+	AccessLogFormat string
+	// Address to serve pprof profiles and runtime stats on. Changing it requires a restart.
+	DebugHttp string
+	// Interfaces, or patterns, to announce on though they're skipped, such as loopback.
+	SSDPAllowInterfaces []string
+	SSDPSkipVirtual     bool
+	// Address to serve HTTPS on as well, with the certificate and key in HttpsCert and HttpsKey, or
+	// a self-signed one if they're not given. Changing them requires a restart.
+	Https     string
+	HttpsCert string
+	HttpsKey  string
+	// People who log in to the web UI and API, and the scope each path requires of them.
+	WebUsers  []dms.WebUser
+	WebUIAuth map[string]string
+	// Which containers clients may browse, by address and User-Agent.
+	ClientRules []dms.ClientRule
+	// Containers listed as empty until clients are unlocked with the PIN, and for how long.
+	ProtectedContainers    []string
+	ParentalPIN            string
+	ParentalUnlockDuration time.Duration
+	// Language to title generated containers in and sort names for, and titles in place of its.
+	Locale          string
+	GeneratedTitles map[string]string
+	// MIME types given to clients by User-Agent in place of dms's own.
+	MimeTypeOverrides []dms.MimeTypeOverride
+	// List all the music, videos and photos in a container for each, with fixed ObjectIDs.
+	ClassContainers bool
+	// List the episodes of TV shows by series and season.
+	TVShows bool
+	// File to keep the videos that have been watched in.
+	WatchedPath string
+	// Put before the titles of watched videos.
+	WatchedPrefix string
+	// List the watched and unwatched videos in a container for each.
+	WatchedContainers bool
+	// File to record the SSDP messages received and sent in.
+	SSDPDump string
+	// CACHE-CONTROL max-age of SSDP announcements, and their multicast TTL. Changing them
+	// requires a restart.
+	SSDPMaxAge time.Duration
+	SSDPTTL    int
+	// The UPnP version to describe the device as. Changing it requires a restart.
+	UPnPVersion string
+	// Publish the play-to session as an MPRIS player on DBus. Changing it requires a restart.
+	MPRIS bool
 }
 
-func (config *dmsConfig) load(configPath string) {
+// Overlays the settings present in the JSON file at configPath onto config.
+func (config *dmsConfig) load(configPath string) error {
 	file, err := os.Open(configPath)
 	if err != nil {
-		log.Printf("config error (config file: '%s'): %v\n", configPath, err)
-		return
+		return fmt.Errorf("opening config file: %w", err)
 	}
 	defer file.Close()
+	// Paths and hooks in the file replace those from the flags, rather than being merged into
+	// them.
+	paths, hooks := config.Paths, config.Hooks
+	config.Paths, config.Hooks = nil, nil
 	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&config)
+	err = decoder.Decode(config)
+	if err != nil {
+		return fmt.Errorf("decoding config file %q: %w", configPath, err)
+	}
+	if config.Paths == nil {
+		config.Paths = paths
+	}
+	if config.Hooks == nil {
+		config.Hooks = hooks
+	}
+	return nil
+}
+
+// Fills in derived and default values after the flags and config file have been applied.
+func (config *dmsConfig) finish() error {
+	var err error
+	config.Path, err = filepath.Abs(config.Path)
 	if err != nil {
-		log.Printf("config error: %v\n", err)
+		return err
+	}
+	for i := range config.Paths {
+		config.Paths[i].Path, err = filepath.Abs(config.Paths[i].Path)
+		if err != nil {
+			return err
+		}
+	}
+	config.AllowedIpNets = makeIpNets(config.AllowedIps)
+	config.DeleteIpNets = makeIpNets(config.DeleteIps)
+	if config.TranscodeLogPattern == "" {
+		u, err := user.Current()
+		if err != nil {
+			return fmt.Errorf("unable to resolve current user: %q", err)
+		}
+		config.TranscodeLogPattern = filepath.Join(u.HomeDir, ".dms", "log", "[tsname]")
+	}
+	if _, err := config.logLevel(); err != nil {
+		return err
+	}
+	if len(config.AcmeHosts) != 0 && config.AdminHttp == "" {
+		return fmt.Errorf("acmeHosts requires adminHttp")
+	}
+	if config.Group != "" && config.User == "" {
+		return fmt.Errorf("group requires user")
+	}
+	if config.AllowUpload && config.UploadDir == "" {
+		return fmt.Errorf("allowUpload requires uploadDir")
+	}
+	if config.AllowDelete && len(config.DeleteIpNets) == 0 {
+		return fmt.Errorf("allowDelete requires deleteIps")
+	}
+	if config.SSDPMaxAge < 0 || config.NotifyInterval < 0 {
+		return fmt.Errorf("ssdpMaxAge and notifyInterval can't be negative")
+	}
+	if config.SSDPMaxAge != 0 && config.NotifyInterval > config.SSDPMaxAge/2 {
+		return fmt.Errorf("notifyInterval must be at most half ssdpMaxAge, or control points forget the server between announcements")
+	}
+	if config.SSDPTTL < 1 || config.SSDPTTL > 255 {
+		return fmt.Errorf("ssdpTTL must be from 1 to 255")
+	}
+	switch config.UPnPVersion {
+	case "", dms.UPnPVersion10, dms.UPnPVersion11, dms.UPnPVersion20:
+	default:
+		return fmt.Errorf("upnpVersion must be 1.0, 1.1 or 2.0")
+	}
+	return nil
+}
+
+// Logs the shared paths that can't be read, such as after switching to another user.
+func (config *dmsConfig) checkPathsReadable(logger log.Logger) {
+	paths := []string{config.Path}
+	if len(config.Paths) != 0 {
+		paths = nil
+		for _, rd := range config.Paths {
+			paths = append(paths, rd.Path)
+		}
+	}
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			logger.Levelf(log.Error, "can't read shared path: %v", err)
+			continue
+		}
+		f.Close()
+	}
+}
+
+func (config *dmsConfig) logLevel() (level log.Level, err error) {
+	if config.LogLevel == "" {
+		return log.Warning, nil
+	}
+	err = level.UnmarshalText([]byte(config.LogLevel))
+	return
+}
+
+func (config *dmsConfig) icons() (icons []dms.Icon, err error) {
+	for _, size := range config.DeviceIconSizes {
+		s := strings.Split(size, ":")
+		if len(s) != 1 && len(s) != 2 {
+			return nil, fmt.Errorf("bad device icon size: %q", size)
+		}
+		advertisedSize, err := strconv.Atoi(s[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad device icon size: %q", size)
+		}
+		actualSize := advertisedSize
+		if len(s) == 2 {
+			// Force actual icon size to be different from advertised
+			actualSize, err = strconv.Atoi(s[1])
+			if err != nil {
+				return nil, fmt.Errorf("bad device icon size: %q", size)
+			}
+		}
+		b, err := readIcon(config.DeviceIcon, uint(actualSize))
+		if err != nil {
+			return nil, err
+		}
+		icons = append(icons, dms.Icon{
+			Width:    advertisedSize,
+			Height:   advertisedSize,
+			Depth:    8,
+			Mimetype: "image/png",
+			Bytes:    b,
+		})
+	}
+	return
+}
+
+// Copies the settings that can be changed on a running server. The remainder (listen address,
+// interfaces, notify interval and cache path) only take effect on restart.
+func (config *dmsConfig) apply(srv *dms.Server, icons []dms.Icon) {
+	srv.FriendlyName = config.FriendlyName
+	srv.RootObjectPath = filepath.Clean(config.Path)
+	srv.RootDirs = append([]dms.RootDir(nil), config.Paths...)
+	srv.LogHeaders = config.LogHeaders
+	srv.NoTranscode = config.NoTranscode
+	srv.AllowDynamicStreams = config.AllowDynamicStreams
+	srv.ForceTranscodeTo = config.ForceTranscodeTo
+	srv.TranscodeLogPattern = config.TranscodeLogPattern
+	srv.AccessLogFormat = config.AccessLogFormat
+	srv.NoProbe = config.NoProbe
+	srv.NoPhotoGrouping = config.NoPhotoGrouping
+	srv.PrefetchBrowse = config.PrefetchBrowse
+	srv.Icons = icons
+	srv.StallEventSubscribe = config.StallEventSubscribe
+	srv.IgnoreHidden = config.IgnoreHidden
+	srv.IgnoreUnreadable = config.IgnoreUnreadable
+	srv.IgnorePaths = config.IgnorePaths
+	srv.IgnoreNomedia = config.IgnoreNomedia
+	srv.IncludePatterns = config.IncludePatterns
+	srv.ExcludePatterns = config.ExcludePatterns
+	srv.AllowedIpNets = config.AllowedIpNets
+	srv.MetadataProviders = config.MetadataProviders
+	srv.InterfacePriority = config.InterfacePriority
+	srv.StrmProxyUserAgents = config.StrmProxyUserAgents
+	srv.LPCMUserAgents = config.LPCMUserAgents
+	srv.CheckUpdates = config.CheckUpdates
+	srv.RemoteStreams = config.RemoteStreams
+	srv.ImageCacheDir = config.ImageCacheDir
+	srv.SimulatedLatency = config.SimulatedLatency
+	srv.SimulatedKbps = config.SimulatedKbps
+	srv.StreamKbps = config.StreamKbps
+	srv.TotalStreamKbps = config.TotalStreamKbps
+	srv.MaxStreams = config.MaxStreams
+	srv.ShutdownTimeout = config.ShutdownTimeout
+	srv.SOAPDumpClients = config.SOAPDumpClients
+	srv.SOAPDumpDir = config.SOAPDumpDir
+	srv.PhotoPlaces = config.PhotoPlaces
+	srv.RecentItems = config.RecentItems
+	srv.KeepMissing = config.KeepMissing
+	srv.AllowUpload = config.AllowUpload
+	srv.UploadDir = config.UploadDir
+	srv.AllowDelete = config.AllowDelete
+	srv.DeleteIpNets = config.DeleteIpNets
+	srv.AudioProfiles = config.AudioProfiles
+	srv.HWAccel = config.HWAccel
+	srv.IncompleteFiles = config.IncompleteFiles
+	srv.ProblemFiles = config.ProblemFiles
+	srv.TranscodeCacheDir = config.TranscodeCacheDir
+	srv.TranscodeCacheSize = int64(config.TranscodeCacheSize) << 20
+	srv.Hooks = config.Hooks
+	srv.SSDPAllowInterfaces = config.SSDPAllowInterfaces
+	srv.SSDPSkipVirtual = config.SSDPSkipVirtual
+	srv.WebUsers = config.WebUsers
+	srv.WebUIAuth = config.WebUIAuth
+	srv.ClientRules = config.ClientRules
+	srv.ProtectedContainers = config.ProtectedContainers
+	srv.ParentalPIN = config.ParentalPIN
+	srv.ParentalUnlockDuration = config.ParentalUnlockDuration
+	srv.Locale = config.Locale
+	srv.GeneratedTitles = config.GeneratedTitles
+	srv.MimeTypeOverrides = config.MimeTypeOverrides
+	srv.ClassContainers = config.ClassContainers
+	srv.TVShows = config.TVShows
+	srv.WatchedPrefix = config.WatchedPrefix
+	srv.WatchedContainers = config.WatchedContainers
+	srv.SSDPDumpPath = config.SSDPDump
+}
+
+// Filters records below a level that can be changed while running, so the log level can be
+// reloaded along with the rest of the config.
+type levelHandler struct {
+	level   atomic.Value
+	handler log.Handler
+}
+
+func (me *levelHandler) Handle(r log.Record) {
+	if r.Level.LessThan(me.level.Load().(log.Level)) {
 		return
 	}
+	me.handler.Handle(r)
 }
 
 // default config
 var config = &dmsConfig{
-	Path:             "",
-	IfName:           "",
-	Http:             ":1338",
-	FriendlyName:     "",
-	DeviceIcon:       "",
-	DeviceIconSizes:  []string{"48,128"},
-	LogHeaders:       false,
-	FFprobeCachePath: getDefaultFFprobeCachePath(),
-	ForceTranscodeTo: "",
+	Path:                   "",
+	IfName:                 "",
+	Http:                   ":1338",
+	FriendlyName:           "",
+	DeviceIcon:             "",
+	DeviceIconSizes:        []string{"48,128"},
+	LogHeaders:             false,
+	FFprobeCachePath:       getDefaultFFprobeCachePath(),
+	ForceTranscodeTo:       "",
+	NotifyInterval:         30 * time.Second,
+	SSDPMaxAge:             ssdp.DefaultMaxAge,
+	SSDPTTL:                ssdp.DefaultTTL,
+	AcmeCacheDir:           getDefaultAcmeCacheDir(),
+	AudiobookPositionsPath: getDefaultAudiobookPositionsPath(),
+	APITokensPath:          getDefaultAPITokensPath(),
+	BookmarksPath:          getDefaultBookmarksPath(),
+	WatchedPath:            getDefaultWatchedPath(),
+	ClientPrefsPath:        getDefaultClientPrefsPath(),
+	ImageCacheDir:          getDefaultImageCacheDir(),
+	TranscodeCacheSize:     10240,
+	ShutdownTimeout:        30 * time.Second,
+	SOAPDumpDir:            getDefaultSOAPDumpDir(),
 }
 
 func getDefaultFFprobeCachePath() (path string) {
@@ -92,6 +427,101 @@ func getDefaultFFprobeCachePath() (path string) {
 	return
 }
 
+func getDefaultAudiobookPositionsPath() string {
+	_user, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(_user.HomeDir, ".dms", "audiobooks.json")
+}
+
+func getDefaultImageCacheDir() string {
+	_user, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(_user.HomeDir, ".dms", "images")
+}
+
+func getDefaultSOAPDumpDir() string {
+	_user, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(_user.HomeDir, ".dms", "log", "soap")
+}
+
+func getDefaultDetachLogPath() string {
+	_user, err := user.Current()
+	if err != nil {
+		return "dms.log"
+	}
+	return filepath.Join(_user.HomeDir, ".dms", "dms.log")
+}
+
+func getDefaultAPITokensPath() string {
+	_user, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(_user.HomeDir, ".dms", "api-tokens.json")
+}
+
+func getDefaultBookmarksPath() string {
+	_user, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(_user.HomeDir, ".dms", "bookmarks.json")
+}
+
+func getDefaultWatchedPath() string {
+	_user, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(_user.HomeDir, ".dms", "watched.json")
+}
+
+func getDefaultClientPrefsPath() string {
+	_user, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(_user.HomeDir, ".dms", "clients.json")
+}
+
+// Adds, revokes or lists the API tokens in the file at path, as asked on the command line.
+func manageAPITokens(path, add, revoke string, list bool) error {
+	var tokens dms.APITokens
+	if err := tokens.Load(path); err != nil {
+		return fmt.Errorf("loading API tokens: %w", err)
+	}
+	if add != "" {
+		name, scopes, _ := strings.Cut(add, "=")
+		token, err := tokens.Add(name, strings.Split(scopes, ","), "command line")
+		if err != nil {
+			return fmt.Errorf("adding API token: %w", err)
+		}
+		fmt.Println(token)
+	}
+	if revoke != "" {
+		if err := tokens.Revoke(revoke); err != nil {
+			return fmt.Errorf("revoking API token: %w", err)
+		}
+	}
+	if list {
+		all, err := tokens.List()
+		if err != nil {
+			return err
+		}
+		for _, t := range all {
+			fmt.Printf("%s\t%s\t%s\n", t.Name, strings.Join(t.Scopes, ","), t.Created.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
 type fFprobeCache struct {
 	c *rrcache.RRCache
 	sync.Mutex
@@ -118,6 +548,85 @@ func (fc *fFprobeCache) Set(key interface{}, value interface{}) {
 	fc.c.Set(key, value, size)
 }
 
+// Collects repeated -path flags, each either a directory or Name=directory.
+type rootDirsFlag []dms.RootDir
+
+func (me *rootDirsFlag) String() string {
+	var ss []string
+	for _, rd := range *me {
+		if rd.Name != "" {
+			ss = append(ss, rd.Name+"="+rd.Path)
+		} else {
+			ss = append(ss, rd.Path)
+		}
+	}
+	return strings.Join(ss, ",")
+}
+
+func (me *rootDirsFlag) Set(s string) error {
+	rd := dms.RootDir{Path: s}
+	// A name can't contain a path separator, so this leaves directories containing "=" alone.
+	if i := strings.IndexByte(s, '='); i > 0 && !strings.ContainsAny(s[:i], `/\`) {
+		rd.Name, rd.Path = s[:i], s[i+1:]
+	}
+	*me = append(*me, rd)
+	return nil
+}
+
+// Parses an audio profile given as a User-Agent substring=formats, as -audioProfile takes it.
+func parseAudioProfile(s string) (dms.AudioProfile, error) {
+	i := strings.LastIndexByte(s, '=')
+	if i <= 0 {
+		return dms.AudioProfile{}, fmt.Errorf("bad audio profile %q: want substring=formats", s)
+	}
+	return dms.AudioProfile{
+		UserAgents: []string{s[:i]},
+		Formats:    strings.Split(s[i+1:], ","),
+	}, nil
+}
+
+// A flag that can be repeated to give several values.
+type stringsFlag []string
+
+func (me *stringsFlag) String() string {
+	return strings.Join(*me, ",")
+}
+
+func (me *stringsFlag) Set(s string) error {
+	*me = append(*me, s)
+	return nil
+}
+
+// Returns the interfaces that are up and match any of the names or patterns, or all those that are
+// up if none are given.
+func selectInterfaces(patterns []string) (ret []net.Interface, err error) {
+	all, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	matched := make([]bool, len(patterns))
+	for _, if_ := range all {
+		ok := len(patterns) == 0
+		for i, pattern := range patterns {
+			if m, _ := path.Match(pattern, if_.Name); m {
+				ok, matched[i] = true, true
+			}
+		}
+		// Those that are down are kept, such as Wi-Fi that hasn't connected yet, for SSDP to start
+		// on when they come up.
+		if !ok || if_.MTU <= 0 {
+			continue
+		}
+		ret = append(ret, if_)
+	}
+	for i, pattern := range patterns {
+		if !matched[i] {
+			return nil, fmt.Errorf("no interface matches %q", pattern)
+		}
+	}
+	return
+}
+
 func main() {
 	err := mainErr()
 	if err != nil {
@@ -126,25 +635,110 @@ func main() {
 }
 
 func mainErr() error {
-	path := flag.String("path", config.Path, "browse root path")
-	ifName := flag.String("ifname", config.IfName, "specific SSDP network interface")
-	http := flag.String("http", config.Http, "http server port")
+	var paths rootDirsFlag
+	flag.Var(&paths, "path", "browse root path. Repeat to share several directories as top-level containers, optionally named with Name=path")
+	var ifNames stringsFlag
+	flag.Var(&ifNames, "ifname", "network interface to announce and serve on, or a pattern such as eth*. Repeat for several (default all)")
+	http := flag.String("http", config.Http, "address to serve HTTP on. Giving a host, such as 192.168.1.10:1338, also limits announcements to that address")
 	friendlyName := flag.String("friendlyName", config.FriendlyName, "server friendly name")
 	deviceIcon := flag.String("deviceIcon", config.DeviceIcon, "device defaultIcon")
 	deviceIconSizes := flag.String("deviceIconSizes", strings.Join(config.DeviceIconSizes, ","), "comma separated list of icon sizes to advertise, eg 48,128,256. Use 48:512,128:512 format to force actual size.")
 	logHeaders := flag.Bool("logHeaders", config.LogHeaders, "log HTTP headers")
 	fFprobeCachePath := flag.String("fFprobeCachePath", config.FFprobeCachePath, "path to FFprobe cache file")
-	configFilePath := flag.String("config", "", "json configuration file")
-	allowedIps := flag.String("allowedIps", "", "allowed ip of clients, separated by comma")
+	configFilePath := flag.String("config", "", "json configuration file, reloaded on SIGHUP")
+	setup := flag.Bool("setup", false, "if the config file doesn't exist, ask for the media directories, name, port and interface on the terminal, or on a web page on -http without one, and write it. The config file defaults to $HOME/.dms/config.json")
+	allowedIps := flag.String("allowedIps", "", "allowed ip of clients, or networks such as 192.168.1.0/24, separated by comma (default private networks and those of the interfaces)")
 	forceTranscodeTo := flag.String("forceTranscodeTo", config.ForceTranscodeTo, "force transcoding to certain format, supported: 'chromecast', 'vp8', 'web'")
 	transcodeLogPattern := flag.String("transcodeLogPattern", "", "pattern where to write transcode logs to. The [tsname] placeholder is replaced with the name of the item currently being played. The default is $HOME/.dms/log/[tsname]")
+	logLevel := flag.String("logLevel", "", "minimum level of log messages, one of debug, info, warning, error or critical (default warning)")
+	flag.StringVar(&config.AccessLog, "accessLog", "", "file to append a line to for each HTTP request, with the client, what it requested, the range, bytes sent, duration, status, transcode and why it failed")
+	flag.StringVar(&config.AccessLogFormat, "accessLogFormat", "", "format of -accessLog: common or combined for the Common Log Format of web servers (default key=value fields)")
+	flag.StringVar(&config.DebugHttp, "debugHttp", "", "address to serve pprof profiles and runtime stats on for diagnosing the server, such as localhost:6060. They aren't authenticated")
+	flag.StringVar(&config.Https, "https", "", "address to serve HTTPS on as well, such as :1339. It's advertised to renderers that support it, and clients of the web UI and API are sent to it")
+	flag.StringVar(&config.HttpsCert, "httpsCert", "", "certificate file for -https, in PEM (default a self-signed one made on the first run in $HOME/.dms/https)")
+	flag.StringVar(&config.HttpsKey, "httpsKey", "", "key file of -httpsCert, in PEM")
+	flag.StringVar(&config.AdminHttp, "adminHttp", "", "additional address to serve only the web UI on, to WebUsers that log in, such as :443 with -acmeHosts")
+	acmeHosts := flag.String("acmeHosts", "", "comma separated host names to obtain Let's Encrypt certificates for, enabling TLS on -adminHttp")
+	flag.StringVar(&config.AcmeEmail, "acmeEmail", "", "contact email for the Let's Encrypt account")
+	flag.StringVar(&config.AcmeCacheDir, "acmeCacheDir", config.AcmeCacheDir, "directory to store Let's Encrypt certificates and account keys")
+	flag.StringVar(&config.IndexPath, "indexPath", "", "database file to index the shared directories into in the background, serving browsing and search from it")
+	flag.DurationVar(&config.KeepMissing, "keepMissing", 0, "keep the metadata and thumbnails of files that have gone from the index this long, such as 72h, in case they come back, listing them in the web UI's trash (default forget them at once)")
+	flag.BoolVar(&config.AllowUpload, "allowUpload", false, "let control points such as cameras and phones upload media with CreateObject, saving it in -uploadDir")
+	flag.BoolVar(&config.AllowDelete, "allowDelete", false, "let control points at -deleteIps delete items with DestroyObject, such as recordings that have been watched")
+	flag.StringVar(&config.DeleteIps, "deleteIps", "", "ips of control points, or networks such as 192.168.1.0/24, separated by comma, that may delete items with -allowDelete")
+	flag.StringVar(&config.UploadDir, "uploadDir", "", "directory to save uploaded media in, which should be shared for it to be listed")
+	flag.StringVar(&config.AudiobookPositionsPath, "audiobookPositionsPath", config.AudiobookPositionsPath, "file to keep the positions listeners are up to in audiobooks")
+	flag.StringVar(&config.BookmarksPath, "bookmarksPath", config.BookmarksPath, "file to keep how far each client got through films and music in, to resume them there")
+	flag.StringVar(&config.WatchedPath, "watchedPath", config.WatchedPath, "file to keep the videos that have been streamed to the end in")
+	flag.StringVar(&config.WatchedPrefix, "watchedPrefix", "", "put this before the titles of watched videos, such as \"* \"")
+	flag.BoolVar(&config.WatchedContainers, "watchedContainers", false, "list the watched videos, and the unwatched ones in the index, in Watched and Unwatched containers too")
+	flag.StringVar(&config.ImageCacheDir, "imageCacheDir", config.ImageCacheDir, "directory to keep images scaled for photo frames in")
+	flag.StringVar(&config.APITokensPath, "apiTokensPath", config.APITokensPath, "file to keep the REST API tokens in. The API is open to allowed clients until a token is added")
+	addAPIToken := flag.String("addApiToken", "", "add a REST API token given as name=scope,..., with scopes browse, playback and admin, print it and exit")
+	revokeAPIToken := flag.String("revokeApiToken", "", "revoke the named REST API token and exit")
+	flag.StringVar(&config.ClientPrefsPath, "clientPrefsPath", config.ClientPrefsPath, "file to keep the display preferences of clients set on the /clients page in")
+	listAPITokens := flag.Bool("listApiTokens", false, "list the REST API tokens and exit")
+	metadataProviders := flag.String("metadataProviders", "", fmt.Sprintf("comma separated metadata providers to identify media with, in order of precedence (default %s)", strings.Join(dms.MetadataProviderNames(), ",")))
 	flag.BoolVar(&config.NoTranscode, "noTranscode", false, "disable transcoding")
 	flag.BoolVar(&config.NoProbe, "noProbe", false, "disable media probing with ffprobe")
+	flag.BoolVar(&config.NoPhotoGrouping, "noPhotoGrouping", false, "list every photo separately, rather than grouping RAW+JPEG pairs and bursts into single items")
+	flag.IntVar(&config.RecentItems, "recentItems", 0, "list the newest of each type of media in a Recently Added container (needs -indexPath), and those played last in a Recently Played container, this many in each")
+	flag.BoolVar(&config.ClassContainers, "classContainers", false, "list all the music, videos and photos in a container for each too, with the ObjectIDs 1, 2 and 3 that control points such as the Xbox 360 and Samsung TVs go to (needs -indexPath)")
+	flag.BoolVar(&config.TVShows, "tvShows", false, "list the episodes of TV shows in a TV Shows container too, by series and season, from their NFO files or names such as Show.S01E02.mkv (needs -indexPath)")
+	flag.BoolVar(&config.PhotoPlaces, "photoPlaces", false, "list photos with a GPS location in a Places container too, grouped by where they were taken (needs -indexPath)")
+	flag.BoolVar(&config.PrefetchBrowse, "prefetchBrowse", false, "list the subfolders of folders browsed in the background, for slow storage")
 	flag.BoolVar(&config.StallEventSubscribe, "stallEventSubscribe", false, "workaround for some bad event subscribers")
-	flag.DurationVar(&config.NotifyInterval, "notifyInterval", 30*time.Second, "interval between SSPD announces")
+	flag.DurationVar(&config.NotifyInterval, "notifyInterval", config.NotifyInterval, "interval between SSPD announces, less up to a fifth at random")
+	var notifyAddrs stringsFlag
+	flag.Var(&notifyAddrs, "notifyAddr", "address of a control point, as host or host:port, to send SSDP announcements to directly as well as to the multicast group, such as one on another network. Repeat for several")
 	flag.BoolVar(&config.IgnoreHidden, "ignoreHidden", false, "ignore hidden files and directories")
 	flag.BoolVar(&config.IgnoreUnreadable, "ignoreUnreadable", false, "ignore unreadable files and directories")
+	flag.BoolVar(&config.IgnoreNomedia, "ignoreNomedia", false, "ignore directories containing a .nomedia file")
+	flag.StringVar(&config.IncompleteFiles, "incompleteFiles", "", "what to do with files still being written, such as downloads: hide, mark or grow to serve them as they grow (default serve them as they are)")
+	flag.DurationVar(&config.ResourceURLExpiry, "resourceURLExpiry", 0, "sign the URLs of media, so they can't be guessed, and expire them after this long, such as 24h (default not signed)")
+	flag.StringVar(&config.ResourceURLKey, "resourceURLKey", "", "key to sign the URLs of media with, so they stay valid across restarts (default random)")
+	flag.StringVar(&config.ProblemFiles, "problemFiles", "", "what to do with media files that can't be played, such as empty, truncated or DRM protected ones: mark them, or list them as they are (default hide them)")
+	var includePatterns, excludePatterns stringsFlag
+	flag.Var(&includePatterns, "include", "only show files whose names match this glob, such as *.mkv, or regular expression prefixed with re:. Repeat for several")
+	flag.Var(&excludePatterns, "exclude", "ignore files and directories whose names match this glob, such as sample-*, or regular expression prefixed with re:. Repeat for several")
+	ssdpAllowInterfaces := flag.String("ssdpAllowInterfaces", "", "comma separated interfaces, or patterns such as lo, to announce on though they're skipped: loopback, point-to-point such as VPN tunnels, those without multicast and, with -ssdpSkipVirtual, virtual ones")
+	flag.StringVar(&config.SSDPDump, "ssdpDump", "", "file to record the SSDP messages received and sent on every interface in, as JSON lines with the time, interface and address, for debugging discovery. Rotated at 4MB")
+	flag.StringVar(&config.UPnPVersion, "upnpVersion", "", "UPnP version to describe the device as to renderers that validate it: 1.0, 1.1 or 2.0, which adds the optional fields of the description (default 1.1)")
+	flag.DurationVar(&config.SSDPMaxAge, "ssdpMaxAge", config.SSDPMaxAge, "how long control points may take dms to be there after an SSDP announcement or search response, as its CACHE-CONTROL max-age")
+	flag.IntVar(&config.SSDPTTL, "ssdpTTL", config.SSDPTTL, "multicast TTL, or IPv6 hop limit, of SSDP messages, one more than the routers they may cross")
+	flag.BoolVar(&config.SSDPSkipVirtual, "ssdpSkipVirtual", config.SSDPSkipVirtual, "don't announce on virtual interfaces, such as bridges, Docker's and those of VMs")
+	interfacePriority := flag.String("interfacePriority", "", "comma separated interfaces, or patterns such as eth*, in order of preference for the address advertised when several are on the same network")
+	strmProxyUserAgents := flag.String("strmProxyUserAgents", "", "comma separated User-Agent substrings of renderers to proxy the remote media of .strm and .url files for, rather than redirect, or * for all")
+	soapDumpClients := flag.String("soapDumpClients", "", "comma separated addresses of clients whose SOAP requests and responses are dumped in full to -soapDumpDir")
+	flag.StringVar(&config.SOAPDumpDir, "soapDumpDir", config.SOAPDumpDir, "directory of the SOAP dumps of -soapDumpClients, a file for each, rotated at 4MB")
+	lpcmUserAgents := flag.String("lpcmUserAgents", "", "comma separated User-Agent substrings of renderers that only take L16 audio besides MP3, to list it first for them, or * for all")
+	var audioProfiles stringsFlag
+	flag.Var(&audioProfiles, "audioProfile", "audio formats to offer renderers whose User-Agent contains a substring, given as substring=formats, with the formats comma separated in order of preference from original, flac, wav, lpcm, alac, mp3 and aac, such as Sonos=lpcm,mp3. Repeat for several, and the first that matches is used")
+	flag.StringVar(&config.HWAccel.API, "hwAccel", "", "encode the video of the chromecast and web transcodes on hardware: vaapi, nvenc or qsv for QuickSync")
+	flag.StringVar(&config.HWAccel.Device, "hwAccelDevice", "", "DRM render node for vaapi and qsv (default /dev/dri/renderD128), or index of the GPU for nvenc")
+	flag.StringVar(&config.HWAccel.Encoder, "hwEncoder", "", "ffmpeg encoder to use with -hwAccel, such as hevc_vaapi (default the H.264 encoder of the API)")
+	flag.StringVar(&config.TranscodeCacheDir, "transcodeCacheDir", "", "directory to cache transcodes of whole files in, so they're transcoded once for every client and replay")
+	flag.IntVar(&config.TranscodeCacheSize, "transcodeCacheSize", config.TranscodeCacheSize, "megabytes of transcodes to keep in -transcodeCacheDir, deleting the least recently played beyond it")
 	ignorePaths := flag.String("ignore", "", "comma separated list of directories to ignore (i.e. thumbnails,thumbs)")
+	var hooks stringsFlag
+	flag.Var(&hooks, "hook", fmt.Sprintf("shell command to run on an event, given as event=command, with the event's data in DMS_ environment variables. Repeat for several. Events are %s", strings.Join(dms.HookEvents, ", ")))
+	flag.BoolVar(&config.MPRIS, "mpris", false, "publish what's played on renderers from the web UI or API as an MPRIS player on the DBus session bus, for the media keys and now-playing widgets of Linux desktops")
+	flag.StringVar(&config.OpenHomeRenderer, "openHomeRenderer", "", "address or name of a renderer to offer the OpenHome Product, Playlist and Radio services for, so that OpenHome control points like Kazoo and Lumin queue music and play the remote streams as radio on it")
+	flag.BoolVar(&config.CheckUpdates, "checkUpdates", false, "check GitHub once a day for a newer release, shown in the web UI. Nothing identifying the server is sent")
+	printVersion := flag.Bool("version", false, "print the version and exit")
+	pidFile := flag.String("pidFile", "", "write the process ID to this file while running")
+	detachFlag := flag.Bool("detach", false, "run in the background, detached from the terminal, logging to $HOME/.dms/dms.log. Not on Windows")
+	check := flag.Bool("check", false, "check the config, the shared paths, ffmpeg and ffprobe, and multicast and the HTTP port on each interface, print what to do about any problems, and exit")
+	service := flag.String("service", "", "install, uninstall, start or stop the Windows service, which runs dms with the other flags given")
+	flag.DurationVar(&config.SimulatedLatency, "simulatedLatency", 0, "for testing, delay every HTTP request by this, such as 300ms")
+	flag.IntVar(&config.SimulatedKbps, "simulatedKbps", 0, "for testing, limit HTTP responses to this many kilobits a second")
+	flag.IntVar(&config.StreamKbps, "streamKbps", 0, "limit each stream of media to this many kilobits a second")
+	flag.IntVar(&config.TotalStreamKbps, "totalStreamKbps", 0, "limit all streams of media together to this many kilobits a second")
+	flag.IntVar(&config.MaxStreams, "maxStreams", 0, "most streams of media to serve at once. More wait 5 seconds for one to end, and are then told to retry (default no limit)")
+	flag.StringVar(&config.User, "user", "", "when started as root, switch to this user once the listeners are open")
+	flag.StringVar(&config.Group, "group", "", "group to switch to with -user (default the user's primary group)")
+	flag.StringVar(&config.Locale, "locale", "", "language, such as de or ja, to sort names for and title the containers dms makes in (default the Unicode order and English)")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdownTimeout", config.ShutdownTimeout, "on shutdown, how long to let streams finish before closing them")
 	flag.BoolVar(&config.AllowDynamicStreams, "allowDynamicStreams", false, "activate support for dynamic streams described via .dms.json metadata files")
 
 	flag.Parse()
@@ -152,11 +746,18 @@ func mainErr() error {
 		flag.Usage()
 		return fmt.Errorf("%s: %s\n", "unexpected positional arguments", flag.Args())
 	}
+	if *printVersion {
+		fmt.Println(dms.Version())
+		return nil
+	}
 
-	logger := log.Default.WithNames("main")
-
-	config.Path, _ = filepath.Abs(*path)
-	config.IfName = *ifName
+	if len(paths) == 1 && paths[0].Name == "" {
+		config.Path = paths[0].Path
+	} else {
+		config.Paths = paths
+	}
+	config.IfNames = ifNames
+	config.NotifyAddrs = notifyAddrs
 	config.Http = *http
 	config.FriendlyName = *friendlyName
 	config.DeviceIcon = *deviceIcon
@@ -164,26 +765,136 @@ func mainErr() error {
 
 	config.LogHeaders = *logHeaders
 	config.FFprobeCachePath = *fFprobeCachePath
-	config.AllowedIpNets = makeIpNets(*allowedIps)
+	config.AllowedIps = *allowedIps
 	config.ForceTranscodeTo = *forceTranscodeTo
 	config.IgnorePaths = strings.Split(*ignorePaths, ",")
+	config.IncludePatterns = includePatterns
+	config.ExcludePatterns = excludePatterns
 	config.TranscodeLogPattern = *transcodeLogPattern
-
-	if config.TranscodeLogPattern == "" {
-		u, err := user.Current()
+	config.LogLevel = *logLevel
+	if *acmeHosts != "" {
+		config.AcmeHosts = strings.Split(*acmeHosts, ",")
+	}
+	if *interfacePriority != "" {
+		config.InterfacePriority = strings.Split(*interfacePriority, ",")
+	}
+	if *ssdpAllowInterfaces != "" {
+		config.SSDPAllowInterfaces = strings.Split(*ssdpAllowInterfaces, ",")
+	}
+	if *strmProxyUserAgents != "" {
+		config.StrmProxyUserAgents = strings.Split(*strmProxyUserAgents, ",")
+	}
+	if *soapDumpClients != "" {
+		config.SOAPDumpClients = strings.Split(*soapDumpClients, ",")
+	}
+	if *lpcmUserAgents != "" {
+		config.LPCMUserAgents = strings.Split(*lpcmUserAgents, ",")
+	}
+	if *metadataProviders != "" {
+		config.MetadataProviders = strings.Split(*metadataProviders, ",")
+	}
+	for _, p := range audioProfiles {
+		profile, err := parseAudioProfile(p)
 		if err != nil {
-			return fmt.Errorf("unable to resolve current user: %q", err)
+			return err
 		}
-		config.TranscodeLogPattern = filepath.Join(u.HomeDir, ".dms", "log", "[tsname]")
+		config.AudioProfiles = append(config.AudioProfiles, profile)
+	}
+	for _, h := range hooks {
+		event, command, ok := strings.Cut(h, "=")
+		if !ok {
+			return fmt.Errorf("bad hook %q: want event=command", h)
+		}
+		if config.Hooks == nil {
+			config.Hooks = make(map[string][]string)
+		}
+		config.Hooks[event] = append(config.Hooks[event], command)
 	}
 
-	if len(*configFilePath) > 0 {
-		config.load(*configFilePath)
+	// Without flags, the config file written by setup is used, and setup is offered if there's
+	// someone at a terminal to answer it and there's no config file yet.
+	firstRun := flag.NFlag() == 0 && stdinIsTerminal()
+	if *configFilePath == "" && (*setup || flag.NFlag() == 0) {
+		if p := getDefaultConfigPath(); p != "" {
+			if _, err := os.Stat(p); err == nil || *setup || firstRun {
+				*configFilePath = p
+			}
+		}
+	}
+	if (*setup || firstRun) && *configFilePath != "" {
+		if _, err := os.Stat(*configFilePath); errors.Is(err, os.ErrNotExist) {
+			if stdinIsTerminal() {
+				err = runSetupWizard(os.Stdin, os.Stdout, *configFilePath, config)
+			} else {
+				err = serveSetupPage(log.Default.WithNames("main", "setup"), *configFilePath, config)
+			}
+			if err != nil {
+				return fmt.Errorf("setting up: %w", err)
+			}
+		}
+	}
+
+	// Settings from the config file take precedence over flags. Keep what the flags gave us so
+	// that settings removed from the file revert on reload.
+	flagConfig := *config
+	loadConfig := func() (*dmsConfig, error) {
+		config := flagConfig
+		if len(*configFilePath) > 0 {
+			if err := config.load(*configFilePath); err != nil {
+				return nil, err
+			}
+		}
+		return &config, config.finish()
+	}
+	var err error
+	config, err = loadConfig()
+	if *check {
+		return runChecks(os.Stdout, config, err)
+	}
+	if err != nil {
+		return err
+	}
+	if *addAPIToken != "" || *revokeAPIToken != "" || *listAPITokens {
+		return manageAPITokens(config.APITokensPath, *addAPIToken, *revokeAPIToken, *listAPITokens)
+	}
+	if *service != "" {
+		return manageService(*service, withoutFlag(os.Args[1:], "service", true))
+	}
+	if *detachFlag {
+		return detach(withoutFlag(os.Args[1:], "detach", false), getDefaultDetachLogPath())
+	}
+
+	// Services have no terminal to log to.
+	var handler log.Handler = log.DefaultHandler
+	if h, ok := serviceLogHandler(); ok {
+		handler = h
+	}
+	logLevelHandler := &levelHandler{handler: handler}
+	level, _ := config.logLevel()
+	logLevelHandler.level.Store(level)
+	log.Default.SetHandlers(logLevelHandler)
+	log.Default = log.Default.WithFilterLevel(log.Debug)
+	logger := log.Default.WithNames("main")
+	if *pidFile != "" {
+		remove, err := writePidFile(*pidFile)
+		if err != nil {
+			return fmt.Errorf("writing pid file: %w", err)
+		}
+		defer remove()
 	}
 
 	logger.Printf("device icon sizes are %q", config.DeviceIconSizes)
-	logger.Printf("allowed ip nets are %q", config.AllowedIpNets)
-	logger.Printf("serving folder %q", config.Path)
+	if config.AllowedIpNets == nil {
+		logger.Printf("allowing clients on private networks and those of the interfaces")
+	} else {
+		logger.Printf("allowed ip nets are %q", config.AllowedIpNets)
+	}
+	if len(config.Paths) == 0 {
+		logger.Printf("serving folder %q", config.Path)
+	}
+	for _, rd := range config.Paths {
+		logger.Printf("serving folder %q", rd.Path)
+	}
 	if config.AllowDynamicStreams {
 		logger.Printf("Dynamic streams ARE allowed")
 	}
@@ -195,32 +906,32 @@ func mainErr() error {
 		log.Print(err)
 	}
 
+	icons, err := config.icons()
+	if err != nil {
+		return err
+	}
+	// Opened before dropping privileges, so it can be somewhere only root can write to.
+	var accessLog *os.File
+	if config.AccessLog != "" {
+		accessLog, err = os.OpenFile(config.AccessLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+		if err != nil {
+			return fmt.Errorf("opening access log: %w", err)
+		}
+		defer accessLog.Close()
+	}
 	dmsServer := &dms.Server{
 		Logger: logger.WithNames("dms", "server"),
-		Interfaces: func(ifName string) (ifs []net.Interface) {
-			var err error
-			if ifName == "" {
-				ifs, err = net.Interfaces()
-			} else {
-				var if_ *net.Interface
-				if_, err = net.InterfaceByName(ifName)
-				if if_ != nil {
-					ifs = append(ifs, *if_)
-				}
+		Interfaces: func() []net.Interface {
+			patterns := config.IfNames
+			if config.IfName != "" {
+				patterns = append([]string{config.IfName}, patterns...)
 			}
+			ifs, err := selectInterfaces(patterns)
 			if err != nil {
 				log.Fatal(err)
 			}
-			var tmp []net.Interface
-			for _, if_ := range ifs {
-				if if_.Flags&net.FlagUp == 0 || if_.MTU <= 0 {
-					continue
-				}
-				tmp = append(tmp, if_)
-			}
-			ifs = tmp
-			return
-		}(config.IfName),
+			return ifs
+		}(),
 		HTTPConn: func() net.Listener {
 			conn, err := net.Listen("tcp", config.Http)
 			if err != nil {
@@ -228,63 +939,168 @@ func mainErr() error {
 			}
 			return conn
 		}(),
-		FriendlyName:        config.FriendlyName,
-		RootObjectPath:      filepath.Clean(config.Path),
-		FFProbeCache:        cache,
-		LogHeaders:          config.LogHeaders,
-		NoTranscode:         config.NoTranscode,
-		AllowDynamicStreams: config.AllowDynamicStreams,
-		ForceTranscodeTo:    config.ForceTranscodeTo,
-		TranscodeLogPattern: config.TranscodeLogPattern,
-		NoProbe:             config.NoProbe,
-		Icons: func() []dms.Icon {
-			var icons []dms.Icon
-			for _, size := range config.DeviceIconSizes {
-				s := strings.Split(size, ":")
-				if len(s) != 1 && len(s) != 2 {
-					log.Fatal("bad device icon size: ", size)
-				}
-				advertisedSize, err := strconv.Atoi(s[0])
-				if err != nil {
-					log.Fatal("bad device icon size: ", size)
-				}
-				actualSize := advertisedSize
-				if len(s) == 2 {
-					// Force actual icon size to be different from advertised
-					actualSize, err = strconv.Atoi(s[1])
-					if err != nil {
-						log.Fatal("bad device icon size: ", size)
-					}
-				}
-				icons = append(icons, dms.Icon{
-					Width:    advertisedSize,
-					Height:   advertisedSize,
-					Depth:    8,
-					Mimetype: "image/png",
-					Bytes:    readIcon(config.DeviceIcon, uint(actualSize)),
-				})
+		FFProbeCache:           cache,
+		NotifyInterval:         config.NotifyInterval,
+		SSDPMaxAge:             config.SSDPMaxAge,
+		SSDPTTL:                config.SSDPTTL,
+		UPnPVersion:            config.UPnPVersion,
+		MPRIS:                  config.MPRIS,
+		OpenHomeRenderer:       config.OpenHomeRenderer,
+		NotifyAddrs:            config.NotifyAddrs,
+		IndexPath:              config.IndexPath,
+		AudiobookPositionsPath: config.AudiobookPositionsPath,
+		BookmarksPath:          config.BookmarksPath,
+		WatchedPath:            config.WatchedPath,
+		APITokensPath:          config.APITokensPath,
+		ClientPrefsPath:        config.ClientPrefsPath,
+	}
+	if accessLog != nil {
+		dmsServer.AccessLog = accessLog
+	}
+	// Settings changed from the web UI are written to the config file, if there's one.
+	var settingsEditor *configEditor
+	if *configFilePath != "" {
+		settingsEditor = &configEditor{path: *configFilePath, flagConfig: &flagConfig}
+		dmsServer.SettingsEditor = settingsEditor
+	}
+	if config.ResourceURLExpiry > 0 {
+		key := []byte(config.ResourceURLKey)
+		if len(key) == 0 {
+			key = make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return err
 			}
-			return icons
-		}(),
-		StallEventSubscribe: config.StallEventSubscribe,
-		NotifyInterval:      config.NotifyInterval,
-		IgnoreHidden:        config.IgnoreHidden,
-		IgnoreUnreadable:    config.IgnoreUnreadable,
-		IgnorePaths:         config.IgnorePaths,
-		AllowedIpNets:       config.AllowedIpNets,
+		}
+		dmsServer.ResourceResolver = &dms.SignedResourceURLs{Key: key, Expiry: config.ResourceURLExpiry}
+	}
+	if config.AdminHttp != "" {
+		dmsServer.AdminConn, err = config.adminListener()
+		if err != nil {
+			return fmt.Errorf("opening admin listener: %w", err)
+		}
+	}
+	if config.Https != "" {
+		dmsServer.HTTPSConn, dmsServer.TLSConfig, err = config.httpsListener()
+		if err != nil {
+			return fmt.Errorf("opening HTTPS listener: %w", err)
+		}
+	}
+	if config.DebugHttp != "" {
+		dmsServer.DebugConn, err = net.Listen("tcp", config.DebugHttp)
+		if err != nil {
+			return fmt.Errorf("opening debug listener: %w", err)
+		}
+	}
+	if config.User != "" {
+		if err := dropPrivileges(config.User, config.Group); err != nil {
+			return fmt.Errorf("dropping privileges: %w", err)
+		}
+		logger.Printf("running as user %d, group %d", os.Getuid(), os.Getgid())
+		config.checkPathsReadable(logger)
 	}
+	config.apply(dmsServer, icons)
 	if err := dmsServer.Init(); err != nil {
 		log.Fatalf("error initing dms server: %v", err)
 	}
+	// Reloads the config file, on SIGHUP and for changes from the web UI.
+	var reloadMu sync.Mutex
+	reload := func() error {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		newConfig, err := loadConfig()
+		var icons []dms.Icon
+		if err == nil {
+			icons, err = newConfig.icons()
+		}
+		if err != nil {
+			return fmt.Errorf("not reloading config: %w", err)
+		}
+		if newConfig.Http != config.Http || newConfig.IfName != config.IfName ||
+			strings.Join(newConfig.IfNames, ",") != strings.Join(config.IfNames, ",") ||
+			newConfig.NotifyInterval != config.NotifyInterval ||
+			newConfig.SSDPMaxAge != config.SSDPMaxAge || newConfig.SSDPTTL != config.SSDPTTL ||
+			newConfig.UPnPVersion != config.UPnPVersion || newConfig.MPRIS != config.MPRIS ||
+			newConfig.OpenHomeRenderer != config.OpenHomeRenderer ||
+			strings.Join(newConfig.NotifyAddrs, ",") != strings.Join(config.NotifyAddrs, ",") ||
+			newConfig.FFprobeCachePath != config.FFprobeCachePath ||
+			newConfig.AdminHttp != config.AdminHttp || newConfig.IndexPath != config.IndexPath ||
+			newConfig.Https != config.Https || newConfig.HttpsCert != config.HttpsCert ||
+			newConfig.HttpsKey != config.HttpsKey ||
+			newConfig.AudiobookPositionsPath != config.AudiobookPositionsPath ||
+			newConfig.BookmarksPath != config.BookmarksPath ||
+			newConfig.WatchedPath != config.WatchedPath ||
+			newConfig.APITokensPath != config.APITokensPath ||
+			newConfig.ClientPrefsPath != config.ClientPrefsPath ||
+			newConfig.ResourceURLExpiry != config.ResourceURLExpiry ||
+			newConfig.ResourceURLKey != config.ResourceURLKey ||
+			newConfig.User != config.User || newConfig.Group != config.Group ||
+			strings.Join(newConfig.AcmeHosts, ",") != strings.Join(config.AcmeHosts, ",") {
+			logger.Levelf(log.Warning, "changes to listeners, certificates, interfaces, notifyInterval, ssdpMaxAge, ssdpTTL, upnpVersion, mpris, openHomeRenderer, notifyAddr, URL signing, the user and the cache, index, audiobook positions, bookmarks, watched videos, API tokens and client preferences paths require a restart")
+		}
+		level, _ := newConfig.logLevel()
+		logLevelHandler.level.Store(level)
+		err = dmsServer.Reload(func(srv *dms.Server) {
+			newConfig.apply(srv, icons)
+		})
+		if err != nil {
+			return fmt.Errorf("error reloading config: %w", err)
+		}
+		config = newConfig
+		logger.Levelf(log.Info, "reloaded config")
+		return nil
+	}
+	if settingsEditor != nil {
+		settingsEditor.reload = reload
+		settingsEditor.config = func() *dmsConfig {
+			reloadMu.Lock()
+			defer reloadMu.Unlock()
+			return config
+		}
+	}
 	go func() {
 		if err := dmsServer.Run(); err != nil {
 			log.Fatal(err)
 		}
 	}()
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
-	<-sigs
-	err := dmsServer.Close()
+	signal.Notify(sigs, append([]os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}, rescanSignals...)...)
+	serviceStopped, err := startService(sigs, config.ShutdownTimeout)
+	if err != nil {
+		return fmt.Errorf("starting service: %w", err)
+	}
+	defer serviceStopped()
+	for sig := range sigs {
+		if isRescanSignal(sig) {
+			logger.Levelf(log.Info, "rescanning the library")
+			if err := dmsServer.Rescan("/"); err != nil {
+				logger.Levelf(log.Error, "rescanning: %v", err)
+			}
+			continue
+		}
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := reload(); err != nil {
+			logger.Levelf(log.Error, "%v", err)
+		}
+	}
+	logger.Levelf(log.Info, "shutting down")
+	// Another signal stops waiting for streams to finish.
+	closed := make(chan error, 1)
+	go func() {
+		closed <- dmsServer.Close()
+	}()
+	for {
+		select {
+		case err = <-closed:
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP || isRescanSignal(sig) {
+				continue
+			}
+			log.Fatalf("%v while shutting down", sig)
+		}
+		break
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -294,6 +1110,16 @@ func mainErr() error {
 	return nil
 }
 
+// Reports whether sig asks for the library to be rescanned.
+func isRescanSignal(sig os.Signal) bool {
+	for _, s := range rescanSignals {
+		if sig == s {
+			return true
+		}
+	}
+	return false
+}
+
 func (cache *fFprobeCache) load(path string) error {
 	f, err := os.Open(path)
 	if err != nil {
@@ -352,17 +1178,17 @@ func getIconReader(path string) (io.ReadCloser, error) {
 	return os.Open(path)
 }
 
-func readIcon(path string, size uint) []byte {
+func readIcon(path string, size uint) ([]byte, error) {
 	r, err := getIconReader(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer r.Close()
 	imageData, _, err := image.Decode(r)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("decoding icon %q: %w", path, err)
 	}
-	return resizeImage(imageData, size)
+	return resizeImage(imageData, size), nil
 }
 
 func resizeImage(imageData image.Image, size uint) []byte {
@@ -373,32 +1199,29 @@ func resizeImage(imageData image.Image, size uint) []byte {
 }
 
 func makeIpNets(s string) []*net.IPNet {
-	var nets []*net.IPNet
 	if len(s) < 1 {
-		_, ipnet, _ := net.ParseCIDR("0.0.0.0/0")
-		nets = append(nets, ipnet)
-		_, ipnet, _ = net.ParseCIDR("::/0")
-		nets = append(nets, ipnet)
-	} else {
-		for _, el := range strings.Split(s, ",") {
-			ip := net.ParseIP(el)
-
-			if ip == nil {
-				_, ipnet, err := net.ParseCIDR(el)
-				if err == nil {
-					nets = append(nets, ipnet)
-				} else {
-					log.Printf("unable to parse expression %q", el)
-				}
+		// Leave the server to allow its default networks.
+		return nil
+	}
+	// Not nil even if nothing parses, so that a mistake doesn't allow more than intended.
+	nets := []*net.IPNet{}
+	for _, el := range strings.Split(s, ",") {
+		ip := net.ParseIP(el)
 
+		if ip == nil {
+			_, ipnet, err := net.ParseCIDR(el)
+			if err == nil {
+				nets = append(nets, ipnet)
 			} else {
-				_, ipnet, err := net.ParseCIDR(el + "/32")
-				if err == nil {
-					nets = append(nets, ipnet)
-				} else {
-					log.Printf("unable to parse ip %q", el)
-				}
+				log.Printf("unable to parse expression %q", el)
+			}
+
+		} else {
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
 			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
 		}
 	}
 	return nets
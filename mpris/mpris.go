@@ -0,0 +1,410 @@
+// Package mpris publishes a media player on the DBus session bus with the MPRIS D-Bus interface,
+// so that desktops show what it's playing and send it their media keys. See
+// https://specifications.freedesktop.org/mpris-spec/latest/.
+package mpris
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+)
+
+const (
+	objectPath      = dbus.ObjectPath("/org/mpris/MediaPlayer2")
+	busNamePrefix   = "org.mpris.MediaPlayer2."
+	rootInterface   = "org.mpris.MediaPlayer2"
+	playerInterface = "org.mpris.MediaPlayer2.Player"
+
+	propertiesInterface = "org.freedesktop.DBus.Properties"
+
+	errInvalidArgs      = "org.freedesktop.DBus.Error.InvalidArgs"
+	errPropertyReadOnly = "org.freedesktop.DBus.Error.PropertyReadOnly"
+	errNotSupported     = "org.freedesktop.DBus.Error.NotSupported"
+
+	// The track ID of no track.
+	noTrack = dbus.ObjectPath("/org/mpris/MediaPlayer2/TrackList/NoTrack")
+)
+
+// The PlaybackStatus of a player.
+const (
+	Playing = "Playing"
+	Paused  = "Paused"
+	Stopped = "Stopped"
+)
+
+// The methods of org.mpris.MediaPlayer2.Player that are passed to OnControl.
+const (
+	Play      = "Play"
+	Pause     = "Pause"
+	PlayPause = "PlayPause"
+	Stop      = "Stop"
+	Next      = "Next"
+	Previous  = "Previous"
+)
+
+// What a player is playing, as MPRIS metadata.
+type Metadata struct {
+	// Identifies the track. It changes when another one is played.
+	TrackID int
+	Title   string
+	Artists []string
+	Album   string
+	Length  time.Duration
+	// Of the cover art.
+	ArtURL string
+	URL    string
+}
+
+func (me Metadata) variants() map[string]dbus.Variant {
+	if me.TrackID == 0 {
+		return map[string]dbus.Variant{"mpris:trackid": dbus.MakeVariant(noTrack)}
+	}
+	ret := map[string]dbus.Variant{
+		"mpris:trackid": dbus.MakeVariant(dbus.ObjectPath(fmt.Sprintf("/org/anacrolix/dms/track/%d", me.TrackID))),
+	}
+	if me.Title != "" {
+		ret["xesam:title"] = dbus.MakeVariant(me.Title)
+	}
+	if len(me.Artists) != 0 {
+		ret["xesam:artist"] = dbus.MakeVariant(me.Artists)
+	}
+	if me.Album != "" {
+		ret["xesam:album"] = dbus.MakeVariant(me.Album)
+	}
+	if me.Length > 0 {
+		ret["mpris:length"] = dbus.MakeVariant(int64(me.Length / time.Microsecond))
+	}
+	if me.ArtURL != "" {
+		ret["mpris:artUrl"] = dbus.MakeVariant(me.ArtURL)
+	}
+	if me.URL != "" {
+		ret["xesam:url"] = dbus.MakeVariant(me.URL)
+	}
+	return ret
+}
+
+// The state of a player that's published.
+type State struct {
+	// Playing, Paused or Stopped.
+	Status   string
+	Metadata Metadata
+	// Which of the controls can be used. Those that can't aren't passed to OnControl.
+	CanPlay, CanPause, CanGoNext, CanGoPrevious bool
+}
+
+// Whether the control can be used in the state.
+func (me State) can(control string) bool {
+	switch control {
+	case Play:
+		return me.CanPlay
+	case Pause:
+		return me.CanPause
+	case PlayPause:
+		return me.CanPlay || me.CanPause
+	case Stop:
+		return me.CanPlay || me.CanPause
+	case Next:
+		return me.CanGoNext
+	case Previous:
+		return me.CanGoPrevious
+	}
+	return false
+}
+
+// The D-Bus names of the methods of the exported objects that have other names in Go.
+var methodNames = map[string]string{"SeekBy": "Seek"}
+
+// A player published on the session bus. Its state is set with Update.
+type Player struct {
+	// Published as org.mpris.MediaPlayer2.<Name>, or with the process ID after it if another has
+	// that name.
+	Name string
+	// Shown by desktops as the player's name.
+	Identity string
+	// Called with the method of org.mpris.MediaPlayer2.Player that a desktop called, such as for a
+	// media key, one of Play, Pause, PlayPause, Stop, Next and Previous. Its error is returned to
+	// the caller.
+	OnControl func(control string) error
+	Logger    log.Logger
+
+	conn *dbus.Conn
+	mu   sync.Mutex
+	// The bus name that's owned.
+	busName string
+	state   State
+}
+
+// Connects to the session bus and publishes the player, in the Stopped state.
+func (me *Player) Start() error {
+	if me.Logger.IsZero() {
+		me.Logger = log.Default.WithNames("mpris")
+	}
+	me.mu.Lock()
+	me.state = State{Status: Stopped}
+	me.mu.Unlock()
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return err
+	}
+	if err := me.start(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// Exports the player's object on the bus, and then asks for its name.
+func (me *Player) start(conn *dbus.Conn) error {
+	me.conn = conn
+	for iface, v := range map[string]interface{}{
+		rootInterface:                  rootMethods{},
+		playerInterface:                playerMethods{me},
+		propertiesInterface:            properties{me},
+		introspect.IntrospectData.Name: introspect.Introspectable(introspectXML),
+	} {
+		if err := conn.ExportWithMap(v, methodNames, objectPath, iface); err != nil {
+			return fmt.Errorf("exporting %s: %w", iface, err)
+		}
+	}
+	name := busNamePrefix + me.Name
+	ok, err := me.requestName(name)
+	if err == nil && !ok {
+		name = fmt.Sprintf("%s.instance%d", name, os.Getpid())
+		ok, err = me.requestName(name)
+	}
+	if err != nil {
+		return fmt.Errorf("requesting name %q: %w", name, err)
+	}
+	if !ok {
+		return fmt.Errorf("name %q is taken", name)
+	}
+	me.mu.Lock()
+	me.busName = name
+	me.mu.Unlock()
+	return nil
+}
+
+// Asks the bus for the name, reporting whether the player got it.
+func (me *Player) requestName(name string) (bool, error) {
+	reply, err := me.conn.RequestName(name, dbus.NameFlagDoNotQueue)
+	return reply == dbus.RequestNameReplyPrimaryOwner, err
+}
+
+// Returns the bus name the player is published under, once it's started.
+func (me *Player) BusName() string {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.busName
+}
+
+// Removes the player from the bus.
+func (me *Player) Close() error {
+	if me.conn == nil {
+		return nil
+	}
+	return me.conn.Close()
+}
+
+// Sets the state of the player, telling desktops what's changed.
+func (me *Player) Update(state State) {
+	me.mu.Lock()
+	old := me.properties(playerInterface)
+	me.state = state
+	now := me.properties(playerInterface)
+	me.mu.Unlock()
+	changed := make(map[string]dbus.Variant)
+	for name, v := range now {
+		if !reflect.DeepEqual(old[name], v) {
+			changed[name] = dbus.MakeVariant(v)
+		}
+	}
+	if len(changed) == 0 || me.conn == nil {
+		return
+	}
+	if err := me.conn.Emit(objectPath, propertiesInterface+".PropertiesChanged", playerInterface, changed, []string{}); err != nil {
+		me.Logger.Levelf(log.Warning, "error sending PropertiesChanged: %v", err)
+	}
+}
+
+// Returns the properties of the interface of the player. The caller holds mu.
+func (me *Player) properties(iface string) map[string]interface{} {
+	switch iface {
+	case rootInterface:
+		return map[string]interface{}{
+			"CanQuit":             false,
+			"CanRaise":            false,
+			"HasTrackList":        false,
+			"Identity":            me.Identity,
+			"SupportedUriSchemes": []string{},
+			"SupportedMimeTypes":  []string{},
+		}
+	case playerInterface:
+		return map[string]interface{}{
+			"PlaybackStatus": me.state.Status,
+			"Rate":           1.0,
+			"MinimumRate":    1.0,
+			"MaximumRate":    1.0,
+			"Volume":         1.0,
+			"Metadata":       me.state.Metadata.variants(),
+			// What's played is on the renderer, which isn't asked where it's up to.
+			"Position":      int64(0),
+			"CanGoNext":     me.state.CanGoNext,
+			"CanGoPrevious": me.state.CanGoPrevious,
+			"CanPlay":       me.state.CanPlay,
+			"CanPause":      me.state.CanPause,
+			"CanSeek":       false,
+			"CanControl":    true,
+		}
+	}
+	return nil
+}
+
+// Does what a desktop asked of the player, if the control can be used. Those that can't do
+// nothing, rather than failing.
+func (me *Player) control(control string) *dbus.Error {
+	me.mu.Lock()
+	can := me.state.can(control)
+	me.mu.Unlock()
+	if !can || me.OnControl == nil {
+		return nil
+	}
+	if err := me.OnControl(control); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+// The methods of org.freedesktop.DBus.Properties. None can be set.
+type properties struct {
+	p *Player
+}
+
+func (me properties) Get(iface, name string) (dbus.Variant, *dbus.Error) {
+	me.p.mu.Lock()
+	v, ok := me.p.properties(iface)[name]
+	me.p.mu.Unlock()
+	if !ok {
+		return dbus.Variant{}, dbus.NewError(errInvalidArgs, []interface{}{fmt.Sprintf("no property %q of %q", name, iface)})
+	}
+	return dbus.MakeVariant(v), nil
+}
+
+func (me properties) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	me.p.mu.Lock()
+	props := me.p.properties(iface)
+	me.p.mu.Unlock()
+	ret := make(map[string]dbus.Variant, len(props))
+	for name, v := range props {
+		ret[name] = dbus.MakeVariant(v)
+	}
+	return ret, nil
+}
+
+func (me properties) Set(iface, name string, v dbus.Variant) *dbus.Error {
+	return dbus.NewError(errPropertyReadOnly, []interface{}{"properties can't be set"})
+}
+
+// The methods of org.mpris.MediaPlayer2. CanRaise and CanQuit are false, so they do nothing.
+type rootMethods struct{}
+
+func (rootMethods) Raise() *dbus.Error { return nil }
+
+func (rootMethods) Quit() *dbus.Error { return nil }
+
+// The methods of org.mpris.MediaPlayer2.Player.
+type playerMethods struct {
+	p *Player
+}
+
+func (me playerMethods) Play() *dbus.Error      { return me.p.control(Play) }
+func (me playerMethods) Pause() *dbus.Error     { return me.p.control(Pause) }
+func (me playerMethods) PlayPause() *dbus.Error { return me.p.control(PlayPause) }
+func (me playerMethods) Stop() *dbus.Error      { return me.p.control(Stop) }
+func (me playerMethods) Next() *dbus.Error      { return me.p.control(Next) }
+func (me playerMethods) Previous() *dbus.Error  { return me.p.control(Previous) }
+
+// CanSeek is false, so seeking does nothing. It's exported as Seek, which vet takes for io.Seeker's.
+func (playerMethods) SeekBy(offset int64) *dbus.Error { return nil }
+
+func (playerMethods) SetPosition(track dbus.ObjectPath, position int64) *dbus.Error { return nil }
+
+func (playerMethods) OpenUri(uri string) *dbus.Error {
+	return dbus.NewError(errNotSupported, []interface{}{"no URI schemes are supported"})
+}
+
+const introspectXML = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+  <interface name="org.freedesktop.DBus.Introspectable">
+    <method name="Introspect"><arg name="data" type="s" direction="out"/></method>
+  </interface>
+  <interface name="org.freedesktop.DBus.Peer">
+    <method name="Ping"/>
+  </interface>
+  <interface name="org.freedesktop.DBus.Properties">
+    <method name="Get">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="property" type="s" direction="in"/>
+      <arg name="value" type="v" direction="out"/>
+    </method>
+    <method name="GetAll">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="properties" type="a{sv}" direction="out"/>
+    </method>
+    <method name="Set">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="property" type="s" direction="in"/>
+      <arg name="value" type="v" direction="in"/>
+    </method>
+    <signal name="PropertiesChanged">
+      <arg name="interface" type="s"/>
+      <arg name="changed" type="a{sv}"/>
+      <arg name="invalidated" type="as"/>
+    </signal>
+  </interface>
+  <interface name="org.mpris.MediaPlayer2">
+    <method name="Raise"/>
+    <method name="Quit"/>
+    <property name="CanQuit" type="b" access="read"/>
+    <property name="CanRaise" type="b" access="read"/>
+    <property name="HasTrackList" type="b" access="read"/>
+    <property name="Identity" type="s" access="read"/>
+    <property name="SupportedUriSchemes" type="as" access="read"/>
+    <property name="SupportedMimeTypes" type="as" access="read"/>
+  </interface>
+  <interface name="org.mpris.MediaPlayer2.Player">
+    <method name="Next"/>
+    <method name="Previous"/>
+    <method name="Pause"/>
+    <method name="PlayPause"/>
+    <method name="Stop"/>
+    <method name="Play"/>
+    <method name="Seek"><arg name="Offset" type="x" direction="in"/></method>
+    <method name="SetPosition">
+      <arg name="TrackId" type="o" direction="in"/>
+      <arg name="Position" type="x" direction="in"/>
+    </method>
+    <method name="OpenUri"><arg name="Uri" type="s" direction="in"/></method>
+    <signal name="Seeked"><arg name="Position" type="x"/></signal>
+    <property name="PlaybackStatus" type="s" access="read"/>
+    <property name="Rate" type="d" access="read"/>
+    <property name="Metadata" type="a{sv}" access="read"/>
+    <property name="Volume" type="d" access="read"/>
+    <property name="Position" type="x" access="read"/>
+    <property name="MinimumRate" type="d" access="read"/>
+    <property name="MaximumRate" type="d" access="read"/>
+    <property name="CanGoNext" type="b" access="read"/>
+    <property name="CanGoPrevious" type="b" access="read"/>
+    <property name="CanPlay" type="b" access="read"/>
+    <property name="CanPause" type="b" access="read"/>
+    <property name="CanSeek" type="b" access="read"/>
+    <property name="CanControl" type="b" access="read"/>
+  </interface>
+</node>
+`
@@ -0,0 +1,200 @@
+package mpris
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/log"
+	"github.com/godbus/dbus/v5"
+)
+
+const testBusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-BUS Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:dir=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// Starts a session bus of its own for the test, skipping it without dbus-daemon.
+func startSessionBus(t *testing.T) {
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("no dbus-daemon")
+	}
+	dir := t.TempDir()
+	config := filepath.Join(dir, "session.conf")
+	if err := os.WriteFile(config, []byte(fmt.Sprintf(testBusConfig, dir)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("dbus-daemon", "--nofork", "--print-address", "--config-file", config)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	addr, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", strings.TrimSpace(addr))
+}
+
+// Returns the name of the D-Bus error the call failed with.
+func errorName(err error) string {
+	var e dbus.Error
+	if errors.As(err, &e) {
+		return e.Name
+	}
+	return ""
+}
+
+func TestPlayer(t *testing.T) {
+	startSessionBus(t)
+	desktop, err := dbus.ConnectSessionBus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desktop.Close()
+	// The name is taken, so the player has one with its PID.
+	if _, err := desktop.RequestName(busNamePrefix+"test", dbus.NameFlagDoNotQueue); err != nil {
+		t.Fatal(err)
+	}
+	if err := desktop.AddMatchSignal(dbus.WithMatchInterface(propertiesInterface), dbus.WithMatchMember("PropertiesChanged")); err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan *dbus.Signal, 10)
+	desktop.Signal(signals)
+
+	// Controls are called from the connection's goroutine.
+	var mu sync.Mutex
+	var controls []string
+	controlled := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.Join(controls, ",")
+	}
+	p := &Player{
+		Name:     "test",
+		Identity: "Test",
+		Logger:   log.Default,
+		OnControl: func(control string) error {
+			mu.Lock()
+			controls = append(controls, control)
+			mu.Unlock()
+			if control == Next {
+				return errors.New("no next track")
+			}
+			return nil
+		},
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if name := p.BusName(); name != fmt.Sprintf("%stest.instance%d", busNamePrefix, os.Getpid()) {
+		t.Errorf("got bus name %q", name)
+	}
+	obj := desktop.Object(p.BusName(), objectPath)
+
+	if v, err := obj.GetProperty(rootInterface + ".Identity"); err != nil || v.Value() != "Test" {
+		t.Errorf("got Identity %v, %v", v, err)
+	}
+	if v, err := obj.GetProperty(playerInterface + ".PlaybackStatus"); err != nil || v.Value() != Stopped {
+		t.Errorf("got PlaybackStatus %v, %v", v, err)
+	}
+	// Nothing can be done while stopped.
+	if err := obj.Call(playerInterface+"."+PlayPause, 0).Err; err != nil || controlled() != "" {
+		t.Errorf("got %v, controls %s", err, controlled())
+	}
+
+	state := State{
+		Status: Playing,
+		Metadata: Metadata{
+			TrackID: 2,
+			Title:   "Song",
+			Artists: []string{"Artist"},
+			Length:  90 * time.Second,
+		},
+		CanPlay:   true,
+		CanPause:  true,
+		CanGoNext: true,
+	}
+	p.Update(state)
+	var signal *dbus.Signal
+	select {
+	case signal = <-signals:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no PropertiesChanged")
+	}
+	if signal.Path != objectPath || signal.Body[0] != playerInterface {
+		t.Fatalf("got %v %v", signal.Path, signal.Body)
+	}
+	changed := signal.Body[1].(map[string]dbus.Variant)
+	if _, ok := changed["CanGoPrevious"]; ok || changed["PlaybackStatus"].Value() != Playing {
+		t.Errorf("got changed %v", changed)
+	}
+	metadata := changed["Metadata"].Value().(map[string]dbus.Variant)
+	if metadata["xesam:title"].Value() != "Song" || metadata["mpris:length"].Value() != int64(90e6) {
+		t.Errorf("got metadata %v", metadata)
+	}
+	// Nothing's sent when nothing changes. It would arrive before the reply to GetAll.
+	p.Update(state)
+
+	var all map[string]dbus.Variant
+	if err := obj.Call(propertiesInterface+".GetAll", 0, playerInterface).Store(&all); err != nil {
+		t.Fatal(err)
+	}
+	if all["CanPause"].Value() != true || all["CanSeek"].Value() != false {
+		t.Errorf("got %v", all)
+	}
+	if len(signals) != 0 {
+		t.Errorf("got %v", <-signals)
+	}
+	if err := obj.Call(playerInterface+"."+PlayPause, 0).Err; err != nil {
+		t.Error(err)
+	}
+	if err := obj.Call(playerInterface+"."+Next, 0).Err; errorName(err) != "org.freedesktop.DBus.Error.Failed" {
+		t.Errorf("got %v", err)
+	}
+	// Previous can't be used.
+	obj.Call(playerInterface+"."+Previous, 0)
+	if got := controlled(); got != "PlayPause,Next" {
+		t.Errorf("got controls %s", got)
+	}
+	if err := obj.Call(playerInterface+".Seek", 0, int64(5e6)).Err; err != nil {
+		t.Errorf("seeking got %v", err)
+	}
+	if err := obj.Call(playerInterface+".Shuffle", 0).Err; errorName(err) != "org.freedesktop.DBus.Error.UnknownMethod" {
+		t.Errorf("got %v", err)
+	}
+	if _, err := obj.GetProperty(playerInterface + ".Nope"); errorName(err) != errInvalidArgs {
+		t.Errorf("got %v", err)
+	}
+	if err := obj.SetProperty(playerInterface+".Volume", dbus.MakeVariant(0.5)); errorName(err) != errPropertyReadOnly {
+		t.Errorf("got %v", err)
+	}
+	var xml string
+	if err := obj.Call("org.freedesktop.DBus.Introspectable.Introspect", 0).Store(&xml); err != nil || !strings.Contains(xml, playerInterface) {
+		t.Errorf("got %q, %v", xml, err)
+	}
+}
@@ -0,0 +1,82 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Looks up a user by name, or by ID if there's none of that name.
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if _, numErr := strconv.Atoi(name); err != nil && numErr == nil {
+		return user.LookupId(name)
+	}
+	return u, err
+}
+
+// Looks up a group by name, or by ID if there's none of that name.
+func lookupGroup(name string) (*user.Group, error) {
+	g, err := user.LookupGroup(name)
+	if _, numErr := strconv.Atoi(name); err != nil && numErr == nil {
+		return user.LookupGroupId(name)
+	}
+	return g, err
+}
+
+// Switches the process to userName, and groupName or else the user's primary group, so that dms
+// doesn't run as root once it has opened its listeners. The user's other groups are kept, since
+// they often give read access to media.
+func dropPrivileges(userName, groupName string) error {
+	u, err := lookupUser(userName)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	if groupName != "" {
+		g, err := lookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+	if os.Getuid() == uid && os.Getgid() == gid {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("switching to user %q needs dms to be started as root", u.Username)
+	}
+	groups := []int{gid}
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if g, err := strconv.Atoi(id); err == nil && g != gid {
+				groups = append(groups, g)
+			}
+		}
+	}
+	// Groups are set first, since root is needed to set them.
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setting groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setting group: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setting user: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "errors"
+
+func dropPrivileges(userName, groupName string) error {
+	return errors.New("-user isn't supported on Windows. Give the service an account to run as instead")
+}
@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// Runs dms again with args in a new session, detached from the terminal, with its output in
+// logPath.
+func detach(args []string, logPath string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		return err
+	}
+	defer null.Close()
+	if err := os.MkdirAll(filepath.Dir(logPath), 0o750); err != nil {
+		return err
+	}
+	out, err := os.Create(logPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	cmd := exec.Command(exe, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = null, out, out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	fmt.Printf("dms is running in the background as process %d, logging to %s\n", cmd.Process.Pid, logPath)
+	return cmd.Process.Release()
+}
+
+func manageService(action string, args []string) error {
+	return errors.New("services are only supported on Windows. Use -detach, or a service manager such as systemd")
+}
+
+// The signals that rescan the library.
+var rescanSignals = []os.Signal{syscall.SIGUSR1}
+
+// Only Windows has services.
+func startService(sigs chan<- os.Signal, stopTimeout time.Duration) (stopped func(), err error) {
+	return func() {}, nil
+}
+
+// Returns the handler for logs when dms is running as a service, which has no terminal.
+func serviceLogHandler() (log.Handler, bool) {
+	return nil, false
+}
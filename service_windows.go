@@ -0,0 +1,148 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/anacrolix/log"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// Windows has no SIGUSR1, so the library is only rescanned through the API.
+var rescanSignals []os.Signal
+
+func detach(args []string, logPath string) error {
+	return errors.New("-detach isn't supported on Windows. Install dms as a service with -service install")
+}
+
+// Installs, uninstalls, starts or stops the Windows service. It's installed to run dms with args.
+func manageService(action string, args []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+	if action == "install" {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		s, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: "dms",
+			Description: "DLNA media server",
+			StartType:   mgr.StartAutomatic,
+		}, args...)
+		if err != nil {
+			return fmt.Errorf("installing service: %w", err)
+		}
+		defer s.Close()
+		if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			s.Delete()
+			return fmt.Errorf("installing event log source: %w", err)
+		}
+		fmt.Printf("installed service %q running %s %q\n", serviceName, exe, args)
+		return nil
+	}
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("opening service %q: %w", serviceName, err)
+	}
+	defer s.Close()
+	switch action {
+	case "uninstall":
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		return eventlog.Remove(serviceName)
+	case "start":
+		return s.Start()
+	case "stop":
+		_, err := s.Control(svc.Stop)
+		return err
+	}
+	return fmt.Errorf("unknown service action %q, want install, uninstall, start or stop", action)
+}
+
+// Passes the service manager's requests to stop to the signal loop.
+type serviceHandler struct {
+	sigs        chan<- os.Signal
+	stopTimeout time.Duration
+	stopped     chan struct{}
+}
+
+func (me *serviceHandler) Execute(args []string, reqs <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case req := <-reqs:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				// Streams are let finish for up to the shutdown timeout.
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32((me.stopTimeout + 10*time.Second) / time.Millisecond)}
+				me.sigs <- syscall.SIGTERM
+			}
+		case <-me.stopped:
+			return false, 0
+		}
+	}
+}
+
+// Runs the service's control handler if dms was started as a Windows service. The returned func
+// tells the service manager it's stopped.
+func startService(sigs chan<- os.Signal, stopTimeout time.Duration) (stopped func(), err error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return func() {}, err
+	}
+	h := &serviceHandler{sigs: sigs, stopTimeout: stopTimeout, stopped: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := svc.Run(serviceName, h); err != nil {
+			log.Levelf(log.Error, "running service: %v", err)
+		}
+	}()
+	return func() {
+		close(h.stopped)
+		<-done
+	}, nil
+}
+
+// Writes logs to the Windows event log.
+type eventLogHandler struct {
+	l *eventlog.Log
+}
+
+func (me eventLogHandler) Handle(r log.Record) {
+	switch {
+	case !r.Level.LessThan(log.Error):
+		me.l.Error(1, r.Text())
+	case !r.Level.LessThan(log.Warning):
+		me.l.Warning(1, r.Text())
+	default:
+		me.l.Info(1, r.Text())
+	}
+}
+
+// Returns the handler for logs when dms is running as a service, which has no terminal.
+func serviceLogHandler() (log.Handler, bool) {
+	if isService, err := svc.IsWindowsService(); err != nil || !isService {
+		return nil, false
+	}
+	l, err := eventlog.Open(serviceName)
+	if err != nil {
+		return nil, false
+	}
+	return eventLogHandler{l}, true
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/dms/dlna/dms"
+)
+
+func getDefaultConfigPath() string {
+	_user, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(_user.HomeDir, ".dms", "config.json")
+}
+
+// Whether someone is at a terminal to answer the setup wizard's questions.
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	// Services are often given the null device, which is a character device too.
+	if null, err := os.Stat(os.DevNull); err == nil && os.SameFile(fi, null) {
+		return false
+	}
+	return true
+}
+
+// The settings the setup wizard asks for, as they're written to the config file.
+type setupConfig struct {
+	Path         string        `json:",omitempty"`
+	Paths        []dms.RootDir `json:",omitempty"`
+	FriendlyName string        `json:",omitempty"`
+	Http         string
+	IfNames      []string `json:",omitempty"`
+}
+
+// Sets the shared directories from lines of the form of -path.
+func (sc *setupConfig) setPaths(lines []string) error {
+	var paths rootDirsFlag
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			paths.Set(line)
+		}
+	}
+	if len(paths) == 0 {
+		return errors.New("no media directories given")
+	}
+	for i := range paths {
+		abs, err := filepath.Abs(paths[i].Path)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(abs); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return fmt.Errorf("%s isn't a directory", abs)
+		}
+		paths[i].Path = abs
+	}
+	sc.Path, sc.Paths = "", nil
+	if len(paths) == 1 && paths[0].Name == "" {
+		sc.Path = paths[0].Path
+	} else {
+		sc.Paths = paths
+	}
+	return nil
+}
+
+// Sets the port to serve HTTP on, keeping the host of the current address.
+func (sc *setupConfig) setPort(s string) error {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("bad port %q", s)
+	}
+	host, _, _ := net.SplitHostPort(sc.Http)
+	sc.Http = net.JoinHostPort(host, strconv.Itoa(port))
+	return nil
+}
+
+// Sets the interface to serve on, given by name, or by number in ifs counting from 1. Empty is
+// all of them.
+func (sc *setupConfig) setInterface(s string, ifs []net.Interface) error {
+	s = strings.TrimSpace(s)
+	sc.IfNames = nil
+	if s == "" || s == "all" {
+		return nil
+	}
+	if i, err := strconv.Atoi(s); err == nil && i >= 1 && i <= len(ifs) {
+		s = ifs[i-1].Name
+	}
+	for _, if_ := range ifs {
+		if if_.Name == s {
+			sc.IfNames = []string{s}
+			return nil
+		}
+	}
+	return fmt.Errorf("no interface %q", s)
+}
+
+func (sc *setupConfig) port() string {
+	_, port, _ := net.SplitHostPort(sc.Http)
+	return port
+}
+
+func (sc *setupConfig) write(configPath string) error {
+	b, err := json.MarshalIndent(sc, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(configPath, append(b, '\n'), 0o600)
+}
+
+// Returns the interfaces that media can be served on, for the wizard to offer.
+func setupInterfaces() (ret []net.Interface) {
+	ifs, _ := selectInterfaces(nil)
+	for _, if_ := range ifs {
+		if if_.Flags&net.FlagLoopback == 0 {
+			ret = append(ret, if_)
+		}
+	}
+	return
+}
+
+// Describes an interface by its name and addresses, such as "eth0 192.168.1.10".
+func interfaceDescription(if_ net.Interface) string {
+	s := if_.Name
+	addrs, _ := if_.Addrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			s += " " + ipNet.IP.String()
+		}
+	}
+	return s
+}
+
+// Starts setupConfig from the flags, sharing the working directory if no directories were given.
+func newSetupConfig(config *dmsConfig) (sc setupConfig, err error) {
+	sc = setupConfig{
+		Path:         config.Path,
+		Paths:        config.Paths,
+		FriendlyName: config.FriendlyName,
+		Http:         config.Http,
+		IfNames:      config.IfNames,
+	}
+	if sc.Path == "" && len(sc.Paths) == 0 {
+		sc.Path, err = os.Getwd()
+	}
+	return
+}
+
+// Returns the shared directories as they're entered.
+func (sc *setupConfig) pathLines() (ret []string) {
+	if sc.Path != "" {
+		return []string{sc.Path}
+	}
+	for _, rd := range sc.Paths {
+		if rd.Name != "" {
+			ret = append(ret, rd.Name+"="+rd.Path)
+		} else {
+			ret = append(ret, rd.Path)
+		}
+	}
+	return
+}
+
+// Asks for the settings on the terminal, and writes them to configPath.
+func runSetupWizard(in io.Reader, out io.Writer, configPath string, config *dmsConfig) error {
+	sc, err := newSetupConfig(config)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(in)
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimSpace(line), err
+	}
+	// Asks until set accepts the answer, or the default given by an empty one.
+	ask := func(prompt, def string, set func(string) error) error {
+		for {
+			fmt.Fprintf(out, "%s [%s]: ", prompt, def)
+			answer, err := readLine()
+			if err != nil {
+				return err
+			}
+			if answer == "" {
+				answer = def
+			}
+			if err := set(answer); err != nil {
+				fmt.Fprintf(out, "%v\n", err)
+				continue
+			}
+			return nil
+		}
+	}
+	fmt.Fprintf(out, "No config file was found, so let's set up dms. Press Enter to take the suggestion in brackets.\n\n")
+	for {
+		fmt.Fprintf(out, "Media directories to share, one per line, optionally named with Name=directory. An empty line ends the list [%s]:\n", strings.Join(sc.pathLines(), ", "))
+		var lines []string
+		for {
+			line, err := readLine()
+			if err != nil {
+				return err
+			}
+			if line == "" {
+				break
+			}
+			lines = append(lines, line)
+		}
+		if lines == nil {
+			break
+		}
+		if err := sc.setPaths(lines); err != nil {
+			fmt.Fprintf(out, "%v\n", err)
+			continue
+		}
+		break
+	}
+	if err := ask("Name shown on TVs and players, or - for the default", "-", func(s string) error {
+		if s == "-" {
+			s = ""
+		}
+		sc.FriendlyName = s
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := ask("Port to serve on", sc.port(), sc.setPort); err != nil {
+		return err
+	}
+	ifs := setupInterfaces()
+	if len(ifs) > 1 {
+		fmt.Fprintf(out, "Network interfaces:\n")
+		for i, if_ := range ifs {
+			fmt.Fprintf(out, "  %d) %s\n", i+1, interfaceDescription(if_))
+		}
+		if err := ask("Interface to serve on, by number or name, or all", "all", func(s string) error {
+			return sc.setInterface(s, ifs)
+		}); err != nil {
+			return err
+		}
+	}
+	if err := sc.write(configPath); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\nSaved the settings to %s. Edit it to change them, or delete it to run setup again.\n\n", configPath)
+	return nil
+}
+
+var setupPage = template.Must(template.New("setup").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Set up dms</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; }
+label { display: block; margin-top: 1em; font-weight: bold; }
+input, textarea, select { width: 100%; box-sizing: border-box; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+{{if .Done}}
+<h1>dms is starting</h1>
+<p>The settings were saved to <code>{{.ConfigPath}}</code>. It'll show up on your TVs and players shortly.</p>
+{{else}}
+<h1>Set up dms</h1>
+{{with .Error}}<p class="error">{{.}}</p>{{end}}
+<form method="post">
+<label for="paths">Media directories to share, one per line</label>
+<textarea id="paths" name="paths" rows="4">{{.Paths}}</textarea>
+<label for="name">Name shown on TVs and players</label>
+<input id="name" name="name" value="{{.Config.FriendlyName}}" placeholder="Default">
+<label for="port">Port</label>
+<input id="port" name="port" value="{{.Port}}">
+<label for="ifname">Network interface</label>
+<select id="ifname" name="ifname">
+<option value="">All</option>
+{{range .Interfaces}}<option value="{{.Name}}"{{if eq .Name $.IfName}} selected{{end}}>{{.Description}}</option>
+{{end}}</select>
+<p><button type="submit">Save and start</button></p>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type setupPageInterface struct {
+	Name, Description string
+}
+
+type setupPageData struct {
+	Config     *setupConfig
+	Paths      string
+	Port       string
+	IfName     string
+	Interfaces []setupPageInterface
+	Error      error
+	Done       bool
+	ConfigPath string
+}
+
+// Whether a client may use the setup page. Anyone who can reach it can choose what's shared.
+func setupClientAllowed(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+// Serves the setup page, until the settings are saved to configPath, when done is closed.
+type setupHandler struct {
+	logger     log.Logger
+	configPath string
+	ifs        []net.Interface
+	done       chan struct{}
+
+	mu   sync.Mutex
+	sc   setupConfig
+	data setupPageData
+}
+
+func newSetupHandler(logger log.Logger, configPath string, config *dmsConfig, ifs []net.Interface) (*setupHandler, error) {
+	sc, err := newSetupConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	me := &setupHandler{
+		logger:     logger,
+		configPath: configPath,
+		ifs:        ifs,
+		done:       make(chan struct{}),
+		sc:         sc,
+	}
+	me.data = setupPageData{Config: &me.sc, ConfigPath: configPath}
+	for _, if_ := range ifs {
+		me.data.Interfaces = append(me.data.Interfaces, setupPageInterface{if_.Name, interfaceDescription(if_)})
+	}
+	return me, nil
+}
+
+func (me *setupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !setupClientAllowed(r.RemoteAddr) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	// Otherwise a page elsewhere, open in a browser on the network, could choose what's shared.
+	if r.Method == http.MethodPost && !dms.SameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	sc, data := &me.sc, &me.data
+	data.Error = nil
+	if r.Method == http.MethodPost && !data.Done {
+		data.Error = sc.setPaths(strings.Split(r.FormValue("paths"), "\n"))
+		if data.Error == nil {
+			data.Error = sc.setPort(r.FormValue("port"))
+		}
+		if data.Error == nil {
+			data.Error = sc.setInterface(r.FormValue("ifname"), me.ifs)
+		}
+		sc.FriendlyName = strings.TrimSpace(r.FormValue("name"))
+		if data.Error == nil {
+			data.Error = sc.write(me.configPath)
+		}
+		if data.Error == nil {
+			data.Done = true
+			defer close(me.done)
+		}
+	}
+	data.Paths = strings.Join(sc.pathLines(), "\n")
+	data.Port = sc.port()
+	data.IfName = strings.Join(sc.IfNames, "")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := setupPage.Execute(w, data); err != nil {
+		me.logger.Levelf(log.Error, "rendering setup page: %v", err)
+	}
+}
+
+// Serves a page to set up dms on the HTTP address, for when there's no terminal, until the
+// settings are saved to configPath.
+func serveSetupPage(logger log.Logger, configPath string, config *dmsConfig) error {
+	h, err := newSetupHandler(logger, configPath, config, setupInterfaces())
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", h.sc.Http)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: h}
+	logger.Printf("no config file was found, so open http://<this host>:%s/ to set up dms", h.sc.port())
+	go srv.Serve(ln)
+	<-h.done
+	// Let the page saying it's starting finish, and free the address for the server.
+	return srv.Shutdown(context.Background())
+}
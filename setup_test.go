@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/log"
+)
+
+func TestSetupPage(t *testing.T) {
+	dir := t.TempDir()
+	media := filepath.Join(dir, "media")
+	if err := os.Mkdir(media, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "config.json")
+	ifs := []net.Interface{{Index: 2, Name: "eth0"}}
+	h, err := newSetupHandler(log.Default, configPath, &dmsConfig{Path: dir, Http: ":1338"}, ifs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method, remoteAddr, origin string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "http://dms.local:1338/", strings.NewReader(form.Encode()))
+		r.RemoteAddr = remoteAddr
+		if method == "POST" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := serve("GET", "192.168.1.20:4000", "", nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), dir) {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if w := serve("GET", "203.0.113.5:4000", "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("public client got %d", w.Code)
+	}
+	form := url.Values{"paths": {media}, "name": {"Den"}, "port": {"8200"}, "ifname": {"eth0"}}
+	// A page elsewhere can't choose what's shared.
+	if w := serve("POST", "192.168.1.20:4000", "http://evil.example", form); w.Code != http.StatusForbidden {
+		t.Errorf("cross-origin POST got %d", w.Code)
+	}
+	bad := url.Values{"paths": {filepath.Join(dir, "missing")}, "port": {"8200"}}
+	if w := serve("POST", "192.168.1.20:4000", "http://dms.local:1338", bad); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `class="error"`) {
+		t.Errorf("bad settings got %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
+		t.Fatalf("config written before the settings were saved: %v", err)
+	}
+	select {
+	case <-h.done:
+		t.Fatal("done before the settings were saved")
+	default:
+	}
+	if w := serve("POST", "192.168.1.20:4000", "http://dms.local:1338", form); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "dms is starting") {
+		t.Fatalf("saving got %d: %s", w.Code, w.Body)
+	}
+	select {
+	case <-h.done:
+	default:
+		t.Fatal("not done after the settings were saved")
+	}
+	b, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got setupConfig
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Path != media || got.FriendlyName != "Den" || got.Http != ":8200" || len(got.IfNames) != 1 || got.IfNames[0] != "eth0" {
+		t.Errorf("saved %+v", got)
+	}
+	// Saving again doesn't close done twice.
+	if w := serve("POST", "192.168.1.20:4000", "http://dms.local:1338", form); w.Code != http.StatusOK {
+		t.Errorf("saving again got %d", w.Code)
+	}
+}
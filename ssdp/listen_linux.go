@@ -0,0 +1,65 @@
+package ssdp
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// Listens on the port of the multicast group like net.ListenMulticastUDP, but also sets
+// SO_REUSEPORT, so the port is shared with other servers on the host that only set that, such as
+// other media servers. net.ListenMulticastUDP only sets SO_REUSEADDR on Linux.
+func listenMulticastUDP(network string, ifi *net.Interface, gaddr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) (err error) {
+		cerr := c.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+			if err == nil {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return
+	}}
+	// The wildcard address is bound, as by net.ListenMulticastUDP.
+	laddr := &net.UDPAddr{IP: net.IPv4zero, Port: gaddr.Port}
+	if network == "udp6" {
+		laddr.IP = net.IPv6unspecified
+	} else {
+		network = "udp4"
+	}
+	pc, err := lc.ListenPacket(context.Background(), network, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+	if network == "udp6" {
+		p := ipv6.NewPacketConn(conn)
+		err = p.JoinGroup(ifi, gaddr)
+		if err == nil {
+			err = p.SetMulticastInterface(ifi)
+		}
+		if err == nil {
+			err = p.SetMulticastLoopback(false)
+		}
+	} else {
+		p := ipv4.NewPacketConn(conn)
+		err = p.JoinGroup(ifi, gaddr)
+		if err == nil {
+			err = p.SetMulticastInterface(ifi)
+		}
+		if err == nil {
+			err = p.SetMulticastLoopback(false)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: gaddr, Err: err}
+	}
+	return conn, nil
+}
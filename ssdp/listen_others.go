@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package ssdp
+
+import "net"
+
+// net.ListenMulticastUDP already sets SO_REUSEADDR, and SO_REUSEPORT where it's needed too, so
+// the port is shared with other servers on the host.
+func listenMulticastUDP(network string, ifi *net.Interface, gaddr *net.UDPAddr) (*net.UDPConn, error) {
+	return net.ListenMulticastUDP(network, ifi, gaddr)
+}
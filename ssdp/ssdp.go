@@ -11,21 +11,37 @@ import (
 	"net/textproto"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/anacrolix/log"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 const (
 	AddrString = "239.255.255.250:1900"
+	// The link-local scope multicast group for SSDP over IPv6.
+	AddrString6 = "[FF02::C]:1900"
+
 	rootDevice = "upnp:rootdevice"
 	aliveNTS   = "ssdp:alive"
 	byebyeNTS  = "ssdp:byebye"
+	updateNTS  = "ssdp:update"
 	mxMax      = 10
+
+	// The CACHE-CONTROL max-age given when neither it nor the notify interval is, the least UPnP
+	// recommends.
+	DefaultMaxAge = 30 * time.Minute
+	// The multicast TTL, or IPv6 hop limit, used when none is given.
+	DefaultTTL = 2
+	// Announcements are sent this many times when the server starts, as UDP may lose some, this
+	// far apart.
+	initialNotifies      = 3
+	initialNotifySpacing = time.Second
 )
 
-var NetAddr *net.UDPAddr
+var NetAddr, NetAddr6 *net.UDPAddr
 
 func init() {
 	var err error
@@ -33,6 +49,10 @@ func init() {
 	if err != nil {
 		log.Printf("Could not resolve %s: %s", AddrString, err)
 	}
+	NetAddr6, err = net.ResolveUDPAddr("udp6", AddrString6)
+	if err != nil {
+		log.Printf("Could not resolve %s: %s", AddrString6, err)
+	}
 }
 
 type badStringError struct {
@@ -90,15 +110,59 @@ type Server struct {
 	NotifyInterval time.Duration
 	closed         chan struct{}
 	Logger         log.Logger
+	// Called for each NOTIFY message sent, with its NTS, such as "ssdp:alive".
+	OnNotify func(nts string)
+	// Called for each M-SEARCH discovery request and its sender, with whether any of the targets
+	// searched for are ours. Those from senders SenderFilter refuses aren't answered.
+	OnSearch func(req *http.Request, sender *net.UDPAddr, answered bool)
+	// Reports whether to answer searches from the address. All are answered if nil.
+	SenderFilter func(net.IP) bool
+	// Called for each NOTIFY message from other devices that passes SenderFilter, such as
+	// renderers announcing themselves.
+	OnAnnounce func(req *http.Request, sender *net.UDPAddr)
+	// Use the IPv6 multicast group rather than the IPv4 one. Only addresses of the server's family
+	// are advertised.
+	IPv6 bool
+	// BOOTID.UPNP.ORG, which must increase each time the device restarts, such as the Unix time it
+	// started at. Update advances it.
+	BootID int32
+	// CONFIGID.UPNP.ORG, which identifies the device description. Update changes it.
+	ConfigID int32
+	// Control points that NOTIFY messages are sent to directly as well as to the multicast group,
+	// such as ones on routed networks it doesn't reach. Each is sent those for the address the
+	// host reaches it from, so the server on another interface or family sends it none.
+	UnicastAddrs []*net.UDPAddr
+	// Returns the HTTPS URL of the device description at an address, for SECURELOCATION.UPNP.ORG,
+	// which control points that support TLS fetch rather than LOCATION. Optional.
+	SecureLocation func(net.IP) string
+	// Called with each message received and each one sent, and the address it's from or to, such
+	// as to record them for debugging. Optional.
+	OnMessage func(sent bool, msg []byte, addr *net.UDPAddr)
+	// How long control points may take the server to be there after an announcement or a search
+	// response, as CACHE-CONTROL max-age. It defaults to 2.5 NotifyIntervals, or to DefaultMaxAge
+	// if neither is given, and NotifyInterval defaults to half of it.
+	MaxAge time.Duration
+	// The multicast TTL, or IPv6 hop limit, of what's sent. Defaults to DefaultTTL.
+	TTL int
 }
 
-func makeConn(ifi net.Interface) (ret *net.UDPConn, err error) {
-	ret, err = net.ListenMulticastUDP("udp", &ifi, NetAddr)
+func makeConn(ifi net.Interface, useIPv6 bool, ttl int) (ret *net.UDPConn, err error) {
+	if useIPv6 {
+		ret, err = listenMulticastUDP("udp6", &ifi, NetAddr6)
+		if err != nil {
+			return
+		}
+		if err := ipv6.NewPacketConn(ret).SetMulticastHopLimit(ttl); err != nil {
+			log.Print(err)
+		}
+		return
+	}
+	ret, err = listenMulticastUDP("udp", &ifi, NetAddr)
 	if err != nil {
 		return
 	}
 	p := ipv4.NewPacketConn(ret)
-	if err := p.SetMulticastTTL(2); err != nil {
+	if err := p.SetMulticastTTL(ttl); err != nil {
 		log.Print(err)
 	}
 	// if err := p.SetMulticastLoopback(true); err != nil {
@@ -107,7 +171,8 @@ func makeConn(ifi net.Interface) (ret *net.UDPConn, err error) {
 	return
 }
 
-func (me *Server) serve() {
+// Handles what's received until the server is closed, or reading fails.
+func (me *Server) serve() error {
 	for {
 		size := me.Interface.MTU
 		if size > 65536 {
@@ -119,12 +184,14 @@ func (me *Server) serve() {
 		n, addr, err := me.conn.ReadFromUDP(b)
 		select {
 		case <-me.closed:
-			return
+			return nil
 		default:
 		}
 		if err != nil {
-			me.Logger.Printf("error reading from UDP socket: %s", err)
-			break
+			return fmt.Errorf("reading from UDP socket: %w", err)
+		}
+		if me.OnMessage != nil {
+			me.OnMessage(false, b[:n], addr)
 		}
 		go me.handle(b[:n], addr)
 	}
@@ -132,7 +199,19 @@ func (me *Server) serve() {
 
 func (me *Server) Init() (err error) {
 	me.closed = make(chan struct{})
-	me.conn, err = makeConn(me.Interface)
+	if me.MaxAge == 0 {
+		me.MaxAge = DefaultMaxAge
+		if me.NotifyInterval != 0 {
+			me.MaxAge = 5 * me.NotifyInterval / 2
+		}
+	}
+	if me.NotifyInterval == 0 {
+		me.NotifyInterval = me.MaxAge / 2
+	}
+	if me.TTL == 0 {
+		me.TTL = DefaultTTL
+	}
+	me.conn, err = makeConn(me.Interface, me.IPv6, me.TTL)
 	if me.IPFilter == nil {
 		me.IPFilter = func(net.IP) bool { return true }
 	}
@@ -145,44 +224,139 @@ func (me *Server) Close() {
 	me.conn.Close()
 }
 
+// Announces the server a few times as it starts, and then about every NotifyInterval, and answers
+// searches, until it's closed. It returns early with an error if the interface can't be used
+// anymore, such as when it's gone.
 func (me *Server) Serve() (err error) {
-	go me.serve()
-	for {
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- me.serve()
+	}()
+	for i := 1; ; i++ {
 		select {
 		case <-me.closed:
 			return
 		default:
 		}
 
-		addrs, err := me.Interface.Addrs()
-		if err != nil {
+		if err := me.notifyAddrs(aliveNTS); err != nil {
 			return err
 		}
-		for _, addr := range addrs {
-			ip := func() net.IP {
-				switch val := addr.(type) {
-				case *net.IPNet:
-					return val.IP
-				case *net.IPAddr:
-					return val.IP
-				}
-				panic(fmt.Sprint("unexpected addr type:", addr))
-			}()
-			if !me.IPFilter(ip) {
-				continue
-			}
-			if ip.IsLinkLocalUnicast() {
-				// These addresses seem to confuse VLC. Possibly there's supposed to be a zone
-				// included in the address, but I don't see one.
-				continue
-			}
-			extraHdrs := [][2]string{
-				{"CACHE-CONTROL", fmt.Sprintf("max-age=%d", 5*me.NotifyInterval/2/time.Second)},
-				{"LOCATION", me.Location(ip)},
+		// Up to a fifth less, so that servers started together don't announce together.
+		wait := me.NotifyInterval - time.Duration(rand.Int63n(int64(me.NotifyInterval/5)+1))
+		if i < initialNotifies {
+			wait = initialNotifySpacing
+		}
+		select {
+		case <-me.closed:
+			return
+		case err := <-readErr:
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// The CACHE-CONTROL header of announcements and search responses.
+func (me *Server) cacheControl() [2]string {
+	return [2]string{"CACHE-CONTROL", fmt.Sprintf("max-age=%d", me.MaxAge/time.Second)}
+}
+
+// Sends notifications of the given type for each usable address on the interface.
+func (me *Server) notifyAddrs(nts string, moreHdrs ...[2]string) error {
+	ips, err := me.usableAddrs()
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		extraHdrs := append([][2]string{me.cacheControl()}, me.locationHeaders(ip)...)
+		extraHdrs = append(extraHdrs, moreHdrs...)
+		me.notifyAll(nts, extraHdrs, me.unicastAddrs(ip))
+	}
+	return nil
+}
+
+// Returns the addresses of the interface that are advertised.
+func (me *Server) usableAddrs() (ret []net.IP, err error) {
+	addrs, err := me.Interface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		ip := func() net.IP {
+			switch val := addr.(type) {
+			case *net.IPNet:
+				return val.IP
+			case *net.IPAddr:
+				return val.IP
 			}
-			me.notifyAll(aliveNTS, extraHdrs)
+			panic(fmt.Sprint("unexpected addr type:", addr))
+		}()
+		if !me.sameFamily(ip) || !me.IPFilter(ip) {
+			continue
+		}
+		if ip.IsLinkLocalUnicast() {
+			// These addresses seem to confuse VLC. Possibly there's supposed to be a zone
+			// included in the address, but I don't see one.
+			continue
+		}
+		ret = append(ret, ip)
+	}
+	return
+}
+
+// Returns the UnicastAddrs that the host sends to from ip.
+func (me *Server) unicastAddrs(ip net.IP) (ret []*net.UDPAddr) {
+	for _, addr := range me.UnicastAddrs {
+		if !me.sameFamily(addr.IP) {
+			continue
+		}
+		from, err := routedFrom(addr)
+		if err != nil {
+			me.Logger.Levelf(log.Debug, "can't reach %v: %v", addr, err)
+			continue
+		}
+		if from.Equal(ip) {
+			ret = append(ret, addr)
 		}
-		time.Sleep(me.NotifyInterval)
+	}
+	return
+}
+
+// Returns the local address the host would send to addr from. Nothing is sent.
+func routedFrom(addr *net.UDPAddr) (net.IP, error) {
+	c, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// Update announces that the device description has changed to that with configID, so that control
+// points fetch it again from LOCATION. The boot ID advances, and later messages carry the new IDs.
+func (me *Server) Update(configID int32) error {
+	atomic.StoreInt32(&me.ConfigID, configID)
+	bootID := atomic.LoadInt32(&me.BootID)
+	err := me.notifyAddrs(updateNTS, [2]string{"NEXTBOOTID.UPNP.ORG", strconv.Itoa(int(bootID + 1))})
+	atomic.StoreInt32(&me.BootID, bootID+1)
+	return err
+}
+
+// The UPnP 1.1 headers identifying the device's boot and description, for every message.
+// Returns LOCATION for the address, and SECURELOCATION.UPNP.ORG if there's a SecureLocation.
+func (me *Server) locationHeaders(ip net.IP) [][2]string {
+	ret := [][2]string{{"LOCATION", me.Location(ip)}}
+	if me.SecureLocation != nil {
+		ret = append(ret, [2]string{"SECURELOCATION.UPNP.ORG", me.SecureLocation(ip)})
+	}
+	return ret
+}
+
+func (me *Server) idHeaders() [][2]string {
+	return [][2]string{
+		{"BOOTID.UPNP.ORG", strconv.Itoa(int(atomic.LoadInt32(&me.BootID)))},
+		{"CONFIGID.UPNP.ORG", strconv.Itoa(int(atomic.LoadInt32(&me.ConfigID)))},
 	}
 }
 
@@ -195,7 +369,7 @@ func (me *Server) usnFromTarget(target string) string {
 
 func (me *Server) makeNotifyMessage(target, nts string, extraHdrs [][2]string) []byte {
 	lines := [...][2]string{
-		{"HOST", AddrString},
+		{"HOST", me.groupAddrString()},
 		{"NT", target},
 		{"NTS", nts},
 		{"SERVER", me.Server},
@@ -209,6 +383,9 @@ func (me *Server) makeNotifyMessage(target, nts string, extraHdrs [][2]string) [
 	for _, pair := range lines {
 		writeHdr(pair)
 	}
+	for _, pair := range me.idHeaders() {
+		writeHdr(pair)
+	}
 	for _, pair := range extraHdrs {
 		writeHdr(pair)
 	}
@@ -221,6 +398,8 @@ func (me *Server) send(buf []byte, addr *net.UDPAddr) {
 		me.Logger.Printf("error writing to UDP socket: %s", err)
 	} else if n != len(buf) {
 		me.Logger.Printf("short write: %d/%d bytes", n, len(buf))
+	} else if me.OnMessage != nil {
+		me.OnMessage(true, buf, addr)
 	}
 }
 
@@ -240,17 +419,115 @@ func (me *Server) log(args ...interface{}) {
 }
 
 func (me *Server) sendByeBye() {
+	var unicast []*net.UDPAddr
+	ips, _ := me.usableAddrs()
+	for _, ip := range ips {
+		unicast = append(unicast, me.unicastAddrs(ip)...)
+	}
 	for _, type_ := range me.allTypes() {
 		buf := me.makeNotifyMessage(type_, byebyeNTS, nil)
-		me.send(buf, NetAddr)
+		me.send(buf, me.groupAddr())
+		for _, addr := range unicast {
+			me.send(buf, addr)
+		}
+		me.notified(byebyeNTS)
 	}
 }
 
-func (me *Server) notifyAll(nts string, extraHdrs [][2]string) {
+// Sends notifications for each of the types to the multicast group, and to the unicast
+// addresses.
+func (me *Server) notifyAll(nts string, extraHdrs [][2]string, unicast []*net.UDPAddr) {
 	for _, type_ := range me.allTypes() {
 		buf := me.makeNotifyMessage(type_, nts, extraHdrs)
 		delay := time.Duration(rand.Int63n(int64(100 * time.Millisecond)))
-		me.delayedSend(delay, buf, NetAddr)
+		me.delayedSend(delay, buf, me.groupAddr())
+		for _, addr := range unicast {
+			me.delayedSend(delay, buf, addr)
+		}
+		me.notified(nts)
+	}
+}
+
+// Returns the address to answer a search from sender with, so that LOCATION is one it can reach:
+// the one the host sends to it from, if it's on the interface, such as for senders on other
+// networks, or else the one on its network. IPv6 senders often search from their link-local
+// address, which doesn't identify a network, so they're given one of the interface's other
+// addresses, preferring unique local ones, which don't change like global ones can. Returns nil if
+// the interface has none the sender can reach.
+func (me *Server) responseAddr(sender *net.UDPAddr) net.IP {
+	addrs, err := me.Interface.Addrs()
+	if err != nil {
+		// The interface has gone, and is left to be closed.
+		return nil
+	}
+	from, _ := routedFrom(sender)
+	return me.chooseResponseAddr(addrs, sender.IP, from)
+}
+
+// Returns which of the interface's addresses to answer a search from sender with, given the one
+// the host sends to it from, which is nil if there's no route to it. See responseAddr.
+func (me *Server) chooseResponseAddr(addrs []net.Addr, sender, from net.IP) net.IP {
+	linkLocalSender := me.IPv6 && sender.IsLinkLocalUnicast()
+	var candidates []*net.IPNet
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP
+		if !me.sameFamily(ip) || linkLocalSender && ip.IsLinkLocalUnicast() || !me.IPFilter(ip) {
+			continue
+		}
+		candidates = append(candidates, ipNet)
+	}
+	if from != nil {
+		for _, c := range candidates {
+			if c.IP.Equal(from) {
+				return c.IP
+			}
+		}
+	}
+	for _, c := range candidates {
+		if c.Contains(sender) {
+			return c.IP
+		}
+	}
+	if !linkLocalSender {
+		return nil
+	}
+	for _, c := range candidates {
+		if c.IP.IsPrivate() {
+			return c.IP
+		}
+	}
+	if len(candidates) != 0 {
+		return candidates[0].IP
+	}
+	return nil
+}
+
+func (me *Server) groupAddr() *net.UDPAddr {
+	if me.IPv6 {
+		return NetAddr6
+	}
+	return NetAddr
+}
+
+func (me *Server) groupAddrString() string {
+	if me.IPv6 {
+		return AddrString6
+	}
+	return AddrString
+}
+
+// Reports whether ip is of the address family the server is for.
+func (me *Server) sameFamily(ip net.IP) bool {
+	return (ip.To4() == nil) == me.IPv6
+}
+
+func (me *Server) notified(nts string) {
+	if me.OnNotify != nil {
+		me.OnNotify(nts)
 	}
 }
 
@@ -265,17 +542,63 @@ func (me *Server) allTypes() (ret []string) {
 	return
 }
 
+// Sends an M-SEARCH for devices or services of the target type, such as media renderers. The
+// responses are passed to OnAnnounce as if they were announcements. They're sent to the SSDP port,
+// so with other servers on the host sharing it, some may go to them instead.
+func (me *Server) Search(target string) {
+	buf := &bytes.Buffer{}
+	fmt.Fprint(buf, "M-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(buf, "HOST: %s\r\n", me.groupAddrString())
+	fmt.Fprint(buf, "MAN: \"ssdp:discover\"\r\n")
+	fmt.Fprint(buf, "MX: 2\r\n")
+	fmt.Fprintf(buf, "ST: %s\r\n", target)
+	fmt.Fprint(buf, "\r\n")
+	me.send(buf.Bytes(), me.groupAddr())
+}
+
+// Passes a response to Search to OnAnnounce, as an ssdp:alive announcement of the type searched
+// for.
+func (me *Server) handleSearchResponse(buf []byte, sender *net.UDPAddr) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return
+	}
+	if me.OnAnnounce == nil || me.SenderFilter != nil && !me.SenderFilter(sender.IP) {
+		return
+	}
+	req := &http.Request{Method: "NOTIFY", Header: resp.Header}
+	req.Header.Set("NT", resp.Header.Get("ST"))
+	req.Header.Set("NTS", aliveNTS)
+	me.OnAnnounce(req, sender)
+}
+
 func (me *Server) handle(buf []byte, sender *net.UDPAddr) {
+	if bytes.HasPrefix(buf, []byte("HTTP/")) {
+		me.handleSearchResponse(buf, sender)
+		return
+	}
 	req, err := ReadRequest(bufio.NewReader(bytes.NewReader(buf)))
 	if err != nil {
 		me.Logger.Println(err)
 		return
 	}
+	if req.Method == "NOTIFY" {
+		if me.OnAnnounce != nil && (me.SenderFilter == nil || me.SenderFilter(sender.IP)) {
+			me.OnAnnounce(req, sender)
+		}
+		return
+	}
 	if req.Method != "M-SEARCH" || req.Header.Get("man") != `"ssdp:discover"` {
 		return
 	}
+	if me.SenderFilter != nil && !me.SenderFilter(sender.IP) {
+		if me.OnSearch != nil {
+			me.OnSearch(req, sender, false)
+		}
+		return
+	}
 	var mx int64
-	if req.Header.Get("Host") == AddrString {
+	if strings.EqualFold(req.Header.Get("Host"), me.groupAddrString()) {
 		mxHeader := req.Header.Get("mx")
 		i, err := strconv.ParseUint(mxHeader, 0, 0)
 		if err != nil {
@@ -302,34 +625,18 @@ func (me *Server) handle(buf []byte, sender *net.UDPAddr) {
 		}
 		return nil
 	}(req.Header.Get("st"))
-	for _, ip := range func() (ret []net.IP) {
-		addrs, err := me.Interface.Addrs()
-		if err != nil {
-			panic(err)
-		}
-		for _, addr := range addrs {
-			if ip, ok := func() (net.IP, bool) {
-				switch data := addr.(type) {
-				case *net.IPNet:
-					if data.Contains(sender.IP) {
-						return data.IP, true
-					}
-					return nil, false
-				case *net.IPAddr:
-					return data.IP, true
-				}
-				panic(addr)
-			}(); ok {
-				ret = append(ret, ip)
-			}
-		}
+	if me.OnSearch != nil {
+		me.OnSearch(req, sender, len(types) != 0)
+	}
+	ip := me.responseAddr(sender)
+	if ip == nil {
+		me.Logger.Levelf(log.Debug, "no address on %s that %v can reach", me.Interface.Name, sender.IP)
 		return
-	}() {
-		for _, type_ := range types {
-			resp := me.makeResponse(ip, type_, req)
-			delay := time.Duration(rand.Int63n(int64(time.Second) * mx))
-			me.delayedSend(delay, resp, sender)
-		}
+	}
+	for _, type_ := range types {
+		resp := me.makeResponse(ip, type_, req)
+		delay := time.Duration(rand.Int63n(int64(time.Second) * mx))
+		me.delayedSend(delay, resp, sender)
 	}
 }
 
@@ -341,14 +648,15 @@ func (me *Server) makeResponse(ip net.IP, targ string, req *http.Request) (ret [
 		Header:     make(http.Header),
 		Request:    req,
 	}
-	for _, pair := range [...][2]string{
-		{"CACHE-CONTROL", fmt.Sprintf("max-age=%d", 5*me.NotifyInterval/2/time.Second)},
+	hdrs := [][2]string{
+		me.cacheControl(),
 		{"EXT", ""},
-		{"LOCATION", me.Location(ip)},
 		{"SERVER", me.Server},
 		{"ST", targ},
 		{"USN", me.usnFromTarget(targ)},
-	} {
+	}
+	hdrs = append(hdrs, me.locationHeaders(ip)...)
+	for _, pair := range append(hdrs, me.idHeaders()...) {
 		resp.Header.Set(pair[0], pair[1])
 	}
 	buf := &bytes.Buffer{}
@@ -0,0 +1,316 @@
+package ssdp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipNet.IP = ip
+	return ipNet
+}
+
+func TestChooseResponseAddr(t *testing.T) {
+	all := func(net.IP) bool { return true }
+	for _, tc := range []struct {
+		name     string
+		ipv6     bool
+		addrs    []string
+		filter   func(net.IP) bool
+		sender   string
+		from     string
+		expected string
+	}{
+		{
+			name:     "same network",
+			addrs:    []string{"10.0.0.2/8", "192.168.1.2/24", "fd00::2/64"},
+			sender:   "192.168.1.50",
+			expected: "192.168.1.2",
+		},
+		{
+			name:     "routed from another network",
+			addrs:    []string{"10.0.0.2/8", "192.168.1.2/24"},
+			sender:   "172.16.0.5",
+			from:     "10.0.0.2",
+			expected: "10.0.0.2",
+		},
+		{
+			name:     "route preferred to network",
+			addrs:    []string{"10.0.0.2/8", "192.168.1.2/24"},
+			sender:   "192.168.1.50",
+			from:     "10.0.0.2",
+			expected: "10.0.0.2",
+		},
+		{
+			name:     "route from another interface",
+			addrs:    []string{"192.168.1.2/24"},
+			sender:   "172.16.0.5",
+			from:     "10.0.0.2",
+			expected: "",
+		},
+		{
+			name:     "unreachable",
+			addrs:    []string{"192.168.1.2/24"},
+			sender:   "8.8.8.8",
+			expected: "",
+		},
+		{
+			name:     "filtered",
+			addrs:    []string{"192.168.1.2/24"},
+			filter:   func(ip net.IP) bool { return !ip.Equal(net.ParseIP("192.168.1.2")) },
+			sender:   "192.168.1.50",
+			expected: "",
+		},
+		{
+			name:     "other family",
+			addrs:    []string{"fd00::2/64"},
+			sender:   "192.168.1.50",
+			expected: "",
+		},
+		{
+			name:     "ipv6 same network",
+			ipv6:     true,
+			addrs:    []string{"192.168.1.2/24", "fe80::1/64", "2001:db8::2/64", "fd00::2/64"},
+			sender:   "2001:db8::50",
+			expected: "2001:db8::2",
+		},
+		{
+			name:     "ipv6 link-local sender prefers unique local",
+			ipv6:     true,
+			addrs:    []string{"fe80::1/64", "2001:db8::2/64", "fd00::2/64"},
+			sender:   "fe80::99",
+			from:     "fe80::1",
+			expected: "fd00::2",
+		},
+		{
+			name:     "ipv6 link-local sender given global",
+			ipv6:     true,
+			addrs:    []string{"fe80::1/64", "2001:db8::2/64"},
+			sender:   "fe80::99",
+			expected: "2001:db8::2",
+		},
+		{
+			name:     "ipv6 link-local sender with only link-local",
+			ipv6:     true,
+			addrs:    []string{"fe80::1/64"},
+			sender:   "fe80::99",
+			expected: "",
+		},
+		{
+			name:     "ipv6 unreachable",
+			ipv6:     true,
+			addrs:    []string{"fd00::2/64"},
+			sender:   "2001:db8::50",
+			expected: "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := &Server{IPv6: tc.ipv6, IPFilter: tc.filter}
+			if srv.IPFilter == nil {
+				srv.IPFilter = all
+			}
+			var addrs []net.Addr
+			for _, s := range tc.addrs {
+				addrs = append(addrs, mustParseCIDR(t, s))
+			}
+			// Addresses that aren't networks aren't answered from.
+			addrs = append(addrs, &net.IPAddr{IP: net.ParseIP(tc.sender)})
+			got := srv.chooseResponseAddr(addrs, net.ParseIP(tc.sender), net.ParseIP(tc.from))
+			if tc.expected == "" {
+				if got != nil {
+					t.Errorf("got %v, expected none", got)
+				}
+			} else if !got.Equal(net.ParseIP(tc.expected)) {
+				t.Errorf("got %v, expected %s", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestRoutedFrom(t *testing.T) {
+	from, err := routedFrom(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1900})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !from.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("got %v", from)
+	}
+}
+
+func newTestServer(ipv6 bool) *Server {
+	return &Server{
+		Server:   "test/1.0 UPnP/1.1 dms/1.0",
+		UUID:     "uuid:1234",
+		Devices:  []string{"urn:schemas-upnp-org:device:MediaServer:1"},
+		Services: []string{"urn:schemas-upnp-org:service:ContentDirectory:1"},
+		Location: func(ip net.IP) string {
+			return "http://" + net.JoinHostPort(ip.String(), "1338") + "/rootDesc.xml"
+		},
+		IPv6:     ipv6,
+		BootID:   7,
+		ConfigID: 3,
+		MaxAge:   90 * time.Second,
+	}
+}
+
+func checkHeaders(t *testing.T, h http.Header, expected map[string]string) {
+	t.Helper()
+	for k, v := range expected {
+		if vs, ok := h[http.CanonicalHeaderKey(k)]; !ok {
+			t.Errorf("%s missing", k)
+		} else if len(vs) != 1 || vs[0] != v {
+			t.Errorf("%s: got %q, expected %q", k, vs, v)
+		}
+	}
+}
+
+func TestMakeNotifyMessage(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		ipv6      bool
+		target    string
+		nts       string
+		extraHdrs [][2]string
+		expected  map[string]string
+	}{
+		{
+			name:   "root device alive",
+			target: rootDevice,
+			nts:    aliveNTS,
+			extraHdrs: [][2]string{
+				{"CACHE-CONTROL", "max-age=90"},
+				{"LOCATION", "http://192.168.1.2:1338/rootDesc.xml"},
+			},
+			expected: map[string]string{
+				"HOST":          AddrString,
+				"NT":            rootDevice,
+				"NTS":           aliveNTS,
+				"USN":           "uuid:1234::upnp:rootdevice",
+				"CACHE-CONTROL": "max-age=90",
+				"LOCATION":      "http://192.168.1.2:1338/rootDesc.xml",
+			},
+		},
+		{
+			name:   "uuid byebye",
+			target: "uuid:1234",
+			nts:    byebyeNTS,
+			expected: map[string]string{
+				"HOST": AddrString,
+				"NT":   "uuid:1234",
+				"NTS":  byebyeNTS,
+				"USN":  "uuid:1234",
+			},
+		},
+		{
+			name:      "ipv6 service update",
+			ipv6:      true,
+			target:    "urn:schemas-upnp-org:service:ContentDirectory:1",
+			nts:       updateNTS,
+			extraHdrs: [][2]string{{"NEXTBOOTID.UPNP.ORG", "8"}},
+			expected: map[string]string{
+				"HOST":                AddrString6,
+				"NT":                  "urn:schemas-upnp-org:service:ContentDirectory:1",
+				"NTS":                 updateNTS,
+				"USN":                 "uuid:1234::urn:schemas-upnp-org:service:ContentDirectory:1",
+				"NEXTBOOTID.UPNP.ORG": "8",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newTestServer(tc.ipv6)
+			buf := srv.makeNotifyMessage(tc.target, tc.nts, tc.extraHdrs)
+			req, err := ReadRequest(bufio.NewReader(bytes.NewReader(buf)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Method != "NOTIFY" {
+				t.Errorf("method %q", req.Method)
+			}
+			tc.expected["SERVER"] = srv.Server
+			tc.expected["BOOTID.UPNP.ORG"] = "7"
+			tc.expected["CONFIGID.UPNP.ORG"] = "3"
+			checkHeaders(t, req.Header, tc.expected)
+			if len(req.Header) != len(tc.expected) {
+				t.Errorf("got headers %v", req.Header)
+			}
+		})
+	}
+}
+
+func TestMakeResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ip       string
+		target   string
+		secure   bool
+		expected map[string]string
+	}{
+		{
+			name:   "root device",
+			ip:     "192.168.1.2",
+			target: rootDevice,
+			expected: map[string]string{
+				"ST":       rootDevice,
+				"USN":      "uuid:1234::upnp:rootdevice",
+				"LOCATION": "http://192.168.1.2:1338/rootDesc.xml",
+			},
+		},
+		{
+			name:   "uuid",
+			ip:     "10.0.0.2",
+			target: "uuid:1234",
+			expected: map[string]string{
+				"ST":       "uuid:1234",
+				"USN":      "uuid:1234",
+				"LOCATION": "http://10.0.0.2:1338/rootDesc.xml",
+			},
+		},
+		{
+			name:   "ipv6 device with secure location",
+			ip:     "fd00::2",
+			target: "urn:schemas-upnp-org:device:MediaServer:1",
+			secure: true,
+			expected: map[string]string{
+				"ST":                      "urn:schemas-upnp-org:device:MediaServer:1",
+				"USN":                     "uuid:1234::urn:schemas-upnp-org:device:MediaServer:1",
+				"LOCATION":                "http://[fd00::2]:1338/rootDesc.xml",
+				"SECURELOCATION.UPNP.ORG": "https://[fd00::2]:1339/rootDesc.xml",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newTestServer(false)
+			if tc.secure {
+				srv.SecureLocation = func(ip net.IP) string {
+					return "https://" + net.JoinHostPort(ip.String(), "1339") + "/rootDesc.xml"
+				}
+			}
+			req := &http.Request{Method: "M-SEARCH", Header: http.Header{}}
+			buf := srv.makeResponse(net.ParseIP(tc.ip), tc.target, req)
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status %d", resp.StatusCode)
+			}
+			tc.expected["CACHE-CONTROL"] = "max-age=90"
+			tc.expected["EXT"] = ""
+			tc.expected["SERVER"] = srv.Server
+			tc.expected["BOOTID.UPNP.ORG"] = "7"
+			tc.expected["CONFIGID.UPNP.ORG"] = "3"
+			checkHeaders(t, resp.Header, tc.expected)
+			if _, ok := resp.Header["Securelocation.upnp.org"]; ok != tc.secure {
+				t.Errorf("SECURELOCATION.UPNP.ORG present: %v", ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package transcode
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Hardware to encode video on rather than the CPU, for boxes such as NUCs and ARM boards that
+// can't transcode several HD streams in software.
+type HWAccel struct {
+	// "vaapi", "nvenc" or "qsv", for QuickSync. Empty encodes on the CPU.
+	API string
+	// For VAAPI and QuickSync, the DRM render node, which defaults to /dev/dri/renderD128. For
+	// NVENC, the index of the GPU.
+	Device string
+	// The ffmpeg encoder, such as hevc_vaapi, if not the H.264 one of the API.
+	Encoder string
+}
+
+const defaultRenderNode = "/dev/dri/renderD128"
+
+var hwH264Encoders = map[string]string{
+	"vaapi": "h264_vaapi",
+	"nvenc": "h264_nvenc",
+	"qsv":   "h264_qsv",
+}
+
+// Checks the API is known, and the device is of the kind it takes.
+func (hw HWAccel) Check() error {
+	if hw.API == "" {
+		return nil
+	}
+	if _, ok := hwH264Encoders[hw.API]; !ok {
+		return fmt.Errorf("unknown hardware acceleration API %q, want vaapi, nvenc or qsv", hw.API)
+	}
+	if hw.API == "nvenc" && hw.Device != "" {
+		if _, err := strconv.Atoi(hw.Device); err != nil {
+			return fmt.Errorf("NVENC device %q isn't the index of a GPU", hw.Device)
+		}
+	}
+	return nil
+}
+
+func (hw HWAccel) device() string {
+	if hw.Device == "" && hw.API != "nvenc" {
+		return defaultRenderNode
+	}
+	return hw.Device
+}
+
+func (hw HWAccel) encoder() string {
+	if hw.Encoder != "" {
+		return hw.Encoder
+	}
+	return hwH264Encoders[hw.API]
+}
+
+// Returns the ffmpeg arguments that set up the hardware, which go before the input, and those that
+// encode the video with it as H.264 at quality, from 0 to 51 with lower being better. Frames are
+// decoded on the CPU and uploaded, which works for any input.
+func (hw HWAccel) h264Args(quality int) (input, output []string) {
+	q := strconv.Itoa(quality)
+	switch hw.API {
+	case "vaapi":
+		input = []string{"-init_hw_device", "vaapi=hw:" + hw.device(), "-filter_hw_device", "hw"}
+		output = []string{"-vf", "format=nv12,hwupload", "-c:v", hw.encoder(), "-qp", q}
+	case "qsv":
+		input = []string{"-init_hw_device", "qsv=hw:hw_any,child_device=" + hw.device(), "-filter_hw_device", "hw"}
+		output = []string{"-vf", "format=nv12,hwupload=extra_hw_frames=64", "-c:v", hw.encoder(), "-preset", "veryfast", "-global_quality", q}
+	case "nvenc":
+		output = []string{"-pix_fmt", "yuv420p", "-c:v", hw.encoder(), "-preset", "p1", "-cq", q}
+		if hw.Device != "" {
+			output = append(output, "-gpu", hw.Device)
+		}
+	}
+	return
+}
@@ -5,9 +5,11 @@ package transcode
 import (
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"runtime"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/anacrolix/ffprobe"
@@ -16,29 +18,118 @@ import (
 	. "github.com/anacrolix/dms/misc"
 )
 
-// Invokes an external command and returns a reader from its stdout. The
-// command is waited on asynchronously.
+// Invokes an external command and returns a reader from its stdout. The command is waited on
+// asynchronously, and the reader returns its error, if it fails, once its output is read.
 func transcodePipe(args []string, stderr io.Writer) (r io.ReadCloser, err error) {
 	log.Println("transcode command:", args)
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stderr = stderr
-	r, err = cmd.StdoutPipe()
+	// Not StdoutPipe, which Wait closes when the command exits, possibly before what it wrote is
+	// read.
+	pr, pw, err := os.Pipe()
 	if err != nil {
 		return
 	}
+	cmd.Stdout = pw
 	err = cmd.Start()
+	pw.Close()
 	if err != nil {
+		pr.Close()
 		return
 	}
+	cr := &cmdReader{f: pr, done: make(chan struct{})}
+	running.add(cmd, cr.done)
 	go func() {
-		err := cmd.Wait()
-		if err != nil {
-			log.Printf("command %s failed: %s", args, err)
+		cr.err = cmd.Wait()
+		running.remove(cmd)
+		if cr.err != nil {
+			log.Printf("command %s failed: %s", args, cr.err)
 		}
+		close(cr.done)
 	}()
+	return cr, nil
+}
+
+// The transcoders running, and when they exit.
+type runningCommands struct {
+	mu   sync.Mutex
+	cmds map[*exec.Cmd]chan struct{}
+}
+
+var running runningCommands
+
+func (me *runningCommands) add(cmd *exec.Cmd, done chan struct{}) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.cmds == nil {
+		me.cmds = make(map[*exec.Cmd]chan struct{})
+	}
+	me.cmds[cmd] = done
+}
+
+func (me *runningCommands) remove(cmd *exec.Cmd) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	delete(me.cmds, cmd)
+}
+
+// Stops the transcoders that are still running, such as when shutting down. They're interrupted,
+// so they can finish cleanly, and those that haven't exited after timeout are killed.
+func StopAll(timeout time.Duration) {
+	running.mu.Lock()
+	cmds := make(map[*exec.Cmd]chan struct{}, len(running.cmds))
+	for cmd, done := range running.cmds {
+		cmds[cmd] = done
+	}
+	running.mu.Unlock()
+	for cmd := range cmds {
+		// Windows can't interrupt other processes.
+		if cmd.Process.Signal(os.Interrupt) != nil {
+			cmd.Process.Kill()
+		}
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	expired := false
+	for cmd, done := range cmds {
+		if !expired {
+			select {
+			case <-done:
+				continue
+			case <-t.C:
+				expired = true
+			}
+		}
+		select {
+		case <-done:
+		default:
+			cmd.Process.Kill()
+		}
+	}
+}
+
+// Reads the output of a command, returning its error at the end of it.
+type cmdReader struct {
+	f    *os.File
+	done chan struct{}
+	err  error
+}
+
+func (me *cmdReader) Read(b []byte) (n int, err error) {
+	n, err = me.f.Read(b)
+	if err == io.EOF {
+		<-me.done
+		if me.err != nil {
+			err = me.err
+		}
+	}
 	return
 }
 
+func (me *cmdReader) Close() error {
+	return me.f.Close()
+}
+
 // Return a series of ffmpeg arguments that pick specific codecs for specific
 // streams. This requires use of the -map flag.
 func streamArgs(s map[string]interface{}) (ret []string) {
@@ -98,6 +189,28 @@ func Transcode(path string, start, length time.Duration, stderr io.Writer) (r io
 	return transcodePipe(args, stderr)
 }
 
+// Streams the first video and audio streams of the input as MPEG-TS without re-encoding them, such
+// as the main title of a DVD, whose MPEG-2 renderers take as it is. The input may be any that
+// ffmpeg takes, such as a concat: of the title's VOBs.
+func Remux(input string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
+	args := []string{
+		"ffmpeg",
+		"-ss", FormatDurationSexagesimal(start),
+	}
+	if length > 0 {
+		args = append(args, "-t", FormatDurationSexagesimal(length))
+	}
+	args = append(args, []string{
+		"-i", input,
+		"-map", "0:v:0",
+		"-map", "0:a:0?",
+		"-c", "copy",
+		"-f", "mpegts",
+		"pipe:",
+	}...)
+	return transcodePipe(args, stderr)
+}
+
 // Returns a stream of Chromecast supported VP8.
 func VP8Transcode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
 	args := []string{
@@ -123,13 +236,26 @@ func VP8Transcode(path string, start, length time.Duration, stderr io.Writer) (r
 
 // Returns a stream of Chromecast supported matroska.
 func ChromecastTranscode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
-	args := []string{
-		"ffmpeg",
+	return HWAccel{}.ChromecastTranscode(path, start, length, stderr)
+}
+
+// ChromecastTranscode, encoding the video on the hardware.
+func (hw HWAccel) ChromecastTranscode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
+	input, video := hw.h264Args(23)
+	if hw.API == "" {
+		video = []string{"-c:v", "libx264", "-preset", "ultrafast", "-profile:v", "high", "-level", "5.0"}
+	} else if hw.Encoder == "" {
+		video = append(video, "-profile:v", "high")
+	}
+	args := append([]string{"ffmpeg"}, input...)
+	args = append(args, []string{
 		"-ss", FormatDurationSexagesimal(start),
 		"-i", path,
-		"-c:v", "libx264", "-preset", "ultrafast", "-profile:v", "high", "-level", "5.0",
+	}...)
+	args = append(args, video...)
+	args = append(args, []string{
 		"-movflags", "+faststart+frag_keyframe+empty_moov",
-	}
+	}...)
 	if length > 0 {
 		args = append(args, []string{
 			"-t", FormatDurationSexagesimal(length),
@@ -144,16 +270,25 @@ func ChromecastTranscode(path string, start, length time.Duration, stderr io.Wri
 
 // Returns a stream of h264 video and mp3 audio
 func WebTranscode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
-	args := []string{
-		"ffmpeg",
+	return HWAccel{}.WebTranscode(path, start, length, stderr)
+}
+
+// WebTranscode, encoding the video on the hardware.
+func (hw HWAccel) WebTranscode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
+	input, video := hw.h264Args(25)
+	if hw.API == "" {
+		video = []string{"-pix_fmt", "yuv420p", "-c:v", "libx264", "-crf", "25", "-preset", "ultrafast"}
+	}
+	args := append([]string{"ffmpeg"}, input...)
+	args = append(args, []string{
 		"-ss", FormatDurationSexagesimal(start),
 		"-i", path,
-		"-pix_fmt", "yuv420p",
-		"-c:v", "libx264", "-crf", "25",
+	}...)
+	args = append(args, video...)
+	args = append(args, []string{
 		"-c:a", "mp3", "-ab", "128k", "-ar", "44100",
-		"-preset", "ultrafast",
 		"-movflags", "+faststart+frag_keyframe+empty_moov",
-	}
+	}...)
 	if length > 0 {
 		args = append(args, []string{
 			"-t", FormatDurationSexagesimal(length),
@@ -166,6 +301,70 @@ func WebTranscode(path string, start, length time.Duration, stderr io.Writer) (r
 	return transcodePipe(args, stderr)
 }
 
+// Streams a span of an audio file as MP3 at playback speed, so that the time spent streaming
+// follows the listener's progress.
+func AudiobookTranscode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
+	args := []string{
+		"ffmpeg",
+		"-re",
+		"-ss", FormatDurationSexagesimal(start),
+		"-i", path,
+	}
+	if length > 0 {
+		args = append(args, []string{
+			"-t", FormatDurationSexagesimal(length),
+		}...)
+	}
+	args = append(args, []string{
+		"-vn",
+		"-c:a", "libmp3lame", "-b:a", "96k",
+		"-f", "mp3",
+		"pipe:",
+	}...)
+	return transcodePipe(args, stderr)
+}
+
+// ffmpeg arguments for the audio formats that AudioTranscode produces.
+var audioFormatArgs = map[string][]string{
+	// 16 bits, since renderers that need FLAC transcoded to them often don't take 24.
+	"flac": {"-c:a", "flac", "-sample_fmt", "s16", "-f", "flac"},
+	"wav":  {"-c:a", "pcm_s16le", "-f", "wav"},
+	// Raw big-endian samples, as audio/L16 is.
+	"lpcm": {"-c:a", "pcm_s16be", "-f", "s16be"},
+	"mp3":  {"-c:a", "libmp3lame", "-b:a", "320k", "-f", "mp3"},
+	// MP4 can only be written to a pipe fragmented, here into a second of audio at a time.
+	"alac": {"-c:a", "alac", "-movflags", "+empty_moov", "-frag_duration", "1000000", "-f", "mp4"},
+	"aac":  {"-c:a", "aac", "-b:a", "256k", "-movflags", "+empty_moov", "-frag_duration", "1000000", "-f", "mp4"},
+}
+
+// Streams the audio of a file in format, one of flac, wav, lpcm, alac, mp3 and aac, resampled to
+// sampleRate and mixed to channels, for renderers such as speakers that only take some formats and
+// rates.
+func AudioTranscode(path string, start, length time.Duration, format string, sampleRate, channels int, stderr io.Writer) (r io.ReadCloser, err error) {
+	formatArgs, ok := audioFormatArgs[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown audio format %q", format)
+	}
+	args := []string{
+		"ffmpeg",
+		"-ss", FormatDurationSexagesimal(start),
+		"-i", path,
+	}
+	if length > 0 {
+		args = append(args, []string{
+			"-t", FormatDurationSexagesimal(length),
+		}...)
+	}
+	args = append(args, []string{
+		"-vn",
+		"-ar", strconv.Itoa(sampleRate),
+		"-ac", strconv.Itoa(channels),
+	}...)
+	args = append(args, formatArgs...)
+	args = append(args, "pipe:")
+	return transcodePipe(args, stderr)
+}
+
 // credit laurent @ https://stackoverflow.com/questions/34118732/parse-a-command-line-string-into-flags-and-arguments-in-golang
 func parseCommandLine(command string) ([]string, error) {
 	var args []string
@@ -76,10 +76,74 @@ func (me *Eventing) Subscribe(callback []*url.URL, timeoutSeconds int) (sid stri
 	return
 }
 
+// Returns the number of subscriptions that haven't expired.
+func (me *Eventing) NumSubscribers() (n int) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	now := time.Now()
+	for _, s := range me.subscribers {
+		if s.expiry.After(now) {
+			n++
+		}
+	}
+	return
+}
+
+// Extends the subscription, returning how long it now lasts.
+func (me *Eventing) Renew(sid string, timeoutSeconds int) (actualTimeout int, err error) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	ssr, ok := me.subscribers[sid]
+	if !ok || !ssr.expiry.After(time.Now()) {
+		err = fmt.Errorf("no such subscription: %s", sid)
+		return
+	}
+	ssr.expiry = time.Now().Add(time.Duration(timeoutSeconds) * time.Second)
+	actualTimeout = int(ssr.expiry.Sub(time.Now()) / time.Second)
+	return
+}
+
 func (me *Eventing) Unsubscribe(sid string) error {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if _, ok := me.subscribers[sid]; !ok {
+		return fmt.Errorf("no such subscription: %s", sid)
+	}
+	delete(me.subscribers, sid)
 	return nil
 }
 
+// An event to send to a subscriber, with its sequence number.
+type Notification struct {
+	SID  string
+	URLs []*url.URL
+	Seq  uint32
+}
+
+// Returns the next event to send to each subscriber, or only the one with sid if it's given, such
+// as for its initial event. Subscribers aren't sent others until they've been sent that, so it's
+// always first. Expired subscriptions are dropped.
+func (me *Eventing) Notifications(sid string) (ret []Notification) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	now := time.Now()
+	for _, ssr := range me.subscribers {
+		if !ssr.expiry.After(now) {
+			delete(me.subscribers, ssr.sid)
+			continue
+		}
+		if sid != "" && ssr.sid != sid || sid == "" && ssr.nextSeq == 0 {
+			continue
+		}
+		ret = append(ret, Notification{ssr.sid, ssr.urls, ssr.nextSeq})
+		ssr.nextSeq++
+		if ssr.nextSeq == 0 {
+			ssr.nextSeq = 1
+		}
+	}
+	return
+}
+
 var callbackURLRegexp = regexp.MustCompile("<(.*?)>")
 
 // Parse the CALLBACK HTTP header in an event subscription request. See UPnP
@@ -59,3 +59,26 @@ func TestSubscribeRace(t *testing.T) {
 	<-done
 	<-done
 }
+
+func TestNotificationSequence(t *testing.T) {
+	e := &Eventing{}
+	sid, _, _ := e.Subscribe(nil, 10)
+	other, _, _ := e.Subscribe(nil, 10)
+	if ns := e.Notifications(sid); len(ns) != 1 || ns[0].SID != sid || ns[0].Seq != 0 {
+		t.Fatalf("initial event %v", ns)
+	}
+	// The other hasn't been sent its initial event yet.
+	if ns := e.Notifications(""); len(ns) != 1 || ns[0].SID != sid || ns[0].Seq != 1 {
+		t.Fatalf("got %v", ns)
+	}
+	e.Notifications(other)
+	if err := e.Unsubscribe(sid); err != nil {
+		t.Fatal(err)
+	}
+	if ns := e.Notifications(""); len(ns) != 1 || ns[0].SID != other {
+		t.Fatalf("after unsubscribing got %v", ns)
+	}
+	if _, err := e.Renew(sid, 10); err == nil {
+		t.Fatal("renewed a subscription that was ended")
+	}
+}
@@ -82,22 +82,29 @@ type Service struct {
 	EventSubURL string `xml:"eventSubURL"`
 }
 
+// The fields are in the order UPnP requires of the elements.
 type Device struct {
-	DeviceType      string `xml:"deviceType"`
-	FriendlyName    string `xml:"friendlyName"`
-	Manufacturer    string `xml:"manufacturer"`
-	ModelName       string `xml:"modelName"`
-	UDN             string
-	VendorXML       string    `xml:",innerxml"`
-	IconList        []Icon    `xml:"iconList>icon"`
-	ServiceList     []Service `xml:"serviceList>service"`
-	PresentationURL string    `xml:"presentationURL,omitempty"`
+	DeviceType       string `xml:"deviceType"`
+	FriendlyName     string `xml:"friendlyName"`
+	Manufacturer     string `xml:"manufacturer"`
+	ManufacturerURL  string `xml:"manufacturerURL,omitempty"`
+	ModelDescription string `xml:"modelDescription,omitempty"`
+	ModelName        string `xml:"modelName"`
+	ModelNumber      string `xml:"modelNumber,omitempty"`
+	ModelURL         string `xml:"modelURL,omitempty"`
+	SerialNumber     string `xml:"serialNumber,omitempty"`
+	UDN              string
+	VendorXML        string    `xml:",innerxml"`
+	IconList         []Icon    `xml:"iconList>icon"`
+	ServiceList      []Service `xml:"serviceList>service"`
+	PresentationURL  string    `xml:"presentationURL,omitempty"`
 }
 
 type DeviceDesc struct {
 	XMLName     xml.Name    `xml:"urn:schemas-upnp-org:device-1-0 root"`
 	NSDLNA      string      `xml:"xmlns:dlna,attr"`
 	NSSEC       string      `xml:"xmlns:sec,attr"`
+	ConfigID    int32       `xml:"configId,attr,omitempty"`
 	SpecVersion SpecVersion `xml:"specVersion"`
 	Device      Device      `xml:"device"`
 }
@@ -114,12 +121,14 @@ func (e *Error) Error() string {
 
 const (
 	InvalidActionErrorCode        = 401
+	InvalidArgsErrorCode          = 402
 	ActionFailedErrorCode         = 501
 	ArgumentValueInvalidErrorCode = 600
 )
 
 var (
 	InvalidActionError        = Errorf(401, "Invalid Action")
+	InvalidArgsError          = Errorf(402, "Invalid Args")
 	ArgumentValueInvalidError = Errorf(600, "The argument value is invalid")
 )
 
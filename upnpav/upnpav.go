@@ -8,6 +8,14 @@ import (
 const (
 	// NoSuchObjectErrorCode : The specified ObjectID is invalid.
 	NoSuchObjectErrorCode = 701
+	// InvalidSearchCriteriaErrorCode : The search criteria specified is not supported or is invalid.
+	InvalidSearchCriteriaErrorCode = 708
+	// UnsupportedSortCriteriaErrorCode : The sort criteria specified is not supported or is
+	// invalid.
+	UnsupportedSortCriteriaErrorCode = 709
+	// NoSuchContainerErrorCode : The specified ContainerID is invalid or identifies an object that
+	// is not a container.
+	NoSuchContainerErrorCode = 710
 )
 
 // Resource description
@@ -19,6 +27,9 @@ type Resource struct {
 	Bitrate      uint     `xml:"bitrate,attr,omitempty"`
 	Duration     string   `xml:"duration,attr,omitempty"`
 	Resolution   string   `xml:"resolution,attr,omitempty"`
+	// Of the audio, in Hz.
+	SampleFrequency int `xml:"sampleFrequency,attr,omitempty"`
+	NrAudioChannels int `xml:"nrAudioChannels,attr,omitempty"`
 }
 
 // Container description
@@ -26,12 +37,28 @@ type Container struct {
 	Object
 	XMLName    xml.Name `xml:"container"`
 	ChildCount int      `xml:"childCount,attr"`
+	// Leaves childCount out, such as when the Filter of a Browse doesn't ask for it.
+	OmitChildCount bool `xml:"-"`
+}
+
+// MarshalXML leaves childCount out if OmitChildCount is set.
+func (c Container) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	// Marshalers are given their type's name, rather than that of XMLName.
+	start.Name = xml.Name{Local: "container"}
+	if c.OmitChildCount {
+		return e.EncodeElement(struct{ Object }{c.Object}, start)
+	}
+	// Without the method, so that it's encoded as it would be otherwise.
+	type container Container
+	return e.EncodeElement(container(c), start)
 }
 
 // Item description
 type Item struct {
 	Object
-	XMLName  xml.Name `xml:"item"`
+	XMLName xml.Name `xml:"item"`
+	// Samsung's metadata, such as the bookmark to resume at, in seconds, as BM=.
+	DCMInfo  string `xml:"sec:dcmInfo,omitempty"`
 	Res      []Resource
 	InnerXML string `xml:",innerxml"`
 }
@@ -40,6 +67,7 @@ type Item struct {
 type Object struct {
 	ID          string    `xml:"id,attr"`
 	ParentID    string    `xml:"parentID,attr"`
+	RefID       string    `xml:"refID,attr,omitempty"`
 	Restricted  int       `xml:"restricted,attr"` // indicates whether the object is modifiable
 	Title       string    `xml:"dc:title"`
 	Class       string    `xml:"upnp:class"`
@@ -48,9 +76,14 @@ type Object struct {
 	Artist      string    `xml:"upnp:artist,omitempty"`
 	Album       string    `xml:"upnp:album,omitempty"`
 	Genre       string    `xml:"upnp:genre,omitempty"`
+	Description string    `xml:"dc:description,omitempty"`
 	AlbumArtURI string    `xml:"upnp:albumArtURI,omitempty"`
-	Searchable  int       `xml:"searchable,attr"`
-	SearchXML   string    `xml:",innerxml"`
+	// The show an episode is of, and its numbers in it.
+	SeriesTitle   string `xml:"upnp:seriesTitle,omitempty"`
+	EpisodeSeason int    `xml:"upnp:episodeSeason,omitempty"`
+	EpisodeNumber int    `xml:"upnp:episodeNumber,omitempty"`
+	Searchable    int    `xml:"searchable,attr"`
+	SearchXML     string `xml:",innerxml"`
 }
 
 // Timestamp wraps time.Time for formatting purposes
@@ -58,7 +91,11 @@ type Timestamp struct {
 	time.Time
 }
 
-// MarshalXML formats the Timestamp per DIDL-Lite spec
+// MarshalXML formats the Timestamp per DIDL-Lite spec. Zero timestamps, of objects with no date or
+// whose date wasn't asked for, are left out.
 func (t Timestamp) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if t.IsZero() {
+		return nil
+	}
 	return e.EncodeElement(t.Format("2006-01-02"), start)
 }